@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jcalabro/atlas/internal/pds"
+	"github.com/jcalabro/atlas/internal/pds/db"
+	"github.com/urfave/cli/v3"
+)
+
+func adminCmd() *cli.Command {
+	return &cli.Command{
+		Name:        "admin",
+		Usage:       "Administer accounts, repos, and hosts without a running server",
+		Description: "Talks directly to FoundationDB. Output is written to stdout as JSON lines (or a CAR file for repo export), and logs are written to stderr.",
+		Flags: append(fdbFlags,
+			&cli.StringFlag{
+				Name:    "config",
+				Usage:   "Path to TOML config file containing PDS host configurations",
+				Value:   defaultConfigFile,
+				Sources: cli.EnvVars("ATLAS_CONFIG"),
+			},
+			&cli.StringFlag{
+				Name:    "plc",
+				Usage:   "URL of the PLC server to use",
+				Value:   "https://plc.directory",
+				Sources: cli.EnvVars("ATLAS_PLC"),
+			},
+		),
+		Before: func(ctx context.Context, c *cli.Command) (context.Context, error) {
+			// stdout is reserved for command output, like exported repos
+			if err := setDefaultLogger(
+				os.Stderr,
+				c.String("log-lvl"),
+				c.String("log-fmt"),
+				c.Bool("log-src"),
+			); err != nil {
+				return nil, fmt.Errorf("unable to set default logger: %w", err)
+			}
+			return ctx, nil
+		},
+		Commands: []*cli.Command{
+			adminAccountCmd(),
+			adminHostCmd(),
+			adminRepoCmd(),
+			adminEventsCmd(),
+			adminKeysCmd(),
+		},
+	}
+}
+
+func newAdmin(ctx context.Context, c *cli.Command) (*pds.Admin, error) {
+	return pds.NewAdmin(ctx, os.Stdout, &pds.AdminArgs{
+		ConfigFile: c.String("config"),
+		PLCURL:     c.String("plc"),
+		FDB: db.Config{
+			ClusterFile: c.String("fdb-cluster-file"),
+			APIVersion:  c.Int("fdb-api-version"),
+		},
+	})
+}
+
+// accountArg returns the command's single DID or handle argument
+func accountArg(c *cli.Command) (string, error) {
+	if c.NArg() != 1 {
+		return "", fmt.Errorf("expected exactly one account DID or handle")
+	}
+	return c.Args().First(), nil
+}
+
+// withAccount runs fn with the admin client and the account named by the command's argument
+func withAccount(fn func(ctx context.Context, c *cli.Command, admin *pds.Admin, account string) error) cli.ActionFunc {
+	return func(ctx context.Context, c *cli.Command) error {
+		account, err := accountArg(c)
+		if err != nil {
+			return err
+		}
+
+		admin, err := newAdmin(ctx, c)
+		if err != nil {
+			return err
+		}
+
+		return fn(ctx, c, admin, account)
+	}
+}
+
+func adminAccountCmd() *cli.Command {
+	return &cli.Command{
+		Name:  "account",
+		Usage: "Manage accounts",
+		Commands: []*cli.Command{
+			{
+				Name:  "create",
+				Usage: "Create an account, bypassing invite codes and signup verification",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "host",
+						Usage:    "PDS hostname to create the account on",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "handle",
+						Usage:    "Handle of the new account",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "email",
+						Usage:    "Email address of the new account",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "password",
+						Usage: "Password of the new account (a random password is generated and printed if empty)",
+					},
+				},
+				Action: func(ctx context.Context, c *cli.Command) error {
+					admin, err := newAdmin(ctx, c)
+					if err != nil {
+						return err
+					}
+					return admin.CreateAccount(ctx, c.String("host"), c.String("handle"), c.String("email"), c.String("password"))
+				},
+			},
+			{
+				Name:      "get",
+				Usage:     "Show an account",
+				ArgsUsage: "<did or handle>",
+				Action: withAccount(func(ctx context.Context, c *cli.Command, admin *pds.Admin, account string) error {
+					return admin.GetAccount(ctx, account)
+				}),
+			},
+			{
+				Name:  "list",
+				Usage: "List the accounts on a host",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "host",
+						Usage:    "PDS hostname whose accounts should be listed",
+						Required: true,
+					},
+				},
+				Action: func(ctx context.Context, c *cli.Command) error {
+					admin, err := newAdmin(ctx, c)
+					if err != nil {
+						return err
+					}
+					return admin.ListAccounts(ctx, c.String("host"))
+				},
+			},
+			{
+				Name:      "disable",
+				Usage:     "Take an account down",
+				ArgsUsage: "<did or handle>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "ref",
+						Usage: "Reference recorded with the takedown, like a ticket number",
+					},
+				},
+				Action: withAccount(func(ctx context.Context, c *cli.Command, admin *pds.Admin, account string) error {
+					return admin.DisableAccount(ctx, account, c.String("ref"))
+				}),
+			},
+			{
+				Name:      "enable",
+				Usage:     "Reverse the takedown of an account",
+				ArgsUsage: "<did or handle>",
+				Action: withAccount(func(ctx context.Context, c *cli.Command, admin *pds.Admin, account string) error {
+					return admin.EnableAccount(ctx, account)
+				}),
+			},
+			{
+				Name:      "delete",
+				Usage:     "Permanently delete an account and its repo and blobs",
+				ArgsUsage: "<did or handle>",
+				Action: withAccount(func(ctx context.Context, c *cli.Command, admin *pds.Admin, account string) error {
+					return admin.DeleteAccount(ctx, account)
+				}),
+			},
+			{
+				Name:      "reset-password",
+				Usage:     "Set an account's password and sign out all of its sessions",
+				ArgsUsage: "<did or handle>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "password",
+						Usage: "New password (a random password is generated and printed if empty)",
+					},
+				},
+				Action: withAccount(func(ctx context.Context, c *cli.Command, admin *pds.Admin, account string) error {
+					return admin.ResetPassword(ctx, account, c.String("password"))
+				}),
+			},
+		},
+	}
+}
+
+func adminHostCmd() *cli.Command {
+	return &cli.Command{
+		Name:  "host",
+		Usage: "Inspect hosts and manage the host registry",
+		Commands: []*cli.Command{
+			{
+				Name:  "list",
+				Usage: "List the hosts from the config file and the host registry",
+				Action: func(ctx context.Context, c *cli.Command) error {
+					admin, err := newAdmin(ctx, c)
+					if err != nil {
+						return err
+					}
+					return admin.ListHosts(ctx)
+				},
+			},
+			{
+				Name:      "create",
+				Usage:     "Add a host to the host registry",
+				ArgsUsage: "<hostname>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "file",
+						Usage:    "Path to a TOML file with the host's settings, in the same format as a [hosts] table of the config file",
+						Required: true,
+					},
+				},
+				Action: withHostname(func(ctx context.Context, c *cli.Command, admin *pds.Admin, hostname string) error {
+					return admin.CreateHost(ctx, hostname, c.String("file"))
+				}),
+			},
+			{
+				Name:      "update",
+				Usage:     "Replace a registered host's settings. Keys the file doesn't name are kept.",
+				ArgsUsage: "<hostname>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "file",
+						Usage:    "Path to a TOML file with the host's settings, in the same format as a [hosts] table of the config file",
+						Required: true,
+					},
+				},
+				Action: withHostname(func(ctx context.Context, c *cli.Command, admin *pds.Admin, hostname string) error {
+					return admin.UpdateHost(ctx, hostname, c.String("file"))
+				}),
+			},
+			{
+				Name:      "disable",
+				Usage:     "Stop serving a registered host, keeping its accounts",
+				ArgsUsage: "<hostname>",
+				Action: withHostname(func(ctx context.Context, c *cli.Command, admin *pds.Admin, hostname string) error {
+					return admin.DisableHost(ctx, hostname)
+				}),
+			},
+			{
+				Name:      "enable",
+				Usage:     "Resume serving a disabled registered host",
+				ArgsUsage: "<hostname>",
+				Action: withHostname(func(ctx context.Context, c *cli.Command, admin *pds.Admin, hostname string) error {
+					return admin.EnableHost(ctx, hostname)
+				}),
+			},
+		},
+	}
+}
+
+// withHostname runs fn with the admin client and the hostname named by the command's argument
+func withHostname(fn func(ctx context.Context, c *cli.Command, admin *pds.Admin, hostname string) error) cli.ActionFunc {
+	return func(ctx context.Context, c *cli.Command) error {
+		if c.NArg() != 1 {
+			return fmt.Errorf("expected exactly one hostname")
+		}
+
+		admin, err := newAdmin(ctx, c)
+		if err != nil {
+			return err
+		}
+
+		return fn(ctx, c, admin, c.Args().First())
+	}
+}
+
+func adminRepoCmd() *cli.Command {
+	return &cli.Command{
+		Name:  "repo",
+		Usage: "Export and import repos as CAR files",
+		Commands: []*cli.Command{
+			{
+				Name:      "export",
+				Usage:     "Write an account's repo to stdout as a CAR file",
+				ArgsUsage: "<did or handle> > out.car",
+				Action: withAccount(func(ctx context.Context, c *cli.Command, admin *pds.Admin, account string) error {
+					return admin.ExportRepo(ctx, account, os.Stdout)
+				}),
+			},
+			{
+				Name:        "import",
+				Usage:       "Replace the records in an account's repo with those in a CAR file read from stdin",
+				Description: "Records that differ from the CAR are written and records missing from it are deleted, in new commits signed by the account's current key. The CAR must be a repo of the same DID.",
+				ArgsUsage:   "<did or handle> < in.car",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "file",
+						Usage: "Read the CAR from this file rather than stdin",
+					},
+				},
+				Action: withAccount(func(ctx context.Context, c *cli.Command, admin *pds.Admin, account string) error {
+					var r io.Reader = os.Stdin
+					if path := c.String("file"); path != "" {
+						f, err := os.Open(path)
+						if err != nil {
+							return err
+						}
+						defer f.Close() //nolint:errcheck
+						r = f
+					}
+					return admin.ImportRepo(ctx, account, r)
+				}),
+			},
+		},
+	}
+}
+
+func adminEventsCmd() *cli.Command {
+	return &cli.Command{
+		Name:  "events",
+		Usage: "Inspect the event stream",
+		Commands: []*cli.Command{
+			{
+				Name:  "tail",
+				Usage: "Print firehose events as they're written",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "host",
+						Usage: "Only print the events of this PDS hostname",
+					},
+					&cli.Int64Flag{
+						Name:  "cursor",
+						Usage: "Replay events after this sequence number rather than starting with new events",
+					},
+					&cli.BoolFlag{
+						Name:  "follow",
+						Usage: "Wait for new events rather than exiting at the end of the stream",
+						Value: true,
+					},
+				},
+				Action: func(ctx context.Context, c *cli.Command) error {
+					admin, err := newAdmin(ctx, c)
+					if err != nil {
+						return err
+					}
+
+					args := &pds.TailEventsArgs{
+						Host:   c.String("host"),
+						Follow: c.Bool("follow"),
+					}
+					if c.IsSet("cursor") {
+						cursor := c.Int64("cursor")
+						args.Cursor = &cursor
+					}
+
+					return admin.TailEvents(ctx, args)
+				},
+			},
+		},
+	}
+}
+
+func adminKeysCmd() *cli.Command {
+	return &cli.Command{
+		Name:  "keys",
+		Usage: "Generate keys",
+		Commands: []*cli.Command{
+			{
+				Name:  "generate",
+				Usage: "Generate an ES256 private key for a host's jwt_signing_key, in PEM format",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "out",
+						Usage: "Write the key to this file, which must not already exist, rather than stdout",
+					},
+				},
+				Action: func(ctx context.Context, c *cli.Command) error {
+					path := c.String("out")
+					if path == "" {
+						return pds.GenerateJWTKey(os.Stdout)
+					}
+
+					f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+					if err != nil {
+						return err
+					}
+					if err := pds.GenerateJWTKey(f); err != nil {
+						f.Close() //nolint:errcheck
+						return err
+					}
+					return f.Close()
+				},
+			},
+		},
+	}
+}
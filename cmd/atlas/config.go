@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/jcalabro/atlas/internal/pds"
+	"github.com/urfave/cli/v3"
+)
+
+func configCmd() *cli.Command {
+	return &cli.Command{
+		Name:  "config",
+		Usage: "Work with PDS config files",
+		Commands: []*cli.Command{
+			{
+				Name:        "check",
+				Usage:       "Validate a config file and show how it differs from the running config",
+				Description: "Runs the same validation as server startup and SIGHUP reloads, then prints a JSON report with the hosts that would be added, removed, or changed. Exits non-zero if the config is invalid.",
+				ArgsUsage:   "<file>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "running",
+						Usage: "Path to a copy of the config the PDS is currently running with, to diff against (no diff if empty)",
+					},
+					&cli.BoolFlag{
+						Name:  "check-blobstore",
+						Usage: "Make sure the blobstore credentials can reach the bucket",
+					},
+				},
+				Action: func(ctx context.Context, c *cli.Command) error {
+					if c.NArg() != 1 {
+						return fmt.Errorf("expected exactly one config file")
+					}
+
+					return pds.CheckConfig(ctx, os.Stdout, &pds.CheckConfigArgs{
+						File:           c.Args().First(),
+						Running:        c.String("running"),
+						CheckBlobstore: c.Bool("check-blobstore"),
+					})
+				},
+			},
+		},
+	}
+}
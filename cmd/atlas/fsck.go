@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/jcalabro/atlas/internal/pds"
+	"github.com/jcalabro/atlas/internal/pds/db"
+	"github.com/urfave/cli/v3"
+)
+
+func fsckCmd() *cli.Command {
+	return &cli.Command{
+		Name:        "fsck",
+		Usage:       "Check the integrity of repos",
+		Description: "Verifies commit signatures, MST blocks, and secondary indexes for the given repos, printing a JSON report for each repo with issues",
+		Flags: append(fdbFlags,
+			&cli.StringSliceFlag{
+				Name:  "did",
+				Usage: "DID of a repo to check (may be repeated)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "host",
+				Usage: "PDS hostname whose repos should all be checked (may be repeated)",
+			},
+			&cli.BoolFlag{
+				Name:  "repair",
+				Usage: "Rebuild the records index and collection counts from the MST where they disagree",
+			},
+			&cli.StringFlag{
+				Name:    "plc",
+				Usage:   "URL of the PLC server to use",
+				Value:   "https://plc.directory",
+				Sources: cli.EnvVars("ATLAS_PLC"),
+			},
+		),
+		Action: func(ctx context.Context, c *cli.Command) error {
+			return pds.Fsck(ctx, os.Stdout, &pds.FsckArgs{
+				DIDs:   c.StringSlice("did"),
+				Hosts:  c.StringSlice("host"),
+				Repair: c.Bool("repair"),
+				PLCURL: c.String("plc"),
+				FDB: db.Config{
+					ClusterFile: c.String("fdb-cluster-file"),
+					APIVersion:  c.Int("fdb-api-version"),
+				},
+			})
+		},
+	}
+}
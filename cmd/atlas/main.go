@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"strings"
@@ -49,6 +50,7 @@ func main() {
 		},
 		Before: func(ctx context.Context, c *cli.Command) (context.Context, error) {
 			if err := setDefaultLogger(
+				os.Stdout,
 				c.String("log-lvl"),
 				c.String("log-fmt"),
 				c.Bool("log-src"),
@@ -59,6 +61,10 @@ func main() {
 		},
 		Commands: []*cli.Command{
 			pdsCmd(),
+			fsckCmd(),
+			rewrapKeysCmd(),
+			adminCmd(),
+			configCmd(),
 		},
 	}
 
@@ -68,7 +74,7 @@ func main() {
 	}
 }
 
-func setDefaultLogger(llevel, lfmt string, addSource bool) error {
+func setDefaultLogger(w io.Writer, llevel, lfmt string, addSource bool) error {
 	opts := &slog.HandlerOptions{
 		AddSource: addSource,
 	}
@@ -87,9 +93,9 @@ func setDefaultLogger(llevel, lfmt string, addSource bool) error {
 	var log *slog.Logger
 	switch strings.ToLower(lfmt) {
 	case "default":
-		log = slog.New(slog.NewTextHandler(os.Stdout, opts))
+		log = slog.New(slog.NewTextHandler(w, opts))
 	case "json":
-		log = slog.New(slog.NewJSONHandler(os.Stdout, opts))
+		log = slog.New(slog.NewJSONHandler(w, opts))
 	default:
 		return fmt.Errorf(`unsupported log format: %s (wanted "default" or "json")`, lfmt)
 	}
@@ -59,6 +59,23 @@ func pdsCmd() *cli.Command {
 				Value:   defaultConfigFile,
 				Sources: cli.EnvVars("ATLAS_CONFIG"),
 			},
+			&cli.DurationFlag{
+				Name:    "block-retention",
+				Usage:   "How long unreachable repo blocks are kept before being garbage collected",
+				Value:   24 * time.Hour,
+				Sources: cli.EnvVars("ATLAS_BLOCK_RETENTION"),
+			},
+			&cli.DurationFlag{
+				Name:    "signing-key-grace",
+				Usage:   "How long a repo's previous signing key is kept after a key rotation",
+				Value:   7 * 24 * time.Hour,
+				Sources: cli.EnvVars("ATLAS_SIGNING_KEY_GRACE"),
+			},
+			&cli.StringFlag{
+				Name:    "audit-log-file",
+				Usage:   "Path to a JSONL file that admin audit events are appended to, in addition to FoundationDB",
+				Sources: cli.EnvVars("ATLAS_AUDIT_LOG_FILE"),
+			},
 			&cli.StringSliceFlag{
 				Name:    "fallback-appview-csv",
 				Usage:   "URLs of fallback appview servers to which XRPC requests will be proxied if the atproto-proxy is not supplied",
@@ -74,6 +91,9 @@ func pdsCmd() *cli.Command {
 				PLCURL:              c.String("plc"),
 				ConfigFile:          c.String("config"),
 				FallbackAppviewURLs: c.StringSlice("fallback-appview-csv"),
+				BlockRetention:      c.Duration("block-retention"),
+				SigningKeyGrace:     c.Duration("signing-key-grace"),
+				AuditLogFile:        c.String("audit-log-file"),
 				FDB: db.Config{
 					ClusterFile: c.String("fdb-cluster-file"),
 					APIVersion:  c.Int("fdb-api-version"),
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/jcalabro/atlas/internal/pds"
+	"github.com/jcalabro/atlas/internal/pds/db"
+	"github.com/urfave/cli/v3"
+)
+
+func rewrapKeysCmd() *cli.Command {
+	return &cli.Command{
+		Name:        "rewrap-keys",
+		Usage:       "Re-encrypt actor private keys with each host's current key-encryption key",
+		Description: "Re-wraps every actor's private keys with the host's current kek_file or kek_env, and encrypts any keys still stored in plaintext. Keys wrapped with a previous KEK require it to be listed in previous_kek_files.",
+		Flags: append(fdbFlags,
+			&cli.StringFlag{
+				Name:    "config",
+				Usage:   "Path to TOML config file containing PDS host configurations",
+				Value:   defaultConfigFile,
+				Sources: cli.EnvVars("ATLAS_CONFIG"),
+			},
+			&cli.StringSliceFlag{
+				Name:  "host",
+				Usage: "PDS hostname whose keys should be re-wrapped (may be repeated, defaults to all configured hosts)",
+			},
+		),
+		Action: func(ctx context.Context, c *cli.Command) error {
+			return pds.RewrapKeys(ctx, os.Stdout, &pds.RewrapKeysArgs{
+				ConfigFile: c.String("config"),
+				Hosts:      c.StringSlice("host"),
+				FDB: db.Config{
+					ClusterFile: c.String("fdb-cluster-file"),
+					APIVersion:  c.Int("fdb-api-version"),
+				},
+			})
+		},
+	}
+}
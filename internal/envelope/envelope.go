@@ -0,0 +1,244 @@
+// Package envelope encrypts private keys at rest using envelope encryption: each key is encrypted
+// with its own random data-encryption key (DEK), and the DEK is encrypted ("wrapped") with a
+// key-encryption key (KEK) held by a KMS.
+package envelope
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jcalabro/atlas/internal/types"
+)
+
+// dekSize is the size of the AES-256 data-encryption keys generated for each sealed key
+const dekSize = 32
+
+// ErrUnknownKEK is returned when a key was wrapped with a KEK that isn't in the keyring
+var ErrUnknownKEK = errors.New("key was wrapped with an unknown key-encryption key")
+
+// KMS encrypts and decrypts small payloads (data-encryption keys) with a key-encryption key that
+// never leaves the KMS. Implementations may be backed by a cloud KMS or, like LocalKMS, by key
+// material held in memory.
+type KMS interface {
+	// KeyID identifies the key-encryption key so that wrapped keys can be matched to it
+	KeyID() string
+
+	Encrypt(ctx context.Context, plaintext []byte) ([]byte, error)
+	Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error)
+}
+
+// LocalKMS is a KMS backed by an AES-256-GCM key held in memory
+type LocalKMS struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// NewLocalKMS creates a KMS from 32 bytes of key material
+func NewLocalKMS(kek []byte) (*LocalKMS, error) {
+	if len(kek) != 32 {
+		return nil, fmt.Errorf("key-encryption key must be 32 bytes, got %d", len(kek))
+	}
+
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(kek)
+	return &LocalKMS{
+		id:   "local:" + hex.EncodeToString(sum[:8]),
+		aead: aead,
+	}, nil
+}
+
+// LoadLocalKMS creates a KMS from a base64-encoded 32 byte key read from the given file, or from
+// the given environment variable if path is empty
+func LoadLocalKMS(path, env string) (*LocalKMS, error) {
+	var encoded string
+	switch {
+	case path != "":
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key-encryption key file: %w", err)
+		}
+		encoded = string(buf)
+	case env != "":
+		val, ok := os.LookupEnv(env)
+		if !ok {
+			return nil, fmt.Errorf("key-encryption key environment variable %q is not set", env)
+		}
+		encoded = val
+	default:
+		return nil, fmt.Errorf("a key-encryption key file or environment variable is required")
+	}
+
+	kek, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode key-encryption key: %w", err)
+	}
+
+	return NewLocalKMS(kek)
+}
+
+func (k *LocalKMS) KeyID() string {
+	return k.id
+}
+
+func (k *LocalKMS) Encrypt(_ context.Context, plaintext []byte) ([]byte, error) {
+	return seal(k.aead, plaintext)
+}
+
+func (k *LocalKMS) Decrypt(_ context.Context, ciphertext []byte) ([]byte, error) {
+	return open(k.aead, ciphertext)
+}
+
+// Keyring seals keys with its current KMS, and opens keys sealed by either the current or any of
+// the previous KMSes so that keys can be re-wrapped after the KEK is rotated
+type Keyring struct {
+	current KMS
+	byID    map[string]KMS
+}
+
+func NewKeyring(current KMS, previous ...KMS) *Keyring {
+	byID := make(map[string]KMS, len(previous)+1)
+	for _, kms := range previous {
+		byID[kms.KeyID()] = kms
+	}
+	byID[current.KeyID()] = current
+
+	return &Keyring{current: current, byID: byID}
+}
+
+// KeyID returns the ID of the KEK that new keys are wrapped with
+func (k *Keyring) KeyID() string {
+	return k.current.KeyID()
+}
+
+// Seal encrypts plaintext with a fresh DEK, and wraps the DEK with the current KEK
+func (k *Keyring) Seal(ctx context.Context, plaintext []byte) (*types.WrappedKey, error) {
+	dek := make([]byte, dekSize)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, fmt.Errorf("failed to generate data-encryption key: %w", err)
+	}
+	defer clear(dek)
+
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := seal(aead, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped, err := k.current.Encrypt(ctx, dek)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data-encryption key: %w", err)
+	}
+
+	return &types.WrappedKey{
+		KekId:      k.current.KeyID(),
+		WrappedDek: wrapped,
+		Ciphertext: ciphertext,
+	}, nil
+}
+
+// Open unwraps the key's DEK and decrypts the key. Callers should clear the returned plaintext
+// once they're done with it.
+func (k *Keyring) Open(ctx context.Context, key *types.WrappedKey) ([]byte, error) {
+	kms, ok := k.byID[key.KekId]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKEK, key.KekId)
+	}
+
+	dek, err := kms.Decrypt(ctx, key.WrappedDek)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data-encryption key: %w", err)
+	}
+	defer clear(dek)
+
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := open(aead, key.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt key: %w", err)
+	}
+
+	return plaintext, nil
+}
+
+// Rewrap re-wraps the key's DEK with the current KEK without decrypting the key itself. Returns
+// the key unchanged if it's already wrapped with the current KEK.
+func (k *Keyring) Rewrap(ctx context.Context, key *types.WrappedKey) (*types.WrappedKey, error) {
+	if key.KekId == k.current.KeyID() {
+		return key, nil
+	}
+
+	kms, ok := k.byID[key.KekId]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKEK, key.KekId)
+	}
+
+	dek, err := kms.Decrypt(ctx, key.WrappedDek)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data-encryption key: %w", err)
+	}
+	defer clear(dek)
+
+	wrapped, err := k.current.Encrypt(ctx, dek)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data-encryption key: %w", err)
+	}
+
+	return &types.WrappedKey{
+		KekId:      k.current.KeyID(),
+		WrappedDek: wrapped,
+		Ciphertext: key.Ciphertext,
+	}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gcm: %w", err)
+	}
+
+	return aead, nil
+}
+
+// seal encrypts plaintext with a random nonce, which is prepended to the ciphertext
+func seal(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(aead cipher.AEAD, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext is too short")
+	}
+
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, nil)
+}
@@ -0,0 +1,142 @@
+package envelope
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestKMS(t *testing.T) *LocalKMS {
+	t.Helper()
+	kek := make([]byte, 32)
+	_, err := rand.Read(kek)
+	require.NoError(t, err)
+
+	kms, err := NewLocalKMS(kek)
+	require.NoError(t, err)
+	return kms
+}
+
+func TestLocalKMS(t *testing.T) {
+	t.Parallel()
+
+	t.Run("round trip", func(t *testing.T) {
+		t.Parallel()
+		kms := newTestKMS(t)
+
+		ct, err := kms.Encrypt(t.Context(), []byte("hello"))
+		require.NoError(t, err)
+		require.NotContains(t, string(ct), "hello")
+
+		pt, err := kms.Decrypt(t.Context(), ct)
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello"), pt)
+
+		_, err = newTestKMS(t).Decrypt(t.Context(), ct)
+		require.Error(t, err)
+	})
+
+	t.Run("rejects bad key sizes", func(t *testing.T) {
+		t.Parallel()
+		_, err := NewLocalKMS(make([]byte, 16))
+		require.Error(t, err)
+	})
+}
+
+// not parallel because it sets an environment variable
+func TestLoadLocalKMS(t *testing.T) {
+	kek := make([]byte, 32)
+	_, err := rand.Read(kek)
+	require.NoError(t, err)
+	encoded := base64.StdEncoding.EncodeToString(kek)
+
+	path := filepath.Join(t.TempDir(), "kek")
+	require.NoError(t, os.WriteFile(path, []byte(encoded+"\n"), 0o600))
+
+	fromFile, err := LoadLocalKMS(path, "")
+	require.NoError(t, err)
+
+	t.Setenv("ATLAS_TEST_KEK", encoded)
+	fromEnv, err := LoadLocalKMS("", "ATLAS_TEST_KEK")
+	require.NoError(t, err)
+	require.Equal(t, fromFile.KeyID(), fromEnv.KeyID())
+
+	_, err = LoadLocalKMS("", "ATLAS_TEST_KEK_MISSING")
+	require.Error(t, err)
+
+	_, err = LoadLocalKMS(filepath.Join(t.TempDir(), "missing"), "")
+	require.Error(t, err)
+
+	_, err = LoadLocalKMS("", "")
+	require.Error(t, err)
+}
+
+func TestKeyring(t *testing.T) {
+	t.Parallel()
+
+	t.Run("seal and open", func(t *testing.T) {
+		t.Parallel()
+		kms := newTestKMS(t)
+		keyring := NewKeyring(kms)
+
+		wrapped, err := keyring.Seal(t.Context(), []byte("private key"))
+		require.NoError(t, err)
+		require.Equal(t, kms.KeyID(), wrapped.KekId)
+		require.NotContains(t, string(wrapped.Ciphertext), "private key")
+
+		pt, err := keyring.Open(t.Context(), wrapped)
+		require.NoError(t, err)
+		require.Equal(t, []byte("private key"), pt)
+
+		// tampering is detected
+		wrapped.Ciphertext[len(wrapped.Ciphertext)-1] ^= 1
+		_, err = keyring.Open(t.Context(), wrapped)
+		require.Error(t, err)
+	})
+
+	t.Run("unknown kek", func(t *testing.T) {
+		t.Parallel()
+
+		wrapped, err := NewKeyring(newTestKMS(t)).Seal(t.Context(), []byte("private key"))
+		require.NoError(t, err)
+
+		other := NewKeyring(newTestKMS(t))
+		_, err = other.Open(t.Context(), wrapped)
+		require.ErrorIs(t, err, ErrUnknownKEK)
+
+		_, err = other.Rewrap(t.Context(), wrapped)
+		require.ErrorIs(t, err, ErrUnknownKEK)
+	})
+
+	t.Run("rewrap with a rotated kek", func(t *testing.T) {
+		t.Parallel()
+		oldKMS, newKMS := newTestKMS(t), newTestKMS(t)
+
+		wrapped, err := NewKeyring(oldKMS).Seal(t.Context(), []byte("private key"))
+		require.NoError(t, err)
+
+		rotated := NewKeyring(newKMS, oldKMS)
+		pt, err := rotated.Open(t.Context(), wrapped)
+		require.NoError(t, err)
+		require.Equal(t, []byte("private key"), pt)
+
+		rewrapped, err := rotated.Rewrap(t.Context(), wrapped)
+		require.NoError(t, err)
+		require.Equal(t, newKMS.KeyID(), rewrapped.KekId)
+		require.Equal(t, wrapped.Ciphertext, rewrapped.Ciphertext)
+
+		// the old kek is no longer needed
+		pt, err = NewKeyring(newKMS).Open(t.Context(), rewrapped)
+		require.NoError(t, err)
+		require.Equal(t, []byte("private key"), pt)
+
+		// already current
+		again, err := rotated.Rewrap(t.Context(), rewrapped)
+		require.NoError(t, err)
+		require.Same(t, rewrapped, again)
+	})
+}
@@ -0,0 +1,39 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Fake is a Mailer that records messages instead of sending them, for tests and local development
+type Fake struct {
+	mu   sync.Mutex
+	sent []*Message
+}
+
+func (f *Fake) Send(_ context.Context, msg *Message) error {
+	if err := msg.validate(); err != nil {
+		return fmt.Errorf("invalid message: %w", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.sent = append(f.sent, msg)
+	return nil
+}
+
+// Sent returns the messages that were sent to the given address
+func (f *Fake) Sent(to string) []*Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var out []*Message
+	for _, msg := range f.sent {
+		if msg.To == to {
+			out = append(out, msg)
+		}
+	}
+	return out
+}
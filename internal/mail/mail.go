@@ -0,0 +1,35 @@
+// Package mail sends email to account holders, such as notices from a host's admins.
+package mail
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages
+type Mailer interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+// validate checks that the message can be sent, and that none of its headers could be used to
+// inject additional headers
+func (m *Message) validate() error {
+	switch {
+	case m.To == "":
+		return fmt.Errorf("recipient is required")
+	case strings.ContainsAny(m.To, "\r\n"):
+		return fmt.Errorf("recipient contains a line break")
+	case strings.ContainsAny(m.Subject, "\r\n"):
+		return fmt.Errorf("subject contains a line break")
+	}
+
+	return nil
+}
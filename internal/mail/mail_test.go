@@ -0,0 +1,113 @@
+package mail
+
+import (
+	"bufio"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// serveSMTP accepts a single SMTP session on a local listener and returns the message data it
+// received once the session ends
+func serveSMTP(t *testing.T) (string, <-chan string) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+
+	received := make(chan string, 1)
+	go func() {
+		defer close(received)
+
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close() //nolint:errcheck
+
+		tp := textproto.NewConn(conn)
+		reply := func(line string) { _ = tp.PrintfLine("%s", line) }
+
+		reply("220 localhost ESMTP")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+
+			switch cmd := strings.ToUpper(strings.Fields(line + " ")[0]); cmd {
+			case "EHLO", "HELO":
+				reply("250 localhost")
+			case "MAIL", "RCPT":
+				reply("250 OK")
+			case "DATA":
+				reply("354 go ahead")
+				data, err := tp.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				received <- string(data)
+				reply("250 OK")
+			case "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("502 unsupported")
+			}
+		}
+	}()
+
+	return ln.Addr().String(), received
+}
+
+func TestSMTP(t *testing.T) {
+	t.Parallel()
+
+	addr, received := serveSMTP(t)
+
+	mailer, err := NewSMTP(&SMTPArgs{Addr: addr, From: "admin@example.com"})
+	require.NoError(t, err)
+
+	err = mailer.Send(t.Context(), &Message{
+		To:      "alice@example.com",
+		Subject: "hello",
+		Body:    "line one\nline two",
+	})
+	require.NoError(t, err)
+
+	data := <-received
+	msg, err := textproto.NewReader(bufio.NewReader(strings.NewReader(data))).ReadMIMEHeader()
+	require.NoError(t, err)
+	require.Equal(t, "admin@example.com", msg.Get("From"))
+	require.Equal(t, "alice@example.com", msg.Get("To"))
+	require.Equal(t, "hello", msg.Get("Subject"))
+	require.Contains(t, data, "line one\nline two")
+
+	// headers can't be injected through the subject
+	err = mailer.Send(t.Context(), &Message{To: "alice@example.com", Subject: "hi\r\nBcc: eve@example.com"})
+	require.ErrorContains(t, err, "line break")
+
+	_, err = NewSMTP(&SMTPArgs{Addr: "localhost", From: "admin@example.com"})
+	require.Error(t, err)
+	_, err = NewSMTP(&SMTPArgs{Addr: addr})
+	require.Error(t, err)
+	_, err = NewSMTP(&SMTPArgs{Addr: addr, From: "admin@example.com", Username: "admin"})
+	require.Error(t, err)
+}
+
+func TestFake(t *testing.T) {
+	t.Parallel()
+
+	var fake Fake
+	require.NoError(t, fake.Send(t.Context(), &Message{To: "alice@example.com", Subject: "hello", Body: "hi"}))
+	require.Error(t, fake.Send(t.Context(), &Message{Subject: "no recipient"}))
+
+	sent := fake.Sent("alice@example.com")
+	require.Len(t, sent, 1)
+	require.Equal(t, "hello", sent[0].Subject)
+	require.Empty(t, fake.Sent("bob@example.com"))
+}
@@ -0,0 +1,138 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// SMTP sends mail through an SMTP relay, upgrading the connection with STARTTLS when the relay
+// supports it
+type SMTP struct {
+	addr     string
+	host     string
+	username string
+	password string
+	from     string
+}
+
+// SMTPArgs configures an SMTP mailer
+type SMTPArgs struct {
+	// Addr is the host:port of the relay
+	Addr string
+
+	// Username and Password authenticate with the relay. Authentication is skipped if Username is
+	// empty.
+	Username string
+	Password string
+
+	// From is the sender address of every message
+	From string
+}
+
+// NewSMTP creates a mailer that sends through the given relay
+func NewSMTP(args *SMTPArgs) (*SMTP, error) {
+	host, _, err := net.SplitHostPort(args.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid smtp address %q: %w", args.Addr, err)
+	}
+
+	switch {
+	case args.From == "":
+		return nil, fmt.Errorf("sender address is required")
+	case strings.ContainsAny(args.From, "\r\n"):
+		return nil, fmt.Errorf("sender address contains a line break")
+	case args.Username != "" && args.Password == "":
+		return nil, fmt.Errorf("smtp password is required when a username is set")
+	}
+
+	return &SMTP{
+		addr:     args.Addr,
+		host:     host,
+		username: args.Username,
+		password: args.Password,
+		from:     args.From,
+	}, nil
+}
+
+// format renders the message with the headers that are required by RFC 5322
+func (s *SMTP) format(msg *Message, now time.Time) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", s.from)
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&buf, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("\r\n")
+
+	body := strings.ReplaceAll(msg.Body, "\r\n", "\n")
+	buf.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	return buf.Bytes()
+}
+
+func (s *SMTP) Send(ctx context.Context, msg *Message) error {
+	if err := msg.validate(); err != nil {
+		return fmt.Errorf("invalid message: %w", err)
+	}
+
+	conn, err := (&net.Dialer{Timeout: 10 * time.Second}).DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to smtp relay: %w", err)
+	}
+
+	// bound the whole exchange, since net/smtp doesn't take a context
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(time.Minute)
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close() //nolint:errcheck
+		return fmt.Errorf("failed to set smtp deadline: %w", err)
+	}
+
+	client, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close() //nolint:errcheck
+		return fmt.Errorf("failed to start smtp session: %w", err)
+	}
+	defer client.Close() //nolint:errcheck
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: s.host}); err != nil {
+			return fmt.Errorf("failed to start tls: %w", err)
+		}
+	}
+
+	if s.username != "" {
+		if err := client.Auth(smtp.PlainAuth("", s.username, s.password, s.host)); err != nil {
+			return fmt.Errorf("failed to authenticate with smtp relay: %w", err)
+		}
+	}
+
+	if err := client.Mail(s.from); err != nil {
+		return fmt.Errorf("smtp relay rejected sender: %w", err)
+	}
+	if err := client.Rcpt(msg.To); err != nil {
+		return fmt.Errorf("smtp relay rejected recipient: %w", err)
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("failed to start smtp data: %w", err)
+	}
+	if _, err := w.Write(s.format(msg, time.Now())); err != nil {
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("smtp relay rejected message: %w", err)
+	}
+
+	return client.Quit()
+}
@@ -1,6 +1,7 @@
 package pds
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -62,6 +63,11 @@ func (s *server) handleCreateAccount(w http.ResponseWriter, r *http.Request) {
 	// past validation - start recording metrics (default to error)
 	metricStatus = "error"
 
+	if !s.checkRateLimits(w, r, s.createAccountRateLimits(host, r)...) {
+		metricStatus = "rate_limited"
+		return
+	}
+
 	// check if the handle is already taken (handles are globally unique)
 	_, err = s.directory.LookupHandle(ctx, handle)
 	if err == nil {
@@ -89,62 +95,134 @@ func (s *server) handleCreateAccount(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	signingKey, err := atcrypto.GeneratePrivateKeyK256()
+	if code, err := s.checkInviteCode(r, host, in.InviteCode); err != nil {
+		if code == http.StatusBadRequest {
+			metricStatus = "invalid_invite_code"
+		}
+		s.err(w, code, err)
+		return
+	}
+
+	if code, err := s.verifySignup(r, host, &in); err != nil {
+		if code == http.StatusBadRequest {
+			metricStatus = "verification_failed"
+		}
+		s.err(w, code, err)
+		return
+	}
+
+	var inviteCode string
+	if host.inviteCodeRequired {
+		inviteCode = *in.InviteCode
+	}
+
+	actor, err := s.createActor(ctx, host, in.Handle, *in.Email, *in.Password, inviteCode)
+	if errors.Is(err, db.ErrInviteCodeUnavailable) {
+		metricStatus = "invalid_invite_code"
+		s.badRequest(w, fmt.Errorf("invite code is not available"))
+		return
+	}
 	if err != nil {
-		s.internalErr(w, fmt.Errorf("failed to create signing key: %w", err))
+		s.internalErr(w, err)
 		return
 	}
 
-	rotationKey, err := atcrypto.GeneratePrivateKeyK256()
+	// let relays know there's a new repo to pick up
+	s.relays.RequestCrawl(host.hostname)
+
+	session, err := s.createSession(context.WithValue(ctx, userAgentContextKey{}, r.UserAgent()), actor)
 	if err != nil {
-		s.internalErr(w, fmt.Errorf("failed to create rotation key: %w", err))
+		s.internalErr(w, fmt.Errorf("failed to create session: %w", err))
 		return
 	}
 
+	metricStatus = "success"
+
+	res := atproto.ServerCreateAccount_Output{
+		Did:        actor.Did,
+		Handle:     actor.Handle,
+		AccessJwt:  session.AccessToken,
+		RefreshJwt: session.RefreshToken,
+	}
+
+	s.jsonOK(w, res)
+}
+
+// createActor generates the keys and DID of a new account, initializes its repo, and saves it. The
+// invite code is consumed if one is given. Handle and email availability must already have been
+// checked by the caller.
+func (s *server) createActor(ctx context.Context, host *loadedHostConfig, handle, email, password, inviteCode string) (*types.Actor, error) {
+	signingKey, err := atcrypto.GeneratePrivateKeyK256()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create signing key: %w", err)
+	}
+
+	rotationKey, err := atcrypto.GeneratePrivateKeyK256()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create rotation key: %w", err)
+	}
+
+	// encrypt the private keys before they're stored, and before the did is created so
+	// that a KMS failure doesn't leave behind an unusable did
+	wrappedSigningKey, plainSigningKey, err := sealKey(ctx, host, signingKey.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to seal signing key: %w", err)
+	}
+	wrappedRotationKey, plainRotationKey, err := sealKey(ctx, host, rotationKey.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to seal rotation key: %w", err)
+	}
+
 	// create a new did and submit the genesis operation to PLC
-	did, plcOp, err := s.plc.CreateDID(ctx, signingKey, rotationKey, "", in.Handle, host.hostname)
+	did, plcOp, err := s.plc.CreateDID(ctx, signingKey, rotationKey, "", handle, host.hostname)
 	if err != nil {
-		s.internalErr(w, fmt.Errorf("failed to create did: %w", err))
-		return
+		return nil, fmt.Errorf("failed to create did: %w", err)
 	}
 	if err := s.plc.SendOperation(ctx, did, plcOp); err != nil {
-		s.internalErr(w, fmt.Errorf("failed to submit plc operation: %w", err))
-		return
+		return nil, fmt.Errorf("failed to submit plc operation: %w", err)
 	}
 
-	pwHash, err := bcrypt.GenerateFromPassword([]byte(*in.Password), bcrypt.DefaultCost)
+	pwHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
-		s.internalErr(w, fmt.Errorf("failed to hash password: %w", err))
-		return
+		return nil, fmt.Errorf("failed to hash password: %w", err)
 	}
 
 	actor := &types.Actor{
 		Did:                   did,
 		CreatedAt:             timestamppb.Now(),
-		Email:                 *in.Email,
+		Email:                 email,
 		EmailVerificationCode: fmt.Sprintf("%s-%s", util.RandString(6), util.RandString(6)),
 		EmailConfirmed:        false,
 		PasswordHash:          pwHash,
-		SigningKey:            signingKey.Bytes(),
-		Handle:                in.Handle,
+		SigningKey:            plainSigningKey,
+		WrappedSigningKey:     wrappedSigningKey,
+		Handle:                handle,
 		Active:                true,
-		RotationKeys:          [][]byte{rotationKey.Bytes()},
-		RefreshTokens:         []*types.RefreshToken{},
 		PdsHost:               host.hostname,
 	}
 
+	if wrappedRotationKey != nil {
+		actor.WrappedRotationKeys = []*types.WrappedKey{wrappedRotationKey}
+	} else {
+		actor.RotationKeys = [][]byte{plainRotationKey}
+	}
+
 	// initialize the empty repo for this account
 	rootCID, rev, err := s.db.InitRepo(ctx, actor)
 	if err != nil {
-		s.internalErr(w, fmt.Errorf("failed to initialize repo: %w", err))
-		return
+		return nil, fmt.Errorf("failed to initialize repo: %w", err)
 	}
 	actor.Head = rootCID.String()
 	actor.Rev = rev
 
-	if err := s.db.SaveActor(ctx, actor); err != nil {
-		s.internalErr(w, fmt.Errorf("failed to write actor to database: %w", err))
-		return
+	// the code was checked up front, but it's only consumed along with saving the actor so that a
+	// failed signup doesn't use it up
+	actor.InviteCode = inviteCode
+	if err := s.db.CreateActor(ctx, actor); err != nil {
+		if errors.Is(err, db.ErrInviteCodeUnavailable) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to write actor to database: %w", err)
 	}
 
 	// write identity and account events to database for firehose to pick up
@@ -171,24 +249,12 @@ func (s *server) handleCreateAccount(w http.ResponseWriter, r *http.Request) {
 		s.log.Error("failed to write account event", "err", err, "did", actor.Did)
 	}
 
-	session, err := s.createSession(ctx, actor)
-	if err != nil {
-		s.internalErr(w, fmt.Errorf("failed to create session: %w", err))
-		return
-	}
-
-	metricStatus = "success"
-
-	res := atproto.ServerCreateAccount_Output{
-		Did:        actor.Did,
-		Handle:     actor.Handle,
-		AccessJwt:  session.AccessToken,
-		RefreshJwt: session.RefreshToken,
-	}
-
-	s.jsonOK(w, res)
+	return actor, nil
 }
 
+// minPasswordLength is the shortest password an account may have
+const minPasswordLength = 12
+
 func validateCreateAccountInput(in *atproto.ServerCreateAccount_Input) error {
 	switch {
 	case in.Email == nil || *in.Email == "":
@@ -199,9 +265,8 @@ func validateCreateAccountInput(in *atproto.ServerCreateAccount_Input) error {
 		return fmt.Errorf("password is required")
 	}
 
-	const passLen = 12
-	if len(*in.Password) < passLen {
-		return fmt.Errorf("password must be at least %d characters", passLen)
+	if len(*in.Password) < minPasswordLength {
+		return fmt.Errorf("password must be at least %d characters", minPasswordLength)
 	}
 
 	return nil
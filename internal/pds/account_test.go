@@ -14,6 +14,7 @@ import (
 	"github.com/bluesky-social/indigo/atproto/atcrypto"
 	"github.com/bluesky-social/indigo/atproto/identity"
 	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/jcalabro/atlas/internal/pds/db"
 	"github.com/jcalabro/atlas/internal/plc"
 	"github.com/jcalabro/atlas/internal/util"
 	"github.com/stretchr/testify/require"
@@ -110,9 +111,6 @@ func TestHandleCreateAccount(t *testing.T) {
 		err = bcrypt.CompareHashAndPassword(actor.PasswordHash, []byte(password))
 		require.NoError(t, err)
 
-		require.Len(t, actor.RefreshTokens, 1)
-		require.Equal(t, resp.Out.RefreshJwt, actor.RefreshTokens[0].Token)
-
 		// actually attempt to verify the returned tokens to make sure it's valid
 		// need host config in context for token verification
 		verifyCtx := context.WithValue(ctx, hostContextKey{}, srv.hosts[testPDSHost])
@@ -121,6 +119,10 @@ func TestHandleCreateAccount(t *testing.T) {
 		require.NotNil(t, refreshClaims)
 		require.Equal(t, resp.Out.Did, refreshClaims.DID)
 
+		session, err := srv.db.GetSession(ctx, actor.Did, refreshClaims.JTI)
+		require.NoError(t, err)
+		require.Equal(t, db.HashRefreshToken(resp.Out.RefreshJwt), session.TokenHash)
+
 		accessClaims, err := srv.verifyAccessToken(verifyCtx, resp.Out.AccessJwt)
 		require.NoError(t, err)
 		require.NotNil(t, accessClaims)
@@ -0,0 +1,630 @@
+package pds
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	indigoutil "github.com/bluesky-social/indigo/util"
+	"github.com/ipfs/go-cid"
+	"github.com/jcalabro/atlas/internal/mail"
+	"github.com/jcalabro/atlas/internal/pds/db"
+	"github.com/jcalabro/atlas/internal/plc"
+	"github.com/jcalabro/atlas/internal/types"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// maxAccountInfos bounds the number of accounts that can be fetched with getAccountInfos
+	maxAccountInfos = 100
+
+	// defaultEmailSubject is used for admin emails that don't set a subject
+	defaultEmailSubject = "Message from the administrators"
+)
+
+// adminAccount returns the account with the given DID or handle, as long as it belongs to the host.
+// Accounts on other hosts are reported as not found so that admins can't probe them. Returns the
+// HTTP status code to respond with on error.
+func (s *server) adminAccount(ctx context.Context, host *loadedHostConfig, account string) (*types.Actor, int, error) {
+	ident, err := syntax.ParseAtIdentifier(account)
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid account: %w", err)
+	}
+
+	var actor *types.Actor
+	if ident.IsDID() {
+		actor, err = s.db.GetActorByDID(ctx, ident.String())
+	} else {
+		actor, err = s.db.GetActorByHandle(ctx, ident.Normalize().String())
+	}
+	if errors.Is(err, db.ErrNotFound) || (err == nil && actor.PdsHost != host.hostname) {
+		return nil, http.StatusNotFound, fmt.Errorf("account not found")
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("failed to get actor: %w", err)
+	}
+
+	return actor, http.StatusOK, nil
+}
+
+// accountView describes the account to an admin, including the invite codes it was issued and the
+// one it signed up with
+func (s *server) accountView(ctx context.Context, actor *types.Actor) (*atproto.AdminDefs_AccountView, error) {
+	view := &atproto.AdminDefs_AccountView{
+		Did:             actor.Did,
+		Handle:          actor.Handle,
+		Email:           &actor.Email,
+		IndexedAt:       actor.CreatedAt.AsTime().Format(indigoutil.ISO8601),
+		InvitesDisabled: &actor.InvitesDisabled,
+	}
+	if actor.InviteNote != "" {
+		view.InviteNote = &actor.InviteNote
+	}
+
+	codes, err := s.db.ListAccountInviteCodes(ctx, actor.PdsHost, actor.Did)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list invite codes: %w", err)
+	}
+	for _, invite := range codes {
+		view.Invites = append(view.Invites, inviteCodeView(invite))
+	}
+
+	if actor.InviteCode != "" {
+		invite, err := s.db.GetInviteCode(ctx, actor.InviteCode)
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			return nil, fmt.Errorf("failed to get invite code: %w", err)
+		}
+		if invite != nil {
+			view.InvitedBy = inviteCodeView(invite)
+		}
+	}
+
+	return view, nil
+}
+
+// purgeIdentity drops the actor's DID and handles from the identity cache after they change
+func (s *server) purgeIdentity(ctx context.Context, did string, handles ...string) {
+	if err := s.directory.Purge(ctx, syntax.DID(did).AtIdentifier()); err != nil {
+		s.log.Warn("failed to purge identity from cache", "err", err, "did", did)
+	}
+	for _, handle := range handles {
+		if err := s.directory.Purge(ctx, syntax.Handle(handle).AtIdentifier()); err != nil {
+			s.log.Warn("failed to purge handle from cache", "err", err, "handle", handle)
+		}
+	}
+}
+
+func (s *server) handleGetAccountInfo(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	span := spanFromContext(ctx)
+	defer span.End()
+
+	host := hostFromContext(ctx)
+
+	did := r.URL.Query().Get("did")
+	span.SetAttributes(attribute.String("did", did))
+
+	if _, err := syntax.ParseDID(did); err != nil {
+		s.badRequest(w, fmt.Errorf("invalid did: %w", err))
+		return
+	}
+
+	actor, code, err := s.adminAccount(ctx, host, did)
+	if err != nil {
+		s.err(w, code, err)
+		return
+	}
+
+	view, err := s.accountView(ctx, actor)
+	if err != nil {
+		s.internalErr(w, err)
+		return
+	}
+
+	s.jsonOK(w, view)
+}
+
+func (s *server) handleGetAccountInfos(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	span := spanFromContext(ctx)
+	defer span.End()
+
+	host := hostFromContext(ctx)
+
+	dids := r.URL.Query()["dids"]
+	span.SetAttributes(attribute.Int("count", len(dids)))
+
+	if len(dids) == 0 || len(dids) > maxAccountInfos {
+		s.badRequest(w, fmt.Errorf("must request between 1 and %d accounts", maxAccountInfos))
+		return
+	}
+
+	out := &atproto.AdminGetAccountInfos_Output{
+		Infos: make([]*atproto.AdminDefs_AccountView, 0, len(dids)),
+	}
+	for _, did := range dids {
+		if _, err := syntax.ParseDID(did); err != nil {
+			s.badRequest(w, fmt.Errorf("invalid did %q: %w", did, err))
+			return
+		}
+
+		// accounts that don't exist or belong to another host are left out
+		actor, code, err := s.adminAccount(ctx, host, did)
+		if code == http.StatusNotFound {
+			continue
+		}
+		if err != nil {
+			s.err(w, code, err)
+			return
+		}
+
+		view, err := s.accountView(ctx, actor)
+		if err != nil {
+			s.internalErr(w, err)
+			return
+		}
+		out.Infos = append(out.Infos, view)
+	}
+
+	s.jsonOK(w, out)
+}
+
+// handleSearchAccounts lists the host's accounts whose email starts with the given prefix, or every
+// account if no email is given
+func (s *server) handleSearchAccounts(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	span := spanFromContext(ctx)
+	defer span.End()
+
+	host := hostFromContext(ctx)
+
+	email := r.URL.Query().Get("email")
+	cursor := r.URL.Query().Get("cursor")
+	span.SetAttributes(
+		attribute.String("email", email),
+		attribute.String("cursor", cursor),
+	)
+
+	limit, err := parseIntParam(r, "limit", 50)
+	if err != nil || limit < 1 {
+		s.badRequest(w, fmt.Errorf("invalid limit"))
+		return
+	}
+	if limit > 100 {
+		limit = 100
+	}
+
+	actors, next, err := s.db.SearchActorsByEmail(ctx, host.hostname, email, cursor, limit)
+	if err != nil {
+		s.internalErr(w, fmt.Errorf("failed to search accounts: %w", err))
+		return
+	}
+
+	out := &atproto.AdminSearchAccounts_Output{
+		Accounts: make([]*atproto.AdminDefs_AccountView, 0, len(actors)),
+		Cursor:   nextCursorOrNil(next),
+	}
+	for _, actor := range actors {
+		view, err := s.accountView(ctx, actor)
+		if err != nil {
+			s.internalErr(w, err)
+			return
+		}
+		out.Accounts = append(out.Accounts, view)
+	}
+
+	s.jsonOK(w, out)
+}
+
+func (s *server) handleUpdateAccountEmail(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	span := spanFromContext(ctx)
+	defer span.End()
+
+	host := hostFromContext(ctx)
+
+	var in atproto.AdminUpdateAccountEmail_Input
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		s.badRequest(w, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+
+	span.SetAttributes(attribute.String("account", in.Account))
+
+	if in.Email == "" {
+		s.badRequest(w, fmt.Errorf("email is required"))
+		return
+	}
+
+	actor, code, err := s.adminAccount(ctx, host, in.Account)
+	if err != nil {
+		s.err(w, code, err)
+		return
+	}
+
+	_, err = s.db.UpdateActorEmail(ctx, actor.Did, in.Email)
+	if errors.Is(err, db.ErrEmailTaken) {
+		s.badRequest(w, fmt.Errorf("email is already in use"))
+		return
+	}
+	if err != nil {
+		s.internalErr(w, fmt.Errorf("failed to update email: %w", err))
+		return
+	}
+
+	s.audit(ctx, host, "com.atproto.admin.updateAccountEmail", actor.Did,
+		map[string]string{"email": actor.Email}, map[string]string{"email": in.Email})
+	s.log.Info("admin updated account email", "did", actor.Did)
+}
+
+// handleUpdateAccountHandle changes an account's handle and publishes it to the account's DID
+// document. Retrying after a failure resumes from wherever the previous attempt stopped.
+func (s *server) handleUpdateAccountHandle(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	span := spanFromContext(ctx)
+	defer span.End()
+
+	host := hostFromContext(ctx)
+
+	var in atproto.AdminUpdateAccountHandle_Input
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		s.badRequest(w, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+
+	in.Handle = strings.ToLower(in.Handle)
+	span.SetAttributes(
+		attribute.String("did", in.Did),
+		attribute.String("handle", in.Handle),
+	)
+
+	if _, err := syntax.ParseDID(in.Did); err != nil {
+		s.badRequest(w, fmt.Errorf("invalid did: %w", err))
+		return
+	}
+	handle, err := syntax.ParseHandle(in.Handle)
+	if err != nil {
+		s.badRequest(w, fmt.Errorf("invalid handle: %w", err))
+		return
+	}
+
+	actor, code, err := s.adminAccount(ctx, host, in.Did)
+	if err != nil {
+		s.err(w, code, err)
+		return
+	}
+	oldHandle := actor.Handle
+
+	if oldHandle != in.Handle {
+		// handles are globally unique, including those of accounts on other PDSes
+		ident, err := s.directory.LookupHandle(ctx, handle)
+		if err == nil && ident.DID.String() != actor.Did {
+			s.badRequest(w, fmt.Errorf("handle %q is already taken", in.Handle))
+			return
+		}
+		if err != nil && !errors.Is(err, identity.ErrHandleNotFound) {
+			s.internalErr(w, fmt.Errorf("failed to resolve handle: %w", err))
+			return
+		}
+
+		actor, err = s.db.UpdateActorHandle(ctx, actor.Did, in.Handle)
+		if errors.Is(err, db.ErrHandleTaken) {
+			s.badRequest(w, fmt.Errorf("handle %q is already taken", in.Handle))
+			return
+		}
+		if err != nil {
+			s.internalErr(w, fmt.Errorf("failed to update handle: %w", err))
+			return
+		}
+	}
+
+	rotationKey, err := s.db.RotationKey(ctx, actor)
+	if err != nil {
+		s.internalErr(w, err)
+		return
+	}
+
+	last, err := s.plc.GetLastOperation(ctx, actor.Did)
+	if err != nil {
+		s.internalErr(w, fmt.Errorf("failed to get last plc operation: %w", err))
+		return
+	}
+
+	// a retried update may have already published the new handle
+	aka := "at://" + in.Handle
+	if len(last.AlsoKnownAs) == 0 || last.AlsoKnownAs[0] != aka {
+		op, err := plc.HandleUpdate(last, in.Handle, rotationKey)
+		if err != nil {
+			s.internalErr(w, fmt.Errorf("failed to create plc operation: %w", err))
+			return
+		}
+		if err := s.plc.SendOperation(ctx, actor.Did, op); err != nil {
+			s.internalErr(w, fmt.Errorf("failed to submit plc operation: %w", err))
+			return
+		}
+	}
+
+	s.purgeIdentity(ctx, actor.Did, oldHandle, in.Handle)
+
+	identityEvent := &types.RepoEvent{
+		PdsHost:   host.hostname,
+		Repo:      actor.Did,
+		Handle:    actor.Handle,
+		Time:      timestamppb.Now(),
+		EventType: types.EventType_EVENT_TYPE_IDENTITY,
+	}
+	if err := s.db.WriteIdentityEvent(ctx, identityEvent); err != nil {
+		s.internalErr(w, fmt.Errorf("failed to write identity event: %w", err))
+		return
+	}
+
+	s.audit(ctx, host, "com.atproto.admin.updateAccountHandle", actor.Did,
+		map[string]string{"handle": oldHandle}, map[string]string{"handle": in.Handle})
+	s.log.Info("admin updated account handle", "did", actor.Did, "old_handle", oldHandle, "handle", in.Handle)
+}
+
+// handleUpdateAccountPassword sets a new password for an account and signs out all of its sessions
+func (s *server) handleUpdateAccountPassword(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	span := spanFromContext(ctx)
+	defer span.End()
+
+	host := hostFromContext(ctx)
+
+	var in atproto.AdminUpdateAccountPassword_Input
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		s.badRequest(w, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+
+	span.SetAttributes(attribute.String("did", in.Did))
+
+	if _, err := syntax.ParseDID(in.Did); err != nil {
+		s.badRequest(w, fmt.Errorf("invalid did: %w", err))
+		return
+	}
+	if len(in.Password) < minPasswordLength {
+		s.badRequest(w, fmt.Errorf("password must be at least %d characters", minPasswordLength))
+		return
+	}
+
+	actor, code, err := s.adminAccount(ctx, host, in.Did)
+	if err != nil {
+		s.err(w, code, err)
+		return
+	}
+
+	pwHash, err := bcrypt.GenerateFromPassword([]byte(in.Password), bcrypt.DefaultCost)
+	if err != nil {
+		s.internalErr(w, fmt.Errorf("failed to hash password: %w", err))
+		return
+	}
+
+	if err := s.db.UpdateActorPassword(ctx, actor.Did, pwHash); err != nil {
+		s.internalErr(w, fmt.Errorf("failed to update password: %w", err))
+		return
+	}
+
+	// password hashes are never recorded
+	s.audit(ctx, host, "com.atproto.admin.updateAccountPassword", actor.Did, nil, nil)
+	s.log.Info("admin updated account password", "did", actor.Did)
+}
+
+// handleDeleteAccount permanently deletes an account and its repo. The account's DID isn't
+// tombstoned, so its owner may still migrate it to another PDS with their own rotation key.
+func (s *server) handleDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	span := spanFromContext(ctx)
+	defer span.End()
+
+	host := hostFromContext(ctx)
+
+	var in atproto.AdminDeleteAccount_Input
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		s.badRequest(w, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+
+	span.SetAttributes(attribute.String("did", in.Did))
+
+	if _, err := syntax.ParseDID(in.Did); err != nil {
+		s.badRequest(w, fmt.Errorf("invalid did: %w", err))
+		return
+	}
+
+	actor, code, err := s.adminAccount(ctx, host, in.Did)
+	if err != nil {
+		s.err(w, code, err)
+		return
+	}
+
+	if err := s.deleteAccount(ctx, actor); err != nil {
+		s.internalErr(w, err)
+		return
+	}
+
+	s.audit(ctx, host, "com.atproto.admin.deleteAccount", actor.Did,
+		map[string]string{"handle": actor.Handle, "email": actor.Email}, nil)
+	s.log.Info("admin deleted account", "did", actor.Did, "handle", actor.Handle)
+}
+
+// deleteAccount permanently deletes an account and its repo and blobs, and tells the firehose
+func (s *server) deleteAccount(ctx context.Context, actor *types.Actor) error {
+	// blob contents are removed first, since their metadata is what tells us where they are
+	s.deleteAccountBlobs(ctx, actor.Did)
+
+	if err := s.db.DeleteActor(ctx, actor.Did); err != nil {
+		return fmt.Errorf("failed to delete account: %w", err)
+	}
+
+	s.purgeIdentity(ctx, actor.Did, actor.Handle)
+
+	accountEvent := &types.RepoEvent{
+		PdsHost:   actor.PdsHost,
+		Repo:      actor.Did,
+		Time:      timestamppb.Now(),
+		EventType: types.EventType_EVENT_TYPE_ACCOUNT,
+		Active:    false,
+		Status:    "deleted",
+	}
+	if err := s.db.WriteIdentityEvent(ctx, accountEvent); err != nil {
+		s.log.Error("failed to write account event", "err", err, "did", actor.Did)
+	}
+
+	return nil
+}
+
+// deleteAccountBlobs removes the contents of the account's blobs from the blobstore. Failures are
+// logged rather than returned so that a blobstore outage can't block the deletion of an account.
+func (s *server) deleteAccountBlobs(ctx context.Context, did string) {
+	if s.blobstore == nil {
+		return
+	}
+
+	var cursor string
+	for {
+		blobs, next, err := s.db.ListBlobs(ctx, did, cursor, 500)
+		if err != nil {
+			s.log.Error("failed to list blobs of deleted account", "err", err, "did", did)
+			return
+		}
+
+		for _, blob := range blobs {
+			c, err := cid.Cast(blob.Cid)
+			if err != nil {
+				s.log.Error("invalid blob cid", "err", err, "did", did)
+				continue
+			}
+
+			// taken down blobs live under the quarantine prefix
+			for _, key := range []string{blobKey(did, c), quarantineKey(did, c)} {
+				_, err = s.blobstore.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+					Bucket: aws.String(s.blobstore.bucket),
+					Key:    aws.String(key),
+				})
+				if err != nil {
+					s.log.Error("failed to delete blob of deleted account", "err", err, "did", did, "cid", c)
+				}
+			}
+		}
+
+		if next == "" {
+			return
+		}
+		cursor = next
+	}
+}
+
+// handleDisableAccountInvites stops an account from creating invite codes and disables the codes
+// it was already issued
+func (s *server) handleDisableAccountInvites(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	span := spanFromContext(ctx)
+	defer span.End()
+
+	host := hostFromContext(ctx)
+
+	var in atproto.AdminDisableAccountInvites_Input
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		s.badRequest(w, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+
+	span.SetAttributes(attribute.String("account", in.Account))
+
+	if _, err := syntax.ParseDID(in.Account); err != nil {
+		s.badRequest(w, fmt.Errorf("invalid account: %w", err))
+		return
+	}
+
+	actor, code, err := s.adminAccount(ctx, host, in.Account)
+	if err != nil {
+		s.err(w, code, err)
+		return
+	}
+
+	var note string
+	if in.Note != nil {
+		note = *in.Note
+	}
+
+	if err := s.db.DisableActorInvites(ctx, actor.Did, note); err != nil {
+		s.internalErr(w, fmt.Errorf("failed to disable invites: %w", err))
+		return
+	}
+
+	s.audit(ctx, host, "com.atproto.admin.disableAccountInvites", actor.Did, nil, map[string]string{"note": note})
+	s.log.Info("admin disabled account invites", "did", actor.Did)
+}
+
+// handleSendEmail sends an email from the host's admins to one of its accounts
+func (s *server) handleSendEmail(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	span := spanFromContext(ctx)
+	defer span.End()
+
+	host := hostFromContext(ctx)
+	if host.mailer == nil {
+		s.badRequest(w, fmt.Errorf("email is not enabled on this host"))
+		return
+	}
+
+	var in atproto.AdminSendEmail_Input
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		s.badRequest(w, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+
+	span.SetAttributes(
+		attribute.String("recipient_did", in.RecipientDid),
+		attribute.String("sender_did", in.SenderDid),
+	)
+
+	if _, err := syntax.ParseDID(in.RecipientDid); err != nil {
+		s.badRequest(w, fmt.Errorf("invalid recipientDid: %w", err))
+		return
+	}
+	if in.Content == "" {
+		s.badRequest(w, fmt.Errorf("content is required"))
+		return
+	}
+	if in.Subject != nil && strings.ContainsAny(*in.Subject, "\r\n") {
+		s.badRequest(w, fmt.Errorf("subject must be a single line"))
+		return
+	}
+
+	actor, code, err := s.adminAccount(ctx, host, in.RecipientDid)
+	if err != nil {
+		s.err(w, code, err)
+		return
+	}
+
+	subject := defaultEmailSubject
+	if in.Subject != nil && *in.Subject != "" {
+		subject = *in.Subject
+	}
+
+	err = host.mailer.Send(ctx, &mail.Message{
+		To:      actor.Email,
+		Subject: subject,
+		Body:    in.Content,
+	})
+	if err != nil {
+		s.internalErr(w, fmt.Errorf("failed to send email: %w", err))
+		return
+	}
+
+	s.log.Info("admin sent email", "did", actor.Did, "sender_did", in.SenderDid)
+
+	s.jsonOK(w, &atproto.AdminSendEmail_Output{Sent: true})
+}
@@ -0,0 +1,388 @@
+package pds
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/jcalabro/atlas/internal/mail"
+	"github.com/jcalabro/atlas/internal/pds/db"
+	"github.com/jcalabro/atlas/internal/types"
+	"github.com/jcalabro/atlas/internal/util"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestAdminAccounts(t *testing.T) {
+	t.Parallel()
+
+	srv := testServer(t)
+	mailer := &mail.Fake{}
+	srv.hosts[testPDSHost].mailer = mailer
+	srv.hosts[testPDSHost].userInviteCodes = 2
+
+	call := func(t *testing.T, method, path string, handler http.HandlerFunc, in any, out any) *httptest.ResponseRecorder {
+		t.Helper()
+
+		var body bytes.Buffer
+		if in != nil {
+			require.NoError(t, json.NewEncoder(&body).Encode(in))
+		}
+
+		req := httptest.NewRequest(method, path, &body)
+		req = req.WithContext(context.WithValue(req.Context(), hostContextKey{}, srv.hosts[testPDSHost]))
+		w := httptest.NewRecorder()
+		handler(w, req)
+
+		if w.Code == http.StatusOK && out != nil {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), out))
+		}
+		return w
+	}
+
+	signup := func(t *testing.T) *atproto.ServerCreateAccount_Output {
+		t.Helper()
+		password := "secure-password-123"
+		resp := createAccount(t, srv, &atproto.ServerCreateAccount_Input{
+			Email:    uniqueEmail(),
+			Handle:   uniqueHandle(),
+			Password: &password,
+		})
+		require.Equal(t, http.StatusOK, resp.Code, resp.Body.Body.String())
+		return resp.Out
+	}
+
+	getInfo := func(t *testing.T, did string) (*httptest.ResponseRecorder, *atproto.AdminDefs_AccountView) {
+		t.Helper()
+		var view atproto.AdminDefs_AccountView
+		w := call(t, http.MethodGet, "/?did="+url.QueryEscape(did), srv.handleGetAccountInfo, nil, &view)
+		return w, &view
+	}
+
+	t.Run("gets account info", func(t *testing.T) {
+		t.Parallel()
+
+		account := signup(t)
+
+		w, view := getInfo(t, account.Did)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.Equal(t, account.Did, view.Did)
+		require.Equal(t, account.Handle, view.Handle)
+		require.NotNil(t, view.Email)
+		require.NotNil(t, view.InvitesDisabled)
+		require.False(t, *view.InvitesDisabled)
+
+		var infos atproto.AdminGetAccountInfos_Output
+		q := url.Values{"dids": {account.Did, "did:plc:adminmissing"}}
+		w = call(t, http.MethodGet, "/?"+q.Encode(), srv.handleGetAccountInfos, nil, &infos)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.Len(t, infos.Infos, 1)
+		require.Equal(t, account.Did, infos.Infos[0].Did)
+
+		w, _ = getInfo(t, "not-a-did")
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		w, _ = getInfo(t, "did:plc:adminmissing")
+		require.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("accounts on other hosts are hidden", func(t *testing.T) {
+		t.Parallel()
+
+		actor := &types.Actor{
+			Did:          "did:plc:adminotherhost" + util.RandString(8),
+			Email:        *uniqueEmail(),
+			Handle:       uniqueHandle(),
+			PdsHost:      "other.atlaspds.dev",
+			CreatedAt:    timestamppb.Now(),
+			PasswordHash: []byte("hash"),
+			SigningKey:   []byte("key"),
+			RotationKeys: [][]byte{[]byte("key")},
+			Active:       true,
+		}
+		require.NoError(t, srv.db.SaveActor(t.Context(), actor))
+
+		w, _ := getInfo(t, actor.Did)
+		require.Equal(t, http.StatusNotFound, w.Code)
+
+		w = call(t, http.MethodPost, "/", srv.handleDeleteAccount, &atproto.AdminDeleteAccount_Input{Did: actor.Did}, nil)
+		require.Equal(t, http.StatusNotFound, w.Code)
+
+		_, err := srv.db.GetActorByDID(t.Context(), actor.Did)
+		require.NoError(t, err)
+	})
+
+	t.Run("searches accounts by email prefix", func(t *testing.T) {
+		t.Parallel()
+
+		prefix := "search-" + util.RandString(12)
+		var dids []string
+		for i := range 3 {
+			password := "secure-password-123"
+			email := prefix + string(rune('a'+i)) + "@atlaspds.net"
+			resp := createAccount(t, srv, &atproto.ServerCreateAccount_Input{
+				Email:    &email,
+				Handle:   uniqueHandle(),
+				Password: &password,
+			})
+			require.Equal(t, http.StatusOK, resp.Code, resp.Body.Body.String())
+			dids = append(dids, resp.Out.Did)
+		}
+
+		var found []string
+		cursor := ""
+		for {
+			q := url.Values{"email": {prefix}, "limit": {"2"}, "cursor": {cursor}}
+			var out atproto.AdminSearchAccounts_Output
+			w := call(t, http.MethodGet, "/?"+q.Encode(), srv.handleSearchAccounts, nil, &out)
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+			for _, account := range out.Accounts {
+				require.True(t, strings.HasPrefix(*account.Email, prefix))
+				found = append(found, account.Did)
+			}
+			if out.Cursor == nil {
+				break
+			}
+			cursor = *out.Cursor
+		}
+		require.Equal(t, dids, found)
+	})
+
+	t.Run("updates email", func(t *testing.T) {
+		t.Parallel()
+
+		account := signup(t)
+		other := signup(t)
+		otherActor, err := srv.db.GetActorByDID(t.Context(), other.Did)
+		require.NoError(t, err)
+
+		email := *uniqueEmail()
+		w := call(t, http.MethodPost, "/", srv.handleUpdateAccountEmail, &atproto.AdminUpdateAccountEmail_Input{
+			Account: account.Handle,
+			Email:   email,
+		}, nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		actor, err := srv.db.GetActorByEmail(t.Context(), testPDSHost, email)
+		require.NoError(t, err)
+		require.Equal(t, account.Did, actor.Did)
+		require.False(t, actor.EmailConfirmed)
+
+		w = call(t, http.MethodPost, "/", srv.handleUpdateAccountEmail, &atproto.AdminUpdateAccountEmail_Input{
+			Account: account.Did,
+			Email:   otherActor.Email,
+		}, nil)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("updates handle", func(t *testing.T) {
+		t.Parallel()
+
+		account := signup(t)
+		handle := uniqueHandle()
+
+		cursor, err := srv.db.GetLatestSeq(t.Context())
+		require.NoError(t, err)
+
+		in := &atproto.AdminUpdateAccountHandle_Input{Did: account.Did, Handle: handle}
+		w := call(t, http.MethodPost, "/", srv.handleUpdateAccountHandle, in, nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		actor, err := srv.db.GetActorByHandle(t.Context(), handle)
+		require.NoError(t, err)
+		require.Equal(t, account.Did, actor.Did)
+
+		_, err = srv.db.GetActorByHandle(t.Context(), account.Handle)
+		require.ErrorIs(t, err, db.ErrNotFound)
+
+		op, err := srv.plc.GetLastOperation(t.Context(), account.Did)
+		require.NoError(t, err)
+		require.Equal(t, []string{"at://" + handle}, op.AlsoKnownAs)
+
+		events, _, err := srv.db.GetEventsSince(t.Context(), cursor, 100)
+		require.NoError(t, err)
+		var handles []string
+		for _, event := range events {
+			if event.Repo == account.Did {
+				handles = append(handles, event.Handle)
+			}
+		}
+		require.Equal(t, []string{handle}, handles)
+
+		// another account's handle can't be taken
+		other := signup(t)
+		in = &atproto.AdminUpdateAccountHandle_Input{Did: account.Did, Handle: other.Handle}
+		w = call(t, http.MethodPost, "/", srv.handleUpdateAccountHandle, in, nil)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("updates password and revokes sessions", func(t *testing.T) {
+		t.Parallel()
+
+		account := signup(t)
+
+		in := &atproto.AdminUpdateAccountPassword_Input{Did: account.Did, Password: "short"}
+		w := call(t, http.MethodPost, "/", srv.handleUpdateAccountPassword, in, nil)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+
+		in.Password = "a-brand-new-password"
+		w = call(t, http.MethodPost, "/", srv.handleUpdateAccountPassword, in, nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		actor, err := srv.db.GetActorByDID(t.Context(), account.Did)
+		require.NoError(t, err)
+		require.NoError(t, bcrypt.CompareHashAndPassword(actor.PasswordHash, []byte(in.Password)))
+
+		sessions, err := srv.db.ListSessions(t.Context(), account.Did)
+		require.NoError(t, err)
+		require.Empty(t, sessions)
+	})
+
+	t.Run("disables invites", func(t *testing.T) {
+		t.Parallel()
+
+		account := signup(t)
+		actor, err := srv.db.GetActorByDID(t.Context(), account.Did)
+		require.NoError(t, err)
+
+		codes, err := srv.db.EnsureAccountInviteCodes(t.Context(), testPDSHost, account.Did, 2, func() string {
+			return newInviteCode(srv.hosts[testPDSHost])
+		})
+		require.NoError(t, err)
+		require.Len(t, codes, 2)
+
+		note := "spamming invites"
+		w := call(t, http.MethodPost, "/", srv.handleDisableAccountInvites, &atproto.AdminDisableAccountInvites_Input{
+			Account: account.Did,
+			Note:    &note,
+		}, nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		w, view := getInfo(t, account.Did)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.True(t, *view.InvitesDisabled)
+		require.Equal(t, note, *view.InviteNote)
+		require.Len(t, view.Invites, 2)
+		for _, invite := range view.Invites {
+			require.True(t, invite.Disabled)
+		}
+
+		// no new codes are issued to the account
+		actor.InvitesDisabled = true
+		req := httptest.NewRequest(http.MethodGet, "/xrpc/com.atproto.server.getAccountInviteCodes", nil)
+		req = req.WithContext(context.WithValue(context.WithValue(req.Context(),
+			hostContextKey{}, srv.hosts[testPDSHost]), actorContextKey{}, actor))
+		rec := httptest.NewRecorder()
+		srv.handleGetAccountInviteCodes(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+		var out atproto.ServerGetAccountInviteCodes_Output
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &out))
+		require.Len(t, out.Codes, 2)
+	})
+
+	t.Run("deletes account", func(t *testing.T) {
+		t.Parallel()
+
+		account := signup(t)
+
+		cursor, err := srv.db.GetLatestSeq(t.Context())
+		require.NoError(t, err)
+
+		w := call(t, http.MethodPost, "/", srv.handleDeleteAccount, &atproto.AdminDeleteAccount_Input{Did: account.Did}, nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		_, err = srv.db.GetActorByDID(t.Context(), account.Did)
+		require.ErrorIs(t, err, db.ErrNotFound)
+		_, err = srv.db.GetActorByHandle(t.Context(), account.Handle)
+		require.ErrorIs(t, err, db.ErrNotFound)
+
+		events, _, err := srv.db.GetEventsSince(t.Context(), cursor, 100)
+		require.NoError(t, err)
+		var statuses []string
+		for _, event := range events {
+			if event.Repo == account.Did {
+				statuses = append(statuses, event.Status)
+			}
+		}
+		require.Equal(t, []string{"deleted"}, statuses)
+
+		w = call(t, http.MethodPost, "/", srv.handleDeleteAccount, &atproto.AdminDeleteAccount_Input{Did: account.Did}, nil)
+		require.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("sends email", func(t *testing.T) {
+		t.Parallel()
+
+		account := signup(t)
+		actor, err := srv.db.GetActorByDID(t.Context(), account.Did)
+		require.NoError(t, err)
+
+		subject := "about your account"
+		var out atproto.AdminSendEmail_Output
+		w := call(t, http.MethodPost, "/", srv.handleSendEmail, &atproto.AdminSendEmail_Input{
+			RecipientDid: account.Did,
+			SenderDid:    "did:plc:adminsender",
+			Subject:      &subject,
+			Content:      "hello there",
+		}, &out)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.True(t, out.Sent)
+
+		sent := mailer.Sent(actor.Email)
+		require.Len(t, sent, 1)
+		require.Equal(t, subject, sent[0].Subject)
+		require.Equal(t, "hello there", sent[0].Body)
+
+		bad := "hi\r\nBcc: eve@example.com"
+		w = call(t, http.MethodPost, "/", srv.handleSendEmail, &atproto.AdminSendEmail_Input{
+			RecipientDid: account.Did,
+			Subject:      &bad,
+			Content:      "hello there",
+		}, nil)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestAdminDIDs(t *testing.T) {
+	t.Parallel()
+
+	srv := testServer(t)
+
+	admin, adminSession := setupTestActor(t, srv, "did:plc:admindid"+util.RandString(8), *uniqueEmail(), uniqueHandle())
+	_, userSession := setupTestActor(t, srv, "did:plc:adminuser"+util.RandString(8), *uniqueEmail(), uniqueHandle())
+	srv.hosts[testPDSHost].adminDIDs = map[string]struct{}{admin.Did: {}}
+
+	handler := srv.adminMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	serve := func(token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/xrpc/com.atproto.admin.getAccountInfo", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req = req.WithContext(context.WithValue(req.Context(), hostContextKey{}, srv.hosts[testPDSHost]))
+
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w.Code
+	}
+
+	require.Equal(t, http.StatusNoContent, serve(adminSession.AccessToken))
+	require.Equal(t, http.StatusForbidden, serve(userSession.AccessToken))
+	require.Equal(t, http.StatusUnauthorized, serve("not-a-token"))
+
+	// basic auth is rejected since the host has no admin password
+	req := httptest.NewRequest(http.MethodGet, "/xrpc/com.atproto.admin.getAccountInfo", nil)
+	req.SetBasicAuth("admin", "")
+	req = req.WithContext(context.WithValue(req.Context(), hostContextKey{}, srv.hosts[testPDSHost]))
+	w := httptest.NewRecorder()
+	handler(w, req)
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+}
@@ -0,0 +1,732 @@
+package pds
+
+import (
+	"cmp"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	indigoutil "github.com/bluesky-social/indigo/util"
+	"github.com/ipfs/go-cid"
+	"github.com/jcalabro/atlas/internal/pds/db"
+	"github.com/jcalabro/atlas/internal/plc"
+	"github.com/jcalabro/atlas/internal/types"
+	"go.opentelemetry.io/otel"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// adminPageSize is the number of accounts or events loaded at a time by the admin commands
+const adminPageSize = 500
+
+// AdminArgs configures the admin commands
+type AdminArgs struct {
+	// ConfigFile is the PDS config, which provides each host's keys and settings
+	ConfigFile string
+
+	PLCURL string
+	FDB    db.Config
+}
+
+// Admin administers accounts and repos directly in FDB, without a running server. Every command
+// writes JSON lines to out, and mutations are recorded in the audit log with the actor "cli".
+type Admin struct {
+	s   *server
+	out io.Writer
+}
+
+// NewAdmin loads the config and connects to FDB and PLC the same way the server does
+func NewAdmin(ctx context.Context, out io.Writer, args *AdminArgs) (*Admin, error) {
+	log := slog.Default().With(slog.String("service", "atlas.admin"))
+	tracer := otel.Tracer("atlas.admin")
+
+	cfg, err := LoadConfig(args.ConfigFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+
+	plcClient, err := plc.NewClient(&plc.ClientArgs{
+		Tracer: tracer,
+		PLCURL: args.PLCURL,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize plc client: %w", err)
+	}
+
+	database, err := db.New(tracer, args.FDB)
+	if err != nil {
+		return nil, err
+	}
+
+	var bs *blobstore
+	if cfg.Blobstore != nil {
+		bs, err = newBlobstore(cfg.Blobstore)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize blobstore: %w", err)
+		}
+	}
+
+	s := &server{
+		log:    log,
+		tracer: tracer,
+
+		hosts:        cfg.Hosts,
+		staticHosts:  cfg.Hosts,
+		configFile:   args.ConfigFile,
+		hostRegistry: cfg.HostRegistry,
+
+		db:        database,
+		blobstore: bs,
+
+		directory: &identity.BaseDirectory{
+			PLCURL:     args.PLCURL,
+			HTTPClient: http.Client{Timeout: 10 * time.Second},
+		},
+		plc: plcClient,
+	}
+	database.SetKeyOpener(s)
+
+	if s.hostRegistry != nil {
+		registered, err := s.loadRegisteredHosts(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load registered hosts: %w", err)
+		}
+		s.setRegisteredHosts(registered)
+	}
+
+	return &Admin{s: s, out: out}, nil
+}
+
+func (a *Admin) print(v any) error {
+	return json.NewEncoder(a.out).Encode(v)
+}
+
+// account finds an account by DID or handle
+func (a *Admin) account(ctx context.Context, account string) (*types.Actor, error) {
+	var actor *types.Actor
+	var err error
+	if strings.HasPrefix(account, "did:") {
+		actor, err = a.s.db.GetActorByDID(ctx, account)
+	} else {
+		actor, err = a.s.db.GetActorByHandle(ctx, strings.ToLower(account))
+	}
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, fmt.Errorf("account %q not found", account)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get account: %w", err)
+	}
+
+	return actor, nil
+}
+
+// host returns the config of a host, which must be configured
+func (a *Admin) host(hostname string) (*loadedHostConfig, error) {
+	host := a.s.getHost(hostname)
+	if host == nil {
+		return nil, fmt.Errorf("host %q is not configured", hostname)
+	}
+	return host, nil
+}
+
+// generatePassword returns the password if one was given, or a random one if not. generated
+// reports whether the password should be shown to the operator.
+func generatePassword(password string) (pw string, generated bool, err error) {
+	if password == "" {
+		return rand.Text(), true, nil
+	}
+	if len(password) < minPasswordLength {
+		return "", false, fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+	return password, false, nil
+}
+
+type adminCreateAccountOutput struct {
+	Did      string `json:"did"`
+	Handle   string `json:"handle"`
+	Email    string `json:"email"`
+	PDSHost  string `json:"pdsHost"`
+	Password string `json:"password,omitempty"`
+}
+
+// CreateAccount creates an account on the host. A random password is generated and printed if
+// none is given. Invite codes and signup verification don't apply.
+func (a *Admin) CreateAccount(ctx context.Context, hostname, handle, email, password string) error {
+	host, err := a.host(hostname)
+	if err != nil {
+		return err
+	}
+
+	handle = strings.ToLower(handle)
+	parsed, err := syntax.ParseHandle(handle)
+	if err != nil {
+		return fmt.Errorf("invalid handle: %w", err)
+	}
+	if email == "" {
+		return fmt.Errorf("email is required")
+	}
+
+	password, generated, err := generatePassword(password)
+	if err != nil {
+		return err
+	}
+
+	_, err = a.s.directory.LookupHandle(ctx, parsed)
+	if err == nil {
+		return fmt.Errorf("handle %q is already taken", handle)
+	}
+	if !errors.Is(err, identity.ErrHandleNotFound) {
+		return fmt.Errorf("failed to resolve handle: %w", err)
+	}
+
+	existing, err := a.s.db.GetActorByEmail(ctx, host.hostname, email)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		return fmt.Errorf("failed to get actor by email: %w", err)
+	}
+	if existing != nil {
+		return fmt.Errorf("email %q is already in use on %s", email, host.hostname)
+	}
+
+	actor, err := a.s.createActor(ctx, host, handle, email, password, "")
+	if err != nil {
+		return err
+	}
+
+	a.s.auditAs(ctx, auditActorCLI, host.hostname, "com.atproto.server.createAccount", actor.Did,
+		nil, map[string]string{"handle": actor.Handle, "email": actor.Email})
+
+	out := &adminCreateAccountOutput{
+		Did:     actor.Did,
+		Handle:  actor.Handle,
+		Email:   actor.Email,
+		PDSHost: actor.PdsHost,
+	}
+	if generated {
+		out.Password = password
+	}
+
+	return a.print(out)
+}
+
+type adminAccountView struct {
+	*atproto.AdminDefs_AccountView
+	PDSHost   string `json:"pdsHost"`
+	Active    bool   `json:"active"`
+	TakenDown bool   `json:"takenDown"`
+	Head      string `json:"head"`
+	Rev       string `json:"rev"`
+}
+
+// GetAccount prints an account, found by DID or handle
+func (a *Admin) GetAccount(ctx context.Context, account string) error {
+	actor, err := a.account(ctx, account)
+	if err != nil {
+		return err
+	}
+
+	view, err := a.s.accountView(ctx, actor)
+	if err != nil {
+		return err
+	}
+
+	return a.print(&adminAccountView{
+		AdminDefs_AccountView: view,
+		PDSHost:               actor.PdsHost,
+		Active:                actor.Active,
+		TakenDown:             actor.Takedown != nil,
+		Head:                  actor.Head,
+		Rev:                   actor.Rev,
+	})
+}
+
+type adminAccountSummary struct {
+	Did       string `json:"did"`
+	Handle    string `json:"handle"`
+	Email     string `json:"email"`
+	CreatedAt string `json:"createdAt"`
+	Active    bool   `json:"active"`
+	TakenDown bool   `json:"takenDown"`
+}
+
+// ListAccounts prints every account on the host
+func (a *Admin) ListAccounts(ctx context.Context, hostname string) error {
+	var cursor string
+	for {
+		actors, next, err := a.s.db.ListActors(ctx, hostname, cursor, adminPageSize)
+		if err != nil {
+			return fmt.Errorf("failed to list actors: %w", err)
+		}
+
+		for _, actor := range actors {
+			err := a.print(&adminAccountSummary{
+				Did:       actor.Did,
+				Handle:    actor.Handle,
+				Email:     actor.Email,
+				CreatedAt: actor.CreatedAt.AsTime().Format(indigoutil.ISO8601),
+				Active:    actor.Active,
+				TakenDown: actor.Takedown != nil,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// DisableAccount takes an account down, the same as com.atproto.admin.updateSubjectStatus. The ref
+// is recorded with the takedown, and may be empty.
+func (a *Admin) DisableAccount(ctx context.Context, account, ref string) error {
+	takedown := &types.Takedown{Ref: ref, CreatedAt: timestamppb.Now()}
+	return a.setTakedown(ctx, account, takedown)
+}
+
+// EnableAccount reverses DisableAccount
+func (a *Admin) EnableAccount(ctx context.Context, account string) error {
+	return a.setTakedown(ctx, account, nil)
+}
+
+func (a *Admin) setTakedown(ctx context.Context, account string, takedown *types.Takedown) error {
+	actor, err := a.account(ctx, account)
+	if err != nil {
+		return err
+	}
+	host, err := a.host(actor.PdsHost)
+	if err != nil {
+		return err
+	}
+
+	subject := &db.Subject{Did: actor.Did}
+	if err := a.s.db.SetTakedown(ctx, subject, takedown); err != nil {
+		return fmt.Errorf("failed to update takedown: %w", err)
+	}
+
+	if (actor.Takedown != nil) != (takedown != nil) {
+		a.s.writeTakedownEvent(ctx, host, actor, takedown != nil)
+	}
+
+	a.s.auditAs(ctx, auditActorCLI, host.hostname, "com.atproto.admin.updateSubjectStatus", actor.Did,
+		takedownStatus(actor.Takedown), takedownStatus(takedown))
+
+	return a.print(&atproto.AdminUpdateSubjectStatus_Output{
+		Subject: &atproto.AdminUpdateSubjectStatus_Output_Subject{
+			AdminDefs_RepoRef: &atproto.AdminDefs_RepoRef{Did: actor.Did},
+		},
+		Takedown: takedownStatus(takedown),
+	})
+}
+
+// DeleteAccount permanently deletes an account and its repo and blobs
+func (a *Admin) DeleteAccount(ctx context.Context, account string) error {
+	actor, err := a.account(ctx, account)
+	if err != nil {
+		return err
+	}
+
+	if err := a.s.deleteAccount(ctx, actor); err != nil {
+		return err
+	}
+
+	a.s.auditAs(ctx, auditActorCLI, actor.PdsHost, "com.atproto.admin.deleteAccount", actor.Did,
+		map[string]string{"handle": actor.Handle, "email": actor.Email}, nil)
+
+	return a.print(map[string]string{"did": actor.Did, "handle": actor.Handle})
+}
+
+// ResetPassword sets the account's password and signs out all of its sessions. A random password
+// is generated and printed if none is given.
+func (a *Admin) ResetPassword(ctx context.Context, account, password string) error {
+	password, generated, err := generatePassword(password)
+	if err != nil {
+		return err
+	}
+
+	actor, err := a.account(ctx, account)
+	if err != nil {
+		return err
+	}
+
+	pwHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	if err := a.s.db.UpdateActorPassword(ctx, actor.Did, pwHash); err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+
+	// password hashes are never recorded
+	a.s.auditAs(ctx, auditActorCLI, actor.PdsHost, "com.atproto.admin.updateAccountPassword", actor.Did, nil, nil)
+
+	out := map[string]string{"did": actor.Did}
+	if generated {
+		out["password"] = password
+	}
+	return a.print(out)
+}
+
+type adminHostView struct {
+	Hostname           string   `json:"hostname"`
+	Source             string   `json:"source"`
+	ServiceDID         string   `json:"serviceDid,omitempty"`
+	UserDomains        []string `json:"userDomains,omitempty"`
+	InviteCodeRequired bool     `json:"inviteCodeRequired"`
+	KeysEncrypted      bool     `json:"keysEncrypted"`
+	Labeler            bool     `json:"labeler"`
+
+	// Disabled is only set for registered hosts, which aren't served while disabled
+	Disabled bool `json:"disabled,omitempty"`
+
+	// Overridden is set for registered hosts that aren't served because the config file has a host
+	// of the same name
+	Overridden bool `json:"overridden,omitempty"`
+}
+
+const (
+	hostSourceConfig   = "config"
+	hostSourceRegistry = "registry"
+)
+
+// ListHosts prints the hosts from the config file and the host registry, including registered
+// hosts that aren't being served
+func (a *Admin) ListHosts(ctx context.Context) error {
+	var recs []*types.RegisteredHost
+	if a.s.hostRegistry != nil {
+		var err error
+		recs, err = a.s.db.ListRegisteredHosts(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list registered hosts: %w", err)
+		}
+	}
+
+	a.s.hostsMu.RLock()
+	static := a.s.staticHosts
+	a.s.hostsMu.RUnlock()
+
+	var views []*adminHostView
+	for _, host := range a.s.allHosts() {
+		source := hostSourceRegistry
+		if _, ok := static[host.hostname]; ok {
+			source = hostSourceConfig
+		}
+
+		views = append(views, &adminHostView{
+			Hostname:           host.hostname,
+			Source:             source,
+			ServiceDID:         host.serviceDID,
+			UserDomains:        host.userDomains,
+			InviteCodeRequired: host.inviteCodeRequired,
+			KeysEncrypted:      host.keyring != nil,
+			Labeler:            host.labelSigner != nil,
+		})
+	}
+
+	// registered hosts that aren't served, since they're disabled or overridden
+	for _, rec := range recs {
+		_, overridden := static[rec.Hostname]
+		if !overridden && !rec.Disabled {
+			continue
+		}
+
+		views = append(views, &adminHostView{
+			Hostname:   rec.Hostname,
+			Source:     hostSourceRegistry,
+			Labeler:    rec.LabelSigningKey != nil,
+			Disabled:   rec.Disabled,
+			Overridden: overridden,
+		})
+	}
+
+	slices.SortFunc(views, func(a, b *adminHostView) int {
+		return cmp.Or(strings.Compare(a.Hostname, b.Hostname), strings.Compare(a.Source, b.Source))
+	})
+
+	for _, view := range views {
+		if err := a.print(view); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CreateHost adds a host to the host registry. The file is a host's table from the config file,
+// whose keys are read from the files it names and stored encrypted.
+func (a *Admin) CreateHost(ctx context.Context, hostname, file string) error {
+	return a.registerHost(ctx, hostname, file, true)
+}
+
+// UpdateHost replaces a registered host's config. Keys that the file doesn't name are kept.
+func (a *Admin) UpdateHost(ctx context.Context, hostname, file string) error {
+	return a.registerHost(ctx, hostname, file, false)
+}
+
+func (a *Admin) registerHost(ctx context.Context, hostname, file string, create bool) error {
+	host, keys, err := readHostFile(file)
+	if err != nil {
+		return err
+	}
+
+	before, after, _, err := a.s.registerHost(ctx, hostname, host, keys, create)
+	if err != nil {
+		return err
+	}
+
+	action := "net.atlaspds.admin.updateHost"
+	if create {
+		action = "net.atlaspds.admin.createHost"
+	}
+	a.s.auditAs(ctx, auditActorCLI, hostname, action, hostname,
+		newRegisteredHostState(before), newRegisteredHostState(after))
+
+	return a.print(a.s.registeredHostView(after))
+}
+
+// DisableHost stops every replica from serving a registered host. Its accounts and repos are kept.
+func (a *Admin) DisableHost(ctx context.Context, hostname string) error {
+	return a.setHostDisabled(ctx, hostname, true)
+}
+
+// EnableHost reverses DisableHost
+func (a *Admin) EnableHost(ctx context.Context, hostname string) error {
+	return a.setHostDisabled(ctx, hostname, false)
+}
+
+func (a *Admin) setHostDisabled(ctx context.Context, hostname string, disabled bool) error {
+	before, after, _, err := a.s.setHostDisabled(ctx, hostname, disabled)
+	if err != nil {
+		return err
+	}
+
+	action := "net.atlaspds.admin.enableHost"
+	if disabled {
+		action = "net.atlaspds.admin.disableHost"
+	}
+	a.s.auditAs(ctx, auditActorCLI, hostname, action, hostname,
+		newRegisteredHostState(before), newRegisteredHostState(after))
+
+	return a.print(a.s.registeredHostView(after))
+}
+
+// ExportRepo writes the account's repo to w as a CAR file, the same as com.atproto.sync.getRepo
+func (a *Admin) ExportRepo(ctx context.Context, account string, w io.Writer) error {
+	actor, err := a.account(ctx, account)
+	if err != nil {
+		return err
+	}
+
+	head, err := cid.Decode(actor.Head)
+	if err != nil {
+		return fmt.Errorf("invalid repo head: %w", err)
+	}
+
+	cs := &carStream{w: w, root: head}
+	if err := a.s.db.StreamRepo(ctx, actor.Did, head, cs.writeBlock); err != nil {
+		return fmt.Errorf("failed to export repo: %w", err)
+	}
+
+	return cs.finish()
+}
+
+// ImportRepo replaces the records in the account's repo with those in the CAR file read from r,
+// which must be a repo of the same DID
+func (a *Admin) ImportRepo(ctx context.Context, account string, r io.Reader) error {
+	actor, err := a.account(ctx, account)
+	if err != nil {
+		return err
+	}
+
+	res, err := a.s.importRepo(ctx, actor, r)
+	if err != nil {
+		return err
+	}
+
+	if res.Commits > 0 {
+		a.s.auditAs(ctx, auditActorCLI, actor.PdsHost, "com.atproto.repo.importRepo", actor.Did,
+			map[string]string{"rev": actor.Rev}, map[string]string{"rev": res.Rev})
+	}
+
+	return a.print(res)
+}
+
+type adminEventView struct {
+	Seq     int64          `json:"seq"`
+	Type    string         `json:"type"`
+	PDSHost string         `json:"pdsHost"`
+	Repo    string         `json:"repo"`
+	Time    string         `json:"time"`
+	Commit  string         `json:"commit,omitempty"`
+	Rev     string         `json:"rev,omitempty"`
+	Since   string         `json:"since,omitempty"`
+	TooBig  bool           `json:"tooBig,omitempty"`
+	Ops     []*adminOpView `json:"ops,omitempty"`
+	Handle  string         `json:"handle,omitempty"`
+	Active  *bool          `json:"active,omitempty"`
+	Status  string         `json:"status,omitempty"`
+}
+
+type adminOpView struct {
+	Action string `json:"action"`
+	Path   string `json:"path"`
+	Cid    string `json:"cid,omitempty"`
+}
+
+func newAdminEventView(event *types.RepoEvent) *adminEventView {
+	view := &adminEventView{
+		Seq:     event.Seq,
+		PDSHost: event.PdsHost,
+		Repo:    event.Repo,
+		Time:    event.Time.AsTime().Format(indigoutil.ISO8601),
+	}
+
+	switch event.EventType {
+	case types.EventType_EVENT_TYPE_IDENTITY:
+		view.Type = "identity"
+		view.Handle = event.Handle
+		return view
+	case types.EventType_EVENT_TYPE_ACCOUNT:
+		view.Type = "account"
+		view.Active = &event.Active
+		view.Status = event.Status
+		return view
+	case types.EventType_EVENT_TYPE_SYNC:
+		view.Type = "sync"
+	default:
+		// EVENT_TYPE_UNSPECIFIED and EVENT_TYPE_COMMIT are both commit events
+		view.Type = "commit"
+		view.Since = event.Since
+		view.TooBig = event.TooBig
+	}
+
+	view.Rev = event.Rev
+	if c, err := cid.Cast(event.Commit); err == nil {
+		view.Commit = c.String()
+	}
+	for _, op := range event.Ops {
+		opView := &adminOpView{Action: op.Action, Path: op.Path}
+		if c, err := cid.Cast(op.Cid); err == nil {
+			opView.Cid = c.String()
+		}
+		view.Ops = append(view.Ops, opView)
+	}
+
+	return view
+}
+
+// TailEventsArgs selects the events printed by TailEvents
+type TailEventsArgs struct {
+	// Host only prints the events of one host if set
+	Host string
+
+	// Cursor replays events after this sequence number if set. Otherwise only new events are
+	// printed.
+	Cursor *int64
+
+	// Follow waits for new events rather than returning once the end of the stream is reached
+	Follow bool
+}
+
+// TailEvents prints the events that are sent to the firehose
+func (a *Admin) TailEvents(ctx context.Context, args *TailEventsArgs) error {
+	var cursor []byte
+	if args.Cursor == nil {
+		var err error
+		cursor, err = a.s.db.GetLatestSeq(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get latest seq: %w", err)
+		}
+	}
+
+	next := func() ([]*types.RepoEvent, []byte, error) {
+		if cursor == nil && args.Cursor != nil {
+			return a.s.db.GetEventsSinceSeq(ctx, *args.Cursor, adminPageSize)
+		}
+		return a.s.db.GetEventsSince(ctx, cursor, adminPageSize)
+	}
+
+	for {
+		// the watch is set up before reading so that events written in between aren't missed
+		var watch fdb.FutureNil
+		if args.Follow {
+			var err error
+			watch, err = a.s.db.WatchLatestSeq(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to watch events: %w", err)
+			}
+		}
+
+		for {
+			events, nextCursor, err := next()
+			if err != nil {
+				return fmt.Errorf("failed to get events: %w", err)
+			}
+			if len(events) == 0 {
+				break
+			}
+			cursor = nextCursor
+
+			for _, event := range events {
+				if args.Host != "" && event.PdsHost != args.Host {
+					continue
+				}
+				if err := a.print(newAdminEventView(event)); err != nil {
+					return err
+				}
+			}
+		}
+
+		if !args.Follow {
+			return nil
+		}
+
+		// FDB's futures don't have a channel interface
+		watchDone := make(chan struct{})
+		go func() {
+			watch.BlockUntilReady()
+			close(watchDone)
+		}()
+
+		select {
+		case <-ctx.Done():
+			watch.Cancel()
+			return nil
+		case <-watchDone:
+		}
+	}
+}
+
+// GenerateJWTKey writes a new ES256 private key to out in the PEM format expected by a host's
+// jwt_signing_key
+func GenerateJWTKey(out io.Writer) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to marshal key: %w", err)
+	}
+
+	return pem.Encode(out, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
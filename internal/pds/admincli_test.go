@@ -0,0 +1,222 @@
+package pds
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/jcalabro/atlas/internal/types"
+	"github.com/jcalabro/atlas/internal/util"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestGenerateJWTKey(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	require.NoError(t, GenerateJWTKey(&buf))
+
+	path := filepath.Join(t.TempDir(), "jwt.pem")
+	require.NoError(t, os.WriteFile(path, buf.Bytes(), 0o600))
+
+	key, err := loadSigningKey(path)
+	require.NoError(t, err)
+	require.Equal(t, "P-256", key.Curve.Params().Name)
+}
+
+func TestGeneratePassword(t *testing.T) {
+	t.Parallel()
+
+	pw, generated, err := generatePassword("")
+	require.NoError(t, err)
+	require.True(t, generated)
+	require.GreaterOrEqual(t, len(pw), minPasswordLength)
+
+	pw, generated, err = generatePassword("correct-horse-battery")
+	require.NoError(t, err)
+	require.False(t, generated)
+	require.Equal(t, "correct-horse-battery", pw)
+
+	_, _, err = generatePassword("short")
+	require.Error(t, err)
+}
+
+func TestAdminEventView(t *testing.T) {
+	t.Parallel()
+
+	commitCID, err := cid.Decode("bafyreie5737gdxlw5i64vzichcalba3z2v5n6icifvx5xytvske7mr3hpm")
+	require.NoError(t, err)
+
+	view := newAdminEventView(&types.RepoEvent{
+		Seq:       7,
+		PdsHost:   testPDSHost,
+		Repo:      "did:plc:alice",
+		Rev:       "3l2",
+		Since:     "3l1",
+		Commit:    commitCID.Bytes(),
+		Time:      timestamppb.Now(),
+		EventType: types.EventType_EVENT_TYPE_COMMIT,
+		Ops: []*types.RepoOp{
+			{Action: "create", Path: "app.bsky.feed.post/3l2", Cid: commitCID.Bytes()},
+			{Action: "delete", Path: "app.bsky.feed.post/3l1"},
+		},
+	})
+	require.Equal(t, "commit", view.Type)
+	require.Equal(t, int64(7), view.Seq)
+	require.Equal(t, commitCID.String(), view.Commit)
+	require.Equal(t, "3l1", view.Since)
+	require.Len(t, view.Ops, 2)
+	require.Equal(t, commitCID.String(), view.Ops[0].Cid)
+	require.Empty(t, view.Ops[1].Cid)
+
+	view = newAdminEventView(&types.RepoEvent{
+		Repo:      "did:plc:alice",
+		Time:      timestamppb.Now(),
+		EventType: types.EventType_EVENT_TYPE_ACCOUNT,
+		Status:    "takendown",
+	})
+	require.Equal(t, "account", view.Type)
+	require.NotNil(t, view.Active)
+	require.False(t, *view.Active)
+	require.Equal(t, "takendown", view.Status)
+
+	view = newAdminEventView(&types.RepoEvent{
+		Repo:      "did:plc:alice",
+		Time:      timestamppb.Now(),
+		EventType: types.EventType_EVENT_TYPE_IDENTITY,
+		Handle:    "alice.dev.atlaspds.dev",
+	})
+	require.Equal(t, "identity", view.Type)
+	require.Equal(t, "alice.dev.atlaspds.dev", view.Handle)
+	require.Nil(t, view.Active)
+}
+
+func TestAdmin(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	srv := testServer(t)
+	var out bytes.Buffer
+	admin := &Admin{s: srv, out: &out}
+
+	// decode returns the last JSON line printed
+	decode := func(v any) {
+		t.Helper()
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		require.NoError(t, json.Unmarshal([]byte(lines[len(lines)-1]), v))
+		out.Reset()
+	}
+
+	handle := "admincli" + strings.ToLower(util.RandString(8)) + ".dev.atlaspds.dev"
+	email := handle + "@example.com"
+
+	require.Error(t, admin.CreateAccount(ctx, "unknown.example.com", handle, email, ""))
+	require.Error(t, admin.CreateAccount(ctx, testPDSHost, handle, email, "short"))
+
+	require.NoError(t, admin.CreateAccount(ctx, testPDSHost, strings.ToUpper(handle), email, ""))
+	var created adminCreateAccountOutput
+	decode(&created)
+	require.Equal(t, handle, created.Handle)
+	require.NotEmpty(t, created.Password)
+
+	actor, err := srv.db.GetActorByDID(ctx, created.Did)
+	require.NoError(t, err)
+	require.NoError(t, bcrypt.CompareHashAndPassword(actor.PasswordHash, []byte(created.Password)))
+
+	// the email is unique per host
+	require.Error(t, admin.CreateAccount(ctx, testPDSHost, "other"+handle, email, ""))
+
+	t.Run("get and list", func(t *testing.T) {
+		require.NoError(t, admin.GetAccount(ctx, handle))
+		var view adminAccountView
+		decode(&view)
+		require.Equal(t, created.Did, view.Did)
+		require.Equal(t, testPDSHost, view.PDSHost)
+		require.True(t, view.Active)
+		require.False(t, view.TakenDown)
+
+		require.Error(t, admin.GetAccount(ctx, "did:plc:doesnotexist"))
+
+		require.NoError(t, admin.ListAccounts(ctx, testPDSHost))
+		require.Contains(t, out.String(), created.Did)
+		out.Reset()
+	})
+
+	t.Run("disable and enable", func(t *testing.T) {
+		require.NoError(t, admin.DisableAccount(ctx, created.Did, "ticket-1"))
+		out.Reset()
+
+		actor, err := srv.db.GetActorByDID(ctx, created.Did)
+		require.NoError(t, err)
+		require.NotNil(t, actor.Takedown)
+		require.Equal(t, "ticket-1", actor.Takedown.Ref)
+
+		require.NoError(t, admin.EnableAccount(ctx, created.Did))
+		out.Reset()
+
+		actor, err = srv.db.GetActorByDID(ctx, created.Did)
+		require.NoError(t, err)
+		require.Nil(t, actor.Takedown)
+	})
+
+	t.Run("reset password", func(t *testing.T) {
+		require.NoError(t, admin.ResetPassword(ctx, created.Did, "a-brand-new-password"))
+		var res map[string]string
+		decode(&res)
+		require.Empty(t, res["password"])
+
+		actor, err := srv.db.GetActorByDID(ctx, created.Did)
+		require.NoError(t, err)
+		require.NoError(t, bcrypt.CompareHashAndPassword(actor.PasswordHash, []byte("a-brand-new-password")))
+	})
+
+	t.Run("export and import", func(t *testing.T) {
+		rkey := createTestRecordDirect(t, srv, actor, "app.bsky.feed.post", map[string]any{"text": "first"})
+		createTestRecordDirect(t, srv, actor, "app.bsky.feed.post", map[string]any{"text": "second"})
+
+		var car bytes.Buffer
+		require.NoError(t, admin.ExportRepo(ctx, created.Did, &car))
+		require.NotZero(t, car.Len())
+
+		// diverge from the export, then import it to undo the changes
+		putTestRecordDirect(t, srv, actor, "app.bsky.feed.post", rkey, map[string]any{"text": "edited"})
+		createTestRecordDirect(t, srv, actor, "app.bsky.feed.like", map[string]any{"subject": "x"})
+
+		require.NoError(t, admin.ImportRepo(ctx, created.Did, bytes.NewReader(car.Bytes())))
+		var res importRepoResult
+		decode(&res)
+		require.Equal(t, 1, res.Commits)
+		require.Equal(t, 1, res.Written)
+		require.Equal(t, 1, res.Deleted)
+		require.Equal(t, 1, res.Unchanged)
+
+		collections, err := srv.db.GetCollections(ctx, created.Did)
+		require.NoError(t, err)
+		require.Equal(t, []string{"app.bsky.feed.post"}, collections)
+
+		// importing again is a no-op
+		require.NoError(t, admin.ImportRepo(ctx, created.Did, bytes.NewReader(car.Bytes())))
+		decode(&res)
+		require.Zero(t, res.Commits)
+		require.Equal(t, 2, res.Unchanged)
+
+		// repos of other accounts are rejected
+		other, _ := setupTestActor(t, srv, "did:plc:admincli"+strings.ToLower(util.RandString(8)),
+			"other-"+email, "other"+handle)
+		require.Error(t, admin.ImportRepo(ctx, other.Did, bytes.NewReader(car.Bytes())))
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		require.NoError(t, admin.DeleteAccount(ctx, handle))
+		out.Reset()
+
+		_, err := admin.account(ctx, created.Did)
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,251 @@
+package pds
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+
+	indigoutil "github.com/bluesky-social/indigo/util"
+	"github.com/jcalabro/atlas/internal/pds/db"
+	"github.com/jcalabro/atlas/internal/types"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	maxListAuditEvents = 100
+
+	// auditActorAdmin is the actor recorded for requests authenticated with the shared admin password
+	auditActorAdmin = "admin"
+
+	// auditActorSystem is the actor recorded for mutations the PDS makes on its own, like config reloads
+	auditActorSystem = "system"
+
+	// auditActorCLI is the actor recorded for mutations made with the atlas admin commands
+	auditActorCLI = "cli"
+
+	auditActionConfigReload = "net.atlaspds.config.reload"
+)
+
+// auditFile appends audit events to a JSONL file, one event per line, so they can be shipped to
+// systems outside of FDB
+type auditFile struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func openAuditFile(path string) (*auditFile, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log file: %w", err)
+	}
+
+	return &auditFile{file: file}, nil
+}
+
+func (f *auditFile) write(event *auditEventView) error {
+	buf, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit event: %w", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, err := f.file.Write(append(buf, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit event: %w", err)
+	}
+
+	return nil
+}
+
+func (f *auditFile) Close() error {
+	return f.file.Close()
+}
+
+// adminActor returns who is making an admin request. Admins using their access token are recorded
+// by DID, and the shared admin password as "admin".
+func adminActor(ctx context.Context) string {
+	if actor := actorFromContext(ctx); actor != nil {
+		return actor.Did
+	}
+	return auditActorAdmin
+}
+
+// audit records an admin mutation of subject. before and after are JSON encoded, and may be nil
+// when there's no state worth recording.
+func (s *server) audit(ctx context.Context, host *loadedHostConfig, action, subject string, before, after any) {
+	s.auditAs(ctx, adminActor(ctx), host.hostname, action, subject, before, after)
+}
+
+// auditAs records a mutation of subject made by actor on the given host
+func (s *server) auditAs(ctx context.Context, actor, hostname, action, subject string, before, after any) {
+	s.appendAuditEvent(ctx, &types.AuditEvent{
+		PdsHost:   hostname,
+		Actor:     actor,
+		Action:    action,
+		Subject:   subject,
+		Before:    auditJSON(before),
+		After:     auditJSON(after),
+		RequestId: requestIDFromContext(ctx),
+		CreatedAt: timestamppb.Now(),
+	})
+}
+
+// appendAuditEvent stores the event and copies it to the audit log file, if there is one. The
+// mutation being audited has already happened, so failures are logged rather than returned.
+func (s *server) appendAuditEvent(ctx context.Context, event *types.AuditEvent) {
+	id, err := s.db.AppendAuditEvent(ctx, event)
+	if err != nil {
+		s.log.Error("failed to store audit event", "err", err, "action", event.Action, "subject", event.Subject)
+	}
+	event.Id = id
+
+	if s.auditFile != nil {
+		if err := s.auditFile.write(newAuditEventView(event)); err != nil {
+			s.log.Error("failed to write audit log file", "err", err, "action", event.Action, "subject", event.Subject)
+		}
+	}
+}
+
+// auditJSON encodes the before or after state of an audited mutation
+func auditJSON(v any) string {
+	if v == nil {
+		return ""
+	}
+
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+
+	return string(buf)
+}
+
+// auditConfigReload records a config reload in the audit log of every host that was or is now
+// configured. The config is identified by the digest of its file.
+func (s *server) auditConfigReload(ctx context.Context, before, after map[string]*loadedHostConfig, beforeDigest, afterDigest string) {
+	hostnames := make(map[string]struct{}, len(after))
+	for hostname := range before {
+		hostnames[hostname] = struct{}{}
+	}
+	for hostname := range after {
+		hostnames[hostname] = struct{}{}
+	}
+
+	for hostname := range hostnames {
+		_, wasConfigured := before[hostname]
+		_, isConfigured := after[hostname]
+
+		s.auditAs(ctx, auditActorSystem, hostname, auditActionConfigReload, s.configFile,
+			&configState{SHA256: beforeDigest, Configured: wasConfigured},
+			&configState{SHA256: afterDigest, Configured: isConfigured})
+	}
+}
+
+type configState struct {
+	SHA256     string `json:"sha256"`
+	Configured bool   `json:"configured"`
+}
+
+// configDigest returns the hex sha256 of the config file, or an empty string if it can't be read
+func configDigest(path string) string {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:])
+}
+
+type auditEventView struct {
+	ID        string          `json:"id"`
+	PDSHost   string          `json:"pdsHost"`
+	Actor     string          `json:"actor"`
+	Action    string          `json:"action"`
+	Subject   string          `json:"subject,omitempty"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+	RequestID string          `json:"requestId,omitempty"`
+	CreatedAt string          `json:"createdAt"`
+}
+
+func newAuditEventView(event *types.AuditEvent) *auditEventView {
+	return &auditEventView{
+		ID:        event.Id,
+		PDSHost:   event.PdsHost,
+		Actor:     event.Actor,
+		Action:    event.Action,
+		Subject:   event.Subject,
+		Before:    json.RawMessage(event.Before),
+		After:     json.RawMessage(event.After),
+		RequestID: event.RequestId,
+		CreatedAt: event.CreatedAt.AsTime().Format(indigoutil.ISO8601),
+	}
+}
+
+type listAuditEventsOutput struct {
+	Cursor *string           `json:"cursor,omitempty"`
+	Events []*auditEventView `json:"events"`
+}
+
+// handleListAuditEvents lists the host's audit log, newest first, optionally only the events for
+// one subject or by one actor
+func (s *server) handleListAuditEvents(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	span := spanFromContext(ctx)
+	defer span.End()
+
+	host := hostFromContext(ctx)
+
+	limit, err := parseIntParam(r, "limit", 50)
+	if err != nil || limit < 1 {
+		s.badRequest(w, fmt.Errorf("invalid limit"))
+		return
+	}
+
+	q := &db.AuditQuery{
+		Host:    host.hostname,
+		Subject: r.URL.Query().Get("subject"),
+		Actor:   r.URL.Query().Get("actor"),
+		Cursor:  r.URL.Query().Get("cursor"),
+		Limit:   int(min(limit, maxListAuditEvents)),
+	}
+
+	span.SetAttributes(
+		attribute.String("subject", q.Subject),
+		attribute.String("actor", q.Actor),
+	)
+
+	if q.Subject != "" && q.Actor != "" {
+		s.badRequest(w, fmt.Errorf("only one of subject and actor may be given"))
+		return
+	}
+
+	events, next, err := s.db.ListAuditEvents(ctx, q)
+	if errors.Is(err, db.ErrInvalidAuditCursor) {
+		s.badRequest(w, fmt.Errorf("invalid cursor"))
+		return
+	}
+	if err != nil {
+		s.internalErr(w, fmt.Errorf("failed to list audit events: %w", err))
+		return
+	}
+
+	out := &listAuditEventsOutput{
+		Cursor: nextCursorOrNil(next),
+		Events: make([]*auditEventView, 0, len(events)),
+	}
+	for _, event := range events {
+		out.Events = append(out.Events, newAuditEventView(event))
+	}
+
+	s.jsonOK(w, out)
+}
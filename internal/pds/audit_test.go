@@ -0,0 +1,201 @@
+package pds
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/jcalabro/atlas/internal/types"
+	"github.com/jcalabro/atlas/internal/util"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// readAuditFile returns the events written to an audit log file
+func readAuditFile(t *testing.T, path string) []*auditEventView {
+	t.Helper()
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close() //nolint:errcheck
+
+	var events []*auditEventView
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event auditEventView
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		events = append(events, &event)
+	}
+	require.NoError(t, scanner.Err())
+
+	return events
+}
+
+func TestAuditFile(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	f, err := openAuditFile(path)
+	require.NoError(t, err)
+
+	event := &types.AuditEvent{
+		Id:        "0000000000000001",
+		PdsHost:   testPDSHost,
+		Actor:     "admin",
+		Action:    "com.atproto.admin.updateAccountHandle",
+		Subject:   "did:plc:alice",
+		Before:    auditJSON(map[string]string{"handle": "old.example.com"}),
+		After:     auditJSON(map[string]string{"handle": "new.example.com"}),
+		RequestId: "request-1",
+		CreatedAt: timestamppb.Now(),
+	}
+	require.NoError(t, f.write(newAuditEventView(event)))
+
+	event.Before, event.After = "", ""
+	require.NoError(t, f.write(newAuditEventView(event)))
+	require.NoError(t, f.Close())
+
+	// reopening appends rather than truncating
+	f, err = openAuditFile(path)
+	require.NoError(t, err)
+	require.NoError(t, f.write(newAuditEventView(event)))
+	require.NoError(t, f.Close())
+
+	events := readAuditFile(t, path)
+	require.Len(t, events, 3)
+	require.Equal(t, "did:plc:alice", events[0].Subject)
+	require.JSONEq(t, `{"handle":"old.example.com"}`, string(events[0].Before))
+	require.JSONEq(t, `{"handle":"new.example.com"}`, string(events[0].After))
+	require.Equal(t, "request-1", events[0].RequestID)
+	require.Empty(t, events[1].Before)
+	require.Empty(t, events[1].After)
+}
+
+func TestConfigDigest(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	require.Empty(t, configDigest(path))
+
+	require.NoError(t, os.WriteFile(path, []byte("[hosts]\n"), 0o600))
+	digest := configDigest(path)
+	require.Len(t, digest, 64)
+
+	require.NoError(t, os.WriteFile(path, []byte("[hosts.a]\n"), 0o600))
+	require.NotEqual(t, digest, configDigest(path))
+}
+
+func TestListAuditEvents(t *testing.T) {
+	t.Parallel()
+
+	srv := testServer(t)
+	host := "audit-" + strings.ToLower(util.RandString(8)) + ".dev.atlaspds.dev"
+	srv.hosts[testPDSHost].hostname = host
+
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	var err error
+	srv.auditFile, err = openAuditFile(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, srv.auditFile.Close()) })
+
+	did := "did:plc:audit" + strings.ToLower(util.RandString(8))
+	setupTestActor(t, srv, did, "audit@example.com", "audit"+strings.ToLower(util.RandString(8))+".dev.atlaspds.dev")
+
+	for _, email := range []string{"audit2@example.com", "audit3@example.com"} {
+		body, err := json.Marshal(&atproto.AdminUpdateAccountEmail_Input{Account: did, Email: email})
+		require.NoError(t, err)
+
+		req := addTestHostContext(srv, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+		req = req.WithContext(context.WithValue(req.Context(), requestIDContextKey{}, "request-"+email))
+		w := httptest.NewRecorder()
+		srv.handleUpdateAccountEmail(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+
+	list := func(t *testing.T, query string) *listAuditEventsOutput {
+		t.Helper()
+
+		req := addTestHostContext(srv, httptest.NewRequest(http.MethodGet, "/?"+query, nil))
+		w := httptest.NewRecorder()
+		srv.handleListAuditEvents(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var out listAuditEventsOutput
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &out))
+		return &out
+	}
+
+	page := list(t, "subject="+did+"&limit=1")
+	require.Len(t, page.Events, 1)
+	require.NotNil(t, page.Cursor)
+
+	latest := page.Events[0]
+	require.Equal(t, "com.atproto.admin.updateAccountEmail", latest.Action)
+	require.Equal(t, "admin", latest.Actor)
+	require.Equal(t, did, latest.Subject)
+	require.Equal(t, "request-audit3@example.com", latest.RequestID)
+	require.JSONEq(t, `{"email":"audit2@example.com"}`, string(latest.Before))
+	require.JSONEq(t, `{"email":"audit3@example.com"}`, string(latest.After))
+
+	page = list(t, "subject="+did+"&cursor="+*page.Cursor)
+	require.Len(t, page.Events, 1)
+	require.Nil(t, page.Cursor)
+	require.Equal(t, "request-audit2@example.com", page.Events[0].RequestID)
+
+	require.Len(t, list(t, "actor=admin").Events, 2)
+	require.Empty(t, list(t, "actor=did:plc:someoneelse").Events)
+
+	// the file gets the same events, with the same ids
+	events := readAuditFile(t, path)
+	require.Len(t, events, 2)
+	require.Equal(t, latest.ID, events[1].ID)
+
+	for _, query := range []string{"cursor=abc", "limit=0", "subject=" + did + "&actor=admin"} {
+		req := addTestHostContext(srv, httptest.NewRequest(http.MethodGet, "/?"+query, nil))
+		w := httptest.NewRecorder()
+		srv.handleListAuditEvents(w, req)
+		require.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
+
+func TestAuditConfigReload(t *testing.T) {
+	t.Parallel()
+
+	srv := testServer(t)
+	srv.configFile = filepath.Join(t.TempDir(), "config.toml")
+
+	kept := "kept-" + strings.ToLower(util.RandString(8)) + ".dev.atlaspds.dev"
+	removed := "removed-" + strings.ToLower(util.RandString(8)) + ".dev.atlaspds.dev"
+	before := map[string]*loadedHostConfig{kept: {hostname: kept}, removed: {hostname: removed}}
+	after := map[string]*loadedHostConfig{kept: {hostname: kept}}
+
+	srv.auditConfigReload(t.Context(), before, after, "before", "after")
+
+	for hostname, configured := range map[string]bool{kept: true, removed: false} {
+		srv.hosts[testPDSHost].hostname = hostname
+		req := addTestHostContext(srv, httptest.NewRequest(http.MethodGet, "/", nil))
+		w := httptest.NewRecorder()
+		srv.handleListAuditEvents(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var out listAuditEventsOutput
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &out))
+		require.Len(t, out.Events, 1)
+		require.Equal(t, auditActorSystem, out.Events[0].Actor)
+		require.Equal(t, auditActionConfigReload, out.Events[0].Action)
+		require.JSONEq(t, `{"sha256":"before","configured":true}`, string(out.Events[0].Before))
+
+		var state configState
+		require.NoError(t, json.Unmarshal(out.Events[0].After, &state))
+		require.Equal(t, "after", state.SHA256)
+		require.Equal(t, configured, state.Configured)
+	}
+}
@@ -197,6 +197,18 @@ func (s *server) handleGetBlob(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	takenDown, err := s.db.IsTakenDown(ctx, &db.Subject{Did: did, Cid: blobCID.Bytes()})
+	if errors.Is(err, db.ErrNotFound) || takenDown {
+		metrics.BlobDownloads.WithLabelValues("not_found").Inc()
+		s.notFound(w, fmt.Errorf("blob not found"))
+		return
+	}
+	if err != nil {
+		metrics.BlobDownloads.WithLabelValues("error").Inc()
+		s.internalErr(w, fmt.Errorf("failed to get takedown status: %w", err))
+		return
+	}
+
 	// verify blob exists in our database
 	blob, err := s.db.GetBlob(ctx, did, blobCID.Bytes())
 	if errors.Is(err, db.ErrNotFound) {
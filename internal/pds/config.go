@@ -2,18 +2,38 @@ package pds
 
 import (
 	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
+	"maps"
+	"net/url"
 	"os"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/jcalabro/atlas/internal/envelope"
+	"github.com/jcalabro/atlas/internal/mail"
+	"github.com/jcalabro/atlas/internal/verify"
 )
 
 // Config represents the TOML configuration file structure
 type Config struct {
-	Hosts     map[string]Host  `toml:"hosts"`
-	Blobstore *BlobstoreConfig `toml:"blobstore"`
+	Hosts        map[string]Host     `toml:"hosts"`
+	Blobstore    *BlobstoreConfig    `toml:"blobstore"`
+	HostRegistry *HostRegistryConfig `toml:"host_registry"`
+	TLS          *TLSConfig          `toml:"tls"`
+
+	// TrustedProxies are the addresses or CIDR ranges of the load balancers in front of the PDS.
+	// The client address in X-Forwarded-For is only honored on connections from them. If empty,
+	// it's honored on every connection unless the PDS terminates TLS itself. Changes take effect on
+	// restart rather than on reload.
+	TrustedProxies []string `toml:"trusted_proxies"`
 }
 
 // BlobstoreConfig contains S3-compatible storage settings
@@ -33,8 +53,58 @@ type Host struct {
 	ContactEmail   string   `toml:"contact_email"`
 	PrivacyPolicy  string   `toml:"privacy_policy"`
 	TermsOfService string   `toml:"terms_of_service"`
+
+	// AdminPassword enables the admin API for this host via HTTP basic auth as the "admin" user.
+	// The admin API is disabled if this is empty.
+	AdminPassword string `toml:"admin_password"`
+
+	// AdminDIDs are accounts on this host that may use the admin API with their access token
+	AdminDIDs []string `toml:"admin_dids"`
+
+	// KEKFile is the path to a base64-encoded 32 byte key-encryption key that's used to encrypt
+	// the private keys of this host's accounts. KEKEnv names an environment variable holding the
+	// key instead. Private keys are stored unencrypted if neither is set.
+	KEKFile string `toml:"kek_file"`
+	KEKEnv  string `toml:"kek_env"`
+
+	// PreviousKEKFiles are key-encryption keys that were rotated out. They're only used to
+	// decrypt keys that haven't yet been re-wrapped with the current key-encryption key.
+	PreviousKEKFiles []string `toml:"previous_kek_files"`
+
+	// Relays are the base URLs of relays that should be asked to crawl this host
+	Relays []string `toml:"relays"`
+
+	// RelayAlertMinutes is how long a configured relay may go without a firehose
+	// subscription before it's flagged as disconnected (defaults to 15)
+	RelayAlertMinutes int `toml:"relay_alert_minutes"`
+
+	// RateLimits overrides the default request budgets for this host
+	RateLimits RateLimits `toml:"rate_limits"`
+
+	// InviteCodeRequired makes signups on this host invite-only
+	InviteCodeRequired bool `toml:"invite_code_required"`
+
+	// UserInviteCodes is the number of single-use invite codes each account may hand out
+	UserInviteCodes int `toml:"user_invite_codes"`
+
+	// SignupVerification requires signups on this host to pass a captcha or phone verification
+	SignupVerification SignupVerification `toml:"signup_verification"`
+
+	// Email configures how mail is sent to this host's accounts
+	Email EmailConfig `toml:"email"`
+
+	// Moderation configures where reports made by this host's accounts go
+	Moderation ModerationConfig `toml:"moderation"`
+
+	// Labels configures the labelers whose labels this host serves, and whether it's a labeler itself
+	Labels LabelsConfig `toml:"labels"`
+
+	// TLS configures the host's certificate when the PDS terminates TLS itself
+	TLS HostTLSConfig `toml:"tls"`
 }
 
+const defaultRelayAlertMinutes = 15
+
 // loadedHostConfig contains the parsed and validated config for a single host
 type loadedHostConfig struct {
 	hostname       string
@@ -44,12 +114,54 @@ type loadedHostConfig struct {
 	contactEmail   string
 	privacyPolicy  string
 	termsOfService string
+	adminPassword  string
+
+	// adminDIDs are the accounts that may use the admin API with their access token
+	adminDIDs map[string]struct{}
+
+	// keyring encrypts the private keys of this host's accounts, or is nil if encryption is disabled
+	keyring *envelope.Keyring
+
+	// rateLimits are the request budgets of this host, or nil if rate limiting is disabled
+	rateLimits *rateLimits
+
+	inviteCodeRequired bool
+	userInviteCodes    int
+
+	// signupVerifier checks signups before accounts are created, or is nil if signups aren't verified
+	signupVerifier verify.Verifier
+
+	// mailer sends mail to the host's accounts, or is nil if email is disabled
+	mailer mail.Mailer
+
+	// moderation handles reports made by the host's accounts, or is nil if they're proxied
+	moderation *moderation
+
+	// certificate is served for the host and its user domains, or is nil if they use ACME
+	certificate *tls.Certificate
+
+	// labelers are the DIDs of the remote labelers whose labels are served from queryLabels
+	labelers []string
+
+	// labelSigner signs the labels the host issues as a labeler, or is nil if it isn't one
+	labelSigner *atcrypto.PrivateKeyP256
+
+	relays          []string
+	relayAlertAfter time.Duration
 }
 
 // LoadedConfig contains the fully parsed configuration
 type LoadedConfig struct {
 	Hosts     map[string]*loadedHostConfig
 	Blobstore *BlobstoreConfig
+
+	// HostRegistry is nil unless the host registry is enabled
+	HostRegistry *hostRegistry
+
+	// TLS is nil unless the PDS terminates TLS itself
+	TLS *tlsConfig
+
+	TrustedProxies *trustedProxies
 }
 
 // LoadConfig reads and parses the TOML config file, loading all signing keys
@@ -59,35 +171,169 @@ func LoadConfig(path string) (*LoadedConfig, error) {
 		return nil, fmt.Errorf("failed to decode config file: %w", err)
 	}
 
-	if len(cfg.Hosts) == 0 {
+	var registry *hostRegistry
+	if cfg.HostRegistry != nil {
+		var err error
+		registry, err = loadHostRegistry(cfg.HostRegistry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host_registry config: %w", err)
+		}
+	}
+
+	var tlsCfg *tlsConfig
+	if cfg.TLS != nil {
+		var err error
+		tlsCfg, err = loadTLSConfig(cfg.TLS)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tls config: %w", err)
+		}
+	}
+
+	proxies, err := loadTrustedProxies(cfg.TrustedProxies, cfg.TLS != nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted_proxies: %w", err)
+	}
+
+	// hosts may all be provisioned at runtime when the registry is enabled
+	if len(cfg.Hosts) == 0 && registry == nil {
 		return nil, fmt.Errorf("config must define at least one host")
 	}
 
 	hosts := make(map[string]*loadedHostConfig, len(cfg.Hosts))
 	for hostname, host := range cfg.Hosts {
-		if err := validateHostConfig(hostname, &host); err != nil {
-			return nil, fmt.Errorf("invalid config for host %q: %w", hostname, err)
+		keys, err := readHostKeys(&host)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load keys for host %q: %w", hostname, err)
 		}
 
-		signingKey, err := loadSigningKey(host.JWTSigningKey)
+		hosts[hostname], err = loadHost(hostname, &host, keys)
 		if err != nil {
-			return nil, fmt.Errorf("failed to load signing key for host %q: %w", hostname, err)
+			return nil, err
 		}
+	}
 
-		hosts[hostname] = &loadedHostConfig{
-			hostname:       hostname,
-			serviceDID:     host.ServiceDID,
-			signingKey:     signingKey,
-			userDomains:    host.UserDomains,
-			contactEmail:   host.ContactEmail,
-			privacyPolicy:  host.PrivacyPolicy,
-			termsOfService: host.TermsOfService,
-		}
+	if err := validateUserDomains(cfg.Hosts); err != nil {
+		return nil, err
 	}
 
 	return &LoadedConfig{
-		Hosts:     hosts,
-		Blobstore: cfg.Blobstore,
+		Hosts:          hosts,
+		Blobstore:      cfg.Blobstore,
+		HostRegistry:   registry,
+		TLS:            tlsCfg,
+		TrustedProxies: proxies,
+	}, nil
+}
+
+// hostKeys is a host's key material. Hosts in the config file read it from the files the config
+// names, and registered hosts store it encrypted in FDB.
+type hostKeys struct {
+	jwtSigningKey   []byte // PEM encoded
+	labelSigningKey []byte // PEM encoded, nil if the host isn't a labeler
+}
+
+// readHostKeys reads the key files named by a host in the config file
+func readHostKeys(host *Host) (*hostKeys, error) {
+	if host.JWTSigningKey == "" {
+		return nil, fmt.Errorf("jwt_signing_key is required")
+	}
+
+	jwtSigningKey, err := os.ReadFile(host.JWTSigningKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key file: %w", err)
+	}
+
+	keys := &hostKeys{jwtSigningKey: jwtSigningKey}
+	if host.Labels.SigningKey != "" {
+		keys.labelSigningKey, err = os.ReadFile(host.Labels.SigningKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read label signing key file: %w", err)
+		}
+	}
+
+	return keys, nil
+}
+
+// loadHost validates a host's config and loads the keys, limits, and services it configures
+func loadHost(hostname string, host *Host, keys *hostKeys) (*loadedHostConfig, error) {
+	if err := validateHostConfig(hostname, host); err != nil {
+		return nil, fmt.Errorf("invalid config for host %q: %w", hostname, err)
+	}
+
+	signingKey, err := parseSigningKey(keys.jwtSigningKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load signing key for host %q: %w", hostname, err)
+	}
+
+	keyring, err := loadKeyring(host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load key-encryption keys for host %q: %w", hostname, err)
+	}
+
+	limits, err := loadRateLimits(&host.RateLimits)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rate limits for host %q: %w", hostname, err)
+	}
+
+	verifier, err := loadSignupVerifier(&host.SignupVerification)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signup verification for host %q: %w", hostname, err)
+	}
+
+	mailer, err := loadMailer(&host.Email)
+	if err != nil {
+		return nil, fmt.Errorf("invalid email config for host %q: %w", hostname, err)
+	}
+
+	mod, err := loadModeration(&host.Moderation)
+	if err != nil {
+		return nil, fmt.Errorf("invalid moderation config for host %q: %w", hostname, err)
+	}
+
+	labelers, labelSigner, err := loadLabels(&host.Labels, keys.labelSigningKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid labels config for host %q: %w", hostname, err)
+	}
+
+	certificate, err := loadHostCertificate(&host.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tls config for host %q: %w", hostname, err)
+	}
+
+	adminDIDs := make(map[string]struct{}, len(host.AdminDIDs))
+	for _, did := range host.AdminDIDs {
+		adminDIDs[did] = struct{}{}
+	}
+
+	relayAlertMinutes := host.RelayAlertMinutes
+	if relayAlertMinutes == 0 {
+		relayAlertMinutes = defaultRelayAlertMinutes
+	}
+
+	return &loadedHostConfig{
+		hostname:       hostname,
+		serviceDID:     host.ServiceDID,
+		signingKey:     signingKey,
+		userDomains:    host.UserDomains,
+		contactEmail:   host.ContactEmail,
+		privacyPolicy:  host.PrivacyPolicy,
+		termsOfService: host.TermsOfService,
+		adminPassword:  host.AdminPassword,
+		adminDIDs:      adminDIDs,
+		keyring:        keyring,
+		rateLimits:     limits,
+
+		inviteCodeRequired: host.InviteCodeRequired,
+		userInviteCodes:    host.UserInviteCodes,
+		signupVerifier:     verifier,
+		mailer:             mailer,
+		moderation:         mod,
+		labelers:           labelers,
+		labelSigner:        labelSigner,
+		certificate:        certificate,
+
+		relays:          host.Relays,
+		relayAlertAfter: time.Duration(relayAlertMinutes) * time.Minute,
 	}, nil
 }
 
@@ -97,11 +343,44 @@ func validateHostConfig(hostname string, cfg *Host) error {
 		return fmt.Errorf("hostname cannot be empty")
 	case cfg.ServiceDID == "":
 		return fmt.Errorf("service_did is required")
-	case cfg.JWTSigningKey == "":
-		return fmt.Errorf("jwt_signing_key is required")
 	case len(cfg.UserDomains) == 0:
 		return fmt.Errorf("user_domains is required")
+	case cfg.RelayAlertMinutes < 0:
+		return fmt.Errorf("relay_alert_minutes cannot be negative")
+	case cfg.UserInviteCodes < 0:
+		return fmt.Errorf("user_invite_codes cannot be negative")
+	case cfg.KEKFile != "" && cfg.KEKEnv != "":
+		return fmt.Errorf("only one of kek_file and kek_env may be set")
+	case len(cfg.PreviousKEKFiles) > 0 && cfg.KEKFile == "" && cfg.KEKEnv == "":
+		return fmt.Errorf("previous_kek_files requires kek_file or kek_env")
+	}
+
+	if err := validateServiceDID(hostname, cfg.ServiceDID); err != nil {
+		return err
+	}
+
+	for _, domain := range cfg.UserDomains {
+		if !strings.HasPrefix(domain, ".") || len(domain) < 2 {
+			return fmt.Errorf("invalid user domain %q: must start with a dot, like \".example.com\"", domain)
+		}
+	}
+
+	for _, did := range cfg.AdminDIDs {
+		if _, err := syntax.ParseDID(did); err != nil {
+			return fmt.Errorf("invalid admin did %q: %w", did, err)
+		}
+	}
+
+	for _, relay := range cfg.Relays {
+		u, err := url.Parse(relay)
+		if err != nil {
+			return fmt.Errorf("invalid relay url %q: %w", relay, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid relay url %q: must be an absolute http(s) url", relay)
+		}
 	}
+
 	return nil
 }
 
@@ -111,6 +390,11 @@ func loadSigningKey(path string) (*ecdsa.PrivateKey, error) {
 		return nil, fmt.Errorf("failed to read signing key file: %w", err)
 	}
 
+	return parseSigningKey(keyBytes)
+}
+
+// parseSigningKey parses a PEM encoded P-256 private key
+func parseSigningKey(keyBytes []byte) (*ecdsa.PrivateKey, error) {
 	block, _ := pem.Decode(keyBytes)
 	if block == nil {
 		return nil, fmt.Errorf("failed to decode PEM block containing signing key")
@@ -121,5 +405,76 @@ func loadSigningKey(path string) (*ecdsa.PrivateKey, error) {
 		return nil, fmt.Errorf("failed to parse EC private key: %w", err)
 	}
 
+	// access tokens are signed with ES256
+	if key.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("signing key must be a P-256 key, not %s", key.Curve.Params().Name)
+	}
+
 	return key, nil
 }
+
+// validateServiceDID checks that the host's service DID is well-formed, and that a did:web names
+// the host itself, since that's where it's resolved
+func validateServiceDID(hostname, serviceDID string) error {
+	did, err := syntax.ParseDID(serviceDID)
+	if err != nil {
+		return fmt.Errorf("invalid service_did: %w", err)
+	}
+
+	if did.Method() == "web" {
+		// ports are percent-encoded in did:web
+		if domain := strings.ReplaceAll(did.Identifier(), "%3A", ":"); domain != hostname {
+			return fmt.Errorf("service_did %q doesn't match hostname %q", serviceDID, hostname)
+		}
+	}
+
+	return nil
+}
+
+// validateUserDomains checks that no two hosts offer the same user domain, since a handle under it
+// couldn't be attributed to either. Nested domains are fine: routeHost picks the longest match.
+func validateUserDomains(hosts map[string]Host) error {
+	hostnames := slices.Sorted(maps.Keys(hosts))
+
+	for i, a := range hostnames {
+		for _, b := range hostnames[i+1:] {
+			for _, da := range hosts[a].UserDomains {
+				for _, db := range hosts[b].UserDomains {
+					if sameUserDomain(da, db) {
+						return fmt.Errorf("user domain %q of host %q is also a user domain of host %q", da, a, b)
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// sameUserDomain reports whether two user domains are the same, ignoring case
+func sameUserDomain(a, b string) bool {
+	return strings.EqualFold(a, b)
+}
+
+// loadKeyring loads the host's key-encryption keys, returning nil if encryption isn't configured
+func loadKeyring(cfg *Host) (*envelope.Keyring, error) {
+	if cfg.KEKFile == "" && cfg.KEKEnv == "" {
+		return nil, nil
+	}
+
+	current, err := envelope.LoadLocalKMS(cfg.KEKFile, cfg.KEKEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	previous := make([]envelope.KMS, 0, len(cfg.PreviousKEKFiles))
+	for _, path := range cfg.PreviousKEKFiles {
+		kms, err := envelope.LoadLocalKMS(path, "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to load previous key-encryption key %q: %w", path, err)
+		}
+		previous = append(previous, kms)
+	}
+
+	return envelope.NewKeyring(current, previous...), nil
+}
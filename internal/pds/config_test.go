@@ -0,0 +1,169 @@
+package pds
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestConfig writes a config file with the given hosts, each with a fresh signing key
+func writeTestConfig(t *testing.T, dir, name string, hosts map[string]string) string {
+	t.Helper()
+
+	var keyBuf bytes.Buffer
+	require.NoError(t, GenerateJWTKey(&keyBuf))
+	keyPath := filepath.Join(dir, "jwt.pem")
+	require.NoError(t, os.WriteFile(keyPath, keyBuf.Bytes(), 0o600))
+
+	var buf strings.Builder
+	for hostname, extra := range hosts {
+		fmt.Fprintf(&buf, "[hosts.%q]\nservice_did = \"did:web:%s\"\njwt_signing_key = %q\n%s\n",
+			hostname, strings.ReplaceAll(hostname, ":", "%3A"), keyPath, extra)
+	}
+
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, []byte(buf.String()), 0o600))
+	return path
+}
+
+func TestValidateServiceDID(t *testing.T) {
+	t.Parallel()
+
+	require.NoError(t, validateServiceDID("pds.example.com", "did:web:pds.example.com"))
+	require.NoError(t, validateServiceDID("localhost:2583", "did:web:localhost%3A2583"))
+	require.NoError(t, validateServiceDID("pds.example.com", "did:plc:ewvi7nxzyoun6zhxrhs64oiz"))
+
+	require.Error(t, validateServiceDID("pds.example.com", "pds.example.com"))
+	require.Error(t, validateServiceDID("pds.example.com", "did:web:other.example.com"))
+}
+
+func TestSameUserDomain(t *testing.T) {
+	t.Parallel()
+
+	require.True(t, sameUserDomain(".example.com", ".example.com"))
+	require.True(t, sameUserDomain(".example.com", ".EXAMPLE.com"))
+
+	// nested domains are routed by longest match
+	require.False(t, sameUserDomain(".example.com", ".pds.example.com"))
+	require.False(t, sameUserDomain(".pds.example.com", ".example.com"))
+	require.False(t, sameUserDomain(".example.com", ".otherexample.com"))
+	require.False(t, sameUserDomain(".a.example.com", ".b.example.com"))
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	path := writeTestConfig(t, dir, "ok.toml", map[string]string{
+		"a.example.com": `user_domains = [".a.example.com"]`,
+		"b.example.com": `user_domains = [".b.example.com"]`,
+	})
+	cfg, err := LoadConfig(path)
+	require.NoError(t, err)
+	require.Len(t, cfg.Hosts, 2)
+
+	path = writeTestConfig(t, dir, "same.toml", map[string]string{
+		"a.example.com": `user_domains = [".example.com"]`,
+		"b.example.com": `user_domains = [".EXAMPLE.com"]`,
+	})
+	_, err = LoadConfig(path)
+	require.ErrorContains(t, err, "is also a user domain")
+
+	path = writeTestConfig(t, dir, "nodot.toml", map[string]string{
+		"a.example.com": `user_domains = ["a.example.com"]`,
+	})
+	_, err = LoadConfig(path)
+	require.ErrorContains(t, err, "invalid user domain")
+
+	// access tokens are ES256, so other curves are rejected
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	keyPath := filepath.Join(dir, "p384.pem")
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600))
+
+	_, err = loadSigningKey(keyPath)
+	require.ErrorContains(t, err, "P-256")
+}
+
+func TestLoadConfigNestedUserDomains(t *testing.T) {
+	t.Parallel()
+
+	path := writeTestConfig(t, t.TempDir(), "nested.toml", map[string]string{
+		"a.example.com": `user_domains = [".example.com"]`,
+		"b.example.com": `user_domains = [".b.example.com"]`,
+	})
+	cfg, err := LoadConfig(path)
+	require.NoError(t, err)
+
+	s := &server{}
+	s.setStaticHosts(cfg.Hosts, "")
+
+	// handles go to the host with the longest matching user domain
+	for reqHost, expected := range map[string]string{
+		"a.example.com":       "a.example.com",
+		"b.example.com":       "b.example.com",
+		"alice.example.com":   "a.example.com",
+		"alice.b.example.com": "b.example.com",
+		"x.alice.example.com": "a.example.com",
+	} {
+		host, _ := s.routeHost(reqHost)
+		require.NotNil(t, host, reqHost)
+		require.Equal(t, expected, host.hostname, reqHost)
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	running := writeTestConfig(t, dir, "running.toml", map[string]string{
+		"a.example.com": `user_domains = [".a.example.com"]`,
+		"b.example.com": `user_domains = [".b.example.com"]`,
+	})
+	next := writeTestConfig(t, dir, "next.toml", map[string]string{
+		"a.example.com": "user_domains = [\".a.example.com\"]\ninvite_code_required = true",
+		"c.example.com": `user_domains = [".c.example.com"]`,
+	})
+
+	var out bytes.Buffer
+	require.NoError(t, CheckConfig(t.Context(), &out, &CheckConfigArgs{File: next, Running: running}))
+
+	var report configCheckReport
+	require.NoError(t, json.Unmarshal(out.Bytes(), &report))
+	require.Equal(t, []string{"a.example.com", "c.example.com"}, report.Hosts)
+	require.Equal(t, "not configured", report.Blobstore)
+	require.NotNil(t, report.Diff)
+	require.Equal(t, []string{"c.example.com"}, report.Diff.Added)
+	require.Equal(t, []string{"b.example.com"}, report.Diff.Removed)
+	require.Equal(t, map[string][]string{"a.example.com": {"invite_code_required"}}, report.Diff.Changed)
+	require.False(t, report.Diff.BlobstoreChanged)
+
+	// diffing a file against itself would always report no changes
+	err := CheckConfig(t.Context(), &out, &CheckConfigArgs{File: next, Running: filepath.Join(dir, ".", "next.toml")})
+	require.ErrorContains(t, err, "must be a copy")
+
+	// no diff is reported without a running config
+	out.Reset()
+	require.NoError(t, CheckConfig(t.Context(), &out, &CheckConfigArgs{File: next}))
+	report = configCheckReport{}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &report))
+	require.Nil(t, report.Diff)
+
+	// an invalid config is reported as an error
+	bad := writeTestConfig(t, dir, "bad.toml", map[string]string{"a.example.com": ""})
+	require.ErrorContains(t, CheckConfig(t.Context(), &out, &CheckConfigArgs{File: bad}), "user_domains is required")
+}
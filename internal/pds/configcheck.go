@@ -0,0 +1,176 @@
+package pds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// CheckConfigArgs configures a config check
+type CheckConfigArgs struct {
+	// File is the config to check
+	File string
+
+	// Running is a copy of the config the PDS is currently using, which File is compared against.
+	// It must be a different file, since the PDS doesn't pick up edits to its config file until
+	// it's reloaded. No diff is printed if empty.
+	Running string
+
+	// CheckBlobstore makes sure the blobstore credentials can reach the bucket
+	CheckBlobstore bool
+}
+
+type configCheckReport struct {
+	File      string      `json:"file"`
+	Hosts     []string    `json:"hosts"`
+	Blobstore string      `json:"blobstore"`
+	Diff      *configDiff `json:"diff,omitempty"`
+}
+
+// configDiff lists what would change if the running config were replaced. Changed hosts list the
+// names of the settings that differ rather than their values, since many of them are secrets.
+type configDiff struct {
+	Running          string              `json:"running"`
+	Added            []string            `json:"added,omitempty"`
+	Removed          []string            `json:"removed,omitempty"`
+	Changed          map[string][]string `json:"changed,omitempty"`
+	BlobstoreChanged bool                `json:"blobstoreChanged,omitempty"`
+}
+
+// CheckConfig validates a config file the same way the server does when it starts or reloads, and
+// writes a JSON report to out that includes a diff against the running config. Returns an error if
+// the config is invalid.
+func CheckConfig(ctx context.Context, out io.Writer, args *CheckConfigArgs) error {
+	cfg, err := LoadConfig(args.File)
+	if err != nil {
+		return err
+	}
+
+	report := &configCheckReport{
+		File:      args.File,
+		Hosts:     slices.Sorted(maps.Keys(cfg.Hosts)),
+		Blobstore: "not configured",
+	}
+
+	if cfg.Blobstore != nil {
+		report.Blobstore = "not checked"
+		if args.CheckBlobstore {
+			if err := checkBlobstore(ctx, cfg.Blobstore); err != nil {
+				return err
+			}
+			report.Blobstore = "ok"
+		}
+	}
+
+	if args.Running != "" {
+		if sameFile(args.Running, args.File) {
+			return fmt.Errorf("the running config must be a copy of the config the PDS loaded, not the file being checked")
+		}
+
+		report.Diff, err = diffConfigFiles(args.Running, args.File)
+		if err != nil {
+			return err
+		}
+	}
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+// checkBlobstore makes sure the blobstore's credentials can reach its bucket
+func checkBlobstore(ctx context.Context, cfg *BlobstoreConfig) error {
+	bs, err := newBlobstore(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to initialize blobstore: %w", err)
+	}
+
+	if _, err := bs.bucketExists(ctx); err != nil {
+		return fmt.Errorf("failed to reach blobstore bucket %q at %s: %w", cfg.Bucket, cfg.Endpoint, err)
+	}
+
+	return nil
+}
+
+// diffConfigFiles compares the settings of two config files. Only the running config is decoded,
+// not loaded, so that a running config whose keys have since moved can still be compared.
+func diffConfigFiles(runningPath, newPath string) (*configDiff, error) {
+	var running, next Config
+	if _, err := toml.DecodeFile(runningPath, &running); err != nil {
+		return nil, fmt.Errorf("failed to decode running config: %w", err)
+	}
+	if _, err := toml.DecodeFile(newPath, &next); err != nil {
+		return nil, fmt.Errorf("failed to decode config file: %w", err)
+	}
+
+	diff := diffConfigs(&running, &next)
+	diff.Running = runningPath
+	return diff, nil
+}
+
+func diffConfigs(running, next *Config) *configDiff {
+	diff := &configDiff{
+		Changed:          make(map[string][]string),
+		BlobstoreChanged: !reflect.DeepEqual(running.Blobstore, next.Blobstore),
+	}
+
+	for hostname, host := range next.Hosts {
+		prev, ok := running.Hosts[hostname]
+		if !ok {
+			diff.Added = append(diff.Added, hostname)
+			continue
+		}
+
+		if fields := diffHosts(&prev, &host); len(fields) > 0 {
+			diff.Changed[hostname] = fields
+		}
+	}
+
+	for hostname := range running.Hosts {
+		if _, ok := next.Hosts[hostname]; !ok {
+			diff.Removed = append(diff.Removed, hostname)
+		}
+	}
+
+	slices.Sort(diff.Added)
+	slices.Sort(diff.Removed)
+	return diff
+}
+
+// diffHosts returns the TOML names of the top-level host settings that differ
+func diffHosts(a, b *Host) []string {
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+
+	var fields []string
+	for i := range va.NumField() {
+		if reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			continue
+		}
+
+		name, _, _ := strings.Cut(va.Type().Field(i).Tag.Get("toml"), ",")
+		fields = append(fields, name)
+	}
+
+	return fields
+}
+
+// sameFile returns whether both paths refer to the same file
+func sameFile(a, b string) bool {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bInfo, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(aInfo, bInfo)
+}
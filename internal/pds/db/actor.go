@@ -1,15 +1,27 @@
 package db
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 
 	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/directory"
 	"github.com/jcalabro/atlas/internal/types"
 	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/protobuf/proto"
 )
 
+var (
+	// ErrHandleTaken is returned when changing an actor's handle to one that belongs to another actor
+	ErrHandleTaken = errors.New("handle already taken")
+
+	// ErrEmailTaken is returned when changing an actor's email to one that's used by another actor
+	// on the same host
+	ErrEmailTaken = errors.New("email already taken")
+)
+
 func ValidateActor(a *types.Actor) error {
 	switch {
 	case a == nil:
@@ -26,9 +38,9 @@ func ValidateActor(a *types.Actor) error {
 		return fmt.Errorf("pds_host is required")
 	case len(a.PasswordHash) == 0:
 		return fmt.Errorf("password hash is required")
-	case len(a.SigningKey) == 0:
+	case len(a.SigningKey) == 0 && a.WrappedSigningKey == nil:
 		return fmt.Errorf("signing key is required")
-	case !atLeastOneByteSlice(a.RotationKeys):
+	case !atLeastOneByteSlice(a.RotationKeys) && len(a.WrappedRotationKeys) == 0:
 		return fmt.Errorf("at least one rotation key is required")
 	}
 
@@ -61,8 +73,48 @@ func (db *DB) SaveActor(ctx context.Context, actor *types.Actor) (err error) {
 	return
 }
 
+// CreateActor saves a newly signed up actor. If the actor signed up with an invite code, the code
+// is used in the same transaction so that it's only used up by a signup that succeeds. Fails with
+// ErrInviteCodeUnavailable if the code can't be used on the actor's host.
+func (db *DB) CreateActor(ctx context.Context, actor *types.Actor) (err error) {
+	_, span, done := db.observe(ctx, "CreateActor")
+	defer func() { done(err) }()
+
+	span.SetAttributes(
+		attribute.String("did", actor.Did),
+		attribute.String("handle", actor.Handle),
+		attribute.String("pds_host", actor.PdsHost),
+		attribute.Bool("invite_code", actor.InviteCode != ""),
+	)
+
+	if err = ValidateActor(actor); err != nil {
+		err = fmt.Errorf("invalid actor: %w", err)
+		return
+	}
+
+	_, err = transaction(db.db, func(tx fdb.Transaction) (any, error) {
+		if actor.InviteCode != "" {
+			if err := db.useInviteCodeTx(tx, actor.PdsHost, actor.InviteCode, actor.Did); err != nil {
+				return nil, err
+			}
+		}
+
+		return nil, db.saveActorTx(tx, actor)
+	})
+
+	return
+}
+
 // Saves an actor using an existing transaction
 func (db *DB) saveActorTx(tx fdb.Transaction, actor *types.Actor) error {
+	// refresh tokens used to be stored in plaintext on the actor, but now live in their own
+	// subspace. Move any that are left over.
+	if len(actor.RefreshTokens) > 0 { //nolint:staticcheck
+		if _, err := db.migrateLegacySessionsTx(tx, actor); err != nil {
+			return fmt.Errorf("failed to migrate legacy sessions: %w", err)
+		}
+	}
+
 	buf, err := proto.Marshal(actor)
 	if err != nil {
 		return fmt.Errorf("failed to protobuf marshal actor: %w", err)
@@ -276,3 +328,295 @@ func (db *DB) ListActors(
 	actors = results
 	return
 }
+
+// updateActorTx applies fn to the actor with the given DID and saves it. Returns ErrNotFound if the
+// actor doesn't exist.
+func (db *DB) updateActorTx(tx fdb.Transaction, did string, fn func(actor *types.Actor) error) (*types.Actor, error) {
+	actor, err := db.getActorByDIDTx(tx, did)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get actor: %w", err)
+	}
+	if actor == nil {
+		return nil, ErrNotFound
+	}
+
+	if err := fn(actor); err != nil {
+		return nil, err
+	}
+
+	if err := ValidateActor(actor); err != nil {
+		return nil, fmt.Errorf("invalid actor: %w", err)
+	}
+
+	return actor, db.saveActorTx(tx, actor)
+}
+
+// UpdateActorHandle changes the actor's handle. Fails with ErrHandleTaken if the handle belongs to
+// another actor.
+func (db *DB) UpdateActorHandle(ctx context.Context, did, handle string) (actor *types.Actor, err error) {
+	_, span, done := db.observe(ctx, "UpdateActorHandle")
+	defer func() { done(err) }()
+
+	span.SetAttributes(
+		attribute.String("did", did),
+		attribute.String("handle", handle),
+	)
+
+	actor, err = transaction(db.db, func(tx fdb.Transaction) (*types.Actor, error) {
+		owner, err := tx.Get(pack(db.actors.didsByHandle, handle)).Get()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get handle owner: %w", err)
+		}
+		if len(owner) > 0 && string(owner) != did {
+			return nil, ErrHandleTaken
+		}
+
+		return db.updateActorTx(tx, did, func(actor *types.Actor) error {
+			if actor.Handle != handle {
+				tx.Clear(pack(db.actors.didsByHandle, actor.Handle))
+			}
+			actor.Handle = handle
+			return nil
+		})
+	})
+
+	return
+}
+
+// UpdateActorEmail changes the actor's email, which must then be confirmed again. Fails with
+// ErrEmailTaken if another actor on the same host uses the email.
+func (db *DB) UpdateActorEmail(ctx context.Context, did, email string) (actor *types.Actor, err error) {
+	_, span, done := db.observe(ctx, "UpdateActorEmail")
+	defer func() { done(err) }()
+
+	span.SetAttributes(
+		attribute.String("did", did),
+		attribute.String("email", email),
+	)
+
+	actor, err = transaction(db.db, func(tx fdb.Transaction) (*types.Actor, error) {
+		return db.updateActorTx(tx, did, func(actor *types.Actor) error {
+			if actor.Email == email {
+				return nil
+			}
+
+			owner, err := tx.Get(pack(db.actors.didsByEmail, actor.PdsHost, email)).Get()
+			if err != nil {
+				return fmt.Errorf("failed to get email owner: %w", err)
+			}
+			if len(owner) > 0 && string(owner) != did {
+				return ErrEmailTaken
+			}
+
+			tx.Clear(pack(db.actors.didsByEmail, actor.PdsHost, actor.Email))
+			actor.Email = email
+			actor.EmailConfirmed = false
+			return nil
+		})
+	})
+
+	return
+}
+
+// UpdateActorPassword replaces the actor's password hash and revokes all of its sessions
+func (db *DB) UpdateActorPassword(ctx context.Context, did string, passwordHash []byte) (err error) {
+	_, span, done := db.observe(ctx, "UpdateActorPassword")
+	defer func() { done(err) }()
+
+	span.SetAttributes(attribute.String("did", did))
+
+	_, err = transaction(db.db, func(tx fdb.Transaction) (any, error) {
+		_, err := db.updateActorTx(tx, did, func(actor *types.Actor) error {
+			actor.PasswordHash = passwordHash
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, db.clearSessionsTx(tx, did)
+	})
+
+	return
+}
+
+// DisableActorInvites stops the actor from creating invite codes and disables the codes that were
+// issued to it
+func (db *DB) DisableActorInvites(ctx context.Context, did, note string) (err error) {
+	_, span, done := db.observe(ctx, "DisableActorInvites")
+	defer func() { done(err) }()
+
+	span.SetAttributes(attribute.String("did", did))
+
+	_, err = transaction(db.db, func(tx fdb.Transaction) (any, error) {
+		actor, err := db.updateActorTx(tx, did, func(actor *types.Actor) error {
+			actor.InvitesDisabled = true
+			actor.InviteNote = note
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, db.disableAccountInviteCodesTx(tx, actor.PdsHost, did)
+	})
+
+	return
+}
+
+// SearchActorsByEmail lists the actors on the host whose email starts with the given prefix, in
+// email order. The cursor is the email of the last actor on the previous page.
+func (db *DB) SearchActorsByEmail(
+	ctx context.Context,
+	pdsHost,
+	prefix,
+	cursor string,
+	limit int64,
+) (actors []*types.Actor, nextCursor string, err error) {
+	_, span, done := db.observe(ctx, "SearchActorsByEmail")
+	defer func() { done(err) }()
+
+	span.SetAttributes(
+		attribute.String("pds_host", pdsHost),
+		attribute.String("prefix", prefix),
+		attribute.String("cursor", cursor),
+		attribute.Int64("limit", limit),
+	)
+
+	if limit <= 0 {
+		err = fmt.Errorf("limit must be positive")
+		return
+	}
+
+	actors, err = readTransaction(db.db, func(tx fdb.ReadTransaction) ([]*types.Actor, error) {
+		// a packed string ends with a null terminator, which is dropped so that the range also
+		// covers every longer email that starts with the prefix
+		begin := pack(db.actors.didsByEmail, pdsHost, prefix)
+		kr, err := fdb.PrefixRange(begin[:len(begin)-1])
+		if err != nil {
+			return nil, fmt.Errorf("failed to create email range: %w", err)
+		}
+
+		if cursor != "" {
+			after := fdb.Key(append(pack(db.actors.didsByEmail, pdsHost, cursor), 0x00))
+			if bytes.Compare(after, kr.Begin.FDBKey()) > 0 {
+				kr.Begin = after
+			}
+		}
+
+		kvs, err := tx.GetRange(kr, fdb.RangeOptions{Limit: int(limit + 1)}).GetSliceWithError()
+		if err != nil {
+			return nil, fmt.Errorf("failed to search emails: %w", err)
+		}
+
+		futures := make([]fdb.FutureByteSlice, 0, len(kvs))
+		for _, kv := range kvs {
+			futures = append(futures, tx.Get(pack(db.actors.actors, string(kv.Value))))
+		}
+
+		out := make([]*types.Actor, 0, len(futures))
+		for _, fut := range futures {
+			buf, err := fut.Get()
+			if err != nil {
+				return nil, err
+			}
+			if len(buf) == 0 {
+				continue
+			}
+
+			var actor types.Actor
+			if err := proto.Unmarshal(buf, &actor); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal actor: %w", err)
+			}
+			out = append(out, &actor)
+		}
+
+		return out, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	if int64(len(actors)) > limit {
+		nextCursor = actors[limit-1].Email
+		actors = actors[:limit]
+	}
+
+	return
+}
+
+// DeleteActor permanently deletes the actor along with its repo, records, blob metadata, and
+// sessions. Invite codes issued to the actor are disabled rather than deleted so that the accounts
+// that used them can still see who invited them. Returns ErrNotFound if the actor doesn't exist.
+func (db *DB) DeleteActor(ctx context.Context, did string) (err error) {
+	_, span, done := db.observe(ctx, "DeleteActor")
+	defer func() { done(err) }()
+
+	span.SetAttributes(attribute.String("did", did))
+
+	_, err = transaction(db.db, func(tx fdb.Transaction) (any, error) {
+		actor, err := db.getActorByDIDTx(tx, did)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get actor: %w", err)
+		}
+		if actor == nil {
+			return nil, ErrNotFound
+		}
+
+		// only clear index entries that still point at this actor
+		for _, key := range []fdb.Key{
+			pack(db.actors.didsByHandle, actor.Handle),
+			pack(db.actors.didsByEmail, actor.PdsHost, actor.Email),
+		} {
+			owner, err := tx.Get(key).Get()
+			if err != nil {
+				return nil, fmt.Errorf("failed to get index entry: %w", err)
+			}
+			if string(owner) == did {
+				tx.Clear(key)
+			}
+		}
+
+		tx.Clear(pack(db.actors.actors, did))
+		tx.Clear(pack(db.actors.didsByHost, actor.PdsHost, did))
+		tx.Clear(pack(db.actors.tidsByDID, did))
+		tx.Clear(pack(db.rateLimits.lockouts, did))
+
+		if err := db.clearSessionsTx(tx, did); err != nil {
+			return nil, err
+		}
+
+		// every key in these subspaces is prefixed by the did, so each is cleared with a single
+		// range clear no matter how large the repo is. Entries left behind in the block gc queue
+		// are skipped by the sweeper since their gcPending entries are gone.
+		for _, dir := range []directory.DirectorySubspace{
+			db.records.records,
+			db.records.collectionCounts,
+			db.records.recordsByCID,
+			db.records.recordsByCIDIndexed,
+			db.blockDir.blocks,
+			db.blockDir.blocksByRev,
+			db.blockDir.revsByBlock,
+			db.blockDir.gcPending,
+			db.blobs,
+			db.takedowns,
+		} {
+			kr, err := fdb.PrefixRange(pack(dir, did))
+			if err != nil {
+				return nil, fmt.Errorf("failed to create range: %w", err)
+			}
+			tx.ClearRange(kr)
+		}
+
+		// labels are keyed by uri rather than did, so the account's records are cleared by prefix
+		kr, err := labelPrefixRange(db.labels.labels, "at://"+did+"/")
+		if err != nil {
+			return nil, err
+		}
+		tx.ClearRange(kr)
+
+		return nil, db.disableAccountInviteCodesTx(tx, actor.PdsHost, did)
+	})
+
+	return
+}
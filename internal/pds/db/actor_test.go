@@ -6,6 +6,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/jcalabro/atlas/internal/types"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/protobuf/types/known/timestamppb"
@@ -30,7 +31,6 @@ func TestSaveActor(t *testing.T) {
 			Handle:                "test.dev.atlaspds.net",
 			Active:                true,
 			RotationKeys:          [][]byte{[]byte("rotation_key")},
-			RefreshTokens:         []*types.RefreshToken{{Token: "refresh_token"}},
 			PdsHost:               testPDSHost,
 		}
 
@@ -50,7 +50,6 @@ func TestSaveActor(t *testing.T) {
 			Handle:                "user1.dev.atlaspds.net",
 			Active:                true,
 			RotationKeys:          [][]byte{[]byte("rotation_key")},
-			RefreshTokens:         []*types.RefreshToken{{Token: "refresh_token"}},
 			PdsHost:               testPDSHost,
 		}
 
@@ -75,15 +74,14 @@ func TestSaveActor(t *testing.T) {
 
 	t.Run("handles actor with minimal fields", func(t *testing.T) {
 		actor := &types.Actor{
-			Did:           "did:plc:minimal",
-			Email:         "minimal@example.com",
-			Handle:        "minimal.dev.atlaspds.net",
-			CreatedAt:     timestamppb.New(time.Now()),
-			PasswordHash:  []byte("hash"),
-			SigningKey:    []byte("key"),
-			RotationKeys:  [][]byte{[]byte("rotation")},
-			RefreshTokens: []*types.RefreshToken{},
-			PdsHost:       testPDSHost,
+			Did:          "did:plc:minimal",
+			Email:        "minimal@example.com",
+			Handle:       "minimal.dev.atlaspds.net",
+			CreatedAt:    timestamppb.New(time.Now()),
+			PasswordHash: []byte("hash"),
+			SigningKey:   []byte("key"),
+			RotationKeys: [][]byte{[]byte("rotation")},
+			PdsHost:      testPDSHost,
 		}
 
 		err := db.SaveActor(ctx, actor)
@@ -109,7 +107,6 @@ func TestGetActorByEmail(t *testing.T) {
 			Handle:                "retrieve.dev.atlaspds.net",
 			Active:                true,
 			RotationKeys:          [][]byte{[]byte("rotation_key")},
-			RefreshTokens:         []*types.RefreshToken{{Token: "refresh_token"}},
 			PdsHost:               testPDSHost,
 		}
 
@@ -139,37 +136,34 @@ func TestGetActorByEmail(t *testing.T) {
 
 	t.Run("retrieves correct actor when multiple exist", func(t *testing.T) {
 		actor1 := &types.Actor{
-			Did:           "did:plc:multi1",
-			Email:         "user1@example.com",
-			Handle:        "user1.dev.atlaspds.net",
-			CreatedAt:     timestamppb.New(time.Now()),
-			PasswordHash:  []byte("hash1"),
-			SigningKey:    []byte("key1"),
-			RotationKeys:  [][]byte{[]byte("rotation1")},
-			RefreshTokens: []*types.RefreshToken{},
-			PdsHost:       testPDSHost,
+			Did:          "did:plc:multi1",
+			Email:        "user1@example.com",
+			Handle:       "user1.dev.atlaspds.net",
+			CreatedAt:    timestamppb.New(time.Now()),
+			PasswordHash: []byte("hash1"),
+			SigningKey:   []byte("key1"),
+			RotationKeys: [][]byte{[]byte("rotation1")},
+			PdsHost:      testPDSHost,
 		}
 		actor2 := &types.Actor{
-			Did:           "did:plc:multi2",
-			Email:         "user2@example.com",
-			Handle:        "user2.dev.atlaspds.net",
-			CreatedAt:     timestamppb.New(time.Now()),
-			PasswordHash:  []byte("hash2"),
-			SigningKey:    []byte("key2"),
-			RotationKeys:  [][]byte{[]byte("rotation2")},
-			RefreshTokens: []*types.RefreshToken{},
-			PdsHost:       testPDSHost,
+			Did:          "did:plc:multi2",
+			Email:        "user2@example.com",
+			Handle:       "user2.dev.atlaspds.net",
+			CreatedAt:    timestamppb.New(time.Now()),
+			PasswordHash: []byte("hash2"),
+			SigningKey:   []byte("key2"),
+			RotationKeys: [][]byte{[]byte("rotation2")},
+			PdsHost:      testPDSHost,
 		}
 		actor3 := &types.Actor{
-			Did:           "did:plc:multi3",
-			Email:         "user3@example.com",
-			Handle:        "user3.dev.atlaspds.net",
-			CreatedAt:     timestamppb.New(time.Now()),
-			PasswordHash:  []byte("hash3"),
-			SigningKey:    []byte("key3"),
-			RotationKeys:  [][]byte{[]byte("rotation3")},
-			RefreshTokens: []*types.RefreshToken{},
-			PdsHost:       testPDSHost,
+			Did:          "did:plc:multi3",
+			Email:        "user3@example.com",
+			Handle:       "user3.dev.atlaspds.net",
+			CreatedAt:    timestamppb.New(time.Now()),
+			PasswordHash: []byte("hash3"),
+			SigningKey:   []byte("key3"),
+			RotationKeys: [][]byte{[]byte("rotation3")},
+			PdsHost:      testPDSHost,
 		}
 
 		err := db.SaveActor(ctx, actor1)
@@ -204,7 +198,6 @@ func TestGetActorByDID(t *testing.T) {
 			Handle:                "testdid.dev.atlaspds.net",
 			Active:                true,
 			RotationKeys:          [][]byte{[]byte("rotation_key")},
-			RefreshTokens:         []*types.RefreshToken{{Token: "refresh_token"}},
 			PdsHost:               testPDSHost,
 		}
 
@@ -234,37 +227,34 @@ func TestGetActorByDID(t *testing.T) {
 
 	t.Run("retrieves correct actor when multiple exist", func(t *testing.T) {
 		actor1 := &types.Actor{
-			Did:           "did:plc:multidid1",
-			Email:         "multidid1@example.com",
-			Handle:        "multidid1.dev.atlaspds.net",
-			CreatedAt:     timestamppb.New(time.Now()),
-			PasswordHash:  []byte("hash1"),
-			SigningKey:    []byte("key1"),
-			RotationKeys:  [][]byte{[]byte("rotation1")},
-			RefreshTokens: []*types.RefreshToken{},
-			PdsHost:       testPDSHost,
+			Did:          "did:plc:multidid1",
+			Email:        "multidid1@example.com",
+			Handle:       "multidid1.dev.atlaspds.net",
+			CreatedAt:    timestamppb.New(time.Now()),
+			PasswordHash: []byte("hash1"),
+			SigningKey:   []byte("key1"),
+			RotationKeys: [][]byte{[]byte("rotation1")},
+			PdsHost:      testPDSHost,
 		}
 		actor2 := &types.Actor{
-			Did:           "did:plc:multidid2",
-			Email:         "multidid2@example.com",
-			Handle:        "multidid2.dev.atlaspds.net",
-			CreatedAt:     timestamppb.New(time.Now()),
-			PasswordHash:  []byte("hash2"),
-			SigningKey:    []byte("key2"),
-			RotationKeys:  [][]byte{[]byte("rotation2")},
-			RefreshTokens: []*types.RefreshToken{},
-			PdsHost:       testPDSHost,
+			Did:          "did:plc:multidid2",
+			Email:        "multidid2@example.com",
+			Handle:       "multidid2.dev.atlaspds.net",
+			CreatedAt:    timestamppb.New(time.Now()),
+			PasswordHash: []byte("hash2"),
+			SigningKey:   []byte("key2"),
+			RotationKeys: [][]byte{[]byte("rotation2")},
+			PdsHost:      testPDSHost,
 		}
 		actor3 := &types.Actor{
-			Did:           "did:plc:multidid3",
-			Email:         "multidid3@example.com",
-			Handle:        "multidid3.dev.atlaspds.net",
-			CreatedAt:     timestamppb.New(time.Now()),
-			PasswordHash:  []byte("hash3"),
-			SigningKey:    []byte("key3"),
-			RotationKeys:  [][]byte{[]byte("rotation3")},
-			RefreshTokens: []*types.RefreshToken{},
-			PdsHost:       testPDSHost,
+			Did:          "did:plc:multidid3",
+			Email:        "multidid3@example.com",
+			Handle:       "multidid3.dev.atlaspds.net",
+			CreatedAt:    timestamppb.New(time.Now()),
+			PasswordHash: []byte("hash3"),
+			SigningKey:   []byte("key3"),
+			RotationKeys: [][]byte{[]byte("rotation3")},
+			PdsHost:      testPDSHost,
 		}
 
 		err := db.SaveActor(ctx, actor1)
@@ -300,7 +290,6 @@ func TestGetActorByHandle(t *testing.T) {
 			Handle:                "handletest.dev.atlaspds.net",
 			Active:                true,
 			RotationKeys:          [][]byte{[]byte("rotation_key")},
-			RefreshTokens:         []*types.RefreshToken{{Token: "refresh_token"}},
 			PdsHost:               testPDSHost,
 		}
 
@@ -330,37 +319,34 @@ func TestGetActorByHandle(t *testing.T) {
 
 	t.Run("retrieves correct actor when multiple exist", func(t *testing.T) {
 		actor1 := &types.Actor{
-			Did:           "did:plc:multihandle1",
-			Email:         "multihandle1@example.com",
-			Handle:        "multihandle1.dev.atlaspds.net",
-			CreatedAt:     timestamppb.New(time.Now()),
-			PasswordHash:  []byte("hash1"),
-			SigningKey:    []byte("key1"),
-			RotationKeys:  [][]byte{[]byte("rotation1")},
-			RefreshTokens: []*types.RefreshToken{},
-			PdsHost:       testPDSHost,
+			Did:          "did:plc:multihandle1",
+			Email:        "multihandle1@example.com",
+			Handle:       "multihandle1.dev.atlaspds.net",
+			CreatedAt:    timestamppb.New(time.Now()),
+			PasswordHash: []byte("hash1"),
+			SigningKey:   []byte("key1"),
+			RotationKeys: [][]byte{[]byte("rotation1")},
+			PdsHost:      testPDSHost,
 		}
 		actor2 := &types.Actor{
-			Did:           "did:plc:multihandle2",
-			Email:         "multihandle2@example.com",
-			Handle:        "multihandle2.dev.atlaspds.net",
-			CreatedAt:     timestamppb.New(time.Now()),
-			PasswordHash:  []byte("hash2"),
-			SigningKey:    []byte("key2"),
-			RotationKeys:  [][]byte{[]byte("rotation2")},
-			RefreshTokens: []*types.RefreshToken{},
-			PdsHost:       testPDSHost,
+			Did:          "did:plc:multihandle2",
+			Email:        "multihandle2@example.com",
+			Handle:       "multihandle2.dev.atlaspds.net",
+			CreatedAt:    timestamppb.New(time.Now()),
+			PasswordHash: []byte("hash2"),
+			SigningKey:   []byte("key2"),
+			RotationKeys: [][]byte{[]byte("rotation2")},
+			PdsHost:      testPDSHost,
 		}
 		actor3 := &types.Actor{
-			Did:           "did:plc:multihandle3",
-			Email:         "multihandle3@example.com",
-			Handle:        "multihandle3.dev.atlaspds.net",
-			CreatedAt:     timestamppb.New(time.Now()),
-			PasswordHash:  []byte("hash3"),
-			SigningKey:    []byte("key3"),
-			RotationKeys:  [][]byte{[]byte("rotation3")},
-			RefreshTokens: []*types.RefreshToken{},
-			PdsHost:       testPDSHost,
+			Did:          "did:plc:multihandle3",
+			Email:        "multihandle3@example.com",
+			Handle:       "multihandle3.dev.atlaspds.net",
+			CreatedAt:    timestamppb.New(time.Now()),
+			PasswordHash: []byte("hash3"),
+			SigningKey:   []byte("key3"),
+			RotationKeys: [][]byte{[]byte("rotation3")},
+			PdsHost:      testPDSHost,
 		}
 
 		err := db.SaveActor(ctx, actor1)
@@ -379,15 +365,14 @@ func TestGetActorByHandle(t *testing.T) {
 
 	t.Run("handle lookup is updated when actor handle changes", func(t *testing.T) {
 		actor := &types.Actor{
-			Did:           "did:plc:changehandle",
-			Email:         "changehandle@example.com",
-			Handle:        "original.dev.atlaspds.net",
-			CreatedAt:     timestamppb.New(time.Now()),
-			PasswordHash:  []byte("hash"),
-			SigningKey:    []byte("key"),
-			RotationKeys:  [][]byte{[]byte("rotation")},
-			RefreshTokens: []*types.RefreshToken{},
-			PdsHost:       testPDSHost,
+			Did:          "did:plc:changehandle",
+			Email:        "changehandle@example.com",
+			Handle:       "original.dev.atlaspds.net",
+			CreatedAt:    timestamppb.New(time.Now()),
+			PasswordHash: []byte("hash"),
+			SigningKey:   []byte("key"),
+			RotationKeys: [][]byte{[]byte("rotation")},
+			PdsHost:      testPDSHost,
 		}
 
 		err := db.SaveActor(ctx, actor)
@@ -427,15 +412,14 @@ func TestActorIndexConsistency(t *testing.T) {
 
 	t.Run("all three lookups return the same actor", func(t *testing.T) {
 		actor := &types.Actor{
-			Did:           "did:plc:consistency123",
-			Email:         "consistency@example.com",
-			Handle:        "consistency.dev.atlaspds.net",
-			CreatedAt:     timestamppb.New(time.Now()),
-			PasswordHash:  []byte("hash"),
-			SigningKey:    []byte("key"),
-			RotationKeys:  [][]byte{[]byte("rotation")},
-			RefreshTokens: []*types.RefreshToken{},
-			PdsHost:       testPDSHost,
+			Did:          "did:plc:consistency123",
+			Email:        "consistency@example.com",
+			Handle:       "consistency.dev.atlaspds.net",
+			CreatedAt:    timestamppb.New(time.Now()),
+			PasswordHash: []byte("hash"),
+			SigningKey:   []byte("key"),
+			RotationKeys: [][]byte{[]byte("rotation")},
+			PdsHost:      testPDSHost,
 		}
 
 		err := db.SaveActor(ctx, actor)
@@ -477,15 +461,14 @@ func TestListActors(t *testing.T) {
 		// create 3 actors
 		for i := 1; i <= 3; i++ {
 			actor := &types.Actor{
-				Did:           fmt.Sprintf("%s%03d", prefix, i),
-				Email:         fmt.Sprintf("zlist%d@example.com", i),
-				Handle:        fmt.Sprintf("zlist%d.dev.atlaspds.net", i),
-				PdsHost:       testPDSHost,
-				CreatedAt:     timestamppb.New(time.Now()),
-				PasswordHash:  fmt.Appendf(nil, "hash%d", i),
-				SigningKey:    fmt.Appendf(nil, "key%d", i),
-				RotationKeys:  [][]byte{fmt.Appendf(nil, "rotation%d", i)},
-				RefreshTokens: []*types.RefreshToken{},
+				Did:          fmt.Sprintf("%s%03d", prefix, i),
+				Email:        fmt.Sprintf("zlist%d@example.com", i),
+				Handle:       fmt.Sprintf("zlist%d.dev.atlaspds.net", i),
+				PdsHost:      testPDSHost,
+				CreatedAt:    timestamppb.New(time.Now()),
+				PasswordHash: fmt.Appendf(nil, "hash%d", i),
+				SigningKey:   fmt.Appendf(nil, "key%d", i),
+				RotationKeys: [][]byte{fmt.Appendf(nil, "rotation%d", i)},
 			}
 			err := db.SaveActor(ctx, actor)
 			require.NoError(t, err)
@@ -512,15 +495,14 @@ func TestListActors(t *testing.T) {
 		// create 5 actors with lexicographically ordered DIDs
 		for i := 1; i <= 5; i++ {
 			actor := &types.Actor{
-				Did:           fmt.Sprintf("%s%03d", prefix, i),
-				Email:         fmt.Sprintf("zzpage%d@example.com", i),
-				Handle:        fmt.Sprintf("zzpage%d.dev.atlaspds.net", i),
-				PdsHost:       testPDSHost,
-				CreatedAt:     timestamppb.New(time.Now()),
-				PasswordHash:  fmt.Appendf(nil, "hash%d", i),
-				SigningKey:    fmt.Appendf(nil, "key%d", i),
-				RotationKeys:  [][]byte{fmt.Appendf(nil, "rotation%d", i)},
-				RefreshTokens: []*types.RefreshToken{},
+				Did:          fmt.Sprintf("%s%03d", prefix, i),
+				Email:        fmt.Sprintf("zzpage%d@example.com", i),
+				Handle:       fmt.Sprintf("zzpage%d.dev.atlaspds.net", i),
+				PdsHost:      testPDSHost,
+				CreatedAt:    timestamppb.New(time.Now()),
+				PasswordHash: fmt.Appendf(nil, "hash%d", i),
+				SigningKey:   fmt.Appendf(nil, "key%d", i),
+				RotationKeys: [][]byte{fmt.Appendf(nil, "rotation%d", i)},
 			}
 			err := db.SaveActor(ctx, actor)
 			require.NoError(t, err)
@@ -545,15 +527,14 @@ func TestListActors(t *testing.T) {
 		// create 5 actors
 		for i := 1; i <= 5; i++ {
 			actor := &types.Actor{
-				Did:           fmt.Sprintf("%s%03d", prefix, i),
-				Email:         fmt.Sprintf("zzmid%d@example.com", i),
-				Handle:        fmt.Sprintf("zzmid%d.dev.atlaspds.net", i),
-				PdsHost:       testPDSHost,
-				CreatedAt:     timestamppb.New(time.Now()),
-				PasswordHash:  fmt.Appendf(nil, "hash%d", i),
-				SigningKey:    fmt.Appendf(nil, "key%d", i),
-				RotationKeys:  [][]byte{fmt.Appendf(nil, "rotation%d", i)},
-				RefreshTokens: []*types.RefreshToken{},
+				Did:          fmt.Sprintf("%s%03d", prefix, i),
+				Email:        fmt.Sprintf("zzmid%d@example.com", i),
+				Handle:       fmt.Sprintf("zzmid%d.dev.atlaspds.net", i),
+				PdsHost:      testPDSHost,
+				CreatedAt:    timestamppb.New(time.Now()),
+				PasswordHash: fmt.Appendf(nil, "hash%d", i),
+				SigningKey:   fmt.Appendf(nil, "key%d", i),
+				RotationKeys: [][]byte{fmt.Appendf(nil, "rotation%d", i)},
 			}
 			err := db.SaveActor(ctx, actor)
 			require.NoError(t, err)
@@ -578,15 +559,14 @@ func TestListActors(t *testing.T) {
 		// create 5 actors
 		for i := 1; i <= 5; i++ {
 			actor := &types.Actor{
-				Did:           fmt.Sprintf("%s%03d", prefix, i),
-				Email:         fmt.Sprintf("zzlast%d@example.com", i),
-				Handle:        fmt.Sprintf("zzlast%d.dev.atlaspds.net", i),
-				PdsHost:       testPDSHost,
-				CreatedAt:     timestamppb.New(time.Now()),
-				PasswordHash:  fmt.Appendf(nil, "hash%d", i),
-				SigningKey:    fmt.Appendf(nil, "key%d", i),
-				RotationKeys:  [][]byte{fmt.Appendf(nil, "rotation%d", i)},
-				RefreshTokens: []*types.RefreshToken{},
+				Did:          fmt.Sprintf("%s%03d", prefix, i),
+				Email:        fmt.Sprintf("zzlast%d@example.com", i),
+				Handle:       fmt.Sprintf("zzlast%d.dev.atlaspds.net", i),
+				PdsHost:      testPDSHost,
+				CreatedAt:    timestamppb.New(time.Now()),
+				PasswordHash: fmt.Appendf(nil, "hash%d", i),
+				SigningKey:   fmt.Appendf(nil, "key%d", i),
+				RotationKeys: [][]byte{fmt.Appendf(nil, "rotation%d", i)},
 			}
 			err := db.SaveActor(ctx, actor)
 			require.NoError(t, err)
@@ -608,15 +588,14 @@ func TestListActors(t *testing.T) {
 		// create 3 actors
 		for i := 1; i <= 3; i++ {
 			actor := &types.Actor{
-				Did:           fmt.Sprintf("%s%03d", prefix, i),
-				Email:         fmt.Sprintf("zzone%d@example.com", i),
-				Handle:        fmt.Sprintf("zzone%d.dev.atlaspds.net", i),
-				PdsHost:       testPDSHost,
-				CreatedAt:     timestamppb.New(time.Now()),
-				PasswordHash:  fmt.Appendf(nil, "hash%d", i),
-				SigningKey:    fmt.Appendf(nil, "key%d", i),
-				RotationKeys:  [][]byte{fmt.Appendf(nil, "rotation%d", i)},
-				RefreshTokens: []*types.RefreshToken{},
+				Did:          fmt.Sprintf("%s%03d", prefix, i),
+				Email:        fmt.Sprintf("zzone%d@example.com", i),
+				Handle:       fmt.Sprintf("zzone%d.dev.atlaspds.net", i),
+				PdsHost:      testPDSHost,
+				CreatedAt:    timestamppb.New(time.Now()),
+				PasswordHash: fmt.Appendf(nil, "hash%d", i),
+				SigningKey:   fmt.Appendf(nil, "key%d", i),
+				RotationKeys: [][]byte{fmt.Appendf(nil, "rotation%d", i)},
 			}
 			err := db.SaveActor(ctx, actor)
 			require.NoError(t, err)
@@ -640,15 +619,14 @@ func TestListActors(t *testing.T) {
 		dids := []string{prefix + "zzz", prefix + "aaa", prefix + "mmm"}
 		for _, did := range dids {
 			actor := &types.Actor{
-				Did:           did,
-				Email:         did + "@example.com",
-				Handle:        did + ".dev.atlaspds.net",
-				PdsHost:       testPDSHost,
-				CreatedAt:     timestamppb.New(time.Now()),
-				PasswordHash:  []byte("hash"),
-				SigningKey:    []byte("key"),
-				RotationKeys:  [][]byte{[]byte("rotation")},
-				RefreshTokens: []*types.RefreshToken{},
+				Did:          did,
+				Email:        did + "@example.com",
+				Handle:       did + ".dev.atlaspds.net",
+				PdsHost:      testPDSHost,
+				CreatedAt:    timestamppb.New(time.Now()),
+				PasswordHash: []byte("hash"),
+				SigningKey:   []byte("key"),
+				RotationKeys: [][]byte{[]byte("rotation")},
 			}
 			err := db.SaveActor(ctx, actor)
 			require.NoError(t, err)
@@ -672,15 +650,14 @@ func TestListActors(t *testing.T) {
 		// create actors
 		for i := 1; i <= 3; i++ {
 			actor := &types.Actor{
-				Did:           fmt.Sprintf("%s%03d", prefix, i),
-				Email:         fmt.Sprintf("zzbeyond%d@example.com", i),
-				Handle:        fmt.Sprintf("zzbeyond%d.dev.atlaspds.net", i),
-				PdsHost:       testPDSHost,
-				CreatedAt:     timestamppb.New(time.Now()),
-				PasswordHash:  fmt.Appendf(nil, "hash%d", i),
-				SigningKey:    fmt.Appendf(nil, "key%d", i),
-				RotationKeys:  [][]byte{fmt.Appendf(nil, "rotation%d", i)},
-				RefreshTokens: []*types.RefreshToken{},
+				Did:          fmt.Sprintf("%s%03d", prefix, i),
+				Email:        fmt.Sprintf("zzbeyond%d@example.com", i),
+				Handle:       fmt.Sprintf("zzbeyond%d.dev.atlaspds.net", i),
+				PdsHost:      testPDSHost,
+				CreatedAt:    timestamppb.New(time.Now()),
+				PasswordHash: fmt.Appendf(nil, "hash%d", i),
+				SigningKey:   fmt.Appendf(nil, "key%d", i),
+				RotationKeys: [][]byte{fmt.Appendf(nil, "rotation%d", i)},
 			}
 			err := db.SaveActor(ctx, actor)
 			require.NoError(t, err)
@@ -708,15 +685,14 @@ func TestListActors(t *testing.T) {
 			did := fmt.Sprintf("%s%03d", prefix, i)
 			expectedDIDs[i-1] = did
 			actor := &types.Actor{
-				Did:           did,
-				Email:         fmt.Sprintf("zzwalk%d@example.com", i),
-				Handle:        fmt.Sprintf("zzwalk%d.dev.atlaspds.net", i),
-				PdsHost:       testPDSHost,
-				CreatedAt:     timestamppb.New(time.Now()),
-				PasswordHash:  fmt.Appendf(nil, "hash%d", i),
-				SigningKey:    fmt.Appendf(nil, "key%d", i),
-				RotationKeys:  [][]byte{fmt.Appendf(nil, "rotation%d", i)},
-				RefreshTokens: []*types.RefreshToken{},
+				Did:          did,
+				Email:        fmt.Sprintf("zzwalk%d@example.com", i),
+				Handle:       fmt.Sprintf("zzwalk%d.dev.atlaspds.net", i),
+				PdsHost:      testPDSHost,
+				CreatedAt:    timestamppb.New(time.Now()),
+				PasswordHash: fmt.Appendf(nil, "hash%d", i),
+				SigningKey:   fmt.Appendf(nil, "key%d", i),
+				RotationKeys: [][]byte{fmt.Appendf(nil, "rotation%d", i)},
 			}
 			err := db.SaveActor(ctx, actor)
 			require.NoError(t, err)
@@ -769,3 +745,215 @@ func TestListActors(t *testing.T) {
 		}
 	})
 }
+
+// newTestActor saves an actor with a unique did, email and handle on the given host
+func newTestActor(t *testing.T, db *DB, host string) *types.Actor {
+	t.Helper()
+
+	id := uuid.NewString()
+	actor := &types.Actor{
+		Did:          "did:plc:" + id,
+		Email:        id + "@example.com",
+		Handle:       id + ".dev.atlaspds.net",
+		PdsHost:      host,
+		CreatedAt:    timestamppb.New(time.Now()),
+		PasswordHash: []byte("hash"),
+		SigningKey:   []byte("key"),
+		RotationKeys: [][]byte{[]byte("rotation")},
+		Active:       true,
+	}
+	require.NoError(t, db.SaveActor(t.Context(), actor))
+
+	return actor
+}
+
+// newTestSession returns an unexpired session of the given actor
+func newTestSession(did string) *types.RefreshSession {
+	jti := uuid.NewString()
+	return &types.RefreshSession{
+		Did:             did,
+		Jti:             jti,
+		Family:          jti,
+		TokenHash:       []byte("hash-" + jti),
+		CreatedAt:       timestamppb.Now(),
+		ExpiresAt:       timestamppb.New(time.Now().Add(time.Hour)),
+		FamilyCreatedAt: timestamppb.Now(),
+	}
+}
+
+func TestUpdateActorHandle(t *testing.T) {
+	t.Parallel()
+	db := testDB(t)
+	ctx := context.Background()
+
+	actor := newTestActor(t, db, testPDSHost)
+	other := newTestActor(t, db, testPDSHost)
+
+	handle := uuid.NewString() + ".dev.atlaspds.net"
+	updated, err := db.UpdateActorHandle(ctx, actor.Did, handle)
+	require.NoError(t, err)
+	require.Equal(t, handle, updated.Handle)
+
+	byHandle, err := db.GetActorByHandle(ctx, handle)
+	require.NoError(t, err)
+	require.Equal(t, actor.Did, byHandle.Did)
+
+	// the old handle no longer resolves
+	_, err = db.GetActorByHandle(ctx, actor.Handle)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	_, err = db.UpdateActorHandle(ctx, actor.Did, other.Handle)
+	require.ErrorIs(t, err, ErrHandleTaken)
+
+	_, err = db.UpdateActorHandle(ctx, "did:plc:"+uuid.NewString(), uuid.NewString()+".dev.atlaspds.net")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestUpdateActorEmail(t *testing.T) {
+	t.Parallel()
+	db := testDB(t)
+	ctx := context.Background()
+
+	actor := newTestActor(t, db, testPDSHost)
+	actor.EmailConfirmed = true
+	require.NoError(t, db.SaveActor(ctx, actor))
+	other := newTestActor(t, db, testPDSHost)
+
+	email := uuid.NewString() + "@example.com"
+	updated, err := db.UpdateActorEmail(ctx, actor.Did, email)
+	require.NoError(t, err)
+	require.Equal(t, email, updated.Email)
+	require.False(t, updated.EmailConfirmed)
+
+	_, err = db.GetActorByEmail(ctx, testPDSHost, actor.Email)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	_, err = db.UpdateActorEmail(ctx, actor.Did, other.Email)
+	require.ErrorIs(t, err, ErrEmailTaken)
+
+	// emails are only unique per host
+	elsewhere := newTestActor(t, db, "admin-email.example.com")
+	_, err = db.UpdateActorEmail(ctx, elsewhere.Did, other.Email)
+	require.NoError(t, err)
+}
+
+func TestUpdateActorPassword(t *testing.T) {
+	t.Parallel()
+	db := testDB(t)
+	ctx := context.Background()
+
+	actor := newTestActor(t, db, testPDSHost)
+	session := newTestSession(actor.Did)
+	require.NoError(t, db.CreateSession(ctx, session))
+
+	require.NoError(t, db.UpdateActorPassword(ctx, actor.Did, []byte("new-hash")))
+
+	updated, err := db.GetActorByDID(ctx, actor.Did)
+	require.NoError(t, err)
+	require.Equal(t, []byte("new-hash"), updated.PasswordHash)
+
+	_, err = db.GetSession(ctx, actor.Did, session.Jti)
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestDisableActorInvites(t *testing.T) {
+	t.Parallel()
+	db := testDB(t)
+	ctx := context.Background()
+
+	actor := newTestActor(t, db, testPDSHost)
+	codes, err := db.EnsureAccountInviteCodes(ctx, testPDSHost, actor.Did, 2, uuid.NewString)
+	require.NoError(t, err)
+	require.Len(t, codes, 2)
+
+	require.NoError(t, db.DisableActorInvites(ctx, actor.Did, "too many invites"))
+
+	updated, err := db.GetActorByDID(ctx, actor.Did)
+	require.NoError(t, err)
+	require.True(t, updated.InvitesDisabled)
+	require.Equal(t, "too many invites", updated.InviteNote)
+
+	codes, err = db.ListAccountInviteCodes(ctx, testPDSHost, actor.Did)
+	require.NoError(t, err)
+	require.Len(t, codes, 2)
+	for _, code := range codes {
+		require.True(t, code.Disabled)
+	}
+}
+
+func TestSearchActorsByEmail(t *testing.T) {
+	t.Parallel()
+	db := testDB(t)
+	ctx := context.Background()
+
+	host := "search-" + uuid.NewString() + ".example.com"
+	var emails []string
+	for i := range 5 {
+		actor := newTestActor(t, db, host)
+		email := fmt.Sprintf("match%d@example.com", i)
+		if i == 4 {
+			email = "nomatch@example.com"
+		}
+		_, err := db.UpdateActorEmail(ctx, actor.Did, email)
+		require.NoError(t, err)
+		emails = append(emails, email)
+	}
+
+	var found []string
+	cursor := ""
+	for {
+		actors, next, err := db.SearchActorsByEmail(ctx, host, "match", cursor, 3)
+		require.NoError(t, err)
+		for _, actor := range actors {
+			found = append(found, actor.Email)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	require.Equal(t, emails[:4], found)
+
+	// an empty prefix matches every actor on the host
+	all, next, err := db.SearchActorsByEmail(ctx, host, "", "", 10)
+	require.NoError(t, err)
+	require.Len(t, all, 5)
+	require.Empty(t, next)
+}
+
+func TestDeleteActor(t *testing.T) {
+	t.Parallel()
+	db := testDB(t)
+	ctx := context.Background()
+
+	actor := newTestActor(t, db, testPDSHost)
+	session := newTestSession(actor.Did)
+	require.NoError(t, db.CreateSession(ctx, session))
+
+	codes, err := db.EnsureAccountInviteCodes(ctx, testPDSHost, actor.Did, 1, uuid.NewString)
+	require.NoError(t, err)
+
+	require.NoError(t, db.DeleteActor(ctx, actor.Did))
+
+	_, err = db.GetActorByDID(ctx, actor.Did)
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = db.GetActorByHandle(ctx, actor.Handle)
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = db.GetActorByEmail(ctx, testPDSHost, actor.Email)
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = db.GetSession(ctx, actor.Did, session.Jti)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	actors, _, err := db.ListActors(ctx, testPDSHost, "", 1<<20)
+	require.NoError(t, err)
+	for _, a := range actors {
+		require.NotEqual(t, actor.Did, a.Did)
+	}
+
+	// invite codes are kept, but can't be used
+	code, err := db.GetInviteCode(ctx, codes[0].Code)
+	require.NoError(t, err)
+	require.True(t, code.Disabled)
+
+	require.ErrorIs(t, db.DeleteActor(ctx, actor.Did), ErrNotFound)
+}
@@ -0,0 +1,198 @@
+package db
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/jcalabro/atlas/internal/types"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrInvalidAuditCursor is returned when an audit log cursor isn't one that ListAuditEvents issued
+var ErrInvalidAuditCursor = errors.New("invalid audit cursor")
+
+func validateAuditEvent(event *types.AuditEvent) error {
+	switch {
+	case event == nil:
+		return fmt.Errorf("audit event is nil")
+	case event.PdsHost == "":
+		return fmt.Errorf("pds host is required")
+	case event.Actor == "":
+		return fmt.Errorf("actor is required")
+	case event.Action == "":
+		return fmt.Errorf("action is required")
+	case event.CreatedAt == nil:
+		return fmt.Errorf("created at is required")
+	}
+
+	return nil
+}
+
+// AppendAuditEvent adds an event to the host's audit log and returns the id it was stored under.
+// Events are never modified or removed once written.
+func (db *DB) AppendAuditEvent(ctx context.Context, event *types.AuditEvent) (id string, err error) {
+	_, span, done := db.observe(ctx, "AppendAuditEvent")
+	defer func() { done(err) }()
+
+	if err = validateAuditEvent(event); err != nil {
+		err = fmt.Errorf("invalid audit event: %w", err)
+		return
+	}
+
+	span.SetAttributes(
+		attribute.String("pds_host", event.PdsHost),
+		attribute.String("actor", event.Actor),
+		attribute.String("action", event.Action),
+		attribute.String("subject", event.Subject),
+	)
+
+	stored := proto.Clone(event).(*types.AuditEvent)
+	stored.Id = "" // derived from the key when read
+
+	buf, err := proto.Marshal(stored)
+	if err != nil {
+		err = fmt.Errorf("failed to protobuf marshal audit event: %w", err)
+		return
+	}
+
+	// the versionstamp is only known once the transaction commits
+	var versionstamp fdb.FutureKey
+	_, err = transaction(db.db, func(tx fdb.Transaction) (any, error) {
+		tx.SetVersionstampedKey(versionstampedKey(pack(db.audit.events, event.PdsHost), nil), buf)
+		if event.Subject != "" {
+			tx.SetVersionstampedKey(versionstampedKey(pack(db.audit.bySubject, event.PdsHost, event.Subject), nil), nil)
+		}
+		tx.SetVersionstampedKey(versionstampedKey(pack(db.audit.byActor, event.PdsHost, event.Actor), nil), nil)
+
+		versionstamp = tx.GetVersionstamp()
+		return nil, nil
+	})
+	if err != nil {
+		return
+	}
+
+	vs, err := versionstamp.Get()
+	if err != nil {
+		err = fmt.Errorf("failed to get audit event versionstamp: %w", err)
+		return
+	}
+
+	id = hex.EncodeToString(vs)
+	span.SetAttributes(attribute.String("id", id))
+	return
+}
+
+// AuditQuery selects events from a host's audit log. At most one of Subject and Actor may be set.
+type AuditQuery struct {
+	Host    string
+	Subject string
+	Actor   string
+
+	// The id of the last event on the previous page
+	Cursor string
+	Limit  int
+}
+
+// ListAuditEvents lists a host's audit log, newest first, optionally only the events for one
+// subject or by one actor. The next cursor is empty when there are no more events.
+func (db *DB) ListAuditEvents(ctx context.Context, q *AuditQuery) (events []*types.AuditEvent, nextCursor string, err error) {
+	_, span, done := db.observe(ctx, "ListAuditEvents")
+	defer func() { done(err) }()
+
+	span.SetAttributes(
+		attribute.String("pds_host", q.Host),
+		attribute.String("subject", q.Subject),
+		attribute.String("actor", q.Actor),
+		attribute.String("cursor", q.Cursor),
+		attribute.Int("limit", q.Limit),
+	)
+
+	if q.Subject != "" && q.Actor != "" {
+		err = fmt.Errorf("only one of subject and actor may be given")
+		return
+	}
+
+	var prefix fdb.Key
+	switch {
+	case q.Subject != "":
+		prefix = pack(db.audit.bySubject, q.Host, q.Subject)
+	case q.Actor != "":
+		prefix = pack(db.audit.byActor, q.Host, q.Actor)
+	default:
+		prefix = pack(db.audit.events, q.Host)
+	}
+
+	kr, err := fdb.PrefixRange(prefix)
+	if err != nil {
+		err = fmt.Errorf("failed to create audit range: %w", err)
+		return
+	}
+
+	if q.Cursor != "" {
+		var vs []byte
+		vs, err = hex.DecodeString(q.Cursor)
+		if err != nil || len(vs) != versionstampLength {
+			err = ErrInvalidAuditCursor
+			return
+		}
+		kr.End = fdb.Key(append(slices.Clone(prefix), vs...))
+	}
+
+	type result struct {
+		events []*types.AuditEvent
+		more   bool
+	}
+
+	res, err := readTransaction(db.db, func(tx fdb.ReadTransaction) (*result, error) {
+		kvs, err := tx.GetRange(kr, fdb.RangeOptions{Limit: q.Limit + 1, Reverse: true}).GetSliceWithError()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list audit events: %w", err)
+		}
+
+		res := &result{}
+		if len(kvs) > q.Limit {
+			kvs = kvs[:q.Limit]
+			res.more = true
+		}
+
+		for _, kv := range kvs {
+			vs := kv.Key[len(prefix):]
+			if len(vs) != versionstampLength {
+				return nil, fmt.Errorf("invalid audit key length %d", len(kv.Key))
+			}
+
+			buf := kv.Value
+			if q.Subject != "" || q.Actor != "" {
+				buf, err = tx.Get(fdb.Key(append(pack(db.audit.events, q.Host), vs...))).Get()
+				if err != nil {
+					return nil, fmt.Errorf("failed to get audit event: %w", err)
+				}
+			}
+
+			var event types.AuditEvent
+			if err := proto.Unmarshal(buf, &event); err != nil {
+				return nil, fmt.Errorf("failed to protobuf unmarshal audit event: %w", err)
+			}
+			event.Id = hex.EncodeToString(vs)
+
+			res.events = append(res.events, &event)
+		}
+
+		return res, nil
+	})
+	if err != nil {
+		return
+	}
+
+	events = res.events
+	if res.more {
+		nextCursor = events[len(events)-1].Id
+	}
+
+	return
+}
@@ -0,0 +1,122 @@
+package db
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jcalabro/atlas/internal/types"
+	"github.com/jcalabro/atlas/internal/util"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestValidateAuditEvent(t *testing.T) {
+	t.Parallel()
+
+	valid := func() *types.AuditEvent {
+		return &types.AuditEvent{
+			PdsHost:   testPDSHost,
+			Actor:     "admin",
+			Action:    "com.atproto.admin.deleteAccount",
+			CreatedAt: timestamppb.Now(),
+		}
+	}
+	require.NoError(t, validateAuditEvent(valid()))
+	require.Error(t, validateAuditEvent(nil))
+
+	for _, mutate := range []func(*types.AuditEvent){
+		func(e *types.AuditEvent) { e.PdsHost = "" },
+		func(e *types.AuditEvent) { e.Actor = "" },
+		func(e *types.AuditEvent) { e.Action = "" },
+		func(e *types.AuditEvent) { e.CreatedAt = nil },
+	} {
+		event := valid()
+		mutate(event)
+		require.Error(t, validateAuditEvent(event))
+	}
+}
+
+func TestAuditEvents(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	db := testDB(t)
+
+	host := "audit-" + strings.ToLower(util.RandString(8)) + ".dev.atlaspds.dev"
+
+	appendEvent := func(host, actor, subject string) string {
+		id, err := db.AppendAuditEvent(ctx, &types.AuditEvent{
+			PdsHost:   host,
+			Actor:     actor,
+			Action:    "com.atproto.admin.updateAccountEmail",
+			Subject:   subject,
+			Before:    `{"email":"old@example.com"}`,
+			After:     `{"email":"new@example.com"}`,
+			RequestId: "request-" + subject,
+			CreatedAt: timestamppb.Now(),
+		})
+		require.NoError(t, err)
+		require.Len(t, id, 2*versionstampLength)
+		return id
+	}
+
+	var ids []string
+	for _, subject := range []string{"did:plc:alice", "did:plc:bob", "did:plc:alice", "did:plc:carol"} {
+		ids = append(ids, appendEvent(host, "did:plc:admin", subject))
+	}
+	ids = append(ids, appendEvent(host, "admin", "did:plc:alice"))
+	appendEvent("other-"+host, "admin", "did:plc:alice")
+
+	_, err := db.AppendAuditEvent(ctx, &types.AuditEvent{PdsHost: host})
+	require.Error(t, err)
+
+	list := func(q *AuditQuery) ([]string, string) {
+		t.Helper()
+
+		events, next, err := db.ListAuditEvents(ctx, q)
+		require.NoError(t, err)
+
+		var out []string
+		for _, event := range events {
+			require.Equal(t, host, event.PdsHost)
+			out = append(out, event.Id)
+		}
+		return out, next
+	}
+
+	// newest first, and paginated
+	page, next := list(&AuditQuery{Host: host, Limit: 3})
+	require.Equal(t, []string{ids[4], ids[3], ids[2]}, page)
+	require.Equal(t, ids[2], next)
+
+	page, next = list(&AuditQuery{Host: host, Cursor: next, Limit: 3})
+	require.Equal(t, []string{ids[1], ids[0]}, page)
+	require.Empty(t, next)
+
+	page, _ = list(&AuditQuery{Host: host, Subject: "did:plc:alice", Limit: 10})
+	require.Equal(t, []string{ids[4], ids[2], ids[0]}, page)
+
+	page, next = list(&AuditQuery{Host: host, Subject: "did:plc:alice", Limit: 1})
+	require.Equal(t, []string{ids[4]}, page)
+	page, _ = list(&AuditQuery{Host: host, Subject: "did:plc:alice", Cursor: next, Limit: 10})
+	require.Equal(t, []string{ids[2], ids[0]}, page)
+
+	page, _ = list(&AuditQuery{Host: host, Actor: "admin", Limit: 10})
+	require.Equal(t, []string{ids[4]}, page)
+
+	page, _ = list(&AuditQuery{Host: host, Actor: "did:plc:admin", Limit: 10})
+	require.Equal(t, []string{ids[3], ids[2], ids[1], ids[0]}, page)
+
+	events, _, err := db.ListAuditEvents(ctx, &AuditQuery{Host: host, Subject: "did:plc:carol", Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, "did:plc:admin", events[0].Actor)
+	require.Equal(t, `{"email":"old@example.com"}`, events[0].Before)
+	require.Equal(t, `{"email":"new@example.com"}`, events[0].After)
+	require.Equal(t, "request-did:plc:carol", events[0].RequestId)
+
+	_, _, err = db.ListAuditEvents(ctx, &AuditQuery{Host: host, Cursor: "nope", Limit: 10})
+	require.ErrorIs(t, err, ErrInvalidAuditCursor)
+
+	_, _, err = db.ListAuditEvents(ctx, &AuditQuery{Host: host, Subject: "did:plc:alice", Actor: "admin", Limit: 10})
+	require.Error(t, err)
+}
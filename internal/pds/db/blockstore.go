@@ -156,21 +156,7 @@ func (bs *blockstore) Put(ctx context.Context, blk blocks.Block) error {
 		return fmt.Errorf("blockstore put requires a write transaction")
 	}
 
-	// write to primary index
-	key := pack(bs.db.blockDir.blocks, bs.did, blk.Cid().Bytes())
-	(*bs.writeTx).Set(key, blk.RawData())
-
-	// write to secondary index for incremental sync
-	if bs.rev != "" {
-		revKey := pack(bs.db.blockDir.blocksByRev, bs.did, bs.rev, blk.Cid().Bytes())
-		(*bs.writeTx).Set(revKey, nil)
-	}
-
-	// track writes for CAR file generation
-	if bs.trackWrites {
-		bs.writeLog = append(bs.writeLog, blk)
-	}
-
+	bs.put(blk)
 	return nil
 }
 
@@ -181,25 +167,35 @@ func (bs *blockstore) PutMany(ctx context.Context, blks []blocks.Block) error {
 	}
 
 	for _, blk := range blks {
-		// write to primary index
-		key := pack(bs.db.blockDir.blocks, bs.did, blk.Cid().Bytes())
-		(*bs.writeTx).Set(key, blk.RawData())
-
-		// write to secondary index for incremental sync
-		if bs.rev != "" {
-			revKey := pack(bs.db.blockDir.blocksByRev, bs.did, bs.rev, blk.Cid().Bytes())
-			(*bs.writeTx).Set(revKey, nil)
-		}
-
-		// track writes for CAR file generation
-		if bs.trackWrites {
-			bs.writeLog = append(bs.writeLog, blk)
-		}
+		bs.put(blk)
 	}
 
 	return nil
 }
 
+// put writes a block and its secondary index entries to the write transaction
+func (bs *blockstore) put(blk blocks.Block) {
+	tx := *bs.writeTx
+	cidBytes := blk.Cid().Bytes()
+
+	// write to primary index
+	tx.Set(pack(bs.db.blockDir.blocks, bs.did, cidBytes), blk.RawData())
+
+	// write to secondary indices for incremental sync and garbage collection
+	if bs.rev != "" {
+		tx.Set(pack(bs.db.blockDir.blocksByRev, bs.did, bs.rev, cidBytes), nil)
+		tx.Set(pack(bs.db.blockDir.revsByBlock, bs.did, cidBytes), []byte(bs.rev))
+	}
+
+	// the block is referenced again, so cancel any pending deletion
+	tx.Clear(pack(bs.db.blockDir.gcPending, bs.did, cidBytes))
+
+	// track writes for CAR file generation
+	if bs.trackWrites {
+		bs.writeLog = append(bs.writeLog, blk)
+	}
+}
+
 // DeleteBlock removes a block from the store. Requires transactional mode.
 func (bs *blockstore) DeleteBlock(ctx context.Context, c cid.Cid) error {
 	if bs.writeTx == nil {
@@ -301,79 +297,3 @@ func (db *DB) GetAllBlocks(ctx context.Context, did string) (result []blocks.Blo
 
 	return
 }
-
-// GetBlocksSince retrieves all blocks added after the given revision.
-// Used for incremental sync via the `since` parameter.
-func (db *DB) GetBlocksSince(ctx context.Context, did string, sinceRev string) (result []blocks.Block, err error) {
-	_, span, done := db.observe(ctx, "GetBlocksSince")
-	defer func() { done(err) }()
-
-	span.SetAttributes(
-		attribute.String("did", did),
-		attribute.String("since", sinceRev),
-	)
-
-	result, err = readTransaction(db.db, func(tx fdb.ReadTransaction) ([]blocks.Block, error) {
-		// query the secondary index for all revisions after sinceRev
-		// use sinceRev + "\x00" to exclude the exact sinceRev
-		rangeBegin := pack(db.blockDir.blocksByRev, did, sinceRev+"\x00")
-		rangeEnd := pack(db.blockDir.blocksByRev, did+"\xff")
-
-		kr := fdb.KeyRange{Begin: rangeBegin, End: rangeEnd}
-
-		// collect all CIDs from the secondary index
-		var cids []cid.Cid
-		iter := tx.GetRange(kr, fdb.RangeOptions{}).Iterator()
-		for iter.Advance() {
-			kv, err := iter.Get()
-			if err != nil {
-				return nil, fmt.Errorf("failed to iterate blocks_by_rev: %w", err)
-			}
-
-			// extract CID bytes from the key tuple (did, rev, cid_bytes)
-			tup, err := db.blockDir.blocksByRev.Unpack(kv.Key)
-			if err != nil {
-				return nil, fmt.Errorf("failed to unpack blocks_by_rev key: %w", err)
-			}
-			if len(tup) < 3 {
-				continue
-			}
-
-			cidBytes, ok := tup[2].([]byte)
-			if !ok {
-				continue
-			}
-
-			_, c, err := cid.CidFromBytes(cidBytes)
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse cid from key: %w", err)
-			}
-
-			cids = append(cids, c)
-		}
-
-		// fetch the actual block data from the primary index
-		blks := make([]blocks.Block, 0, len(cids))
-		for _, c := range cids {
-			key := pack(db.blockDir.blocks, did, c.Bytes())
-			val, err := tx.Get(key).Get()
-			if err != nil {
-				return nil, fmt.Errorf("failed to get block: %w", err)
-			}
-			if val == nil {
-				// block was deleted, skip
-				continue
-			}
-
-			blk, err := blocks.NewBlockWithCid(val, c)
-			if err != nil {
-				return nil, fmt.Errorf("failed to create block: %w", err)
-			}
-			blks = append(blks, blk)
-		}
-
-		return blks, nil
-	})
-
-	return
-}
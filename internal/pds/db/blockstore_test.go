@@ -436,6 +436,33 @@ func TestBlockstore_TransactionRollback(t *testing.T) {
 	})
 }
 
+// revIndex returns the blocks_by_rev index entries of a repo, mapping each block to its revision
+func revIndex(t *testing.T, db *DB, did string) map[cid.Cid]string {
+	t.Helper()
+
+	kvs, err := readTransaction(db.db, func(tx fdb.ReadTransaction) ([]fdb.KeyValue, error) {
+		kr, err := fdb.PrefixRange(pack(db.blockDir.blocksByRev, did))
+		if err != nil {
+			return nil, err
+		}
+		return tx.GetRange(kr, fdb.RangeOptions{}).GetSliceWithError()
+	})
+	require.NoError(t, err)
+
+	index := make(map[cid.Cid]string, len(kvs))
+	for _, kv := range kvs {
+		tup, err := db.blockDir.blocksByRev.Unpack(kv.Key)
+		require.NoError(t, err)
+		require.Len(t, tup, 3)
+
+		_, c, err := cid.CidFromBytes(tup[2].([]byte))
+		require.NoError(t, err)
+		index[c] = tup[1].(string)
+	}
+
+	return index
+}
+
 func TestBlockstore_SetRev(t *testing.T) {
 	t.Parallel()
 	db := testDB(t)
@@ -465,11 +492,8 @@ func TestBlockstore_SetRev(t *testing.T) {
 		})
 		require.NoError(t, err)
 
-		// verify secondary index was populated via GetBlocksSince
-		blocksSince, err := db.GetBlocksSince(ctx, did, "")
-		require.NoError(t, err)
-		require.Len(t, blocksSince, 1)
-		require.Equal(t, blk.Cid(), blocksSince[0].Cid())
+		// verify secondary index was populated
+		require.Equal(t, map[cid.Cid]string{blk.Cid(): rev}, revIndex(t, db, did))
 	})
 
 	t.Run("SetRev populates secondary index on PutMany", func(t *testing.T) {
@@ -488,16 +512,7 @@ func TestBlockstore_SetRev(t *testing.T) {
 		require.NoError(t, err)
 
 		// verify secondary index was populated
-		blocksSince, err := db.GetBlocksSince(ctx, did, "")
-		require.NoError(t, err)
-		require.Len(t, blocksSince, 2)
-
-		cidSet := make(map[string]bool)
-		for _, blk := range blocksSince {
-			cidSet[blk.Cid().String()] = true
-		}
-		require.True(t, cidSet[blk1.Cid().String()])
-		require.True(t, cidSet[blk2.Cid().String()])
+		require.Equal(t, map[cid.Cid]string{blk1.Cid(): rev, blk2.Cid(): rev}, revIndex(t, db, did))
 	})
 
 	t.Run("no rev means no secondary index writes", func(t *testing.T) {
@@ -524,10 +539,8 @@ func TestBlockstore_SetRev(t *testing.T) {
 		})
 		require.NoError(t, err)
 
-		// but GetBlocksSince returns nothing (no secondary index entry)
-		blocksSince, err := db.GetBlocksSince(ctx, did, "")
-		require.NoError(t, err)
-		require.Len(t, blocksSince, 0)
+		// but there's no secondary index entry
+		require.Empty(t, revIndex(t, db, did))
 	})
 }
 
@@ -603,154 +616,124 @@ func TestGetAllBlocks(t *testing.T) {
 	})
 }
 
-func TestGetBlocksSince(t *testing.T) {
+func TestStreamRepoDiff(t *testing.T) {
 	t.Parallel()
 	db := testDB(t)
-	ctx := t.Context()
 
-	t.Run("returns blocks after specified revision", func(t *testing.T) {
-		t.Parallel()
+	// diff returns the blocks of the diff from since to the repo's head
+	diff := func(t *testing.T, did, since string) (map[cid.Cid]struct{}, error) {
+		t.Helper()
 
-		did := "did:plc:since1"
-		rev1 := "3jqfcqzm3fo21"
-		rev2 := "3jqfcqzm3fo22"
-		rev3 := "3jqfcqzm3fo23"
+		got := make(map[cid.Cid]struct{})
+		err := db.StreamRepoDiff(t.Context(), did, testHead(t, db, did), since, func(blk blocks.Block) error {
+			got[blk.Cid()] = struct{}{}
+			return nil
+		})
+		return got, err
+	}
 
-		blk1 := makeTestBlock(t, []byte("rev1 block"))
-		blk2 := makeTestBlock(t, []byte("rev2 block"))
-		blk3 := makeTestBlock(t, []byte("rev3 block"))
+	rev := func(t *testing.T, did string) string {
+		t.Helper()
+		actor, err := db.GetActorByDID(t.Context(), did)
+		require.NoError(t, err)
+		return actor.Rev
+	}
 
-		// write blocks with different revisions
-		err := db.Transact(func(tx fdb.Transaction) error {
-			bs := db.newWriteBlockstore(did, tx)
-			bs.SetRev(rev1)
-			if err := bs.Put(ctx, blk1); err != nil {
-				return err
-			}
+	t.Run("returns changes after the specified revision", func(t *testing.T) {
+		t.Parallel()
 
-			bs.SetRev(rev2)
-			if err := bs.Put(ctx, blk2); err != nil {
-				return err
-			}
+		did := "did:plc:since1"
+		testRepoActor(t, db, did)
 
-			bs.SetRev(rev3)
-			return bs.Put(ctx, blk3)
-		})
-		require.NoError(t, err)
+		rec1 := putTestRecord(t, db, did, "3kaaaaaaaaaa2", "rev1")
+		rev1 := rev(t, did)
+		rec2 := putTestRecord(t, db, did, "3kaaaaaaaaab2", "rev2")
+		rec3 := putTestRecord(t, db, did, "3kaaaaaaaaac2", "rev3")
 
-		// get blocks since rev1 (should return rev2 and rev3 blocks)
-		blocksSince, err := db.GetBlocksSince(ctx, did, rev1)
+		got, err := diff(t, did, rev1)
 		require.NoError(t, err)
-		require.Len(t, blocksSince, 2)
-
-		cidSet := make(map[string]bool)
-		for _, blk := range blocksSince {
-			cidSet[blk.Cid().String()] = true
-		}
-		require.False(t, cidSet[blk1.Cid().String()], "rev1 block should not be included")
-		require.True(t, cidSet[blk2.Cid().String()], "rev2 block should be included")
-		require.True(t, cidSet[blk3.Cid().String()], "rev3 block should be included")
+		require.Contains(t, got, testHead(t, db, did))
+		require.Contains(t, got, rec2)
+		require.Contains(t, got, rec3)
+		require.NotContains(t, got, rec1, "records the consumer has should not be included")
 	})
 
-	t.Run("returns empty when since equals latest revision", func(t *testing.T) {
+	t.Run("returns nothing when since is the head revision", func(t *testing.T) {
 		t.Parallel()
 
 		did := "did:plc:since2"
-		rev := "3jqfcqzm3fo2x"
-		blk := makeTestBlock(t, []byte("latest rev block"))
+		testRepoActor(t, db, did)
+		putTestRecord(t, db, did, "3kaaaaaaaaaa2", "latest")
 
-		err := db.Transact(func(tx fdb.Transaction) error {
-			bs := db.newWriteBlockstore(did, tx)
-			bs.SetRev(rev)
-			return bs.Put(ctx, blk)
-		})
-		require.NoError(t, err)
-
-		// get blocks since the current rev (should return nothing)
-		blocksSince, err := db.GetBlocksSince(ctx, did, rev)
+		got, err := diff(t, did, rev(t, did))
 		require.NoError(t, err)
-		require.Len(t, blocksSince, 0)
+		require.Empty(t, got)
 	})
 
-	t.Run("returns all blocks when since is empty", func(t *testing.T) {
+	t.Run("unknown and swept revisions", func(t *testing.T) {
 		t.Parallel()
 
 		did := "did:plc:since3"
-		rev := "3jqfcqzm3fo2y"
-		blk1 := makeTestBlock(t, []byte("block A"))
-		blk2 := makeTestBlock(t, []byte("block B"))
+		testRepoActor(t, db, did)
 
-		err := db.Transact(func(tx fdb.Transaction) error {
-			bs := db.newWriteBlockstore(did, tx)
-			bs.SetRev(rev)
-			return bs.PutMany(ctx, []blocks.Block{blk1, blk2})
-		})
-		require.NoError(t, err)
+		_, err := diff(t, did, "3jqfcqzm3fo2z")
+		require.ErrorIs(t, err, ErrUnknownRev)
 
-		// empty since should return all blocks in secondary index
-		blocksSince, err := db.GetBlocksSince(ctx, did, "")
-		require.NoError(t, err)
-		require.Len(t, blocksSince, 2)
+		putTestRecord(t, db, did, "3kaaaaaaaaaa2", "one")
+		oldRev := rev(t, did)
+		putTestRecord(t, db, did, "3kaaaaaaaaaa2", "one, edited")
+
+		// the old commit is unreachable, so it's gone once the sweeper runs
+		require.Positive(t, sweepTestRepo(t, db, did))
+		_, err = diff(t, did, oldRev)
+		require.ErrorIs(t, err, ErrUnknownRev)
 	})
 
-	t.Run("handles deleted blocks gracefully", func(t *testing.T) {
+	t.Run("swept old tree nodes fail before anything is sent", func(t *testing.T) {
 		t.Parallel()
 
-		did := "did:plc:since4"
-		rev := "3jqfcqzm3fo2z"
-		blk := makeTestBlock(t, []byte("to be deleted"))
+		did := "did:plc:since5"
+		testRepoActor(t, db, did)
 
-		// put block with rev
-		err := db.Transact(func(tx fdb.Transaction) error {
-			bs := db.newWriteBlockstore(did, tx)
-			bs.SetRev(rev)
-			return bs.Put(ctx, blk)
-		})
-		require.NoError(t, err)
+		putTestRecord(t, db, did, "3kaaaaaaaaaa2", "one")
+		oldRev := rev(t, did)
+		putTestRecord(t, db, did, "3kaaaaaaaaab2", "two")
 
-		// delete the block from primary index (but secondary index entry remains)
-		err = db.Transact(func(tx fdb.Transaction) error {
-			bs := db.newWriteBlockstore(did, tx)
-			return bs.DeleteBlock(ctx, blk.Cid())
+		// the old commit is still there, but its tree has been partially swept
+		err := db.Transact(func(tx fdb.Transaction) error {
+			commit, err := db.findCommitByRev(tx, did, oldRev)
+			if err != nil {
+				return err
+			}
+			return db.newWriteBlockstore(did, tx).DeleteBlock(t.Context(), commit.Data)
 		})
 		require.NoError(t, err)
 
-		// GetBlocksSince should skip deleted blocks
-		blocksSince, err := db.GetBlocksSince(ctx, did, "")
-		require.NoError(t, err)
-		require.Len(t, blocksSince, 0, "deleted block should be skipped")
+		got, err := diff(t, did, oldRev)
+		require.ErrorIs(t, err, ErrUnknownRev)
+		require.Empty(t, got)
 	})
 
-	t.Run("blocks are isolated per DID", func(t *testing.T) {
+	t.Run("repos are isolated per DID", func(t *testing.T) {
 		t.Parallel()
 
-		did1 := "did:plc:since5a"
-		did2 := "did:plc:since5b"
-		rev := "3jqfcqzm3fo30"
-		blk1 := makeTestBlock(t, []byte("did1 since block"))
-		blk2 := makeTestBlock(t, []byte("did2 since block"))
+		did1 := "did:plc:since4a"
+		did2 := "did:plc:since4b"
+		testRepoActor(t, db, did1)
+		testRepoActor(t, db, did2)
+		since1, since2 := rev(t, did1), rev(t, did2)
 
-		err := db.Transact(func(tx fdb.Transaction) error {
-			bs1 := db.newWriteBlockstore(did1, tx)
-			bs1.SetRev(rev)
-			if err := bs1.Put(ctx, blk1); err != nil {
-				return err
-			}
-
-			bs2 := db.newWriteBlockstore(did2, tx)
-			bs2.SetRev(rev)
-			return bs2.Put(ctx, blk2)
-		})
-		require.NoError(t, err)
+		rec1 := putTestRecord(t, db, did1, "3kaaaaaaaaaa2", "did1 record")
+		rec2 := putTestRecord(t, db, did2, "3kaaaaaaaaaa2", "did2 record")
 
-		blocks1, err := db.GetBlocksSince(ctx, did1, "")
+		got1, err := diff(t, did1, since1)
 		require.NoError(t, err)
-		require.Len(t, blocks1, 1)
-		require.Equal(t, blk1.Cid(), blocks1[0].Cid())
+		require.Contains(t, got1, rec1)
+		require.NotContains(t, got1, rec2)
 
-		blocks2, err := db.GetBlocksSince(ctx, did2, "")
+		got2, err := diff(t, did2, since2)
 		require.NoError(t, err)
-		require.Len(t, blocks2, 1)
-		require.Equal(t, blk2.Cid(), blocks2[0].Cid())
+		require.Contains(t, got2, rec2)
+		require.NotContains(t, got2, rec1)
 	})
 }
@@ -44,6 +44,37 @@ type DB struct {
 
 	// Blob metadata (actual blob data is in S3)
 	blobs directory.DirectorySubspace
+
+	// Refresh token sessions
+	sessions sessions
+
+	// Rate limit counters and login lockouts
+	rateLimits rateLimits
+
+	// Invite codes that gate account creation
+	invites invites
+
+	// Moderation reports made by each host's accounts
+	reports reports
+
+	// Record and blob takedowns, keyed by (did, "record", collection, rkey) or (did, "blob", cid).
+	// Account takedowns are stored on the actor itself.
+	takedowns directory.DirectorySubspace
+
+	// Labels served from queryLabels and subscribeLabels
+	labels labels
+
+	// Append-only log of admin and moderation mutations
+	audit audit
+
+	// Hosts provisioned at runtime rather than in the config file
+	hostRegistry hostRegistry
+
+	// TLS certificates and ACME state shared by every replica
+	tlsCerts tlsCerts
+
+	// Decrypts actor private keys, which are envelope encrypted per host
+	keys KeyOpener
 }
 
 type actors struct {
@@ -63,6 +94,84 @@ type actors struct {
 	tidsByDID directory.DirectorySubspace
 }
 
+type sessions struct {
+	// Primary index. Refresh sessions are keyed by (did, jti)
+	sessions directory.DirectorySubspace
+
+	// Secondary index. Sessions keyed by (expires_at_us, did, jti) so expired ones can be swept
+	expiry directory.DirectorySubspace
+}
+
+type rateLimits struct {
+	// Request counters keyed by (window_end_unix, name, subject). Keying by the end of the window
+	// first lets expired counters be deleted with a single range clear.
+	counters directory.DirectorySubspace
+
+	// Consecutive failed logins, keyed by did
+	lockouts directory.DirectorySubspace
+}
+
+type invites struct {
+	// Primary index. Invite codes are keyed by (code), since codes are globally unique
+	codes directory.DirectorySubspace
+
+	// Secondary index. Codes keyed by (pds_host, for_account, code) so an account's codes can be listed
+	byAccount directory.DirectorySubspace
+}
+
+type reports struct {
+	// Primary index. Reports are keyed by (pds_host, id)
+	reports directory.DirectorySubspace
+
+	// Secondary index. Unresolved reports keyed by (pds_host, id) so the open queue can be listed
+	open directory.DirectorySubspace
+
+	// The last report id issued by each host, keyed by pds_host
+	lastIDs directory.DirectorySubspace
+}
+
+type labels struct {
+	// Primary index. Labels are keyed by (uri, src, val) so they can be queried by URI prefix
+	labels directory.DirectorySubspace
+
+	// The stream of labels issued by each of this PDS's labelers, keyed by (src, seq). Negations
+	// are kept here so subscribers learn about them.
+	log directory.DirectorySubspace
+
+	// The last seq issued by each labeler, keyed by src
+	lastSeqs directory.DirectorySubspace
+
+	// How far each remote labeler's stream has been consumed, keyed by src
+	cursors directory.DirectorySubspace
+}
+
+type audit struct {
+	// Primary index. Events are keyed by (pds_host, versionstamp)
+	events directory.DirectorySubspace
+
+	// Secondary index. Events keyed by (pds_host, subject, versionstamp)
+	bySubject directory.DirectorySubspace
+
+	// Secondary index. Events keyed by (pds_host, actor, versionstamp)
+	byActor directory.DirectorySubspace
+}
+
+type hostRegistry struct {
+	// Primary index. Registered hosts are keyed by (hostname)
+	hosts directory.DirectorySubspace
+
+	// A counter that's incremented by every change to the registry, so replicas can watch it
+	version directory.DirectorySubspace
+}
+
+type tlsCerts struct {
+	// TLS cache entries keyed by (name)
+	cache directory.DirectorySubspace
+
+	// Issuance locks keyed by (name), so that only one replica orders a certificate at a time
+	locks directory.DirectorySubspace
+}
+
 type records struct {
 	// Primary index. Records are keyed by (did, collection, rkey)
 	records directory.DirectorySubspace
@@ -70,6 +179,15 @@ type records struct {
 	// Secondary index. Tracks count of records per collection per DID.
 	// Key: (did, collection), Value: int64 count (little-endian)
 	collectionCounts directory.DirectorySubspace
+
+	// Secondary index. Records keyed by (did, cid, collection, rkey) so block garbage collection
+	// can tell whether a record block is still referenced by another record with identical content
+	recordsByCID directory.DirectorySubspace
+
+	// Repos whose records have all been written to recordsByCID, keyed by did. Repos created
+	// before that index existed are missing from it until they're backfilled, and block garbage
+	// collection leaves their record blocks alone until then.
+	recordsByCIDIndexed directory.DirectorySubspace
 }
 
 type blockDir struct {
@@ -79,6 +197,17 @@ type blockDir struct {
 	// Secondary index. Blocks keyed by (did, rev, cid) for incremental sync.
 	// Value is empty - this is just for querying which CIDs were added in each rev.
 	blocksByRev directory.DirectorySubspace
+
+	// Reverse of blocksByRev. Keyed by (did, cid), value is the rev the block was last written in.
+	revsByBlock directory.DirectorySubspace
+
+	// Blocks that became unreachable, keyed by (time_us, did, cid) so they can be swept once
+	// they're older than the retention window
+	gcQueue directory.DirectorySubspace
+
+	// Keyed by (did, cid), value is the time_us of the block's authoritative gcQueue entry.
+	// Cleared whenever the block is written again, which cancels the pending deletion.
+	gcPending directory.DirectorySubspace
 }
 
 func New(tracer trace.Tracer, cfg Config) (*DB, error) {
@@ -143,6 +272,16 @@ func New(tracer trace.Tracer, cfg Config) (*DB, error) {
 		return nil, fmt.Errorf("failed to create collection_counts directory: %w", err)
 	}
 
+	db.records.recordsByCID, err = directory.CreateOrOpen(db.db, []string{"records_by_cid"}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create records_by_cid directory: %w", err)
+	}
+
+	db.records.recordsByCIDIndexed, err = directory.CreateOrOpen(db.db, []string{"records_by_cid_indexed"}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create records_by_cid_indexed directory: %w", err)
+	}
+
 	db.blockDir.blocks, err = directory.CreateOrOpen(db.db, []string{"blocks"}, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create blocks directory: %w", err)
@@ -153,11 +292,131 @@ func New(tracer trace.Tracer, cfg Config) (*DB, error) {
 		return nil, fmt.Errorf("failed to create blocks_by_rev directory: %w", err)
 	}
 
+	db.blockDir.revsByBlock, err = directory.CreateOrOpen(db.db, []string{"revs_by_block"}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create revs_by_block directory: %w", err)
+	}
+
+	db.blockDir.gcQueue, err = directory.CreateOrOpen(db.db, []string{"block_gc_queue"}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create block_gc_queue directory: %w", err)
+	}
+
+	db.blockDir.gcPending, err = directory.CreateOrOpen(db.db, []string{"block_gc_pending"}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create block_gc_pending directory: %w", err)
+	}
+
 	db.blobs, err = directory.CreateOrOpen(db.db, []string{"blobs"}, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create blobs directory: %w", err)
 	}
 
+	db.sessions.sessions, err = directory.CreateOrOpen(db.db, []string{"refresh_sessions"}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create refresh_sessions directory: %w", err)
+	}
+
+	db.sessions.expiry, err = directory.CreateOrOpen(db.db, []string{"refresh_sessions_by_expiry"}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create refresh_sessions_by_expiry directory: %w", err)
+	}
+
+	db.rateLimits.counters, err = directory.CreateOrOpen(db.db, []string{"rate_limits"}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create rate_limits directory: %w", err)
+	}
+
+	db.rateLimits.lockouts, err = directory.CreateOrOpen(db.db, []string{"login_lockouts"}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create login_lockouts directory: %w", err)
+	}
+
+	db.invites.codes, err = directory.CreateOrOpen(db.db, []string{"invite_codes"}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create invite_codes directory: %w", err)
+	}
+
+	db.invites.byAccount, err = directory.CreateOrOpen(db.db, []string{"invite_codes_by_account"}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create invite_codes_by_account directory: %w", err)
+	}
+
+	db.reports.reports, err = directory.CreateOrOpen(db.db, []string{"reports"}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create reports directory: %w", err)
+	}
+
+	db.reports.open, err = directory.CreateOrOpen(db.db, []string{"open_reports"}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create open_reports directory: %w", err)
+	}
+
+	db.reports.lastIDs, err = directory.CreateOrOpen(db.db, []string{"report_ids"}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create report_ids directory: %w", err)
+	}
+
+	db.takedowns, err = directory.CreateOrOpen(db.db, []string{"takedowns"}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create takedowns directory: %w", err)
+	}
+
+	db.labels.labels, err = directory.CreateOrOpen(db.db, []string{"labels"}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create labels directory: %w", err)
+	}
+
+	db.labels.log, err = directory.CreateOrOpen(db.db, []string{"label_log"}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create label_log directory: %w", err)
+	}
+
+	db.labels.lastSeqs, err = directory.CreateOrOpen(db.db, []string{"label_seqs"}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create label_seqs directory: %w", err)
+	}
+
+	db.labels.cursors, err = directory.CreateOrOpen(db.db, []string{"labeler_cursors"}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create labeler_cursors directory: %w", err)
+	}
+
+	db.audit.events, err = directory.CreateOrOpen(db.db, []string{"audit_events"}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create audit_events directory: %w", err)
+	}
+
+	db.audit.bySubject, err = directory.CreateOrOpen(db.db, []string{"audit_by_subject"}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create audit_by_subject directory: %w", err)
+	}
+
+	db.audit.byActor, err = directory.CreateOrOpen(db.db, []string{"audit_by_actor"}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create audit_by_actor directory: %w", err)
+	}
+
+	db.hostRegistry.hosts, err = directory.CreateOrOpen(db.db, []string{"registered_hosts"}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create registered_hosts directory: %w", err)
+	}
+
+	db.hostRegistry.version, err = directory.CreateOrOpen(db.db, []string{"registered_hosts_version"}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create registered_hosts_version directory: %w", err)
+	}
+
+	db.tlsCerts.cache, err = directory.CreateOrOpen(db.db, []string{"tls_cache"}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tls_cache directory: %w", err)
+	}
+
+	db.tlsCerts.locks, err = directory.CreateOrOpen(db.db, []string{"tls_locks"}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tls_locks directory: %w", err)
+	}
+
 	if err := db.initEventDirs(); err != nil {
 		return nil, err
 	}
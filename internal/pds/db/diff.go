@@ -0,0 +1,324 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/bluesky-social/indigo/atproto/repo"
+	"github.com/bluesky-social/indigo/atproto/repo/mst"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// ErrUnknownRev is returned when a diff is requested from a revision that isn't in the repo
+var ErrUnknownRev = errors.New("unknown repo revision")
+
+// StreamRepoDiff calls fn with exactly the blocks a consumer who has the repo as of sinceRev needs
+// to reach the commit at head: the head commit (unless it is the commit at sinceRev), the MST nodes that differ between the two trees,
+// and the records referenced by those nodes that the old tree doesn't already have.
+//
+// The two trees are walked top-down one MST layer at a time. Subtrees with identical CIDs at the
+// same layer are skipped entirely, so the work done is proportional to the size of the diff rather
+// than the size of the repo. Like StreamRepo, reads are split across transactions pinned to a
+// single read version and fn is never called while a transaction is open.
+//
+// Returns ErrUnknownRev if sinceRev does not correspond to a commit in the repo, or if blocks from
+// that commit are no longer available. Both trees are walked before fn is first called, so
+// ErrUnknownRev is always returned before any blocks are sent.
+func (db *DB) StreamRepoDiff(
+	ctx context.Context,
+	did string,
+	head cid.Cid,
+	sinceRev string,
+	fn func(blocks.Block) error,
+) (err error) {
+	_, span, done := db.observe(ctx, "StreamRepoDiff")
+	defer func() { done(err) }()
+
+	span.SetAttributes(
+		attribute.String("did", did),
+		attribute.String("commit", head.String()),
+		attribute.String("since", sinceRev),
+	)
+
+	reader := &pinnedReader{db: db.db}
+
+	oldCommit, err := pinnedRead(ctx, reader, func(tx fdb.ReadTransaction) (*repo.Commit, error) {
+		return db.findCommitByRev(tx, did, sinceRev)
+	})
+	if err != nil {
+		return err
+	}
+
+	var newCommit repo.Commit
+	var commitBlock blocks.Block
+	err = db.readBlocks(ctx, reader, did, []cid.Cid{head}, func(c cid.Cid, blk blocks.Block) error {
+		if blk == nil {
+			return fmt.Errorf("%w: missing head commit %s", ErrNotFound, c)
+		}
+		if err := newCommit.UnmarshalCBOR(bytes.NewReader(blk.RawData())); err != nil {
+			return fmt.Errorf("failed to unmarshal commit %s: %w", c, err)
+		}
+		commitBlock = blk
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	load := func(cids []cid.Cid, fn func(cid.Cid, blocks.Block) error) error {
+		return db.readBlocks(ctx, reader, did, cids, fn)
+	}
+
+	// walk both trees before sending anything, so that an old tree whose nodes have been swept is
+	// reported as ErrUnknownRev rather than failing partway through the response
+	var nodes []cid.Cid
+	records, _, err := diffTrees(newCommit.Data, oldCommit.Data, load, func(blk blocks.Block) error {
+		nodes = append(nodes, blk.Cid())
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	span.SetAttributes(
+		attribute.Int("num_nodes", len(nodes)),
+		attribute.Int("num_records", len(records)),
+	)
+
+	// the consumer already has the head commit if nothing has changed since sinceRev
+	if newCommit.Rev != sinceRev {
+		if err := fn(commitBlock); err != nil {
+			return err
+		}
+	}
+
+	err = load(nodes, func(c cid.Cid, blk blocks.Block) error {
+		if blk == nil {
+			return fmt.Errorf("%w: missing mst node %s", ErrNotFound, c)
+		}
+		return fn(blk)
+	})
+	if err != nil {
+		return err
+	}
+
+	// send the records from the new tree that the consumer doesn't already have
+	return load(records, func(c cid.Cid, blk blocks.Block) error {
+		if blk == nil {
+			return fmt.Errorf("%w: missing record block %s", ErrNotFound, c)
+		}
+		return fn(blk)
+	})
+}
+
+// blockLoader reads the given blocks and calls fn with each one in order. blk is nil if the block
+// does not exist.
+type blockLoader func(cids []cid.Cid, fn func(c cid.Cid, blk blocks.Block) error) error
+
+// diffTrees walks the MSTs rooted at newRoot and oldRoot and calls fn with each node that is in
+// the new tree but not the old one. It returns the records referenced by those nodes that aren't
+// referenced by the old tree's differing nodes, along with the number of nodes passed to fn.
+func diffTrees(newRoot, oldRoot cid.Cid, load blockLoader, fn func(blocks.Block) error) ([]cid.Cid, int, error) {
+	if newRoot == oldRoot {
+		return nil, 0, nil
+	}
+
+	newSide := &diffSide{front: []cid.Cid{newRoot}, records: make(map[cid.Cid]struct{})}
+	oldSide := &diffSide{front: []cid.Cid{oldRoot}, records: make(map[cid.Cid]struct{})}
+
+	// load the roots so we know which layer each tree starts at
+	if err := expandDiffSide(load, newSide, fn); err != nil {
+		return nil, 0, err
+	}
+	if err := expandDiffSide(load, oldSide, nil); err != nil {
+		return nil, 0, err
+	}
+
+	numNodes := 1
+	for len(newSide.front) > 0 {
+		removeSharedSubtrees(newSide, oldSide)
+		if len(newSide.front) == 0 {
+			break
+		}
+
+		// always descend whichever tree is currently at the higher layer, so that both fronts
+		// are at the same layer when shared subtrees are compared
+		layer := newSide.layer
+		if len(oldSide.front) > 0 {
+			layer = max(layer, oldSide.layer)
+		}
+
+		if newSide.layer == layer {
+			numNodes += len(newSide.front)
+			if err := expandDiffSide(load, newSide, fn); err != nil {
+				return nil, 0, err
+			}
+		}
+		if len(oldSide.front) > 0 && oldSide.layer == layer {
+			if err := expandDiffSide(load, oldSide, nil); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+
+	var records []cid.Cid
+	for _, c := range newSide.recordOrder {
+		if _, ok := oldSide.records[c]; !ok {
+			records = append(records, c)
+		}
+	}
+
+	return records, numNodes, nil
+}
+
+// diffSide tracks the walk of one of the two trees being diffed
+type diffSide struct {
+	// front is the set of nodes at the current layer that haven't been visited yet. The root is
+	// initially the only node in the front, and its layer isn't known until it is loaded, after
+	// which layer is the layer of the nodes in front.
+	front  []cid.Cid
+	layer  int
+	loaded bool
+
+	// records are the record CIDs referenced by visited nodes
+	records     map[cid.Cid]struct{}
+	recordOrder []cid.Cid
+}
+
+// expandDiffSide visits every node in the side's front, replacing the front with the nodes one
+// layer down. If fn is non-nil, it is called with each visited node block; otherwise this is the
+// old tree, and missing nodes mean the old revision is no longer available.
+func expandDiffSide(load blockLoader, side *diffSide, fn func(blocks.Block) error) error {
+	var next []cid.Cid
+	err := load(side.front, func(c cid.Cid, blk blocks.Block) error {
+		if blk == nil {
+			if fn == nil {
+				return fmt.Errorf("%w: missing mst node %s", ErrUnknownRev, c)
+			}
+			return fmt.Errorf("%w: missing mst node %s", ErrNotFound, c)
+		}
+
+		var node mst.NodeData
+		if err := node.UnmarshalCBOR(bytes.NewReader(blk.RawData())); err != nil {
+			return fmt.Errorf("failed to unmarshal mst node %s: %w", c, err)
+		}
+
+		if !side.loaded {
+			side.loaded = true
+			if len(node.Entries) > 0 {
+				side.layer = mst.HeightForKey(node.Entries[0].KeySuffix)
+			}
+		}
+
+		if node.Left != nil {
+			next = append(next, *node.Left)
+		}
+		for _, entry := range node.Entries {
+			if _, ok := side.records[entry.Value]; !ok {
+				side.records[entry.Value] = struct{}{}
+				side.recordOrder = append(side.recordOrder, entry.Value)
+			}
+			if entry.Right != nil {
+				next = append(next, *entry.Right)
+			}
+		}
+
+		if fn != nil {
+			return fn(blk)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	side.front = next
+	side.layer--
+	return nil
+}
+
+// removeSharedSubtrees drops nodes that appear in both fronts. Nodes with the same CID at the same
+// layer root identical subtrees, so neither needs to be walked any further.
+func removeSharedSubtrees(a, b *diffSide) {
+	if len(b.front) == 0 || a.layer != b.layer {
+		return
+	}
+
+	inA := make(map[cid.Cid]struct{}, len(a.front))
+	for _, c := range a.front {
+		inA[c] = struct{}{}
+	}
+	shared := make(map[cid.Cid]struct{})
+	for _, c := range b.front {
+		if _, ok := inA[c]; ok {
+			shared[c] = struct{}{}
+		}
+	}
+	if len(shared) == 0 {
+		return
+	}
+
+	keep := func(front []cid.Cid) []cid.Cid {
+		var out []cid.Cid
+		for _, c := range front {
+			if _, ok := shared[c]; !ok {
+				out = append(out, c)
+			}
+		}
+		return out
+	}
+	a.front = keep(a.front)
+	b.front = keep(b.front)
+}
+
+// findCommitByRev looks up the commit written at the given revision via the blocks_by_rev index
+func (db *DB) findCommitByRev(tx fdb.ReadTransaction, did, rev string) (*repo.Commit, error) {
+	kr, err := fdb.PrefixRange(pack(db.blockDir.blocksByRev, did, rev))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create blocks_by_rev range: %w", err)
+	}
+
+	iter := tx.GetRange(kr, fdb.RangeOptions{}).Iterator()
+	for iter.Advance() {
+		kv, err := iter.Get()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate blocks_by_rev: %w", err)
+		}
+
+		tup, err := db.blockDir.blocksByRev.Unpack(kv.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unpack blocks_by_rev key: %w", err)
+		}
+		if len(tup) < 3 {
+			continue
+		}
+		cidBytes, ok := tup[2].([]byte)
+		if !ok {
+			continue
+		}
+
+		val, err := tx.Get(pack(db.blockDir.blocks, did, cidBytes)).Get()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get block: %w", err)
+		}
+		if val == nil {
+			continue
+		}
+
+		// records and mst nodes written in the same revision decode with an empty rev
+		var commit repo.Commit
+		if err := commit.UnmarshalCBOR(bytes.NewReader(val)); err != nil {
+			continue
+		}
+		if commit.Rev == rev && commit.DID == did {
+			return &commit, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %q", ErrUnknownRev, rev)
+}
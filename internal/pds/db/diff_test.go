@@ -0,0 +1,290 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/bluesky-social/indigo/atproto/repo/mst"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+)
+
+// memBlockstore is a minimal in-memory blockstore for building MSTs in tests
+type memBlockstore struct {
+	blocks map[cid.Cid]blocks.Block
+}
+
+func newMemBlockstore() *memBlockstore {
+	return &memBlockstore{blocks: make(map[cid.Cid]blocks.Block)}
+}
+
+func (m *memBlockstore) DeleteBlock(_ context.Context, c cid.Cid) error {
+	delete(m.blocks, c)
+	return nil
+}
+
+func (m *memBlockstore) Has(_ context.Context, c cid.Cid) (bool, error) {
+	_, ok := m.blocks[c]
+	return ok, nil
+}
+
+func (m *memBlockstore) Get(_ context.Context, c cid.Cid) (blocks.Block, error) {
+	blk, ok := m.blocks[c]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, c)
+	}
+	return blk, nil
+}
+
+func (m *memBlockstore) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	blk, err := m.Get(ctx, c)
+	if err != nil {
+		return 0, err
+	}
+	return len(blk.RawData()), nil
+}
+
+func (m *memBlockstore) Put(_ context.Context, blk blocks.Block) error {
+	m.blocks[blk.Cid()] = blk
+	return nil
+}
+
+func (m *memBlockstore) PutMany(ctx context.Context, blks []blocks.Block) error {
+	for _, blk := range blks {
+		m.blocks[blk.Cid()] = blk
+	}
+	return nil
+}
+
+func (m *memBlockstore) AllKeysChan(context.Context) (<-chan cid.Cid, error) {
+	return nil, fmt.Errorf("AllKeysChan not implemented")
+}
+
+func (m *memBlockstore) HashOnRead(bool) {}
+
+func (m *memBlockstore) load(cids []cid.Cid, fn func(cid.Cid, blocks.Block) error) error {
+	for _, c := range cids {
+		if err := fn(c, m.blocks[c]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffTestRepo builds MSTs whose records are stored alongside the tree in a shared blockstore
+type diffTestRepo struct {
+	t    *testing.T
+	bs   *memBlockstore
+	tree mst.Tree
+}
+
+func newDiffTestRepo(t *testing.T) *diffTestRepo {
+	return &diffTestRepo{t: t, bs: newMemBlockstore(), tree: mst.NewEmptyTree()}
+}
+
+func diffTestKey(i int) []byte {
+	return fmt.Appendf(nil, "com.example.record/%06d", i)
+}
+
+func (r *diffTestRepo) put(i int, version string) {
+	blk := makeTestBlock(r.t, fmt.Appendf(nil, "record %d %s", i, version))
+	require.NoError(r.t, r.bs.Put(r.t.Context(), blk))
+	_, err := r.tree.Insert(diffTestKey(i), blk.Cid())
+	require.NoError(r.t, err)
+}
+
+func (r *diffTestRepo) remove(i int) {
+	_, err := r.tree.Remove(diffTestKey(i))
+	require.NoError(r.t, err)
+}
+
+func (r *diffTestRepo) write() cid.Cid {
+	root, err := r.tree.WriteDiffBlocks(r.t.Context(), r.bs)
+	require.NoError(r.t, err)
+	return *root
+}
+
+// reachable returns every block reachable from the given MST root, which is what a consumer
+// that synced the repo at that root would have
+func (r *diffTestRepo) reachable(root cid.Cid) *memBlockstore {
+	out := newMemBlockstore()
+	stack := []exportItem{{cid: root, kind: exportNode}}
+	for len(stack) > 0 {
+		item := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		blk, err := r.bs.Get(r.t.Context(), item.cid)
+		require.NoError(r.t, err)
+		require.NoError(r.t, out.Put(r.t.Context(), blk))
+
+		children, err := exportChildren(item, blk.RawData())
+		require.NoError(r.t, err)
+		stack = append(stack, children...)
+	}
+	return out
+}
+
+// applyDiff runs diffTrees and returns the consumer's old blocks plus everything in the diff,
+// along with the number of blocks in the diff
+func (r *diffTestRepo) applyDiff(newRoot, oldRoot cid.Cid) (*memBlockstore, int) {
+	consumer := r.reachable(oldRoot)
+
+	var numBlocks int
+	put := func(blk blocks.Block) error {
+		numBlocks++
+		return consumer.Put(r.t.Context(), blk)
+	}
+
+	records, numNodes, err := diffTrees(newRoot, oldRoot, r.bs.load, put)
+	require.NoError(r.t, err)
+	require.Equal(r.t, numNodes, numBlocks)
+
+	require.NoError(r.t, r.bs.load(records, func(c cid.Cid, blk blocks.Block) error {
+		require.NotNil(r.t, blk, "missing record %s", c)
+		return put(blk)
+	}))
+
+	return consumer, numBlocks
+}
+
+// requireSameTree asserts that the consumer can load and walk the entire tree at root, and that
+// it has the same contents as the source tree
+func (r *diffTestRepo) requireSameTree(consumer *memBlockstore, root cid.Cid) {
+	tree, err := mst.LoadTreeFromStore(r.t.Context(), consumer, root)
+	require.NoError(r.t, err)
+
+	got := make(map[string]cid.Cid)
+	require.NoError(r.t, tree.Walk(func(key []byte, val cid.Cid) error {
+		_, err := consumer.Get(r.t.Context(), val)
+		require.NoError(r.t, err, "consumer is missing record %s", key)
+		got[string(key)] = val
+		return nil
+	}))
+
+	want := make(map[string]cid.Cid)
+	require.NoError(r.t, r.tree.WriteToMap(want))
+	require.Equal(r.t, want, got)
+}
+
+func TestDiffTrees(t *testing.T) {
+	t.Parallel()
+
+	t.Run("identical roots produce an empty diff", func(t *testing.T) {
+		t.Parallel()
+
+		r := newDiffTestRepo(t)
+		for i := range 50 {
+			r.put(i, "v1")
+		}
+		root := r.write()
+
+		records, numNodes, err := diffTrees(root, root, r.bs.load, func(blocks.Block) error {
+			t.Fatal("no blocks should be sent")
+			return nil
+		})
+		require.NoError(t, err)
+		require.Empty(t, records)
+		require.Zero(t, numNodes)
+	})
+
+	t.Run("creates, updates, and deletes", func(t *testing.T) {
+		t.Parallel()
+
+		r := newDiffTestRepo(t)
+		for i := range 500 {
+			r.put(i, "v1")
+		}
+		oldRoot := r.write()
+
+		for i := 500; i < 510; i++ {
+			r.put(i, "v1")
+		}
+		r.put(10, "v2")
+		r.put(250, "v2")
+		r.remove(20)
+		r.remove(400)
+		newRoot := r.write()
+
+		consumer, numBlocks := r.applyDiff(newRoot, oldRoot)
+		r.requireSameTree(consumer, newRoot)
+
+		// only the paths to the changed keys should be sent, not the whole repo
+		require.Less(t, numBlocks, 100)
+	})
+
+	t.Run("tree grows taller", func(t *testing.T) {
+		t.Parallel()
+
+		r := newDiffTestRepo(t)
+		r.put(0, "v1")
+		oldRoot := r.write()
+
+		for i := 1; i < 300; i++ {
+			r.put(i, "v1")
+		}
+		newRoot := r.write()
+
+		consumer, _ := r.applyDiff(newRoot, oldRoot)
+		r.requireSameTree(consumer, newRoot)
+	})
+
+	t.Run("tree shrinks", func(t *testing.T) {
+		t.Parallel()
+
+		r := newDiffTestRepo(t)
+		for i := range 300 {
+			r.put(i, "v1")
+		}
+		oldRoot := r.write()
+
+		for i := range 298 {
+			r.remove(i)
+		}
+		newRoot := r.write()
+
+		consumer, _ := r.applyDiff(newRoot, oldRoot)
+		r.requireSameTree(consumer, newRoot)
+	})
+
+	t.Run("from and to an empty tree", func(t *testing.T) {
+		t.Parallel()
+
+		r := newDiffTestRepo(t)
+		emptyRoot := r.write()
+
+		for i := range 20 {
+			r.put(i, "v1")
+		}
+		fullRoot := r.write()
+
+		consumer, _ := r.applyDiff(fullRoot, emptyRoot)
+		r.requireSameTree(consumer, fullRoot)
+
+		for i := range 20 {
+			r.remove(i)
+		}
+		require.Equal(t, emptyRoot, r.write())
+
+		consumer, _ = r.applyDiff(emptyRoot, fullRoot)
+		r.requireSameTree(consumer, emptyRoot)
+	})
+
+	t.Run("missing old tree is an unknown rev", func(t *testing.T) {
+		t.Parallel()
+
+		r := newDiffTestRepo(t)
+		for i := range 100 {
+			r.put(i, "v1")
+		}
+		oldRoot := r.write()
+		r.put(100, "v1")
+		newRoot := r.write()
+
+		require.NoError(t, r.bs.DeleteBlock(t.Context(), oldRoot))
+
+		_, _, err := diffTrees(newRoot, oldRoot, r.bs.load, func(blocks.Block) error { return nil })
+		require.ErrorIs(t, err, ErrUnknownRev)
+	})
+}
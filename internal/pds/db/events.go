@@ -1,6 +1,7 @@
 package db
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
 	"fmt"
@@ -17,18 +18,40 @@ import (
 type eventDir struct {
 	// Primary index: events keyed by versionstamp for global ordering
 	// Key: (versionstamp), Value: serialized RepoEvent
+	// Large events are instead split across (versionstamp, uint16 chunk index) keys, whose
+	// values are concatenated to form the serialized RepoEvent
 	events directory.DirectorySubspace
 
 	// Secondary index: events by PDS host for filtering
 	// Key: (pds_host, versionstamp), Value: empty
 	eventsByHost directory.DirectorySubspace
 
+	// Secondary index: events by wall clock time (unix micros) for time-based cursors
+	// Key: (time_us, versionstamp), Value: empty
+	eventsByTime directory.DirectorySubspace
+
 	// Stores the latest versionstamp for watch notifications
 	// Key: "latest", Value: latest versionstamp (8 bytes)
 	latestSeq directory.DirectorySubspace
 }
 
 const (
+	// MaxCommitOps is the maximum number of record operations in a single commit, matching the
+	// limits on applyWrites and on #commit events in subscribeRepos
+	MaxCommitOps = 200
+
+	// MaxEventBlocksBytes is the largest CAR slice that will be embedded in a #commit event
+	MaxEventBlocksBytes = 2_000_000
+
+	// maxEventChunkBytes is the largest value written for a single event key. Events larger than
+	// this are split across keys to stay under FDB's 100KB value size limit.
+	maxEventChunkBytes = 90_000
+
+	// maxEventChunks bounds the number of chunks per event. This is well beyond what fits in FDB's
+	// 10MB transaction limit, and keeps the high byte of the chunk index zero so that cursor
+	// range reads can skip all of an event's keys by appending 0xFF.
+	maxEventChunks = 256
+
 	// versionstampLength is the length of an FDB versionstamp (10 bytes)
 	// 8 bytes for commit version + 2 bytes for batch order
 	versionstampLength = 10
@@ -51,6 +74,11 @@ func (db *DB) initEventDirs() error {
 		return fmt.Errorf("failed to create events_by_host directory: %w", err)
 	}
 
+	db.eventDir.eventsByTime, err = directory.CreateOrOpen(db.db, []string{"events_by_time"}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create events_by_time directory: %w", err)
+	}
+
 	db.eventDir.latestSeq, err = directory.CreateOrOpen(db.db, []string{"latest_seq"}, nil)
 	if err != nil {
 		return fmt.Errorf("failed to create latest_seq directory: %w", err)
@@ -62,32 +90,45 @@ func (db *DB) initEventDirs() error {
 // WriteEventTx writes a repo event to the events subspace within an existing transaction.
 // The event's sequence number will be assigned by FDB's versionstamp at commit time.
 // This should be called as part of the same transaction that performs the repo mutation.
+//
+// Commits that exceed the spec limits are marked tooBig and written without blocks. Serialized
+// events larger than a single FDB value are split across multiple chunk keys.
 func (db *DB) WriteEventTx(tx fdb.Transaction, event *types.RepoEvent) error {
+	applyEventLimits(event)
+
 	// serialize the event (seq will be 0, filled in by reader from key)
 	eventBytes, err := proto.Marshal(event)
 	if err != nil {
 		return fmt.Errorf("failed to marshal event: %w", err)
 	}
 
-	// create a key with versionstamp placeholder
-	// the format for SetVersionstampedKey is: prefix + placeholder + suffix
-	// where placeholder is 14 bytes (10 byte versionstamp + 4 byte offset)
 	prefix := db.eventDir.events.Bytes()
+	if len(eventBytes) <= maxEventChunkBytes {
+		tx.SetVersionstampedKey(versionstampedKey(prefix, nil), eventBytes)
+	} else {
+		chunks := (len(eventBytes) + maxEventChunkBytes - 1) / maxEventChunkBytes
+		if chunks > maxEventChunks {
+			return fmt.Errorf("event is too large to store (%d bytes)", len(eventBytes))
+		}
 
-	// versionstamp placeholder: 10 zero bytes followed by 4-byte little-endian offset
-	// the offset tells FDB where in the key to place the versionstamp (relative to start)
-	placeholder := make([]byte, 14)
-	binary.LittleEndian.PutUint32(placeholder[10:], uint32(len(prefix)))
-
-	key := append(prefix, placeholder...)
-	tx.SetVersionstampedKey(fdb.Key(key), eventBytes)
+		// chunk keys are (versionstamp, chunk index) so they sort together and in order
+		for i := range chunks {
+			start := i * maxEventChunkBytes
+			end := min(start+maxEventChunkBytes, len(eventBytes))
+			suffix := binary.BigEndian.AppendUint16(nil, uint16(i))
+			tx.SetVersionstampedKey(versionstampedKey(prefix, suffix), eventBytes[start:end])
+		}
+	}
 
 	// write secondary index by host
 	hostPrefix := db.eventDir.eventsByHost.Pack(tuple.Tuple{event.PdsHost})
-	hostPlaceholder := make([]byte, 14)
-	binary.LittleEndian.PutUint32(hostPlaceholder[10:], uint32(len(hostPrefix)))
-	hostKey := append(hostPrefix, hostPlaceholder...)
-	tx.SetVersionstampedKey(fdb.Key(hostKey), nil)
+	tx.SetVersionstampedKey(versionstampedKey(hostPrefix, nil), nil)
+
+	// write secondary index by time
+	if event.Time != nil {
+		timePrefix := db.eventDir.eventsByTime.Pack(tuple.Tuple{event.Time.AsTime().UnixMicro()})
+		tx.SetVersionstampedKey(versionstampedKey(timePrefix, nil), nil)
+	}
 
 	// update the latest sequence marker (for watch notifications)
 	// use SetVersionstampedValue so watchers can detect new events
@@ -99,6 +140,30 @@ func (db *DB) WriteEventTx(tx fdb.Transaction, event *types.RepoEvent) error {
 	return nil
 }
 
+// versionstampedKey builds a key for SetVersionstampedKey in which FDB will place the commit's
+// versionstamp between prefix and suffix. The format is: prefix + 10 byte placeholder + suffix +
+// 4 byte little-endian offset of the placeholder.
+func versionstampedKey(prefix, suffix []byte) fdb.Key {
+	key := make([]byte, 0, len(prefix)+versionstampLength+len(suffix)+4)
+	key = append(key, prefix...)
+	key = append(key, make([]byte, versionstampLength)...)
+	key = append(key, suffix...)
+	return binary.LittleEndian.AppendUint32(key, uint32(len(prefix)))
+}
+
+// applyEventLimits marks commit events that exceed the sync spec limits as tooBig and drops their
+// blocks. Consumers of a tooBig commit are expected to fetch the repo (or a diff) instead.
+func applyEventLimits(event *types.RepoEvent) {
+	if event.EventType != types.EventType_EVENT_TYPE_UNSPECIFIED && event.EventType != types.EventType_EVENT_TYPE_COMMIT {
+		return
+	}
+
+	if len(event.Ops) > MaxCommitOps || len(event.Blocks) > MaxEventBlocksBytes {
+		event.TooBig = true
+		event.Blocks = nil
+	}
+}
+
 // WriteIdentityEvent writes an identity event to the events subspace.
 // This is used for identity events that happen outside of repo mutations.
 func (db *DB) WriteIdentityEvent(ctx context.Context, event *types.RepoEvent) (err error) {
@@ -136,20 +201,43 @@ func (db *DB) GetEventsSince(ctx context.Context, cursor []byte, limit int) (eve
 			startKey = db.eventDir.events.FDBKey()
 		} else {
 			// start after the cursor (exclusive)
-			// cursor is the raw versionstamp bytes
+			// cursor is the raw versionstamp bytes. appending 0xFF skips both the event's
+			// primary key and any of its chunk keys
 			startKey = fdb.Key(append(db.eventDir.events.Bytes(), cursor...))
-			startKey = append(startKey, 0x00) // make it exclusive by adding a byte
+			startKey = append(startKey, 0xFF)
 		}
 
 		// end key is the end of the events subspace
 		endKey := fdb.Key(append(db.eventDir.events.Bytes(), 0xFF))
 
+		// an event may span several keys, so we can't use the range limit directly. Instead
+		// stream keys and stop once we've assembled the requested number of events.
 		rng := fdb.KeyRange{Begin: startKey, End: endKey}
-		iter := tx.GetRange(rng, fdb.RangeOptions{Limit: limit}).Iterator()
+		iter := tx.GetRange(rng, fdb.RangeOptions{Mode: fdb.StreamingModeIterator}).Iterator()
+
+		prefixLen := len(db.eventDir.events.Bytes())
 
 		var events []*types.RepoEvent
 		var lastKey []byte
 
+		var pendingVersionstamp []byte
+		var pending []byte
+		flush := func() error {
+			// parse event
+			var event types.RepoEvent
+			if err := proto.Unmarshal(pending, &event); err != nil {
+				return fmt.Errorf("failed to unmarshal event: %w", err)
+			}
+
+			// set sequence from versionstamp (first 8 bytes as big-endian int64)
+			event.Seq = int64(binary.BigEndian.Uint64(pendingVersionstamp[:8]))
+
+			events = append(events, &event)
+			lastKey = pendingVersionstamp
+			pendingVersionstamp, pending = nil, nil
+			return nil
+		}
+
 		for iter.Advance() {
 			kv, err := iter.Get()
 			if err != nil {
@@ -157,23 +245,28 @@ func (db *DB) GetEventsSince(ctx context.Context, cursor []byte, limit int) (eve
 			}
 
 			// extract versionstamp from key (after prefix)
-			prefixLen := len(db.eventDir.events.Bytes())
 			if len(kv.Key) < prefixLen+versionstampLength {
 				continue // malformed key
 			}
 			versionstamp := kv.Key[prefixLen : prefixLen+versionstampLength]
 
-			// parse event
-			var event types.RepoEvent
-			if err := proto.Unmarshal(kv.Value, &event); err != nil {
-				return nil, fmt.Errorf("failed to unmarshal event: %w", err)
+			if pendingVersionstamp != nil && !bytes.Equal(versionstamp, pendingVersionstamp) {
+				if err := flush(); err != nil {
+					return nil, err
+				}
+				if len(events) >= limit {
+					break
+				}
 			}
 
-			// set sequence from versionstamp (first 8 bytes as big-endian int64)
-			event.Seq = int64(binary.BigEndian.Uint64(versionstamp[:8]))
+			pendingVersionstamp = versionstamp
+			pending = append(pending, kv.Value...)
+		}
 
-			events = append(events, &event)
-			lastKey = versionstamp
+		if pendingVersionstamp != nil && len(events) < limit {
+			if err := flush(); err != nil {
+				return nil, err
+			}
 		}
 
 		return &result{events: events, nextCursor: lastKey}, nil
@@ -195,6 +288,74 @@ func (db *DB) GetEventsSinceSeq(ctx context.Context, seq int64, limit int) ([]*t
 	return db.GetEventsSince(ctx, cursor, limit)
 }
 
+// GetEventCursorBeforeTime returns a cursor positioned just before the first event written at or
+// after the given unix microsecond timestamp, suitable for passing to GetEventsSince. Events written
+// before the time index existed have no indexed timestamp and are never replayed by time: if no
+// indexed event precedes the timestamp, the cursor is positioned just before the earliest indexed
+// event, or at the end of the stream if there's none.
+func (db *DB) GetEventCursorBeforeTime(ctx context.Context, timeUS int64) (cursor []byte, err error) {
+	_, span, done := db.observe(ctx, "GetEventCursorBeforeTime")
+	defer func() { done(err) }()
+
+	span.SetAttributes(attribute.Int64("time_us", timeUS))
+
+	cursor, err = readTransaction(db.db, func(tx fdb.ReadTransaction) ([]byte, error) {
+		rng := fdb.KeyRange{
+			Begin: db.eventDir.eventsByTime.FDBKey(),
+			End:   db.eventDir.eventsByTime.Pack(tuple.Tuple{timeUS}),
+		}
+
+		kvs, err := tx.GetRange(rng, fdb.RangeOptions{Limit: 1, Reverse: true}).GetSliceWithError()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get event time index: %w", err)
+		}
+		if len(kvs) > 0 {
+			return eventTimeIndexVersionstamp(kvs[0].Key)
+		}
+
+		// nothing indexed precedes the timestamp, so start just before the earliest indexed event
+		// rather than replaying the unindexed events that came before it
+		end := fdb.Key(append(db.eventDir.events.Bytes(), 0xFF))
+		kvs, err = tx.GetRange(db.eventDir.eventsByTime, fdb.RangeOptions{Limit: 1}).GetSliceWithError()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get event time index: %w", err)
+		}
+		if len(kvs) > 0 {
+			earliest, err := eventTimeIndexVersionstamp(kvs[0].Key)
+			if err != nil {
+				return nil, err
+			}
+			end = fdb.Key(append(db.eventDir.events.Bytes(), earliest...))
+		}
+
+		rng = fdb.KeyRange{Begin: db.eventDir.events.FDBKey(), End: end}
+		kvs, err = tx.GetRange(rng, fdb.RangeOptions{Limit: 1, Reverse: true}).GetSliceWithError()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get event: %w", err)
+		}
+		if len(kvs) == 0 {
+			// a zeroed versionstamp sorts before every real event
+			return make([]byte, versionstampLength), nil
+		}
+
+		prefixLen := len(db.eventDir.events.Bytes())
+		key := kvs[0].Key
+		if len(key) < prefixLen+versionstampLength {
+			return nil, fmt.Errorf("malformed event key")
+		}
+		return key[prefixLen : prefixLen+versionstampLength], nil
+	})
+	return
+}
+
+// eventTimeIndexVersionstamp returns the versionstamp of the event an events_by_time key points to
+func eventTimeIndexVersionstamp(key fdb.Key) ([]byte, error) {
+	if len(key) < versionstampLength {
+		return nil, fmt.Errorf("malformed event time index key")
+	}
+	return key[len(key)-versionstampLength:], nil
+}
+
 // WatchLatestSeq returns a future that will be ready when the latest sequence changes.
 // Use this to efficiently wait for new events without polling.
 func (db *DB) WatchLatestSeq(ctx context.Context) (fdb.FutureNil, error) {
@@ -0,0 +1,184 @@
+package db
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/jcalabro/atlas/internal/types"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestApplyEventLimits(t *testing.T) {
+	t.Parallel()
+
+	t.Run("small commit is unchanged", func(t *testing.T) {
+		t.Parallel()
+
+		event := &types.RepoEvent{
+			EventType: types.EventType_EVENT_TYPE_COMMIT,
+			Blocks:    []byte("blocks"),
+			Ops:       []*types.RepoOp{{Action: "create", Path: "app.bsky.feed.post/abc"}},
+		}
+		applyEventLimits(event)
+		require.False(t, event.TooBig)
+		require.Equal(t, []byte("blocks"), event.Blocks)
+	})
+
+	t.Run("too many blocks bytes", func(t *testing.T) {
+		t.Parallel()
+
+		event := &types.RepoEvent{Blocks: make([]byte, MaxEventBlocksBytes+1)}
+		applyEventLimits(event)
+		require.True(t, event.TooBig)
+		require.Nil(t, event.Blocks)
+	})
+
+	t.Run("too many ops", func(t *testing.T) {
+		t.Parallel()
+
+		event := &types.RepoEvent{
+			EventType: types.EventType_EVENT_TYPE_COMMIT,
+			Blocks:    []byte("blocks"),
+			Ops:       make([]*types.RepoOp, MaxCommitOps+1),
+		}
+		applyEventLimits(event)
+		require.True(t, event.TooBig)
+		require.Nil(t, event.Blocks)
+	})
+
+	t.Run("non-commit events are ignored", func(t *testing.T) {
+		t.Parallel()
+
+		event := &types.RepoEvent{
+			EventType: types.EventType_EVENT_TYPE_IDENTITY,
+			Blocks:    make([]byte, MaxEventBlocksBytes+1),
+		}
+		applyEventLimits(event)
+		require.False(t, event.TooBig)
+	})
+}
+
+func TestVersionstampedKey(t *testing.T) {
+	t.Parallel()
+
+	key := versionstampedKey([]byte("prefix"), []byte{0x00, 0x02})
+	require.Len(t, key, len("prefix")+versionstampLength+2+4)
+	require.True(t, bytes.HasPrefix(key, []byte("prefix")))
+	require.Equal(t, []byte{0x00, 0x02}, []byte(key[len("prefix")+versionstampLength:len(key)-4]))
+	require.Equal(t, []byte{byte(len("prefix")), 0, 0, 0}, []byte(key[len(key)-4:]))
+}
+
+func TestWriteEventChunked(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	db := testDB(t)
+
+	cursor, err := db.GetLatestSeq(ctx)
+	require.NoError(t, err)
+
+	// an event with ~1MB of blocks must be split across several FDB values
+	big := bytes.Repeat([]byte("x"), 1_000_000)
+	const did = "did:plc:eventchunktest1"
+
+	_, err = db.db.Transact(func(tx fdb.Transaction) (any, error) {
+		return nil, db.WriteEventTx(tx, &types.RepoEvent{
+			PdsHost: "chunk.example.com",
+			Repo:    did,
+			Rev:     "rev1",
+			Blocks:  big,
+			Ops:     []*types.RepoOp{{Action: "create", Path: "app.bsky.feed.post/a"}},
+			Time:    timestamppb.Now(),
+		})
+	})
+	require.NoError(t, err)
+
+	// followed by a small event so we can verify chunk boundaries when reading
+	_, err = db.db.Transact(func(tx fdb.Transaction) (any, error) {
+		return nil, db.WriteEventTx(tx, &types.RepoEvent{
+			PdsHost: "chunk.example.com",
+			Repo:    did,
+			Rev:     "rev2",
+			Time:    timestamppb.Now(),
+		})
+	})
+	require.NoError(t, err)
+
+	var ours []*types.RepoEvent
+	for {
+		events, next, err := db.GetEventsSince(ctx, cursor, 1)
+		require.NoError(t, err)
+		if len(events) == 0 {
+			break
+		}
+		require.Len(t, events, 1)
+		if events[0].Repo == did {
+			ours = append(ours, events[0])
+		}
+		cursor = next
+	}
+
+	require.Len(t, ours, 2)
+	require.Equal(t, "rev1", ours[0].Rev)
+	require.False(t, ours[0].TooBig)
+	require.Equal(t, big, ours[0].Blocks)
+	require.Equal(t, "rev2", ours[1].Rev)
+	require.LessOrEqual(t, ours[0].Seq, ours[1].Seq)
+}
+
+func TestGetEventCursorBeforeTime(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	db := testDB(t)
+
+	const did = "did:plc:eventtimetest1"
+
+	// events from before the time index existed aren't in it
+	_, err := db.db.Transact(func(tx fdb.Transaction) (any, error) {
+		return nil, db.WriteEventTx(tx, &types.RepoEvent{PdsHost: "time.example.com", Repo: did, Rev: "legacy"})
+	})
+	require.NoError(t, err)
+
+	written := time.Now()
+	_, err = db.db.Transact(func(tx fdb.Transaction) (any, error) {
+		return nil, db.WriteEventTx(tx, &types.RepoEvent{
+			PdsHost: "time.example.com",
+			Repo:    did,
+			Rev:     "indexed",
+			Time:    timestamppb.New(written),
+		})
+	})
+	require.NoError(t, err)
+
+	// a timestamp before every indexed event starts at the earliest indexed event instead of
+	// replaying the unindexed ones
+	cursor, err := db.GetEventCursorBeforeTime(ctx, 0)
+	require.NoError(t, err)
+
+	events, _, err := db.GetEventsSince(ctx, cursor, 1)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.NotNil(t, events[0].Time)
+
+	// replaying from the write time includes our event but not the legacy one before it
+	cursor, err = db.GetEventCursorBeforeTime(ctx, written.UnixMicro())
+	require.NoError(t, err)
+
+	var revs []string
+	for {
+		events, next, err := db.GetEventsSince(ctx, cursor, 100)
+		require.NoError(t, err)
+		if len(events) == 0 {
+			break
+		}
+		for _, event := range events {
+			if event.Repo == did {
+				revs = append(revs, event.Rev)
+			}
+		}
+		cursor = next
+	}
+	require.Equal(t, []string{"indexed"}, revs)
+}
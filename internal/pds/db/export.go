@@ -0,0 +1,328 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/bluesky-social/indigo/atproto/repo"
+	"github.com/bluesky-social/indigo/atproto/repo/mst"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// exportBatchBytes bounds the amount of block data read in a single export transaction
+	exportBatchBytes = 4 << 20
+
+	// exportBatchBlocks bounds the number of blocks read in a single export transaction
+	exportBatchBlocks = 2000
+
+	// fdbErrTransactionTooOld is returned when a read version is older than FDB's MVCC window
+	fdbErrTransactionTooOld = 1007
+)
+
+// ErrRepoChanged is returned when a block needed by a streaming export no longer exists after
+// the export had to move off of its original read version
+var ErrRepoChanged = errors.New("repo changed during export")
+
+// exportItemKind describes how a block visited during an export should be interpreted
+type exportItemKind int
+
+const (
+	exportCommit exportItemKind = iota
+	exportNode
+	exportRecord
+)
+
+func (k exportItemKind) String() string {
+	switch k {
+	case exportCommit:
+		return "commit"
+	case exportNode:
+		return "mst node"
+	case exportRecord:
+		return "record"
+	default:
+		return "block"
+	}
+}
+
+type exportItem struct {
+	cid  cid.Cid
+	kind exportItemKind
+}
+
+// StreamRepo walks the repo rooted at the given commit and calls fn for each block in the
+// spec's preorder CAR ordering: the commit, then each MST node followed by its left subtree, then
+// for each entry its record and right subtree.
+//
+// The walk is split across as many read transactions as needed to stay within FDB's transaction
+// limits. All transactions are pinned to the read version of the first so the export observes a
+// single snapshot. fn is never called while a transaction is open, so slow consumers don't hold
+// transactions open.
+func (db *DB) StreamRepo(ctx context.Context, did string, commitCID cid.Cid, fn func(blocks.Block) error) (err error) {
+	_, span, done := db.observe(ctx, "StreamRepo")
+	defer func() { done(err) }()
+
+	span.SetAttributes(
+		attribute.String("did", did),
+		attribute.String("commit", commitCID.String()),
+	)
+
+	type batch struct {
+		blks  []blocks.Block
+		stack []exportItem
+	}
+
+	reader := &pinnedReader{db: db.db}
+	var numBlocks, numBatches int
+	defer func() {
+		span.SetAttributes(
+			attribute.Int("num_blocks", numBlocks),
+			attribute.Int("num_batches", numBatches),
+			attribute.Bool("repinned", reader.repinned),
+		)
+	}()
+
+	// stack holds the blocks left to visit, with the next block on top
+	stack := []exportItem{{cid: commitCID, kind: exportCommit}}
+	for len(stack) > 0 {
+		res, err := pinnedRead(ctx, reader, func(tx fdb.ReadTransaction) (*batch, error) {
+			// work on a copy so that a retried transaction starts from the same position
+			stack := slices.Clone(stack)
+			bs := db.newReadBlockstore(did, tx)
+
+			var blks []blocks.Block
+			var size int
+			for len(stack) > 0 && len(blks) < exportBatchBlocks && size < exportBatchBytes {
+				item := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+
+				blk, err := bs.Get(ctx, item.cid)
+				if err != nil {
+					return nil, err
+				}
+
+				children, err := exportChildren(item, blk.RawData())
+				if err != nil {
+					return nil, err
+				}
+				stack = append(stack, children...)
+
+				blks = append(blks, blk)
+				size += len(blk.RawData())
+			}
+
+			return &batch{blks: blks, stack: stack}, nil
+		})
+		if err != nil {
+			if reader.repinned {
+				return fmt.Errorf("%w: %w", ErrRepoChanged, err)
+			}
+			return err
+		}
+
+		numBatches++
+		for _, blk := range res.blks {
+			if err := fn(blk); err != nil {
+				return err
+			}
+			numBlocks++
+		}
+
+		stack = res.stack
+	}
+
+	return nil
+}
+
+// exportChildren decodes a visited block and returns the blocks it references, in reverse visit
+// order so they can be pushed directly on to the export stack
+func exportChildren(item exportItem, data []byte) ([]exportItem, error) {
+	switch item.kind {
+	case exportCommit:
+		var commit repo.Commit
+		if err := commit.UnmarshalCBOR(bytes.NewReader(data)); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal commit %s: %w", item.cid, err)
+		}
+		return []exportItem{{cid: commit.Data, kind: exportNode}}, nil
+
+	case exportNode:
+		var node mst.NodeData
+		if err := node.UnmarshalCBOR(bytes.NewReader(data)); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal mst node %s: %w", item.cid, err)
+		}
+
+		children := make([]exportItem, 0, 2*len(node.Entries)+1)
+		for _, entry := range slices.Backward(node.Entries) {
+			if entry.Right != nil {
+				children = append(children, exportItem{cid: *entry.Right, kind: exportNode})
+			}
+			children = append(children, exportItem{cid: entry.Value, kind: exportRecord})
+		}
+		if node.Left != nil {
+			children = append(children, exportItem{cid: *node.Left, kind: exportNode})
+		}
+		return children, nil
+
+	default:
+		return nil, nil
+	}
+}
+
+// StreamBlocks reads the given blocks for a DID and calls fn for each one that exists, in the
+// requested order. Like StreamRepo, reads are batched across transactions pinned to a single
+// read version and fn is called outside of any transaction. Missing blocks are skipped.
+func (db *DB) StreamBlocks(ctx context.Context, did string, cids []cid.Cid, fn func(blocks.Block) error) (err error) {
+	_, span, done := db.observe(ctx, "StreamBlocks")
+	defer func() { done(err) }()
+
+	span.SetAttributes(
+		attribute.String("did", did),
+		attribute.Int("num_cids", len(cids)),
+	)
+
+	reader := &pinnedReader{db: db.db}
+	return db.readBlocks(ctx, reader, did, cids, func(_ cid.Cid, blk blocks.Block) error {
+		if blk == nil {
+			return nil
+		}
+		return fn(blk)
+	})
+}
+
+// readBlocks reads the given blocks in batches of transactions at the reader's pinned version and
+// calls fn for each one in the requested order, outside of any transaction. blk is nil if the block
+// does not exist.
+func (db *DB) readBlocks(
+	ctx context.Context,
+	reader *pinnedReader,
+	did string,
+	cids []cid.Cid,
+	fn func(c cid.Cid, blk blocks.Block) error,
+) error {
+	type batch struct {
+		blks []blocks.Block
+		next int
+	}
+
+	for pos := 0; pos < len(cids); {
+		res, err := pinnedRead(ctx, reader, func(tx fdb.ReadTransaction) (*batch, error) {
+			// issue all of the reads in the batch concurrently, then wait on them in order
+			end := min(pos+exportBatchBlocks, len(cids))
+			futures := make([]fdb.FutureByteSlice, 0, end-pos)
+			for _, c := range cids[pos:end] {
+				futures = append(futures, tx.Get(pack(db.blockDir.blocks, did, c.Bytes())))
+			}
+
+			blks := make([]blocks.Block, 0, len(futures))
+			var size int
+			for i, f := range futures {
+				if size >= exportBatchBytes {
+					break
+				}
+
+				val, err := f.Get()
+				if err != nil {
+					return nil, fmt.Errorf("failed to get block: %w", err)
+				}
+				if val == nil {
+					blks = append(blks, nil)
+					continue
+				}
+
+				blk, err := blocks.NewBlockWithCid(val, cids[pos+i])
+				if err != nil {
+					return nil, err
+				}
+				blks = append(blks, blk)
+				size += len(val)
+			}
+
+			return &batch{blks: blks, next: pos + len(blks)}, nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for i, blk := range res.blks {
+			if err := fn(cids[pos+i], blk); err != nil {
+				return err
+			}
+		}
+		pos = res.next
+	}
+
+	return nil
+}
+
+// pinnedReader runs a sequence of read transactions at the same read version, so that a long
+// read can be split in to transactions that each stay within FDB's limits while observing a
+// single consistent snapshot.
+//
+// FDB only retains about five seconds of history. If the pinned version becomes too old to read
+// from, the reader moves to a fresh version and sets repinned. Since blocks are content addressed
+// this is still correct for exports unless blocks were deleted in the meantime.
+type pinnedReader struct {
+	db       *fdb.Database
+	version  int64
+	repinned bool
+}
+
+// pinnedRead executes fn in a read transaction at the reader's pinned read version, retrying
+// retryable errors in the same manner as fdb.Database.ReadTransact
+func pinnedRead[T any](ctx context.Context, r *pinnedReader, fn func(tx fdb.ReadTransaction) (T, error)) (T, error) {
+	var zero T
+
+	tx, err := r.db.CreateTransaction()
+	if err != nil {
+		return zero, fmt.Errorf("failed to create transaction: %w", err)
+	}
+	defer tx.Cancel()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return zero, err
+		}
+
+		var res T
+		err := func() error {
+			if r.version == 0 {
+				version, err := tx.GetReadVersion().Get()
+				if err != nil {
+					return err
+				}
+				r.version = version
+			} else {
+				tx.SetReadVersion(r.version)
+			}
+
+			var err error
+			res, err = fn(tx)
+			return err
+		}()
+		if err == nil {
+			return res, nil
+		}
+
+		var fdbErr fdb.Error
+		if !errors.As(err, &fdbErr) {
+			return zero, err
+		}
+
+		if fdbErr.Code == fdbErrTransactionTooOld {
+			r.version = 0
+			r.repinned = true
+		}
+
+		// OnError resets the transaction and returns an error if this isn't retryable
+		if err := tx.OnError(fdbErr).Get(); err != nil {
+			return zero, err
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package db
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bluesky-social/indigo/atproto/repo"
+	"github.com/bluesky-social/indigo/atproto/repo/mst"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportChildren(t *testing.T) {
+	t.Parallel()
+
+	c := func(s string) cid.Cid {
+		return makeTestBlock(t, []byte(s)).Cid()
+	}
+
+	t.Run("commit points at the mst root", func(t *testing.T) {
+		t.Parallel()
+
+		commit := repo.Commit{DID: "did:plc:exporttest", Version: 3, Data: c("root"), Rev: "3kabc"}
+		buf := new(bytes.Buffer)
+		require.NoError(t, commit.MarshalCBOR(buf))
+
+		children, err := exportChildren(exportItem{kind: exportCommit}, buf.Bytes())
+		require.NoError(t, err)
+		require.Equal(t, []exportItem{{cid: c("root"), kind: exportNode}}, children)
+	})
+
+	t.Run("node children are in reverse preorder", func(t *testing.T) {
+		t.Parallel()
+
+		left, right1, right2 := c("left"), c("right1"), c("right2")
+		node := mst.NodeData{
+			Left: &left,
+			Entries: []mst.EntryData{
+				{KeySuffix: []byte("app.bsky.feed.post/a"), Value: c("rec1"), Right: &right1},
+				{PrefixLen: 19, KeySuffix: []byte("b"), Value: c("rec2")},
+				{PrefixLen: 19, KeySuffix: []byte("c"), Value: c("rec3"), Right: &right2},
+			},
+		}
+		buf := new(bytes.Buffer)
+		require.NoError(t, node.MarshalCBOR(buf))
+
+		children, err := exportChildren(exportItem{kind: exportNode}, buf.Bytes())
+		require.NoError(t, err)
+
+		// popping from the end of the stack visits: left, rec1, right1, rec2, rec3, right2
+		require.Equal(t, []exportItem{
+			{cid: right2, kind: exportNode},
+			{cid: c("rec3"), kind: exportRecord},
+			{cid: c("rec2"), kind: exportRecord},
+			{cid: right1, kind: exportNode},
+			{cid: c("rec1"), kind: exportRecord},
+			{cid: left, kind: exportNode},
+		}, children)
+	})
+
+	t.Run("records have no children", func(t *testing.T) {
+		t.Parallel()
+
+		children, err := exportChildren(exportItem{kind: exportRecord}, []byte("anything"))
+		require.NoError(t, err)
+		require.Empty(t, children)
+	})
+
+	t.Run("invalid node", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := exportChildren(exportItem{kind: exportNode}, []byte("not cbor"))
+		require.Error(t, err)
+	})
+}
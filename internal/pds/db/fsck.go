@@ -0,0 +1,636 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/bluesky-social/indigo/atproto/repo"
+	"github.com/bluesky-social/indigo/atproto/repo/mst"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/jcalabro/atlas/internal/at"
+	"github.com/jcalabro/atlas/internal/types"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// fsckRepairBatch bounds the number of records rewritten in a single repair transaction. Record
+// values are at most 100KB, so this keeps each transaction well under FDB's 10MB limit.
+const fsckRepairBatch = 50
+
+// FsckIssueKind identifies a class of problem found by CheckRepo
+type FsckIssueKind string
+
+const (
+	// FsckBadHead means the actor's head or rev doesn't agree with the stored head commit
+	FsckBadHead FsckIssueKind = "bad_head"
+
+	// FsckBadSignature means the head commit's signature couldn't be verified
+	FsckBadSignature FsckIssueKind = "bad_signature"
+
+	// FsckMissingBlock means a block referenced by the repo doesn't exist
+	FsckMissingBlock FsckIssueKind = "missing_block"
+
+	// FsckCorruptBlock means a block doesn't hash to its CID or can't be decoded
+	FsckCorruptBlock FsckIssueKind = "corrupt_block"
+
+	// FsckMissingRecord means a record in the MST has no entry in the records index
+	FsckMissingRecord FsckIssueKind = "missing_record"
+
+	// FsckExtraRecord means the records index has an entry that isn't in the MST
+	FsckExtraRecord FsckIssueKind = "extra_record"
+
+	// FsckStaleRecord means a records index entry doesn't match the record in the MST
+	FsckStaleRecord FsckIssueKind = "stale_record"
+
+	// FsckCountMismatch means a collection count doesn't match the number of records in the MST
+	FsckCountMismatch FsckIssueKind = "count_mismatch"
+)
+
+// FsckIssue is a single problem found by CheckRepo
+type FsckIssue struct {
+	Kind   FsckIssueKind
+	Detail string
+}
+
+// FsckOptions configures CheckRepo
+type FsckOptions struct {
+	// Repair rebuilds the records index and collection counts from the MST. Nothing is repaired
+	// unless every block in the MST is present and intact.
+	Repair bool
+
+	// VerifyCommit is called with the head commit to verify its signature, if set
+	VerifyCommit func(ctx context.Context, commit *repo.Commit) error
+}
+
+// FsckResult is the outcome of checking a single repo
+type FsckResult struct {
+	DID  string
+	Head string
+	Rev  string
+
+	// Blocks is the number of distinct blocks reachable from the head
+	Blocks int
+
+	// Records is the number of records in the MST
+	Records int
+
+	Issues []FsckIssue
+
+	// Repaired is the number of records index entries and collection counts that were rewritten
+	Repaired int
+}
+
+// OK returns true if no issues were found
+func (r *FsckResult) OK() bool {
+	return len(r.Issues) == 0
+}
+
+// fsckState is the working state of a single check
+type fsckState struct {
+	res    *FsckResult
+	commit *repo.Commit
+
+	// intact is true if every block reachable from the head was present and valid
+	intact bool
+
+	// leaves maps "collection/rkey" to the record CID for every record in the MST, and counts
+	// is the number of records in each collection
+	leaves map[string]cid.Cid
+	counts map[string]int64
+
+	// index entries that need to be rewritten from the MST or deleted
+	rewrite []*at.URI
+	extra   []*at.URI
+
+	// collections whose counts don't match the MST
+	badCounts int
+}
+
+func (st *fsckState) add(kind FsckIssueKind, format string, args ...any) {
+	st.res.Issues = append(st.res.Issues, FsckIssue{Kind: kind, Detail: fmt.Sprintf(format, args...)})
+}
+
+// CheckRepo verifies the integrity of a single repo. It checks that the actor's head and rev agree
+// with the stored commit, that every block reachable from the head exists and hashes to its CID,
+// and that the records index and collection counts exactly match the records in the MST.
+//
+// Reads are pinned to a single snapshot in the same manner as StreamRepo. If the repo is written
+// to while being checked, the check is restarted.
+func (db *DB) CheckRepo(ctx context.Context, did string, opts FsckOptions) (res *FsckResult, err error) {
+	_, span, done := db.observe(ctx, "CheckRepo")
+	defer func() { done(err) }()
+
+	span.SetAttributes(
+		attribute.String("did", did),
+		attribute.Bool("repair", opts.Repair),
+	)
+
+	if _, err = syntax.ParseDID(did); err != nil {
+		err = fmt.Errorf("invalid did: %w", err)
+		return
+	}
+
+	for attempt := 1; ; attempt++ {
+		res, err = db.checkRepo(ctx, did, opts)
+		if attempt == repairMaxAttempts ||
+			(!errors.Is(err, ErrConcurrentModification) && !errors.Is(err, ErrRepoChanged)) {
+			break
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int("blocks", res.Blocks),
+		attribute.Int("records", res.Records),
+		attribute.Int("issues", len(res.Issues)),
+		attribute.Int("repaired", res.Repaired),
+	)
+
+	return
+}
+
+func (db *DB) checkRepo(ctx context.Context, did string, opts FsckOptions) (*FsckResult, error) {
+	reader := &pinnedReader{db: db.db}
+
+	actor, err := pinnedRead(ctx, reader, func(tx fdb.ReadTransaction) (*types.Actor, error) {
+		return db.getActorByDIDTx(tx, did)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get actor: %w", err)
+	}
+	if actor == nil {
+		return nil, ErrNotFound
+	}
+
+	st := &fsckState{
+		res:    &FsckResult{DID: did, Head: actor.Head, Rev: actor.Rev},
+		leaves: make(map[string]cid.Cid),
+		counts: make(map[string]int64),
+	}
+
+	head, err := cid.Decode(actor.Head)
+	if err != nil {
+		st.add(FsckBadHead, "invalid head cid %q: %s", actor.Head, err)
+		return st.res, nil
+	}
+
+	if err := db.fsckWalk(ctx, reader, st, actor, head); err != nil {
+		return nil, err
+	}
+
+	// the indexes can only be compared against a complete tree
+	if st.intact {
+		if err := db.fsckRecords(ctx, reader, st); err != nil {
+			return nil, err
+		}
+		if err := db.fsckCounts(ctx, reader, st); err != nil {
+			return nil, err
+		}
+	}
+
+	// a check that had to move off of its snapshot may have observed a concurrent write
+	if reader.repinned && !st.res.OK() {
+		return nil, ErrRepoChanged
+	}
+
+	if opts.VerifyCommit != nil && st.commit != nil {
+		if err := opts.VerifyCommit(ctx, st.commit); err != nil {
+			st.add(FsckBadSignature, "%s", err)
+		}
+	}
+
+	if opts.Repair && st.intact {
+		if err := db.fsckRepair(ctx, st); err != nil {
+			return nil, err
+		}
+	}
+
+	return st.res, nil
+}
+
+// fsckWalk visits every block reachable from the head one MST layer at a time, verifying that
+// each one exists and hashes to its CID, and collects the records in the tree
+func (db *DB) fsckWalk(ctx context.Context, reader *pinnedReader, st *fsckState, actor *types.Actor, head cid.Cid) error {
+	st.intact = true
+	seen := map[cid.Cid]struct{}{head: {}}
+
+	front := []exportItem{{cid: head, kind: exportCommit}}
+	for len(front) > 0 {
+		cids := make([]cid.Cid, 0, len(front))
+		for _, item := range front {
+			cids = append(cids, item.cid)
+		}
+
+		var next []exportItem
+		var i int
+		err := db.readBlocks(ctx, reader, actor.Did, cids, func(c cid.Cid, blk blocks.Block) error {
+			item := front[i]
+			i++
+
+			if blk == nil {
+				st.intact = false
+				st.add(FsckMissingBlock, "%s %s does not exist", item.kind, c)
+				return nil
+			}
+
+			sum, err := c.Prefix().Sum(blk.RawData())
+			if err != nil || !sum.Equals(c) {
+				st.intact = false
+				st.add(FsckCorruptBlock, "%s %s does not match its hash", item.kind, c)
+				return nil
+			}
+			st.res.Blocks++
+
+			children, err := st.visit(actor, item, blk.RawData())
+			if err != nil {
+				st.intact = false
+				st.add(FsckCorruptBlock, "%s", err)
+				return nil
+			}
+
+			for _, child := range children {
+				if _, ok := seen[child.cid]; ok {
+					continue
+				}
+				seen[child.cid] = struct{}{}
+				next = append(next, child)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		front = next
+	}
+
+	st.res.Records = len(st.leaves)
+	return nil
+}
+
+// visit decodes a block found by the walk and returns the blocks it references
+func (st *fsckState) visit(actor *types.Actor, item exportItem, data []byte) ([]exportItem, error) {
+	switch item.kind {
+	case exportCommit:
+		var commit repo.Commit
+		if err := commit.UnmarshalCBOR(bytes.NewReader(data)); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal commit %s: %w", item.cid, err)
+		}
+		if err := commit.VerifyStructure(); err != nil {
+			return nil, fmt.Errorf("invalid commit %s: %w", item.cid, err)
+		}
+
+		if commit.DID != actor.Did {
+			st.add(FsckBadHead, "head commit is for did %q", commit.DID)
+		}
+		if commit.Rev != actor.Rev {
+			st.add(FsckBadHead, "actor rev is %q but head commit rev is %q", actor.Rev, commit.Rev)
+		}
+
+		st.commit = &commit
+		return []exportItem{{cid: commit.Data, kind: exportNode}}, nil
+
+	case exportNode:
+		var node mst.NodeData
+		if err := node.UnmarshalCBOR(bytes.NewReader(data)); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal mst node %s: %w", item.cid, err)
+		}
+
+		var children []exportItem
+		if node.Left != nil {
+			children = append(children, exportItem{cid: *node.Left, kind: exportNode})
+		}
+
+		// keys are prefix-compressed against the previous entry in the node
+		var key []byte
+		for _, entry := range node.Entries {
+			if int(entry.PrefixLen) > len(key) {
+				return nil, fmt.Errorf("mst node %s has an invalid key prefix length", item.cid)
+			}
+			key = append(key[:entry.PrefixLen:entry.PrefixLen], entry.KeySuffix...)
+
+			collection, _, ok := strings.Cut(string(key), "/")
+			if !ok {
+				return nil, fmt.Errorf("mst node %s has an invalid key %q", item.cid, key)
+			}
+			st.leaves[string(key)] = entry.Value
+			st.counts[collection]++
+
+			children = append(children, exportItem{cid: entry.Value, kind: exportRecord})
+			if entry.Right != nil {
+				children = append(children, exportItem{cid: *entry.Right, kind: exportNode})
+			}
+		}
+		return children, nil
+
+	default:
+		return nil, nil
+	}
+}
+
+// fsckRecords compares the records index against the records in the MST
+func (db *DB) fsckRecords(ctx context.Context, reader *pinnedReader, st *fsckState) error {
+	did := st.res.DID
+	begin := pack(db.records.records, did)
+	end := pack(db.records.records, did+"\xff")
+
+	indexed := make(map[string]struct{}, len(st.leaves))
+	for {
+		kvs, err := pinnedRead(ctx, reader, func(tx fdb.ReadTransaction) ([]fdb.KeyValue, error) {
+			kr := fdb.KeyRange{Begin: begin, End: end}
+			return tx.GetRange(kr, fdb.RangeOptions{Limit: repairBatch}).GetSliceWithError()
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read records: %w", err)
+		}
+
+		for _, kv := range kvs {
+			tup, err := db.records.records.Unpack(kv.Key)
+			if err != nil {
+				return fmt.Errorf("failed to unpack record key: %w", err)
+			}
+			if len(tup) < 3 {
+				continue
+			}
+			collection, ok1 := tup[1].(string)
+			rkey, ok2 := tup[2].(string)
+			if !ok1 || !ok2 {
+				continue
+			}
+
+			uri := &at.URI{Repo: did, Collection: collection, Rkey: rkey}
+			path := collection + "/" + rkey
+			indexed[path] = struct{}{}
+
+			leaf, ok := st.leaves[path]
+			if !ok {
+				st.add(FsckExtraRecord, "%s is not in the mst", path)
+				st.extra = append(st.extra, uri)
+				continue
+			}
+
+			if problem := checkIndexedRecord(kv.Value, leaf); problem != "" {
+				st.add(FsckStaleRecord, "%s %s", path, problem)
+				st.rewrite = append(st.rewrite, uri)
+			}
+		}
+
+		if len(kvs) < repairBatch {
+			break
+		}
+		begin = append(kvs[len(kvs)-1].Key, 0x00)
+	}
+
+	for _, path := range slices.Sorted(maps.Keys(st.leaves)) {
+		if _, ok := indexed[path]; ok {
+			continue
+		}
+
+		collection, rkey, _ := strings.Cut(path, "/")
+		st.add(FsckMissingRecord, "%s is not in the records index", path)
+		st.rewrite = append(st.rewrite, &at.URI{Repo: did, Collection: collection, Rkey: rkey})
+	}
+
+	return nil
+}
+
+// checkIndexedRecord compares a records index entry with the record CID from the MST, returning
+// a description of the problem if they don't match
+func checkIndexedRecord(buf []byte, leaf cid.Cid) string {
+	var record types.Record
+	if err := proto.Unmarshal(buf, &record); err != nil {
+		return fmt.Sprintf("failed to unmarshal: %s", err)
+	}
+	if record.Cid != leaf.String() {
+		return fmt.Sprintf("has cid %s but the mst has %s", record.Cid, leaf)
+	}
+
+	sum, err := leaf.Prefix().Sum(record.Value)
+	if err != nil || !sum.Equals(leaf) {
+		return "value does not match its cid"
+	}
+
+	return ""
+}
+
+// fsckCounts compares the collection counts index against the records in the MST
+func (db *DB) fsckCounts(ctx context.Context, reader *pinnedReader, st *fsckState) error {
+	did := st.res.DID
+
+	stored, err := pinnedRead(ctx, reader, func(tx fdb.ReadTransaction) (map[string][]byte, error) {
+		kr := fdb.KeyRange{
+			Begin: pack(db.records.collectionCounts, did),
+			End:   pack(db.records.collectionCounts, did+"\xff"),
+		}
+		kvs, err := tx.GetRange(kr, fdb.RangeOptions{}).GetSliceWithError()
+		if err != nil {
+			return nil, err
+		}
+
+		out := make(map[string][]byte, len(kvs))
+		for _, kv := range kvs {
+			tup, err := db.records.collectionCounts.Unpack(kv.Key)
+			if err != nil {
+				return nil, fmt.Errorf("failed to unpack collection count key: %w", err)
+			}
+			if len(tup) < 2 {
+				continue
+			}
+			if collection, ok := tup[1].(string); ok {
+				out[collection] = kv.Value
+			}
+		}
+		return out, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read collection counts: %w", err)
+	}
+
+	collections := slices.Sorted(maps.Keys(st.counts))
+	for collection := range stored {
+		if _, ok := st.counts[collection]; !ok {
+			collections = append(collections, collection)
+		}
+	}
+	slices.Sort(collections)
+
+	for _, collection := range collections {
+		want := st.counts[collection]
+
+		val, ok := stored[collection]
+		if !ok {
+			if want != 0 {
+				st.add(FsckCountMismatch, "%s has no count but the mst has %d records", collection, want)
+				st.badCounts++
+			}
+			continue
+		}
+
+		got, ok := decodeCollectionCount(val)
+		switch {
+		case !ok:
+			st.add(FsckCountMismatch, "%s has a malformed count", collection)
+			st.badCounts++
+		case got != want:
+			st.add(FsckCountMismatch, "%s has count %d but the mst has %d records", collection, got, want)
+			st.badCounts++
+		}
+	}
+
+	return nil
+}
+
+// fsckRepair rebuilds the index entries found to be inconsistent from the MST. Each transaction
+// verifies that the repo head hasn't moved since it was checked, and fails with
+// ErrConcurrentModification if it has.
+func (db *DB) fsckRepair(ctx context.Context, st *fsckState) error {
+	did := st.res.DID
+
+	checkHead := func(tx fdb.Transaction) error {
+		// reading the actor also ensures this transaction conflicts with any concurrent write
+		existing, err := db.getActorByDIDTx(tx, did)
+		if err != nil {
+			return fmt.Errorf("failed to get actor: %w", err)
+		}
+		if existing == nil || existing.Head != st.res.Head {
+			return ErrConcurrentModification
+		}
+		return nil
+	}
+
+	for batch := range slices.Chunk(st.extra, fsckRepairBatch) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		err := db.Transact(func(tx fdb.Transaction) error {
+			if err := checkHead(tx); err != nil {
+				return err
+			}
+			for _, uri := range batch {
+				if err := db.DeleteRecordTx(tx, uri); err != nil {
+					return fmt.Errorf("failed to delete record: %w", err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		st.res.Repaired += len(batch)
+	}
+
+	for batch := range slices.Chunk(st.rewrite, fsckRepairBatch) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		err := db.Transact(func(tx fdb.Transaction) error {
+			if err := checkHead(tx); err != nil {
+				return err
+			}
+			return db.rewriteRecordsTx(tx, st, batch)
+		})
+		if err != nil {
+			return err
+		}
+		st.res.Repaired += len(batch)
+	}
+
+	if st.badCounts > 0 {
+		err := db.Transact(func(tx fdb.Transaction) error {
+			if err := checkHead(tx); err != nil {
+				return err
+			}
+
+			tx.ClearRange(fdb.KeyRange{
+				Begin: pack(db.records.collectionCounts, did),
+				End:   pack(db.records.collectionCounts, did+"\xff"),
+			})
+			for collection, count := range st.counts {
+				tx.Set(pack(db.records.collectionCounts, did, collection), encodeCollectionCount(count))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		st.res.Repaired += st.badCounts
+	}
+
+	return nil
+}
+
+// rewriteRecordsTx rewrites the records index entries for the given records from their MST blocks,
+// preserving the creation time of existing entries
+func (db *DB) rewriteRecordsTx(tx fdb.Transaction, st *fsckState, uris []*at.URI) error {
+	type pending struct {
+		uri      *at.URI
+		leaf     cid.Cid
+		block    fdb.FutureByteSlice
+		existing fdb.FutureByteSlice
+	}
+
+	reads := make([]pending, 0, len(uris))
+	for _, uri := range uris {
+		leaf := st.leaves[uri.Collection+"/"+uri.Rkey]
+		reads = append(reads, pending{
+			uri:      uri,
+			leaf:     leaf,
+			block:    tx.Get(pack(db.blockDir.blocks, uri.Repo, leaf.Bytes())),
+			existing: tx.Get(packURI(db.records.records, uri)),
+		})
+	}
+
+	for _, r := range reads {
+		val, err := r.block.Get()
+		if err != nil {
+			return fmt.Errorf("failed to get record block: %w", err)
+		}
+		if val == nil {
+			return fmt.Errorf("%w: missing record block %s", ErrNotFound, r.leaf)
+		}
+
+		createdAt := timestamppb.Now()
+		buf, err := r.existing.Get()
+		if err != nil {
+			return fmt.Errorf("failed to get existing record: %w", err)
+		}
+		if buf != nil {
+			var existing types.Record
+			switch err := proto.Unmarshal(buf, &existing); {
+			case err != nil:
+				// an unreadable entry can't have its cid index entry cleaned up, which at worst
+				// keeps an unreferenced record block alive
+				tx.Clear(packURI(db.records.records, r.uri))
+			case existing.CreatedAt != nil:
+				createdAt = existing.CreatedAt
+			}
+		}
+
+		record := &types.Record{
+			Did:        r.uri.Repo,
+			Collection: r.uri.Collection,
+			Rkey:       r.uri.Rkey,
+			Cid:        r.leaf.String(),
+			Value:      val,
+			CreatedAt:  createdAt,
+		}
+		if err := db.saveRecordTx(tx, record); err != nil {
+			return fmt.Errorf("failed to save record: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,191 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/bluesky-social/indigo/atproto/repo"
+	"github.com/jcalabro/atlas/internal/at"
+	"github.com/jcalabro/atlas/internal/types"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func requireFsckKinds(t *testing.T, res *FsckResult, kinds ...FsckIssueKind) {
+	t.Helper()
+
+	got := make(map[FsckIssueKind]struct{})
+	for _, issue := range res.Issues {
+		got[issue.Kind] = struct{}{}
+	}
+
+	want := make(map[FsckIssueKind]struct{})
+	for _, kind := range kinds {
+		want[kind] = struct{}{}
+	}
+
+	require.Equal(t, want, got, "issues: %+v", res.Issues)
+}
+
+func TestCheckRepo(t *testing.T) {
+	t.Parallel()
+	db := testDB(t)
+
+	t.Run("healthy repo", func(t *testing.T) {
+		t.Parallel()
+
+		did := "did:plc:fsckhealthy"
+		testRepoActor(t, db, did)
+		putTestRecord(t, db, did, "3kaaaaaaaaaa2", "one")
+		putTestRecord(t, db, did, "3kaaaaaaaaab2", "two")
+		putTestRecord(t, db, did, "3kaaaaaaaaab2", "two, edited")
+		putTestRecord(t, db, did, "3kaaaaaaaaac2", "three")
+		deleteTestRecord(t, db, did, "3kaaaaaaaaac2")
+
+		var verified bool
+		res, err := db.CheckRepo(t.Context(), did, FsckOptions{
+			VerifyCommit: func(_ context.Context, commit *repo.Commit) error {
+				verified = true
+				require.Equal(t, did, commit.DID)
+				return nil
+			},
+		})
+		require.NoError(t, err)
+		require.True(t, res.OK(), "issues: %+v", res.Issues)
+		require.True(t, verified)
+		require.Equal(t, 2, res.Records)
+		require.Equal(t, testHead(t, db, did).String(), res.Head)
+	})
+
+	t.Run("detects and repairs inconsistent indexes", func(t *testing.T) {
+		t.Parallel()
+
+		did := "did:plc:fsckindexes"
+		testRepoActor(t, db, did)
+		putTestRecord(t, db, did, "3kaaaaaaaaaa2", "one")
+		putTestRecord(t, db, did, "3kaaaaaaaaab2", "two")
+		putTestRecord(t, db, did, "3kaaaaaaaaac2", "three")
+
+		original, err := db.GetRecord(t.Context(), at.FormatURI(did, "app.bsky.feed.post", "3kaaaaaaaaaa2"))
+		require.NoError(t, err)
+
+		stale, err := db.GetRecord(t.Context(), at.FormatURI(did, "app.bsky.feed.post", "3kaaaaaaaaab2"))
+		require.NoError(t, err)
+		stale.Cid = original.Cid
+		stale.Value = original.Value
+
+		err = db.Transact(func(tx fdb.Transaction) error {
+			// drop a record from the index
+			uri := &at.URI{Repo: did, Collection: "app.bsky.feed.post", Rkey: "3kaaaaaaaaaa2"}
+			if err := db.DeleteRecordTx(tx, uri); err != nil {
+				return err
+			}
+
+			// point a record at the wrong content
+			if err := db.saveRecordTx(tx, stale); err != nil {
+				return err
+			}
+
+			// add a record that isn't in the repo
+			extra := &types.Record{
+				Did:        did,
+				Collection: "app.bsky.feed.like",
+				Rkey:       "3kaaaaaaaaad2",
+				Cid:        original.Cid,
+				Value:      original.Value,
+				CreatedAt:  timestamppb.Now(),
+			}
+			if err := db.saveRecordTx(tx, extra); err != nil {
+				return err
+			}
+
+			// break the collection count
+			tx.Set(pack(db.records.collectionCounts, did, "app.bsky.feed.post"), encodeCollectionCount(42))
+			return nil
+		})
+		require.NoError(t, err)
+
+		res, err := db.CheckRepo(t.Context(), did, FsckOptions{})
+		require.NoError(t, err)
+		requireFsckKinds(t, res, FsckMissingRecord, FsckStaleRecord, FsckExtraRecord, FsckCountMismatch)
+		require.Zero(t, res.Repaired)
+
+		res, err = db.CheckRepo(t.Context(), did, FsckOptions{Repair: true})
+		require.NoError(t, err)
+		require.False(t, res.OK())
+		require.Equal(t, 4, res.Repaired)
+
+		res, err = db.CheckRepo(t.Context(), did, FsckOptions{})
+		require.NoError(t, err)
+		require.True(t, res.OK(), "issues: %+v", res.Issues)
+
+		restored, err := db.GetRecord(t.Context(), at.FormatURI(did, "app.bsky.feed.post", "3kaaaaaaaaaa2"))
+		require.NoError(t, err)
+		require.Equal(t, original.Cid, restored.Cid)
+		require.Equal(t, original.Value, restored.Value)
+
+		_, err = db.GetRecord(t.Context(), at.FormatURI(did, "app.bsky.feed.like", "3kaaaaaaaaad2"))
+		require.ErrorIs(t, err, ErrNotFound)
+
+		collections, err := db.GetCollections(t.Context(), did)
+		require.NoError(t, err)
+		require.Equal(t, []string{"app.bsky.feed.post"}, collections)
+	})
+
+	t.Run("missing blocks are not repaired", func(t *testing.T) {
+		t.Parallel()
+
+		did := "did:plc:fsckmissing"
+		testRepoActor(t, db, did)
+		putTestRecord(t, db, did, "3kaaaaaaaaaa2", "one")
+		rec := putTestRecord(t, db, did, "3kaaaaaaaaab2", "two")
+
+		err := db.Transact(func(tx fdb.Transaction) error {
+			tx.Clear(pack(db.blockDir.blocks, did, rec.Bytes()))
+			return nil
+		})
+		require.NoError(t, err)
+
+		res, err := db.CheckRepo(t.Context(), did, FsckOptions{Repair: true})
+		require.NoError(t, err)
+		requireFsckKinds(t, res, FsckMissingBlock)
+		require.Zero(t, res.Repaired)
+
+		// the index still has the record whose block is missing
+		_, err = db.GetRecord(t.Context(), at.FormatURI(did, "app.bsky.feed.post", "3kaaaaaaaaab2"))
+		require.NoError(t, err)
+	})
+
+	t.Run("head and signature problems", func(t *testing.T) {
+		t.Parallel()
+
+		did := "did:plc:fsckhead"
+		actor := testRepoActor(t, db, did)
+		putTestRecord(t, db, did, "3kaaaaaaaaaa2", "one")
+
+		actor, err := db.GetActorByDID(t.Context(), actor.Did)
+		require.NoError(t, err)
+		actor.Rev = "3kaaaaaaaaaa2"
+		require.NoError(t, db.SaveActor(t.Context(), actor))
+
+		res, err := db.CheckRepo(t.Context(), did, FsckOptions{
+			VerifyCommit: func(context.Context, *repo.Commit) error {
+				return errors.New("bad signature")
+			},
+		})
+		require.NoError(t, err)
+		requireFsckKinds(t, res, FsckBadHead, FsckBadSignature)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := db.CheckRepo(t.Context(), "not-a-did", FsckOptions{})
+		require.Error(t, err)
+
+		_, err = db.CheckRepo(t.Context(), "did:plc:fsckdoesnotexist", FsckOptions{})
+		require.ErrorIs(t, err, ErrNotFound)
+	})
+}
@@ -0,0 +1,602 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	pdsmetrics "github.com/jcalabro/atlas/internal/pds/metrics"
+	"github.com/jcalabro/atlas/internal/types"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// gcSweepBatch bounds the number of queued blocks handled in a single sweep transaction
+	gcSweepBatch = 500
+
+	// repairBatch bounds the number of keys scanned in a single repair transaction
+	repairBatch = 1000
+
+	// repairMaxAttempts is the number of times a repair restarts because the repo was written to
+	repairMaxAttempts = 5
+)
+
+// queueUnreachableBlocksTx finds the blocks that are no longer reachable after a repo moves from
+// the commit oldCommit (with MST root oldRoot) to a commit with MST root newRoot, and queues them
+// for deletion by SweepBlocks. Must be called after the records index has been updated for the
+// new commit.
+//
+// Blocks aren't deleted immediately so that `since` diffs from recent revisions continue to work
+// for the retention window.
+func (db *DB) queueUnreachableBlocksTx(
+	tx fdb.Transaction,
+	bs *blockstore,
+	oldCommit, oldRoot, newRoot cid.Cid,
+) error {
+	// swap the roots so the "new" side of the diff is the tree being replaced
+	unreachable := []cid.Cid{oldCommit}
+	records, _, err := diffTrees(oldRoot, newRoot, db.txBlockLoader(tx, bs.did), func(blk blocks.Block) error {
+		unreachable = append(unreachable, blk.Cid())
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to diff mst: %w", err)
+	}
+
+	// record blocks may still be referenced by another record with identical content, which can
+	// only be ruled out once the repo's records are all in the records_by_cid index
+	indexed, err := tx.Get(pack(db.records.recordsByCIDIndexed, bs.did)).Get()
+	if err != nil {
+		return fmt.Errorf("failed to check records_by_cid backfill: %w", err)
+	}
+	if indexed == nil {
+		records = nil
+	}
+
+	futures := make([]fdb.RangeResult, 0, len(records))
+	for _, c := range records {
+		kr, err := fdb.PrefixRange(pack(db.records.recordsByCID, bs.did, c.String()))
+		if err != nil {
+			return fmt.Errorf("failed to create records_by_cid range: %w", err)
+		}
+		futures = append(futures, tx.GetRange(kr, fdb.RangeOptions{Limit: 1}))
+	}
+	for i, f := range futures {
+		kvs, err := f.GetSliceWithError()
+		if err != nil {
+			return fmt.Errorf("failed to check record references: %w", err)
+		}
+		if len(kvs) == 0 {
+			unreachable = append(unreachable, records[i])
+		}
+	}
+
+	// anything written by this commit is reachable by definition
+	written := make(map[cid.Cid]struct{}, len(bs.writeLog))
+	for _, blk := range bs.writeLog {
+		written[blk.Cid()] = struct{}{}
+	}
+
+	now := time.Now().UnixMicro()
+	val := make([]byte, 8)
+	binary.BigEndian.PutUint64(val, uint64(now))
+
+	var queued int
+	for _, c := range unreachable {
+		if _, ok := written[c]; ok {
+			continue
+		}
+
+		tx.Set(pack(db.blockDir.gcQueue, now, bs.did, c.Bytes()), nil)
+		tx.Set(pack(db.blockDir.gcPending, bs.did, c.Bytes()), val)
+		queued++
+	}
+
+	pdsmetrics.BlockGCQueued.Add(float64(queued))
+	return nil
+}
+
+// txBlockLoader returns a blockLoader that reads blocks within the given transaction
+func (db *DB) txBlockLoader(tx fdb.ReadTransaction, did string) blockLoader {
+	return func(cids []cid.Cid, fn func(c cid.Cid, blk blocks.Block) error) error {
+		futures := make([]fdb.FutureByteSlice, 0, len(cids))
+		for _, c := range cids {
+			futures = append(futures, tx.Get(pack(db.blockDir.blocks, did, c.Bytes())))
+		}
+
+		for i, f := range futures {
+			val, err := f.Get()
+			if err != nil {
+				return fmt.Errorf("failed to get block: %w", err)
+			}
+
+			var blk blocks.Block
+			if val != nil {
+				blk, err = blocks.NewBlockWithCid(val, cids[i])
+				if err != nil {
+					return err
+				}
+			}
+
+			if err := fn(cids[i], blk); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// clearBlockTx deletes a block along with its secondary index entries. rev is the value of the
+// block's revs_by_block entry, which may be nil for blocks written before that index existed.
+func (db *DB) clearBlockTx(tx fdb.Transaction, did string, cidBytes, rev []byte) {
+	tx.Clear(pack(db.blockDir.blocks, did, cidBytes))
+	if rev != nil {
+		tx.Clear(pack(db.blockDir.blocksByRev, did, string(rev), cidBytes))
+	}
+	tx.Clear(pack(db.blockDir.revsByBlock, did, cidBytes))
+	tx.Clear(pack(db.blockDir.gcPending, did, cidBytes))
+}
+
+// SweepBlocks deletes blocks that were queued for garbage collection before the given time and
+// haven't been written again since. Returns the number of blocks deleted.
+func (db *DB) SweepBlocks(ctx context.Context, before time.Time) (deleted int, err error) {
+	_, span, done := db.observe(ctx, "SweepBlocks")
+	defer func() { done(err) }()
+
+	span.SetAttributes(attribute.String("before", before.Format(time.RFC3339)))
+	defer func() { span.SetAttributes(attribute.Int("deleted", deleted)) }()
+
+	type batch struct {
+		processed int
+		deleted   int
+	}
+
+	kr := fdb.KeyRange{
+		Begin: db.blockDir.gcQueue.FDBKey(),
+		End:   pack(db.blockDir.gcQueue, before.UnixMicro()),
+	}
+
+	for {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+
+		var res *batch
+		res, err = transaction(db.db, func(tx fdb.Transaction) (*batch, error) {
+			kvs, err := tx.GetRange(kr, fdb.RangeOptions{Limit: gcSweepBatch}).GetSliceWithError()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read gc queue: %w", err)
+			}
+
+			deleted, err := db.sweepQueueTx(tx, kvs)
+			if err != nil {
+				return nil, err
+			}
+
+			return &batch{processed: len(kvs), deleted: deleted}, nil
+		})
+		if err != nil {
+			return
+		}
+
+		deleted += res.deleted
+		pdsmetrics.BlockGCDeleted.Add(float64(res.deleted))
+
+		if res.processed < gcSweepBatch {
+			return
+		}
+	}
+}
+
+// sweepQueueTx removes the given gc queue entries and deletes each queued block that is still
+// pending deletion. Returns the number of blocks deleted.
+func (db *DB) sweepQueueTx(tx fdb.Transaction, kvs []fdb.KeyValue) (int, error) {
+	type entry struct {
+		queuedAt int64
+		did      string
+		cidBytes []byte
+		pending  fdb.FutureByteSlice
+		rev      fdb.FutureByteSlice
+	}
+
+	entries := make([]entry, 0, len(kvs))
+	for _, kv := range kvs {
+		tx.Clear(kv.Key)
+
+		tup, err := db.blockDir.gcQueue.Unpack(kv.Key)
+		if err != nil {
+			return 0, fmt.Errorf("failed to unpack gc queue key: %w", err)
+		}
+		if len(tup) < 3 {
+			continue
+		}
+		queuedAt, ok1 := tup[0].(int64)
+		did, ok2 := tup[1].(string)
+		cidBytes, ok3 := tup[2].([]byte)
+		if !ok1 || !ok2 || !ok3 {
+			continue
+		}
+
+		entries = append(entries, entry{
+			queuedAt: queuedAt,
+			did:      did,
+			cidBytes: cidBytes,
+			pending:  tx.Get(pack(db.blockDir.gcPending, did, cidBytes)),
+			rev:      tx.Get(pack(db.blockDir.revsByBlock, did, cidBytes)),
+		})
+	}
+
+	var deleted int
+	for _, e := range entries {
+		pending, err := e.pending.Get()
+		if err != nil {
+			return 0, fmt.Errorf("failed to get gc pending entry: %w", err)
+		}
+
+		// skip blocks that were written again, or queued again by a later commit
+		if len(pending) != 8 || int64(binary.BigEndian.Uint64(pending)) != e.queuedAt {
+			continue
+		}
+
+		rev, err := e.rev.Get()
+		if err != nil {
+			return 0, fmt.Errorf("failed to get block rev: %w", err)
+		}
+
+		db.clearBlockTx(tx, e.did, e.cidBytes, rev)
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// RepairBlocksResult summarizes the work done by RepairRepoBlocks
+type RepairBlocksResult struct {
+	// Reachable is the number of blocks reachable from the repo's head
+	Reachable int
+
+	// BlocksDeleted is the number of unreachable blocks that were deleted
+	BlocksDeleted int
+
+	// RevEntriesDeleted is the number of leftover blocks_by_rev entries that were deleted, in
+	// addition to those cleared along with each deleted block
+	RevEntriesDeleted int
+
+	// RecordsIndexed is the number of records written to the records_by_cid index
+	RecordsIndexed int
+}
+
+// RepairRepoBlocks performs a full mark-and-sweep of a single repo's blocks: every block reachable
+// from the current head is marked, then every other block and blocks_by_rev entry is deleted. It
+// also backfills the records_by_cid index that per-commit garbage collection relies on.
+//
+// Unlike the per-commit garbage collector, this doesn't honor the retention window, so `since`
+// diffs from revisions before the repair will no longer work. If the repo is written to while the
+// sweep is running, the mark phase is restarted.
+func (db *DB) RepairRepoBlocks(ctx context.Context, did string) (res *RepairBlocksResult, err error) {
+	_, span, done := db.observe(ctx, "RepairRepoBlocks")
+	defer func() { done(err) }()
+
+	span.SetAttributes(attribute.String("did", did))
+
+	if _, err = syntax.ParseDID(did); err != nil {
+		err = fmt.Errorf("invalid did: %w", err)
+		return
+	}
+
+	res = &RepairBlocksResult{}
+	res.RecordsIndexed, err = db.indexRecordCIDs(ctx, did)
+	if err != nil {
+		return
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = db.markAndSweep(ctx, did, res)
+		if !errors.Is(err, ErrConcurrentModification) || attempt == repairMaxAttempts {
+			break
+		}
+	}
+
+	span.SetAttributes(
+		attribute.Int("reachable", res.Reachable),
+		attribute.Int("blocks_deleted", res.BlocksDeleted),
+		attribute.Int("rev_entries_deleted", res.RevEntriesDeleted),
+		attribute.Int("records_indexed", res.RecordsIndexed),
+	)
+
+	return
+}
+
+// BackfillRecordCIDIndex indexes the records of every repo that was created before the
+// records_by_cid index existed, so that per-commit garbage collection can delete their record
+// blocks. Returns the number of repos that were backfilled.
+func (db *DB) BackfillRecordCIDIndex(ctx context.Context) (repos int, err error) {
+	_, span, done := db.observe(ctx, "BackfillRecordCIDIndex")
+	defer func() { done(err) }()
+
+	defer func() { span.SetAttributes(attribute.Int("repos", repos)) }()
+
+	type batch struct {
+		dids []string
+		next fdb.Key
+	}
+
+	begin, end := db.actors.actors.FDBRangeKeys()
+
+	for {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+
+		var res *batch
+		res, err = readTransaction(db.db, func(tx fdb.ReadTransaction) (*batch, error) {
+			kr := fdb.KeyRange{Begin: begin, End: end}
+			kvs, err := tx.GetRange(kr, fdb.RangeOptions{Limit: repairBatch}).GetSliceWithError()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read actors: %w", err)
+			}
+
+			dids := make([]string, 0, len(kvs))
+			futures := make([]fdb.FutureByteSlice, 0, len(kvs))
+			for _, kv := range kvs {
+				tup, err := db.actors.actors.Unpack(kv.Key)
+				if err != nil {
+					return nil, fmt.Errorf("failed to unpack actor key: %w", err)
+				}
+				did, ok := tup[0].(string)
+				if len(tup) != 1 || !ok {
+					continue
+				}
+				dids = append(dids, did)
+				futures = append(futures, tx.Get(pack(db.records.recordsByCIDIndexed, did)))
+			}
+
+			res := &batch{}
+			for i, f := range futures {
+				indexed, err := f.Get()
+				if err != nil {
+					return nil, fmt.Errorf("failed to check records_by_cid backfill: %w", err)
+				}
+				if indexed == nil {
+					res.dids = append(res.dids, dids[i])
+				}
+			}
+			if len(kvs) == repairBatch {
+				res.next = append(kvs[len(kvs)-1].Key, 0x00)
+			}
+			return res, nil
+		})
+		if err != nil {
+			return
+		}
+
+		for _, did := range res.dids {
+			if _, err = db.indexRecordCIDs(ctx, did); err != nil {
+				err = fmt.Errorf("failed to backfill records_by_cid for %s: %w", did, err)
+				return
+			}
+			repos++
+		}
+
+		if res.next == nil {
+			return
+		}
+		begin = res.next
+	}
+}
+
+// indexRecordCIDs writes a records_by_cid entry for every record in the repo, then marks the repo
+// as indexed. Records written concurrently index themselves, so the final batch's transaction is
+// the point after which every record is in the index.
+func (db *DB) indexRecordCIDs(ctx context.Context, did string) (int, error) {
+	var indexed int
+	begin := pack(db.records.records, did)
+	end := pack(db.records.records, did+"\xff")
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return indexed, err
+		}
+
+		type batch struct {
+			indexed int
+			next    fdb.Key
+		}
+
+		res, err := transaction(db.db, func(tx fdb.Transaction) (*batch, error) {
+			kr := fdb.KeyRange{Begin: begin, End: end}
+			kvs, err := tx.GetRange(kr, fdb.RangeOptions{Limit: repairBatch}).GetSliceWithError()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read records: %w", err)
+			}
+
+			for _, kv := range kvs {
+				var record types.Record
+				if err := proto.Unmarshal(kv.Value, &record); err != nil {
+					return nil, fmt.Errorf("failed to unmarshal record: %w", err)
+				}
+				tx.Set(pack(db.records.recordsByCID, did, record.Cid, record.Collection, record.Rkey), nil)
+			}
+
+			res := &batch{indexed: len(kvs)}
+			if len(kvs) == repairBatch {
+				res.next = append(kvs[len(kvs)-1].Key, 0x00)
+			} else {
+				tx.Set(pack(db.records.recordsByCIDIndexed, did), nil)
+			}
+			return res, nil
+		})
+		if err != nil {
+			return indexed, err
+		}
+
+		indexed += res.indexed
+		if res.next == nil {
+			return indexed, nil
+		}
+		begin = res.next
+	}
+}
+
+// markAndSweep marks every block reachable from the repo's head, then deletes all other blocks
+// and blocks_by_rev entries. Returns ErrConcurrentModification if the head moves during the sweep.
+func (db *DB) markAndSweep(ctx context.Context, did string, res *RepairBlocksResult) error {
+	actor, err := db.GetActorByDID(ctx, did)
+	if err != nil {
+		return fmt.Errorf("failed to get actor: %w", err)
+	}
+
+	head, err := cid.Decode(actor.Head)
+	if err != nil {
+		return fmt.Errorf("failed to parse repo head CID: %w", err)
+	}
+
+	marked := make(map[string]struct{})
+	err = db.StreamRepo(ctx, did, head, func(blk blocks.Block) error {
+		marked[string(blk.Cid().Bytes())] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to mark reachable blocks: %w", err)
+	}
+	res.Reachable = len(marked)
+
+	// sweep the primary index
+	deleted, err := db.sweepRange(ctx, did, actor.Head, db.blockDir.blocks.Unpack,
+		pack(db.blockDir.blocks, did), pack(db.blockDir.blocks, did+"\xff"),
+		func(tx fdb.Transaction, tup tuple.Tuple) (fdb.FutureByteSlice, bool) {
+			cidBytes, ok := tup[1].([]byte)
+			if !ok {
+				return nil, false
+			}
+			if _, ok := marked[string(cidBytes)]; ok {
+				return nil, false
+			}
+			return tx.Get(pack(db.blockDir.revsByBlock, did, cidBytes)), true
+		},
+		func(tx fdb.Transaction, tup tuple.Tuple, rev []byte) {
+			db.clearBlockTx(tx, did, tup[1].([]byte), rev)
+		},
+	)
+	res.BlocksDeleted += deleted
+	if err != nil {
+		return err
+	}
+
+	// sweep leftover blocks_by_rev entries, such as those for blocks that were re-written in a
+	// later rev before becoming unreachable
+	deleted, err = db.sweepRange(ctx, did, actor.Head, db.blockDir.blocksByRev.Unpack,
+		pack(db.blockDir.blocksByRev, did), pack(db.blockDir.blocksByRev, did+"\xff"),
+		func(tx fdb.Transaction, tup tuple.Tuple) (fdb.FutureByteSlice, bool) {
+			if len(tup) < 3 {
+				return nil, false
+			}
+			cidBytes, ok := tup[2].([]byte)
+			if !ok {
+				return nil, false
+			}
+			_, ok = marked[string(cidBytes)]
+			return nil, !ok
+		},
+		func(tx fdb.Transaction, tup tuple.Tuple, _ []byte) {
+			tx.Clear(pack(db.blockDir.blocksByRev, did, tup[1], tup[2]))
+		},
+	)
+	res.RevEntriesDeleted += deleted
+	return err
+}
+
+// sweepRange scans the keys between begin and end in batches, deleting each key that shouldSweep
+// selects. shouldSweep may return a future whose value is passed to sweep. Each batch verifies
+// that the repo head still matches head, and fails with ErrConcurrentModification if it doesn't.
+func (db *DB) sweepRange(
+	ctx context.Context,
+	did, head string,
+	unpack func(fdb.KeyConvertible) (tuple.Tuple, error),
+	begin, end fdb.Key,
+	shouldSweep func(tx fdb.Transaction, tup tuple.Tuple) (fdb.FutureByteSlice, bool),
+	sweep func(tx fdb.Transaction, tup tuple.Tuple, val []byte),
+) (int, error) {
+	var deleted int
+	for {
+		if err := ctx.Err(); err != nil {
+			return deleted, err
+		}
+
+		type batch struct {
+			deleted int
+			next    fdb.Key
+		}
+
+		res, err := transaction(db.db, func(tx fdb.Transaction) (*batch, error) {
+			// reading the actor also ensures this transaction conflicts with any concurrent write
+			existing, err := db.getActorByDIDTx(tx, did)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get actor: %w", err)
+			}
+			if existing == nil || existing.Head != head {
+				return nil, ErrConcurrentModification
+			}
+
+			kr := fdb.KeyRange{Begin: begin, End: end}
+			kvs, err := tx.GetRange(kr, fdb.RangeOptions{Limit: repairBatch}).GetSliceWithError()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read keys: %w", err)
+			}
+
+			type candidate struct {
+				tup tuple.Tuple
+				val fdb.FutureByteSlice
+			}
+
+			var candidates []candidate
+			for _, kv := range kvs {
+				tup, err := unpack(kv.Key)
+				if err != nil {
+					return nil, fmt.Errorf("failed to unpack key: %w", err)
+				}
+				if len(tup) < 2 {
+					continue
+				}
+				if f, ok := shouldSweep(tx, tup); ok {
+					candidates = append(candidates, candidate{tup: tup, val: f})
+				}
+			}
+
+			for _, c := range candidates {
+				var val []byte
+				if c.val != nil {
+					val, err = c.val.Get()
+					if err != nil {
+						return nil, fmt.Errorf("failed to read sweep candidate: %w", err)
+					}
+				}
+				sweep(tx, c.tup, val)
+			}
+
+			res := &batch{deleted: len(candidates)}
+			if len(kvs) == repairBatch {
+				res.next = append(kvs[len(kvs)-1].Key, 0x00)
+			}
+			return res, nil
+		})
+		if err != nil {
+			return deleted, err
+		}
+
+		deleted += res.deleted
+		if res.next == nil {
+			return deleted, nil
+		}
+		begin = res.next
+	}
+}
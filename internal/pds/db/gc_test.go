@@ -0,0 +1,312 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/bluesky-social/indigo/atproto/atdata"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/jcalabro/atlas/internal/at"
+	"github.com/jcalabro/atlas/internal/types"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// testRepoActor creates an actor with an initialized repo
+func testRepoActor(t *testing.T, db *DB, did string) *types.Actor {
+	t.Helper()
+
+	signingKey, err := atcrypto.GeneratePrivateKeyK256()
+	require.NoError(t, err)
+
+	actor := &types.Actor{
+		Did:        did,
+		Email:      did + "@example.com",
+		Handle:     did[len("did:plc:"):] + ".example.com",
+		PdsHost:    "dev.atlaspds.dev",
+		CreatedAt:  timestamppb.Now(),
+		SigningKey: signingKey.Bytes(),
+		Active:     true,
+	}
+
+	head, rev, err := db.InitRepo(t.Context(), actor)
+	require.NoError(t, err)
+	actor.Head = head.String()
+	actor.Rev = rev
+	require.NoError(t, db.SaveActor(t.Context(), actor))
+
+	return actor
+}
+
+// putTestRecord creates or updates a record and returns the record's CID
+func putTestRecord(t *testing.T, db *DB, did, rkey, text string) cid.Cid {
+	t.Helper()
+
+	actor, err := db.GetActorByDID(t.Context(), did)
+	require.NoError(t, err)
+
+	val, err := atdata.MarshalCBOR(map[string]any{"$type": "app.bsky.feed.post", "text": text})
+	require.NoError(t, err)
+
+	record := &types.Record{
+		Did:        did,
+		Collection: "app.bsky.feed.post",
+		Rkey:       rkey,
+		Value:      val,
+		CreatedAt:  timestamppb.Now(),
+	}
+	res, err := db.PutRecord(t.Context(), actor, record, val, nil, nil)
+	require.NoError(t, err)
+
+	return res.RecordCID
+}
+
+func deleteTestRecord(t *testing.T, db *DB, did, rkey string) {
+	t.Helper()
+
+	actor, err := db.GetActorByDID(t.Context(), did)
+	require.NoError(t, err)
+
+	_, err = db.DeleteRecord(t.Context(), actor, &at.URI{Repo: did, Collection: "app.bsky.feed.post", Rkey: rkey}, nil)
+	require.NoError(t, err)
+}
+
+func testHead(t *testing.T, db *DB, did string) cid.Cid {
+	t.Helper()
+
+	actor, err := db.GetActorByDID(t.Context(), did)
+	require.NoError(t, err)
+
+	head, err := cid.Decode(actor.Head)
+	require.NoError(t, err)
+	return head
+}
+
+// sweepTestRepo sweeps only the given repo's queued blocks regardless of age, so that tests don't
+// interfere with each other's retention windows
+func sweepTestRepo(t *testing.T, db *DB, did string) int {
+	t.Helper()
+
+	var deleted int
+	err := db.Transact(func(tx fdb.Transaction) error {
+		kvs, err := tx.GetRange(db.blockDir.gcQueue, fdb.RangeOptions{}).GetSliceWithError()
+		if err != nil {
+			return err
+		}
+
+		var mine []fdb.KeyValue
+		for _, kv := range kvs {
+			tup, err := db.blockDir.gcQueue.Unpack(kv.Key)
+			if err != nil {
+				return err
+			}
+			if tup[1] == did {
+				mine = append(mine, kv)
+			}
+		}
+
+		deleted, err = db.sweepQueueTx(tx, mine)
+		return err
+	})
+	require.NoError(t, err)
+
+	return deleted
+}
+
+// requireCompleteRepo asserts that every block reachable from the repo's head exists
+func requireCompleteRepo(t *testing.T, db *DB, did string) map[cid.Cid]struct{} {
+	t.Helper()
+
+	reachable := make(map[cid.Cid]struct{})
+	err := db.StreamRepo(t.Context(), did, testHead(t, db, did), func(blk blocks.Block) error {
+		reachable[blk.Cid()] = struct{}{}
+		return nil
+	})
+	require.NoError(t, err)
+
+	return reachable
+}
+
+func requireBlockExists(t *testing.T, db *DB, did string, c cid.Cid, exists bool) {
+	t.Helper()
+
+	blks, err := db.GetBlocks(t.Context(), did, []cid.Cid{c})
+	require.NoError(t, err)
+	if exists {
+		require.Len(t, blks, 1, "block %s should exist", c)
+	} else {
+		require.Empty(t, blks, "block %s should have been deleted", c)
+	}
+}
+
+func TestBlockGC(t *testing.T) {
+	t.Parallel()
+	db := testDB(t)
+
+	t.Run("unreachable blocks are queued and swept", func(t *testing.T) {
+		t.Parallel()
+
+		did := "did:plc:blockgc1"
+		testRepoActor(t, db, did)
+
+		putTestRecord(t, db, did, "3kaaaaaaaaaa2", "one")
+		deleted := putTestRecord(t, db, did, "3kaaaaaaaaab2", "two")
+		updated := putTestRecord(t, db, did, "3kaaaaaaaaac2", "three")
+		oldHead := testHead(t, db, did)
+
+		deleteTestRecord(t, db, did, "3kaaaaaaaaab2")
+		putTestRecord(t, db, did, "3kaaaaaaaaac2", "three, edited")
+
+		// nothing is deleted until the sweeper runs
+		requireBlockExists(t, db, did, oldHead, true)
+		requireBlockExists(t, db, did, deleted, true)
+
+		require.Positive(t, sweepTestRepo(t, db, did))
+		requireBlockExists(t, db, did, oldHead, false)
+		requireBlockExists(t, db, did, deleted, false)
+		requireBlockExists(t, db, did, updated, false)
+
+		// every block that was left is still reachable, and vice versa
+		reachable := requireCompleteRepo(t, db, did)
+		all, err := db.GetAllBlocks(t.Context(), did)
+		require.NoError(t, err)
+		require.Len(t, all, len(reachable))
+
+		// the index entries for swept blocks are gone too
+		for c := range revIndex(t, db, did) {
+			require.Contains(t, reachable, c)
+		}
+
+		// sweeping again is a no-op
+		require.Zero(t, sweepTestRepo(t, db, did))
+	})
+
+	t.Run("blocks written again are not swept", func(t *testing.T) {
+		t.Parallel()
+
+		did := "did:plc:blockgc2"
+		testRepoActor(t, db, did)
+
+		rec := putTestRecord(t, db, did, "3kaaaaaaaaaa2", "same content")
+		deleteTestRecord(t, db, did, "3kaaaaaaaaaa2")
+
+		// re-creating identical content cancels the pending deletion
+		require.Equal(t, rec, putTestRecord(t, db, did, "3kaaaaaaaaab2", "same content"))
+
+		sweepTestRepo(t, db, did)
+		requireBlockExists(t, db, did, rec, true)
+		requireCompleteRepo(t, db, did)
+	})
+
+	t.Run("records with identical content share a block", func(t *testing.T) {
+		t.Parallel()
+
+		did := "did:plc:blockgc3"
+		testRepoActor(t, db, did)
+
+		rec := putTestRecord(t, db, did, "3kaaaaaaaaaa2", "duplicate")
+		require.Equal(t, rec, putTestRecord(t, db, did, "3kaaaaaaaaab2", "duplicate"))
+		deleteTestRecord(t, db, did, "3kaaaaaaaaaa2")
+
+		sweepTestRepo(t, db, did)
+		requireBlockExists(t, db, did, rec, true)
+		requireCompleteRepo(t, db, did)
+	})
+}
+
+func TestBlockGCBeforeBackfill(t *testing.T) {
+	t.Parallel()
+	db := testDB(t)
+
+	did := "did:plc:blockgcbackfill1"
+	testRepoActor(t, db, did)
+
+	shared := putTestRecord(t, db, did, "3kaaaaaaaaaa2", "duplicate")
+	putTestRecord(t, db, did, "3kaaaaaaaaab2", "duplicate")
+	unique := putTestRecord(t, db, did, "3kaaaaaaaaac2", "unique")
+
+	// make the repo look like it was created before records_by_cid existed
+	err := db.Transact(func(tx fdb.Transaction) error {
+		kr, err := fdb.PrefixRange(pack(db.records.recordsByCID, did))
+		if err != nil {
+			return err
+		}
+		tx.ClearRange(kr)
+		tx.Clear(pack(db.records.recordsByCIDIndexed, did))
+		return nil
+	})
+	require.NoError(t, err)
+
+	// record blocks are left alone until the repo's records are indexed
+	deleteTestRecord(t, db, did, "3kaaaaaaaaaa2")
+	deleteTestRecord(t, db, did, "3kaaaaaaaaac2")
+	require.Positive(t, sweepTestRepo(t, db, did))
+	requireBlockExists(t, db, did, shared, true)
+	requireBlockExists(t, db, did, unique, true)
+	requireCompleteRepo(t, db, did)
+
+	repos, err := db.BackfillRecordCIDIndex(t.Context())
+	require.NoError(t, err)
+	require.Positive(t, repos)
+
+	// once indexed, the shared block is still kept while it's referenced
+	unique = putTestRecord(t, db, did, "3kaaaaaaaaad2", "unique again")
+	deleteTestRecord(t, db, did, "3kaaaaaaaaad2")
+	require.Positive(t, sweepTestRepo(t, db, did))
+	requireBlockExists(t, db, did, shared, true)
+	requireBlockExists(t, db, did, unique, false)
+	requireCompleteRepo(t, db, did)
+}
+
+func TestRepairRepoBlocks(t *testing.T) {
+	t.Parallel()
+	db := testDB(t)
+
+	t.Run("deletes everything unreachable", func(t *testing.T) {
+		t.Parallel()
+
+		did := "did:plc:repairblocks1"
+		testRepoActor(t, db, did)
+
+		for _, rkey := range []string{"3kaaaaaaaaaa2", "3kaaaaaaaaab2", "3kaaaaaaaaac2", "3kaaaaaaaaad2"} {
+			putTestRecord(t, db, did, rkey, "original "+rkey)
+		}
+		putTestRecord(t, db, did, "3kaaaaaaaaaa2", "edited")
+		deleteTestRecord(t, db, did, "3kaaaaaaaaab2")
+
+		before, err := db.GetAllBlocks(t.Context(), did)
+		require.NoError(t, err)
+
+		res, err := db.RepairRepoBlocks(t.Context(), did)
+		require.NoError(t, err)
+		require.Equal(t, 3, res.RecordsIndexed)
+		require.Positive(t, res.BlocksDeleted)
+		require.Equal(t, len(before)-res.BlocksDeleted, res.Reachable)
+
+		reachable := requireCompleteRepo(t, db, did)
+		require.Len(t, reachable, res.Reachable)
+
+		after, err := db.GetAllBlocks(t.Context(), did)
+		require.NoError(t, err)
+		require.Len(t, after, res.Reachable)
+
+		for c := range revIndex(t, db, did) {
+			require.Contains(t, reachable, c)
+		}
+
+		// repairing again finds nothing to do
+		res, err = db.RepairRepoBlocks(t.Context(), did)
+		require.NoError(t, err)
+		require.Zero(t, res.BlocksDeleted)
+		require.Zero(t, res.RevEntriesDeleted)
+	})
+
+	t.Run("invalid did", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := db.RepairRepoBlocks(t.Context(), "not-a-did")
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,188 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/jcalabro/atlas/internal/types"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrHostExists is returned when registering a host that's already registered
+var ErrHostExists = errors.New("host already registered")
+
+// hostRegistryVersionKey is the key of the counter that's incremented by every registry change
+const hostRegistryVersionKey = "version"
+
+func validateRegisteredHost(host *types.RegisteredHost) error {
+	switch {
+	case host == nil:
+		return fmt.Errorf("registered host is nil")
+	case host.Hostname == "":
+		return fmt.Errorf("hostname is required")
+	case host.Config == "":
+		return fmt.Errorf("config is required")
+	case host.JwtSigningKey == nil:
+		return fmt.Errorf("jwt signing key is required")
+	case host.CreatedAt == nil:
+		return fmt.Errorf("created at is required")
+	case host.UpdatedAt == nil:
+		return fmt.Errorf("updated at is required")
+	}
+
+	return nil
+}
+
+func (db *DB) getRegisteredHostTx(tx fdb.ReadTransaction, hostname string) (*types.RegisteredHost, error) {
+	buf, err := tx.Get(pack(db.hostRegistry.hosts, hostname)).Get()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get registered host: %w", err)
+	}
+	if len(buf) == 0 {
+		return nil, nil
+	}
+
+	var host types.RegisteredHost
+	if err := proto.Unmarshal(buf, &host); err != nil {
+		return nil, fmt.Errorf("failed to protobuf unmarshal registered host: %w", err)
+	}
+
+	return &host, nil
+}
+
+// saveRegisteredHostTx stores the host and bumps the registry version so watchers reload
+func (db *DB) saveRegisteredHostTx(tx fdb.Transaction, host *types.RegisteredHost) error {
+	buf, err := proto.Marshal(host)
+	if err != nil {
+		return fmt.Errorf("failed to protobuf marshal registered host: %w", err)
+	}
+
+	tx.Set(pack(db.hostRegistry.hosts, host.Hostname), buf)
+	tx.Add(pack(db.hostRegistry.version, hostRegistryVersionKey), binary.LittleEndian.AppendUint64(nil, 1))
+
+	return nil
+}
+
+// CreateRegisteredHost adds a host to the registry. Returns ErrHostExists if it's already registered.
+func (db *DB) CreateRegisteredHost(ctx context.Context, host *types.RegisteredHost) (err error) {
+	_, span, done := db.observe(ctx, "CreateRegisteredHost")
+	defer func() { done(err) }()
+
+	if err = validateRegisteredHost(host); err != nil {
+		err = fmt.Errorf("invalid registered host: %w", err)
+		return
+	}
+
+	span.SetAttributes(attribute.String("hostname", host.Hostname))
+
+	_, err = transaction(db.db, func(tx fdb.Transaction) (any, error) {
+		existing, err := db.getRegisteredHostTx(tx, host.Hostname)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			return nil, ErrHostExists
+		}
+
+		return nil, db.saveRegisteredHostTx(tx, host)
+	})
+	return
+}
+
+// UpdateRegisteredHost replaces a registered host and returns what it replaced. Returns
+// ErrNotFound if the host isn't registered.
+func (db *DB) UpdateRegisteredHost(ctx context.Context, host *types.RegisteredHost) (previous *types.RegisteredHost, err error) {
+	_, span, done := db.observe(ctx, "UpdateRegisteredHost")
+	defer func() { done(err) }()
+
+	if err = validateRegisteredHost(host); err != nil {
+		err = fmt.Errorf("invalid registered host: %w", err)
+		return
+	}
+
+	span.SetAttributes(attribute.String("hostname", host.Hostname))
+
+	previous, err = transaction(db.db, func(tx fdb.Transaction) (*types.RegisteredHost, error) {
+		existing, err := db.getRegisteredHostTx(tx, host.Hostname)
+		if err != nil {
+			return nil, err
+		}
+		if existing == nil {
+			return nil, ErrNotFound
+		}
+
+		return existing, db.saveRegisteredHostTx(tx, host)
+	})
+	return
+}
+
+// GetRegisteredHost returns a registered host, or ErrNotFound
+func (db *DB) GetRegisteredHost(ctx context.Context, hostname string) (host *types.RegisteredHost, err error) {
+	_, span, done := db.observe(ctx, "GetRegisteredHost")
+	defer func() { done(err) }()
+
+	span.SetAttributes(attribute.String("hostname", hostname))
+
+	host, err = readTransaction(db.db, func(tx fdb.ReadTransaction) (*types.RegisteredHost, error) {
+		return db.getRegisteredHostTx(tx, hostname)
+	})
+	if err == nil && host == nil {
+		err = ErrNotFound
+	}
+	return
+}
+
+// ListRegisteredHosts returns every registered host, including disabled ones, ordered by hostname
+func (db *DB) ListRegisteredHosts(ctx context.Context) (hosts []*types.RegisteredHost, err error) {
+	_, span, done := db.observe(ctx, "ListRegisteredHosts")
+	defer func() { done(err) }()
+
+	type result struct {
+		hosts []*types.RegisteredHost
+	}
+
+	res, err := readTransaction(db.db, func(tx fdb.ReadTransaction) (*result, error) {
+		kvs, err := tx.GetRange(db.hostRegistry.hosts, fdb.RangeOptions{}).GetSliceWithError()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list registered hosts: %w", err)
+		}
+
+		res := &result{hosts: make([]*types.RegisteredHost, 0, len(kvs))}
+		for _, kv := range kvs {
+			var host types.RegisteredHost
+			if err := proto.Unmarshal(kv.Value, &host); err != nil {
+				return nil, fmt.Errorf("failed to protobuf unmarshal registered host: %w", err)
+			}
+			res.hosts = append(res.hosts, &host)
+		}
+
+		return res, nil
+	})
+	if err != nil {
+		return
+	}
+
+	hosts = res.hosts
+	span.SetAttributes(attribute.Int("num_hosts", len(hosts)))
+	return
+}
+
+// WatchRegisteredHosts returns a future that will be ready when the registry next changes, or that
+// fails if the watch can't be kept
+func (db *DB) WatchRegisteredHosts(ctx context.Context) (fdb.FutureNil, error) {
+	var watch fdb.FutureNil
+
+	_, err := db.db.Transact(func(tx fdb.Transaction) (any, error) {
+		watch = tx.Watch(pack(db.hostRegistry.version, hostRegistryVersionKey))
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return watch, nil
+}
@@ -0,0 +1,83 @@
+package db
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/jcalabro/atlas/internal/types"
+	"github.com/jcalabro/atlas/internal/util"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func testRegisteredHost(hostname string) *types.RegisteredHost {
+	return &types.RegisteredHost{
+		Hostname:      hostname,
+		Config:        "service_did = \"did:web:" + hostname + "\"\n",
+		JwtSigningKey: &types.WrappedKey{Ciphertext: []byte("sealed")},
+		CreatedAt:     timestamppb.Now(),
+		UpdatedAt:     timestamppb.Now(),
+	}
+}
+
+func TestValidateRegisteredHost(t *testing.T) {
+	t.Parallel()
+
+	require.NoError(t, validateRegisteredHost(testRegisteredHost("pds.example.com")))
+	require.Error(t, validateRegisteredHost(nil))
+
+	for _, mutate := range []func(*types.RegisteredHost){
+		func(h *types.RegisteredHost) { h.Hostname = "" },
+		func(h *types.RegisteredHost) { h.Config = "" },
+		func(h *types.RegisteredHost) { h.JwtSigningKey = nil },
+		func(h *types.RegisteredHost) { h.CreatedAt = nil },
+		func(h *types.RegisteredHost) { h.UpdatedAt = nil },
+	} {
+		host := testRegisteredHost("pds.example.com")
+		mutate(host)
+		require.Error(t, validateRegisteredHost(host))
+	}
+}
+
+func TestRegisteredHosts(t *testing.T) {
+	t.Parallel()
+
+	db := testDB(t)
+	ctx := t.Context()
+
+	hostname := strings.ToLower(util.RandString(12)) + ".example.com"
+	host := testRegisteredHost(hostname)
+
+	_, err := db.GetRegisteredHost(ctx, hostname)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	_, err = db.UpdateRegisteredHost(ctx, host)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	watch, err := db.WatchRegisteredHosts(ctx)
+	require.NoError(t, err)
+
+	require.NoError(t, db.CreateRegisteredHost(ctx, host))
+	require.ErrorIs(t, db.CreateRegisteredHost(ctx, host), ErrHostExists)
+
+	// every change fires the watch
+	require.NoError(t, watch.Get())
+
+	got, err := db.GetRegisteredHost(ctx, hostname)
+	require.NoError(t, err)
+	require.Equal(t, host.Config, got.Config)
+	require.False(t, got.Disabled)
+
+	updated := testRegisteredHost(hostname)
+	updated.Disabled = true
+	previous, err := db.UpdateRegisteredHost(ctx, updated)
+	require.NoError(t, err)
+	require.False(t, previous.Disabled)
+
+	hosts, err := db.ListRegisteredHosts(ctx)
+	require.NoError(t, err)
+	idx := slices.IndexFunc(hosts, func(h *types.RegisteredHost) bool { return h.Hostname == hostname })
+	require.NotEqual(t, -1, idx)
+	require.True(t, hosts[idx].Disabled)
+}
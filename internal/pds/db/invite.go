@@ -0,0 +1,285 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/jcalabro/atlas/internal/types"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var (
+	// ErrInviteCodeUnavailable is returned when an invite code doesn't exist, belongs to another
+	// host, is disabled, or has no uses left
+	ErrInviteCodeUnavailable = errors.New("invite code not available")
+
+	// ErrInviteCodeExists is returned when creating an invite code that already exists
+	ErrInviteCodeExists = errors.New("invite code already exists")
+)
+
+// InviteCodeUsable returns true if the code can be used to sign up on the given host
+func InviteCodeUsable(code *types.InviteCode, host string) bool {
+	return code != nil &&
+		code.PdsHost == host &&
+		!code.Disabled &&
+		int64(len(code.Uses)) < code.Available
+}
+
+func validateInviteCode(code *types.InviteCode) error {
+	switch {
+	case code == nil:
+		return fmt.Errorf("invite code is nil")
+	case code.Code == "":
+		return fmt.Errorf("code is required")
+	case code.PdsHost == "":
+		return fmt.Errorf("pds host is required")
+	case code.ForAccount == "":
+		return fmt.Errorf("for account is required")
+	case code.Available <= 0:
+		return fmt.Errorf("available must be positive")
+	}
+
+	return nil
+}
+
+func (db *DB) getInviteCodeTx(tx fdb.ReadTransaction, code string) (*types.InviteCode, error) {
+	buf, err := tx.Get(pack(db.invites.codes, code)).Get()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get invite code: %w", err)
+	}
+	if len(buf) == 0 {
+		return nil, nil
+	}
+
+	var invite types.InviteCode
+	if err := proto.Unmarshal(buf, &invite); err != nil {
+		return nil, fmt.Errorf("failed to protobuf unmarshal invite code: %w", err)
+	}
+
+	return &invite, nil
+}
+
+func (db *DB) saveInviteCodeTx(tx fdb.Transaction, invite *types.InviteCode) error {
+	buf, err := proto.Marshal(invite)
+	if err != nil {
+		return fmt.Errorf("failed to protobuf marshal invite code: %w", err)
+	}
+
+	tx.Set(pack(db.invites.codes, invite.Code), buf)
+	tx.Set(pack(db.invites.byAccount, invite.PdsHost, invite.ForAccount, invite.Code), nil)
+
+	return nil
+}
+
+func (db *DB) createInviteCodesTx(tx fdb.Transaction, codes []*types.InviteCode) error {
+	for _, invite := range codes {
+		if err := validateInviteCode(invite); err != nil {
+			return fmt.Errorf("invalid invite code: %w", err)
+		}
+
+		existing, err := db.getInviteCodeTx(tx, invite.Code)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			return fmt.Errorf("%w: %q", ErrInviteCodeExists, invite.Code)
+		}
+
+		if err := db.saveInviteCodeTx(tx, invite); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (db *DB) listAccountInviteCodesTx(tx fdb.ReadTransaction, host, account string) ([]*types.InviteCode, error) {
+	kr, err := fdb.PrefixRange(pack(db.invites.byAccount, host, account))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create invite codes range: %w", err)
+	}
+
+	kvs, err := tx.GetRange(kr, fdb.RangeOptions{}).GetSliceWithError()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list invite codes: %w", err)
+	}
+
+	codes := make([]*types.InviteCode, 0, len(kvs))
+	for _, kv := range kvs {
+		tup, err := db.invites.byAccount.Unpack(kv.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unpack invite code key: %w", err)
+		}
+		if len(tup) < 3 {
+			continue
+		}
+		code, ok := tup[2].(string)
+		if !ok {
+			continue
+		}
+
+		invite, err := db.getInviteCodeTx(tx, code)
+		if err != nil {
+			return nil, err
+		}
+		if invite != nil {
+			codes = append(codes, invite)
+		}
+	}
+
+	return codes, nil
+}
+
+// disableAccountInviteCodesTx disables every invite code issued to the account
+func (db *DB) disableAccountInviteCodesTx(tx fdb.Transaction, host, account string) error {
+	codes, err := db.listAccountInviteCodesTx(tx, host, account)
+	if err != nil {
+		return err
+	}
+
+	for _, invite := range codes {
+		if invite.Disabled {
+			continue
+		}
+		invite.Disabled = true
+		if err := db.saveInviteCodeTx(tx, invite); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CreateInviteCodes stores newly issued invite codes. Fails with ErrInviteCodeExists if any of the
+// codes already exist, in which case none are created.
+func (db *DB) CreateInviteCodes(ctx context.Context, codes []*types.InviteCode) (err error) {
+	_, span, done := db.observe(ctx, "CreateInviteCodes")
+	defer func() { done(err) }()
+
+	span.SetAttributes(attribute.Int("count", len(codes)))
+
+	_, err = transaction(db.db, func(tx fdb.Transaction) (any, error) {
+		return nil, db.createInviteCodesTx(tx, codes)
+	})
+
+	return
+}
+
+// GetInviteCode returns the invite code with the given code
+func (db *DB) GetInviteCode(ctx context.Context, code string) (invite *types.InviteCode, err error) {
+	_, _, done := db.observe(ctx, "GetInviteCode")
+	defer func() { done(err) }()
+
+	invite = &types.InviteCode{}
+	err = readProto(db.db, invite, func(tx fdb.ReadTransaction) ([]byte, error) {
+		return tx.Get(pack(db.invites.codes, code)).Get()
+	})
+	if err != nil {
+		invite = nil
+	}
+
+	return
+}
+
+// ListAccountInviteCodes returns the invite codes that were issued to the given account on the host
+func (db *DB) ListAccountInviteCodes(ctx context.Context, host, account string) (codes []*types.InviteCode, err error) {
+	_, span, done := db.observe(ctx, "ListAccountInviteCodes")
+	defer func() { done(err) }()
+
+	span.SetAttributes(
+		attribute.String("host", host),
+		attribute.String("account", account),
+	)
+
+	codes, err = readTransaction(db.db, func(tx fdb.ReadTransaction) ([]*types.InviteCode, error) {
+		return db.listAccountInviteCodesTx(tx, host, account)
+	})
+
+	return
+}
+
+// EnsureAccountInviteCodes tops up the invite codes an account has issued to itself to the given
+// allotment, generating new single-use codes with newCode. Returns every code issued to the account.
+func (db *DB) EnsureAccountInviteCodes(
+	ctx context.Context,
+	host, did string,
+	allotment int,
+	newCode func() string,
+) (codes []*types.InviteCode, err error) {
+	_, span, done := db.observe(ctx, "EnsureAccountInviteCodes")
+	defer func() { done(err) }()
+
+	span.SetAttributes(
+		attribute.String("did", did),
+		attribute.Int("allotment", allotment),
+	)
+
+	codes, err = transaction(db.db, func(tx fdb.Transaction) ([]*types.InviteCode, error) {
+		codes, err := db.listAccountInviteCodesTx(tx, host, did)
+		if err != nil {
+			return nil, err
+		}
+
+		var issued int
+		for _, invite := range codes {
+			if invite.CreatedBy == did {
+				issued++
+			}
+		}
+
+		created := make([]*types.InviteCode, 0, max(allotment-issued, 0))
+		for range allotment - issued {
+			created = append(created, &types.InviteCode{
+				Code:       newCode(),
+				PdsHost:    host,
+				Available:  1,
+				ForAccount: did,
+				CreatedBy:  did,
+				CreatedAt:  timestamppb.Now(),
+			})
+		}
+		if err := db.createInviteCodesTx(tx, created); err != nil {
+			return nil, err
+		}
+
+		return append(codes, created...), nil
+	})
+
+	return
+}
+
+// UseInviteCode records that the given account signed up with the invite code. Fails with
+// ErrInviteCodeUnavailable if the code can't be used on the host.
+func (db *DB) UseInviteCode(ctx context.Context, host, code, did string) (err error) {
+	_, span, done := db.observe(ctx, "UseInviteCode")
+	defer func() { done(err) }()
+
+	span.SetAttributes(attribute.String("did", did))
+
+	_, err = transaction(db.db, func(tx fdb.Transaction) (any, error) {
+		return nil, db.useInviteCodeTx(tx, host, code, did)
+	})
+
+	return
+}
+
+func (db *DB) useInviteCodeTx(tx fdb.Transaction, host, code, did string) error {
+	invite, err := db.getInviteCodeTx(tx, code)
+	if err != nil {
+		return err
+	}
+	if !InviteCodeUsable(invite, host) {
+		return ErrInviteCodeUnavailable
+	}
+
+	invite.Uses = append(invite.Uses, &types.InviteCodeUse{
+		UsedBy: did,
+		UsedAt: timestamppb.Now(),
+	})
+
+	return db.saveInviteCodeTx(tx, invite)
+}
@@ -0,0 +1,123 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jcalabro/atlas/internal/types"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestInviteCodes(t *testing.T) {
+	t.Parallel()
+	db := testDB(t)
+
+	newCode := func(host, account string, available int64) *types.InviteCode {
+		return &types.InviteCode{
+			Code:       uuid.NewString(),
+			PdsHost:    host,
+			Available:  available,
+			ForAccount: account,
+			CreatedBy:  "admin",
+			CreatedAt:  timestamppb.Now(),
+		}
+	}
+
+	t.Run("uses codes up", func(t *testing.T) {
+		t.Parallel()
+		ctx := t.Context()
+
+		invite := newCode("invites1.example.com", "admin", 2)
+		require.NoError(t, db.CreateInviteCodes(ctx, []*types.InviteCode{invite}))
+		require.ErrorIs(t, db.CreateInviteCodes(ctx, []*types.InviteCode{invite}), ErrInviteCodeExists)
+
+		// codes can't be used on other hosts
+		require.ErrorIs(t, db.UseInviteCode(ctx, "other.example.com", invite.Code, "did:plc:invitee0"), ErrInviteCodeUnavailable)
+
+		require.NoError(t, db.UseInviteCode(ctx, invite.PdsHost, invite.Code, "did:plc:invitee1"))
+		require.NoError(t, db.UseInviteCode(ctx, invite.PdsHost, invite.Code, "did:plc:invitee2"))
+		require.ErrorIs(t, db.UseInviteCode(ctx, invite.PdsHost, invite.Code, "did:plc:invitee3"), ErrInviteCodeUnavailable)
+
+		got, err := db.GetInviteCode(ctx, invite.Code)
+		require.NoError(t, err)
+		require.Len(t, got.Uses, 2)
+		require.Equal(t, "did:plc:invitee1", got.Uses[0].UsedBy)
+		require.False(t, InviteCodeUsable(got, invite.PdsHost))
+
+		require.ErrorIs(t, db.UseInviteCode(ctx, invite.PdsHost, uuid.NewString(), "did:plc:invitee4"), ErrInviteCodeUnavailable)
+	})
+
+	t.Run("creating an actor uses its code", func(t *testing.T) {
+		t.Parallel()
+		ctx := t.Context()
+
+		invite := newCode(testPDSHost, "admin", 1)
+		require.NoError(t, db.CreateInviteCodes(ctx, []*types.InviteCode{invite}))
+
+		newActor := func() *types.Actor {
+			id := uuid.NewString()
+			return &types.Actor{
+				Did:          "did:plc:" + id,
+				Email:        id + "@example.com",
+				Handle:       id + ".dev.atlaspds.net",
+				PdsHost:      testPDSHost,
+				CreatedAt:    timestamppb.Now(),
+				PasswordHash: []byte("hash"),
+				SigningKey:   []byte("key"),
+				RotationKeys: [][]byte{[]byte("rotation")},
+				Active:       true,
+				InviteCode:   invite.Code,
+			}
+		}
+
+		first := newActor()
+		require.NoError(t, db.CreateActor(ctx, first))
+
+		got, err := db.GetInviteCode(ctx, invite.Code)
+		require.NoError(t, err)
+		require.Len(t, got.Uses, 1)
+		require.Equal(t, first.Did, got.Uses[0].UsedBy)
+
+		// the actor isn't saved if its code is used up
+		second := newActor()
+		require.ErrorIs(t, db.CreateActor(ctx, second), ErrInviteCodeUnavailable)
+		_, err = db.GetActorByDID(ctx, second.Did)
+		require.ErrorIs(t, err, ErrNotFound)
+
+		// actors without a code don't need one
+		third := newActor()
+		third.InviteCode = ""
+		require.NoError(t, db.CreateActor(ctx, third))
+	})
+
+	t.Run("tops up account allotments", func(t *testing.T) {
+		t.Parallel()
+		ctx := t.Context()
+
+		host, did := "invites2.example.com", "did:plc:"+uuid.NewString()
+		require.NoError(t, db.CreateInviteCodes(ctx, []*types.InviteCode{newCode(host, did, 5)}))
+
+		codes, err := db.EnsureAccountInviteCodes(ctx, host, did, 3, uuid.NewString)
+		require.NoError(t, err)
+		require.Len(t, codes, 4)
+
+		again, err := db.EnsureAccountInviteCodes(ctx, host, did, 3, uuid.NewString)
+		require.NoError(t, err)
+		require.Len(t, again, 4)
+
+		listed, err := db.ListAccountInviteCodes(ctx, host, did)
+		require.NoError(t, err)
+		require.Len(t, listed, 4)
+
+		other, err := db.ListAccountInviteCodes(ctx, "other.example.com", did)
+		require.NoError(t, err)
+		require.Empty(t, other)
+	})
+
+	t.Run("validates codes", func(t *testing.T) {
+		t.Parallel()
+
+		require.Error(t, db.CreateInviteCodes(t.Context(), []*types.InviteCode{newCode("invites3.example.com", "admin", 0)}))
+	})
+}
@@ -0,0 +1,261 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/jcalabro/atlas/internal/types"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/protobuf/proto"
+)
+
+// KeyOpener decrypts actor private keys that were envelope encrypted with a host's
+// key-encryption key
+type KeyOpener interface {
+	OpenKey(ctx context.Context, host string, key *types.WrappedKey) ([]byte, error)
+}
+
+// SetKeyOpener configures how encrypted actor keys are decrypted. Must be called before the
+// database is used to write to repos with encrypted keys.
+func (db *DB) SetKeyOpener(keys KeyOpener) {
+	db.keys = keys
+}
+
+// openKey returns the plaintext of one of an actor's private keys, which is wrapped unless it was
+// stored before encryption was enabled for the actor's host. The returned bytes should be cleared
+// once parsed.
+func (db *DB) openKey(ctx context.Context, host string, wrapped *types.WrappedKey, plain []byte) ([]byte, error) {
+	if wrapped == nil {
+		if len(plain) == 0 {
+			return nil, fmt.Errorf("key is missing")
+		}
+		return slices.Clone(plain), nil
+	}
+
+	if db.keys == nil {
+		return nil, fmt.Errorf("key is encrypted but no key opener is configured")
+	}
+
+	return db.keys.OpenKey(ctx, host, wrapped)
+}
+
+func (db *DB) parseKey(ctx context.Context, host string, wrapped *types.WrappedKey, plain []byte) (*atcrypto.PrivateKeyK256, error) {
+	raw, err := db.openKey(ctx, host, wrapped, plain)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(raw)
+
+	return atcrypto.ParsePrivateBytesK256(raw)
+}
+
+// SigningKey returns the actor's repo signing key, decrypting it if necessary.
+//
+// Opening a key may call out to a KMS, so it must never be called inside an FDB transaction.
+// Repo writes, rebases, and key rotations load the key before starting their transaction so that a
+// slow KMS doesn't count against FDB's transaction time limit. That's safe because a concurrent key
+// rotation also moves the repo head, which the write detects within its transaction.
+func (db *DB) SigningKey(ctx context.Context, actor *types.Actor) (*atcrypto.PrivateKeyK256, error) {
+	key, err := db.parseKey(ctx, actor.PdsHost, actor.WrappedSigningKey, actor.SigningKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load signing key: %w", err)
+	}
+	return key, nil
+}
+
+// PendingSigningKey returns the replacement signing key of an in-progress key rotation, decrypting
+// it if necessary
+func (db *DB) PendingSigningKey(ctx context.Context, actor *types.Actor) (*atcrypto.PrivateKeyK256, error) {
+	key, err := db.parseKey(ctx, actor.PdsHost, actor.WrappedPendingSigningKey, actor.PendingSigningKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load pending signing key: %w", err)
+	}
+	return key, nil
+}
+
+// RetiredSigningKeys returns the public keys of the actor's retired signing keys whose grace window
+// hasn't passed, decrypting them if necessary
+func (db *DB) RetiredSigningKeys(ctx context.Context, actor *types.Actor) ([]atcrypto.PublicKey, error) {
+	now := time.Now()
+
+	var pubkeys []atcrypto.PublicKey
+	for _, retired := range actor.RetiredSigningKeys {
+		if !retired.ExpiresAt.AsTime().After(now) {
+			continue
+		}
+
+		key, err := db.parseKey(ctx, actor.PdsHost, retired.WrappedKey, retired.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load retired signing key: %w", err)
+		}
+		pubkey, err := key.PublicKey()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get retired signing public key: %w", err)
+		}
+		pubkeys = append(pubkeys, pubkey)
+	}
+
+	return pubkeys, nil
+}
+
+// RotationKey returns the actor's primary PLC rotation key, decrypting it if necessary
+func (db *DB) RotationKey(ctx context.Context, actor *types.Actor) (*atcrypto.PrivateKeyK256, error) {
+	var wrapped *types.WrappedKey
+	var plain []byte
+	switch {
+	case len(actor.WrappedRotationKeys) > 0:
+		wrapped = actor.WrappedRotationKeys[0]
+	case len(actor.RotationKeys) > 0:
+		plain = actor.RotationKeys[0]
+	default:
+		return nil, fmt.Errorf("actor has no rotation keys")
+	}
+
+	key, err := db.parseKey(ctx, actor.PdsHost, wrapped, plain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load rotation key: %w", err)
+	}
+	return key, nil
+}
+
+// KeyWrapper converts an actor's private keys to the host's current encryption. It's given
+// either the existing wrapped key, or the plaintext of a key stored before encryption was enabled,
+// and returns the key wrapped with the current key-encryption key.
+type KeyWrapper func(ctx context.Context, wrapped *types.WrappedKey, plain []byte) (*types.WrappedKey, error)
+
+// RewrapKeys re-encrypts all of an actor's private keys with wrap, which is how keys are moved to
+// a new key-encryption key and how plaintext keys are encrypted. Returns whether anything changed.
+//
+// wrap is called outside of any transaction so that it may call out to a remote KMS. If the
+// actor's keys change in the meantime, such as by a concurrent key rotation, the rewrap is retried.
+func (db *DB) RewrapKeys(ctx context.Context, did string, wrap KeyWrapper) (changed bool, err error) {
+	_, span, done := db.observe(ctx, "RewrapKeys")
+	defer func() { done(err) }()
+
+	span.SetAttributes(attribute.String("did", did))
+	defer func() { span.SetAttributes(attribute.Bool("changed", changed)) }()
+
+	if _, err = syntax.ParseDID(did); err != nil {
+		err = fmt.Errorf("invalid did: %w", err)
+		return
+	}
+
+	for attempt := 1; ; attempt++ {
+		changed, err = db.rewrapKeys(ctx, did, wrap)
+		if !errors.Is(err, ErrConcurrentModification) || attempt == repairMaxAttempts {
+			return
+		}
+	}
+}
+
+func (db *DB) rewrapKeys(ctx context.Context, did string, wrap KeyWrapper) (bool, error) {
+	actor, err := db.GetActorByDID(ctx, did)
+	if err != nil {
+		return false, err
+	}
+	original := actorKeys(actor)
+
+	rewrapped := proto.Clone(original).(*types.Actor)
+	if err := rewrapActorKeys(ctx, rewrapped, wrap); err != nil {
+		return false, err
+	}
+	if proto.Equal(original, rewrapped) {
+		return false, nil
+	}
+
+	_, err = transaction(db.db, func(tx fdb.Transaction) (any, error) {
+		existing, err := db.getActorByDIDTx(tx, did)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get actor: %w", err)
+		}
+		if existing == nil {
+			return nil, ErrNotFound
+		}
+		if !proto.Equal(actorKeys(existing), original) {
+			return nil, ErrConcurrentModification
+		}
+
+		existing.SigningKey = rewrapped.SigningKey
+		existing.WrappedSigningKey = rewrapped.WrappedSigningKey
+		existing.RotationKeys = rewrapped.RotationKeys
+		existing.WrappedRotationKeys = rewrapped.WrappedRotationKeys
+		existing.PendingSigningKey = rewrapped.PendingSigningKey
+		existing.WrappedPendingSigningKey = rewrapped.WrappedPendingSigningKey
+		existing.RetiredSigningKeys = rewrapped.RetiredSigningKeys
+
+		return nil, db.saveActorTx(tx, existing)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// actorKeys returns a copy of the actor with only its private key fields set
+func actorKeys(actor *types.Actor) *types.Actor {
+	keys := &types.Actor{
+		SigningKey:               actor.SigningKey,
+		WrappedSigningKey:        actor.WrappedSigningKey,
+		RotationKeys:             actor.RotationKeys,
+		WrappedRotationKeys:      actor.WrappedRotationKeys,
+		PendingSigningKey:        actor.PendingSigningKey,
+		WrappedPendingSigningKey: actor.WrappedPendingSigningKey,
+		RetiredSigningKeys:       actor.RetiredSigningKeys,
+	}
+	return proto.Clone(keys).(*types.Actor)
+}
+
+// rewrapActorKeys replaces each of the actor's keys with the result of wrap, clearing plaintext
+func rewrapActorKeys(ctx context.Context, actor *types.Actor, wrap KeyWrapper) error {
+	rewrap := func(wrapped *types.WrappedKey, plain []byte) (*types.WrappedKey, error) {
+		if wrapped == nil && len(plain) == 0 {
+			return nil, nil
+		}
+		return wrap(ctx, wrapped, plain)
+	}
+
+	var err error
+	if actor.WrappedSigningKey, err = rewrap(actor.WrappedSigningKey, actor.SigningKey); err != nil {
+		return fmt.Errorf("failed to rewrap signing key: %w", err)
+	}
+	actor.SigningKey = nil
+
+	if actor.WrappedPendingSigningKey, err = rewrap(actor.WrappedPendingSigningKey, actor.PendingSigningKey); err != nil {
+		return fmt.Errorf("failed to rewrap pending signing key: %w", err)
+	}
+	actor.PendingSigningKey = nil
+
+	rotation := make([]*types.WrappedKey, 0, len(actor.WrappedRotationKeys)+len(actor.RotationKeys))
+	for _, key := range actor.WrappedRotationKeys {
+		wrapped, err := rewrap(key, nil)
+		if err != nil {
+			return fmt.Errorf("failed to rewrap rotation key: %w", err)
+		}
+		rotation = append(rotation, wrapped)
+	}
+	for _, key := range actor.RotationKeys {
+		wrapped, err := rewrap(nil, key)
+		if err != nil {
+			return fmt.Errorf("failed to rewrap rotation key: %w", err)
+		}
+		rotation = append(rotation, wrapped)
+	}
+	actor.WrappedRotationKeys = rotation
+	actor.RotationKeys = nil
+
+	for _, retired := range actor.RetiredSigningKeys {
+		if retired.WrappedKey, err = rewrap(retired.WrappedKey, retired.Key); err != nil {
+			return fmt.Errorf("failed to rewrap retired signing key: %w", err)
+		}
+		retired.Key = nil
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/jcalabro/atlas/internal/at"
+	"github.com/jcalabro/atlas/internal/envelope"
+	"github.com/jcalabro/atlas/internal/types"
+	"github.com/stretchr/testify/require"
+)
+
+type keyringOpener struct {
+	keyring *envelope.Keyring
+}
+
+func (o *keyringOpener) OpenKey(ctx context.Context, _ string, key *types.WrappedKey) ([]byte, error) {
+	return o.keyring.Open(ctx, key)
+}
+
+func TestRewrapKeys(t *testing.T) {
+	t.Parallel()
+
+	newKMS := func(t *testing.T) *envelope.LocalKMS {
+		t.Helper()
+		kek := make([]byte, 32)
+		_, err := rand.Read(kek)
+		require.NoError(t, err)
+		kms, err := envelope.NewLocalKMS(kek)
+		require.NoError(t, err)
+		return kms
+	}
+
+	wrapper := func(keyring *envelope.Keyring) KeyWrapper {
+		return func(ctx context.Context, wrapped *types.WrappedKey, plain []byte) (*types.WrappedKey, error) {
+			if wrapped != nil {
+				return keyring.Rewrap(ctx, wrapped)
+			}
+			return keyring.Seal(ctx, plain)
+		}
+	}
+
+	oldKMS, newKMS2 := newKMS(t), newKMS(t)
+	opener := &keyringOpener{keyring: envelope.NewKeyring(oldKMS)}
+
+	// a copy of the shared test db that can decrypt keys with this test's keyring
+	db := *testDB(t)
+	db.SetKeyOpener(opener)
+
+	ctx := t.Context()
+	did := "did:plc:rewrapkeys1"
+	original := testRepoActor(t, &db, did)
+
+	rotationKey, err := atcrypto.GeneratePrivateKeyK256()
+	require.NoError(t, err)
+	original.RotationKeys = [][]byte{rotationKey.Bytes()}
+	require.NoError(t, db.SaveActor(ctx, original))
+
+	// encrypts plaintext keys
+	changed, err := db.RewrapKeys(ctx, did, wrapper(opener.keyring))
+	require.NoError(t, err)
+	require.True(t, changed)
+
+	actor, err := db.GetActorByDID(ctx, did)
+	require.NoError(t, err)
+	require.Empty(t, actor.SigningKey)
+	require.Empty(t, actor.RotationKeys)
+	require.Equal(t, oldKMS.KeyID(), actor.WrappedSigningKey.KekId)
+	require.Len(t, actor.WrappedRotationKeys, 1)
+
+	signingKey, err := db.SigningKey(ctx, actor)
+	require.NoError(t, err)
+	require.Equal(t, original.SigningKey, signingKey.Bytes())
+
+	loadedRotationKey, err := db.RotationKey(ctx, actor)
+	require.NoError(t, err)
+	require.Equal(t, rotationKey.Bytes(), loadedRotationKey.Bytes())
+
+	// writes are signed with the decrypted key
+	putTestRecord(t, &db, did, "3kaaaaaaaaaa2", "one")
+	check, err := db.CheckRepo(ctx, did, FsckOptions{})
+	require.NoError(t, err)
+	require.True(t, check.OK(), "issues: %+v", check.Issues)
+
+	// nothing to do when everything is wrapped with the current kek
+	changed, err = db.RewrapKeys(ctx, did, wrapper(opener.keyring))
+	require.NoError(t, err)
+	require.False(t, changed)
+
+	// moves keys to a rotated kek, even while a write is in flight
+	stale, err := db.GetActorByDID(ctx, did)
+	require.NoError(t, err)
+
+	opener.keyring = envelope.NewKeyring(newKMS2, oldKMS)
+	changed, err = db.RewrapKeys(ctx, did, wrapper(opener.keyring))
+	require.NoError(t, err)
+	require.True(t, changed)
+
+	_, err = db.DeleteRecord(ctx, stale, &at.URI{Repo: did, Collection: "app.bsky.feed.post", Rkey: "3kaaaaaaaaaa2"}, nil)
+	require.NoError(t, err)
+
+	// the write didn't restore the keys from before the rewrap
+	actor, err = db.GetActorByDID(ctx, did)
+	require.NoError(t, err)
+	require.NotEqual(t, stale.Head, actor.Head)
+	require.Equal(t, newKMS2.KeyID(), actor.WrappedSigningKey.KekId)
+	require.Equal(t, newKMS2.KeyID(), actor.WrappedRotationKeys[0].KekId)
+
+	// the previous kek is no longer needed
+	opener.keyring = envelope.NewKeyring(newKMS2)
+	signingKey, err = db.SigningKey(ctx, actor)
+	require.NoError(t, err)
+	require.Equal(t, original.SigningKey, signingKey.Bytes())
+
+	_, err = db.RewrapKeys(ctx, "did:plc:rewrapkeysnotfound", wrapper(opener.keyring))
+	require.ErrorIs(t, err, ErrNotFound)
+}
@@ -0,0 +1,506 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/directory"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/bluesky-social/indigo/atproto/atdata"
+	"github.com/jcalabro/atlas/internal/at"
+	"github.com/jcalabro/atlas/internal/types"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrInvalidLabelCursor is returned when a QueryLabels cursor can't be decoded
+var ErrInvalidLabelCursor = errors.New("invalid label cursor")
+
+// labelVersion is the version of the label format that's issued and accepted
+const labelVersion = 1
+
+// selfLabelsType is the $type of the labels a record declares about itself
+const selfLabelsType = "com.atproto.label.defs#selfLabels"
+
+// selfLabels returns the self-labels declared in a record's "labels" field. Records that can't
+// be decoded have no self-labels.
+func selfLabels(record *types.Record) []*types.Label {
+	val, err := atdata.UnmarshalCBOR(record.Value)
+	if err != nil {
+		return nil
+	}
+
+	field, ok := val["labels"].(map[string]any)
+	if !ok || field["$type"] != selfLabelsType {
+		return nil
+	}
+	values, ok := field["values"].([]any)
+	if !ok {
+		return nil
+	}
+
+	uri := (&at.URI{Repo: record.Did, Collection: record.Collection, Rkey: record.Rkey}).String()
+	cts := record.GetCreatedAt().AsTime().UTC().Format(time.RFC3339Nano)
+
+	labels := make([]*types.Label, 0, len(values))
+	for _, v := range values {
+		entry, ok := v.(map[string]any)
+		if !ok {
+			continue
+		}
+		name, ok := entry["val"].(string)
+		if !ok || name == "" {
+			continue
+		}
+
+		labels = append(labels, &types.Label{
+			Src: record.Did,
+			Uri: uri,
+			Cid: record.Cid,
+			Val: name,
+			Cts: cts,
+			Ver: labelVersion,
+		})
+	}
+
+	return labels
+}
+
+// saveSelfLabelsTx replaces the self-label index entries of the record
+func (db *DB) saveSelfLabelsTx(tx fdb.Transaction, record *types.Record) error {
+	uri := &at.URI{Repo: record.Did, Collection: record.Collection, Rkey: record.Rkey}
+	if err := db.clearSelfLabelsTx(tx, uri); err != nil {
+		return err
+	}
+
+	for _, label := range selfLabels(record) {
+		if err := db.applyLabelTx(tx, label); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// clearSelfLabelsTx removes the self-label index entries of the record at uri
+func (db *DB) clearSelfLabelsTx(tx fdb.Transaction, uri *at.URI) error {
+	kr, err := fdb.PrefixRange(pack(db.labels.labels, uri.String(), uri.Repo))
+	if err != nil {
+		return fmt.Errorf("failed to create self-labels range: %w", err)
+	}
+
+	tx.ClearRange(kr)
+	return nil
+}
+
+// applyLabelTx adds a label to the index, or removes the label it negates
+func (db *DB) applyLabelTx(tx fdb.Transaction, label *types.Label) error {
+	key := pack(db.labels.labels, label.Uri, label.Src, label.Val)
+	if label.Neg {
+		tx.Clear(key)
+		return nil
+	}
+
+	buf, err := proto.Marshal(label)
+	if err != nil {
+		return fmt.Errorf("failed to protobuf marshal label: %w", err)
+	}
+
+	tx.Set(key, buf)
+	return nil
+}
+
+func validateLabel(label *types.Label) error {
+	switch {
+	case label == nil:
+		return fmt.Errorf("label is nil")
+	case label.Src == "":
+		return fmt.Errorf("src is required")
+	case label.Uri == "":
+		return fmt.Errorf("uri is required")
+	case label.Val == "":
+		return fmt.Errorf("val is required")
+	case label.Cts == "":
+		return fmt.Errorf("cts is required")
+	}
+
+	return nil
+}
+
+// EmitLabel issues a label from one of this PDS's labelers, assigning it the labeler's next seq
+func (db *DB) EmitLabel(ctx context.Context, label *types.Label) (err error) {
+	_, span, done := db.observe(ctx, "EmitLabel")
+	defer func() { done(err) }()
+
+	if err = validateLabel(label); err != nil {
+		err = fmt.Errorf("invalid label: %w", err)
+		return
+	}
+
+	span.SetAttributes(
+		attribute.String("src", label.Src),
+		attribute.String("uri", label.Uri),
+		attribute.String("val", label.Val),
+		attribute.Bool("neg", label.Neg),
+	)
+
+	seq, err := transaction(db.db, func(tx fdb.Transaction) (int64, error) {
+		seq, err := db.latestLabelSeqTx(tx, label.Src)
+		if err != nil {
+			return 0, err
+		}
+		seq++
+
+		stored := proto.Clone(label).(*types.Label)
+		stored.Seq = seq
+
+		buf, err := proto.Marshal(stored)
+		if err != nil {
+			return 0, fmt.Errorf("failed to protobuf marshal label: %w", err)
+		}
+
+		tx.Set(pack(db.labels.lastSeqs, label.Src), binary.BigEndian.AppendUint64(nil, uint64(seq)))
+		tx.Set(pack(db.labels.log, label.Src, seq), buf)
+		return seq, db.applyLabelTx(tx, stored)
+	})
+	if err != nil {
+		return
+	}
+
+	label.Seq = seq
+	span.SetAttributes(attribute.Int64("seq", seq))
+	return
+}
+
+func (db *DB) latestLabelSeqTx(tx fdb.ReadTransaction, src string) (int64, error) {
+	val, err := tx.Get(pack(db.labels.lastSeqs, src)).Get()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get last label seq: %w", err)
+	}
+	if len(val) != 8 {
+		return 0, nil
+	}
+
+	return int64(binary.BigEndian.Uint64(val)), nil
+}
+
+// LatestLabelSeq returns the seq of the last label issued by src, or 0 if it hasn't issued any
+func (db *DB) LatestLabelSeq(ctx context.Context, src string) (seq int64, err error) {
+	_, span, done := db.observe(ctx, "LatestLabelSeq")
+	defer func() { done(err) }()
+
+	span.SetAttributes(attribute.String("src", src))
+
+	seq, err = readTransaction(db.db, func(tx fdb.ReadTransaction) (int64, error) {
+		return db.latestLabelSeqTx(tx, src)
+	})
+
+	return
+}
+
+// WatchLabelSeq returns a future that fires when src issues another label
+func (db *DB) WatchLabelSeq(ctx context.Context, src string) (fdb.FutureNil, error) {
+	var watch fdb.FutureNil
+
+	_, err := db.db.Transact(func(tx fdb.Transaction) (any, error) {
+		watch = tx.Watch(pack(db.labels.lastSeqs, src))
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return watch, nil
+}
+
+// GetLabelsSince returns up to limit labels issued by src after the given seq, in order
+func (db *DB) GetLabelsSince(ctx context.Context, src string, seq int64, limit int) (labels []*types.Label, err error) {
+	_, span, done := db.observe(ctx, "GetLabelsSince")
+	defer func() { done(err) }()
+
+	span.SetAttributes(
+		attribute.String("src", src),
+		attribute.Int64("seq", seq),
+		attribute.Int("limit", limit),
+	)
+
+	labels, err = readTransaction(db.db, func(tx fdb.ReadTransaction) ([]*types.Label, error) {
+		kr, err := fdb.PrefixRange(pack(db.labels.log, src))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create label log range: %w", err)
+		}
+		kr.Begin = pack(db.labels.log, src, seq+1)
+
+		kvs, err := tx.GetRange(kr, fdb.RangeOptions{Limit: limit}).GetSliceWithError()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get labels: %w", err)
+		}
+
+		out := make([]*types.Label, 0, len(kvs))
+		for _, kv := range kvs {
+			var label types.Label
+			if err := proto.Unmarshal(kv.Value, &label); err != nil {
+				return nil, fmt.Errorf("failed to protobuf unmarshal label: %w", err)
+			}
+			out = append(out, &label)
+		}
+
+		return out, nil
+	})
+
+	return
+}
+
+// SaveLabels stores a batch of labels consumed from a remote labeler's stream along with the
+// cursor to resume the stream from
+func (db *DB) SaveLabels(ctx context.Context, src string, labels []*types.Label, cursor int64) (err error) {
+	_, span, done := db.observe(ctx, "SaveLabels")
+	defer func() { done(err) }()
+
+	span.SetAttributes(
+		attribute.String("src", src),
+		attribute.Int("count", len(labels)),
+		attribute.Int64("cursor", cursor),
+	)
+
+	for _, label := range labels {
+		if err = validateLabel(label); err != nil {
+			err = fmt.Errorf("invalid label: %w", err)
+			return
+		}
+		if label.Src != src {
+			err = fmt.Errorf("label src %q does not match labeler %q", label.Src, src)
+			return
+		}
+	}
+
+	_, err = transaction(db.db, func(tx fdb.Transaction) (any, error) {
+		for _, label := range labels {
+			if err := db.applyLabelTx(tx, label); err != nil {
+				return nil, err
+			}
+		}
+
+		tx.Set(pack(db.labels.cursors, src), binary.BigEndian.AppendUint64(nil, uint64(cursor)))
+		return nil, nil
+	})
+
+	return
+}
+
+// LabelerCursor returns how far a remote labeler's stream has been consumed, or 0 if it hasn't been
+func (db *DB) LabelerCursor(ctx context.Context, src string) (cursor int64, err error) {
+	_, span, done := db.observe(ctx, "LabelerCursor")
+	defer func() { done(err) }()
+
+	span.SetAttributes(attribute.String("src", src))
+
+	cursor, err = readTransaction(db.db, func(tx fdb.ReadTransaction) (int64, error) {
+		val, err := tx.Get(pack(db.labels.cursors, src)).Get()
+		if err != nil {
+			return 0, fmt.Errorf("failed to get labeler cursor: %w", err)
+		}
+		if len(val) != 8 {
+			return 0, nil
+		}
+
+		return int64(binary.BigEndian.Uint64(val)), nil
+	})
+
+	return
+}
+
+// LabelQuery selects labels for QueryLabels
+type LabelQuery struct {
+	// URIPatterns are subject URIs, or prefixes of them ending in "*"
+	URIPatterns []string
+
+	// Sources are the labelers whose labels are returned
+	Sources []string
+
+	// SelfLabels includes the labels that repos have declared about their own records
+	SelfLabels bool
+
+	// Cursor is the opaque cursor returned with the previous page
+	Cursor string
+
+	Limit int
+}
+
+// QueryLabels returns the current labels that match the query in (uri, src, val) order. Expired
+// labels are skipped. An empty next cursor means there are no more labels.
+func (db *DB) QueryLabels(ctx context.Context, q *LabelQuery) (labels []*types.Label, nextCursor string, err error) {
+	_, span, done := db.observe(ctx, "QueryLabels")
+	defer func() { done(err) }()
+
+	span.SetAttributes(
+		attribute.StringSlice("uri_patterns", q.URIPatterns),
+		attribute.StringSlice("sources", q.Sources),
+		attribute.Bool("self_labels", q.SelfLabels),
+		attribute.String("cursor", q.Cursor),
+		attribute.Int("limit", q.Limit),
+	)
+
+	dir := db.labels.labels
+
+	var after fdb.Key
+	if q.Cursor != "" {
+		after, err = decodeLabelCursor(dir, q.Cursor)
+		if err != nil {
+			return
+		}
+	}
+
+	ranges := make([]fdb.KeyRange, 0, len(q.URIPatterns))
+	for _, pattern := range q.URIPatterns {
+		var kr fdb.KeyRange
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			kr, err = labelPrefixRange(dir, prefix)
+		} else {
+			kr, err = fdb.PrefixRange(pack(dir, pattern))
+		}
+		if err != nil {
+			err = fmt.Errorf("failed to create label range for %q: %w", pattern, err)
+			return
+		}
+		ranges = append(ranges, kr)
+	}
+
+	// visiting the ranges in key order lets overlapping patterns be skipped past rather than
+	// returning the same label twice
+	slices.SortFunc(ranges, func(a, b fdb.KeyRange) int {
+		return bytes.Compare(a.Begin.FDBKey(), b.Begin.FDBKey())
+	})
+
+	sources := make(map[string]struct{}, len(q.Sources))
+	for _, src := range q.Sources {
+		sources[src] = struct{}{}
+	}
+	wanted := func(label *types.Label) bool {
+		if _, ok := sources[label.Src]; ok {
+			return true
+		}
+		return q.SelfLabels && label.Src == labelSubjectDID(label.Uri)
+	}
+
+	now := time.Now()
+	type match struct {
+		key   fdb.Key
+		label *types.Label
+	}
+
+	matches, err := readTransaction(db.db, func(tx fdb.ReadTransaction) ([]match, error) {
+		var out []match
+		after := after
+
+		for _, kr := range ranges {
+			if after != nil && bytes.Compare(after, kr.Begin.FDBKey()) > 0 {
+				kr.Begin = after
+			}
+			if bytes.Compare(kr.Begin.FDBKey(), kr.End.FDBKey()) >= 0 {
+				continue
+			}
+
+			iter := tx.GetRange(kr, fdb.RangeOptions{Mode: fdb.StreamingModeIterator}).Iterator()
+			for iter.Advance() {
+				kv, err := iter.Get()
+				if err != nil {
+					return nil, fmt.Errorf("failed to iterate labels: %w", err)
+				}
+				after = append(slices.Clone(kv.Key), 0x00)
+
+				var label types.Label
+				if err := proto.Unmarshal(kv.Value, &label); err != nil {
+					return nil, fmt.Errorf("failed to protobuf unmarshal label: %w", err)
+				}
+				if !wanted(&label) || labelExpired(&label, now) {
+					continue
+				}
+
+				out = append(out, match{key: kv.Key, label: &label})
+				if len(out) > q.Limit {
+					return out, nil
+				}
+			}
+		}
+
+		return out, nil
+	})
+	if err != nil {
+		return
+	}
+
+	if len(matches) > q.Limit {
+		matches = matches[:q.Limit]
+		nextCursor, err = encodeLabelCursor(dir, matches[len(matches)-1].key)
+		if err != nil {
+			return
+		}
+	}
+
+	labels = make([]*types.Label, 0, len(matches))
+	for _, m := range matches {
+		labels = append(labels, m.label)
+	}
+
+	return
+}
+
+// labelPrefixRange returns the range of labels whose uri starts with prefix
+func labelPrefixRange(dir directory.DirectorySubspace, prefix string) (fdb.KeyRange, error) {
+	// a packed string is terminated by a null byte, which is dropped so that longer strings match
+	key := pack(dir, prefix)
+	return fdb.PrefixRange(key[:len(key)-1])
+}
+
+// labelSubjectDID returns the DID of the account that a label's subject belongs to
+func labelSubjectDID(uri string) string {
+	did, _, _ := strings.Cut(strings.TrimPrefix(uri, "at://"), "/")
+	return did
+}
+
+func labelExpired(label *types.Label, now time.Time) bool {
+	if label.Exp == "" {
+		return false
+	}
+
+	exp, err := time.Parse(time.RFC3339Nano, label.Exp)
+	return err == nil && exp.Before(now)
+}
+
+func encodeLabelCursor(dir directory.DirectorySubspace, key fdb.Key) (string, error) {
+	tup, err := dir.Unpack(key)
+	if err != nil {
+		return "", fmt.Errorf("failed to unpack label key: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(tup.Pack()), nil
+}
+
+// decodeLabelCursor returns the key just after the label that the cursor points at
+func decodeLabelCursor(dir directory.DirectorySubspace, cursor string) (fdb.Key, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidLabelCursor, err)
+	}
+
+	tup, err := tuple.Unpack(buf)
+	if err != nil || len(tup) != 3 {
+		return nil, ErrInvalidLabelCursor
+	}
+	for _, elem := range tup {
+		if _, ok := elem.(string); !ok {
+			return nil, ErrInvalidLabelCursor
+		}
+	}
+
+	return append(dir.Pack(tup), 0x00), nil
+}
@@ -0,0 +1,236 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/atdata"
+	"github.com/jcalabro/atlas/internal/at"
+	"github.com/jcalabro/atlas/internal/types"
+	"github.com/jcalabro/atlas/internal/util"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func testLabel(src, uri, val string) *types.Label {
+	return &types.Label{
+		Src: src,
+		Uri: uri,
+		Val: val,
+		Cts: time.Now().UTC().Format(time.RFC3339Nano),
+		Ver: labelVersion,
+	}
+}
+
+func TestSelfLabelsFromRecord(t *testing.T) {
+	t.Parallel()
+
+	value := func(t *testing.T, data map[string]any) []byte {
+		t.Helper()
+
+		buf, err := atdata.MarshalCBOR(data)
+		require.NoError(t, err)
+		return buf
+	}
+
+	record := &types.Record{
+		Did:        "did:plc:abc",
+		Collection: "app.bsky.feed.post",
+		Rkey:       "3jui7kd2xs22b",
+		Cid:        "bafyreie5737gdxlw5i64vzichcalba3z2v5n6icifvx5xytvske7mr3hpm",
+		CreatedAt:  timestamppb.Now(),
+		Value: value(t, map[string]any{
+			"text": "hello",
+			"labels": map[string]any{
+				"$type":  selfLabelsType,
+				"values": []any{map[string]any{"val": "porn"}, map[string]any{"val": ""}, "junk"},
+			},
+		}),
+	}
+
+	labels := selfLabels(record)
+	require.Len(t, labels, 1)
+	require.Equal(t, "did:plc:abc", labels[0].Src)
+	require.Equal(t, "at://did:plc:abc/app.bsky.feed.post/3jui7kd2xs22b", labels[0].Uri)
+	require.Equal(t, record.Cid, labels[0].Cid)
+	require.Equal(t, "porn", labels[0].Val)
+
+	record.Value = value(t, map[string]any{"text": "hello"})
+	require.Empty(t, selfLabels(record))
+
+	record.Value = value(t, map[string]any{"labels": map[string]any{"$type": "something.else", "values": []any{}}})
+	require.Empty(t, selfLabels(record))
+
+	record.Value = []byte("not cbor")
+	require.Empty(t, selfLabels(record))
+}
+
+func TestLabelSubjectDID(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, "did:plc:abc", labelSubjectDID("at://did:plc:abc/app.bsky.feed.post/3jui7kd2xs22b"))
+	require.Equal(t, "did:plc:abc", labelSubjectDID("at://did:plc:abc"))
+	require.Equal(t, "did:plc:abc", labelSubjectDID("did:plc:abc"))
+}
+
+func TestEmitLabel(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	db := testDB(t)
+
+	src := "did:web:labeler-" + strings.ToLower(util.RandString(8)) + ".example.com"
+
+	seq, err := db.LatestLabelSeq(ctx, src)
+	require.NoError(t, err)
+	require.Zero(t, seq)
+
+	for ndx := range 3 {
+		label := testLabel(src, fmt.Sprintf("did:plc:subject%d", ndx), "spam")
+		require.NoError(t, db.EmitLabel(ctx, label))
+		require.Equal(t, int64(ndx+1), label.Seq)
+	}
+
+	negation := testLabel(src, "did:plc:subject0", "spam")
+	negation.Neg = true
+	require.NoError(t, db.EmitLabel(ctx, negation))
+
+	seq, err = db.LatestLabelSeq(ctx, src)
+	require.NoError(t, err)
+	require.Equal(t, int64(4), seq)
+
+	// negations are kept in the stream
+	labels, err := db.GetLabelsSince(ctx, src, 2, 10)
+	require.NoError(t, err)
+	require.Len(t, labels, 2)
+	require.Equal(t, int64(3), labels[0].Seq)
+	require.True(t, labels[1].Neg)
+
+	// but remove the label they negate from the index
+	labels, _, err = db.QueryLabels(ctx, &LabelQuery{URIPatterns: []string{"did:plc:subject*"}, Sources: []string{src}, Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, labels, 2)
+	require.Equal(t, "did:plc:subject1", labels[0].Uri)
+
+	require.Error(t, db.EmitLabel(ctx, &types.Label{Src: src}))
+}
+
+func TestQueryLabels(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	db := testDB(t)
+
+	src := "did:web:labeler-" + strings.ToLower(util.RandString(8)) + ".example.com"
+	other := "did:web:other-" + strings.ToLower(util.RandString(8)) + ".example.com"
+	subject := "did:plc:" + strings.ToLower(util.RandString(24))
+	post := "at://" + subject + "/app.bsky.feed.post/3jui7kd2xs22b"
+
+	expired := testLabel(src, post, "expired")
+	expired.Exp = time.Now().Add(-time.Hour).UTC().Format(time.RFC3339Nano)
+
+	require.NoError(t, db.SaveLabels(ctx, src, []*types.Label{
+		testLabel(src, subject, "impersonation"),
+		testLabel(src, post, "spam"),
+		testLabel(src, post, "rude"),
+		expired,
+	}, 10))
+	require.NoError(t, db.SaveLabels(ctx, other, []*types.Label{testLabel(other, post, "spam")}, 3))
+
+	cursor, err := db.LabelerCursor(ctx, src)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), cursor)
+
+	// labels may only be saved by the labeler that issued them
+	require.Error(t, db.SaveLabels(ctx, src, []*types.Label{testLabel(other, post, "spam")}, 11))
+
+	labels, next, err := db.QueryLabels(ctx, &LabelQuery{URIPatterns: []string{post}, Sources: []string{src}, Limit: 10})
+	require.NoError(t, err)
+	require.Empty(t, next)
+	require.Len(t, labels, 2)
+	require.Equal(t, "rude", labels[0].Val)
+	require.Equal(t, "spam", labels[1].Val)
+
+	labels, _, err = db.QueryLabels(ctx, &LabelQuery{URIPatterns: []string{post}, Sources: []string{src, other}, Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, labels, 3)
+
+	// overlapping patterns are paginated without repeating labels
+	query := &LabelQuery{
+		URIPatterns: []string{subject, "at://" + subject + "/*", post},
+		Sources:     []string{src},
+		Limit:       2,
+	}
+	labels, next, err = db.QueryLabels(ctx, query)
+	require.NoError(t, err)
+	require.Len(t, labels, 2)
+	require.NotEmpty(t, next)
+
+	query.Cursor = next
+	labels, next, err = db.QueryLabels(ctx, query)
+	require.NoError(t, err)
+	require.Len(t, labels, 1)
+	require.Equal(t, "impersonation", labels[0].Val)
+	require.Empty(t, next)
+
+	_, _, err = db.QueryLabels(ctx, &LabelQuery{URIPatterns: []string{post}, Cursor: "!!!", Limit: 10})
+	require.ErrorIs(t, err, ErrInvalidLabelCursor)
+}
+
+func TestRecordSelfLabels(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	db := testDB(t)
+
+	actor := newTestActor(t, db, testPDSHost)
+
+	value, err := atdata.MarshalCBOR(map[string]any{
+		"labels": map[string]any{
+			"$type":  selfLabelsType,
+			"values": []any{map[string]any{"val": "porn"}},
+		},
+	})
+	require.NoError(t, err)
+
+	record := &types.Record{
+		Did:        actor.Did,
+		Collection: "app.bsky.feed.post",
+		Rkey:       "3jui7kd2xs22b",
+		Cid:        "cid",
+		Value:      value,
+		CreatedAt:  timestamppb.Now(),
+	}
+	require.NoError(t, db.SaveRecord(ctx, record))
+
+	query := &LabelQuery{URIPatterns: []string{"at://" + actor.Did + "/*"}, SelfLabels: true, Limit: 10}
+	labels, _, err := db.QueryLabels(ctx, query)
+	require.NoError(t, err)
+	require.Len(t, labels, 1)
+	require.Equal(t, "porn", labels[0].Val)
+
+	// self-labels are only returned when asked for
+	labels, _, err = db.QueryLabels(ctx, &LabelQuery{URIPatterns: query.URIPatterns, Limit: 10})
+	require.NoError(t, err)
+	require.Empty(t, labels)
+
+	// updating the record replaces its self-labels
+	record.Value, err = atdata.MarshalCBOR(map[string]any{"text": "sfw now"})
+	require.NoError(t, err)
+	require.NoError(t, db.SaveRecord(ctx, record))
+
+	labels, _, err = db.QueryLabels(ctx, query)
+	require.NoError(t, err)
+	require.Empty(t, labels)
+
+	// and deleting the account removes every label on its records
+	record.Value = value
+	require.NoError(t, db.SaveRecord(ctx, record))
+	require.NoError(t, db.SaveLabels(ctx, "did:plc:labeler", []*types.Label{
+		testLabel("did:plc:labeler", (&at.URI{Repo: actor.Did, Collection: record.Collection, Rkey: record.Rkey}).String(), "spam"),
+	}, 1))
+	require.NoError(t, db.DeleteActor(ctx, actor.Did))
+
+	labels, _, err = db.QueryLabels(ctx, &LabelQuery{URIPatterns: query.URIPatterns, Sources: []string{"did:plc:labeler"}, SelfLabels: true, Limit: 10})
+	require.NoError(t, err)
+	require.Empty(t, labels)
+}
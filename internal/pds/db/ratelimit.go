@@ -0,0 +1,228 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/jcalabro/atlas/internal/types"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// RateLimit is a budget of Limit points per fixed Window for a single subject, such as an IP
+// address. Name identifies the budget, and must be unique for each kind of limit.
+type RateLimit struct {
+	Name    string
+	Subject string
+	Limit   int64
+	Window  time.Duration
+
+	// Cost is the number of points the request spends (defaults to 1)
+	Cost int64
+}
+
+// RateLimitResult is the state of a rate limit after a request was counted against it
+type RateLimitResult struct {
+	RateLimit
+
+	// Remaining is the number of requests left in the current window
+	Remaining int64
+
+	// Reset is when the current window ends and the budget is refilled
+	Reset time.Time
+
+	// Allowed is false if the request exceeded the limit
+	Allowed bool
+}
+
+// ConsumeRateLimits counts a request against each of the given limits. Every limit is counted even
+// if the request is rejected by another, so a client that keeps retrying stays limited.
+//
+// Counters are kept in fixed windows keyed by the time each window ends, and are incremented with
+// atomic adds read at snapshot isolation, so concurrent requests from every replica never conflict.
+// The tradeoff is that a burst of concurrent requests may slightly overshoot a limit.
+func (db *DB) ConsumeRateLimits(ctx context.Context, now time.Time, limits []RateLimit) (results []RateLimitResult, err error) {
+	_, span, done := db.observe(ctx, "ConsumeRateLimits")
+	defer func() { done(err) }()
+
+	span.SetAttributes(attribute.Int("limits", len(limits)))
+
+	results, err = transaction(db.db, func(tx fdb.Transaction) ([]RateLimitResult, error) {
+		type pending struct {
+			key   fdb.Key
+			reset time.Time
+			count fdb.FutureByteSlice
+		}
+
+		futures := make([]pending, 0, len(limits))
+		for _, limit := range limits {
+			if limit.Window <= 0 {
+				return nil, fmt.Errorf("rate limit %q has no window", limit.Name)
+			}
+
+			reset := now.Truncate(limit.Window).Add(limit.Window)
+			key := pack(db.rateLimits.counters, reset.Unix(), limit.Name, limit.Subject)
+			futures = append(futures, pending{
+				key:   key,
+				reset: reset,
+				count: tx.Snapshot().Get(key),
+			})
+		}
+
+		results := make([]RateLimitResult, 0, len(limits))
+		for i, f := range futures {
+			val, err := f.count.Get()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read rate limit counter: %w", err)
+			}
+
+			limit := limits[i]
+			cost := max(limit.Cost, 1)
+
+			// counters are little-endian so that they can be incremented with atomic adds
+			var count int64
+			if len(val) == 8 {
+				count = int64(binary.LittleEndian.Uint64(val))
+			}
+			count += cost
+
+			tx.Add(f.key, binary.LittleEndian.AppendUint64(nil, uint64(cost)))
+
+			results = append(results, RateLimitResult{
+				RateLimit: limit,
+				Remaining: max(limit.Limit-count, 0),
+				Reset:     f.reset,
+				Allowed:   count <= limit.Limit,
+			})
+		}
+
+		return results, nil
+	})
+
+	return
+}
+
+// SweepRateLimits deletes the counters of rate limit windows that ended before the given time
+func (db *DB) SweepRateLimits(ctx context.Context, before time.Time) (err error) {
+	_, span, done := db.observe(ctx, "SweepRateLimits")
+	defer func() { done(err) }()
+
+	span.SetAttributes(attribute.String("before", before.Format(time.RFC3339)))
+
+	_, err = transaction(db.db, func(tx fdb.Transaction) (any, error) {
+		tx.ClearRange(fdb.KeyRange{
+			Begin: db.rateLimits.counters.FDBKey(),
+			End:   pack(db.rateLimits.counters, before.Unix()),
+		})
+		return nil, nil
+	})
+
+	return
+}
+
+// LoginLockoutPolicy configures when repeated failed logins lock an account
+type LoginLockoutPolicy struct {
+	// MaxFailures is the number of consecutive failures that locks the account
+	MaxFailures int64
+
+	// Duration is how long the account stays locked. Failures older than this are forgotten.
+	Duration time.Duration
+}
+
+// GetLoginLockout returns the time until which the actor's logins are locked. The returned time is
+// zero if the actor isn't locked.
+func (db *DB) GetLoginLockout(ctx context.Context, did string) (lockedUntil time.Time, err error) {
+	_, span, done := db.observe(ctx, "GetLoginLockout")
+	defer func() { done(err) }()
+
+	span.SetAttributes(attribute.String("did", did))
+
+	var lockout types.LoginLockout
+	err = readProto(db.db, &lockout, func(tx fdb.ReadTransaction) ([]byte, error) {
+		return tx.Get(pack(db.rateLimits.lockouts, did)).Get()
+	})
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			err = nil
+		}
+		return
+	}
+
+	if until := lockout.LockedUntil.AsTime(); lockout.LockedUntil != nil && until.After(time.Now()) {
+		lockedUntil = until
+	}
+
+	return
+}
+
+// RecordLoginFailure counts a failed login for the actor, locking the account once the policy's
+// maximum consecutive failures is reached. Returns the time until which the account is locked, or
+// zero if it isn't.
+func (db *DB) RecordLoginFailure(ctx context.Context, did string, policy LoginLockoutPolicy) (lockedUntil time.Time, err error) {
+	_, span, done := db.observe(ctx, "RecordLoginFailure")
+	defer func() { done(err) }()
+
+	span.SetAttributes(attribute.String("did", did))
+
+	lockedUntil, err = transaction(db.db, func(tx fdb.Transaction) (time.Time, error) {
+		key := pack(db.rateLimits.lockouts, did)
+		buf, err := tx.Get(key).Get()
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to get login lockout: %w", err)
+		}
+
+		var lockout types.LoginLockout
+		if err := proto.Unmarshal(buf, &lockout); err != nil {
+			return time.Time{}, fmt.Errorf("failed to protobuf unmarshal login lockout: %w", err)
+		}
+
+		now := time.Now()
+		if lockout.LockedUntil != nil && lockout.LockedUntil.AsTime().After(now) {
+			return lockout.LockedUntil.AsTime(), nil
+		}
+
+		// start over once a lockout has expired or the last failure is old enough to forget
+		if lockout.LockedUntil != nil || (lockout.LastFailure != nil && now.Sub(lockout.LastFailure.AsTime()) > policy.Duration) {
+			lockout.Reset()
+		}
+
+		lockout.Failures++
+		lockout.LastFailure = timestamppb.New(now)
+
+		var until time.Time
+		if policy.MaxFailures > 0 && lockout.Failures >= policy.MaxFailures {
+			until = now.Add(policy.Duration)
+			lockout.LockedUntil = timestamppb.New(until)
+		}
+
+		buf, err = proto.Marshal(&lockout)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to protobuf marshal login lockout: %w", err)
+		}
+		tx.Set(key, buf)
+
+		return until, nil
+	})
+
+	return
+}
+
+// ClearLoginFailures forgets the actor's failed logins, unlocking the account if it was locked
+func (db *DB) ClearLoginFailures(ctx context.Context, did string) (err error) {
+	_, span, done := db.observe(ctx, "ClearLoginFailures")
+	defer func() { done(err) }()
+
+	span.SetAttributes(attribute.String("did", did))
+
+	_, err = transaction(db.db, func(tx fdb.Transaction) (any, error) {
+		tx.Clear(pack(db.rateLimits.lockouts, did))
+		return nil, nil
+	})
+
+	return
+}
@@ -0,0 +1,88 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimits(t *testing.T) {
+	t.Parallel()
+	db := testDB(t)
+
+	t.Run("counts requests in fixed windows", func(t *testing.T) {
+		t.Parallel()
+		ctx := t.Context()
+
+		// counters outlive the test, so each run uses its own subject
+		limit := RateLimit{Name: "test", Subject: uuid.NewString(), Limit: 2, Window: time.Hour}
+		now := time.Now()
+
+		for i := range 3 {
+			results, err := db.ConsumeRateLimits(ctx, now, []RateLimit{limit})
+			require.NoError(t, err)
+			require.Len(t, results, 1)
+			require.Equal(t, i < 2, results[0].Allowed)
+			require.EqualValues(t, max(1-i, 0), results[0].Remaining)
+			require.Equal(t, now.Truncate(time.Hour).Add(time.Hour), results[0].Reset)
+		}
+
+		// the next window starts over
+		results, err := db.ConsumeRateLimits(ctx, now.Add(time.Hour), []RateLimit{limit})
+		require.NoError(t, err)
+		require.True(t, results[0].Allowed)
+
+		// sweeping clears windows that have ended
+		past := now.Add(-2 * time.Hour)
+		for range 3 {
+			_, err = db.ConsumeRateLimits(ctx, past, []RateLimit{limit})
+			require.NoError(t, err)
+		}
+		require.NoError(t, db.SweepRateLimits(ctx, now))
+		results, err = db.ConsumeRateLimits(ctx, past, []RateLimit{limit})
+		require.NoError(t, err)
+		require.EqualValues(t, 1, results[0].Remaining)
+	})
+
+	t.Run("spends the cost of each request", func(t *testing.T) {
+		t.Parallel()
+
+		limit := RateLimit{Name: "test-cost", Subject: uuid.NewString(), Limit: 5, Window: time.Hour, Cost: 3}
+
+		results, err := db.ConsumeRateLimits(t.Context(), time.Now(), []RateLimit{limit})
+		require.NoError(t, err)
+		require.True(t, results[0].Allowed)
+		require.EqualValues(t, 2, results[0].Remaining)
+
+		results, err = db.ConsumeRateLimits(t.Context(), time.Now(), []RateLimit{limit})
+		require.NoError(t, err)
+		require.False(t, results[0].Allowed)
+	})
+
+	t.Run("locks out after repeated failures", func(t *testing.T) {
+		t.Parallel()
+		ctx := t.Context()
+
+		did := "did:plc:" + uuid.NewString()
+		policy := LoginLockoutPolicy{MaxFailures: 2, Duration: time.Hour}
+
+		until, err := db.RecordLoginFailure(ctx, did, policy)
+		require.NoError(t, err)
+		require.True(t, until.IsZero())
+
+		until, err = db.RecordLoginFailure(ctx, did, policy)
+		require.NoError(t, err)
+		require.False(t, until.IsZero())
+
+		locked, err := db.GetLoginLockout(ctx, did)
+		require.NoError(t, err)
+		require.WithinDuration(t, until, locked, time.Millisecond)
+
+		require.NoError(t, db.ClearLoginFailures(ctx, did))
+		locked, err = db.GetLoginLockout(ctx, did)
+		require.NoError(t, err)
+		require.True(t, locked.IsZero())
+	})
+}
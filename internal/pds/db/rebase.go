@@ -0,0 +1,266 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/bluesky-social/indigo/atproto/repo"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/jcalabro/atlas/internal/types"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// RebaseResult summarizes the work done by RebaseRepo
+type RebaseResult struct {
+	CommitCID cid.Cid
+	Rev       string
+
+	// BlocksReindexed is the number of reachable blocks moved to the new rev in blocks_by_rev
+	BlocksReindexed int
+
+	// Blocks is the result of pruning the blocks that are no longer reachable
+	Blocks *RepairBlocksResult
+}
+
+// RebaseRepo squashes a repo's history: it writes a fresh signed commit with no prev over the
+// current MST, emits a #sync event so that consumers resync from the new root, moves every
+// reachable block to the new rev in blocks_by_rev, then prunes every unreachable block.
+//
+// Only the new commit is written atomically. The remaining steps run in bounded-size transactions,
+// and the repo is valid at every point in between. If the operation is interrupted, running it
+// again completes the cleanup (at the cost of another commit). The commits from before the rebase
+// are pruned, so `since` diffs from those revisions fail with ErrUnknownRev afterwards, and
+// consumers have to fetch the full repo instead.
+func (db *DB) RebaseRepo(ctx context.Context, did string) (res *RebaseResult, err error) {
+	_, span, done := db.observe(ctx, "RebaseRepo")
+	defer func() { done(err) }()
+
+	span.SetAttributes(attribute.String("did", did))
+
+	if _, err = syntax.ParseDID(did); err != nil {
+		err = fmt.Errorf("invalid did: %w", err)
+		return
+	}
+
+	for attempt := 1; ; attempt++ {
+		res, err = db.writeRebaseCommit(ctx, did)
+		if !errors.Is(err, ErrConcurrentModification) || attempt == repairMaxAttempts {
+			break
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	span.SetAttributes(
+		attribute.String("commit", res.CommitCID.String()),
+		attribute.String("rev", res.Rev),
+	)
+
+	res.BlocksReindexed, err = db.reindexBlockRevs(ctx, did, res.CommitCID, res.Rev)
+	if err != nil {
+		err = fmt.Errorf("failed to reindex blocks: %w", err)
+		return
+	}
+
+	res.Blocks, err = db.RepairRepoBlocks(ctx, did)
+	if err != nil {
+		err = fmt.Errorf("failed to prune unreachable blocks: %w", err)
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int("blocks_reindexed", res.BlocksReindexed),
+		attribute.Int("blocks_deleted", res.Blocks.BlocksDeleted),
+	)
+
+	return
+}
+
+// writeRebaseCommit replaces the repo's head with a new commit over the same MST that has no
+// prev, and writes the corresponding sync event. The signing key is opened before the transaction
+// starts, and ErrConcurrentModification is returned if the head moves in the meantime.
+func (db *DB) writeRebaseCommit(ctx context.Context, did string) (*RebaseResult, error) {
+	actor, err := db.GetActorByDID(ctx, did)
+	if err != nil {
+		return nil, err
+	}
+
+	privkey, err := db.SigningKey(ctx, actor)
+	if err != nil {
+		return nil, err
+	}
+
+	return transaction(db.db, func(tx fdb.Transaction) (*RebaseResult, error) {
+		existing, err := db.getActorByDIDTx(tx, did)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get actor: %w", err)
+		}
+		if existing == nil {
+			return nil, ErrNotFound
+		}
+
+		// key rotations also move the head, so this also ensures that privkey is still current
+		if existing.Head != actor.Head {
+			return nil, ErrConcurrentModification
+		}
+
+		commitCID, rev, err := db.resignHeadTx(ctx, tx, existing, privkey, false)
+		if err != nil {
+			return nil, err
+		}
+
+		return &RebaseResult{
+			CommitCID: commitCID,
+			Rev:       rev,
+		}, nil
+	})
+}
+
+// resignHeadTx writes a new commit over the MST of the actor's current head, signed with privkey,
+// which must be the actor's current signing key. The new commit keeps the prev of the head if keepPrev is set, and
+// otherwise has no prev. It saves the actor with the new head and writes a sync event so that
+// consumers resync from the new commit.
+func (db *DB) resignHeadTx(ctx context.Context, tx fdb.Transaction, actor *types.Actor, privkey *atcrypto.PrivateKeyK256, keepPrev bool) (cid.Cid, string, error) {
+	headCID, err := cid.Decode(actor.Head)
+	if err != nil {
+		return cid.Undef, "", fmt.Errorf("failed to parse repo head CID: %w", err)
+	}
+
+	bs := db.newWriteBlockstore(actor.Did, tx)
+	commit, clk, err := loadCommit(ctx, bs, headCID)
+	if err != nil {
+		return cid.Undef, "", fmt.Errorf("failed to load commit: %w", err)
+	}
+
+	newRev := clk.Next().String()
+	bs.SetRev(newRev)
+	bs.EnableWriteTracking()
+
+	newCommit := repo.Commit{
+		DID:     actor.Did,
+		Version: repo.ATPROTO_REPO_VERSION,
+		Data:    commit.Data,
+		Rev:     newRev,
+	}
+	if keepPrev {
+		newCommit.Prev = commit.Prev
+	}
+
+	if err := newCommit.Sign(privkey); err != nil {
+		return cid.Undef, "", fmt.Errorf("failed to sign commit: %w", err)
+	}
+
+	commitCID, err := storeCommit(ctx, bs, &newCommit)
+	if err != nil {
+		return cid.Undef, "", fmt.Errorf("failed to store commit: %w", err)
+	}
+
+	// the MST is unchanged, so only the old commit block becomes unreachable
+	if err := db.queueUnreachableBlocksTx(tx, bs, headCID, commit.Data, commit.Data); err != nil {
+		return cid.Undef, "", fmt.Errorf("failed to collect unreachable blocks: %w", err)
+	}
+
+	actor.Head = commitCID.String()
+	actor.Rev = newRev
+	if err := db.saveActorTx(tx, actor); err != nil {
+		return cid.Undef, "", fmt.Errorf("failed to save actor: %w", err)
+	}
+
+	// sync events carry only the commit block
+	carBytes, err := buildCarFile(commitCID, bs.GetWriteLog())
+	if err != nil {
+		return cid.Undef, "", fmt.Errorf("failed to build CAR file: %w", err)
+	}
+
+	event := &types.RepoEvent{
+		EventType: types.EventType_EVENT_TYPE_SYNC,
+		PdsHost:   actor.PdsHost,
+		Repo:      actor.Did,
+		Rev:       newRev,
+		Commit:    commitCID.Bytes(),
+		Blocks:    carBytes,
+		Time:      timestamppb.New(time.Now()),
+	}
+	if err := db.WriteEventTx(tx, event); err != nil {
+		return cid.Undef, "", fmt.Errorf("failed to write sync event: %w", err)
+	}
+
+	return commitCID, newRev, nil
+}
+
+// reindexBlockRevs moves every block reachable from the given commit to rev in the blocks_by_rev
+// index. Blocks that were written again by a later commit are left alone, so this is safe to run
+// concurrently with writes to the repo.
+func (db *DB) reindexBlockRevs(ctx context.Context, did string, commitCID cid.Cid, rev string) (int, error) {
+	for attempt := 1; ; attempt++ {
+		var reachable []cid.Cid
+		err := db.StreamRepo(ctx, did, commitCID, func(blk blocks.Block) error {
+			reachable = append(reachable, blk.Cid())
+			return nil
+		})
+		if errors.Is(err, ErrRepoChanged) && attempt < repairMaxAttempts {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to walk repo: %w", err)
+		}
+
+		var reindexed int
+		for batch := range slices.Chunk(reachable, repairBatch) {
+			if err := ctx.Err(); err != nil {
+				return reindexed, err
+			}
+
+			n, err := transaction(db.db, func(tx fdb.Transaction) (int, error) {
+				return db.reindexBlockRevsTx(tx, did, batch, rev)
+			})
+			if err != nil {
+				return reindexed, err
+			}
+			reindexed += n
+		}
+
+		return reindexed, nil
+	}
+}
+
+// reindexBlockRevsTx moves each of the given blocks to rev in the blocks_by_rev index unless it
+// was written by rev or later. Returns the number of blocks moved.
+func (db *DB) reindexBlockRevsTx(tx fdb.Transaction, did string, cids []cid.Cid, rev string) (int, error) {
+	futures := make([]fdb.FutureByteSlice, 0, len(cids))
+	for _, c := range cids {
+		futures = append(futures, tx.Get(pack(db.blockDir.revsByBlock, did, c.Bytes())))
+	}
+
+	var reindexed int
+	for i, f := range futures {
+		val, err := f.Get()
+		if err != nil {
+			return 0, fmt.Errorf("failed to get block rev: %w", err)
+		}
+
+		existing := string(val)
+		if existing >= rev {
+			continue
+		}
+
+		cidBytes := cids[i].Bytes()
+		if existing != "" {
+			tx.Clear(pack(db.blockDir.blocksByRev, did, existing, cidBytes))
+		}
+		tx.Set(pack(db.blockDir.blocksByRev, did, rev, cidBytes), nil)
+		tx.Set(pack(db.blockDir.revsByBlock, did, cidBytes), []byte(rev))
+		reindexed++
+	}
+
+	return reindexed, nil
+}
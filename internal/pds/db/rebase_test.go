@@ -0,0 +1,158 @@
+package db
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/bluesky-social/indigo/atproto/repo"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/jcalabro/atlas/internal/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRebaseRepo(t *testing.T) {
+	t.Parallel()
+	db := testDB(t)
+
+	t.Run("squashes history into a single commit", func(t *testing.T) {
+		t.Parallel()
+		ctx := t.Context()
+
+		did := "did:plc:rebase1"
+		testRepoActor(t, db, did)
+		putTestRecord(t, db, did, "3kaaaaaaaaaa2", "one")
+		putTestRecord(t, db, did, "3kaaaaaaaaab2", "two")
+		putTestRecord(t, db, did, "3kaaaaaaaaab2", "two, edited")
+		putTestRecord(t, db, did, "3kaaaaaaaaac2", "three")
+		deleteTestRecord(t, db, did, "3kaaaaaaaaac2")
+
+		oldHead := testHead(t, db, did)
+		before := requireCompleteRepo(t, db, did)
+
+		actor, err := db.GetActorByDID(ctx, did)
+		require.NoError(t, err)
+		oldRev := actor.Rev
+
+		cursor, err := db.GetLatestSeq(ctx)
+		require.NoError(t, err)
+
+		res, err := db.RebaseRepo(ctx, did)
+		require.NoError(t, err)
+		require.Equal(t, res.CommitCID, testHead(t, db, did))
+		require.Equal(t, len(before), res.BlocksReindexed)
+		require.Positive(t, res.Blocks.BlocksDeleted)
+
+		// the new commit has no prev and points at the same tree
+		blks, err := db.GetBlocks(ctx, did, []cid.Cid{res.CommitCID})
+		require.NoError(t, err)
+		require.Len(t, blks, 1)
+		var commit repo.Commit
+		require.NoError(t, commit.UnmarshalCBOR(bytes.NewReader(blks[0].RawData())))
+		require.Nil(t, commit.Prev)
+		require.Equal(t, res.Rev, commit.Rev)
+
+		// only the reachable blocks are left, all indexed under the new rev
+		requireBlockExists(t, db, did, oldHead, false)
+		after := requireCompleteRepo(t, db, did)
+		require.Len(t, after, len(before))
+
+		all, err := db.GetAllBlocks(ctx, did)
+		require.NoError(t, err)
+		require.Len(t, all, len(after))
+
+		err = db.Transact(func(tx fdb.Transaction) error {
+			kr, err := fdb.PrefixRange(pack(db.blockDir.blocksByRev, did))
+			if err != nil {
+				return err
+			}
+			kvs, err := tx.GetRange(kr, fdb.RangeOptions{}).GetSliceWithError()
+			if err != nil {
+				return err
+			}
+
+			require.Len(t, kvs, len(after))
+			for _, kv := range kvs {
+				tup, err := db.blockDir.blocksByRev.Unpack(kv.Key)
+				require.NoError(t, err)
+				require.Equal(t, res.Rev, tup[1])
+			}
+			return nil
+		})
+		require.NoError(t, err)
+
+		// the repo is still consistent
+		check, err := db.CheckRepo(ctx, did, FsckOptions{})
+		require.NoError(t, err)
+		require.True(t, check.OK(), "issues: %+v", check.Issues)
+		require.Equal(t, 2, check.Records)
+
+		// a sync event was emitted for the new commit
+		var sync *types.RepoEvent
+		for {
+			events, next, err := db.GetEventsSince(ctx, cursor, 100)
+			require.NoError(t, err)
+			if len(events) == 0 {
+				break
+			}
+			for _, event := range events {
+				if event.Repo == did && event.EventType == types.EventType_EVENT_TYPE_SYNC {
+					sync = event
+				}
+			}
+			cursor = next
+		}
+		require.NotNil(t, sync)
+		require.Equal(t, res.CommitCID.Bytes(), sync.Commit)
+		require.Equal(t, res.Rev, sync.Rev)
+		require.NotEmpty(t, sync.Blocks)
+
+		// diffs from before the rebase are no longer possible, but diffs from the new commit are
+		err = db.StreamRepoDiff(ctx, did, res.CommitCID, oldRev, func(blocks.Block) error { return nil })
+		require.ErrorIs(t, err, ErrUnknownRev)
+
+		// writes continue from the new commit
+		putTestRecord(t, db, did, "3kaaaaaaaaad2", "four")
+		requireCompleteRepo(t, db, did)
+
+		var sent int
+		err = db.StreamRepoDiff(ctx, did, testHead(t, db, did), res.Rev, func(blocks.Block) error {
+			sent++
+			return nil
+		})
+		require.NoError(t, err)
+		require.Positive(t, sent)
+	})
+
+	t.Run("rebasing again is safe", func(t *testing.T) {
+		t.Parallel()
+
+		did := "did:plc:rebase2"
+		testRepoActor(t, db, did)
+		putTestRecord(t, db, did, "3kaaaaaaaaaa2", "one")
+
+		first, err := db.RebaseRepo(t.Context(), did)
+		require.NoError(t, err)
+
+		second, err := db.RebaseRepo(t.Context(), did)
+		require.NoError(t, err)
+		require.NotEqual(t, first.CommitCID, second.CommitCID)
+		require.Greater(t, second.Rev, first.Rev)
+
+		// only the previous commit block was unreachable
+		require.Equal(t, 1, second.Blocks.BlocksDeleted)
+		requireBlockExists(t, db, did, first.CommitCID, false)
+		requireCompleteRepo(t, db, did)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := db.RebaseRepo(t.Context(), "not-a-did")
+		require.Error(t, err)
+
+		_, err = db.RebaseRepo(t.Context(), "did:plc:rebasedoesnotexist")
+		require.ErrorIs(t, err, ErrNotFound)
+	})
+}
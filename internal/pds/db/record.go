@@ -69,12 +69,35 @@ func (db *DB) saveRecordTx(tx fdb.Transaction, record *types.Record) error {
 		return fmt.Errorf("failed to marshal record: %w", err)
 	}
 
-	recordKey := packURI(
-		db.records.records,
-		&at.URI{Repo: record.Did, Collection: record.Collection, Rkey: record.Rkey},
-	)
+	uri := &at.URI{Repo: record.Did, Collection: record.Collection, Rkey: record.Rkey}
+	recordKey := packURI(db.records.records, uri)
+
+	// if this is an update, the old content's entry in the cid index must be removed
+	if err := db.clearRecordCIDTx(tx, recordKey, uri); err != nil {
+		return err
+	}
 
 	tx.Set(recordKey, buf)
+	tx.Set(pack(db.records.recordsByCID, record.Did, record.Cid, record.Collection, record.Rkey), nil)
+	return db.saveSelfLabelsTx(tx, record)
+}
+
+// clearRecordCIDTx removes the records_by_cid entry for the record currently stored at key, if any
+func (db *DB) clearRecordCIDTx(tx fdb.Transaction, key fdb.Key, uri *at.URI) error {
+	buf, err := tx.Get(key).Get()
+	if err != nil {
+		return fmt.Errorf("failed to get existing record: %w", err)
+	}
+	if buf == nil {
+		return nil
+	}
+
+	var existing types.Record
+	if err := proto.Unmarshal(buf, &existing); err != nil {
+		return fmt.Errorf("failed to unmarshal existing record: %w", err)
+	}
+
+	tx.Clear(pack(db.records.recordsByCID, uri.Repo, existing.Cid, uri.Collection, uri.Rkey))
 	return nil
 }
 
@@ -106,26 +129,40 @@ func (db *DB) GetRecord(ctx context.Context, uri string) (record *types.Record,
 }
 
 // DeleteRecordTx clears a record within an existing transaction.
-func (db *DB) DeleteRecordTx(tx fdb.Transaction, uri *at.URI) {
+func (db *DB) DeleteRecordTx(tx fdb.Transaction, uri *at.URI) error {
 	key := packURI(db.records.records, uri)
+	if err := db.clearRecordCIDTx(tx, key, uri); err != nil {
+		return err
+	}
+
 	tx.Clear(key)
+	return db.clearSelfLabelsTx(tx, uri)
 }
 
 // incrementCollectionCountTx atomically increments the collection count for a (did, collection) pair.
 func (db *DB) incrementCollectionCountTx(tx fdb.Transaction, did, collection string) {
 	key := pack(db.records.collectionCounts, did, collection)
-	one := make([]byte, 8)
-	binary.BigEndian.PutUint64(one, 1)
-	tx.Add(key, one)
+	tx.Add(key, encodeCollectionCount(1))
 }
 
 // decrementCollectionCountTx atomically decrements the collection count for a (did, collection) pair.
 func (db *DB) decrementCollectionCountTx(tx fdb.Transaction, did, collection string) {
 	key := pack(db.records.collectionCounts, did, collection)
-	// -1 as uint64 in big-endian (two's complement)
-	minusOne := make([]byte, 8)
-	binary.BigEndian.PutUint64(minusOne, ^uint64(0))
-	tx.Add(key, minusOne)
+	tx.Add(key, encodeCollectionCount(-1))
+}
+
+// encodeCollectionCount encodes a collection count. FDB atomic adds treat values as little-endian
+// integers, so counts must be stored that way for increments to carry correctly.
+func encodeCollectionCount(n int64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, uint64(n))
+}
+
+// decodeCollectionCount decodes a collection count, returning false if the value is malformed
+func decodeCollectionCount(val []byte) (int64, bool) {
+	if len(val) != 8 {
+		return 0, false
+	}
+	return int64(binary.LittleEndian.Uint64(val)), true
 }
 
 // ListRecordsResult contains the result of listing records in a collection.
@@ -156,6 +193,11 @@ func (db *DB) ListRecords(
 	)
 
 	result, err = readTransaction(db.db, func(tx fdb.ReadTransaction) (*ListRecordsResult, error) {
+		takenDown, err := db.recordTakedownsTx(tx, did, collection)
+		if err != nil {
+			return nil, err
+		}
+
 		var rangeBegin, rangeEnd fdb.Key
 
 		if cursor == "" {
@@ -177,7 +219,9 @@ func (db *DB) ListRecords(
 
 		kr := fdb.KeyRange{Begin: rangeBegin, End: rangeEnd}
 		opts := fdb.RangeOptions{
-			Limit:   limit + 1, // fetch one extra to detect if there are more results
+			// fetch one extra to detect if there are more results, plus enough to skip over any
+			// records that are taken down
+			Limit:   limit + 1 + len(takenDown),
 			Reverse: reverse,
 		}
 
@@ -194,7 +238,14 @@ func (db *DB) ListRecords(
 				return nil, fmt.Errorf("failed to unmarshal record: %w", err)
 			}
 
+			if _, ok := takenDown[record.Rkey]; ok {
+				continue
+			}
+
 			records = append(records, &record)
+			if len(records) > limit {
+				break
+			}
 		}
 
 		// determine cursor for next page
@@ -250,11 +301,8 @@ func (db *DB) GetCollections(ctx context.Context, did string) (collections []str
 			}
 
 			// only include collections with count > 0
-			if len(kv.Value) == 8 {
-				count := int64(binary.BigEndian.Uint64(kv.Value))
-				if count > 0 {
-					result = append(result, collection)
-				}
+			if count, ok := decodeCollectionCount(kv.Value); ok && count > 0 {
+				result = append(result, collection)
 			}
 		}
 
@@ -77,8 +77,7 @@ func TestDeleteRecordTx(t *testing.T) {
 
 	// delete record using DeleteRecordTx within a transaction
 	err = db.Transact(func(tx fdb.Transaction) error {
-		db.DeleteRecordTx(tx, record.URI())
-		return nil
+		return db.DeleteRecordTx(tx, record.URI())
 	})
 	require.NoError(t, err)
 
@@ -286,6 +285,28 @@ func TestCollectionCounters(t *testing.T) {
 		require.Contains(t, collections, "app.bsky.feed.like")
 	})
 
+	t.Run("counts carry past a single byte", func(t *testing.T) {
+		did := fmt.Sprintf("did:plc:colcount_carry_%d", ts)
+
+		err := db.Transact(func(tx fdb.Transaction) error {
+			for range 300 {
+				db.incrementCollectionCountTx(tx, did, "app.bsky.feed.post")
+			}
+			db.decrementCollectionCountTx(tx, did, "app.bsky.feed.post")
+			return nil
+		})
+		require.NoError(t, err)
+
+		val, err := db.db.ReadTransact(func(tx fdb.ReadTransaction) (any, error) {
+			return tx.Get(pack(db.records.collectionCounts, did, "app.bsky.feed.post")).Get()
+		})
+		require.NoError(t, err)
+
+		count, ok := decodeCollectionCount(val.([]byte))
+		require.True(t, ok)
+		require.Equal(t, int64(299), count)
+	})
+
 	t.Run("decrement to zero hides collection", func(t *testing.T) {
 		did := fmt.Sprintf("did:plc:colcount_dec_%d", ts)
 
@@ -9,7 +9,6 @@ import (
 	"time"
 
 	"github.com/apple/foundationdb/bindings/go/src/fdb"
-	"github.com/bluesky-social/indigo/atproto/atcrypto"
 	"github.com/bluesky-social/indigo/atproto/repo"
 	"github.com/bluesky-social/indigo/atproto/repo/mst"
 	"github.com/bluesky-social/indigo/atproto/syntax"
@@ -29,6 +28,12 @@ import (
 // indicating another server modified the repo concurrently.
 var ErrConcurrentModification = errors.New("concurrent modification detected")
 
+// ErrRepoTakendown is returned when writing to a repo whose account has been taken down
+var ErrRepoTakendown = errors.New("repo is taken down")
+
+// ErrTooManyOps is returned when a single commit would contain more than MaxCommitOps operations
+var ErrTooManyOps = fmt.Errorf("too many operations in a single commit (max %d)", MaxCommitOps)
+
 // cidBuilder is used to compute CIDs for DAG-CBOR encoded data
 var cidBuilder = cid.NewPrefixV1(cid.DagCBOR, multihash.SHA2_256)
 
@@ -84,6 +89,11 @@ func (db *DB) InitRepo(ctx context.Context, actor *types.Actor) (commitCID cid.C
 		rev       string
 	}
 
+	privkey, err := db.SigningKey(ctx, actor)
+	if err != nil {
+		return
+	}
+
 	res, err := transaction(db.db, func(tx fdb.Transaction) (*result, error) {
 		// compute rev for the initial commit
 		clk := syntax.NewTIDClock(0)
@@ -111,10 +121,6 @@ func (db *DB) InitRepo(ctx context.Context, actor *types.Actor) (commitCID cid.C
 		}
 
 		// sign the commit
-		privkey, err := atcrypto.ParsePrivateBytesK256(actor.SigningKey)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse signing key: %w", err)
-		}
 		if err := commit.Sign(privkey); err != nil {
 			return nil, fmt.Errorf("failed to sign commit: %w", err)
 		}
@@ -125,6 +131,9 @@ func (db *DB) InitRepo(ctx context.Context, actor *types.Actor) (commitCID cid.C
 			return nil, fmt.Errorf("failed to store commit: %w", err)
 		}
 
+		// every record of a new repo is indexed by cid as it's written
+		tx.Set(pack(db.records.recordsByCIDIndexed, actor.Did), nil)
+
 		return &result{commitCID: commitCID, rev: commit.Rev}, nil
 	})
 	if err != nil {
@@ -165,6 +174,12 @@ func (db *DB) CreateRecord(
 		metrics.NilString("swap_commit", swapCommit),
 	)
 
+	// decrypt the signing key outside of the transaction
+	privkey, err := db.SigningKey(ctx, actor)
+	if err != nil {
+		return
+	}
+
 	result, err = transaction(db.db, func(tx fdb.Transaction) (*CreateRecordResult, error) {
 		// check swapCommit - verify the current head hasn't been changed by
 		// another process/thread attempting to write concurrently
@@ -173,6 +188,11 @@ func (db *DB) CreateRecord(
 			return nil, fmt.Errorf("failed to get current head: %w", err)
 		}
 
+		// the account may have been taken down since it was authenticated
+		if existing.Takedown != nil {
+			return nil, ErrRepoTakendown
+		}
+
 		if swapCommit != nil && existing.Head != *swapCommit {
 			return nil, ErrConcurrentModification
 		}
@@ -243,10 +263,6 @@ func (db *DB) CreateRecord(
 			Rev:     newRev,
 		}
 
-		privkey, err := atcrypto.ParsePrivateBytesK256(actor.SigningKey)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse signing key: %w", err)
-		}
 		if err := newCommit.Sign(privkey); err != nil {
 			return nil, fmt.Errorf("failed to sign commit: %w", err)
 		}
@@ -266,10 +282,17 @@ func (db *DB) CreateRecord(
 		// update collection count index
 		db.incrementCollectionCountTx(tx, actor.Did, record.Collection)
 
-		// update actor with new head and rev
-		actor.Head = commitCID.String()
-		actor.Rev = newCommit.Rev
-		if err := db.saveActorTx(tx, actor); err != nil {
+		// queue the blocks that are no longer reachable for garbage collection
+		if err := db.queueUnreachableBlocksTx(tx, bs, headCID, commit.Data, *rootCID); err != nil {
+			return nil, fmt.Errorf("failed to collect unreachable blocks: %w", err)
+		}
+
+		// update the actor with the new head and rev. The actor is saved as re-read in this
+		// transaction so that concurrent changes to it, such as a takedown or a key re-wrap,
+		// aren't overwritten with the copy loaded before the write began
+		existing.Head = commitCID.String()
+		existing.Rev = newCommit.Rev
+		if err := db.saveActorTx(tx, existing); err != nil {
 			return nil, fmt.Errorf("failed to save actor: %w", err)
 		}
 
@@ -338,6 +361,12 @@ func (db *DB) PutRecord(
 		metrics.NilString("swap_commit", swapCommit),
 	)
 
+	// decrypt the signing key outside of the transaction
+	privkey, err := db.SigningKey(ctx, actor)
+	if err != nil {
+		return
+	}
+
 	result, err = transaction(db.db, func(tx fdb.Transaction) (*PutRecordResult, error) {
 		// check swapCommit - verify the current head hasn't been changed by
 		// another process/thread attempting to write concurrently
@@ -346,6 +375,11 @@ func (db *DB) PutRecord(
 			return nil, fmt.Errorf("failed to get current head: %w", err)
 		}
 
+		// the account may have been taken down since it was authenticated
+		if existing.Takedown != nil {
+			return nil, ErrRepoTakendown
+		}
+
 		if swapCommit != nil && existing.Head != *swapCommit {
 			return nil, ErrConcurrentModification
 		}
@@ -437,10 +471,6 @@ func (db *DB) PutRecord(
 			Rev:     newRev,
 		}
 
-		privkey, err := atcrypto.ParsePrivateBytesK256(actor.SigningKey)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse signing key: %w", err)
-		}
 		if err := newCommit.Sign(privkey); err != nil {
 			return nil, fmt.Errorf("failed to sign commit: %w", err)
 		}
@@ -462,10 +492,17 @@ func (db *DB) PutRecord(
 			db.incrementCollectionCountTx(tx, actor.Did, record.Collection)
 		}
 
-		// update actor with new head and rev
-		actor.Head = commitCID.String()
-		actor.Rev = newCommit.Rev
-		if err := db.saveActorTx(tx, actor); err != nil {
+		// queue the blocks that are no longer reachable for garbage collection
+		if err := db.queueUnreachableBlocksTx(tx, bs, headCID, commit.Data, *rootCID); err != nil {
+			return nil, fmt.Errorf("failed to collect unreachable blocks: %w", err)
+		}
+
+		// update the actor with the new head and rev. The actor is saved as re-read in this
+		// transaction so that concurrent changes to it, such as a takedown or a key re-wrap,
+		// aren't overwritten with the copy loaded before the write began
+		existing.Head = commitCID.String()
+		existing.Rev = newCommit.Rev
+		if err := db.saveActorTx(tx, existing); err != nil {
 			return nil, fmt.Errorf("failed to save actor: %w", err)
 		}
 
@@ -532,6 +569,12 @@ func (db *DB) DeleteRecord(
 		metrics.NilString("swap_commit", swapCommit),
 	)
 
+	// decrypt the signing key outside of the transaction
+	privkey, err := db.SigningKey(ctx, actor)
+	if err != nil {
+		return
+	}
+
 	result, err = transaction(db.db, func(tx fdb.Transaction) (*DeleteRecordResult, error) {
 		// check swapCommit - verify the current head hasn't changed
 		existing, err := db.getActorByDIDTx(tx, actor.Did)
@@ -539,6 +582,11 @@ func (db *DB) DeleteRecord(
 			return nil, fmt.Errorf("failed to get current head: %w", err)
 		}
 
+		// the account may have been taken down since it was authenticated
+		if existing.Takedown != nil {
+			return nil, ErrRepoTakendown
+		}
+
 		if swapCommit != nil && existing.Head != *swapCommit {
 			return nil, ErrConcurrentModification
 		}
@@ -594,10 +642,6 @@ func (db *DB) DeleteRecord(
 			Rev:     newRev,
 		}
 
-		privkey, err := atcrypto.ParsePrivateBytesK256(actor.SigningKey)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse signing key: %w", err)
-		}
 		if err := newCommit.Sign(privkey); err != nil {
 			return nil, fmt.Errorf("failed to sign commit: %w", err)
 		}
@@ -609,15 +653,24 @@ func (db *DB) DeleteRecord(
 		}
 
 		// delete record from secondary index
-		db.DeleteRecordTx(tx, uri)
+		if err := db.DeleteRecordTx(tx, uri); err != nil {
+			return nil, fmt.Errorf("failed to delete record: %w", err)
+		}
 
 		// update collection count index
 		db.decrementCollectionCountTx(tx, actor.Did, uri.Collection)
 
-		// update actor with new head and rev
-		actor.Head = commitCID.String()
-		actor.Rev = newCommit.Rev
-		if err := db.saveActorTx(tx, actor); err != nil {
+		// queue the blocks that are no longer reachable for garbage collection
+		if err := db.queueUnreachableBlocksTx(tx, bs, headCID, commit.Data, *rootCID); err != nil {
+			return nil, fmt.Errorf("failed to collect unreachable blocks: %w", err)
+		}
+
+		// update the actor with the new head and rev. The actor is saved as re-read in this
+		// transaction so that concurrent changes to it, such as a takedown or a key re-wrap,
+		// aren't overwritten with the copy loaded before the write began
+		existing.Head = commitCID.String()
+		existing.Rev = newCommit.Rev
+		if err := db.saveActorTx(tx, existing); err != nil {
 			return nil, fmt.Errorf("failed to save actor: %w", err)
 		}
 
@@ -696,6 +749,16 @@ func (db *DB) ApplyWrites(
 		metrics.NilString("swap_commit", swapCommit),
 	)
 
+	if len(ops) > MaxCommitOps {
+		return nil, ErrTooManyOps
+	}
+
+	// decrypt the signing key outside of the transaction
+	privkey, err := db.SigningKey(ctx, actor)
+	if err != nil {
+		return
+	}
+
 	result, err = transaction(db.db, func(tx fdb.Transaction) (*ApplyWritesResult, error) {
 		// check swapCommit - verify the current head hasn't been changed
 		existing, err := db.getActorByDIDTx(tx, actor.Did)
@@ -703,6 +766,11 @@ func (db *DB) ApplyWrites(
 			return nil, fmt.Errorf("failed to get current head: %w", err)
 		}
 
+		// the account may have been taken down since it was authenticated
+		if existing.Takedown != nil {
+			return nil, ErrRepoTakendown
+		}
+
 		if swapCommit != nil && existing.Head != *swapCommit {
 			return nil, ErrConcurrentModification
 		}
@@ -866,7 +934,9 @@ func (db *DB) ApplyWrites(
 
 				// delete from secondary index
 				aturi := &at.URI{Repo: actor.Did, Collection: op.Collection, Rkey: op.Rkey}
-				db.DeleteRecordTx(tx, aturi)
+				if err := db.DeleteRecordTx(tx, aturi); err != nil {
+					return nil, fmt.Errorf("failed to delete record: %w", err)
+				}
 
 				db.decrementCollectionCountTx(tx, actor.Did, op.Collection)
 
@@ -899,10 +969,6 @@ func (db *DB) ApplyWrites(
 			Rev:     newRev,
 		}
 
-		privkey, err := atcrypto.ParsePrivateBytesK256(actor.SigningKey)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse signing key: %w", err)
-		}
 		if err := newCommit.Sign(privkey); err != nil {
 			return nil, fmt.Errorf("failed to sign commit: %w", err)
 		}
@@ -913,10 +979,17 @@ func (db *DB) ApplyWrites(
 			return nil, fmt.Errorf("failed to store commit: %w", err)
 		}
 
-		// update actor with new head and rev
-		actor.Head = commitCID.String()
-		actor.Rev = newCommit.Rev
-		if err := db.saveActorTx(tx, actor); err != nil {
+		// queue the blocks that are no longer reachable for garbage collection
+		if err := db.queueUnreachableBlocksTx(tx, bs, headCID, commit.Data, *rootCID); err != nil {
+			return nil, fmt.Errorf("failed to collect unreachable blocks: %w", err)
+		}
+
+		// update the actor with the new head and rev. The actor is saved as re-read in this
+		// transaction so that concurrent changes to it, such as a takedown or a key re-wrap,
+		// aren't overwritten with the copy loaded before the write began
+		existing.Head = commitCID.String()
+		existing.Rev = newCommit.Rev
+		if err := db.saveActorTx(tx, existing); err != nil {
 			return nil, fmt.Errorf("failed to save actor: %w", err)
 		}
 
@@ -0,0 +1,241 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/directory"
+	"github.com/jcalabro/atlas/internal/types"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func validateReport(report *types.Report) error {
+	switch {
+	case report == nil:
+		return fmt.Errorf("report is nil")
+	case report.PdsHost == "":
+		return fmt.Errorf("pds host is required")
+	case report.ReportedBy == "":
+		return fmt.Errorf("reported by is required")
+	case report.ReasonType == "":
+		return fmt.Errorf("reason type is required")
+	case report.SubjectDid == "":
+		return fmt.Errorf("subject did is required")
+	case report.CreatedAt == nil:
+		return fmt.Errorf("created at is required")
+	}
+
+	return nil
+}
+
+func (db *DB) getReportTx(tx fdb.ReadTransaction, host string, id int64) (*types.Report, error) {
+	buf, err := tx.Get(pack(db.reports.reports, host, id)).Get()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get report: %w", err)
+	}
+	if len(buf) == 0 {
+		return nil, ErrNotFound
+	}
+
+	var report types.Report
+	if err := proto.Unmarshal(buf, &report); err != nil {
+		return nil, fmt.Errorf("failed to protobuf unmarshal report: %w", err)
+	}
+
+	return &report, nil
+}
+
+func (db *DB) saveReportTx(tx fdb.Transaction, report *types.Report) error {
+	buf, err := proto.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to protobuf marshal report: %w", err)
+	}
+
+	tx.Set(pack(db.reports.reports, report.PdsHost, report.Id), buf)
+	if report.ResolvedAt == nil {
+		tx.Set(pack(db.reports.open, report.PdsHost, report.Id), nil)
+	} else {
+		tx.Clear(pack(db.reports.open, report.PdsHost, report.Id))
+	}
+
+	return nil
+}
+
+// CreateReport stores a new moderation report, assigning it the host's next report id
+func (db *DB) CreateReport(ctx context.Context, report *types.Report) (err error) {
+	_, span, done := db.observe(ctx, "CreateReport")
+	defer func() { done(err) }()
+
+	if err = validateReport(report); err != nil {
+		err = fmt.Errorf("invalid report: %w", err)
+		return
+	}
+
+	span.SetAttributes(
+		attribute.String("pds_host", report.PdsHost),
+		attribute.String("reported_by", report.ReportedBy),
+		attribute.String("reason_type", report.ReasonType),
+	)
+
+	id, err := transaction(db.db, func(tx fdb.Transaction) (int64, error) {
+		key := pack(db.reports.lastIDs, report.PdsHost)
+		val, err := tx.Get(key).Get()
+		if err != nil {
+			return 0, fmt.Errorf("failed to get last report id: %w", err)
+		}
+
+		var id int64 = 1
+		if len(val) == 8 {
+			id = int64(binary.BigEndian.Uint64(val)) + 1
+		}
+		tx.Set(key, binary.BigEndian.AppendUint64(nil, uint64(id)))
+
+		stored := proto.Clone(report).(*types.Report)
+		stored.Id = id
+		return id, db.saveReportTx(tx, stored)
+	})
+	if err != nil {
+		return
+	}
+
+	report.Id = id
+	span.SetAttributes(attribute.Int64("id", id))
+	return
+}
+
+// GetReport returns one of the host's reports
+func (db *DB) GetReport(ctx context.Context, host string, id int64) (report *types.Report, err error) {
+	_, span, done := db.observe(ctx, "GetReport")
+	defer func() { done(err) }()
+
+	span.SetAttributes(attribute.String("pds_host", host), attribute.Int64("id", id))
+
+	report, err = readTransaction(db.db, func(tx fdb.ReadTransaction) (*types.Report, error) {
+		return db.getReportTx(tx, host, id)
+	})
+
+	return
+}
+
+// ListReports lists the host's reports in the order they were made, optionally only those that
+// haven't been resolved. The cursor is the id of the last report on the previous page, and a next
+// cursor of 0 means there are no more reports.
+func (db *DB) ListReports(
+	ctx context.Context,
+	host string,
+	openOnly bool,
+	cursor int64,
+	limit int,
+) (reports []*types.Report, nextCursor int64, err error) {
+	_, span, done := db.observe(ctx, "ListReports")
+	defer func() { done(err) }()
+
+	span.SetAttributes(
+		attribute.String("pds_host", host),
+		attribute.Bool("open_only", openOnly),
+		attribute.Int64("cursor", cursor),
+		attribute.Int("limit", limit),
+	)
+
+	dir := db.reports.reports
+	if openOnly {
+		dir = db.reports.open
+	}
+
+	reports, err = readTransaction(db.db, func(tx fdb.ReadTransaction) ([]*types.Report, error) {
+		kr, err := reportRange(dir, host, cursor)
+		if err != nil {
+			return nil, err
+		}
+
+		var ids []int64
+		iter := tx.GetRange(kr, fdb.RangeOptions{Limit: limit + 1}).Iterator()
+		for iter.Advance() {
+			kv, err := iter.Get()
+			if err != nil {
+				return nil, fmt.Errorf("failed to iterate reports: %w", err)
+			}
+
+			tup, err := dir.Unpack(kv.Key)
+			if err != nil {
+				return nil, fmt.Errorf("failed to unpack report key: %w", err)
+			}
+			if len(tup) != 2 {
+				return nil, fmt.Errorf("invalid report key length %d", len(tup))
+			}
+
+			id, ok := tup[1].(int64)
+			if !ok {
+				return nil, fmt.Errorf("invalid report id type %T", tup[1])
+			}
+			ids = append(ids, id)
+		}
+
+		out := make([]*types.Report, 0, len(ids))
+		for _, id := range ids {
+			report, err := db.getReportTx(tx, host, id)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, report)
+		}
+
+		return out, nil
+	})
+	if err != nil {
+		return
+	}
+
+	if len(reports) > limit {
+		reports = reports[:limit]
+		nextCursor = reports[limit-1].Id
+	}
+
+	return
+}
+
+// reportRange returns the range of the host's reports in dir that come after the cursor
+func reportRange(dir directory.DirectorySubspace, host string, cursor int64) (fdb.KeyRange, error) {
+	kr, err := fdb.PrefixRange(pack(dir, host))
+	if err != nil {
+		return fdb.KeyRange{}, fmt.Errorf("failed to create reports range: %w", err)
+	}
+
+	if cursor > 0 {
+		kr.Begin = fdb.Key(append(pack(dir, host, cursor), 0x00))
+	}
+
+	return kr, nil
+}
+
+// ResolveReport marks one of the host's reports as resolved, removing it from the open queue.
+// Resolving a report again replaces its resolution.
+func (db *DB) ResolveReport(ctx context.Context, host string, id int64, resolvedBy, note string) (report *types.Report, err error) {
+	_, span, done := db.observe(ctx, "ResolveReport")
+	defer func() { done(err) }()
+
+	span.SetAttributes(
+		attribute.String("pds_host", host),
+		attribute.Int64("id", id),
+		attribute.String("resolved_by", resolvedBy),
+	)
+
+	report, err = transaction(db.db, func(tx fdb.Transaction) (*types.Report, error) {
+		report, err := db.getReportTx(tx, host, id)
+		if err != nil {
+			return nil, err
+		}
+
+		report.ResolvedAt = timestamppb.Now()
+		report.ResolvedBy = resolvedBy
+		report.ResolutionNote = note
+
+		return report, db.saveReportTx(tx, report)
+	})
+
+	return
+}
@@ -0,0 +1,111 @@
+package db
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jcalabro/atlas/internal/types"
+	"github.com/jcalabro/atlas/internal/util"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestValidateReport(t *testing.T) {
+	t.Parallel()
+
+	valid := func() *types.Report {
+		return &types.Report{
+			PdsHost:    testPDSHost,
+			ReportedBy: "did:plc:reporter",
+			ReasonType: "com.atproto.moderation.defs#reasonSpam",
+			SubjectDid: "did:plc:spammer",
+			CreatedAt:  timestamppb.Now(),
+		}
+	}
+	require.NoError(t, validateReport(valid()))
+	require.Error(t, validateReport(nil))
+
+	for _, mutate := range []func(*types.Report){
+		func(r *types.Report) { r.PdsHost = "" },
+		func(r *types.Report) { r.ReportedBy = "" },
+		func(r *types.Report) { r.ReasonType = "" },
+		func(r *types.Report) { r.SubjectDid = "" },
+		func(r *types.Report) { r.CreatedAt = nil },
+	} {
+		report := valid()
+		mutate(report)
+		require.Error(t, validateReport(report))
+	}
+}
+
+func TestReports(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	db := testDB(t)
+
+	host := "reports-" + strings.ToLower(util.RandString(8)) + ".dev.atlaspds.dev"
+	otherHost := "other-" + host
+
+	for ndx := range 5 {
+		report := &types.Report{
+			PdsHost:    host,
+			ReportedBy: "did:plc:reporter",
+			ReasonType: "com.atproto.moderation.defs#reasonSpam",
+			SubjectDid: "did:plc:spammer",
+			CreatedAt:  timestamppb.Now(),
+		}
+		require.NoError(t, db.CreateReport(ctx, report))
+		require.Equal(t, int64(ndx+1), report.Id)
+	}
+
+	// ids are assigned per host
+	other := &types.Report{
+		PdsHost:    otherHost,
+		ReportedBy: "did:plc:reporter",
+		ReasonType: "com.atproto.moderation.defs#reasonOther",
+		SubjectDid: "did:plc:spammer",
+		CreatedAt:  timestamppb.Now(),
+	}
+	require.NoError(t, db.CreateReport(ctx, other))
+	require.Equal(t, int64(1), other.Id)
+
+	report, err := db.GetReport(ctx, host, 3)
+	require.NoError(t, err)
+	require.Equal(t, "did:plc:spammer", report.SubjectDid)
+
+	_, err = db.GetReport(ctx, host, 100)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	reports, next, err := db.ListReports(ctx, host, false, 0, 2)
+	require.NoError(t, err)
+	require.Len(t, reports, 2)
+	require.Equal(t, int64(1), reports[0].Id)
+	require.Equal(t, int64(2), next)
+
+	reports, next, err = db.ListReports(ctx, host, false, next, 10)
+	require.NoError(t, err)
+	require.Len(t, reports, 3)
+	require.Equal(t, int64(3), reports[0].Id)
+	require.Zero(t, next)
+
+	resolved, err := db.ResolveReport(ctx, host, 2, "did:plc:admin", "removed the posts")
+	require.NoError(t, err)
+	require.NotNil(t, resolved.ResolvedAt)
+	require.Equal(t, "did:plc:admin", resolved.ResolvedBy)
+
+	_, err = db.ResolveReport(ctx, host, 100, "did:plc:admin", "")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	reports, _, err = db.ListReports(ctx, host, true, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, reports, 4)
+	for _, report := range reports {
+		require.NotEqual(t, int64(2), report.Id)
+	}
+
+	// resolved reports are still listed when not filtering for open ones
+	reports, _, err = db.ListReports(ctx, host, false, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, reports, 5)
+	require.Equal(t, "removed the posts", reports[1].ResolutionNote)
+}
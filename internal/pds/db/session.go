@@ -0,0 +1,459 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/jcalabro/atlas/internal/types"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/protobuf/proto"
+)
+
+// sessionSweepBatch bounds the number of expired sessions deleted in a single transaction
+const sessionSweepBatch = 500
+
+var (
+	// ErrSessionExpired is returned when refreshing with a token that is past its expiry
+	ErrSessionExpired = errors.New("refresh token expired")
+
+	// ErrRefreshTokenReused is returned when a refresh token that was already exchanged is used
+	// again. The token's whole family has been revoked by the time it's returned.
+	ErrRefreshTokenReused = errors.New("refresh token was already used")
+)
+
+// HashRefreshToken returns the digest under which a refresh token is stored
+func HashRefreshToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+func validateSession(s *types.RefreshSession) error {
+	switch {
+	case s == nil:
+		return fmt.Errorf("session is nil")
+	case s.Did == "":
+		return fmt.Errorf("did is required")
+	case s.Jti == "":
+		return fmt.Errorf("jti is required")
+	case s.Family == "":
+		return fmt.Errorf("family is required")
+	case len(s.TokenHash) == 0:
+		return fmt.Errorf("token hash is required")
+	case s.ExpiresAt == nil:
+		return fmt.Errorf("expiry is required")
+	}
+
+	return nil
+}
+
+// CreateSession stores a newly issued refresh token
+func (db *DB) CreateSession(ctx context.Context, session *types.RefreshSession) (err error) {
+	_, span, done := db.observe(ctx, "CreateSession")
+	defer func() { done(err) }()
+
+	span.SetAttributes(
+		attribute.String("did", session.GetDid()),
+		attribute.String("family", session.GetFamily()),
+	)
+
+	if err = validateSession(session); err != nil {
+		err = fmt.Errorf("invalid session: %w", err)
+		return
+	}
+
+	_, err = transaction(db.db, func(tx fdb.Transaction) (any, error) {
+		return nil, db.saveSessionTx(tx, session)
+	})
+
+	return
+}
+
+func (db *DB) saveSessionTx(tx fdb.Transaction, session *types.RefreshSession) error {
+	buf, err := proto.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("failed to protobuf marshal session: %w", err)
+	}
+
+	tx.Set(pack(db.sessions.sessions, session.Did, session.Jti), buf)
+	tx.Set(pack(db.sessions.expiry, session.ExpiresAt.AsTime().UnixMicro(), session.Did, session.Jti), nil)
+
+	return nil
+}
+
+func (db *DB) clearSessionTx(tx fdb.Transaction, session *types.RefreshSession) {
+	tx.Clear(pack(db.sessions.sessions, session.Did, session.Jti))
+	tx.Clear(pack(db.sessions.expiry, session.ExpiresAt.AsTime().UnixMicro(), session.Did, session.Jti))
+}
+
+func (db *DB) getSessionTx(tx fdb.ReadTransaction, did, jti string) (*types.RefreshSession, error) {
+	buf, err := tx.Get(pack(db.sessions.sessions, did, jti)).Get()
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) == 0 {
+		return nil, nil
+	}
+
+	var session types.RefreshSession
+	if err := proto.Unmarshal(buf, &session); err != nil {
+		return nil, fmt.Errorf("failed to protobuf unmarshal session: %w", err)
+	}
+
+	return &session, nil
+}
+
+// listSessionsTx returns every session of the actor, including rotated and expired ones
+func (db *DB) listSessionsTx(tx fdb.ReadTransaction, did string) ([]*types.RefreshSession, error) {
+	kr, err := fdb.PrefixRange(pack(db.sessions.sessions, did))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sessions range: %w", err)
+	}
+
+	kvs, err := tx.GetRange(kr, fdb.RangeOptions{}).GetSliceWithError()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+
+	sessions := make([]*types.RefreshSession, 0, len(kvs))
+	for _, kv := range kvs {
+		var session types.RefreshSession
+		if err := proto.Unmarshal(kv.Value, &session); err != nil {
+			return nil, fmt.Errorf("failed to protobuf unmarshal session: %w", err)
+		}
+		sessions = append(sessions, &session)
+	}
+
+	return sessions, nil
+}
+
+// clearSessionsTx deletes every session of the actor
+func (db *DB) clearSessionsTx(tx fdb.Transaction, did string) error {
+	sessions, err := db.listSessionsTx(tx, did)
+	if err != nil {
+		return err
+	}
+
+	for _, session := range sessions {
+		db.clearSessionTx(tx, session)
+	}
+
+	return nil
+}
+
+// GetSession returns the session with the given jti
+func (db *DB) GetSession(ctx context.Context, did, jti string) (session *types.RefreshSession, err error) {
+	_, span, done := db.observe(ctx, "GetSession")
+	defer func() { done(err) }()
+
+	span.SetAttributes(attribute.String("did", did))
+
+	session = &types.RefreshSession{}
+	err = readProto(db.db, session, func(tx fdb.ReadTransaction) ([]byte, error) {
+		return tx.Get(pack(db.sessions.sessions, did, jti)).Get()
+	})
+	if err != nil {
+		session = nil
+	}
+
+	return
+}
+
+// RotateSession exchanges the refresh token identified by (did, jti) for next, which must be in the
+// same family. The presented token must match the stored hash and must not be expired.
+//
+// Presenting a token that was already rotated means it was leaked or replayed, so every token in
+// its family is revoked and ErrRefreshTokenReused is returned.
+func (db *DB) RotateSession(
+	ctx context.Context,
+	did, jti string,
+	tokenHash []byte,
+	next *types.RefreshSession,
+) (err error) {
+	_, span, done := db.observe(ctx, "RotateSession")
+	defer func() { done(err) }()
+
+	span.SetAttributes(attribute.String("did", did))
+
+	if err = validateSession(next); err != nil {
+		err = fmt.Errorf("invalid session: %w", err)
+		return
+	}
+
+	// the family is revoked in a committed transaction, so reuse is reported after it returns
+	var reused bool
+	reused, err = transaction(db.db, func(tx fdb.Transaction) (bool, error) {
+		session, err := db.getSessionTx(tx, did, jti)
+		if err != nil {
+			return false, fmt.Errorf("failed to get session: %w", err)
+		}
+		if session == nil || subtle.ConstantTimeCompare(session.TokenHash, tokenHash) != 1 {
+			return false, ErrNotFound
+		}
+		if session.ExpiresAt.AsTime().Before(time.Now()) {
+			return false, ErrSessionExpired
+		}
+
+		if session.RotatedTo != "" {
+			if _, err := db.revokeFamilyTx(tx, did, session.Family); err != nil {
+				return false, err
+			}
+			return true, nil
+		}
+
+		if next.Family != session.Family {
+			return false, fmt.Errorf("replacement session is in family %q, expected %q", next.Family, session.Family)
+		}
+
+		session.RotatedTo = next.Jti
+		if err := db.saveSessionTx(tx, session); err != nil {
+			return false, err
+		}
+
+		return false, db.saveSessionTx(tx, next)
+	})
+	if err == nil && reused {
+		err = ErrRefreshTokenReused
+	}
+
+	return
+}
+
+// ListSessions returns the actor's active sessions: the latest unexpired token of each family
+func (db *DB) ListSessions(ctx context.Context, did string) (sessions []*types.RefreshSession, err error) {
+	_, span, done := db.observe(ctx, "ListSessions")
+	defer func() { done(err) }()
+
+	span.SetAttributes(attribute.String("did", did))
+	defer func() { span.SetAttributes(attribute.Int("count", len(sessions))) }()
+
+	var all []*types.RefreshSession
+	all, err = readTransaction(db.db, func(tx fdb.ReadTransaction) ([]*types.RefreshSession, error) {
+		return db.listSessionsTx(tx, did)
+	})
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	for _, session := range all {
+		if session.RotatedTo == "" && session.ExpiresAt.AsTime().After(now) {
+			sessions = append(sessions, session)
+		}
+	}
+
+	return
+}
+
+// RevokeSession deletes every token in the given family. Returns ErrNotFound if the actor has no
+// tokens in the family.
+func (db *DB) RevokeSession(ctx context.Context, did, family string) (err error) {
+	_, span, done := db.observe(ctx, "RevokeSession")
+	defer func() { done(err) }()
+
+	span.SetAttributes(
+		attribute.String("did", did),
+		attribute.String("family", family),
+	)
+
+	_, err = transaction(db.db, func(tx fdb.Transaction) (any, error) {
+		revoked, err := db.revokeFamilyTx(tx, did, family)
+		if err != nil {
+			return nil, err
+		}
+		if revoked == 0 {
+			return nil, ErrNotFound
+		}
+		return nil, nil
+	})
+
+	return
+}
+
+func (db *DB) revokeFamilyTx(tx fdb.Transaction, did, family string) (int, error) {
+	sessions, err := db.listSessionsTx(tx, did)
+	if err != nil {
+		return 0, err
+	}
+
+	var revoked int
+	for _, session := range sessions {
+		if session.Family == family {
+			db.clearSessionTx(tx, session)
+			revoked++
+		}
+	}
+
+	return revoked, nil
+}
+
+// MigrateLegacySessions moves the refresh tokens that were stored in plaintext on the actor, before
+// sessions got their own subspace, into hashed sessions. Returns the number of sessions created.
+//
+// Legacy tokens are migrated the next time the actor is saved or authenticates, so sessions from
+// before the cutover keep working until they expire: refresh tokens are exchanged as usual, and
+// access tokens share their refresh token's jti so they're accepted by the session check.
+func (db *DB) MigrateLegacySessions(ctx context.Context, did string) (migrated int, err error) {
+	_, span, done := db.observe(ctx, "MigrateLegacySessions")
+	defer func() { done(err) }()
+
+	span.SetAttributes(attribute.String("did", did))
+	defer func() { span.SetAttributes(attribute.Int("migrated", migrated)) }()
+
+	migrated, err = transaction(db.db, func(tx fdb.Transaction) (int, error) {
+		actor, err := db.getActorByDIDTx(tx, did)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get actor: %w", err)
+		}
+		if actor == nil {
+			return 0, ErrNotFound
+		}
+		if len(actor.RefreshTokens) == 0 { //nolint:staticcheck
+			return 0, nil
+		}
+
+		migrated, err := db.migrateLegacySessionsTx(tx, actor)
+		if err != nil {
+			return 0, err
+		}
+
+		return migrated, db.saveActorTx(tx, actor)
+	})
+
+	return
+}
+
+// migrateLegacySessionsTx creates a session for each of the actor's unexpired legacy refresh tokens
+// and clears them from the actor. The caller must save the actor.
+func (db *DB) migrateLegacySessionsTx(tx fdb.Transaction, actor *types.Actor) (int, error) {
+	legacy := actor.RefreshTokens //nolint:staticcheck
+	actor.RefreshTokens = nil     //nolint:staticcheck
+
+	now := time.Now()
+	var migrated int
+	for _, token := range legacy {
+		if !token.ExpiresAt.AsTime().After(now) {
+			continue
+		}
+
+		// tokens without a jti were never accepted, so there's nothing to keep
+		jti, err := legacyTokenJTI(token.Token)
+		if err != nil {
+			continue
+		}
+
+		existing, err := db.getSessionTx(tx, actor.Did, jti)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get session: %w", err)
+		}
+		if existing != nil {
+			continue
+		}
+
+		session := &types.RefreshSession{
+			Did:             actor.Did,
+			Jti:             jti,
+			Family:          jti,
+			TokenHash:       HashRefreshToken(token.Token),
+			CreatedAt:       token.CreatedAt,
+			ExpiresAt:       token.ExpiresAt,
+			FamilyCreatedAt: token.CreatedAt,
+		}
+		if err := db.saveSessionTx(tx, session); err != nil {
+			return 0, err
+		}
+		migrated++
+	}
+
+	return migrated, nil
+}
+
+// legacyTokenJTI returns the jti claim of a legacy refresh token. The token's signature was
+// checked when it was issued and is checked again whenever it's used, so it's not verified here.
+func legacyTokenJTI(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed token")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("failed to decode token payload: %w", err)
+	}
+
+	var claims struct {
+		JTI string `json:"jti"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", fmt.Errorf("failed to parse token claims: %w", err)
+	}
+	if claims.JTI == "" {
+		return "", fmt.Errorf("token has no jti claim")
+	}
+
+	return claims.JTI, nil
+}
+
+// SweepSessions deletes sessions that expired before the given time. Returns the number of
+// sessions deleted.
+func (db *DB) SweepSessions(ctx context.Context, before time.Time) (deleted int, err error) {
+	_, span, done := db.observe(ctx, "SweepSessions")
+	defer func() { done(err) }()
+
+	span.SetAttributes(attribute.String("before", before.Format(time.RFC3339)))
+	defer func() { span.SetAttributes(attribute.Int("deleted", deleted)) }()
+
+	kr := fdb.KeyRange{
+		Begin: db.sessions.expiry.FDBKey(),
+		End:   pack(db.sessions.expiry, before.UnixMicro()),
+	}
+
+	for {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+
+		var n int
+		n, err = transaction(db.db, func(tx fdb.Transaction) (int, error) {
+			kvs, err := tx.GetRange(kr, fdb.RangeOptions{Limit: sessionSweepBatch}).GetSliceWithError()
+			if err != nil {
+				return 0, fmt.Errorf("failed to read session expiry index: %w", err)
+			}
+
+			for _, kv := range kvs {
+				tup, err := db.sessions.expiry.Unpack(kv.Key)
+				if err != nil {
+					return 0, fmt.Errorf("failed to unpack session expiry key: %w", err)
+				}
+
+				tx.Clear(kv.Key)
+				if len(tup) < 3 {
+					continue
+				}
+				did, ok1 := tup[1].(string)
+				jti, ok2 := tup[2].(string)
+				if !ok1 || !ok2 {
+					continue
+				}
+				tx.Clear(pack(db.sessions.sessions, did, jti))
+			}
+
+			return len(kvs), nil
+		})
+		if err != nil {
+			return
+		}
+
+		deleted += n
+		if n < sessionSweepBatch {
+			return
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/google/uuid"
+	"github.com/jcalabro/atlas/internal/types"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestSessions(t *testing.T) {
+	t.Parallel()
+	db := testDB(t)
+
+	newSession := func(did, family string, expiresIn time.Duration) *types.RefreshSession {
+		jti := uuid.NewString()
+		if family == "" {
+			family = jti
+		}
+		return &types.RefreshSession{
+			Did:             did,
+			Jti:             jti,
+			Family:          family,
+			TokenHash:       []byte("hash-" + jti),
+			CreatedAt:       timestamppb.Now(),
+			ExpiresAt:       timestamppb.New(time.Now().Add(expiresIn)),
+			FamilyCreatedAt: timestamppb.Now(),
+		}
+	}
+
+	t.Run("rotates within a family", func(t *testing.T) {
+		t.Parallel()
+		ctx := t.Context()
+		did := "did:plc:sessions1"
+
+		first := newSession(did, "", time.Hour)
+		require.NoError(t, db.CreateSession(ctx, first))
+
+		second := newSession(did, first.Family, time.Hour)
+		require.NoError(t, db.RotateSession(ctx, did, first.Jti, first.TokenHash, second))
+
+		got, err := db.GetSession(ctx, did, first.Jti)
+		require.NoError(t, err)
+		require.Equal(t, second.Jti, got.RotatedTo)
+
+		sessions, err := db.ListSessions(ctx, did)
+		require.NoError(t, err)
+		require.Len(t, sessions, 1)
+		require.Equal(t, second.Jti, sessions[0].Jti)
+
+		// the hash must match
+		third := newSession(did, first.Family, time.Hour)
+		err = db.RotateSession(ctx, did, second.Jti, []byte("wrong"), third)
+		require.ErrorIs(t, err, ErrNotFound)
+
+		// and the replacement must continue the family
+		err = db.RotateSession(ctx, did, second.Jti, second.TokenHash, newSession(did, "", time.Hour))
+		require.Error(t, err)
+	})
+
+	t.Run("reuse revokes the family", func(t *testing.T) {
+		t.Parallel()
+		ctx := t.Context()
+		did := "did:plc:sessions2"
+
+		first := newSession(did, "", time.Hour)
+		require.NoError(t, db.CreateSession(ctx, first))
+		other := newSession(did, "", time.Hour)
+		require.NoError(t, db.CreateSession(ctx, other))
+
+		second := newSession(did, first.Family, time.Hour)
+		require.NoError(t, db.RotateSession(ctx, did, first.Jti, first.TokenHash, second))
+
+		err := db.RotateSession(ctx, did, first.Jti, first.TokenHash, newSession(did, first.Family, time.Hour))
+		require.ErrorIs(t, err, ErrRefreshTokenReused)
+
+		_, err = db.GetSession(ctx, did, second.Jti)
+		require.ErrorIs(t, err, ErrNotFound)
+
+		sessions, err := db.ListSessions(ctx, did)
+		require.NoError(t, err)
+		require.Len(t, sessions, 1)
+		require.Equal(t, other.Jti, sessions[0].Jti)
+	})
+
+	t.Run("rejects expired tokens", func(t *testing.T) {
+		t.Parallel()
+		ctx := t.Context()
+		did := "did:plc:sessions3"
+
+		expired := newSession(did, "", -time.Minute)
+		require.NoError(t, db.CreateSession(ctx, expired))
+
+		err := db.RotateSession(ctx, did, expired.Jti, expired.TokenHash, newSession(did, expired.Family, time.Hour))
+		require.ErrorIs(t, err, ErrSessionExpired)
+
+		sessions, err := db.ListSessions(ctx, did)
+		require.NoError(t, err)
+		require.Empty(t, sessions)
+	})
+
+	t.Run("revokes sessions", func(t *testing.T) {
+		t.Parallel()
+		ctx := t.Context()
+		did := "did:plc:sessions4"
+
+		first := newSession(did, "", time.Hour)
+		require.NoError(t, db.CreateSession(ctx, first))
+
+		require.NoError(t, db.RevokeSession(ctx, did, first.Family))
+		require.ErrorIs(t, db.RevokeSession(ctx, did, first.Family), ErrNotFound)
+
+		_, err := db.GetSession(ctx, did, first.Jti)
+		require.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("sweeps expired sessions", func(t *testing.T) {
+		t.Parallel()
+		ctx := t.Context()
+		did := "did:plc:sessions5"
+
+		expired := newSession(did, "", -time.Hour)
+		require.NoError(t, db.CreateSession(ctx, expired))
+		live := newSession(did, "", time.Hour)
+		require.NoError(t, db.CreateSession(ctx, live))
+
+		deleted, err := db.SweepSessions(ctx, time.Now())
+		require.NoError(t, err)
+		require.GreaterOrEqual(t, deleted, 1)
+
+		_, err = db.GetSession(ctx, did, expired.Jti)
+		require.ErrorIs(t, err, ErrNotFound)
+		_, err = db.GetSession(ctx, did, live.Jti)
+		require.NoError(t, err)
+	})
+
+	t.Run("validates sessions", func(t *testing.T) {
+		t.Parallel()
+
+		err := db.CreateSession(t.Context(), &types.RefreshSession{Did: "did:plc:sessions6"})
+		require.Error(t, err)
+	})
+}
+
+// legacyToken returns a token with the given jti in the format issued before sessions got their own
+// subspace. It's unsigned since only its claims are read during migration.
+func legacyToken(t *testing.T, jti string) string {
+	t.Helper()
+
+	payload, err := json.Marshal(map[string]any{"scope": "com.atproto.refresh", "jti": jti})
+	require.NoError(t, err)
+
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(`{"alg":"ES256","typ":"JWT"}`)) + "." + enc.EncodeToString(payload) + ".sig"
+}
+
+func TestLegacyTokenJTI(t *testing.T) {
+	t.Parallel()
+
+	jti, err := legacyTokenJTI(legacyToken(t, "legacy-jti"))
+	require.NoError(t, err)
+	require.Equal(t, "legacy-jti", jti)
+
+	_, err = legacyTokenJTI(legacyToken(t, ""))
+	require.ErrorContains(t, err, "no jti")
+
+	_, err = legacyTokenJTI("not-a-token")
+	require.ErrorContains(t, err, "malformed")
+
+	_, err = legacyTokenJTI("a.!!!.c")
+	require.Error(t, err)
+}
+
+func TestMigrateLegacySessions(t *testing.T) {
+	t.Parallel()
+	db := testDB(t)
+
+	// saveLegacyActor writes the actor as it was stored before sessions got their own subspace
+	saveLegacyActor := func(t *testing.T, actor *types.Actor, tokens ...*types.RefreshToken) {
+		t.Helper()
+
+		actor.RefreshTokens = tokens //nolint:staticcheck
+		buf, err := proto.Marshal(actor)
+		require.NoError(t, err)
+
+		_, err = transaction(db.db, func(tx fdb.Transaction) (any, error) {
+			tx.Set(pack(db.actors.actors, actor.Did), buf)
+			return nil, nil
+		})
+		require.NoError(t, err)
+	}
+
+	newToken := func(t *testing.T, jti string, expiresIn time.Duration) *types.RefreshToken {
+		t.Helper()
+		return &types.RefreshToken{
+			Token:     legacyToken(t, jti),
+			CreatedAt: timestamppb.Now(),
+			ExpiresAt: timestamppb.New(time.Now().Add(expiresIn)),
+		}
+	}
+
+	t.Run("moves unexpired tokens to sessions", func(t *testing.T) {
+		t.Parallel()
+		ctx := t.Context()
+
+		actor := newTestActor(t, db, testPDSHost)
+		valid := newToken(t, uuid.NewString(), time.Hour)
+		expired := newToken(t, uuid.NewString(), -time.Hour)
+		saveLegacyActor(t, actor, valid, expired, &types.RefreshToken{
+			Token:     "malformed",
+			ExpiresAt: timestamppb.New(time.Now().Add(time.Hour)),
+		})
+
+		migrated, err := db.MigrateLegacySessions(ctx, actor.Did)
+		require.NoError(t, err)
+		require.Equal(t, 1, migrated)
+
+		jti, err := legacyTokenJTI(valid.Token)
+		require.NoError(t, err)
+		session, err := db.GetSession(ctx, actor.Did, jti)
+		require.NoError(t, err)
+		require.Equal(t, jti, session.Family)
+		require.Equal(t, HashRefreshToken(valid.Token), session.TokenHash)
+		require.True(t, valid.ExpiresAt.AsTime().Equal(session.ExpiresAt.AsTime()))
+
+		// the legacy token can be exchanged like any other
+		next := newTestSession(actor.Did)
+		next.Family = jti
+		require.NoError(t, db.RotateSession(ctx, actor.Did, jti, HashRefreshToken(valid.Token), next))
+
+		jti, err = legacyTokenJTI(expired.Token)
+		require.NoError(t, err)
+		_, err = db.GetSession(ctx, actor.Did, jti)
+		require.ErrorIs(t, err, ErrNotFound)
+
+		got, err := db.GetActorByDID(ctx, actor.Did)
+		require.NoError(t, err)
+		require.Empty(t, got.RefreshTokens) //nolint:staticcheck
+
+		// migrating again is a no-op
+		migrated, err = db.MigrateLegacySessions(ctx, actor.Did)
+		require.NoError(t, err)
+		require.Zero(t, migrated)
+	})
+
+	t.Run("saving the actor migrates its tokens", func(t *testing.T) {
+		t.Parallel()
+		ctx := t.Context()
+
+		actor := newTestActor(t, db, testPDSHost)
+		jti := uuid.NewString()
+		saveLegacyActor(t, actor, newToken(t, jti, time.Hour))
+
+		legacy, err := db.GetActorByDID(ctx, actor.Did)
+		require.NoError(t, err)
+		require.Len(t, legacy.RefreshTokens, 1) //nolint:staticcheck
+		require.NoError(t, db.SaveActor(ctx, legacy))
+
+		_, err = db.GetSession(ctx, actor.Did, jti)
+		require.NoError(t, err)
+	})
+
+	t.Run("a password change revokes migrated sessions", func(t *testing.T) {
+		t.Parallel()
+		ctx := t.Context()
+
+		actor := newTestActor(t, db, testPDSHost)
+		jti := uuid.NewString()
+		saveLegacyActor(t, actor, newToken(t, jti, time.Hour))
+
+		require.NoError(t, db.UpdateActorPassword(ctx, actor.Did, []byte("new-hash")))
+		_, err := db.GetSession(ctx, actor.Did, jti)
+		require.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := db.MigrateLegacySessions(t.Context(), "did:plc:legacynotfound")
+		require.ErrorIs(t, err, ErrNotFound)
+	})
+}
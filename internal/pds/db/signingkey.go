@@ -0,0 +1,172 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/ipfs/go-cid"
+	"github.com/jcalabro/atlas/internal/types"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var ErrNoPendingSigningKey = errors.New("no signing key rotation in progress")
+
+// PrepareSigningKeyRotation starts a signing key rotation by storing the given key as the actor's
+// pending signing key. The key is either wrapped, or plain if encryption isn't enabled for the
+// actor's host. If a rotation is already in progress, the existing pending key is kept instead so
+// that an interrupted rotation resumes with the key that may have already been published to the
+// DID document. Returns the updated actor.
+func (db *DB) PrepareSigningKeyRotation(
+	ctx context.Context,
+	did string,
+	wrapped *types.WrappedKey,
+	plain []byte,
+) (actor *types.Actor, err error) {
+	_, span, done := db.observe(ctx, "PrepareSigningKeyRotation")
+	defer func() { done(err) }()
+
+	span.SetAttributes(attribute.String("did", did))
+
+	if _, err = syntax.ParseDID(did); err != nil {
+		err = fmt.Errorf("invalid did: %w", err)
+		return
+	}
+
+	if (wrapped == nil) == (len(plain) == 0) {
+		err = fmt.Errorf("exactly one of a wrapped or plain key is required")
+		return
+	}
+
+	var resumed bool
+	actor, err = transaction(db.db, func(tx fdb.Transaction) (*types.Actor, error) {
+		actor, err := db.getActorByDIDTx(tx, did)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get actor: %w", err)
+		}
+		if actor == nil {
+			return nil, ErrNotFound
+		}
+
+		resumed = actor.WrappedPendingSigningKey != nil || len(actor.PendingSigningKey) > 0
+		if resumed {
+			return actor, nil
+		}
+
+		actor.WrappedPendingSigningKey = wrapped
+		actor.PendingSigningKey = plain
+		if err := db.saveActorTx(tx, actor); err != nil {
+			return nil, fmt.Errorf("failed to save actor: %w", err)
+		}
+
+		return actor, nil
+	})
+
+	span.SetAttributes(attribute.Bool("resumed", resumed))
+	return
+}
+
+// RotateSigningKeyResult contains the new head written by RotateSigningKey
+type RotateSigningKeyResult struct {
+	CommitCID cid.Cid
+	Rev       string
+}
+
+// RotateSigningKey completes a signing key rotation started by PrepareSigningKeyRotation. The
+// pending key becomes the actor's signing key, the previous key is retired for the grace window,
+// and the current head is re-signed with the new key, keeping its prev. A sync event is written so
+// that consumers resync from the new commit. Retired keys whose grace window has passed are dropped.
+//
+// This must only be called once the new key has been published to the actor's DID document, and
+// after an identity event has been written so that consumers refresh their copy of it.
+func (db *DB) RotateSigningKey(ctx context.Context, did string, grace time.Duration) (res *RotateSigningKeyResult, err error) {
+	_, span, done := db.observe(ctx, "RotateSigningKey")
+	defer func() { done(err) }()
+
+	span.SetAttributes(
+		attribute.String("did", did),
+		attribute.String("grace", grace.String()),
+	)
+
+	if _, err = syntax.ParseDID(did); err != nil {
+		err = fmt.Errorf("invalid did: %w", err)
+		return
+	}
+
+	for attempt := 1; ; attempt++ {
+		res, err = db.rotateSigningKey(ctx, did, grace)
+		if !errors.Is(err, ErrConcurrentModification) || attempt == repairMaxAttempts {
+			return
+		}
+	}
+}
+
+// rotateSigningKey opens the pending key before its transaction starts so that a slow KMS doesn't
+// count against FDB's transaction time limit. Returns ErrConcurrentModification if the actor's head
+// or pending key changes in the meantime.
+func (db *DB) rotateSigningKey(ctx context.Context, did string, grace time.Duration) (*RotateSigningKeyResult, error) {
+	actor, err := db.GetActorByDID(ctx, did)
+	if err != nil {
+		return nil, err
+	}
+	if actor.WrappedPendingSigningKey == nil && len(actor.PendingSigningKey) == 0 {
+		return nil, ErrNoPendingSigningKey
+	}
+
+	privkey, err := db.PendingSigningKey(ctx, actor)
+	if err != nil {
+		return nil, err
+	}
+
+	return transaction(db.db, func(tx fdb.Transaction) (*RotateSigningKeyResult, error) {
+		existing, err := db.getActorByDIDTx(tx, did)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get actor: %w", err)
+		}
+		if existing == nil {
+			return nil, ErrNotFound
+		}
+		if existing.Head != actor.Head ||
+			!bytes.Equal(existing.PendingSigningKey, actor.PendingSigningKey) ||
+			!proto.Equal(existing.WrappedPendingSigningKey, actor.WrappedPendingSigningKey) {
+			return nil, ErrConcurrentModification
+		}
+
+		now := time.Now()
+		retired := make([]*types.RetiredSigningKey, 0, len(existing.RetiredSigningKeys)+1)
+		for _, key := range existing.RetiredSigningKeys {
+			if key.ExpiresAt.AsTime().After(now) {
+				retired = append(retired, key)
+			}
+		}
+		retired = append(retired, &types.RetiredSigningKey{
+			Key:        existing.SigningKey,
+			WrappedKey: existing.WrappedSigningKey,
+			RetiredAt:  timestamppb.New(now),
+			ExpiresAt:  timestamppb.New(now.Add(grace)),
+		})
+
+		existing.RetiredSigningKeys = retired
+		existing.SigningKey = existing.PendingSigningKey
+		existing.WrappedSigningKey = existing.WrappedPendingSigningKey
+		existing.PendingSigningKey = nil
+		existing.WrappedPendingSigningKey = nil
+
+		// also saves the actor with the new keys
+		commitCID, rev, err := db.resignHeadTx(ctx, tx, existing, privkey, true)
+		if err != nil {
+			return nil, err
+		}
+
+		return &RotateSigningKeyResult{
+			CommitCID: commitCID,
+			Rev:       rev,
+		}, nil
+	})
+}
@@ -0,0 +1,134 @@
+package db
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/bluesky-social/indigo/atproto/repo"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotateSigningKey(t *testing.T) {
+	t.Parallel()
+	db := testDB(t)
+
+	newKey := func(t *testing.T) *atcrypto.PrivateKeyK256 {
+		t.Helper()
+		key, err := atcrypto.GeneratePrivateKeyK256()
+		require.NoError(t, err)
+		return key
+	}
+
+	t.Run("re-signs the head with the new key", func(t *testing.T) {
+		t.Parallel()
+		ctx := t.Context()
+
+		did := "did:plc:rotatekey1"
+		original := testRepoActor(t, db, did)
+		putTestRecord(t, db, did, "3kaaaaaaaaaa2", "one")
+		before := testHead(t, db, did)
+
+		key := newKey(t)
+		prepared, err := db.PrepareSigningKeyRotation(ctx, did, nil, key.Bytes())
+		require.NoError(t, err)
+		require.Equal(t, key.Bytes(), prepared.PendingSigningKey)
+
+		// preparing again resumes with the same key
+		prepared, err = db.PrepareSigningKeyRotation(ctx, did, nil, newKey(t).Bytes())
+		require.NoError(t, err)
+		pending, err := db.PendingSigningKey(ctx, prepared)
+		require.NoError(t, err)
+		require.Equal(t, key.Bytes(), pending.Bytes())
+
+		res, err := db.RotateSigningKey(ctx, did, time.Hour)
+		require.NoError(t, err)
+
+		actor, err := db.GetActorByDID(ctx, did)
+		require.NoError(t, err)
+		require.Equal(t, key.Bytes(), actor.SigningKey)
+		require.Empty(t, actor.PendingSigningKey)
+		require.Len(t, actor.RetiredSigningKeys, 1)
+		require.Equal(t, original.SigningKey, actor.RetiredSigningKeys[0].Key)
+		require.WithinDuration(t, time.Now().Add(time.Hour), actor.RetiredSigningKeys[0].ExpiresAt.AsTime(), time.Minute)
+		require.Equal(t, res.CommitCID.String(), actor.Head)
+
+		blks, err := db.GetBlocks(ctx, did, []cid.Cid{res.CommitCID})
+		require.NoError(t, err)
+		require.Len(t, blks, 1)
+		var commit repo.Commit
+		require.NoError(t, commit.UnmarshalCBOR(bytes.NewReader(blks[0].RawData())))
+
+		pub, err := key.PublicKey()
+		require.NoError(t, err)
+		require.NoError(t, commit.VerifySignature(pub))
+
+		// the re-signed commit replaces the head rather than squashing its history
+		blks, err = db.GetBlocks(ctx, did, []cid.Cid{before})
+		require.NoError(t, err)
+		require.Len(t, blks, 1)
+		var replaced repo.Commit
+		require.NoError(t, replaced.UnmarshalCBOR(bytes.NewReader(blks[0].RawData())))
+		require.NotNil(t, replaced.Prev)
+		require.Equal(t, replaced.Prev, commit.Prev)
+
+		// the old key remains available for its grace window
+		originalKey, err := atcrypto.ParsePrivateBytesK256(original.SigningKey)
+		require.NoError(t, err)
+		originalPub, err := originalKey.PublicKey()
+		require.NoError(t, err)
+		retired, err := db.RetiredSigningKeys(ctx, actor)
+		require.NoError(t, err)
+		require.Len(t, retired, 1)
+		require.True(t, originalPub.Equal(retired[0]))
+
+		// writes continue with the new key
+		putTestRecord(t, db, did, "3kaaaaaaaaab2", "two")
+		check, err := db.CheckRepo(ctx, did, FsckOptions{})
+		require.NoError(t, err)
+		require.True(t, check.OK(), "issues: %+v", check.Issues)
+
+		// there is nothing left to rotate to
+		_, err = db.RotateSigningKey(ctx, did, time.Hour)
+		require.ErrorIs(t, err, ErrNoPendingSigningKey)
+	})
+
+	t.Run("drops expired retired keys", func(t *testing.T) {
+		t.Parallel()
+		ctx := t.Context()
+
+		did := "did:plc:rotatekey2"
+		testRepoActor(t, db, did)
+
+		for range 3 {
+			_, err := db.PrepareSigningKeyRotation(ctx, did, nil, newKey(t).Bytes())
+			require.NoError(t, err)
+			_, err = db.RotateSigningKey(ctx, did, 0)
+			require.NoError(t, err)
+		}
+
+		actor, err := db.GetActorByDID(ctx, did)
+		require.NoError(t, err)
+		require.Len(t, actor.RetiredSigningKeys, 1)
+
+		// the remaining key was retired with no grace window
+		retired, err := db.RetiredSigningKeys(ctx, actor)
+		require.NoError(t, err)
+		require.Empty(t, retired)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := db.PrepareSigningKeyRotation(t.Context(), "not-a-did", nil, newKey(t).Bytes())
+		require.Error(t, err)
+
+		_, err = db.PrepareSigningKeyRotation(t.Context(), "did:plc:rotatekeynotfound", nil, newKey(t).Bytes())
+		require.ErrorIs(t, err, ErrNotFound)
+
+		_, err = db.RotateSigningKey(t.Context(), "did:plc:rotatekeynotfound", time.Hour)
+		require.ErrorIs(t, err, ErrNotFound)
+	})
+}
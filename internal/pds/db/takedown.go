@@ -0,0 +1,228 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/jcalabro/atlas/internal/types"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	takedownKindRecord = "record"
+	takedownKindBlob   = "blob"
+)
+
+// Subject identifies the target of a takedown. An account is identified by its Did alone, a record
+// by its Did, Collection, and Rkey, and a blob by its Did and Cid.
+type Subject struct {
+	Did        string
+	Collection string
+	Rkey       string
+	Cid        []byte
+}
+
+func (s *Subject) isAccount() bool {
+	return s.Collection == "" && s.Rkey == "" && len(s.Cid) == 0
+}
+
+func (s *Subject) validate() error {
+	switch {
+	case s == nil:
+		return fmt.Errorf("subject is nil")
+	case s.Did == "":
+		return fmt.Errorf("did is required")
+	case len(s.Cid) > 0 && (s.Collection != "" || s.Rkey != ""):
+		return fmt.Errorf("subject must be a record or a blob, not both")
+	case (s.Collection == "") != (s.Rkey == ""):
+		return fmt.Errorf("records require both a collection and an rkey")
+	}
+
+	return nil
+}
+
+// takedownKey returns the key of a record or blob takedown
+func (db *DB) takedownKey(s *Subject) fdb.Key {
+	if len(s.Cid) > 0 {
+		return pack(db.takedowns, s.Did, takedownKindBlob, s.Cid)
+	}
+	return pack(db.takedowns, s.Did, takedownKindRecord, s.Collection, s.Rkey)
+}
+
+// subjectKey returns the key of the record or blob that a takedown applies to
+func (db *DB) subjectKey(s *Subject) fdb.Key {
+	if len(s.Cid) > 0 {
+		return pack(db.blobs, s.Did, s.Cid)
+	}
+	return pack(db.records.records, s.Did, s.Collection, s.Rkey)
+}
+
+func (db *DB) getTakedownTx(tx fdb.ReadTransaction, s *Subject) (*types.Takedown, error) {
+	if s.isAccount() {
+		actor, err := db.getActorByDIDTx(tx, s.Did)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get actor: %w", err)
+		}
+		if actor == nil {
+			return nil, ErrNotFound
+		}
+		return actor.Takedown, nil
+	}
+
+	buf, err := tx.Get(db.takedownKey(s)).Get()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get takedown: %w", err)
+	}
+	if len(buf) == 0 {
+		return nil, nil
+	}
+
+	var takedown types.Takedown
+	if err := proto.Unmarshal(buf, &takedown); err != nil {
+		return nil, fmt.Errorf("failed to protobuf unmarshal takedown: %w", err)
+	}
+
+	return &takedown, nil
+}
+
+// SetTakedown takes down the subject, or reverses its takedown if takedown is nil. Taking down a
+// record or blob that doesn't exist fails with ErrNotFound, but reversals always succeed so that
+// stale takedowns can be cleaned up.
+func (db *DB) SetTakedown(ctx context.Context, subject *Subject, takedown *types.Takedown) (err error) {
+	_, span, done := db.observe(ctx, "SetTakedown")
+	defer func() { done(err) }()
+
+	if err = subject.validate(); err != nil {
+		err = fmt.Errorf("invalid subject: %w", err)
+		return
+	}
+
+	span.SetAttributes(
+		attribute.String("did", subject.Did),
+		attribute.String("collection", subject.Collection),
+		attribute.String("rkey", subject.Rkey),
+		attribute.Bool("applied", takedown != nil),
+	)
+
+	_, err = transaction(db.db, func(tx fdb.Transaction) (any, error) {
+		if subject.isAccount() {
+			_, err := db.updateActorTx(tx, subject.Did, func(actor *types.Actor) error {
+				actor.Takedown = takedown
+				return nil
+			})
+			return nil, err
+		}
+
+		key := db.takedownKey(subject)
+		if takedown == nil {
+			tx.Clear(key)
+			return nil, nil
+		}
+
+		buf, err := tx.Get(db.subjectKey(subject)).Get()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get takedown subject: %w", err)
+		}
+		if len(buf) == 0 {
+			return nil, ErrNotFound
+		}
+
+		val, err := proto.Marshal(takedown)
+		if err != nil {
+			return nil, fmt.Errorf("failed to protobuf marshal takedown: %w", err)
+		}
+
+		tx.Set(key, val)
+		return nil, nil
+	})
+
+	return
+}
+
+// GetTakedown returns the takedown applied directly to the subject, or nil if it isn't taken down.
+// Returns ErrNotFound if the subject is an account that doesn't exist.
+func (db *DB) GetTakedown(ctx context.Context, subject *Subject) (takedown *types.Takedown, err error) {
+	_, span, done := db.observe(ctx, "GetTakedown")
+	defer func() { done(err) }()
+
+	if err = subject.validate(); err != nil {
+		err = fmt.Errorf("invalid subject: %w", err)
+		return
+	}
+
+	span.SetAttributes(attribute.String("did", subject.Did))
+
+	takedown, err = readTransaction(db.db, func(tx fdb.ReadTransaction) (*types.Takedown, error) {
+		return db.getTakedownTx(tx, subject)
+	})
+
+	return
+}
+
+// IsTakenDown returns true if the subject or the account that owns it is taken down
+func (db *DB) IsTakenDown(ctx context.Context, subject *Subject) (takenDown bool, err error) {
+	_, span, done := db.observe(ctx, "IsTakenDown")
+	defer func() { done(err) }()
+
+	if err = subject.validate(); err != nil {
+		err = fmt.Errorf("invalid subject: %w", err)
+		return
+	}
+
+	span.SetAttributes(attribute.String("did", subject.Did))
+
+	takenDown, err = readTransaction(db.db, func(tx fdb.ReadTransaction) (bool, error) {
+		account, err := db.getTakedownTx(tx, &Subject{Did: subject.Did})
+		if err != nil {
+			return false, err
+		}
+		if account != nil || subject.isAccount() {
+			return account != nil, nil
+		}
+
+		takedown, err := db.getTakedownTx(tx, subject)
+		if err != nil {
+			return false, err
+		}
+
+		return takedown != nil, nil
+	})
+
+	return
+}
+
+// recordTakedownsTx returns the set of rkeys in the collection that are taken down
+func (db *DB) recordTakedownsTx(tx fdb.ReadTransaction, did, collection string) (map[string]struct{}, error) {
+	kr, err := fdb.PrefixRange(pack(db.takedowns, did, takedownKindRecord, collection))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create takedowns range: %w", err)
+	}
+
+	rkeys := map[string]struct{}{}
+	iter := tx.GetRange(kr, fdb.RangeOptions{}).Iterator()
+	for iter.Advance() {
+		kv, err := iter.Get()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate takedowns: %w", err)
+		}
+
+		tup, err := db.takedowns.Unpack(kv.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unpack takedown key: %w", err)
+		}
+		if len(tup) != 4 {
+			return nil, fmt.Errorf("invalid takedown key length %d", len(tup))
+		}
+
+		rkey, ok := tup[3].(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid takedown rkey type %T", tup[3])
+		}
+
+		rkeys[rkey] = struct{}{}
+	}
+
+	return rkeys, nil
+}
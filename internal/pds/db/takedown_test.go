@@ -0,0 +1,199 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jcalabro/atlas/internal/at"
+	"github.com/jcalabro/atlas/internal/types"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestSubjectValidate(t *testing.T) {
+	t.Parallel()
+
+	require.NoError(t, (&Subject{Did: "did:plc:a"}).validate())
+	require.NoError(t, (&Subject{Did: "did:plc:a", Collection: "app.bsky.feed.post", Rkey: "a"}).validate())
+	require.NoError(t, (&Subject{Did: "did:plc:a", Cid: []byte("cid")}).validate())
+
+	var nilSubject *Subject
+	require.Error(t, nilSubject.validate())
+	require.Error(t, (&Subject{}).validate())
+	require.Error(t, (&Subject{Did: "did:plc:a", Collection: "app.bsky.feed.post"}).validate())
+	require.Error(t, (&Subject{Did: "did:plc:a", Rkey: "a"}).validate())
+	require.Error(t, (&Subject{Did: "did:plc:a", Collection: "app.bsky.feed.post", Rkey: "a", Cid: []byte("cid")}).validate())
+}
+
+func TestAccountTakedown(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	db := testDB(t)
+
+	actor := newTestActor(t, db, testPDSHost)
+	subject := &Subject{Did: actor.Did}
+
+	takedown, err := db.GetTakedown(ctx, subject)
+	require.NoError(t, err)
+	require.Nil(t, takedown)
+
+	require.NoError(t, db.SetTakedown(ctx, subject, &types.Takedown{Ref: "ticket-1", CreatedAt: timestamppb.Now()}))
+
+	takedown, err = db.GetTakedown(ctx, subject)
+	require.NoError(t, err)
+	require.Equal(t, "ticket-1", takedown.Ref)
+
+	updated, err := db.GetActorByDID(ctx, actor.Did)
+	require.NoError(t, err)
+	require.Equal(t, "ticket-1", updated.Takedown.GetRef())
+
+	// the account's records are taken down along with it
+	takenDown, err := db.IsTakenDown(ctx, &Subject{Did: actor.Did, Collection: "app.bsky.feed.post", Rkey: "a"})
+	require.NoError(t, err)
+	require.True(t, takenDown)
+
+	require.NoError(t, db.SetTakedown(ctx, subject, nil))
+
+	takenDown, err = db.IsTakenDown(ctx, subject)
+	require.NoError(t, err)
+	require.False(t, takenDown)
+
+	require.ErrorIs(t, db.SetTakedown(ctx, &Subject{Did: "did:plc:nonexistenttakedown"}, &types.Takedown{}), ErrNotFound)
+
+	_, err = db.IsTakenDown(ctx, &Subject{Did: "did:plc:nonexistenttakedown"})
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestRecordTakedown(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	db := testDB(t)
+
+	actor := newTestActor(t, db, testPDSHost)
+	collection := "app.bsky.feed.post"
+
+	for ndx := range 5 {
+		require.NoError(t, db.SaveRecord(ctx, &types.Record{
+			Did:        actor.Did,
+			Collection: collection,
+			Rkey:       fmt.Sprintf("rkey%d", ndx),
+			Cid:        fmt.Sprintf("cid%d", ndx),
+			Value:      []byte("value"),
+			CreatedAt:  timestamppb.New(time.Now()),
+		}))
+	}
+
+	subject := &Subject{Did: actor.Did, Collection: collection, Rkey: "rkey1"}
+	require.NoError(t, db.SetTakedown(ctx, subject, &types.Takedown{Ref: "spam", CreatedAt: timestamppb.Now()}))
+
+	takenDown, err := db.IsTakenDown(ctx, subject)
+	require.NoError(t, err)
+	require.True(t, takenDown)
+
+	takenDown, err = db.IsTakenDown(ctx, &Subject{Did: actor.Did, Collection: collection, Rkey: "rkey2"})
+	require.NoError(t, err)
+	require.False(t, takenDown)
+
+	// the account itself isn't taken down
+	takenDown, err = db.IsTakenDown(ctx, &Subject{Did: actor.Did})
+	require.NoError(t, err)
+	require.False(t, takenDown)
+
+	// taken down records are skipped without shortening pages
+	result, err := db.ListRecords(ctx, actor.Did, collection, 2, "", false)
+	require.NoError(t, err)
+	require.Len(t, result.Records, 2)
+	require.Equal(t, "rkey0", result.Records[0].Rkey)
+	require.Equal(t, "rkey2", result.Records[1].Rkey)
+	require.Equal(t, "rkey2", result.Cursor)
+
+	result, err = db.ListRecords(ctx, actor.Did, collection, 10, "", true)
+	require.NoError(t, err)
+	require.Len(t, result.Records, 4)
+	require.Empty(t, result.Cursor)
+
+	// records that don't exist can't be taken down
+	missing := &Subject{Did: actor.Did, Collection: collection, Rkey: "missing"}
+	require.ErrorIs(t, db.SetTakedown(ctx, missing, &types.Takedown{}), ErrNotFound)
+
+	require.NoError(t, db.SetTakedown(ctx, subject, nil))
+
+	result, err = db.ListRecords(ctx, actor.Did, collection, 10, "", false)
+	require.NoError(t, err)
+	require.Len(t, result.Records, 5)
+}
+
+func TestBlobTakedown(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	db := testDB(t)
+
+	actor := newTestActor(t, db, testPDSHost)
+	blob := &types.Blob{
+		Did:       actor.Did,
+		Cid:       []byte("blobcid"),
+		MimeType:  "image/png",
+		Size:      10,
+		CreatedAt: timestamppb.Now(),
+	}
+	require.NoError(t, db.SaveBlob(ctx, blob))
+
+	subject := &Subject{Did: actor.Did, Cid: blob.Cid}
+	require.NoError(t, db.SetTakedown(ctx, subject, &types.Takedown{Ref: "copyright", CreatedAt: timestamppb.Now()}))
+
+	takedown, err := db.GetTakedown(ctx, subject)
+	require.NoError(t, err)
+	require.Equal(t, "copyright", takedown.Ref)
+
+	require.ErrorIs(t, db.SetTakedown(ctx, &Subject{Did: actor.Did, Cid: []byte("missing")}, &types.Takedown{}), ErrNotFound)
+
+	// takedowns are removed along with the account
+	require.NoError(t, db.DeleteActor(ctx, actor.Did))
+
+	takedown, err = db.GetTakedown(ctx, subject)
+	require.NoError(t, err)
+	require.Nil(t, takedown)
+}
+
+func TestRepoWriteDuringAccountChange(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	db := testDB(t)
+
+	did := "did:plc:takedownwrite1"
+	testRepoActor(t, db, did)
+	putTestRecord(t, db, did, "3kaaaaaaaaaa2", "one")
+	putTestRecord(t, db, did, "3kaaaaaaaaab2", "two")
+
+	// the account is taken down after the writer loaded it, so the write is rejected
+	stale, err := db.GetActorByDID(ctx, did)
+	require.NoError(t, err)
+	require.NoError(t, db.SetTakedown(ctx, &Subject{Did: did}, &types.Takedown{Ref: "ticket-2", CreatedAt: timestamppb.Now()}))
+
+	_, err = db.DeleteRecord(ctx, stale, &at.URI{Repo: did, Collection: "app.bsky.feed.post", Rkey: "3kaaaaaaaaaa2"}, nil)
+	require.ErrorIs(t, err, ErrRepoTakendown)
+
+	actor, err := db.GetActorByDID(ctx, did)
+	require.NoError(t, err)
+	require.Equal(t, "ticket-2", actor.Takedown.GetRef())
+	require.Equal(t, stale.Head, actor.Head)
+
+	// other changes made while a write is in flight are kept
+	require.NoError(t, db.SetTakedown(ctx, &Subject{Did: did}, nil))
+	stale, err = db.GetActorByDID(ctx, did)
+	require.NoError(t, err)
+
+	require.NoError(t, db.UpdateActorPassword(ctx, did, []byte("new hash")))
+	require.NoError(t, db.DisableActorInvites(ctx, did, "abuse"))
+
+	_, err = db.DeleteRecord(ctx, stale, &at.URI{Repo: did, Collection: "app.bsky.feed.post", Rkey: "3kaaaaaaaaaa2"}, nil)
+	require.NoError(t, err)
+
+	actor, err = db.GetActorByDID(ctx, did)
+	require.NoError(t, err)
+	require.NotEqual(t, stale.Head, actor.Head)
+	require.Equal(t, []byte("new hash"), actor.PasswordHash)
+	require.True(t, actor.InvitesDisabled)
+	require.Equal(t, "abuse", actor.InviteNote)
+}
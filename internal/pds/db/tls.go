@@ -0,0 +1,181 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/jcalabro/atlas/internal/types"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// GetTLSCacheEntry returns an entry of the shared TLS cache, or ErrNotFound
+func (db *DB) GetTLSCacheEntry(ctx context.Context, name string) (entry *types.TLSCacheEntry, err error) {
+	_, span, done := db.observe(ctx, "GetTLSCacheEntry")
+	defer func() { done(err) }()
+
+	span.SetAttributes(attribute.String("name", name))
+
+	var e types.TLSCacheEntry
+	err = readProto(db.db, &e, func(tx fdb.ReadTransaction) ([]byte, error) {
+		return tx.Get(pack(db.tlsCerts.cache, name)).Get()
+	})
+	if err != nil {
+		return
+	}
+
+	entry = &e
+	return
+}
+
+// PutTLSCacheEntry creates or replaces an entry of the shared TLS cache
+func (db *DB) PutTLSCacheEntry(ctx context.Context, name string, entry *types.TLSCacheEntry) (err error) {
+	_, span, done := db.observe(ctx, "PutTLSCacheEntry")
+	defer func() { done(err) }()
+
+	span.SetAttributes(attribute.String("name", name))
+
+	buf, err := proto.Marshal(entry)
+	if err != nil {
+		err = fmt.Errorf("failed to protobuf marshal tls cache entry: %w", err)
+		return
+	}
+
+	_, err = transaction(db.db, func(tx fdb.Transaction) (any, error) {
+		tx.Set(pack(db.tlsCerts.cache, name), buf)
+		return nil, nil
+	})
+	return
+}
+
+// CreateTLSCacheEntry stores an entry of the shared TLS cache unless it already exists, and returns
+// whichever entry is stored, so concurrent creators all end up using the same one
+func (db *DB) CreateTLSCacheEntry(ctx context.Context, name string, entry *types.TLSCacheEntry) (stored *types.TLSCacheEntry, err error) {
+	_, span, done := db.observe(ctx, "CreateTLSCacheEntry")
+	defer func() { done(err) }()
+
+	span.SetAttributes(attribute.String("name", name))
+
+	buf, err := proto.Marshal(entry)
+	if err != nil {
+		err = fmt.Errorf("failed to protobuf marshal tls cache entry: %w", err)
+		return
+	}
+
+	stored, err = transaction(db.db, func(tx fdb.Transaction) (*types.TLSCacheEntry, error) {
+		key := pack(db.tlsCerts.cache, name)
+
+		existing, err := tx.Get(key).Get()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get tls cache entry: %w", err)
+		}
+		if len(existing) == 0 {
+			tx.Set(key, buf)
+			return entry, nil
+		}
+
+		var e types.TLSCacheEntry
+		if err := proto.Unmarshal(existing, &e); err != nil {
+			return nil, fmt.Errorf("failed to protobuf unmarshal tls cache entry: %w", err)
+		}
+		return &e, nil
+	})
+	return
+}
+
+// DeleteTLSCacheEntry removes an entry of the shared TLS cache. Deleting a missing entry is not an error.
+func (db *DB) DeleteTLSCacheEntry(ctx context.Context, name string) (err error) {
+	_, span, done := db.observe(ctx, "DeleteTLSCacheEntry")
+	defer func() { done(err) }()
+
+	span.SetAttributes(attribute.String("name", name))
+
+	_, err = transaction(db.db, func(tx fdb.Transaction) (any, error) {
+		tx.Clear(pack(db.tlsCerts.cache, name))
+		return nil, nil
+	})
+	return
+}
+
+// AcquireTLSLock takes the issuance lock of a certificate for ttl. Returns false if another holder
+// has an unexpired lock. A holder that already has the lock extends it.
+func (db *DB) AcquireTLSLock(ctx context.Context, name, holder string, ttl time.Duration) (acquired bool, err error) {
+	_, span, done := db.observe(ctx, "AcquireTLSLock")
+	defer func() { done(err) }()
+
+	span.SetAttributes(
+		attribute.String("name", name),
+		attribute.String("holder", holder),
+	)
+
+	acquired, err = transaction(db.db, func(tx fdb.Transaction) (bool, error) {
+		key := pack(db.tlsCerts.locks, name)
+
+		buf, err := tx.Get(key).Get()
+		if err != nil {
+			return false, fmt.Errorf("failed to get tls lock: %w", err)
+		}
+
+		now := time.Now()
+		if len(buf) > 0 {
+			var lock types.TLSLock
+			if err := proto.Unmarshal(buf, &lock); err != nil {
+				return false, fmt.Errorf("failed to protobuf unmarshal tls lock: %w", err)
+			}
+			if lock.Holder != holder && lock.ExpiresAt.AsTime().After(now) {
+				return false, nil
+			}
+		}
+
+		buf, err = proto.Marshal(&types.TLSLock{
+			Holder:    holder,
+			ExpiresAt: timestamppb.New(now.Add(ttl)),
+		})
+		if err != nil {
+			return false, fmt.Errorf("failed to protobuf marshal tls lock: %w", err)
+		}
+
+		tx.Set(key, buf)
+		return true, nil
+	})
+
+	span.SetAttributes(attribute.Bool("acquired", acquired))
+	return
+}
+
+// ReleaseTLSLock releases the issuance lock of a certificate if it's held by holder
+func (db *DB) ReleaseTLSLock(ctx context.Context, name, holder string) (err error) {
+	_, span, done := db.observe(ctx, "ReleaseTLSLock")
+	defer func() { done(err) }()
+
+	span.SetAttributes(
+		attribute.String("name", name),
+		attribute.String("holder", holder),
+	)
+
+	_, err = transaction(db.db, func(tx fdb.Transaction) (any, error) {
+		key := pack(db.tlsCerts.locks, name)
+
+		buf, err := tx.Get(key).Get()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get tls lock: %w", err)
+		}
+		if len(buf) == 0 {
+			return nil, nil
+		}
+
+		var lock types.TLSLock
+		if err := proto.Unmarshal(buf, &lock); err != nil {
+			return nil, fmt.Errorf("failed to protobuf unmarshal tls lock: %w", err)
+		}
+		if lock.Holder == holder {
+			tx.Clear(key)
+		}
+
+		return nil, nil
+	})
+	return
+}
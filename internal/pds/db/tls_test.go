@@ -0,0 +1,97 @@
+package db
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jcalabro/atlas/internal/types"
+	"github.com/jcalabro/atlas/internal/util"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestTLSCache(t *testing.T) {
+	t.Parallel()
+
+	db := testDB(t)
+	ctx := t.Context()
+
+	name := "*." + strings.ToLower(util.RandString(12)) + ".example.com"
+
+	_, err := db.GetTLSCacheEntry(ctx, name)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	require.NoError(t, db.PutTLSCacheEntry(ctx, name, &types.TLSCacheEntry{Data: []byte("pem"), UpdatedAt: timestamppb.Now()}))
+
+	entry, err := db.GetTLSCacheEntry(ctx, name)
+	require.NoError(t, err)
+	require.Equal(t, []byte("pem"), entry.Data)
+
+	require.NoError(t, db.DeleteTLSCacheEntry(ctx, name))
+	require.NoError(t, db.DeleteTLSCacheEntry(ctx, name))
+
+	_, err = db.GetTLSCacheEntry(ctx, name)
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestCreateTLSCacheEntry(t *testing.T) {
+	t.Parallel()
+
+	db := testDB(t)
+	ctx := t.Context()
+
+	name := strings.ToLower(util.RandString(12)) + "+key"
+
+	stored, err := db.CreateTLSCacheEntry(ctx, name, &types.TLSCacheEntry{Data: []byte("first"), UpdatedAt: timestamppb.Now()})
+	require.NoError(t, err)
+	require.Equal(t, []byte("first"), stored.Data)
+
+	// a second creator gets the existing entry rather than replacing it
+	stored, err = db.CreateTLSCacheEntry(ctx, name, &types.TLSCacheEntry{Data: []byte("second"), UpdatedAt: timestamppb.Now()})
+	require.NoError(t, err)
+	require.Equal(t, []byte("first"), stored.Data)
+
+	entry, err := db.GetTLSCacheEntry(ctx, name)
+	require.NoError(t, err)
+	require.Equal(t, []byte("first"), entry.Data)
+}
+
+func TestTLSLock(t *testing.T) {
+	t.Parallel()
+
+	db := testDB(t)
+	ctx := t.Context()
+
+	name := "*." + strings.ToLower(util.RandString(12)) + ".example.com"
+
+	acquired, err := db.AcquireTLSLock(ctx, name, "a", time.Minute)
+	require.NoError(t, err)
+	require.True(t, acquired)
+
+	// the holder can extend the lock, but others can't take it
+	acquired, err = db.AcquireTLSLock(ctx, name, "a", time.Minute)
+	require.NoError(t, err)
+	require.True(t, acquired)
+
+	acquired, err = db.AcquireTLSLock(ctx, name, "b", time.Minute)
+	require.NoError(t, err)
+	require.False(t, acquired)
+
+	// only the holder can release it
+	require.NoError(t, db.ReleaseTLSLock(ctx, name, "b"))
+	acquired, err = db.AcquireTLSLock(ctx, name, "b", time.Minute)
+	require.NoError(t, err)
+	require.False(t, acquired)
+
+	require.NoError(t, db.ReleaseTLSLock(ctx, name, "a"))
+	acquired, err = db.AcquireTLSLock(ctx, name, "b", time.Nanosecond)
+	require.NoError(t, err)
+	require.True(t, acquired)
+
+	// expired locks can be taken
+	time.Sleep(time.Millisecond)
+	acquired, err = db.AcquireTLSLock(ctx, name, "a", time.Minute)
+	require.NoError(t, err)
+	require.True(t, acquired)
+}
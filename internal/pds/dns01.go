@@ -0,0 +1,87 @@
+package pds
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// DNSProvider publishes the TXT records that prove control of a domain for ACME DNS-01
+// challenges, which are the only way to get wildcard certificates for user domains
+type DNSProvider interface {
+	// Present creates a TXT record at fqdn with the given value
+	Present(ctx context.Context, fqdn, value string) error
+
+	// CleanUp removes the TXT record created by Present
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+// DNSProviderFactory creates a DNS provider from its config
+type DNSProviderFactory func(cfg *DNS01Config) (DNSProvider, error)
+
+var (
+	dnsProvidersMu sync.RWMutex
+	dnsProviders   = map[string]DNSProviderFactory{
+		"exec": newExecDNSProvider,
+	}
+)
+
+// RegisterDNSProvider makes a DNS provider available to the tls.acme.dns01 config by name. It's
+// meant to be called from an init function of a build that links in a DNS provider's client.
+func RegisterDNSProvider(name string, factory DNSProviderFactory) {
+	dnsProvidersMu.Lock()
+	defer dnsProvidersMu.Unlock()
+
+	if _, ok := dnsProviders[name]; ok {
+		panic(fmt.Sprintf("dns provider %q is already registered", name))
+	}
+	dnsProviders[name] = factory
+}
+
+func loadDNSProvider(cfg *DNS01Config) (DNSProvider, error) {
+	dnsProvidersMu.RLock()
+	factory, ok := dnsProviders[cfg.Provider]
+	names := slices.Sorted(maps.Keys(dnsProviders))
+	dnsProvidersMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown dns provider %q (must be one of %s)", cfg.Provider, strings.Join(names, ", "))
+	}
+
+	return factory(cfg)
+}
+
+// execDNSProvider runs a command to update DNS, so that any DNS host can be used without linking in
+// its client. The command is run with the arguments "present" or "cleanup", then the record's
+// fully qualified name and value, and must exit non-zero on failure.
+type execDNSProvider struct {
+	command []string
+}
+
+func newExecDNSProvider(cfg *DNS01Config) (DNSProvider, error) {
+	if len(cfg.Command) == 0 {
+		return nil, fmt.Errorf("command is required for the exec dns provider")
+	}
+	return &execDNSProvider{command: cfg.Command}, nil
+}
+
+func (p *execDNSProvider) Present(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "present", fqdn, value)
+}
+
+func (p *execDNSProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "cleanup", fqdn, value)
+}
+
+func (p *execDNSProvider) run(ctx context.Context, action, fqdn, value string) error {
+	args := append(slices.Clone(p.command[1:]), action, fqdn, value)
+	out, err := exec.CommandContext(ctx, p.command[0], args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("dns provider command failed to %s %s: %w: %s", action, fqdn, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
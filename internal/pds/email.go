@@ -0,0 +1,53 @@
+package pds
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jcalabro/atlas/internal/mail"
+)
+
+// EmailConfig configures how mail is sent to a host's account holders
+type EmailConfig struct {
+	// Provider is "smtp" or "fake". Email is disabled if it's empty.
+	Provider string `toml:"provider"`
+
+	// SMTPAddr is the host:port of the SMTP relay
+	SMTPAddr string `toml:"smtp_addr"`
+
+	// SMTPUsername authenticates with the relay, with the password read from the environment
+	// variable named by SMTPPasswordEnv
+	SMTPUsername    string `toml:"smtp_username"`
+	SMTPPasswordEnv string `toml:"smtp_password_env"`
+
+	// From is the sender address of outgoing mail
+	From string `toml:"from"`
+}
+
+// loadMailer creates the configured mailer, or returns nil if email is disabled
+func loadMailer(cfg *EmailConfig) (mail.Mailer, error) {
+	switch cfg.Provider {
+	case "":
+		return nil, nil
+	case "smtp":
+		var password string
+		if cfg.SMTPPasswordEnv != "" {
+			val, ok := os.LookupEnv(cfg.SMTPPasswordEnv)
+			if !ok || val == "" {
+				return nil, fmt.Errorf("environment variable %q is not set", cfg.SMTPPasswordEnv)
+			}
+			password = val
+		}
+
+		return mail.NewSMTP(&mail.SMTPArgs{
+			Addr:     cfg.SMTPAddr,
+			Username: cfg.SMTPUsername,
+			Password: password,
+			From:     cfg.From,
+		})
+	case "fake":
+		return &mail.Fake{}, nil
+	default:
+		return nil, fmt.Errorf("unknown provider %q", cfg.Provider)
+	}
+}
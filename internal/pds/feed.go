@@ -50,7 +50,7 @@ func (s *server) handleGetFeed(w http.ResponseWriter, r *http.Request) {
 	var serviceAuthToken string
 	if actor != nil {
 		// create service auth token for the feed generator
-		token, err := createServiceAuthToken(actor, feedGeneratorDID, getFeedSkeletonLxm)
+		token, err := s.createServiceAuthToken(ctx, actor, feedGeneratorDID, getFeedSkeletonLxm)
 		if err != nil {
 			s.log.Error("failed to create service auth token", "err", err, "did", actor.Did)
 			s.internalErr(w, fmt.Errorf("authentication error"))
@@ -284,7 +284,7 @@ func TestCreateServiceAuthToken(t *testing.T) {
 
 		actor, _ := setupTestActor(t, srv, "did:plc:serviceauthtest", "serviceauth@dev.atlaspds.dev", "serviceauth.dev.atlaspds.dev")
 
-		token, err := createServiceAuthToken(actor, "did:web:target.example.com", "app.bsky.feed.getFeedSkeleton")
+		token, err := srv.createServiceAuthToken(t.Context(), actor, "did:web:target.example.com", "app.bsky.feed.getFeedSkeleton")
 		require.NoError(t, err)
 		require.NotEmpty(t, token)
 
@@ -55,6 +55,9 @@ type firehose struct {
 
 	mu          sync.RWMutex
 	subscribers map[*subscriber]struct{}
+
+	// relays is notified of subscribeRepos connections so it can track relay health (may be nil)
+	relays *relayCrawler
 }
 
 // subscriber represents a connected websocket client
@@ -65,6 +68,10 @@ type subscriber struct {
 	events   chan *types.RepoEvent
 	pdsHost  string // empty means all hosts
 	cancelFn context.CancelFunc
+
+	// jetstream is non-nil for subscribers of the JSON jetstream endpoint, and
+	// holds their filters and encoding options
+	jetstream *jetstreamOptions
 }
 
 func newFirehose(log *slog.Logger, db *db.DB) *firehose {
@@ -207,13 +214,24 @@ func (f *firehose) Subscribe(ctx context.Context, w http.ResponseWriter, r *http
 		cancelFn: cancel,
 	}
 
-	f.log.Info("new subscriber connected", "id", sub.id, "pds_host", pdsHost, "cursor", cursorParam)
+	f.log.Info("new subscriber connected", "id", sub.id, "pds_host", pdsHost, "cursor", cursorParam, "user_agent", r.UserAgent())
 	pdsmetrics.FirehoseSubscribers.WithLabelValues(pdsHost).Inc()
 	defer func() {
 		pdsmetrics.FirehoseSubscribers.WithLabelValues(pdsHost).Dec()
 		f.log.Info("subscriber disconnected", "id", sub.id)
 	}()
 
+	defer f.relays.subscriberConnected(pdsHost, r)()
+
+	return f.stream(subCtx, sub, cursor)
+}
+
+// stream replays events from the cursor (if any), then registers the subscriber for live
+// events and writes them to the websocket until the connection is closed
+func (f *firehose) stream(subCtx context.Context, sub *subscriber, cursor []byte) error {
+	conn := sub.conn
+	cancel := sub.cancelFn
+
 	// replay events from cursor if specified
 	if cursor != nil {
 		if err := f.replayEvents(subCtx, sub, cursor); err != nil {
@@ -316,6 +334,10 @@ func (f *firehose) replayEvents(ctx context.Context, sub *subscriber, cursor []b
 
 // sendEvent encodes and sends a single event to a subscriber
 func (f *firehose) sendEvent(sub *subscriber, event *types.RepoEvent) error {
+	if sub.jetstream != nil {
+		return f.sendJetstreamEvent(sub, event)
+	}
+
 	var (
 		msg     []byte
 		msgType string
@@ -330,6 +352,9 @@ func (f *firehose) sendEvent(sub *subscriber, event *types.RepoEvent) error {
 	case types.EventType_EVENT_TYPE_ACCOUNT:
 		msg, err = encodeAccountEvent(event)
 		msgType = "account"
+	case types.EventType_EVENT_TYPE_SYNC:
+		msg, err = encodeSyncEvent(event)
+		msgType = "sync"
 	default:
 		// EVENT_TYPE_UNSPECIFIED and EVENT_TYPE_COMMIT are both commit events
 		msg, err = encodeCommitEvent(event)
@@ -339,10 +364,7 @@ func (f *firehose) sendEvent(sub *subscriber, event *types.RepoEvent) error {
 		return fmt.Errorf("failed to encode event: %w", err)
 	}
 
-	sub.connMu.Lock()
-	defer sub.connMu.Unlock()
-	sub.conn.SetWriteDeadline(time.Now().Add(writeTimeout)) //nolint:errcheck
-	if err := sub.conn.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+	if err := f.writeMessage(sub, websocket.BinaryMessage, msg); err != nil {
 		return err
 	}
 	pdsmetrics.FirehoseEventsWritten.WithLabelValues(sub.pdsHost, msgType).Inc()
@@ -404,6 +426,33 @@ func encodeAccountEvent(event *types.RepoEvent) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// encodeSyncEvent converts a RepoEvent (sync type) to the ATProto CBOR wire format
+func encodeSyncEvent(event *types.RepoEvent) ([]byte, error) {
+	sync := &atproto.SyncSubscribeRepos_Sync{
+		Seq:    event.Seq,
+		Did:    event.Repo,
+		Rev:    event.Rev,
+		Blocks: event.Blocks,
+		Time:   event.Time.AsTime().Format(util.ISO8601),
+	}
+
+	var buf bytes.Buffer
+
+	header := events.EventHeader{
+		Op:      events.EvtKindMessage,
+		MsgType: "#sync",
+	}
+	if err := header.MarshalCBOR(&buf); err != nil {
+		return nil, fmt.Errorf("failed to marshal header: %w", err)
+	}
+
+	if err := sync.MarshalCBOR(&buf); err != nil {
+		return nil, fmt.Errorf("failed to marshal sync: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
 // encodeCommitEvent converts a RepoEvent to the ATProto CBOR wire format
 func encodeCommitEvent(event *types.RepoEvent) ([]byte, error) {
 	// parse commit CID
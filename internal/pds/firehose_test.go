@@ -1,13 +1,16 @@
 package pds
 
 import (
+	"bytes"
 	"context"
 	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/atproto/atdata"
+	"github.com/bluesky-social/indigo/events"
 	"github.com/gorilla/websocket"
 	"github.com/jcalabro/atlas/internal/at"
 	"github.com/jcalabro/atlas/internal/types"
@@ -233,6 +236,36 @@ func TestFirehoseEventContent(t *testing.T) {
 	})
 }
 
+func TestEncodeSyncEvent(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	msg, err := encodeSyncEvent(&types.RepoEvent{
+		EventType: types.EventType_EVENT_TYPE_SYNC,
+		Seq:       42,
+		Repo:      "did:plc:encodesync1",
+		Rev:       "3kaaaaaaaaaa2",
+		Blocks:    []byte("car bytes"),
+		Time:      timestamppb.New(now),
+	})
+	require.NoError(t, err)
+
+	r := bytes.NewReader(msg)
+
+	var header events.EventHeader
+	require.NoError(t, header.UnmarshalCBOR(r))
+	require.Equal(t, int64(events.EvtKindMessage), header.Op)
+	require.Equal(t, "#sync", header.MsgType)
+
+	var sync atproto.SyncSubscribeRepos_Sync
+	require.NoError(t, sync.UnmarshalCBOR(r))
+	require.Equal(t, int64(42), sync.Seq)
+	require.Equal(t, "did:plc:encodesync1", sync.Did)
+	require.Equal(t, "3kaaaaaaaaaa2", sync.Rev)
+	require.Equal(t, []byte("car bytes"), []byte(sync.Blocks))
+	require.NotEmpty(t, sync.Time)
+}
+
 // createTestRecordDirect creates a record directly through the db layer
 func createTestRecordDirect(t *testing.T, srv *server, actor *types.Actor, collection string, recordData map[string]any) string {
 	t.Helper()
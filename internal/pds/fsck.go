@@ -0,0 +1,307 @@
+package pds
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/repo"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/jcalabro/atlas/internal/pds/db"
+	"go.opentelemetry.io/otel"
+)
+
+// fsckPageSize is the number of actors loaded at a time when checking every repo on a host
+const fsckPageSize = 100
+
+// repoChecker runs integrity checks against repos, verifying each head commit's signature against
+// the repo's DID document
+type repoChecker struct {
+	db        *db.DB
+	directory identity.Directory
+}
+
+type fsckIssue struct {
+	Kind   string `json:"kind"`
+	Detail string `json:"detail"`
+}
+
+// fsckReport is the result of checking a single repo
+type fsckReport struct {
+	Did      string      `json:"did"`
+	Head     string      `json:"head"`
+	Rev      string      `json:"rev"`
+	Blocks   int         `json:"blocks"`
+	Records  int         `json:"records"`
+	Issues   []fsckIssue `json:"issues"`
+	Repaired int         `json:"repaired"`
+}
+
+func (c *repoChecker) checkRepo(ctx context.Context, did string, repair bool) (*fsckReport, error) {
+	res, err := c.db.CheckRepo(ctx, did, db.FsckOptions{
+		Repair:       repair,
+		VerifyCommit: c.verifyCommit,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report := &fsckReport{
+		Did:      res.DID,
+		Head:     res.Head,
+		Rev:      res.Rev,
+		Blocks:   res.Blocks,
+		Records:  res.Records,
+		Issues:   make([]fsckIssue, 0, len(res.Issues)),
+		Repaired: res.Repaired,
+	}
+	for _, issue := range res.Issues {
+		report.Issues = append(report.Issues, fsckIssue{Kind: string(issue.Kind), Detail: issue.Detail})
+	}
+
+	return report, nil
+}
+
+// checkHost checks every repo on the given host, calling fn with each report
+func (c *repoChecker) checkHost(ctx context.Context, host string, repair bool, fn func(*fsckReport) error) error {
+	var cursor string
+	for {
+		actors, next, err := c.db.ListActors(ctx, host, cursor, fsckPageSize)
+		if err != nil {
+			return fmt.Errorf("failed to list actors: %w", err)
+		}
+
+		for _, actor := range actors {
+			report, err := c.checkRepo(ctx, actor.Did, repair)
+			if errors.Is(err, db.ErrNotFound) {
+				continue // deleted since it was listed
+			}
+			if err != nil {
+				return fmt.Errorf("failed to check repo %s: %w", actor.Did, err)
+			}
+
+			if err := fn(report); err != nil {
+				return err
+			}
+		}
+
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// verifyCommit checks the commit's signature against the atproto signing key in its DID document
+func (c *repoChecker) verifyCommit(ctx context.Context, commit *repo.Commit) error {
+	did, err := syntax.ParseDID(commit.DID)
+	if err != nil {
+		return fmt.Errorf("invalid commit did: %w", err)
+	}
+
+	ident, err := c.directory.LookupDID(ctx, did)
+	if err != nil {
+		return fmt.Errorf("failed to resolve did document: %w", err)
+	}
+
+	pubkey, err := ident.PublicKey()
+	if err != nil {
+		return fmt.Errorf("failed to get signing key from did document: %w", err)
+	}
+
+	if err := commit.VerifySignature(pubkey); err != nil {
+		retired, rerr := c.isRetiredKey(ctx, commit.DID, pubkey)
+		if rerr != nil {
+			return fmt.Errorf("commit signature does not match did document: %w (%w)", err, rerr)
+		}
+		if retired {
+			return fmt.Errorf("did document still lists a retired signing key, so the key rotation hasn't propagated: %w", err)
+		}
+		return fmt.Errorf("commit signature does not match did document: %w", err)
+	}
+
+	return nil
+}
+
+// isRetiredKey returns whether pubkey is one of the actor's signing keys that was replaced by a
+// rotation within its grace window
+func (c *repoChecker) isRetiredKey(ctx context.Context, did string, pubkey atcrypto.PublicKey) (bool, error) {
+	actor, err := c.db.GetActorByDID(ctx, did)
+	if err != nil {
+		return false, fmt.Errorf("failed to get actor: %w", err)
+	}
+
+	retired, err := c.db.RetiredSigningKeys(ctx, actor)
+	if err != nil {
+		return false, err
+	}
+
+	return slices.ContainsFunc(retired, pubkey.Equal), nil
+}
+
+type fsckInput struct {
+	// Did is the repo to check. Every repo on the host is checked if empty.
+	Did    string `json:"did,omitempty"`
+	Repair bool   `json:"repair,omitempty"`
+}
+
+type fsckOutput struct {
+	Checked int `json:"checked"`
+	Failed  int `json:"failed"`
+
+	// Repos contains the report for every repo with issues, and always for a requested repo
+	Repos []*fsckReport `json:"repos"`
+}
+
+func (s *server) handleFsck(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	span := spanFromContext(ctx)
+	defer span.End()
+
+	host := hostFromContext(ctx)
+
+	var in fsckInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		s.badRequest(w, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+
+	checker := &repoChecker{db: s.db, directory: s.directory}
+	out := &fsckOutput{Repos: []*fsckReport{}}
+
+	if in.Did != "" {
+		if _, err := syntax.ParseDID(in.Did); err != nil {
+			s.badRequest(w, fmt.Errorf("invalid did: %w", err))
+			return
+		}
+
+		// admins may only check repos on their own host
+		actor, err := s.db.GetActorByDID(ctx, in.Did)
+		if errors.Is(err, db.ErrNotFound) || (err == nil && actor.PdsHost != host.hostname) {
+			s.notFound(w, fmt.Errorf("repo not found"))
+			return
+		}
+		if err != nil {
+			s.internalErr(w, fmt.Errorf("failed to get actor: %w", err))
+			return
+		}
+
+		report, err := checker.checkRepo(ctx, in.Did, in.Repair)
+		if err != nil {
+			s.internalErr(w, fmt.Errorf("failed to check repo: %w", err))
+			return
+		}
+
+		out.Checked = 1
+		if len(report.Issues) > 0 {
+			out.Failed = 1
+		}
+		if report.Repaired > 0 {
+			s.audit(ctx, host, "net.atlaspds.admin.fsck", report.Did, nil, report)
+		}
+		out.Repos = append(out.Repos, report)
+
+		s.jsonOK(w, out)
+		return
+	}
+
+	err := checker.checkHost(ctx, host.hostname, in.Repair, func(report *fsckReport) error {
+		out.Checked++
+		if len(report.Issues) > 0 {
+			out.Failed++
+			out.Repos = append(out.Repos, report)
+		}
+		if report.Repaired > 0 {
+			s.audit(ctx, host, "net.atlaspds.admin.fsck", report.Did, nil, report)
+		}
+		return nil
+	})
+	if err != nil {
+		s.internalErr(w, fmt.Errorf("failed to check repos: %w", err))
+		return
+	}
+
+	s.jsonOK(w, out)
+}
+
+// FsckArgs configures a standalone run of the repo integrity checker
+type FsckArgs struct {
+	// DIDs are individual repos to check
+	DIDs []string
+
+	// Hosts are PDS hostnames whose repos should all be checked
+	Hosts []string
+
+	// Repair rebuilds inconsistent indexes from each repo's MST
+	Repair bool
+
+	PLCURL string
+	FDB    db.Config
+}
+
+// Fsck checks the integrity of the requested repos without a running server, writing a JSON line
+// to out for each repo with issues. Returns an error if any repo has issues.
+func Fsck(ctx context.Context, out io.Writer, args *FsckArgs) error {
+	log := slog.Default().With(slog.String("service", "atlas.fsck"))
+
+	if len(args.DIDs) == 0 && len(args.Hosts) == 0 {
+		return fmt.Errorf("at least one did or host is required")
+	}
+
+	database, err := db.New(otel.Tracer("atlas.fsck"), args.FDB)
+	if err != nil {
+		return err
+	}
+
+	checker := &repoChecker{
+		db: database,
+		directory: &identity.BaseDirectory{
+			PLCURL:     args.PLCURL,
+			HTTPClient: http.Client{Timeout: 10 * time.Second},
+		},
+	}
+
+	var checked, failed, repaired int
+	enc := json.NewEncoder(out)
+	report := func(report *fsckReport) error {
+		checked++
+		repaired += report.Repaired
+		if len(report.Issues) == 0 {
+			return nil
+		}
+
+		failed++
+		return enc.Encode(report)
+	}
+
+	for _, did := range args.DIDs {
+		res, err := checker.checkRepo(ctx, did, args.Repair)
+		if err != nil {
+			return fmt.Errorf("failed to check repo %s: %w", did, err)
+		}
+		if err := report(res); err != nil {
+			return err
+		}
+	}
+
+	for _, host := range args.Hosts {
+		if err := checker.checkHost(ctx, host, args.Repair, report); err != nil {
+			return fmt.Errorf("failed to check host %s: %w", host, err)
+		}
+	}
+
+	log.Info("fsck complete", "checked", checked, "failed", failed, "repaired", repaired)
+	if failed > 0 {
+		return fmt.Errorf("found issues in %d of %d repos (%d repaired)", failed, checked, repaired)
+	}
+
+	return nil
+}
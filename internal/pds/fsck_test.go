@@ -0,0 +1,164 @@
+package pds
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminMiddleware(t *testing.T) {
+	t.Parallel()
+
+	s := &server{log: slog.Default()}
+	handler := s.adminMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	serve := func(host *loadedHostConfig, user, password string) int {
+		req := httptest.NewRequest(http.MethodPost, "/xrpc/net.atlaspds.admin.fsck", nil)
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		req = req.WithContext(context.WithValue(req.Context(), hostContextKey{}, host))
+
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w.Code
+	}
+
+	enabled := &loadedHostConfig{hostname: testPDSHost, adminPassword: "hunter2"}
+	disabled := &loadedHostConfig{hostname: testPDSHost}
+	didsOnly := &loadedHostConfig{hostname: testPDSHost, adminDIDs: map[string]struct{}{"did:plc:admin": {}}}
+
+	require.Equal(t, http.StatusNoContent, serve(enabled, "admin", "hunter2"))
+	require.Equal(t, http.StatusUnauthorized, serve(enabled, "", ""))
+	require.Equal(t, http.StatusUnauthorized, serve(enabled, "admin", "wrong"))
+	require.Equal(t, http.StatusUnauthorized, serve(enabled, "root", "hunter2"))
+	require.Equal(t, http.StatusForbidden, serve(disabled, "admin", ""))
+
+	// an empty password never matches, even when the admin api is enabled with admin dids
+	require.Equal(t, http.StatusUnauthorized, serve(didsOnly, "admin", ""))
+}
+
+func TestHandleFsck(t *testing.T) {
+	t.Parallel()
+	srv := testServer(t)
+
+	dir, ok := srv.directory.(*identity.MockDirectory)
+	require.True(t, ok, "directory must be a MockDirectory")
+
+	fsck := func(t *testing.T, in *fsckInput) (*httptest.ResponseRecorder, *fsckOutput) {
+		t.Helper()
+
+		body, err := json.Marshal(in)
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodPost, "/xrpc/net.atlaspds.admin.fsck", bytes.NewReader(body))
+		req = req.WithContext(context.WithValue(req.Context(), hostContextKey{}, srv.hosts[testPDSHost]))
+
+		w := httptest.NewRecorder()
+		srv.handleFsck(w, req)
+
+		var out fsckOutput
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &out))
+		}
+		return w, &out
+	}
+
+	t.Run("verifies the commit signature against the did document", func(t *testing.T) {
+		t.Parallel()
+
+		actor, _ := setupTestActor(t, srv, "did:plc:fsckhandler1", "fsckhandler1@example.com", "fsckhandler1.dev.atlaspds.dev")
+
+		privkey, err := atcrypto.ParsePrivateBytesK256(actor.SigningKey)
+		require.NoError(t, err)
+		pubkey, err := privkey.PublicKey()
+		require.NoError(t, err)
+
+		dir.Insert(identity.Identity{
+			DID: syntax.DID(actor.Did),
+			Keys: map[string]identity.VerificationMethod{
+				"atproto": {Type: "Multikey", PublicKeyMultibase: pubkey.Multibase()},
+			},
+		})
+
+		w, out := fsck(t, &fsckInput{Did: actor.Did})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.Equal(t, 1, out.Checked)
+		require.Zero(t, out.Failed)
+		require.Len(t, out.Repos, 1)
+		require.Empty(t, out.Repos[0].Issues)
+		require.Equal(t, actor.Head, out.Repos[0].Head)
+	})
+
+	t.Run("reports a did document with a retired signing key", func(t *testing.T) {
+		t.Parallel()
+		ctx := t.Context()
+
+		actor, _ := setupTestActor(t, srv, "did:plc:fsckhandler3", "fsckhandler3@example.com", "fsckhandler3.dev.atlaspds.dev")
+
+		privkey, err := atcrypto.ParsePrivateBytesK256(actor.SigningKey)
+		require.NoError(t, err)
+		pubkey, err := privkey.PublicKey()
+		require.NoError(t, err)
+
+		// rotate the key without updating the did document
+		newKey, err := atcrypto.GeneratePrivateKeyK256()
+		require.NoError(t, err)
+		_, err = srv.db.PrepareSigningKeyRotation(ctx, actor.Did, nil, newKey.Bytes())
+		require.NoError(t, err)
+		_, err = srv.db.RotateSigningKey(ctx, actor.Did, time.Hour)
+		require.NoError(t, err)
+
+		dir.Insert(identity.Identity{
+			DID: syntax.DID(actor.Did),
+			Keys: map[string]identity.VerificationMethod{
+				"atproto": {Type: "Multikey", PublicKeyMultibase: pubkey.Multibase()},
+			},
+		})
+
+		w, out := fsck(t, &fsckInput{Did: actor.Did})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.Equal(t, 1, out.Failed)
+		require.Len(t, out.Repos[0].Issues, 1)
+		require.Equal(t, "bad_signature", out.Repos[0].Issues[0].Kind)
+		require.Contains(t, out.Repos[0].Issues[0].Detail, "retired signing key")
+	})
+
+	t.Run("reports an unresolvable did document", func(t *testing.T) {
+		t.Parallel()
+
+		actor, _ := setupTestActor(t, srv, "did:plc:fsckhandler2", "fsckhandler2@example.com", "fsckhandler2.dev.atlaspds.dev")
+
+		w, out := fsck(t, &fsckInput{Did: actor.Did})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.Equal(t, 1, out.Failed)
+		require.Len(t, out.Repos[0].Issues, 1)
+		require.Equal(t, "bad_signature", out.Repos[0].Issues[0].Kind)
+	})
+
+	t.Run("error - invalid did", func(t *testing.T) {
+		t.Parallel()
+
+		w, _ := fsck(t, &fsckInput{Did: "not-a-did"})
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("error - repo not found", func(t *testing.T) {
+		t.Parallel()
+
+		w, _ := fsck(t, &fsckInput{Did: "did:plc:fsckhandlernotfound"})
+		require.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
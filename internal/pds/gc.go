@@ -0,0 +1,153 @@
+package pds
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/jcalabro/atlas/internal/pds/db"
+)
+
+const (
+	// defaultBlockRetention is how long unreachable repo blocks are kept before being deleted, so
+	// that `since` diffs from recent revisions keep working
+	defaultBlockRetention = 24 * time.Hour
+
+	// blockSweepInterval is how often the sweeper deletes expired unreachable blocks
+	blockSweepInterval = time.Minute
+)
+
+// blockSweeper periodically deletes repo blocks that became unreachable more than retention ago
+type blockSweeper struct {
+	log       *slog.Logger
+	db        *db.DB
+	retention time.Duration
+}
+
+func newBlockSweeper(log *slog.Logger, db *db.DB, retention time.Duration) *blockSweeper {
+	if retention <= 0 {
+		retention = defaultBlockRetention
+	}
+
+	return &blockSweeper{
+		log:       log.With("component", "block-sweeper"),
+		db:        db,
+		retention: retention,
+	}
+}
+
+// Run sweeps expired blocks until ctx is cancelled. It first backfills the records_by_cid index of
+// repos that predate it, since their record blocks aren't collected until then.
+func (b *blockSweeper) Run(ctx context.Context) {
+	b.backfill(ctx)
+
+	ticker := time.NewTicker(blockSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.sweep(ctx)
+		}
+	}
+}
+
+func (b *blockSweeper) sweep(ctx context.Context) {
+	start := time.Now()
+	deleted, err := b.db.SweepBlocks(ctx, start.Add(-b.retention))
+	if err != nil {
+		if ctx.Err() == nil {
+			b.log.Error("failed to sweep unreachable blocks", "err", err)
+		}
+		return
+	}
+
+	if deleted > 0 {
+		b.log.Info("swept unreachable blocks", "deleted", deleted, "duration", time.Since(start))
+	}
+}
+
+func (b *blockSweeper) backfill(ctx context.Context) {
+	start := time.Now()
+	repos, err := b.db.BackfillRecordCIDIndex(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			b.log.Error("failed to backfill records_by_cid index", "err", err, "repos", repos)
+		}
+		return
+	}
+
+	if repos > 0 {
+		b.log.Info("backfilled records_by_cid index", "repos", repos, "duration", time.Since(start))
+	}
+}
+
+type repairRepoBlocksInput struct {
+	Did string `json:"did"`
+}
+
+type repairRepoBlocksOutput struct {
+	Reachable         int `json:"reachable"`
+	BlocksDeleted     int `json:"blocksDeleted"`
+	RevEntriesDeleted int `json:"revEntriesDeleted"`
+	RecordsIndexed    int `json:"recordsIndexed"`
+}
+
+// handleRepairRepoBlocks runs a full mark-and-sweep of a repo's blocks, deleting every block that
+// isn't reachable from its head without waiting for the retention window
+func (s *server) handleRepairRepoBlocks(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	span := spanFromContext(ctx)
+	defer span.End()
+
+	host := hostFromContext(ctx)
+
+	var in repairRepoBlocksInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		s.badRequest(w, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+
+	if _, err := syntax.ParseDID(in.Did); err != nil {
+		s.badRequest(w, fmt.Errorf("invalid did: %w", err))
+		return
+	}
+
+	// admins may only repair repos on their own host
+	actor, err := s.db.GetActorByDID(ctx, in.Did)
+	if errors.Is(err, db.ErrNotFound) || (err == nil && actor.PdsHost != host.hostname) {
+		s.notFound(w, fmt.Errorf("repo not found"))
+		return
+	}
+	if err != nil {
+		s.internalErr(w, fmt.Errorf("failed to get actor: %w", err))
+		return
+	}
+
+	res, err := s.db.RepairRepoBlocks(ctx, in.Did)
+	if err != nil {
+		s.internalErr(w, fmt.Errorf("failed to repair repo blocks: %w", err))
+		return
+	}
+
+	out := &repairRepoBlocksOutput{
+		Reachable:         res.Reachable,
+		BlocksDeleted:     res.BlocksDeleted,
+		RevEntriesDeleted: res.RevEntriesDeleted,
+		RecordsIndexed:    res.RecordsIndexed,
+	}
+
+	s.audit(ctx, host, "net.atlaspds.admin.repairRepoBlocks", in.Did, nil, out)
+	s.log.Info("repaired repo blocks", "did", in.Did, "reachable", res.Reachable,
+		"blocks_deleted", res.BlocksDeleted, "rev_entries_deleted", res.RevEntriesDeleted,
+		"records_indexed", res.RecordsIndexed)
+
+	s.jsonOK(w, out)
+}
@@ -0,0 +1,64 @@
+package pds
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleRepairRepoBlocks(t *testing.T) {
+	t.Parallel()
+	srv := testServer(t)
+
+	repair := func(t *testing.T, in *repairRepoBlocksInput) (*httptest.ResponseRecorder, *repairRepoBlocksOutput) {
+		t.Helper()
+
+		body, err := json.Marshal(in)
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodPost, "/xrpc/net.atlaspds.admin.repairRepoBlocks", bytes.NewReader(body))
+		req = req.WithContext(context.WithValue(req.Context(), hostContextKey{}, srv.hosts[testPDSHost]))
+
+		w := httptest.NewRecorder()
+		srv.handleRepairRepoBlocks(w, req)
+
+		var out repairRepoBlocksOutput
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &out))
+		}
+		return w, &out
+	}
+
+	t.Run("sweeps the repo", func(t *testing.T) {
+		t.Parallel()
+
+		actor, _ := setupTestActor(t, srv, "did:plc:repairhandler1", "repairhandler1@example.com", "repairhandler1.dev.atlaspds.dev")
+
+		w, out := repair(t, &repairRepoBlocksInput{Did: actor.Did})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.Positive(t, out.Reachable)
+
+		blks, err := srv.db.GetAllBlocks(t.Context(), actor.Did)
+		require.NoError(t, err)
+		require.Len(t, blks, out.Reachable)
+	})
+
+	t.Run("error - invalid did", func(t *testing.T) {
+		t.Parallel()
+
+		w, _ := repair(t, &repairRepoBlocksInput{Did: "not-a-did"})
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("error - repo not found", func(t *testing.T) {
+		t.Parallel()
+
+		w, _ := repair(t, &repairRepoBlocksInput{Did: "did:plc:repairhandlernotfound"})
+		require.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
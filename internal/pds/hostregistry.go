@@ -0,0 +1,600 @@
+package pds
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	indigoutil "github.com/bluesky-social/indigo/util"
+	"github.com/jcalabro/atlas/internal/envelope"
+	"github.com/jcalabro/atlas/internal/pds/db"
+	"github.com/jcalabro/atlas/internal/types"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// HostRegistryConfig enables the host registry, which provisions hosts at runtime by storing them
+// in FDB. Hosts in the config file take precedence over registered hosts of the same name.
+// Changes to this section take effect on restart rather than on reload.
+type HostRegistryConfig struct {
+	// KEKFile is the path to a base64-encoded 32 byte key-encryption key that encrypts the key
+	// material of registered hosts. KEKEnv names an environment variable holding the key instead.
+	KEKFile string `toml:"kek_file"`
+	KEKEnv  string `toml:"kek_env"`
+
+	// AdminPassword enables the host registry admin API via HTTP basic auth as the "admin" user.
+	// Hosts can still be managed with the atlas admin commands if this is empty.
+	AdminPassword string `toml:"admin_password"`
+}
+
+// hostRegistry is the loaded host registry config
+type hostRegistry struct {
+	keyring       *envelope.Keyring
+	adminPassword string
+}
+
+func loadHostRegistry(cfg *HostRegistryConfig) (*hostRegistry, error) {
+	if cfg.KEKFile != "" && cfg.KEKEnv != "" {
+		return nil, fmt.Errorf("only one of kek_file and kek_env may be set")
+	}
+
+	// registered hosts' keys are always encrypted, so a KEK is required
+	kms, err := envelope.LoadLocalKMS(cfg.KEKFile, cfg.KEKEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hostRegistry{
+		keyring:       envelope.NewKeyring(kms),
+		adminPassword: cfg.AdminPassword,
+	}, nil
+}
+
+// registeredHostConfig encodes the host's config for storage, without its key material and
+// secrets, which are stored encrypted alongside it
+func registeredHostConfig(host *Host) (string, error) {
+	stripped := *host
+	stripped.JWTSigningKey = ""
+	stripped.Labels.SigningKey = ""
+	stripped.AdminPassword = ""
+
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(&stripped); err != nil {
+		return "", fmt.Errorf("failed to encode host config: %w", err)
+	}
+
+	return buf.String(), nil
+}
+
+// openRegisteredHost decrypts a registered host's key material and loads it the same way as a host
+// in the config file
+func (r *hostRegistry) openRegisteredHost(ctx context.Context, rec *types.RegisteredHost) (*Host, *hostKeys, error) {
+	var host Host
+	if _, err := toml.Decode(rec.Config, &host); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode host config: %w", err)
+	}
+
+	jwtSigningKey, err := r.keyring.Open(ctx, rec.JwtSigningKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decrypt jwt signing key: %w", err)
+	}
+	keys := &hostKeys{jwtSigningKey: jwtSigningKey}
+
+	if rec.LabelSigningKey != nil {
+		keys.labelSigningKey, err = r.keyring.Open(ctx, rec.LabelSigningKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decrypt label signing key: %w", err)
+		}
+	}
+
+	if rec.AdminPassword != nil {
+		password, err := r.keyring.Open(ctx, rec.AdminPassword)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decrypt admin password: %w", err)
+		}
+		host.AdminPassword = string(password)
+	}
+
+	return &host, keys, nil
+}
+
+// loadRegisteredHosts loads every enabled host in the registry. A host that fails to load is
+// logged and skipped so that it can't take the others down with it.
+func (s *server) loadRegisteredHosts(ctx context.Context) (map[string]*loadedHostConfig, error) {
+	recs, err := s.db.ListRegisteredHosts(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := make(map[string]*loadedHostConfig, len(recs))
+	for _, rec := range recs {
+		if rec.Disabled {
+			continue
+		}
+
+		host, keys, err := s.hostRegistry.openRegisteredHost(ctx, rec)
+		if err != nil {
+			s.log.Error("failed to open registered host", "err", err, "host", rec.Hostname)
+			continue
+		}
+
+		loaded, err := loadHost(rec.Hostname, host, keys)
+		if err != nil {
+			s.log.Error("failed to load registered host", "err", err, "host", rec.Hostname)
+			continue
+		}
+
+		hosts[rec.Hostname] = loaded
+	}
+
+	return hosts, nil
+}
+
+// setStaticHosts replaces the hosts from the config file along with the config's digest, returning
+// the previous ones
+func (s *server) setStaticHosts(static map[string]*loadedHostConfig, digest string) (map[string]*loadedHostConfig, string) {
+	s.hostsMu.Lock()
+	defer s.hostsMu.Unlock()
+
+	before, beforeDigest := s.staticHosts, s.configDigest
+	s.staticHosts, s.configDigest = static, digest
+	s.mergeHostsLocked()
+
+	return before, beforeDigest
+}
+
+// setRegisteredHosts replaces the hosts from the registry
+func (s *server) setRegisteredHosts(registered map[string]*loadedHostConfig) {
+	s.hostsMu.Lock()
+	defer s.hostsMu.Unlock()
+
+	s.registeredHosts = registered
+	s.mergeHostsLocked()
+}
+
+// mergeHostsLocked rebuilds the hosts being served. Hosts in the config file take precedence over
+// registered hosts of the same name. hostsMu must be held for writing.
+func (s *server) mergeHostsLocked() {
+	hosts := make(map[string]*loadedHostConfig, len(s.staticHosts)+len(s.registeredHosts))
+	maps.Copy(hosts, s.registeredHosts)
+	maps.Copy(hosts, s.staticHosts)
+	s.hosts = hosts
+}
+
+// watchHostRegistry reloads the registered hosts whenever the registry changes, on any replica
+func (s *server) watchHostRegistry(ctx context.Context) {
+	const retryInterval = 5 * time.Second
+
+	// wait returns false if ctx is done before d has passed
+	wait := func(d time.Duration) bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(d):
+			return true
+		}
+	}
+
+	for {
+		// the watch is set up before loading so that changes made in between aren't missed
+		watch, err := s.db.WatchRegisteredHosts(ctx)
+		if err != nil {
+			s.log.Warn("failed to watch host registry", "err", err)
+		}
+
+		registered, err := s.loadRegisteredHosts(ctx)
+		if err != nil {
+			s.log.Error("failed to load registered hosts", "err", err)
+		} else {
+			s.setRegisteredHosts(registered)
+			s.log.Info("loaded registered hosts", "num_hosts", len(registered))
+		}
+
+		// poll until the watch can be set up again, and retry failed loads rather than waiting for
+		// the registry to change
+		if watch == nil || err != nil {
+			if watch != nil {
+				watch.Cancel()
+			}
+			if !wait(retryInterval) {
+				return
+			}
+			continue
+		}
+
+		// FDB's futures don't have a channel interface
+		watchDone := make(chan struct{})
+		go func() {
+			watch.BlockUntilReady()
+			close(watchDone)
+		}()
+
+		select {
+		case <-ctx.Done():
+			watch.Cancel()
+			return
+		case <-watchDone:
+		}
+
+		// a failed watch is ready immediately, so back off rather than spinning
+		if err := watch.Get(); err != nil {
+			s.log.Warn("host registry watch failed", "err", err)
+			if !wait(retryInterval) {
+				return
+			}
+		}
+	}
+}
+
+// registerHost validates a host's config and stores it in the registry. When updating, key
+// material and the admin password that aren't given are carried over from the stored host.
+func (s *server) registerHost(ctx context.Context, hostname string, host *Host, keys *hostKeys, create bool) (before, after *types.RegisteredHost, code int, err error) {
+	if s.hostRegistry == nil {
+		return nil, nil, http.StatusForbidden, fmt.Errorf("host registry is not enabled")
+	}
+
+	now := timestamppb.Now()
+	after = &types.RegisteredHost{Hostname: hostname, CreatedAt: now, UpdatedAt: now}
+
+	if !create {
+		before, err = s.db.GetRegisteredHost(ctx, hostname)
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, nil, http.StatusNotFound, fmt.Errorf("host %q is not registered", hostname)
+		}
+		if err != nil {
+			return nil, nil, http.StatusInternalServerError, fmt.Errorf("failed to get registered host: %w", err)
+		}
+
+		existing, existingKeys, err := s.hostRegistry.openRegisteredHost(ctx, before)
+		if err != nil {
+			return nil, nil, http.StatusInternalServerError, err
+		}
+		if keys.jwtSigningKey == nil {
+			keys.jwtSigningKey = existingKeys.jwtSigningKey
+		}
+		if keys.labelSigningKey == nil {
+			keys.labelSigningKey = existingKeys.labelSigningKey
+		}
+		if host.AdminPassword == "" {
+			host.AdminPassword = existing.AdminPassword
+		}
+
+		after.CreatedAt = before.CreatedAt
+		after.Disabled = before.Disabled
+	}
+
+	if keys.jwtSigningKey == nil {
+		return nil, nil, http.StatusBadRequest, fmt.Errorf("jwt signing key is required")
+	}
+	if host.TLS.CertFile != "" || host.TLS.KeyFile != "" {
+		return nil, nil, http.StatusBadRequest, fmt.Errorf("registered hosts get certificates from acme rather than from files")
+	}
+
+	// the same validation as hosts in the config file
+	if _, err := loadHost(hostname, host, keys); err != nil {
+		return nil, nil, http.StatusBadRequest, err
+	}
+	for _, other := range s.allHosts() {
+		if other.hostname == hostname {
+			continue
+		}
+		for _, a := range host.UserDomains {
+			for _, b := range other.userDomains {
+				if sameUserDomain(a, b) {
+					return nil, nil, http.StatusBadRequest, fmt.Errorf("user domain %q is already a user domain of host %q", a, other.hostname)
+				}
+			}
+		}
+	}
+
+	after.Config, err = registeredHostConfig(host)
+	if err != nil {
+		return nil, nil, http.StatusInternalServerError, err
+	}
+
+	after.JwtSigningKey, err = s.hostRegistry.keyring.Seal(ctx, keys.jwtSigningKey)
+	if err != nil {
+		return nil, nil, http.StatusInternalServerError, fmt.Errorf("failed to seal jwt signing key: %w", err)
+	}
+	if keys.labelSigningKey != nil {
+		after.LabelSigningKey, err = s.hostRegistry.keyring.Seal(ctx, keys.labelSigningKey)
+		if err != nil {
+			return nil, nil, http.StatusInternalServerError, fmt.Errorf("failed to seal label signing key: %w", err)
+		}
+	}
+	if host.AdminPassword != "" {
+		after.AdminPassword, err = s.hostRegistry.keyring.Seal(ctx, []byte(host.AdminPassword))
+		if err != nil {
+			return nil, nil, http.StatusInternalServerError, fmt.Errorf("failed to seal admin password: %w", err)
+		}
+	}
+
+	if create {
+		err = s.db.CreateRegisteredHost(ctx, after)
+	} else {
+		before, err = s.db.UpdateRegisteredHost(ctx, after)
+	}
+	switch {
+	case errors.Is(err, db.ErrHostExists):
+		return nil, nil, http.StatusConflict, fmt.Errorf("host %q is already registered", hostname)
+	case errors.Is(err, db.ErrNotFound):
+		return nil, nil, http.StatusNotFound, fmt.Errorf("host %q is not registered", hostname)
+	case err != nil:
+		return nil, nil, http.StatusInternalServerError, fmt.Errorf("failed to store registered host: %w", err)
+	}
+
+	return before, after, http.StatusOK, nil
+}
+
+// setHostDisabled stops or resumes serving a registered host. Its accounts and repos are kept.
+func (s *server) setHostDisabled(ctx context.Context, hostname string, disabled bool) (before, after *types.RegisteredHost, code int, err error) {
+	if s.hostRegistry == nil {
+		return nil, nil, http.StatusForbidden, fmt.Errorf("host registry is not enabled")
+	}
+
+	before, err = s.db.GetRegisteredHost(ctx, hostname)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, nil, http.StatusNotFound, fmt.Errorf("host %q is not registered", hostname)
+	}
+	if err != nil {
+		return nil, nil, http.StatusInternalServerError, fmt.Errorf("failed to get registered host: %w", err)
+	}
+
+	after = proto.Clone(before).(*types.RegisteredHost)
+	after.Disabled = disabled
+	after.UpdatedAt = timestamppb.Now()
+
+	if _, err := s.db.UpdateRegisteredHost(ctx, after); err != nil {
+		return nil, nil, http.StatusInternalServerError, fmt.Errorf("failed to update registered host: %w", err)
+	}
+
+	return before, after, http.StatusOK, nil
+}
+
+// registeredHostState is the audited state of a registered host, which leaves out its secrets
+type registeredHostState struct {
+	Config   string `json:"config"`
+	Labeler  bool   `json:"labeler"`
+	Disabled bool   `json:"disabled"`
+}
+
+func newRegisteredHostState(rec *types.RegisteredHost) *registeredHostState {
+	if rec == nil {
+		return nil
+	}
+	return &registeredHostState{
+		Config:   rec.Config,
+		Labeler:  rec.LabelSigningKey != nil,
+		Disabled: rec.Disabled,
+	}
+}
+
+type registeredHostView struct {
+	Hostname         string `json:"hostname"`
+	Config           string `json:"config"`
+	Labeler          bool   `json:"labeler"`
+	AdminPasswordSet bool   `json:"adminPasswordSet"`
+	Disabled         bool   `json:"disabled"`
+
+	// Overridden is true if the config file has a host of the same name, which is served instead
+	Overridden bool `json:"overridden"`
+
+	CreatedAt string `json:"createdAt"`
+	UpdatedAt string `json:"updatedAt"`
+}
+
+func (s *server) registeredHostView(rec *types.RegisteredHost) *registeredHostView {
+	s.hostsMu.RLock()
+	_, overridden := s.staticHosts[rec.Hostname]
+	s.hostsMu.RUnlock()
+
+	return &registeredHostView{
+		Hostname:         rec.Hostname,
+		Config:           rec.Config,
+		Labeler:          rec.LabelSigningKey != nil,
+		AdminPasswordSet: rec.AdminPassword != nil,
+		Disabled:         rec.Disabled,
+		Overridden:       overridden,
+		CreatedAt:        rec.CreatedAt.AsTime().Format(indigoutil.ISO8601),
+		UpdatedAt:        rec.UpdatedAt.AsTime().Format(indigoutil.ISO8601),
+	}
+}
+
+// hostRegistryAdminMiddleware authenticates requests to the host registry admin API, which manages
+// every host rather than the one the request was made to, so it has its own admin password
+func (s *server) hostRegistryAdminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.hostRegistry == nil || s.hostRegistry.adminPassword == "" {
+			s.forbidden(w, fmt.Errorf("host registry admin api is not enabled"))
+			return
+		}
+
+		user, password, ok := r.BasicAuth()
+		if !ok {
+			s.unauthorized(w, fmt.Errorf("admin credentials are required"))
+			return
+		}
+
+		userOK := subtle.ConstantTimeCompare([]byte(user), []byte("admin")) == 1
+		passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(s.hostRegistry.adminPassword)) == 1
+		if !userOK || !passwordOK {
+			s.unauthorized(w, fmt.Errorf("invalid admin credentials"))
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+type registerHostInput struct {
+	Hostname string `json:"hostname"`
+
+	// Config is the host's TOML table from the config file. Key material is given below rather
+	// than as file paths.
+	Config string `json:"config"`
+
+	// JWTSigningKey and LabelSigningKey are PEM encoded. They may be left out of updates to keep
+	// the current keys.
+	JWTSigningKey   string `json:"jwtSigningKey,omitempty"`
+	LabelSigningKey string `json:"labelSigningKey,omitempty"`
+}
+
+func (s *server) handleCreateHost(w http.ResponseWriter, r *http.Request) {
+	s.handleRegisterHost(w, r, true)
+}
+
+func (s *server) handleUpdateHost(w http.ResponseWriter, r *http.Request) {
+	s.handleRegisterHost(w, r, false)
+}
+
+func (s *server) handleRegisterHost(w http.ResponseWriter, r *http.Request, create bool) {
+	ctx := r.Context()
+	span := spanFromContext(ctx)
+	defer span.End()
+
+	var in registerHostInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		s.badRequest(w, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+
+	span.SetAttributes(attribute.String("hostname", in.Hostname))
+
+	var host Host
+	if _, err := toml.Decode(in.Config, &host); err != nil {
+		s.badRequest(w, fmt.Errorf("invalid host config: %w", err))
+		return
+	}
+	if host.JWTSigningKey != "" || host.Labels.SigningKey != "" {
+		s.badRequest(w, fmt.Errorf("keys must be given as jwtSigningKey and labelSigningKey rather than as file paths"))
+		return
+	}
+
+	keys := &hostKeys{}
+	if in.JWTSigningKey != "" {
+		keys.jwtSigningKey = []byte(in.JWTSigningKey)
+	}
+	if in.LabelSigningKey != "" {
+		keys.labelSigningKey = []byte(in.LabelSigningKey)
+	}
+
+	before, after, code, err := s.registerHost(ctx, in.Hostname, &host, keys, create)
+	if err != nil {
+		s.err(w, code, err)
+		return
+	}
+
+	action := "net.atlaspds.admin.updateHost"
+	if create {
+		action = "net.atlaspds.admin.createHost"
+	}
+	s.auditAs(ctx, adminActor(ctx), after.Hostname, action, after.Hostname,
+		newRegisteredHostState(before), newRegisteredHostState(after))
+	s.log.Info("admin registered host", "host", after.Hostname, "create", create)
+
+	s.jsonOK(w, s.registeredHostView(after))
+}
+
+type setHostDisabledInput struct {
+	Hostname string `json:"hostname"`
+}
+
+func (s *server) handleDisableHost(w http.ResponseWriter, r *http.Request) {
+	s.handleSetHostDisabled(w, r, true)
+}
+
+func (s *server) handleEnableHost(w http.ResponseWriter, r *http.Request) {
+	s.handleSetHostDisabled(w, r, false)
+}
+
+func (s *server) handleSetHostDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	ctx := r.Context()
+	span := spanFromContext(ctx)
+	defer span.End()
+
+	var in setHostDisabledInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		s.badRequest(w, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+
+	span.SetAttributes(
+		attribute.String("hostname", in.Hostname),
+		attribute.Bool("disabled", disabled),
+	)
+
+	before, after, code, err := s.setHostDisabled(ctx, in.Hostname, disabled)
+	if err != nil {
+		s.err(w, code, err)
+		return
+	}
+
+	action := "net.atlaspds.admin.enableHost"
+	if disabled {
+		action = "net.atlaspds.admin.disableHost"
+	}
+	s.auditAs(ctx, adminActor(ctx), after.Hostname, action, after.Hostname,
+		newRegisteredHostState(before), newRegisteredHostState(after))
+	s.log.Info("admin updated registered host", "host", after.Hostname, "disabled", disabled)
+
+	s.jsonOK(w, s.registeredHostView(after))
+}
+
+type listHostsOutput struct {
+	Hosts []*registeredHostView `json:"hosts"`
+}
+
+// handleListHosts lists the registered hosts, including disabled ones
+func (s *server) handleListHosts(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	span := spanFromContext(ctx)
+	defer span.End()
+
+	recs, err := s.db.ListRegisteredHosts(ctx)
+	if err != nil {
+		s.internalErr(w, fmt.Errorf("failed to list registered hosts: %w", err))
+		return
+	}
+
+	out := &listHostsOutput{Hosts: make([]*registeredHostView, 0, len(recs))}
+	for _, rec := range recs {
+		out.Hosts = append(out.Hosts, s.registeredHostView(rec))
+	}
+
+	s.jsonOK(w, out)
+}
+
+// readHostFile reads a host's TOML table and the key files it names, for registering a host from
+// the command line. Key files that aren't named are left nil.
+func readHostFile(path string) (*Host, *hostKeys, error) {
+	var host Host
+	if _, err := toml.DecodeFile(path, &host); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode host config file: %w", err)
+	}
+
+	keys := &hostKeys{}
+	var err error
+	if host.JWTSigningKey != "" {
+		keys.jwtSigningKey, err = os.ReadFile(host.JWTSigningKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read signing key file: %w", err)
+		}
+	}
+	if host.Labels.SigningKey != "" {
+		keys.labelSigningKey, err = os.ReadFile(host.Labels.SigningKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read label signing key file: %w", err)
+		}
+	}
+
+	return &host, keys, nil
+}
@@ -0,0 +1,291 @@
+package pds
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jcalabro/atlas/internal/envelope"
+	"github.com/jcalabro/atlas/internal/types"
+	"github.com/jcalabro/atlas/internal/util"
+	"github.com/stretchr/testify/require"
+)
+
+func testHostRegistry(t *testing.T) *hostRegistry {
+	t.Helper()
+
+	kek := make([]byte, 32)
+	_, err := rand.Read(kek)
+	require.NoError(t, err)
+	kms, err := envelope.NewLocalKMS(kek)
+	require.NoError(t, err)
+
+	return &hostRegistry{keyring: envelope.NewKeyring(kms), adminPassword: "hunter2"}
+}
+
+func testJWTKey(t *testing.T) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	require.NoError(t, GenerateJWTKey(&buf))
+	return buf.Bytes()
+}
+
+func TestLoadConfigHostRegistry(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	kekPath := filepath.Join(dir, "kek")
+	kek := make([]byte, 32)
+	_, err := rand.Read(kek)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(kekPath, []byte(base64.StdEncoding.EncodeToString(kek)), 0o600))
+
+	write := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+		return path
+	}
+
+	// hosts may all come from the registry
+	cfg, err := LoadConfig(write("ok.toml", "[host_registry]\nkek_file = \""+kekPath+"\"\nadmin_password = \"hunter2\"\n"))
+	require.NoError(t, err)
+	require.Empty(t, cfg.Hosts)
+	require.NotNil(t, cfg.HostRegistry)
+	require.Equal(t, "hunter2", cfg.HostRegistry.adminPassword)
+
+	_, err = LoadConfig(write("nokek.toml", "[host_registry]\n"))
+	require.ErrorContains(t, err, "key-encryption key")
+
+	_, err = LoadConfig(write("both.toml", "[host_registry]\nkek_file = \""+kekPath+"\"\nkek_env = \"ATLAS_KEK\"\n"))
+	require.ErrorContains(t, err, "only one of")
+
+	_, err = LoadConfig(write("empty.toml", ""))
+	require.ErrorContains(t, err, "at least one host")
+}
+
+func TestOpenRegisteredHost(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	registry := testHostRegistry(t)
+	jwtKey := testJWTKey(t)
+
+	host := &Host{
+		ServiceDID:    "did:web:pds.example.com",
+		JWTSigningKey: "/path/to/jwt.pem",
+		UserDomains:   []string{".pds.example.com"},
+		AdminPassword: "hunter2",
+	}
+
+	config, err := registeredHostConfig(host)
+	require.NoError(t, err)
+	require.NotContains(t, config, "hunter2")
+	require.NotContains(t, config, "jwt.pem")
+
+	sealed, err := registry.keyring.Seal(ctx, jwtKey)
+	require.NoError(t, err)
+	password, err := registry.keyring.Seal(ctx, []byte(host.AdminPassword))
+	require.NoError(t, err)
+
+	opened, keys, err := registry.openRegisteredHost(ctx, &types.RegisteredHost{
+		Hostname:      "pds.example.com",
+		Config:        config,
+		JwtSigningKey: sealed,
+		AdminPassword: password,
+	})
+	require.NoError(t, err)
+	require.Equal(t, jwtKey, keys.jwtSigningKey)
+	require.Nil(t, keys.labelSigningKey)
+	require.Equal(t, "hunter2", opened.AdminPassword)
+	require.Equal(t, host.UserDomains, opened.UserDomains)
+
+	loaded, err := loadHost("pds.example.com", opened, keys)
+	require.NoError(t, err)
+	require.Equal(t, "did:web:pds.example.com", loaded.serviceDID)
+
+	// keys sealed with another KEK can't be opened
+	_, _, err = testHostRegistry(t).openRegisteredHost(ctx, &types.RegisteredHost{Config: config, JwtSigningKey: sealed})
+	require.Error(t, err)
+}
+
+func TestSetHosts(t *testing.T) {
+	t.Parallel()
+
+	srv := &server{}
+	static := map[string]*loadedHostConfig{
+		"a.example.com": {hostname: "a.example.com", serviceDID: "did:web:a.example.com"},
+	}
+	registered := map[string]*loadedHostConfig{
+		"a.example.com": {hostname: "a.example.com", serviceDID: "did:plc:registered"},
+		"b.example.com": {hostname: "b.example.com"},
+	}
+
+	before, beforeDigest := srv.setStaticHosts(static, "digest1")
+	require.Nil(t, before)
+	require.Empty(t, beforeDigest)
+	srv.setRegisteredHosts(registered)
+	require.Len(t, srv.allHosts(), 2)
+
+	// the config file overrides the registry
+	require.Equal(t, "did:web:a.example.com", srv.getHost("a.example.com").serviceDID)
+	require.NotNil(t, srv.getHost("b.example.com"))
+
+	// reloading the config file keeps the registered hosts
+	before, beforeDigest = srv.setStaticHosts(map[string]*loadedHostConfig{}, "digest2")
+	require.Equal(t, static, before)
+	require.Equal(t, "digest1", beforeDigest)
+	require.Equal(t, "did:plc:registered", srv.getHost("a.example.com").serviceDID)
+	require.NotNil(t, srv.getHost("b.example.com"))
+
+	// concurrent reloads of both sources don't lose either update
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			srv.setStaticHosts(map[string]*loadedHostConfig{
+				"static.example.com": {hostname: "static.example.com", serviceDID: strconv.Itoa(i)},
+			}, strconv.Itoa(i))
+		}()
+		go func() {
+			defer wg.Done()
+			srv.setRegisteredHosts(map[string]*loadedHostConfig{
+				"registered.example.com": {hostname: "registered.example.com", serviceDID: strconv.Itoa(i)},
+			})
+		}()
+	}
+	wg.Wait()
+
+	require.NotNil(t, srv.getHost("static.example.com"))
+	require.NotNil(t, srv.getHost("registered.example.com"))
+	require.Len(t, srv.allHosts(), 2)
+}
+
+func TestHostRegistryAdmin(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	srv := testServer(t)
+	srv.staticHosts = srv.hosts
+	srv.hostRegistry = testHostRegistry(t)
+	router := srv.router()
+
+	hostname := strings.ToLower(util.RandString(12)) + ".example.com"
+	config := "service_did = \"did:web:" + hostname + "\"\nuser_domains = [\"." + hostname + "\"]\n"
+
+	call := func(t *testing.T, method, nsid, password string, in any) *httptest.ResponseRecorder {
+		t.Helper()
+
+		var body bytes.Buffer
+		if in != nil {
+			require.NoError(t, json.NewEncoder(&body).Encode(in))
+		}
+
+		req := httptest.NewRequest(method, "/xrpc/"+nsid, &body)
+		req.SetBasicAuth("admin", password)
+		req = addTestHostContext(srv, req)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	in := &registerHostInput{Hostname: hostname, Config: config, JWTSigningKey: string(testJWTKey(t))}
+
+	w := call(t, http.MethodPost, "net.atlaspds.admin.createHost", "wrong", in)
+	require.Equal(t, http.StatusUnauthorized, w.Code, w.Body.String())
+
+	// key file paths are rejected, since the file would be read by every replica
+	w = call(t, http.MethodPost, "net.atlaspds.admin.createHost", "hunter2", &registerHostInput{
+		Hostname: hostname,
+		Config:   config + "jwt_signing_key = \"/etc/atlas/jwt.pem\"\n",
+	})
+	require.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+
+	// user domains can't be the same as the other hosts'
+	w = call(t, http.MethodPost, "net.atlaspds.admin.createHost", "hunter2", &registerHostInput{
+		Hostname:      hostname,
+		Config:        "service_did = \"did:web:" + hostname + "\"\nuser_domains = [\".DEV.atlaspds.dev\"]\n",
+		JWTSigningKey: in.JWTSigningKey,
+	})
+	require.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+
+	w = call(t, http.MethodPost, "net.atlaspds.admin.createHost", "hunter2", in)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var view registeredHostView
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &view))
+	require.Equal(t, hostname, view.Hostname)
+	require.False(t, view.Disabled)
+	require.False(t, view.Overridden)
+
+	w = call(t, http.MethodPost, "net.atlaspds.admin.createHost", "hunter2", in)
+	require.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+
+	registered, err := srv.loadRegisteredHosts(ctx)
+	require.NoError(t, err)
+	require.Contains(t, registered, hostname)
+
+	srv.setRegisteredHosts(registered)
+	require.NotNil(t, srv.getHost(hostname))
+	require.NotNil(t, srv.getHost(testPDSHost))
+
+	t.Run("update keeps keys", func(t *testing.T) {
+		w := call(t, http.MethodPost, "net.atlaspds.admin.updateHost", "hunter2", &registerHostInput{
+			Hostname: hostname,
+			Config:   config + "invite_code_required = true\n",
+		})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		registered, err := srv.loadRegisteredHosts(ctx)
+		require.NoError(t, err)
+		require.Contains(t, registered, hostname)
+		require.True(t, registered[hostname].inviteCodeRequired)
+		require.Equal(t, srv.getHost(hostname).signingKey, registered[hostname].signingKey)
+
+		w = call(t, http.MethodPost, "net.atlaspds.admin.updateHost", "hunter2", &registerHostInput{
+			Hostname: "unregistered." + hostname,
+			Config:   config,
+		})
+		require.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+	})
+
+	t.Run("disable and enable", func(t *testing.T) {
+		w := call(t, http.MethodPost, "net.atlaspds.admin.disableHost", "hunter2", &setHostDisabledInput{Hostname: hostname})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		registered, err := srv.loadRegisteredHosts(ctx)
+		require.NoError(t, err)
+		require.NotContains(t, registered, hostname)
+
+		w = call(t, http.MethodGet, "net.atlaspds.admin.listHosts", "hunter2", nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var out listHostsOutput
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &out))
+		var found bool
+		for _, host := range out.Hosts {
+			if host.Hostname == hostname {
+				found = true
+				require.True(t, host.Disabled)
+			}
+		}
+		require.True(t, found)
+
+		w = call(t, http.MethodPost, "net.atlaspds.admin.enableHost", "hunter2", &setHostDisabledInput{Hostname: hostname})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		registered, err = srv.loadRegisteredHosts(ctx)
+		require.NoError(t, err)
+		require.Contains(t, registered, hostname)
+	})
+}
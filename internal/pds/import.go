@@ -0,0 +1,123 @@
+package pds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/bluesky-social/indigo/atproto/repo"
+	"github.com/ipfs/go-cid"
+	"github.com/jcalabro/atlas/internal/at"
+	"github.com/jcalabro/atlas/internal/pds/db"
+	"github.com/jcalabro/atlas/internal/types"
+)
+
+// importRepoResult summarizes the changes made by importRepo
+type importRepoResult struct {
+	Did       string `json:"did"`
+	Cid       string `json:"cid"`
+	Rev       string `json:"rev"`
+	Commits   int    `json:"commits"`
+	Written   int    `json:"written"`
+	Deleted   int    `json:"deleted"`
+	Unchanged int    `json:"unchanged"`
+}
+
+// importRepo makes the actor's repo match the records in a CAR file exported from another PDS or
+// from a backup. Records that differ are written and records missing from the CAR are deleted, in
+// commits signed with the actor's current signing key. The CAR's commit must be for the actor's DID.
+//
+// Each commit is atomic, but the import as a whole is not. If it's interrupted, running it again
+// completes it.
+func (s *server) importRepo(ctx context.Context, actor *types.Actor, r io.Reader) (*importRepoResult, error) {
+	commit, imported, err := repo.LoadRepoFromCAR(ctx, r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read repo from car: %w", err)
+	}
+	if commit.DID != actor.Did {
+		return nil, fmt.Errorf("car is for %s, not %s", commit.DID, actor.Did)
+	}
+
+	res := &importRepoResult{Did: actor.Did, Cid: actor.Head, Rev: actor.Rev}
+
+	var ops []db.WriteOp
+	seen := make(map[string]struct{})
+	err = imported.MST.Walk(func(key []byte, val cid.Cid) error {
+		path := string(key)
+		collection, rkey, ok := strings.Cut(path, "/")
+		if !ok {
+			return fmt.Errorf("invalid record path %q", path)
+		}
+		seen[path] = struct{}{}
+
+		existing, err := s.db.GetRecord(ctx, at.FormatURI(actor.Did, collection, rkey))
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			return fmt.Errorf("failed to get record: %w", err)
+		}
+		if existing != nil && existing.Cid == val.String() {
+			res.Unchanged++
+			return nil
+		}
+
+		blk, err := imported.RecordStore.Get(ctx, val)
+		if err != nil {
+			return fmt.Errorf("car is missing record %s: %w", path, err)
+		}
+
+		// "update" creates the record if it doesn't exist
+		ops = append(ops, db.WriteOp{Action: "update", Collection: collection, Rkey: rkey, Value: blk.RawData()})
+		res.Written++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	collections, err := s.db.GetCollections(ctx, actor.Did)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get collections: %w", err)
+	}
+	for _, collection := range collections {
+		var cursor string
+		for {
+			page, err := s.db.ListRecords(ctx, actor.Did, collection, fsckPageSize, cursor, false)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list records: %w", err)
+			}
+
+			for _, record := range page.Records {
+				if _, ok := seen[record.Collection+"/"+record.Rkey]; !ok {
+					ops = append(ops, db.WriteOp{Action: "delete", Collection: record.Collection, Rkey: record.Rkey})
+					res.Deleted++
+				}
+			}
+
+			if page.Cursor == "" {
+				break
+			}
+			cursor = page.Cursor
+		}
+	}
+
+	for batch := range slices.Chunk(ops, db.MaxCommitOps) {
+		// each commit builds on the previous one, so the actor's head is reloaded every time
+		current, err := s.db.GetActorByDID(ctx, actor.Did)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get actor: %w", err)
+		}
+
+		written, err := s.db.ApplyWrites(ctx, current, batch, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write records: %w", err)
+		}
+
+		res.Cid = written.CommitCID.String()
+		res.Rev = written.Rev
+		res.Commits++
+	}
+
+	return res, nil
+}
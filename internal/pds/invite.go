@@ -0,0 +1,243 @@
+package pds
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	indigoutil "github.com/bluesky-social/indigo/util"
+	"github.com/jcalabro/atlas/internal/pds/db"
+	"github.com/jcalabro/atlas/internal/types"
+	"github.com/jcalabro/atlas/internal/util"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// adminInviteAccount is the creator and owner of invite codes that aren't issued to an account
+	adminInviteAccount = "admin"
+
+	// maxInviteCodesPerRequest bounds the number of codes an admin may create in a single request
+	maxInviteCodesPerRequest = 1000
+)
+
+// newInviteCode generates a random invite code that's prefixed with the host so that users can tell
+// where a code may be used, such as "dev-atlaspds-net-abcde-fghij"
+func newInviteCode(host *loadedHostConfig) string {
+	return fmt.Sprintf("%s-%s-%s", strings.ReplaceAll(host.hostname, ".", "-"), util.RandString(5), util.RandString(5))
+}
+
+func inviteCodeView(invite *types.InviteCode) *atproto.ServerDefs_InviteCode {
+	uses := make([]*atproto.ServerDefs_InviteCodeUse, 0, len(invite.Uses))
+	for _, use := range invite.Uses {
+		uses = append(uses, &atproto.ServerDefs_InviteCodeUse{
+			UsedBy: use.UsedBy,
+			UsedAt: use.UsedAt.AsTime().Format(indigoutil.ISO8601),
+		})
+	}
+
+	return &atproto.ServerDefs_InviteCode{
+		Code:       invite.Code,
+		Available:  max(invite.Available-int64(len(invite.Uses)), 0),
+		Disabled:   invite.Disabled,
+		ForAccount: invite.ForAccount,
+		CreatedBy:  invite.CreatedBy,
+		CreatedAt:  invite.CreatedAt.AsTime().Format(indigoutil.ISO8601),
+		Uses:       uses,
+	}
+}
+
+// createInviteCodes issues count admin codes to each of the given accounts on the host. Returns
+// the HTTP status code to respond with on error.
+func (s *server) createInviteCodes(
+	r *http.Request,
+	host *loadedHostConfig,
+	count, useCount int64,
+	accounts []string,
+) ([]*atproto.ServerCreateInviteCodes_AccountCodes, int, error) {
+	if useCount <= 0 {
+		return nil, http.StatusBadRequest, fmt.Errorf("useCount must be positive")
+	}
+	if count <= 0 || count*int64(len(accounts)) > maxInviteCodesPerRequest {
+		return nil, http.StatusBadRequest, fmt.Errorf("must create between 1 and %d codes", maxInviteCodesPerRequest)
+	}
+
+	for _, account := range accounts {
+		if account == adminInviteAccount {
+			continue
+		}
+		if _, err := syntax.ParseDID(account); err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid account %q: %w", account, err)
+		}
+	}
+
+	var (
+		invites []*types.InviteCode
+		out     = make([]*atproto.ServerCreateInviteCodes_AccountCodes, 0, len(accounts))
+	)
+	for _, account := range accounts {
+		codes := &atproto.ServerCreateInviteCodes_AccountCodes{Account: account}
+		for range count {
+			invite := &types.InviteCode{
+				Code:       newInviteCode(host),
+				PdsHost:    host.hostname,
+				Available:  useCount,
+				ForAccount: account,
+				CreatedBy:  adminInviteAccount,
+				CreatedAt:  timestamppb.Now(),
+			}
+			invites = append(invites, invite)
+			codes.Codes = append(codes.Codes, invite.Code)
+		}
+		out = append(out, codes)
+	}
+
+	if err := s.db.CreateInviteCodes(r.Context(), invites); err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("failed to save invite codes: %w", err)
+	}
+
+	for _, codes := range out {
+		s.audit(r.Context(), host, "com.atproto.server.createInviteCodes", codes.Account, nil, codes)
+	}
+
+	return out, http.StatusOK, nil
+}
+
+func (s *server) handleCreateInviteCode(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	span := spanFromContext(ctx)
+	defer span.End()
+
+	host := hostFromContext(ctx)
+
+	var in atproto.ServerCreateInviteCode_Input
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		s.badRequest(w, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+
+	account := adminInviteAccount
+	if in.ForAccount != nil && *in.ForAccount != "" {
+		account = *in.ForAccount
+	}
+
+	codes, code, err := s.createInviteCodes(r, host, 1, in.UseCount, []string{account})
+	if err != nil {
+		s.err(w, code, fmt.Errorf("failed to create invite code: %w", err))
+		return
+	}
+
+	s.jsonOK(w, &atproto.ServerCreateInviteCode_Output{Code: codes[0].Codes[0]})
+}
+
+func (s *server) handleCreateInviteCodes(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	span := spanFromContext(ctx)
+	defer span.End()
+
+	host := hostFromContext(ctx)
+
+	var in atproto.ServerCreateInviteCodes_Input
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		s.badRequest(w, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+
+	accounts := in.ForAccounts
+	if len(accounts) == 0 {
+		accounts = []string{adminInviteAccount}
+	}
+
+	codes, code, err := s.createInviteCodes(r, host, in.CodeCount, in.UseCount, accounts)
+	if err != nil {
+		s.err(w, code, fmt.Errorf("failed to create invite codes: %w", err))
+		return
+	}
+
+	s.jsonOK(w, &atproto.ServerCreateInviteCodes_Output{Codes: codes})
+}
+
+// handleGetAccountInviteCodes lists the invite codes issued to the authenticated account. Unless
+// createAvailable is false or an admin disabled the account's invites, the account's allotment of
+// codes is topped up first.
+func (s *server) handleGetAccountInviteCodes(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	span := spanFromContext(ctx)
+	defer span.End()
+
+	host := hostFromContext(ctx)
+	actor := actorFromContext(ctx)
+	if actor == nil {
+		s.internalErr(w, fmt.Errorf("actor not found in context"))
+		return
+	}
+
+	boolParam := func(name string) (bool, error) {
+		str := r.URL.Query().Get(name)
+		if str == "" {
+			return true, nil
+		}
+		return strconv.ParseBool(str)
+	}
+
+	includeUsed, err := boolParam("includeUsed")
+	if err != nil {
+		s.badRequest(w, fmt.Errorf("invalid includeUsed: %w", err))
+		return
+	}
+	createAvailable, err := boolParam("createAvailable")
+	if err != nil {
+		s.badRequest(w, fmt.Errorf("invalid createAvailable: %w", err))
+		return
+	}
+
+	var codes []*types.InviteCode
+	if createAvailable && host.userInviteCodes > 0 && !actor.InvitesDisabled {
+		codes, err = s.db.EnsureAccountInviteCodes(ctx, host.hostname, actor.Did, host.userInviteCodes, func() string {
+			return newInviteCode(host)
+		})
+	} else {
+		codes, err = s.db.ListAccountInviteCodes(ctx, host.hostname, actor.Did)
+	}
+	if err != nil {
+		s.internalErr(w, fmt.Errorf("failed to get invite codes: %w", err))
+		return
+	}
+
+	out := &atproto.ServerGetAccountInviteCodes_Output{
+		Codes: make([]*atproto.ServerDefs_InviteCode, 0, len(codes)),
+	}
+	for _, invite := range codes {
+		if !includeUsed && !db.InviteCodeUsable(invite, host.hostname) {
+			continue
+		}
+		out.Codes = append(out.Codes, inviteCodeView(invite))
+	}
+
+	s.jsonOK(w, out)
+}
+
+// checkInviteCode verifies that the given invite code may be used to sign up on the host, if the
+// host requires one
+func (s *server) checkInviteCode(r *http.Request, host *loadedHostConfig, code *string) (int, error) {
+	if !host.inviteCodeRequired {
+		return http.StatusOK, nil
+	}
+	if code == nil || *code == "" {
+		return http.StatusBadRequest, fmt.Errorf("invite code is required")
+	}
+
+	invite, err := s.db.GetInviteCode(r.Context(), *code)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		return http.StatusInternalServerError, fmt.Errorf("failed to get invite code: %w", err)
+	}
+	if !db.InviteCodeUsable(invite, host.hostname) {
+		return http.StatusBadRequest, fmt.Errorf("invite code is not available")
+	}
+
+	return http.StatusOK, nil
+}
@@ -0,0 +1,163 @@
+package pds
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInviteCodes(t *testing.T) {
+	t.Parallel()
+
+	srv := testServer(t)
+	srv.hosts[testPDSHost].inviteCodeRequired = true
+	srv.hosts[testPDSHost].userInviteCodes = 2
+
+	admin := func(t *testing.T, handler http.HandlerFunc, in any, out any) *httptest.ResponseRecorder {
+		t.Helper()
+
+		body, err := json.Marshal(in)
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+		req = req.WithContext(context.WithValue(req.Context(), hostContextKey{}, srv.hosts[testPDSHost]))
+		w := httptest.NewRecorder()
+		handler(w, req)
+
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), out))
+		}
+		return w
+	}
+
+	signup := func(t *testing.T, code string) *createAccountResponse {
+		t.Helper()
+		password := "secure-password-123"
+		return createAccount(t, srv, &atproto.ServerCreateAccount_Input{
+			Email:      uniqueEmail(),
+			Handle:     uniqueHandle(),
+			Password:   &password,
+			InviteCode: &code,
+		})
+	}
+
+	t.Run("requires a valid code", func(t *testing.T) {
+		t.Parallel()
+
+		resp := signup(t, "")
+		require.Equal(t, http.StatusBadRequest, resp.Code)
+		require.Contains(t, resp.Body.Body.String(), "invite code is required")
+
+		resp = signup(t, "not-a-real-code")
+		require.Equal(t, http.StatusBadRequest, resp.Code)
+		require.Contains(t, resp.Body.Body.String(), "not available")
+	})
+
+	t.Run("codes are used up", func(t *testing.T) {
+		t.Parallel()
+
+		var out atproto.ServerCreateInviteCode_Output
+		w := admin(t, srv.handleCreateInviteCode, &atproto.ServerCreateInviteCode_Input{UseCount: 1}, &out)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.True(t, strings.HasPrefix(out.Code, strings.ReplaceAll(testPDSHost, ".", "-")))
+
+		resp := signup(t, out.Code)
+		require.Equal(t, http.StatusOK, resp.Code, resp.Body.Body.String())
+
+		invite, err := srv.db.GetInviteCode(t.Context(), out.Code)
+		require.NoError(t, err)
+		require.Len(t, invite.Uses, 1)
+		require.Equal(t, resp.Out.Did, invite.Uses[0].UsedBy)
+
+		actor, err := srv.db.GetActorByDID(t.Context(), resp.Out.Did)
+		require.NoError(t, err)
+		require.Equal(t, out.Code, actor.InviteCode)
+
+		resp = signup(t, out.Code)
+		require.Equal(t, http.StatusBadRequest, resp.Code)
+	})
+
+	t.Run("creates codes in bulk", func(t *testing.T) {
+		t.Parallel()
+
+		var out atproto.ServerCreateInviteCodes_Output
+		w := admin(t, srv.handleCreateInviteCodes, &atproto.ServerCreateInviteCodes_Input{
+			CodeCount:   2,
+			UseCount:    3,
+			ForAccounts: []string{"did:plc:invitebulk1", "did:plc:invitebulk2"},
+		}, &out)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.Len(t, out.Codes, 2)
+		require.Equal(t, "did:plc:invitebulk1", out.Codes[0].Account)
+		require.Len(t, out.Codes[0].Codes, 2)
+
+		invite, err := srv.db.GetInviteCode(t.Context(), out.Codes[1].Codes[0])
+		require.NoError(t, err)
+		require.Equal(t, "did:plc:invitebulk2", invite.ForAccount)
+		require.EqualValues(t, 3, invite.Available)
+
+		w = admin(t, srv.handleCreateInviteCodes, &atproto.ServerCreateInviteCodes_Input{CodeCount: 1}, &out)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+
+		w = admin(t, srv.handleCreateInviteCodes, &atproto.ServerCreateInviteCodes_Input{CodeCount: 1, UseCount: 1, ForAccounts: []string{"bob"}}, &out)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("accounts get an allotment", func(t *testing.T) {
+		t.Parallel()
+
+		_, session := setupTestActor(t, srv, "did:plc:inviteallotment1", "inviteallotment1@example.com", "inviteallotment1.dev.atlaspds.dev")
+
+		list := func(query string) *atproto.ServerGetAccountInviteCodes_Output {
+			req := httptest.NewRequest(http.MethodGet, "/xrpc/com.atproto.server.getAccountInviteCodes"+query, nil)
+			req.Header.Set("Authorization", "Bearer "+session.AccessToken)
+			req = req.WithContext(context.WithValue(req.Context(), hostContextKey{}, srv.hosts[testPDSHost]))
+			w := httptest.NewRecorder()
+			srv.router().ServeHTTP(w, req)
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+			var out atproto.ServerGetAccountInviteCodes_Output
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &out))
+			return &out
+		}
+
+		first := list("")
+		require.Len(t, first.Codes, 2)
+		for _, code := range first.Codes {
+			require.Equal(t, "did:plc:inviteallotment1", code.ForAccount)
+			require.EqualValues(t, 1, code.Available)
+		}
+
+		// the allotment isn't topped up again once it's been issued
+		second := list("")
+		require.ElementsMatch(t, first.Codes, second.Codes)
+
+		resp := signup(t, first.Codes[0].Code)
+		require.Equal(t, http.StatusOK, resp.Code, resp.Body.Body.String())
+
+		unused := list("?includeUsed=false")
+		require.Len(t, unused.Codes, 1)
+		require.Equal(t, first.Codes[1].Code, unused.Codes[0].Code)
+	})
+
+	t.Run("describeServer reports the requirement", func(t *testing.T) {
+		t.Parallel()
+
+		req := httptest.NewRequest(http.MethodGet, "/xrpc/com.atproto.server.describeServer", nil)
+		req = req.WithContext(context.WithValue(req.Context(), hostContextKey{}, srv.hosts[testPDSHost]))
+		w := httptest.NewRecorder()
+		srv.handleDescribeServer(w, req)
+
+		var out atproto.ServerDescribeServer_Output
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &out))
+		require.NotNil(t, out.InviteCodeRequired)
+		require.True(t, *out.InviteCodeRequired)
+	})
+}
@@ -0,0 +1,395 @@
+package pds
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/atdata"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/util"
+	"github.com/gorilla/websocket"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car"
+	pdsmetrics "github.com/jcalabro/atlas/internal/pds/metrics"
+	"github.com/jcalabro/atlas/internal/types"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// maxWantedCollections and maxWantedDIDs mirror the filter limits enforced by Jetstream
+	maxWantedCollections = 100
+	maxWantedDIDs        = 10_000
+
+	jetstreamKindCommit   = "commit"
+	jetstreamKindIdentity = "identity"
+	jetstreamKindAccount  = "account"
+)
+
+// jetstreamZstd is shared by all compressed subscribers. EncodeAll is safe for concurrent use.
+var jetstreamZstd = sync.OnceValues(func() (*zstd.Encoder, error) {
+	return zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+})
+
+// jetstreamOptions holds the filters and encoding settings requested by a jetstream subscriber
+type jetstreamOptions struct {
+	// exact collection NSIDs, and prefixes from entries like "app.bsky.graph.*"
+	wantedCollections map[string]struct{}
+	wantedPrefixes    []string
+
+	wantedDIDs map[string]struct{}
+
+	// compress sends each event as an independent zstd frame in a binary message
+	compress bool
+}
+
+// jetstreamEvent is the JSON wire format of a single jetstream message
+type jetstreamEvent struct {
+	DID      string             `json:"did"`
+	TimeUS   int64              `json:"time_us"`
+	Kind     string             `json:"kind"`
+	Commit   *jetstreamCommit   `json:"commit,omitempty"`
+	Identity *jetstreamIdentity `json:"identity,omitempty"`
+	Account  *jetstreamAccount  `json:"account,omitempty"`
+}
+
+type jetstreamCommit struct {
+	Rev        string         `json:"rev"`
+	Operation  string         `json:"operation"`
+	Collection string         `json:"collection"`
+	RKey       string         `json:"rkey"`
+	Record     map[string]any `json:"record,omitempty"`
+	CID        string         `json:"cid,omitempty"`
+}
+
+type jetstreamIdentity struct {
+	DID    string `json:"did"`
+	Handle string `json:"handle,omitempty"`
+	Seq    int64  `json:"seq"`
+	Time   string `json:"time"`
+}
+
+type jetstreamAccount struct {
+	Active bool   `json:"active"`
+	DID    string `json:"did"`
+	Seq    int64  `json:"seq"`
+	Time   string `json:"time"`
+	Status string `json:"status,omitempty"`
+}
+
+// handleJetstreamSubscribe is the HTTP handler for /subscribe, which serves a Jetstream-compatible
+// JSON event stream derived from the same events as subscribeRepos
+func (s *server) handleJetstreamSubscribe(w http.ResponseWriter, r *http.Request) {
+	opts, cursor, err := parseJetstreamParams(r)
+	if err != nil {
+		s.badRequest(w, err)
+		return
+	}
+
+	if err := s.firehose.SubscribeJetstream(r.Context(), w, r, opts, cursor); err != nil {
+		s.log.Error("jetstream subscribe error", "err", err)
+	}
+}
+
+// parseJetstreamParams reads the subscriber's filters, compression setting, and optional
+// unix microsecond cursor from the request
+func parseJetstreamParams(r *http.Request) (*jetstreamOptions, *int64, error) {
+	q := r.URL.Query()
+
+	opts := &jetstreamOptions{
+		wantedCollections: make(map[string]struct{}),
+		wantedDIDs:        make(map[string]struct{}),
+	}
+
+	collections := q["wantedCollections"]
+	if len(collections) > maxWantedCollections {
+		return nil, nil, fmt.Errorf("too many wantedCollections (max %d)", maxWantedCollections)
+	}
+	for _, c := range collections {
+		if prefix, ok := strings.CutSuffix(c, ".*"); ok {
+			if prefix == "" || strings.Contains(prefix, "*") {
+				return nil, nil, fmt.Errorf("invalid wantedCollections prefix %q", c)
+			}
+			opts.wantedPrefixes = append(opts.wantedPrefixes, prefix+".")
+			continue
+		}
+
+		if _, err := syntax.ParseNSID(c); err != nil {
+			return nil, nil, fmt.Errorf("invalid wantedCollections entry %q: %w", c, err)
+		}
+		opts.wantedCollections[c] = struct{}{}
+	}
+
+	dids := q["wantedDids"]
+	if len(dids) > maxWantedDIDs {
+		return nil, nil, fmt.Errorf("too many wantedDids (max %d)", maxWantedDIDs)
+	}
+	for _, d := range dids {
+		if _, err := syntax.ParseDID(d); err != nil {
+			return nil, nil, fmt.Errorf("invalid wantedDids entry %q: %w", d, err)
+		}
+		opts.wantedDIDs[d] = struct{}{}
+	}
+
+	if c := q.Get("compress"); c != "" {
+		compress, err := strconv.ParseBool(c)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid compress: %w", err)
+		}
+		opts.compress = compress
+	}
+	if strings.EqualFold(r.Header.Get("Socket-Encoding"), "zstd") {
+		opts.compress = true
+	}
+
+	var cursor *int64
+	if c := q.Get("cursor"); c != "" {
+		timeUS, err := strconv.ParseInt(c, 10, 64)
+		if err != nil || timeUS < 0 {
+			return nil, nil, fmt.Errorf("invalid cursor %q", c)
+		}
+		cursor = &timeUS
+	}
+
+	return opts, cursor, nil
+}
+
+// wantsDID reports whether events for the given repo pass the subscriber's DID filter
+func (o *jetstreamOptions) wantsDID(did string) bool {
+	if len(o.wantedDIDs) == 0 {
+		return true
+	}
+	_, ok := o.wantedDIDs[did]
+	return ok
+}
+
+// wantsCollection reports whether commits to the given collection pass the subscriber's filter
+func (o *jetstreamOptions) wantsCollection(collection string) bool {
+	if len(o.wantedCollections) == 0 && len(o.wantedPrefixes) == 0 {
+		return true
+	}
+	if _, ok := o.wantedCollections[collection]; ok {
+		return true
+	}
+	for _, prefix := range o.wantedPrefixes {
+		if strings.HasPrefix(collection, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// SubscribeJetstream adds a new JSON jetstream subscriber and handles the websocket connection.
+// The cursor, if non-nil, is a unix microsecond timestamp to replay events from.
+func (f *firehose) SubscribeJetstream(ctx context.Context, w http.ResponseWriter, r *http.Request, opts *jetstreamOptions, cursorUS *int64) error {
+	var cursor []byte
+	if cursorUS != nil {
+		var err error
+		cursor, err = f.db.GetEventCursorBeforeTime(ctx, *cursorUS)
+		if err != nil {
+			return fmt.Errorf("failed to resolve cursor: %w", err)
+		}
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return fmt.Errorf("failed to accept websocket: %w", err)
+	}
+	defer conn.Close() //nolint:errcheck
+
+	subCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var pdsHost string
+	if host := hostFromContext(r.Context()); host != nil {
+		pdsHost = host.hostname
+	}
+
+	sub := &subscriber{
+		id:        fmt.Sprintf("%s-%d", r.RemoteAddr, time.Now().UnixNano()),
+		conn:      conn,
+		events:    make(chan *types.RepoEvent, subscriberBufferSize),
+		pdsHost:   pdsHost,
+		cancelFn:  cancel,
+		jetstream: opts,
+	}
+
+	f.log.Info("new jetstream subscriber connected", "id", sub.id, "pds_host", pdsHost, "cursor", cursorUS,
+		"wanted_collections", len(opts.wantedCollections)+len(opts.wantedPrefixes), "wanted_dids", len(opts.wantedDIDs),
+		"compress", opts.compress)
+	pdsmetrics.JetstreamSubscribers.WithLabelValues(pdsHost).Inc()
+	defer func() {
+		pdsmetrics.JetstreamSubscribers.WithLabelValues(pdsHost).Dec()
+		f.log.Info("jetstream subscriber disconnected", "id", sub.id)
+	}()
+
+	return f.stream(subCtx, sub, cursor)
+}
+
+// sendJetstreamEvent filters, encodes, and sends a single event to a jetstream subscriber
+func (f *firehose) sendJetstreamEvent(sub *subscriber, event *types.RepoEvent) error {
+	msgs, err := encodeJetstreamEvents(event, sub.jetstream)
+	if err != nil {
+		return fmt.Errorf("failed to encode jetstream event: %w", err)
+	}
+
+	for _, msg := range msgs {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return fmt.Errorf("failed to marshal jetstream event: %w", err)
+		}
+
+		msgType := websocket.TextMessage
+		if sub.jetstream.compress {
+			enc, err := jetstreamZstd()
+			if err != nil {
+				return fmt.Errorf("failed to create zstd encoder: %w", err)
+			}
+			data = enc.EncodeAll(data, nil)
+			msgType = websocket.BinaryMessage
+		}
+
+		if err := f.writeMessage(sub, msgType, data); err != nil {
+			return err
+		}
+		pdsmetrics.JetstreamEventsWritten.WithLabelValues(sub.pdsHost, msg.Kind).Inc()
+	}
+
+	return nil
+}
+
+// writeMessage writes a single websocket message to the subscriber
+func (f *firehose) writeMessage(sub *subscriber, msgType int, data []byte) error {
+	sub.connMu.Lock()
+	defer sub.connMu.Unlock()
+	sub.conn.SetWriteDeadline(time.Now().Add(writeTimeout)) //nolint:errcheck
+	return sub.conn.WriteMessage(msgType, data)
+}
+
+// encodeJetstreamEvents converts a RepoEvent into the jetstream messages that pass the given
+// filters. Commits produce one message per matching op.
+func encodeJetstreamEvents(event *types.RepoEvent, opts *jetstreamOptions) ([]*jetstreamEvent, error) {
+	if !opts.wantsDID(event.Repo) {
+		return nil, nil
+	}
+
+	timeUS := event.Time.AsTime().UnixMicro()
+	timeStr := event.Time.AsTime().Format(util.ISO8601)
+
+	switch event.EventType {
+	case types.EventType_EVENT_TYPE_IDENTITY:
+		return []*jetstreamEvent{{
+			DID:    event.Repo,
+			TimeUS: timeUS,
+			Kind:   jetstreamKindIdentity,
+			Identity: &jetstreamIdentity{
+				DID:    event.Repo,
+				Handle: event.Handle,
+				Seq:    event.Seq,
+				Time:   timeStr,
+			},
+		}}, nil
+	case types.EventType_EVENT_TYPE_ACCOUNT:
+		return []*jetstreamEvent{{
+			DID:    event.Repo,
+			TimeUS: timeUS,
+			Kind:   jetstreamKindAccount,
+			Account: &jetstreamAccount{
+				Active: event.Active,
+				DID:    event.Repo,
+				Seq:    event.Seq,
+				Time:   timeStr,
+				Status: event.Status,
+			},
+		}}, nil
+	case types.EventType_EVENT_TYPE_SYNC:
+		// jetstream has no equivalent of a sync event since it carries no record operations
+		return nil, nil
+	}
+
+	// EVENT_TYPE_UNSPECIFIED and EVENT_TYPE_COMMIT are both commit events
+	var blocks map[cid.Cid][]byte
+	var msgs []*jetstreamEvent
+	for _, op := range event.Ops {
+		collection, rkey, ok := strings.Cut(op.Path, "/")
+		if !ok {
+			return nil, fmt.Errorf("invalid op path %q", op.Path)
+		}
+		if !opts.wantsCollection(collection) {
+			continue
+		}
+
+		commit := &jetstreamCommit{
+			Rev:        event.Rev,
+			Operation:  op.Action,
+			Collection: collection,
+			RKey:       rkey,
+		}
+
+		if len(op.Cid) > 0 {
+			recordCID, err := cid.Cast(op.Cid)
+			if err != nil {
+				return nil, fmt.Errorf("invalid op cid: %w", err)
+			}
+			commit.CID = recordCID.String()
+
+			// lazily read the CAR the first time we need a record out of it
+			if blocks == nil {
+				blocks, err = readCarBlocks(event.Blocks)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			// the record block may be missing for tooBig events, in which case
+			// consumers still receive the operation and cid but no record body
+			if raw, ok := blocks[recordCID]; ok {
+				commit.Record, err = atdata.UnmarshalCBOR(raw)
+				if err != nil {
+					return nil, fmt.Errorf("failed to decode record %s: %w", op.Path, err)
+				}
+			}
+		}
+
+		msgs = append(msgs, &jetstreamEvent{
+			DID:    event.Repo,
+			TimeUS: timeUS,
+			Kind:   jetstreamKindCommit,
+			Commit: commit,
+		})
+	}
+
+	return msgs, nil
+}
+
+// readCarBlocks reads all blocks from an event's CAR slice, keyed by CID
+func readCarBlocks(data []byte) (map[cid.Cid][]byte, error) {
+	blocks := make(map[cid.Cid][]byte)
+	if len(data) == 0 {
+		return blocks, nil
+	}
+
+	cr, err := car.NewCarReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read event car: %w", err)
+	}
+
+	for {
+		blk, err := cr.Next()
+		if errors.Is(err, io.EOF) {
+			return blocks, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read event car block: %w", err)
+		}
+		blocks[blk.Cid()] = blk.RawData()
+	}
+}
@@ -0,0 +1,346 @@
+package pds
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/atdata"
+	"github.com/gorilla/websocket"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	"github.com/jcalabro/atlas/internal/types"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestParseJetstreamParams(t *testing.T) {
+	t.Parallel()
+
+	t.Run("defaults", func(t *testing.T) {
+		t.Parallel()
+
+		r := httptest.NewRequest("GET", "/subscribe", nil)
+		opts, cursor, err := parseJetstreamParams(r)
+		require.NoError(t, err)
+		require.Nil(t, cursor)
+		require.False(t, opts.compress)
+		require.True(t, opts.wantsDID("did:plc:anyone"))
+		require.True(t, opts.wantsCollection("app.bsky.feed.post"))
+	})
+
+	t.Run("filters, cursor, and compression", func(t *testing.T) {
+		t.Parallel()
+
+		r := httptest.NewRequest("GET", "/subscribe?wantedCollections=app.bsky.feed.post&wantedCollections=app.bsky.graph.*"+
+			"&wantedDids=did:plc:abc&cursor=1725911162329308&compress=true", nil)
+		opts, cursor, err := parseJetstreamParams(r)
+		require.NoError(t, err)
+		require.NotNil(t, cursor)
+		require.Equal(t, int64(1725911162329308), *cursor)
+		require.True(t, opts.compress)
+
+		require.True(t, opts.wantsDID("did:plc:abc"))
+		require.False(t, opts.wantsDID("did:plc:other"))
+
+		require.True(t, opts.wantsCollection("app.bsky.feed.post"))
+		require.True(t, opts.wantsCollection("app.bsky.graph.follow"))
+		require.False(t, opts.wantsCollection("app.bsky.feed.like"))
+		require.False(t, opts.wantsCollection("app.bsky.graphs.follow"))
+	})
+
+	t.Run("socket encoding header enables compression", func(t *testing.T) {
+		t.Parallel()
+
+		r := httptest.NewRequest("GET", "/subscribe", nil)
+		r.Header.Set("Socket-Encoding", "zstd")
+		opts, _, err := parseJetstreamParams(r)
+		require.NoError(t, err)
+		require.True(t, opts.compress)
+	})
+
+	t.Run("invalid params", func(t *testing.T) {
+		t.Parallel()
+
+		for _, query := range []string{
+			"wantedCollections=not-an-nsid",
+			"wantedCollections=.*",
+			"wantedDids=notadid",
+			"cursor=abc",
+			"cursor=-1",
+			"compress=maybe",
+		} {
+			r := httptest.NewRequest("GET", "/subscribe?"+query, nil)
+			_, _, err := parseJetstreamParams(r)
+			require.Error(t, err, query)
+		}
+	})
+
+	t.Run("too many collections", func(t *testing.T) {
+		t.Parallel()
+
+		var sb strings.Builder
+		for i := range maxWantedCollections + 1 {
+			sb.WriteString("&wantedCollections=com.example.c" + strconv.Itoa(i))
+		}
+		r := httptest.NewRequest("GET", "/subscribe?"+sb.String()[1:], nil)
+		_, _, err := parseJetstreamParams(r)
+		require.ErrorContains(t, err, "too many wantedCollections")
+	})
+}
+
+func TestEncodeJetstreamEvents(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	allOpts := &jetstreamOptions{}
+
+	t.Run("commit with records", func(t *testing.T) {
+		t.Parallel()
+
+		post := map[string]any{"$type": "app.bsky.feed.post", "text": "hello jetstream"}
+		like := map[string]any{"$type": "app.bsky.feed.like", "createdAt": "2024-01-01T00:00:00Z"}
+		postCID, carBytes := testEventCar(t, post, like)
+
+		event := &types.RepoEvent{
+			Repo: "did:plc:jetstream1",
+			Rev:  "3kabc",
+			Time: timestamppb.New(now),
+			Ops: []*types.RepoOp{
+				{Action: "create", Path: "app.bsky.feed.post/3kpost", Cid: postCID.Bytes()},
+				{Action: "delete", Path: "app.bsky.feed.like/3klike"},
+			},
+			Blocks: carBytes,
+		}
+
+		msgs, err := encodeJetstreamEvents(event, allOpts)
+		require.NoError(t, err)
+		require.Len(t, msgs, 2)
+
+		require.Equal(t, "did:plc:jetstream1", msgs[0].DID)
+		require.Equal(t, now.UnixMicro(), msgs[0].TimeUS)
+		require.Equal(t, jetstreamKindCommit, msgs[0].Kind)
+		require.Equal(t, "create", msgs[0].Commit.Operation)
+		require.Equal(t, "app.bsky.feed.post", msgs[0].Commit.Collection)
+		require.Equal(t, "3kpost", msgs[0].Commit.RKey)
+		require.Equal(t, "3kabc", msgs[0].Commit.Rev)
+		require.Equal(t, postCID.String(), msgs[0].Commit.CID)
+		require.Equal(t, "hello jetstream", msgs[0].Commit.Record["text"])
+
+		require.Equal(t, "delete", msgs[1].Commit.Operation)
+		require.Empty(t, msgs[1].Commit.CID)
+		require.Nil(t, msgs[1].Commit.Record)
+
+		// the delete should not carry a record in its JSON either
+		data, err := json.Marshal(msgs[1])
+		require.NoError(t, err)
+		require.NotContains(t, string(data), `"record"`)
+	})
+
+	t.Run("filters commits by collection", func(t *testing.T) {
+		t.Parallel()
+
+		event := &types.RepoEvent{
+			Repo: "did:plc:jetstream2",
+			Time: timestamppb.New(now),
+			Ops: []*types.RepoOp{
+				{Action: "delete", Path: "app.bsky.feed.post/3kpost"},
+				{Action: "delete", Path: "app.bsky.graph.follow/3kfollow"},
+			},
+		}
+
+		opts := &jetstreamOptions{wantedPrefixes: []string{"app.bsky.graph."}}
+		msgs, err := encodeJetstreamEvents(event, opts)
+		require.NoError(t, err)
+		require.Len(t, msgs, 1)
+		require.Equal(t, "app.bsky.graph.follow", msgs[0].Commit.Collection)
+	})
+
+	t.Run("filters by did", func(t *testing.T) {
+		t.Parallel()
+
+		event := &types.RepoEvent{
+			Repo:      "did:plc:jetstream3",
+			Time:      timestamppb.New(now),
+			EventType: types.EventType_EVENT_TYPE_IDENTITY,
+		}
+
+		opts := &jetstreamOptions{wantedDIDs: map[string]struct{}{"did:plc:someoneelse": {}}}
+		msgs, err := encodeJetstreamEvents(event, opts)
+		require.NoError(t, err)
+		require.Empty(t, msgs)
+	})
+
+	t.Run("identity and account events ignore collection filters", func(t *testing.T) {
+		t.Parallel()
+
+		opts := &jetstreamOptions{wantedCollections: map[string]struct{}{"app.bsky.feed.post": {}}}
+
+		msgs, err := encodeJetstreamEvents(&types.RepoEvent{
+			Seq:       42,
+			Repo:      "did:plc:jetstream4",
+			Time:      timestamppb.New(now),
+			EventType: types.EventType_EVENT_TYPE_IDENTITY,
+			Handle:    "jetstream4.dev.atlaspds.dev",
+		}, opts)
+		require.NoError(t, err)
+		require.Len(t, msgs, 1)
+		require.Equal(t, jetstreamKindIdentity, msgs[0].Kind)
+		require.Equal(t, "jetstream4.dev.atlaspds.dev", msgs[0].Identity.Handle)
+		require.Equal(t, int64(42), msgs[0].Identity.Seq)
+
+		msgs, err = encodeJetstreamEvents(&types.RepoEvent{
+			Repo:      "did:plc:jetstream4",
+			Time:      timestamppb.New(now),
+			EventType: types.EventType_EVENT_TYPE_ACCOUNT,
+			Status:    "deactivated",
+		}, opts)
+		require.NoError(t, err)
+		require.Len(t, msgs, 1)
+		require.Equal(t, jetstreamKindAccount, msgs[0].Kind)
+		require.False(t, msgs[0].Account.Active)
+		require.Equal(t, "deactivated", msgs[0].Account.Status)
+	})
+}
+
+func TestJetstreamSubscribe(t *testing.T) {
+	t.Parallel()
+
+	srv := testServer(t)
+	srv.firehose = newFirehose(srv.log, srv.db)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	t.Cleanup(cancel)
+	go srv.firehose.Run(ctx)
+
+	handler := srv.observabilityMiddleware(srv.hostMiddleware(srv.router()))
+	ts := httptest.NewServer(handler)
+	t.Cleanup(ts.Close)
+
+	tsHost := strings.TrimPrefix(ts.URL, "http://")
+	if idx := strings.LastIndex(tsHost, ":"); idx != -1 {
+		tsHost = tsHost[:idx]
+	}
+	srv.hosts[tsHost] = srv.hosts[testPDSHost]
+
+	wsBase := "ws" + strings.TrimPrefix(ts.URL, "http") + "/subscribe"
+
+	t.Run("live filtered events", func(t *testing.T) {
+		t.Parallel()
+
+		actor, _ := setupTestActor(t, srv, "did:plc:jetstreamlive1", "jetstreamlive1@example.com", "jetstreamlive1.dev.atlaspds.dev")
+
+		conn, _, err := websocket.DefaultDialer.Dial(wsBase+"?wantedDids="+actor.Did+"&wantedCollections=app.bsky.feed.post", nil)
+		require.NoError(t, err)
+		defer conn.Close() //nolint:errcheck
+
+		// give the subscriber a moment to register for live events
+		time.Sleep(100 * time.Millisecond)
+
+		createTestRecordDirect(t, srv, actor, "app.bsky.feed.like", map[string]any{
+			"$type":     "app.bsky.feed.like",
+			"createdAt": time.Now().Format(time.RFC3339),
+		})
+		rkey := createTestRecordDirect(t, srv, actor, "app.bsky.feed.post", map[string]any{
+			"$type":     "app.bsky.feed.post",
+			"text":      "hello jetstream",
+			"createdAt": time.Now().Format(time.RFC3339),
+		})
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second)) //nolint:errcheck
+		msgType, data, err := conn.ReadMessage()
+		require.NoError(t, err)
+		require.Equal(t, websocket.TextMessage, msgType)
+
+		var evt jetstreamEvent
+		require.NoError(t, json.Unmarshal(data, &evt))
+		require.Equal(t, actor.Did, evt.DID)
+		require.Equal(t, jetstreamKindCommit, evt.Kind)
+		require.Equal(t, "app.bsky.feed.post", evt.Commit.Collection)
+		require.Equal(t, rkey, evt.Commit.RKey)
+		require.Equal(t, "hello jetstream", evt.Commit.Record["text"])
+	})
+
+	t.Run("cursor replay with compression", func(t *testing.T) {
+		t.Parallel()
+
+		actor, _ := setupTestActor(t, srv, "did:plc:jetstreamreplay1", "jetstreamreplay1@example.com", "jetstreamreplay1.dev.atlaspds.dev")
+
+		start := time.Now().Add(-time.Second).UnixMicro()
+		createTestRecordDirect(t, srv, actor, "app.bsky.feed.post", map[string]any{
+			"$type":     "app.bsky.feed.post",
+			"text":      "replayed",
+			"createdAt": time.Now().Format(time.RFC3339),
+		})
+
+		url := wsBase + "?compress=true&wantedDids=" + actor.Did + "&wantedCollections=app.bsky.feed.post&cursor=" + strconv.FormatInt(start, 10)
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		require.NoError(t, err)
+		defer conn.Close() //nolint:errcheck
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second)) //nolint:errcheck
+		msgType, data, err := conn.ReadMessage()
+		require.NoError(t, err)
+		require.Equal(t, websocket.BinaryMessage, msgType)
+
+		dec, err := zstd.NewReader(nil)
+		require.NoError(t, err)
+		defer dec.Close()
+		data, err = dec.DecodeAll(data, nil)
+		require.NoError(t, err)
+
+		var evt jetstreamEvent
+		require.NoError(t, json.Unmarshal(data, &evt))
+		require.Equal(t, actor.Did, evt.DID)
+		require.GreaterOrEqual(t, evt.TimeUS, start)
+		require.Equal(t, "replayed", evt.Commit.Record["text"])
+	})
+
+	t.Run("invalid params rejected before upgrade", func(t *testing.T) {
+		t.Parallel()
+
+		_, resp, err := websocket.DefaultDialer.Dial(wsBase+"?wantedDids=notadid", nil)
+		require.Error(t, err)
+		require.NotNil(t, resp)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
+
+// testEventCar builds an event CAR slice containing the given records, returning the CID of the first
+func testEventCar(t *testing.T, records ...map[string]any) (cid.Cid, []byte) {
+	t.Helper()
+
+	var blks []blocks.Block
+	for _, rec := range records {
+		raw, err := atdata.MarshalCBOR(rec)
+		require.NoError(t, err)
+
+		c, err := cid.NewPrefixV1(cid.DagCBOR, 0x12).Sum(raw)
+		require.NoError(t, err)
+
+		blk, err := blocks.NewBlockWithCid(raw, c)
+		require.NoError(t, err)
+		blks = append(blks, blk)
+	}
+
+	hb, err := cbor.DumpObject(&car.CarHeader{Roots: []cid.Cid{blks[0].Cid()}, Version: 1})
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, carutil.LdWrite(&buf, hb))
+	for _, blk := range blks {
+		require.NoError(t, carutil.LdWrite(&buf, blk.Cid().Bytes(), blk.RawData()))
+	}
+
+	return blks[0].Cid(), buf.Bytes()
+}
@@ -0,0 +1,35 @@
+package pds
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/jcalabro/atlas/internal/types"
+)
+
+// OpenKey decrypts an actor's private key with the keyring of the actor's host. It implements
+// db.KeyOpener, and sees keyring changes made by config reloads.
+func (s *server) OpenKey(ctx context.Context, host string, key *types.WrappedKey) ([]byte, error) {
+	h := s.getHost(host)
+	if h == nil || h.keyring == nil {
+		return nil, fmt.Errorf("no key-encryption key is configured for host %q", host)
+	}
+
+	return h.keyring.Open(ctx, key)
+}
+
+// sealKey prepares a newly generated private key for storage on an actor. It returns the wrapped
+// key if the host has a key-encryption key, or else a copy of the plaintext key.
+func sealKey(ctx context.Context, host *loadedHostConfig, key []byte) (*types.WrappedKey, []byte, error) {
+	if host.keyring == nil {
+		return nil, slices.Clone(key), nil
+	}
+
+	wrapped, err := host.keyring.Seal(ctx, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encrypt key: %w", err)
+	}
+
+	return wrapped, nil, nil
+}
@@ -1,11 +1,128 @@
 package pds
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/bluesky-social/indigo/atproto/labeling"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/gorilla/websocket"
+	"github.com/jcalabro/atlas/internal/pds/db"
+	pdsmetrics "github.com/jcalabro/atlas/internal/pds/metrics"
+	"github.com/jcalabro/atlas/internal/types"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+const (
+	defaultQueryLabelsLimit = 50
+	maxQueryLabelsLimit     = 250
+)
+
+// LabelsConfig configures the labels a host serves
+type LabelsConfig struct {
+	// Labelers are the DIDs of labeling services whose label streams are consumed and served from
+	// queryLabels. Labels are only stored once their signature has been verified.
+	Labelers []string `toml:"labelers"`
+
+	// SigningKey is the path to a PEM encoded P-256 private key. When set, the host acts as a
+	// labeler under its service DID: its admins may issue labels, which are signed with this key
+	// and streamed from subscribeLabels.
+	SigningKey string `toml:"signing_key"`
+}
+
+// loadLabels validates the labeler DIDs and parses the host's PEM encoded label signing key. The
+// signer is nil if the host isn't a labeler.
+func loadLabels(cfg *LabelsConfig, signingKey []byte) ([]string, *atcrypto.PrivateKeyP256, error) {
+	for _, did := range cfg.Labelers {
+		if _, err := syntax.ParseDID(did); err != nil {
+			return nil, nil, fmt.Errorf("invalid labeler did %q: %w", did, err)
+		}
+	}
+
+	if signingKey == nil {
+		return cfg.Labelers, nil, nil
+	}
+
+	key, err := parseSigningKey(signingKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load label signing key: %w", err)
+	}
+
+	signer, err := atcrypto.ParsePrivateBytesP256(key.D.FillBytes(make([]byte, 32)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid label signing key: %w", err)
+	}
+
+	return cfg.Labelers, signer, nil
+}
+
+// labelSources returns the labelers whose labels the host serves
+func (h *loadedHostConfig) labelSources() []string {
+	sources := make([]string, 0, len(h.labelers)+1)
+	if h.labelSigner != nil {
+		sources = append(sources, h.serviceDID)
+	}
+	return append(sources, h.labelers...)
+}
+
+func signedLabel(l *types.Label) *labeling.Label {
+	out := &labeling.Label{
+		CreatedAt: l.Cts,
+		SourceDID: l.Src,
+		URI:       l.Uri,
+		Val:       l.Val,
+		Version:   l.Ver,
+	}
+	if l.Cid != "" {
+		out.CID = &l.Cid
+	}
+	if l.Exp != "" {
+		out.ExpiresAt = &l.Exp
+	}
+	if l.Neg {
+		out.Negated = &l.Neg
+	}
+	if len(l.Sig) > 0 {
+		out.Sig = l.Sig
+	}
+	return out
+}
+
+func storedLabel(l *labeling.Label) *types.Label {
+	out := &types.Label{
+		Src: l.SourceDID,
+		Uri: l.URI,
+		Val: l.Val,
+		Cts: l.CreatedAt,
+		Sig: l.Sig,
+		Ver: l.Version,
+	}
+	if l.CID != nil {
+		out.Cid = *l.CID
+	}
+	if l.ExpiresAt != nil {
+		out.Exp = *l.ExpiresAt
+	}
+	if l.Negated != nil {
+		out.Neg = *l.Negated
+	}
+	return out
+}
+
+func labelView(l *types.Label) *atproto.LabelDefs_Label {
+	lex := signedLabel(l).ToLexicon()
+	return &lex
+}
+
 func (s *server) handleQueryLabels(w http.ResponseWriter, r *http.Request) {
 	// if the client requests proxying via atproto-proxy header, proxy to appview
 	if r.Header.Get("atproto-proxy") != "" && s.appviewProxy != nil {
@@ -16,9 +133,321 @@ func (s *server) handleQueryLabels(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// otherwise, return empty labels
-	// PDSes don't typically store labels - that's the job of labelers
-	s.jsonOK(w, &atproto.LabelQueryLabels_Output{
-		Labels: []*atproto.LabelDefs_Label{},
+	ctx := r.Context()
+	span := spanFromContext(ctx)
+	defer span.End()
+
+	host := hostFromContext(ctx)
+	query := r.URL.Query()
+
+	limit, err := parseIntParam(r, "limit", defaultQueryLabelsLimit)
+	if err != nil || limit < 1 || limit > maxQueryLabelsLimit {
+		s.badRequest(w, fmt.Errorf("limit must be between 1 and %d", maxQueryLabelsLimit))
+		return
+	}
+
+	patterns := query["uriPatterns"]
+	for _, pattern := range patterns {
+		if pattern == "" {
+			s.badRequest(w, fmt.Errorf("uri patterns may not be empty"))
+			return
+		}
+	}
+
+	// only labels from the host's own labelers are served, along with the self-labels that
+	// records declare unless specific sources were asked for
+	sources := host.labelSources()
+	if requested := query["sources"]; len(requested) > 0 {
+		allowed := make(map[string]struct{}, len(sources))
+		for _, src := range sources {
+			allowed[src] = struct{}{}
+		}
+
+		sources = sources[:0]
+		for _, src := range requested {
+			if _, ok := allowed[src]; ok {
+				sources = append(sources, src)
+			}
+		}
+	}
+
+	span.SetAttributes(
+		attribute.StringSlice("uri_patterns", patterns),
+		attribute.StringSlice("sources", sources),
+		attribute.Int64("limit", limit),
+	)
+
+	out := &atproto.LabelQueryLabels_Output{Labels: []*atproto.LabelDefs_Label{}}
+	if len(patterns) == 0 {
+		s.jsonOK(w, out)
+		return
+	}
+
+	labels, next, err := s.db.QueryLabels(ctx, &db.LabelQuery{
+		URIPatterns: patterns,
+		Sources:     sources,
+		SelfLabels:  len(query["sources"]) == 0,
+		Cursor:      query.Get("cursor"),
+		Limit:       int(limit),
 	})
+	if errors.Is(err, db.ErrInvalidLabelCursor) {
+		s.badRequest(w, err)
+		return
+	}
+	if err != nil {
+		s.internalErr(w, fmt.Errorf("failed to query labels: %w", err))
+		return
+	}
+
+	for _, label := range labels {
+		out.Labels = append(out.Labels, labelView(label))
+	}
+	out.Cursor = nextCursorOrNil(next)
+
+	s.jsonOK(w, out)
+}
+
+type emitLabelInput struct {
+	URI string  `json:"uri"`
+	Cid *string `json:"cid,omitempty"`
+	Val string  `json:"val"`
+	Neg bool    `json:"neg,omitempty"`
+	Exp *string `json:"exp,omitempty"`
+}
+
+// handleEmitLabel issues a label signed by the host's labeler, or negates one it issued earlier
+func (s *server) handleEmitLabel(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	span := spanFromContext(ctx)
+	defer span.End()
+
+	host := hostFromContext(ctx)
+	if host.labelSigner == nil {
+		s.badRequest(w, fmt.Errorf("this host is not a labeler"))
+		return
+	}
+
+	var in emitLabelInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		s.badRequest(w, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+
+	span.SetAttributes(
+		attribute.String("uri", in.URI),
+		attribute.String("val", in.Val),
+		attribute.Bool("neg", in.Neg),
+	)
+
+	label := &labeling.Label{
+		CID:       in.Cid,
+		CreatedAt: syntax.DatetimeNow().String(),
+		ExpiresAt: in.Exp,
+		SourceDID: host.serviceDID,
+		URI:       in.URI,
+		Val:       in.Val,
+		Version:   labeling.ATPROTO_LABEL_VERSION,
+	}
+	if in.Neg {
+		label.Negated = &in.Neg
+	}
+	if err := label.VerifySyntax(); err != nil {
+		s.badRequest(w, err)
+		return
+	}
+
+	if err := label.Sign(host.labelSigner); err != nil {
+		s.internalErr(w, fmt.Errorf("failed to sign label: %w", err))
+		return
+	}
+
+	stored := storedLabel(label)
+	if err := s.db.EmitLabel(ctx, stored); err != nil {
+		s.internalErr(w, fmt.Errorf("failed to emit label: %w", err))
+		return
+	}
+
+	s.audit(ctx, host, "net.atlaspds.admin.emitLabel", stored.Uri, nil, labelView(stored))
+	s.log.Info("admin emitted label", "uri", stored.Uri, "val", stored.Val, "neg", stored.Neg, "seq", stored.Seq)
+
+	s.jsonOK(w, labelView(stored))
+}
+
+// handleSubscribeLabels streams the labels issued by the host's labeler
+func (s *server) handleSubscribeLabels(w http.ResponseWriter, r *http.Request) {
+	host := hostFromContext(r.Context())
+	if host.labelSigner == nil {
+		s.badRequest(w, fmt.Errorf("this host is not a labeler"))
+		return
+	}
+
+	var cursor *int64
+	if param := r.URL.Query().Get("cursor"); param != "" {
+		seq, err := strconv.ParseInt(param, 10, 64)
+		if err != nil || seq < 0 {
+			s.badRequest(w, fmt.Errorf("invalid cursor"))
+			return
+		}
+		cursor = &seq
+	}
+
+	if err := s.streamLabels(r.Context(), w, r, host, cursor); err != nil {
+		s.log.Error("subscribeLabels error", "err", err)
+	}
+}
+
+// streamLabels replays the labels after the cursor, or starts from the latest label if there's no
+// cursor, and then writes new labels to the websocket as they're issued
+func (s *server) streamLabels(ctx context.Context, w http.ResponseWriter, r *http.Request, host *loadedHostConfig, cursor *int64) error {
+	src := host.serviceDID
+
+	latest, err := s.db.LatestLabelSeq(ctx, src)
+	if err != nil {
+		s.internalErr(w, fmt.Errorf("failed to get latest label seq: %w", err))
+		return nil
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return fmt.Errorf("failed to accept websocket: %w", err)
+	}
+	defer conn.Close() //nolint:errcheck
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pdsmetrics.LabelSubscribers.WithLabelValues(host.hostname).Inc()
+	defer pdsmetrics.LabelSubscribers.WithLabelValues(host.hostname).Dec()
+
+	write := func(msg []byte) error {
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout)) //nolint:errcheck
+		return conn.WriteMessage(websocket.BinaryMessage, msg)
+	}
+
+	seq := latest
+	if cursor != nil {
+		if *cursor > latest {
+			msg, err := encodeErrorFrame("FutureCursor", "cursor is ahead of the latest label")
+			if err != nil {
+				return err
+			}
+			return write(msg)
+		}
+		seq = *cursor
+	}
+
+	// read from the websocket so that disconnects are noticed
+	conn.SetReadDeadline(time.Now().Add(pongWait)) //nolint:errcheck
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(pongWait)) //nolint:errcheck
+		return nil
+	})
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				cancel()
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+
+	for {
+		// the watch is set before catching up so that labels issued in the meantime aren't missed
+		watch, err := s.db.WatchLabelSeq(ctx, src)
+		if err != nil {
+			return fmt.Errorf("failed to watch label seq: %w", err)
+		}
+
+		for {
+			labels, err := s.db.GetLabelsSince(ctx, src, seq, maxEventBatchSize)
+			if err != nil {
+				watch.Cancel()
+				return fmt.Errorf("failed to get labels: %w", err)
+			}
+
+			for _, label := range labels {
+				msg, err := encodeLabelsFrame(label)
+				if err != nil {
+					watch.Cancel()
+					return err
+				}
+				if err := write(msg); err != nil {
+					watch.Cancel()
+					return nil
+				}
+				seq = label.Seq
+			}
+
+			if len(labels) < maxEventBatchSize {
+				break
+			}
+		}
+
+		ready := make(chan struct{})
+		go func() {
+			watch.BlockUntilReady()
+			close(ready)
+		}()
+
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				watch.Cancel()
+				return nil
+			case <-ping.C:
+				conn.SetWriteDeadline(time.Now().Add(writeTimeout)) //nolint:errcheck
+				if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+					watch.Cancel()
+					return nil
+				}
+			case <-ready:
+				break wait
+			}
+		}
+	}
+}
+
+// encodeLabelsFrame converts a label to a #labels message in the ATProto CBOR wire format
+func encodeLabelsFrame(label *types.Label) ([]byte, error) {
+	body := &atproto.LabelSubscribeLabels_Labels{
+		Seq:    label.Seq,
+		Labels: []*atproto.LabelDefs_Label{labelView(label)},
+	}
+
+	var buf bytes.Buffer
+
+	header := events.EventHeader{
+		Op:      events.EvtKindMessage,
+		MsgType: "#labels",
+	}
+	if err := header.MarshalCBOR(&buf); err != nil {
+		return nil, fmt.Errorf("failed to marshal header: %w", err)
+	}
+
+	if err := body.MarshalCBOR(&buf); err != nil {
+		return nil, fmt.Errorf("failed to marshal labels: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// encodeErrorFrame builds an error frame in the ATProto CBOR wire format
+func encodeErrorFrame(name, message string) ([]byte, error) {
+	var buf bytes.Buffer
+
+	header := events.EventHeader{Op: events.EvtKindErrorFrame}
+	if err := header.MarshalCBOR(&buf); err != nil {
+		return nil, fmt.Errorf("failed to marshal header: %w", err)
+	}
+
+	frame := events.ErrorFrame{Error: name, Message: message}
+	if err := frame.MarshalCBOR(&buf); err != nil {
+		return nil, fmt.Errorf("failed to marshal error frame: %w", err)
+	}
+
+	return buf.Bytes(), nil
 }
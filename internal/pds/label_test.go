@@ -1,12 +1,25 @@
 package pds
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/labeling"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/gorilla/websocket"
+	"github.com/jcalabro/atlas/internal/types"
+	"github.com/jcalabro/atlas/internal/util"
 	"github.com/stretchr/testify/require"
 )
 
@@ -136,3 +149,392 @@ func TestHandleQueryLabels(t *testing.T) {
 		require.Empty(t, out.Labels)
 	})
 }
+
+func TestLoadLabels(t *testing.T) {
+	t.Parallel()
+
+	labelers, signer, err := loadLabels(&LabelsConfig{}, nil)
+	require.NoError(t, err)
+	require.Empty(t, labelers)
+	require.Nil(t, signer)
+
+	key, err := os.ReadFile("../../testdata/jwt-signing-key.pem")
+	require.NoError(t, err)
+
+	labelers, signer, err = loadLabels(&LabelsConfig{
+		Labelers: []string{"did:plc:ar7c4by46qjdydhdevvrndac"},
+	}, key)
+	require.NoError(t, err)
+	require.Equal(t, []string{"did:plc:ar7c4by46qjdydhdevvrndac"}, labelers)
+	require.NotNil(t, signer)
+
+	_, _, err = loadLabels(&LabelsConfig{Labelers: []string{"not-a-did"}}, nil)
+	require.Error(t, err)
+
+	_, _, err = loadLabels(&LabelsConfig{}, []byte("not a pem"))
+	require.Error(t, err)
+
+	_, err = readHostKeys(&Host{JWTSigningKey: "../../testdata/jwt-signing-key.pem", Labels: LabelsConfig{SigningKey: "./nonexistent.pem"}})
+	require.Error(t, err)
+}
+
+func testLabelSigner(t *testing.T) *atcrypto.PrivateKeyP256 {
+	t.Helper()
+
+	key, err := atcrypto.GeneratePrivateKeyP256()
+	require.NoError(t, err)
+	return key
+}
+
+func signTestLabel(t *testing.T, key atcrypto.PrivateKey, src, uri, val string) *labeling.Label {
+	t.Helper()
+
+	label := &labeling.Label{
+		CreatedAt: syntax.DatetimeNow().String(),
+		SourceDID: src,
+		URI:       uri,
+		Val:       val,
+		Version:   labeling.ATPROTO_LABEL_VERSION,
+	}
+	require.NoError(t, label.Sign(key))
+	return label
+}
+
+func TestVerifyLabel(t *testing.T) {
+	t.Parallel()
+
+	key := testLabelSigner(t)
+	pub, err := key.PublicKey()
+	require.NoError(t, err)
+
+	label := signTestLabel(t, key, "did:plc:labeler", "at://did:plc:abc/app.bsky.feed.post/3jui7kd2xs22b", "spam")
+	require.NoError(t, verifyLabel(label, "did:plc:labeler", pub))
+
+	// labels survive being stored and served without invalidating their signatures
+	roundTripped := signedLabel(storedLabel(label))
+	require.NoError(t, verifyLabel(roundTripped, "did:plc:labeler", pub))
+
+	// labelers may only issue their own labels
+	require.Error(t, verifyLabel(label, "did:plc:other", pub))
+
+	tampered := *label
+	tampered.Val = "porn"
+	require.Error(t, verifyLabel(&tampered, "did:plc:labeler", pub))
+
+	other, err := testLabelSigner(t).PublicKey()
+	require.NoError(t, err)
+	require.Error(t, verifyLabel(label, "did:plc:labeler", other))
+}
+
+func TestLabelFrames(t *testing.T) {
+	t.Parallel()
+
+	label := storedLabel(signTestLabel(t, testLabelSigner(t), "did:plc:labeler", "did:plc:abc", "spam"))
+	label.Seq = 7
+
+	msg, err := encodeLabelsFrame(label)
+	require.NoError(t, err)
+
+	frame, err := decodeLabelsFrame(msg)
+	require.NoError(t, err)
+	require.Equal(t, int64(7), frame.Seq)
+	require.Len(t, frame.Labels, 1)
+	require.Equal(t, "spam", frame.Labels[0].Val)
+	require.Equal(t, []byte(label.Sig), []byte(frame.Labels[0].Sig))
+
+	msg, err = encodeErrorFrame("FutureCursor", "too far")
+	require.NoError(t, err)
+	_, err = decodeLabelsFrame(msg)
+	require.ErrorContains(t, err, "FutureCursor")
+
+	// other message types are skipped
+	var buf bytes.Buffer
+	require.NoError(t, (&events.EventHeader{Op: events.EvtKindMessage, MsgType: "#info"}).MarshalCBOR(&buf))
+	require.NoError(t, (&atproto.LabelSubscribeLabels_Info{Name: "OutdatedCursor"}).MarshalCBOR(&buf))
+	frame, err = decodeLabelsFrame(buf.Bytes())
+	require.NoError(t, err)
+	require.Nil(t, frame)
+}
+
+func TestLabelStreamURL(t *testing.T) {
+	t.Parallel()
+
+	u, err := labelStreamURL("https://mod.bsky.app", 0)
+	require.NoError(t, err)
+	require.Equal(t, "wss://mod.bsky.app/xrpc/com.atproto.label.subscribeLabels", u)
+
+	u, err = labelStreamURL("http://localhost:2583", 42)
+	require.NoError(t, err)
+	require.Equal(t, "ws://localhost:2583/xrpc/com.atproto.label.subscribeLabels?cursor=42", u)
+
+	_, err = labelStreamURL("ftp://mod.bsky.app", 0)
+	require.Error(t, err)
+}
+
+// labelerTestServer returns a test server whose host is a labeler with a unique DID
+func labelerTestServer(t *testing.T) *server {
+	t.Helper()
+
+	srv := testServer(t)
+	host := srv.hosts[testPDSHost]
+	host.serviceDID = "did:web:labeler-" + strings.ToLower(util.RandString(8)) + ".example.com"
+	host.labelSigner = testLabelSigner(t)
+	return srv
+}
+
+func emitTestLabel(t *testing.T, srv *server, in *emitLabelInput) *atproto.LabelDefs_Label {
+	t.Helper()
+
+	body, err := json.Marshal(in)
+	require.NoError(t, err)
+
+	req := addTestHostContext(srv, httptest.NewRequest(http.MethodPost, "/xrpc/net.atlaspds.admin.emitLabel", bytes.NewReader(body)))
+	w := httptest.NewRecorder()
+	srv.handleEmitLabel(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var out atproto.LabelDefs_Label
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &out))
+	return &out
+}
+
+func queryTestLabels(t *testing.T, srv *server, query string) *atproto.LabelQueryLabels_Output {
+	t.Helper()
+
+	req := addTestHostContext(srv, httptest.NewRequest(http.MethodGet, "/xrpc/com.atproto.label.queryLabels?"+query, nil))
+	w := httptest.NewRecorder()
+	srv.handleQueryLabels(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var out atproto.LabelQueryLabels_Output
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &out))
+	return &out
+}
+
+func TestEmitAndQueryLabels(t *testing.T) {
+	t.Parallel()
+
+	srv := labelerTestServer(t)
+	host := srv.hosts[testPDSHost]
+	pub, err := host.labelSigner.PublicKey()
+	require.NoError(t, err)
+
+	subject := "did:plc:" + strings.ToLower(util.RandString(24))
+	post := "at://" + subject + "/app.bsky.feed.post/3jui7kd2xs22b"
+
+	emitted := emitTestLabel(t, srv, &emitLabelInput{URI: post, Val: "spam"})
+	require.Equal(t, host.serviceDID, emitted.Src)
+
+	label := labeling.FromLexicon(emitted)
+	require.NoError(t, label.VerifySignature(pub))
+
+	emitTestLabel(t, srv, &emitLabelInput{URI: subject, Val: "impersonation"})
+	emitTestLabel(t, srv, &emitLabelInput{URI: post, Val: "rude"})
+
+	out := queryTestLabels(t, srv, "uriPatterns="+post)
+	require.Len(t, out.Labels, 2)
+	require.Nil(t, out.Cursor)
+
+	// prefixes match both the account and its records, without returning any label twice
+	out = queryTestLabels(t, srv, "uriPatterns="+subject+"*&uriPatterns=at://"+subject+"/*&limit=2")
+	require.Len(t, out.Labels, 2)
+	require.NotNil(t, out.Cursor)
+
+	next := queryTestLabels(t, srv, "uriPatterns="+subject+"*&uriPatterns=at://"+subject+"/*&limit=2&cursor="+*out.Cursor)
+	require.Len(t, next.Labels, 1)
+	require.Nil(t, next.Cursor)
+
+	// negations remove the label
+	emitTestLabel(t, srv, &emitLabelInput{URI: post, Val: "rude", Neg: true})
+	out = queryTestLabels(t, srv, "uriPatterns="+post)
+	require.Len(t, out.Labels, 1)
+	require.Equal(t, "spam", out.Labels[0].Val)
+
+	// labels from sources the host doesn't serve aren't returned
+	out = queryTestLabels(t, srv, "uriPatterns="+post+"&sources=did:plc:someoneelse")
+	require.Empty(t, out.Labels)
+
+	req := addTestHostContext(srv, httptest.NewRequest(http.MethodGet, "/?uriPatterns="+post+"&cursor=bogus", nil))
+	w := httptest.NewRecorder()
+	srv.handleQueryLabels(w, req)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	t.Run("rejects invalid labels", func(t *testing.T) {
+		body, err := json.Marshal(&emitLabelInput{URI: "not a uri", Val: "spam"})
+		require.NoError(t, err)
+
+		req := addTestHostContext(srv, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+		w := httptest.NewRecorder()
+		srv.handleEmitLabel(w, req)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("hosts that aren't labelers can't emit labels", func(t *testing.T) {
+		plain := testServer(t)
+
+		body, err := json.Marshal(&emitLabelInput{URI: post, Val: "spam"})
+		require.NoError(t, err)
+
+		req := addTestHostContext(plain, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+		w := httptest.NewRecorder()
+		plain.handleEmitLabel(w, req)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestSelfLabels(t *testing.T) {
+	t.Parallel()
+
+	srv := testServer(t)
+	actor, _ := setupTestActor(t, srv, "did:plc:selflabels", "selflabels@example.com", "selflabels.dev.atlaspds.dev")
+
+	rkey := createTestRecordDirect(t, srv, actor, "app.bsky.feed.post", map[string]any{
+		"$type":     "app.bsky.feed.post",
+		"text":      "nsfw",
+		"createdAt": time.Now().Format(time.RFC3339),
+		"labels": map[string]any{
+			"$type":  "com.atproto.label.defs#selfLabels",
+			"values": []any{map[string]any{"val": "porn"}},
+		},
+	})
+
+	uri := "at://" + actor.Did + "/app.bsky.feed.post/" + rkey
+	out := queryTestLabels(t, srv, "uriPatterns="+uri)
+	require.Len(t, out.Labels, 1)
+	require.Equal(t, actor.Did, out.Labels[0].Src)
+	require.Equal(t, "porn", out.Labels[0].Val)
+	require.Empty(t, out.Labels[0].Sig)
+
+	// self-labels are left out when asking for specific labelers
+	out = queryTestLabels(t, srv, "uriPatterns="+uri+"&sources=did:plc:labeler")
+	require.Empty(t, out.Labels)
+}
+
+func TestSubscribeLabels(t *testing.T) {
+	t.Parallel()
+
+	srv := labelerTestServer(t)
+	host := srv.hosts[testPDSHost]
+	pub, err := host.labelSigner.PublicKey()
+	require.NoError(t, err)
+
+	ts := httptest.NewServer(srv.observabilityMiddleware(srv.hostMiddleware(srv.router())))
+	t.Cleanup(ts.Close)
+
+	tsHost := strings.TrimPrefix(ts.URL, "http://")
+	if idx := strings.LastIndex(tsHost, ":"); idx != -1 {
+		tsHost = tsHost[:idx]
+	}
+	srv.hosts[tsHost] = host
+
+	for _, val := range []string{"spam", "rude"} {
+		emitTestLabel(t, srv, &emitLabelInput{URI: "did:plc:subscribelabels", Val: val})
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/xrpc/com.atproto.label.subscribeLabels?cursor=0", nil)
+	require.NoError(t, err)
+	defer conn.Close() //nolint:errcheck
+
+	read := func() *atproto.LabelSubscribeLabels_Labels {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second)) //nolint:errcheck
+		_, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+
+		frame, err := decodeLabelsFrame(msg)
+		require.NoError(t, err)
+		require.NotNil(t, frame)
+		return frame
+	}
+
+	// earlier labels are replayed, then new ones are streamed as they're issued
+	for ndx, val := range []string{"spam", "rude"} {
+		frame := read()
+		require.Equal(t, int64(ndx+1), frame.Seq)
+		require.Equal(t, val, frame.Labels[0].Val)
+
+		label := labeling.FromLexicon(frame.Labels[0])
+		require.NoError(t, verifyLabel(&label, host.serviceDID, pub))
+	}
+
+	emitTestLabel(t, srv, &emitLabelInput{URI: "did:plc:subscribelabels", Val: "spam", Neg: true})
+	frame := read()
+	require.Equal(t, int64(3), frame.Seq)
+	require.True(t, *frame.Labels[0].Neg)
+
+	// cursors from the future are rejected
+	future, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/xrpc/com.atproto.label.subscribeLabels?cursor=100", nil)
+	require.NoError(t, err)
+	defer future.Close() //nolint:errcheck
+
+	future.SetReadDeadline(time.Now().Add(5 * time.Second)) //nolint:errcheck
+	_, msg, err := future.ReadMessage()
+	require.NoError(t, err)
+	_, err = decodeLabelsFrame(msg)
+	require.ErrorContains(t, err, "FutureCursor")
+}
+
+func TestLabelSync(t *testing.T) {
+	t.Parallel()
+
+	srv := testServer(t)
+	labelerDID := "did:web:labelsync-" + strings.ToLower(util.RandString(8)) + ".example.com"
+	key := testLabelSigner(t)
+	subject := "did:plc:" + strings.ToLower(util.RandString(24))
+
+	// a remote labeler that sends one valid label and one that isn't signed by its key
+	valid := storedLabel(signTestLabel(t, key, labelerDID, subject, "spam"))
+	valid.Seq = 1
+	forged := storedLabel(signTestLabel(t, testLabelSigner(t), labelerDID, subject, "forged"))
+	forged.Seq = 2
+
+	labeler := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close() //nolint:errcheck
+
+		for _, label := range []*types.Label{valid, forged} {
+			msg, err := encodeLabelsFrame(label)
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+				return
+			}
+		}
+
+		// hold the connection open until the consumer goes away
+		conn.ReadMessage() //nolint:errcheck
+	}))
+	t.Cleanup(labeler.Close)
+
+	pub, err := key.PublicKey()
+	require.NoError(t, err)
+
+	dir := srv.directory.(*identity.MockDirectory)
+	dir.Insert(identity.Identity{
+		DID:      syntax.DID(labelerDID),
+		Keys:     map[string]identity.VerificationMethod{"atproto_label": {Type: "Multikey", PublicKeyMultibase: pub.Multibase()}},
+		Services: map[string]identity.ServiceEndpoint{"atproto_labeler": {Type: "AtprotoLabeler", URL: labeler.URL}},
+	})
+
+	host := srv.hosts[testPDSHost]
+	host.labelers = []string{labelerDID}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	ls := newLabelSync(srv.log, srv.db, srv.directory, srv.allHosts)
+	go ls.subscribe(ctx, labelerDID) //nolint:errcheck
+
+	require.Eventually(t, func() bool {
+		cursor, err := srv.db.LabelerCursor(ctx, labelerDID)
+		return err == nil && cursor == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	out := queryTestLabels(t, srv, "uriPatterns="+subject)
+	require.Len(t, out.Labels, 1)
+	require.Equal(t, "spam", out.Labels[0].Val)
+	require.Equal(t, labelerDID, out.Labels[0].Src)
+}
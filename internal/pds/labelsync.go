@@ -0,0 +1,283 @@
+package pds
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/labeling"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/gorilla/websocket"
+	"github.com/jcalabro/atlas/internal/pds/db"
+	"github.com/jcalabro/atlas/internal/pds/metrics"
+	"github.com/jcalabro/atlas/internal/types"
+)
+
+const (
+	// labelSyncRefreshInterval is how often the configured labelers are re-read, so that config
+	// reloads start and stop their streams
+	labelSyncRefreshInterval = time.Minute
+
+	// labelSyncRetryInterval is how long to wait before reconnecting to a labeler's stream
+	labelSyncRetryInterval = 30 * time.Second
+)
+
+// labelSync consumes the subscribeLabels streams of the labelers configured on each host,
+// verifies each label's signature against the labeler's DID document, and stores the labels so
+// they can be served from queryLabels
+type labelSync struct {
+	log       *slog.Logger
+	db        *db.DB
+	directory identity.Directory
+	hosts     func() []*loadedHostConfig
+	dialer    *websocket.Dialer
+
+	// running holds a cancel func for the stream of each labeler being consumed
+	running map[string]context.CancelFunc
+}
+
+func newLabelSync(log *slog.Logger, db *db.DB, directory identity.Directory, hosts func() []*loadedHostConfig) *labelSync {
+	return &labelSync{
+		log:       log.With("component", "labelsync"),
+		db:        db,
+		directory: directory,
+		hosts:     hosts,
+		dialer:    websocket.DefaultDialer,
+		running:   make(map[string]context.CancelFunc),
+	}
+}
+
+// Run consumes the streams of every configured labeler until ctx is cancelled
+func (l *labelSync) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	l.refresh(ctx, &wg)
+
+	ticker := time.NewTicker(labelSyncRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.refresh(ctx, &wg)
+		}
+	}
+}
+
+// refresh starts consuming newly configured labelers and stops those that were removed. Each
+// labeler is only consumed once, even if several hosts use it.
+func (l *labelSync) refresh(ctx context.Context, wg *sync.WaitGroup) {
+	configured := make(map[string]struct{})
+	for _, host := range l.hosts() {
+		for _, did := range host.labelers {
+			configured[did] = struct{}{}
+		}
+	}
+
+	for did := range configured {
+		if _, ok := l.running[did]; ok {
+			continue
+		}
+
+		subCtx, cancel := context.WithCancel(ctx)
+		l.running[did] = cancel
+		wg.Go(func() { l.consume(subCtx, did) })
+	}
+
+	for did, cancel := range l.running {
+		if _, ok := configured[did]; !ok {
+			cancel()
+			delete(l.running, did)
+		}
+	}
+}
+
+// consume follows a labeler's stream, reconnecting after failures, until ctx is cancelled
+func (l *labelSync) consume(ctx context.Context, did string) {
+	log := l.log.With("labeler", did)
+	log.Info("consuming labeler stream")
+
+	for {
+		err := l.subscribe(ctx, did)
+		if ctx.Err() != nil {
+			log.Info("stopped consuming labeler stream")
+			return
+		}
+		log.Warn("labeler stream failed, will reconnect", "err", err, "retry_in", labelSyncRetryInterval)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(labelSyncRetryInterval):
+		}
+	}
+}
+
+// labelerIdentity resolves the labeler's stream endpoint and signing key
+func (l *labelSync) labelerIdentity(ctx context.Context, did string) (string, atcrypto.PublicKey, error) {
+	ident, err := l.directory.LookupDID(ctx, syntax.DID(did))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to resolve labeler: %w", err)
+	}
+
+	endpoint := ident.GetServiceEndpoint("atproto_labeler")
+	if endpoint == "" {
+		return "", nil, fmt.Errorf("labeler did document has no atproto_labeler service")
+	}
+
+	key, err := ident.GetPublicKey("atproto_label")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get labeler signing key: %w", err)
+	}
+
+	return endpoint, key, nil
+}
+
+// subscribe reads the labeler's stream from the stored cursor until the connection fails
+func (l *labelSync) subscribe(ctx context.Context, did string) error {
+	endpoint, key, err := l.labelerIdentity(ctx, did)
+	if err != nil {
+		return err
+	}
+
+	cursor, err := l.db.LabelerCursor(ctx, did)
+	if err != nil {
+		return err
+	}
+
+	u, err := labelStreamURL(endpoint, cursor)
+	if err != nil {
+		return err
+	}
+
+	conn, _, err := l.dialer.DialContext(ctx, u, nil)
+	if err != nil {
+		return fmt.Errorf("failed to connect to labeler: %w", err)
+	}
+	defer conn.Close() //nolint:errcheck
+
+	// closing the connection unblocks the read loop when ctx is cancelled
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close() //nolint:errcheck
+	})
+	defer stop()
+
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("failed to read from labeler: %w", err)
+		}
+
+		frame, err := decodeLabelsFrame(msg)
+		if err != nil {
+			return err
+		}
+		if frame == nil {
+			continue
+		}
+
+		labels := make([]*types.Label, 0, len(frame.Labels))
+		for _, lex := range frame.Labels {
+			label := labeling.FromLexicon(lex)
+
+			err := verifyLabel(&label, did, key)
+			if err != nil {
+				// the labeler may have rotated its key, so it's looked up again before giving up
+				if purgeErr := l.directory.Purge(ctx, syntax.DID(did).AtIdentifier()); purgeErr == nil {
+					if _, fresh, lookupErr := l.labelerIdentity(ctx, did); lookupErr == nil {
+						key = fresh
+						err = verifyLabel(&label, did, key)
+					}
+				}
+			}
+			if err != nil {
+				metrics.LabelsConsumed.WithLabelValues(did, "invalid").Inc()
+				l.log.Warn("dropping label that failed verification", "labeler", did, "uri", label.URI, "val", label.Val, "err", err)
+				continue
+			}
+
+			metrics.LabelsConsumed.WithLabelValues(did, "ok").Inc()
+			labels = append(labels, storedLabel(&label))
+		}
+
+		if err := l.db.SaveLabels(ctx, did, labels, frame.Seq); err != nil {
+			return err
+		}
+	}
+}
+
+// verifyLabel checks that a label from a labeler's stream was issued and signed by that labeler
+func verifyLabel(label *labeling.Label, did string, key atcrypto.PublicKey) error {
+	if label.SourceDID != did {
+		return fmt.Errorf("label src %q does not match labeler", label.SourceDID)
+	}
+	if err := label.VerifySyntax(); err != nil {
+		return err
+	}
+	return label.VerifySignature(key)
+}
+
+// labelStreamURL returns the websocket URL of a labeler's subscribeLabels stream
+func labelStreamURL(endpoint string, cursor int64) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid labeler endpoint %q: %w", endpoint, err)
+	}
+
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	case "http":
+		u.Scheme = "ws"
+	default:
+		return "", fmt.Errorf("invalid labeler endpoint %q: must be an http(s) url", endpoint)
+	}
+
+	u.Path = "/xrpc/com.atproto.label.subscribeLabels"
+	if cursor > 0 {
+		u.RawQuery = url.Values{"cursor": {strconv.FormatInt(cursor, 10)}}.Encode()
+	}
+
+	return u.String(), nil
+}
+
+// decodeLabelsFrame parses a message from a subscribeLabels stream. It returns nil for messages
+// other than #labels, and an error for error frames.
+func decodeLabelsFrame(msg []byte) (*atproto.LabelSubscribeLabels_Labels, error) {
+	r := bytes.NewReader(msg)
+
+	var header events.EventHeader
+	if err := header.UnmarshalCBOR(r); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal header: %w", err)
+	}
+
+	switch {
+	case header.Op == events.EvtKindErrorFrame:
+		var frame events.ErrorFrame
+		if err := frame.UnmarshalCBOR(r); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal error frame: %w", err)
+		}
+		return nil, fmt.Errorf("labeler sent an error: %s: %s", frame.Error, frame.Message)
+	case header.MsgType != "#labels":
+		return nil, nil
+	}
+
+	var frame atproto.LabelSubscribeLabels_Labels
+	if err := frame.UnmarshalCBOR(r); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal labels: %w", err)
+	}
+
+	return &frame, nil
+}
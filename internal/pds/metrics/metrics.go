@@ -82,6 +82,72 @@ var (
 		[]string{"pds_host", "event_type"},
 	)
 
+	// Relay metrics
+	RelayCrawlRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:      "relay_crawl_requests",
+			Namespace: namespace,
+			Help:      "Total number of requestCrawl calls made to relays",
+		},
+		[]string{"pds_host", "relay", "status"},
+	)
+
+	RelayConnections = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:      "relay_connections",
+			Namespace: namespace,
+			Help:      "Current number of firehose subscriptions attributed to each configured relay",
+		},
+		[]string{"pds_host", "relay"},
+	)
+
+	RelayDisconnected = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:      "relay_disconnected",
+			Namespace: namespace,
+			Help:      "Set to 1 when a configured relay has not subscribed to the firehose within its alert window",
+		},
+		[]string{"pds_host", "relay"},
+	)
+
+	// Jetstream metrics
+	JetstreamSubscribers = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:      "jetstream_subscribers",
+			Namespace: namespace,
+			Help:      "Current number of jetstream subscribers",
+		},
+		[]string{"pds_host"},
+	)
+
+	JetstreamEventsWritten = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:      "jetstream_events_written",
+			Namespace: namespace,
+			Help:      "Total number of JSON events written to jetstream subscriber websockets",
+		},
+		[]string{"pds_host", "event_type"},
+	)
+
+	// Label metrics
+	LabelsConsumed = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:      "labels_consumed",
+			Namespace: namespace,
+			Help:      "Total number of labels read from remote labelers' streams",
+		},
+		[]string{"labeler", "status"},
+	)
+
+	LabelSubscribers = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:      "label_subscribers",
+			Namespace: namespace,
+			Help:      "Current number of subscribeLabels subscribers",
+		},
+		[]string{"pds_host"},
+	)
+
 	// Blob storage metrics
 	BlobUploads = promauto.NewCounterVec(
 		prometheus.CounterOpts{
@@ -174,4 +240,38 @@ var (
 		},
 		[]string{"operation", "collection", "status"}, // operation: create, update, delete
 	)
+
+	// Block garbage collection metrics
+	BlockGCQueued = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name:      "block_gc_queued_total",
+			Namespace: namespace,
+			Help:      "Total number of unreachable repo blocks queued for deletion",
+		},
+	)
+
+	BlockGCDeleted = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name:      "block_gc_deleted_total",
+			Namespace: namespace,
+			Help:      "Total number of unreachable repo blocks deleted by the sweeper",
+		},
+	)
+
+	// Config reload metrics
+	ConfigLastReloadSuccessful = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name:      "config_last_reload_successful",
+			Namespace: namespace,
+			Help:      "Whether the last config reload succeeded (1) or failed (0)",
+		},
+	)
+
+	ConfigLastReloadTimestamp = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name:      "config_last_reload_timestamp_seconds",
+			Namespace: namespace,
+			Help:      "Unix time of the last config reload attempt",
+		},
+	)
 )
@@ -3,6 +3,7 @@ package pds
 import (
 	"bufio"
 	"context"
+	"crypto/subtle"
 	"errors"
 	"fmt"
 	"net"
@@ -11,6 +12,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/jcalabro/atlas/internal/env"
 	"github.com/jcalabro/atlas/internal/pds/db"
 	"github.com/jcalabro/atlas/internal/pds/metrics"
@@ -22,8 +24,10 @@ import (
 
 type actorContextKey struct{}
 type hostContextKey struct{}
+type requestIDContextKey struct{}
 type spanContextKey struct{}
 type tokenContextKey struct{}
+type userAgentContextKey struct{}
 
 func actorFromContext(ctx context.Context) *types.Actor {
 	if actor, ok := ctx.Value(actorContextKey{}).(*types.Actor); ok {
@@ -39,6 +43,13 @@ func hostFromContext(ctx context.Context) *loadedHostConfig {
 	return nil
 }
 
+func requestIDFromContext(ctx context.Context) string {
+	if id, ok := ctx.Value(requestIDContextKey{}).(string); ok {
+		return id
+	}
+	return ""
+}
+
 func spanFromContext(ctx context.Context) trace.Span {
 	if span, ok := ctx.Value(spanContextKey{}).(trace.Span); ok {
 		return span
@@ -53,6 +64,13 @@ func tokenFromContext(ctx context.Context) string {
 	return ""
 }
 
+func userAgentFromContext(ctx context.Context) string {
+	if ua, ok := ctx.Value(userAgentContextKey{}).(string); ok {
+		return ua
+	}
+	return ""
+}
+
 type responseWriter struct {
 	http.ResponseWriter
 	status int
@@ -94,6 +112,14 @@ func (s *server) corsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+const (
+	// requestIDHeader carries the id that ties a request to its logs, traces, and audit events
+	requestIDHeader = "X-Request-Id"
+
+	// maxRequestIDLength bounds request ids accepted from clients and proxies
+	maxRequestIDLength = 128
+)
+
 func (s *server) observabilityMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx, span := s.tracer.Start(r.Context(), r.Method+" "+r.URL.Path,
@@ -103,6 +129,10 @@ func (s *server) observabilityMiddleware(next http.Handler) http.Handler {
 
 		ctx = context.WithValue(ctx, spanContextKey{}, span)
 
+		requestID := requestIDFromHeader(r.Header.Get(requestIDHeader))
+		ctx = context.WithValue(ctx, requestIDContextKey{}, requestID)
+		w.Header().Set(requestIDHeader, requestID)
+
 		rw := &responseWriter{
 			ResponseWriter: w,
 			status:         http.StatusOK,
@@ -113,6 +143,7 @@ func (s *server) observabilityMiddleware(next http.Handler) http.Handler {
 			attribute.String("http.path", r.URL.Path),
 			attribute.String("http.remote_addr", r.RemoteAddr),
 			attribute.String("http.user_agent", r.UserAgent()),
+			attribute.String("http.request_id", requestID),
 		)
 
 		start := time.Now()
@@ -135,24 +166,42 @@ func (s *server) observabilityMiddleware(next http.Handler) http.Handler {
 		metrics.Requests.WithLabelValues(env.Version, serviceName, r.Host, r.URL.Path, r.Method, status).Inc()
 		metrics.RequestDuration.WithLabelValues(serviceName, r.Host, r.URL.Path, r.Method, status).Observe(duration)
 
-		s.log.Debug("request", "method", r.Method, "path", r.URL.Path, "status", rw.status, "duration", duration)
+		s.log.Debug("request", "method", r.Method, "path", r.URL.Path, "status", rw.status, "duration", duration, "request_id", requestID)
 	})
 }
 
+// requestIDFromHeader returns the request id set by an upstream proxy, or a new one if the header
+// is missing or isn't a reasonable id
+func requestIDFromHeader(header string) string {
+	if header == "" || len(header) > maxRequestIDLength {
+		return uuid.NewString()
+	}
+
+	for _, c := range header {
+		if c < '!' || c > '~' {
+			return uuid.NewString()
+		}
+	}
+
+	return header
+}
+
 // hostMiddleware validates the Host header against configured PDS hosts
 // and stores the host configuration in the request context.
 func (s *server) hostMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		header := r.Host
+		reqHost := requestHost(r)
 
-		// strip port if present
-		if idx := strings.LastIndex(header, ":"); idx != -1 {
-			header = header[:idx]
+		host, userDomain := s.routeHost(reqHost)
+		if host == nil {
+			s.notFound(w, fmt.Errorf("host %q not found", reqHost))
+			return
 		}
 
-		host := s.getHost(header)
-		if host == nil {
-			s.notFound(w, fmt.Errorf("host %q not found", header))
+		// handle subdomains only serve the endpoints that resolve the handle, so that the rest of
+		// the PDS can't be reached under a name that a user controls
+		if userDomain && !userDomainPaths[r.URL.Path] {
+			s.notFound(w, fmt.Errorf("%s is not served for handle %q", r.URL.Path, reqHost))
 			return
 		}
 
@@ -161,6 +210,21 @@ func (s *server) hostMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// userDomainPaths are the identity endpoints served to handle subdomains of a host's user domains
+var userDomainPaths = map[string]bool{
+	"/.well-known/atproto-did":                 true,
+	"/xrpc/com.atproto.identity.resolveHandle": true,
+}
+
+// requestHost returns the lowercased request hostname, without the port
+func requestHost(r *http.Request) string {
+	reqHost := r.Host
+	if idx := strings.LastIndex(reqHost, ":"); idx != -1 {
+		reqHost = reqHost[:idx]
+	}
+	return strings.ToLower(reqHost)
+}
+
 // authMiddleware extracts and verifies the JWT from the Authorization header
 // and loads the associated actor. For refresh endpoints, it requires a refresh token.
 func (s *server) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
@@ -213,23 +277,35 @@ func (s *server) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		// for refresh token requests, verify the token exists in the actor's refresh tokens
-		if isRefresh {
-			found := false
-			for _, rt := range actor.RefreshTokens {
-				if rt.Token == tokenString {
-					// check if expired
-					if rt.ExpiresAt.AsTime().Before(time.Now()) {
-						s.unauthorized(w, fmt.Errorf("refresh token expired"))
-						return
-					}
-
-					found = true
-					break
-				}
+		if actor.Takedown != nil {
+			s.accountTakedown(w)
+			return
+		}
+
+		// tokens issued before sessions got their own subspace are still stored on the actor, so
+		// they're moved over before the session is checked
+		if len(actor.RefreshTokens) > 0 { //nolint:staticcheck
+			if _, err := s.db.MigrateLegacySessions(ctx, actor.Did); err != nil {
+				s.log.Error("failed to migrate legacy sessions", "did", actor.Did, "error", err)
+				s.internalErr(w, fmt.Errorf("failed to authenticate"))
+				return
+			}
+
+			// so that saving this copy of the actor doesn't bring back a session revoked later
+			actor.RefreshTokens = nil //nolint:staticcheck
+		}
+
+		// access tokens are only valid while their session hasn't been revoked. Refresh tokens are
+		// checked atomically as they're exchanged.
+		if !isRefresh {
+			_, err := s.db.GetSession(ctx, actor.Did, claims.JTI)
+			if errors.Is(err, db.ErrNotFound) {
+				s.unauthorized(w, fmt.Errorf("session has been revoked"))
+				return
 			}
-			if !found {
-				s.unauthorized(w, fmt.Errorf("refresh token not found"))
+			if err != nil {
+				s.log.Error("failed to get session", "did", actor.Did, "error", err)
+				s.internalErr(w, fmt.Errorf("failed to authenticate"))
 				return
 			}
 		}
@@ -240,3 +316,77 @@ func (s *server) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		next(w, r.WithContext(ctx))
 	}
 }
+
+// adminMiddleware requires HTTP basic auth with the host's admin password, or the access token of
+// one of the host's admin DIDs. The admin API is disabled on hosts that configure neither.
+func (s *server) adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	withAdminDID := s.authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if !isAdminDID(hostFromContext(ctx), actorFromContext(ctx)) {
+			s.forbidden(w, fmt.Errorf("account is not an admin of this host"))
+			return
+		}
+
+		next(w, r)
+	})
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := hostFromContext(r.Context())
+		if host == nil || (host.adminPassword == "" && len(host.adminDIDs) == 0) {
+			s.forbidden(w, fmt.Errorf("admin api is not enabled on this host"))
+			return
+		}
+
+		if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+			withAdminDID(w, r)
+			return
+		}
+
+		user, password, ok := r.BasicAuth()
+		if !ok {
+			s.unauthorized(w, fmt.Errorf("admin credentials are required"))
+			return
+		}
+
+		if !validAdminCredentials(host, user, password) {
+			s.unauthorized(w, fmt.Errorf("invalid admin credentials"))
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func validAdminCredentials(host *loadedHostConfig, user, password string) bool {
+	if host.adminPassword == "" {
+		return false
+	}
+
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte("admin")) == 1
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(host.adminPassword)) == 1
+	return userOK && passwordOK
+}
+
+// isAdminDID returns true if the actor is one of the host's admins
+func isAdminDID(host *loadedHostConfig, actor *types.Actor) bool {
+	if host == nil || actor == nil || actor.PdsHost != host.hostname {
+		return false
+	}
+
+	_, ok := host.adminDIDs[actor.Did]
+	return ok
+}
+
+// isAdminRequest returns true if the request carries valid admin credentials for the host, or was
+// authenticated as one of the host's admin DIDs
+func isAdminRequest(r *http.Request, host *loadedHostConfig) bool {
+	if host == nil {
+		return false
+	}
+	if isAdminDID(host, actorFromContext(r.Context())) {
+		return true
+	}
+
+	user, password, ok := r.BasicAuth()
+	return ok && validAdminCredentials(host, user, password)
+}
@@ -4,6 +4,7 @@ import (
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -76,3 +77,126 @@ func TestSpanFromContext(t *testing.T) {
 
 	handler.ServeHTTP(rw, req)
 }
+
+func TestRequestID(t *testing.T) {
+	t.Parallel()
+
+	s := &server{
+		log:    slog.Default(),
+		tracer: noop.NewTracerProvider().Tracer("test"),
+	}
+
+	var seen string
+	handler := s.observabilityMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestIDFromContext(r.Context())
+	}))
+
+	// ids are generated when the request doesn't have one
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.NotEmpty(t, seen)
+	require.Equal(t, seen, rw.Header().Get(requestIDHeader))
+
+	// ids set by a proxy are kept
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(requestIDHeader, "proxy-request-1")
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+	require.Equal(t, "proxy-request-1", seen)
+	require.Equal(t, "proxy-request-1", rw.Header().Get(requestIDHeader))
+
+	// unreasonable ids are replaced
+	for _, id := range []string{strings.Repeat("a", maxRequestIDLength+1), "has spaces", "new\nline"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(requestIDHeader, id)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		require.NotEqual(t, id, seen)
+		require.NotEmpty(t, seen)
+	}
+}
+
+// testMultiHostServer has two hosts whose user domains nest, so that routing has to prefer the
+// longest match
+func testMultiHostServer() *server {
+	return &server{
+		log:    slog.Default(),
+		tracer: noop.NewTracerProvider().Tracer("test"),
+		hosts: map[string]*loadedHostConfig{
+			"example.com": {
+				hostname:    "example.com",
+				serviceDID:  "did:web:example.com",
+				userDomains: []string{".example.com"},
+			},
+			"pds.example.com": {
+				hostname:    "pds.example.com",
+				serviceDID:  "did:web:pds.example.com",
+				userDomains: []string{".pds.example.com"},
+			},
+		},
+	}
+}
+
+func TestRouteHost(t *testing.T) {
+	t.Parallel()
+
+	s := testMultiHostServer()
+
+	for reqHost, expected := range map[string]struct {
+		hostname   string
+		userDomain bool
+	}{
+		"example.com":           {"example.com", false},
+		"pds.example.com":       {"pds.example.com", false},
+		"alice.example.com":     {"example.com", true},
+		"alice.pds.example.com": {"pds.example.com", true},
+		"a.b.pds.example.com":   {"pds.example.com", true},
+	} {
+		host, userDomain := s.routeHost(reqHost)
+		require.NotNil(t, host, reqHost)
+		require.Equal(t, expected.hostname, host.hostname, reqHost)
+		require.Equal(t, expected.userDomain, userDomain, reqHost)
+	}
+
+	for _, reqHost := range []string{"other.com", "notexample.com", "com"} {
+		host, _ := s.routeHost(reqHost)
+		require.Nil(t, host, reqHost)
+	}
+}
+
+func TestHostMiddleware(t *testing.T) {
+	t.Parallel()
+
+	s := testMultiHostServer()
+
+	var routed *loadedHostConfig
+	handler := s.hostMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routed = hostFromContext(r.Context())
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(host, path string) int {
+		routed = nil
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Host = host
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	require.Equal(t, http.StatusOK, serve("pds.example.com:443", "/xrpc/com.atproto.server.describeServer"))
+	require.Equal(t, "pds.example.com", routed.hostname)
+
+	// handle subdomains are routed to the host that owns the user domain
+	require.Equal(t, http.StatusOK, serve("Alice.PDS.example.com", "/.well-known/atproto-did"))
+	require.Equal(t, "pds.example.com", routed.hostname)
+
+	require.Equal(t, http.StatusOK, serve("alice.example.com", "/xrpc/com.atproto.identity.resolveHandle"))
+	require.Equal(t, "example.com", routed.hostname)
+
+	// but only for the identity endpoints
+	require.Equal(t, http.StatusNotFound, serve("alice.pds.example.com", "/xrpc/com.atproto.server.createSession"))
+	require.Equal(t, http.StatusNotFound, serve("alice.pds.example.com", "/.well-known/did.json"))
+	require.Nil(t, routed)
+
+	require.Equal(t, http.StatusNotFound, serve("other.com", "/.well-known/atproto-did"))
+}
@@ -293,7 +293,7 @@ func (s *server) handleProxy(w http.ResponseWriter, r *http.Request) {
 	var serviceAuthToken string
 	if actor != nil {
 		// create service auth token for the target service
-		token, err := createServiceAuthToken(actor, serviceDID, lxm)
+		token, err := s.createServiceAuthToken(r.Context(), actor, serviceDID, lxm)
 		if err != nil {
 			s.log.Error("failed to create service auth token", "err", err, "did", actor.Did)
 			s.internalErr(w, fmt.Errorf("authentication error"))
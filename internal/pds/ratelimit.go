@@ -0,0 +1,546 @@
+package pds
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/jcalabro/atlas/internal/pds/db"
+)
+
+// rateLimitSweepInterval is how often the counters of past rate limit windows are deleted
+const rateLimitSweepInterval = time.Minute
+
+// RateLimits configures a host's request budgets. Each budget is written as "<requests>/<window>",
+// such as "30/5m". Budgets that are left empty use the defaults, and "off" disables a limit.
+type RateLimits struct {
+	LoginPerIP         string `toml:"login_per_ip"`
+	LoginPerIdentifier string `toml:"login_per_identifier"`
+	LoginPerHost       string `toml:"login_per_host"`
+
+	CreateAccountPerIP   string `toml:"create_account_per_ip"`
+	CreateAccountPerHost string `toml:"create_account_per_host"`
+
+	// LockoutFailures is the number of consecutive failed logins that temporarily lock an account
+	// (defaults to 10). A negative value disables lockout.
+	LockoutFailures int `toml:"lockout_failures"`
+
+	// LockoutDuration is how long a locked account stays locked, such as "15m" (the default)
+	LockoutDuration string `toml:"lockout_duration"`
+
+	// Routes overrides the budgets of individual XRPC routes, keyed by method NSID, or "proxy" for
+	// requests proxied to the appview
+	Routes map[string]RouteRateLimits `toml:"routes"`
+
+	// WritePointsPerHour and WritePointsPerDay budget the repo writes of each account. Creates cost
+	// 3 points, updates 2 and deletes 1. A negative value disables the limit.
+	WritePointsPerHour int `toml:"write_points_per_hour"`
+	WritePointsPerDay  int `toml:"write_points_per_day"`
+
+	// BypassDIDs are accounts and services, such as a trusted labeler, that are exempt from the
+	// XRPC route and repo write limits
+	BypassDIDs []string `toml:"bypass_dids"`
+}
+
+// RouteRateLimits configures the budgets of a single XRPC route. The per-DID budget only applies to
+// authenticated requests.
+type RouteRateLimits struct {
+	PerIP  string `toml:"per_ip"`
+	PerDID string `toml:"per_did"`
+}
+
+var defaultRateLimits = RateLimits{
+	LoginPerIP:         "30/5m",
+	LoginPerIdentifier: "30/5m",
+	LoginPerHost:       "3000/5m",
+
+	CreateAccountPerIP:   "10/1h",
+	CreateAccountPerHost: "300/1h",
+
+	LockoutFailures: 10,
+	LockoutDuration: "15m",
+
+	Routes: map[string]RouteRateLimits{
+		"com.atproto.repo.applyWrites": {PerIP: "3000/5m", PerDID: "1500/5m"},
+		"com.atproto.repo.uploadBlob":  {PerIP: "600/5m", PerDID: "300/5m"},
+		"com.atproto.repo.listRecords": {PerIP: "3000/5m"},
+		"com.atproto.sync.getRepo":     {PerIP: "300/5m"},
+		"proxy":                        {PerIP: "3000/5m"},
+
+		"com.atproto.temp.requestPhoneVerification": {PerIP: "10/1h"},
+		"com.atproto.moderation.createReport":       {PerIP: "300/1h", PerDID: "100/1h"},
+	},
+
+	WritePointsPerHour: 5000,
+	WritePointsPerDay:  35000,
+}
+
+// write point costs of each kind of repo write
+const (
+	createWritePoints = 3
+	updateWritePoints = 2
+	deleteWritePoints = 1
+)
+
+// budget is a parsed rate limit budget. The zero value is an unlimited budget.
+type budget struct {
+	limit  int64
+	window time.Duration
+}
+
+// parseBudget parses a budget of the form "<requests>/<window>", or "off"
+func parseBudget(s string) (budget, error) {
+	if s == "off" {
+		return budget{}, nil
+	}
+
+	count, window, ok := strings.Cut(s, "/")
+	if !ok {
+		return budget{}, fmt.Errorf("invalid budget %q: must be of the form <requests>/<window>", s)
+	}
+
+	limit, err := strconv.ParseInt(count, 10, 64)
+	if err != nil || limit <= 0 {
+		return budget{}, fmt.Errorf("invalid budget %q: request count must be a positive integer", s)
+	}
+
+	dur, err := time.ParseDuration(window)
+	if err != nil || dur < time.Second {
+		return budget{}, fmt.Errorf("invalid budget %q: window must be a duration of at least 1s", s)
+	}
+
+	return budget{limit: limit, window: dur}, nil
+}
+
+// rateLimit returns the limit for the given subject, or false if the budget is unlimited
+func (b budget) rateLimit(name, subject string) (db.RateLimit, bool) {
+	if b.limit == 0 {
+		return db.RateLimit{}, false
+	}
+	return db.RateLimit{Name: name, Subject: subject, Limit: b.limit, Window: b.window}, true
+}
+
+// rateLimits contains a host's parsed request budgets
+type rateLimits struct {
+	loginPerIP         budget
+	loginPerIdentifier budget
+	loginPerHost       budget
+
+	createAccountPerIP   budget
+	createAccountPerHost budget
+
+	// lockout.MaxFailures is zero if lockout is disabled
+	lockout db.LoginLockoutPolicy
+
+	// routes contains the budgets of every rate limited route
+	routes map[string]routeBudgets
+
+	writePointsPerHour budget
+	writePointsPerDay  budget
+
+	bypassDIDs map[string]struct{}
+}
+
+type routeBudgets struct {
+	perIP  budget
+	perDID budget
+}
+
+func loadRateLimits(cfg *RateLimits) (*rateLimits, error) {
+	orDefault := func(val, def string) string {
+		if val == "" {
+			return def
+		}
+		return val
+	}
+
+	limits := &rateLimits{}
+	budgets := []struct {
+		name string
+		val  string
+		def  string
+		dst  *budget
+	}{
+		{"login_per_ip", cfg.LoginPerIP, defaultRateLimits.LoginPerIP, &limits.loginPerIP},
+		{"login_per_identifier", cfg.LoginPerIdentifier, defaultRateLimits.LoginPerIdentifier, &limits.loginPerIdentifier},
+		{"login_per_host", cfg.LoginPerHost, defaultRateLimits.LoginPerHost, &limits.loginPerHost},
+		{"create_account_per_ip", cfg.CreateAccountPerIP, defaultRateLimits.CreateAccountPerIP, &limits.createAccountPerIP},
+		{"create_account_per_host", cfg.CreateAccountPerHost, defaultRateLimits.CreateAccountPerHost, &limits.createAccountPerHost},
+	}
+	for _, b := range budgets {
+		parsed, err := parseBudget(orDefault(b.val, b.def))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", b.name, err)
+		}
+		*b.dst = parsed
+	}
+
+	lockoutDuration, err := time.ParseDuration(orDefault(cfg.LockoutDuration, defaultRateLimits.LockoutDuration))
+	if err != nil || lockoutDuration <= 0 {
+		return nil, fmt.Errorf("lockout_duration must be a positive duration")
+	}
+
+	switch {
+	case cfg.LockoutFailures > 0:
+		limits.lockout = db.LoginLockoutPolicy{MaxFailures: int64(cfg.LockoutFailures), Duration: lockoutDuration}
+	case cfg.LockoutFailures == 0:
+		limits.lockout = db.LoginLockoutPolicy{MaxFailures: int64(defaultRateLimits.LockoutFailures), Duration: lockoutDuration}
+	}
+
+	for route := range cfg.Routes {
+		if _, ok := defaultRateLimits.Routes[route]; !ok {
+			return nil, fmt.Errorf("routes: %q is not a rate limited route", route)
+		}
+	}
+
+	limits.routes = make(map[string]routeBudgets, len(defaultRateLimits.Routes))
+	for route, def := range defaultRateLimits.Routes {
+		override := cfg.Routes[route]
+
+		perIP, err := parseBudget(orDefault(override.PerIP, def.PerIP))
+		if err != nil {
+			return nil, fmt.Errorf("routes.%q.per_ip: %w", route, err)
+		}
+
+		perDID := budget{}
+		if val := orDefault(override.PerDID, def.PerDID); val != "" {
+			if perDID, err = parseBudget(val); err != nil {
+				return nil, fmt.Errorf("routes.%q.per_did: %w", route, err)
+			}
+		}
+
+		limits.routes[route] = routeBudgets{perIP: perIP, perDID: perDID}
+	}
+
+	pointsBudget := func(val, def int, window time.Duration) budget {
+		switch {
+		case val > 0:
+			return budget{limit: int64(val), window: window}
+		case val == 0:
+			return budget{limit: int64(def), window: window}
+		default:
+			return budget{}
+		}
+	}
+	limits.writePointsPerHour = pointsBudget(cfg.WritePointsPerHour, defaultRateLimits.WritePointsPerHour, time.Hour)
+	limits.writePointsPerDay = pointsBudget(cfg.WritePointsPerDay, defaultRateLimits.WritePointsPerDay, 24*time.Hour)
+
+	limits.bypassDIDs = make(map[string]struct{}, len(cfg.BypassDIDs))
+	for _, did := range cfg.BypassDIDs {
+		if _, err := syntax.ParseDID(did); err != nil {
+			return nil, fmt.Errorf("bypass_dids: invalid did %q: %w", did, err)
+		}
+		limits.bypassDIDs[did] = struct{}{}
+	}
+
+	return limits, nil
+}
+
+// trustedProxies decides which peers may report the client's address with X-Forwarded-For
+type trustedProxies struct {
+	// all trusts every peer, which is only safe when TLS is terminated by a load balancer that
+	// every request passes through
+	all      bool
+	prefixes []netip.Prefix
+}
+
+// loadTrustedProxies parses the configured proxy addresses and CIDR ranges. If none are configured,
+// every peer is trusted unless the PDS terminates TLS itself, since clients then connect directly.
+func loadTrustedProxies(addrs []string, terminatesTLS bool) (*trustedProxies, error) {
+	if len(addrs) == 0 {
+		return &trustedProxies{all: !terminatesTLS}, nil
+	}
+
+	proxies := &trustedProxies{prefixes: make([]netip.Prefix, 0, len(addrs))}
+	for _, addr := range addrs {
+		prefix, err := netip.ParsePrefix(addr)
+		if err != nil {
+			ip, ierr := netip.ParseAddr(addr)
+			if ierr != nil {
+				return nil, fmt.Errorf("invalid address or cidr range %q", addr)
+			}
+			prefix = netip.PrefixFrom(ip, ip.BitLen())
+		}
+		proxies.prefixes = append(proxies.prefixes, prefix.Masked())
+	}
+
+	return proxies, nil
+}
+
+func (p *trustedProxies) trusts(addr string) bool {
+	if p == nil {
+		return false
+	}
+	if p.all {
+		return true
+	}
+
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+
+	for _, prefix := range p.prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address that per-IP rate limits apply to. That's the peer address, unless
+// the peer is a trusted proxy. Then it's the last X-Forwarded-For entry that wasn't appended by a
+// trusted proxy, since earlier entries are supplied by the client and can't be trusted.
+func (s *server) clientIP(r *http.Request) string {
+	peer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		peer = host
+	}
+	if !s.proxies.trusts(peer) {
+		return peer
+	}
+
+	ip := peer
+	entries := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := strings.TrimSpace(entries[i])
+		if entry == "" {
+			break
+		}
+
+		ip = entry
+		if s.proxies.all || !s.proxies.trusts(entry) {
+			break
+		}
+	}
+
+	return ip
+}
+
+// checkRateLimits counts the request against the given limits and sets RateLimit-* headers for
+// the most constrained one. If any limit is exceeded, it writes a 429 and returns false.
+//
+// Rate limiting fails open: if the counters can't be updated, the request is allowed.
+func (s *server) checkRateLimits(w http.ResponseWriter, r *http.Request, limits ...db.RateLimit) bool {
+	if len(limits) == 0 {
+		return true
+	}
+
+	results, err := s.db.ConsumeRateLimits(r.Context(), time.Now(), limits)
+	if err != nil {
+		s.log.Error("failed to check rate limits", "err", err)
+		return true
+	}
+
+	// report the exceeded limit that resets last, or else the one with the least remaining
+	tightest := results[0]
+	for _, res := range results[1:] {
+		switch {
+		case tightest.Allowed && !res.Allowed:
+			tightest = res
+		case tightest.Allowed == res.Allowed && !res.Allowed && res.Reset.After(tightest.Reset):
+			tightest = res
+		case tightest.Allowed && res.Allowed && res.Remaining < tightest.Remaining:
+			tightest = res
+		}
+	}
+
+	h := w.Header()
+	h.Set("RateLimit-Limit", strconv.FormatInt(tightest.Limit, 10))
+	h.Set("RateLimit-Remaining", strconv.FormatInt(tightest.Remaining, 10))
+	h.Set("RateLimit-Reset", strconv.FormatInt(tightest.Reset.Unix(), 10))
+	h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", tightest.Limit, int64(tightest.Window.Seconds())))
+
+	if tightest.Allowed {
+		return true
+	}
+
+	s.tooManyRequests(w, time.Until(tightest.Reset), fmt.Errorf("rate limit exceeded"))
+	return false
+}
+
+// loginRateLimits returns the limits that apply to a login attempt for the given account, which is
+// the account's did if it exists and otherwise the normalized identifier
+func (s *server) loginRateLimits(host *loadedHostConfig, r *http.Request, account string) []db.RateLimit {
+	if host.rateLimits == nil {
+		return nil
+	}
+
+	var limits []db.RateLimit
+	add := func(b budget, name, subject string) {
+		if limit, ok := b.rateLimit(name, subject); ok {
+			limits = append(limits, limit)
+		}
+	}
+
+	add(host.rateLimits.loginPerIP, "login-ip", host.hostname+"/"+s.clientIP(r))
+	add(host.rateLimits.loginPerIdentifier, "login-identifier", host.hostname+"/"+account)
+	add(host.rateLimits.loginPerHost, "login-host", host.hostname)
+
+	return limits
+}
+
+// createAccountRateLimits returns the limits that apply to an account creation
+func (s *server) createAccountRateLimits(host *loadedHostConfig, r *http.Request) []db.RateLimit {
+	if host.rateLimits == nil {
+		return nil
+	}
+
+	var limits []db.RateLimit
+	add := func(b budget, name, subject string) {
+		if limit, ok := b.rateLimit(name, subject); ok {
+			limits = append(limits, limit)
+		}
+	}
+
+	add(host.rateLimits.createAccountPerIP, "create-account-ip", host.hostname+"/"+s.clientIP(r))
+	add(host.rateLimits.createAccountPerHost, "create-account-host", host.hostname)
+
+	return limits
+}
+
+// bypassesRateLimits returns true if the request is exempt from the XRPC route and repo write
+// limits, because it was made by an admin or by an account or service that's trusted by the host
+func (s *server) bypassesRateLimits(r *http.Request, limits *rateLimits) bool {
+	if actor := actorFromContext(r.Context()); actor != nil {
+		if _, ok := limits.bypassDIDs[actor.Did]; ok {
+			return true
+		}
+	}
+
+	return isAdminRequest(r, hostFromContext(r.Context()))
+}
+
+// rateLimitMiddleware applies the budgets of the given route. It must be wrapped by authMiddleware
+// on authenticated routes so that per-DID budgets can be applied.
+func (s *server) rateLimitMiddleware(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := hostFromContext(r.Context())
+		if host == nil || host.rateLimits == nil || s.bypassesRateLimits(r, host.rateLimits) {
+			next(w, r)
+			return
+		}
+
+		budgets := host.rateLimits.routes[route]
+
+		var limits []db.RateLimit
+		if limit, ok := budgets.perIP.rateLimit("route-ip:"+route, host.hostname+"/"+s.clientIP(r)); ok {
+			limits = append(limits, limit)
+		}
+		if actor := actorFromContext(r.Context()); actor != nil {
+			if limit, ok := budgets.perDID.rateLimit("route-did:"+route, actor.Did); ok {
+				limits = append(limits, limit)
+			}
+		}
+
+		if !s.checkRateLimits(w, r, limits...) {
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// checkWritePoints spends the given number of repo write points of the authenticated actor. If the
+// actor is out of points, it writes a 429 and returns false.
+func (s *server) checkWritePoints(w http.ResponseWriter, r *http.Request, points int64) bool {
+	host := hostFromContext(r.Context())
+	actor := actorFromContext(r.Context())
+	if host == nil || host.rateLimits == nil || actor == nil || s.bypassesRateLimits(r, host.rateLimits) {
+		return true
+	}
+
+	var limits []db.RateLimit
+	if limit, ok := host.rateLimits.writePointsPerHour.rateLimit("write-points-hour", actor.Did); ok {
+		limit.Cost = points
+		limits = append(limits, limit)
+	}
+	if limit, ok := host.rateLimits.writePointsPerDay.rateLimit("write-points-day", actor.Did); ok {
+		limit.Cost = points
+		limits = append(limits, limit)
+	}
+
+	return s.checkRateLimits(w, r, limits...)
+}
+
+// writePoints returns the number of write points that the given repo write costs
+func writePoints(action string) int64 {
+	switch action {
+	case "create":
+		return createWritePoints
+	case "update":
+		return updateWritePoints
+	default:
+		return deleteWritePoints
+	}
+}
+
+// sweepRateLimits periodically deletes the counters of past rate limit windows until ctx is
+// cancelled
+func (s *server) sweepRateLimits(ctx context.Context) {
+	ticker := time.NewTicker(rateLimitSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.db.SweepRateLimits(ctx, time.Now()); err != nil && ctx.Err() == nil {
+				s.log.Error("failed to sweep rate limits", "err", err)
+			}
+		}
+	}
+}
+
+type unlockAccountInput struct {
+	Did string `json:"did"`
+}
+
+// handleUnlockAccount clears an account's failed logins, lifting a brute-force lockout
+func (s *server) handleUnlockAccount(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	span := spanFromContext(ctx)
+	defer span.End()
+
+	host := hostFromContext(ctx)
+
+	var in unlockAccountInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		s.badRequest(w, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+
+	if _, err := syntax.ParseDID(in.Did); err != nil {
+		s.badRequest(w, fmt.Errorf("invalid did: %w", err))
+		return
+	}
+
+	// admins may only unlock accounts on their own host
+	actor, err := s.db.GetActorByDID(ctx, in.Did)
+	if errors.Is(err, db.ErrNotFound) || (err == nil && actor.PdsHost != host.hostname) {
+		s.notFound(w, fmt.Errorf("account not found"))
+		return
+	}
+	if err != nil {
+		s.internalErr(w, fmt.Errorf("failed to get actor: %w", err))
+		return
+	}
+
+	if err := s.db.ClearLoginFailures(ctx, in.Did); err != nil {
+		s.internalErr(w, fmt.Errorf("failed to unlock account: %w", err))
+		return
+	}
+
+	s.audit(ctx, host, "net.atlaspds.admin.unlockAccount", in.Did, nil, nil)
+	s.log.Info("unlocked account", "did", in.Did)
+}
@@ -0,0 +1,403 @@
+package pds
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jcalabro/atlas/internal/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBudget(t *testing.T) {
+	t.Parallel()
+
+	b, err := parseBudget("30/5m")
+	require.NoError(t, err)
+	require.Equal(t, budget{limit: 30, window: 5 * time.Minute}, b)
+
+	b, err = parseBudget("off")
+	require.NoError(t, err)
+	_, ok := b.rateLimit("login", "subject")
+	require.False(t, ok)
+
+	for _, bad := range []string{"", "30", "0/5m", "-1/5m", "abc/5m", "30/abc", "30/500ms"} {
+		_, err := parseBudget(bad)
+		require.Error(t, err, bad)
+	}
+}
+
+func TestLoadRateLimits(t *testing.T) {
+	t.Parallel()
+
+	t.Run("defaults", func(t *testing.T) {
+		t.Parallel()
+
+		limits, err := loadRateLimits(&RateLimits{})
+		require.NoError(t, err)
+		require.Equal(t, budget{limit: 30, window: 5 * time.Minute}, limits.loginPerIP)
+		require.Equal(t, budget{limit: 300, window: time.Hour}, limits.createAccountPerHost)
+		require.EqualValues(t, 10, limits.lockout.MaxFailures)
+		require.Equal(t, 15*time.Minute, limits.lockout.Duration)
+	})
+
+	t.Run("overrides", func(t *testing.T) {
+		t.Parallel()
+
+		limits, err := loadRateLimits(&RateLimits{
+			LoginPerIP:      "5/1m",
+			LoginPerHost:    "off",
+			LockoutFailures: -1,
+		})
+		require.NoError(t, err)
+		require.Equal(t, budget{limit: 5, window: time.Minute}, limits.loginPerIP)
+		require.Equal(t, budget{}, limits.loginPerHost)
+		require.Zero(t, limits.lockout.MaxFailures)
+	})
+
+	t.Run("routes", func(t *testing.T) {
+		t.Parallel()
+
+		limits, err := loadRateLimits(&RateLimits{
+			Routes: map[string]RouteRateLimits{
+				"com.atproto.repo.uploadBlob": {PerDID: "off"},
+			},
+			WritePointsPerDay: -1,
+			BypassDIDs:        []string{"did:web:labeler.example.com"},
+		})
+		require.NoError(t, err)
+		require.Equal(t, routeBudgets{perIP: budget{limit: 600, window: 5 * time.Minute}}, limits.routes["com.atproto.repo.uploadBlob"])
+		require.Equal(t, budget{limit: 300, window: 5 * time.Minute}, limits.routes["com.atproto.sync.getRepo"].perIP)
+		require.Equal(t, budget{limit: 5000, window: time.Hour}, limits.writePointsPerHour)
+		require.Equal(t, budget{}, limits.writePointsPerDay)
+		require.Contains(t, limits.bypassDIDs, "did:web:labeler.example.com")
+
+		_, err = loadRateLimits(&RateLimits{Routes: map[string]RouteRateLimits{"com.atproto.repo.getRecord": {PerIP: "1/1s"}}})
+		require.ErrorContains(t, err, "not a rate limited route")
+
+		_, err = loadRateLimits(&RateLimits{BypassDIDs: []string{"labeler"}})
+		require.ErrorContains(t, err, "bypass_dids")
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := loadRateLimits(&RateLimits{LoginPerIdentifier: "lots"})
+		require.ErrorContains(t, err, "login_per_identifier")
+
+		_, err = loadRateLimits(&RateLimits{LockoutDuration: "forever"})
+		require.ErrorContains(t, err, "lockout_duration")
+	})
+}
+
+func TestLoadTrustedProxies(t *testing.T) {
+	t.Parallel()
+
+	proxies, err := loadTrustedProxies(nil, false)
+	require.NoError(t, err)
+	require.True(t, proxies.all)
+
+	// clients connect directly when the PDS terminates TLS
+	proxies, err = loadTrustedProxies(nil, true)
+	require.NoError(t, err)
+	require.False(t, proxies.all)
+	require.False(t, proxies.trusts("192.0.2.1"))
+
+	proxies, err = loadTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"}, true)
+	require.NoError(t, err)
+	require.True(t, proxies.trusts("10.1.2.3"))
+	require.True(t, proxies.trusts("::ffff:10.1.2.3"))
+	require.True(t, proxies.trusts("192.0.2.1"))
+	require.True(t, proxies.trusts("2001:db8::1"))
+	require.False(t, proxies.trusts("192.0.2.2"))
+	require.False(t, proxies.trusts("not-an-ip"))
+
+	_, err = loadTrustedProxies([]string{"nope"}, false)
+	require.ErrorContains(t, err, "invalid address")
+
+	var none *trustedProxies
+	require.False(t, none.trusts("10.1.2.3"))
+}
+
+func TestClientIP(t *testing.T) {
+	t.Parallel()
+
+	clientIP := func(proxies *trustedProxies, remoteAddr, xff string) string {
+		s := &server{proxies: proxies}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		if xff != "" {
+			req.Header.Set("X-Forwarded-For", xff)
+		}
+		return s.clientIP(req)
+	}
+
+	t.Run("behind a load balancer that terminates tls", func(t *testing.T) {
+		t.Parallel()
+
+		proxies, err := loadTrustedProxies(nil, false)
+		require.NoError(t, err)
+
+		require.Equal(t, "192.0.2.1", clientIP(proxies, "192.0.2.1:1234", ""))
+
+		// the load balancer's entry is the last one
+		require.Equal(t, "198.51.100.2", clientIP(proxies, "192.0.2.1:1234", "203.0.113.7, 198.51.100.2"))
+		require.Equal(t, "198.51.100.3", clientIP(proxies, "192.0.2.1:1234", "198.51.100.3"))
+	})
+
+	t.Run("spoofed headers on direct connections are ignored", func(t *testing.T) {
+		t.Parallel()
+
+		// the PDS terminates TLS, so clients connect directly
+		proxies, err := loadTrustedProxies(nil, true)
+		require.NoError(t, err)
+
+		require.Equal(t, "192.0.2.1", clientIP(proxies, "192.0.2.1:1234", "198.51.100.2"))
+		require.Equal(t, "192.0.2.1", clientIP(proxies, "192.0.2.1:1234", "203.0.113.7, 198.51.100.2"))
+
+		// likewise for peers that aren't one of the configured proxies
+		proxies, err = loadTrustedProxies([]string{"10.0.0.0/8"}, true)
+		require.NoError(t, err)
+		require.Equal(t, "192.0.2.1", clientIP(proxies, "192.0.2.1:1234", "198.51.100.2"))
+
+		// and when no proxies are configured at all
+		require.Equal(t, "192.0.2.1", clientIP(nil, "192.0.2.1:1234", "198.51.100.2"))
+	})
+
+	t.Run("trusted proxies", func(t *testing.T) {
+		t.Parallel()
+
+		proxies, err := loadTrustedProxies([]string{"10.0.0.0/8"}, true)
+		require.NoError(t, err)
+
+		require.Equal(t, "198.51.100.2", clientIP(proxies, "10.0.0.1:1234", "198.51.100.2"))
+
+		// entries appended by other trusted proxies are skipped, but client-supplied ones are not
+		require.Equal(t, "198.51.100.2", clientIP(proxies, "10.0.0.1:1234", "203.0.113.7, 198.51.100.2, 10.0.0.2"))
+
+		// the proxy itself is the client if it doesn't forward an address
+		require.Equal(t, "10.0.0.1", clientIP(proxies, "10.0.0.1:1234", ""))
+	})
+}
+
+func TestLoginRateLimits(t *testing.T) {
+	t.Parallel()
+
+	srv := testServer(t)
+	limits, err := loadRateLimits(&RateLimits{
+		LoginPerIP:      "2/1h",
+		LockoutFailures: 3,
+	})
+	require.NoError(t, err)
+	srv.hosts[testPDSHost].rateLimits = limits
+
+	login := func(ip, identifier, password string) *httptest.ResponseRecorder {
+		body := `{"identifier":"` + identifier + `","password":"` + password + `"}`
+		req := httptest.NewRequest(http.MethodPost, "/xrpc/com.atproto.server.createSession", strings.NewReader(body))
+		req.Header.Set("X-Forwarded-For", ip)
+		req = req.WithContext(context.WithValue(req.Context(), hostContextKey{}, srv.hosts[testPDSHost]))
+
+		w := httptest.NewRecorder()
+		srv.router().ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("limits requests per ip", func(t *testing.T) {
+		t.Parallel()
+
+		// counters outlive the test, so each run uses its own ip
+		ip := uuid.NewString()
+		for i := range 2 {
+			w := login(ip, "nobody@example.com", "password")
+			require.Equal(t, http.StatusUnauthorized, w.Code)
+			require.Equal(t, "2", w.Header().Get("RateLimit-Limit"))
+			require.Equal(t, strconv.Itoa(1-i), w.Header().Get("RateLimit-Remaining"))
+		}
+
+		w := login(ip, "nobody@example.com", "password")
+		require.Equal(t, http.StatusTooManyRequests, w.Code)
+		require.Contains(t, w.Body.String(), "RateLimitExceeded")
+		require.NotEmpty(t, w.Header().Get("Retry-After"))
+		require.Equal(t, "2;w=3600", w.Header().Get("RateLimit-Policy"))
+
+		// other clients are unaffected
+		w = login(uuid.NewString(), "nobody@example.com", "password")
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("spoofed forwarded addresses share the peer's budget", func(t *testing.T) {
+		t.Parallel()
+
+		// the PDS terminates TLS, so clients connect directly
+		proxies, err := loadTrustedProxies(nil, true)
+		require.NoError(t, err)
+		direct := testServer(t)
+		direct.proxies = proxies
+		direct.hosts[testPDSHost].rateLimits = limits
+
+		// counters outlive the test, so each run uses its own peer address
+		peer := uuid.NewString()
+		for i := range 3 {
+			body := `{"identifier":"nobody@example.com","password":"password"}`
+			req := httptest.NewRequest(http.MethodPost, "/xrpc/com.atproto.server.createSession", strings.NewReader(body))
+			req.RemoteAddr = peer
+			req.Header.Set("X-Forwarded-For", uuid.NewString())
+			req = req.WithContext(context.WithValue(req.Context(), hostContextKey{}, direct.hosts[testPDSHost]))
+
+			w := httptest.NewRecorder()
+			direct.router().ServeHTTP(w, req)
+			if i < 2 {
+				require.Equal(t, http.StatusUnauthorized, w.Code)
+			} else {
+				require.Equal(t, http.StatusTooManyRequests, w.Code)
+			}
+		}
+	})
+
+	t.Run("limits attempts per account however it's named", func(t *testing.T) {
+		t.Parallel()
+
+		perAccountLimits, err := loadRateLimits(&RateLimits{LoginPerIdentifier: "2/1h"})
+		require.NoError(t, err)
+		perAccount := testServer(t)
+		perAccount.hosts[testPDSHost].rateLimits = perAccountLimits
+
+		actor, _ := setupTestActor(t, perAccount, "did:plc:loginaccount1", "loginaccount1@example.com", "loginaccount1.dev.atlaspds.dev")
+
+		attempt := func(identifier string) *httptest.ResponseRecorder {
+			body := `{"identifier":"` + identifier + `","password":"wrong"}`
+			req := httptest.NewRequest(http.MethodPost, "/xrpc/com.atproto.server.createSession", strings.NewReader(body))
+			req.Header.Set("X-Forwarded-For", uuid.NewString())
+			req = req.WithContext(context.WithValue(req.Context(), hostContextKey{}, perAccount.hosts[testPDSHost]))
+
+			w := httptest.NewRecorder()
+			perAccount.router().ServeHTTP(w, req)
+			return w
+		}
+
+		require.Equal(t, http.StatusBadRequest, attempt(actor.Did).Code)
+		require.Equal(t, http.StatusBadRequest, attempt("LoginAccount1@Example.com").Code)
+		require.Equal(t, http.StatusTooManyRequests, attempt(actor.Handle).Code)
+		require.Equal(t, http.StatusTooManyRequests, attempt(strings.ToUpper(actor.Handle)).Code)
+	})
+
+	t.Run("locks out after repeated failures", func(t *testing.T) {
+		t.Parallel()
+		ctx := t.Context()
+
+		actor, _ := setupTestActor(t, srv, "did:plc:lockout1", "lockout1@example.com", "lockout1.dev.atlaspds.dev")
+		require.NoError(t, srv.db.ClearLoginFailures(ctx, actor.Did))
+
+		for range 3 {
+			w := login(uuid.NewString(), actor.Did, "wrong")
+			require.Equal(t, http.StatusBadRequest, w.Code)
+		}
+
+		// even the right password is rejected while locked
+		w := login(uuid.NewString(), actor.Did, "password")
+		require.Equal(t, http.StatusTooManyRequests, w.Code)
+		require.Contains(t, w.Body.String(), "temporarily locked")
+
+		// an admin can unlock the account
+		body, err := json.Marshal(&unlockAccountInput{Did: actor.Did})
+		require.NoError(t, err)
+		req := httptest.NewRequest(http.MethodPost, "/xrpc/net.atlaspds.admin.unlockAccount", bytes.NewReader(body))
+		req = req.WithContext(context.WithValue(req.Context(), hostContextKey{}, srv.hosts[testPDSHost]))
+		unlock := httptest.NewRecorder()
+		srv.handleUnlockAccount(unlock, req)
+		require.Equal(t, http.StatusOK, unlock.Code, unlock.Body.String())
+
+		w = login(uuid.NewString(), actor.Did, "password")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	})
+}
+
+func TestRouteRateLimits(t *testing.T) {
+	t.Parallel()
+
+	srv := testServer(t)
+	srv.hosts[testPDSHost].adminPassword = "hunter2"
+	limits, err := loadRateLimits(&RateLimits{
+		Routes: map[string]RouteRateLimits{
+			"com.atproto.sync.getRepo": {PerIP: "1/1h"},
+		},
+		WritePointsPerHour: 4,
+		BypassDIDs:         []string{"did:plc:ratelimitbypass"},
+	})
+	require.NoError(t, err)
+	srv.hosts[testPDSHost].rateLimits = limits
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		req = req.WithContext(context.WithValue(req.Context(), hostContextKey{}, srv.hosts[testPDSHost]))
+		w := httptest.NewRecorder()
+		srv.router().ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("limits routes per ip", func(t *testing.T) {
+		t.Parallel()
+
+		// counters outlive the test, so each run uses its own ip
+		ip := uuid.NewString()
+		getRepo := func() *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodGet, "/xrpc/com.atproto.sync.getRepo?did=did:plc:ratelimitmissing", nil)
+			req.Header.Set("X-Forwarded-For", ip)
+			return serve(req)
+		}
+
+		w := getRepo()
+		require.NotEqual(t, http.StatusTooManyRequests, w.Code)
+		require.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+
+		w = getRepo()
+		require.Equal(t, http.StatusTooManyRequests, w.Code)
+
+		// admins are exempt
+		req := httptest.NewRequest(http.MethodGet, "/xrpc/com.atproto.sync.getRepo?did=did:plc:ratelimitmissing", nil)
+		req.Header.Set("X-Forwarded-For", ip)
+		req.SetBasicAuth("admin", "hunter2")
+		w = serve(req)
+		require.NotEqual(t, http.StatusTooManyRequests, w.Code)
+		require.Empty(t, w.Header().Get("RateLimit-Remaining"))
+	})
+
+	createRecord := func(actor *types.Actor, session *Session) *httptest.ResponseRecorder {
+		body := `{"repo":"` + actor.Did + `","collection":"app.bsky.feed.post","record":{"text":"hi","createdAt":"2024-01-01T00:00:00Z"}}`
+		req := httptest.NewRequest(http.MethodPost, "/xrpc/com.atproto.repo.createRecord", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+session.AccessToken)
+		return serve(req)
+	}
+
+	t.Run("spends write points", func(t *testing.T) {
+		t.Parallel()
+
+		// the hourly window is shared across runs, so each run uses its own account
+		id := strings.ReplaceAll(uuid.NewString(), "-", "")[:16]
+		actor, session := setupTestActor(t, srv, "did:plc:"+id, id+"@example.com", id+".dev.atlaspds.dev")
+
+		w := createRecord(actor, session)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.Equal(t, "1", w.Header().Get("RateLimit-Remaining"))
+
+		w = createRecord(actor, session)
+		require.Equal(t, http.StatusTooManyRequests, w.Code)
+	})
+
+	t.Run("trusted dids are exempt", func(t *testing.T) {
+		t.Parallel()
+
+		actor, session := setupTestActor(t, srv, "did:plc:ratelimitbypass", "ratelimitbypass@example.com", "ratelimitbypass.dev.atlaspds.dev")
+		for range 3 {
+			w := createRecord(actor, session)
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			require.Empty(t, w.Header().Get("RateLimit-Remaining"))
+		}
+	})
+}
@@ -0,0 +1,71 @@
+package pds
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/jcalabro/atlas/internal/pds/db"
+)
+
+type rebaseRepoInput struct {
+	Did string `json:"did"`
+}
+
+type rebaseRepoOutput struct {
+	Cid             string `json:"cid"`
+	Rev             string `json:"rev"`
+	BlocksReindexed int    `json:"blocksReindexed"`
+	BlocksDeleted   int    `json:"blocksDeleted"`
+}
+
+// handleRebaseRepo squashes a repo's history into a single fresh commit and prunes every block that
+// is no longer reachable
+func (s *server) handleRebaseRepo(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	span := spanFromContext(ctx)
+	defer span.End()
+
+	host := hostFromContext(ctx)
+
+	var in rebaseRepoInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		s.badRequest(w, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+
+	if _, err := syntax.ParseDID(in.Did); err != nil {
+		s.badRequest(w, fmt.Errorf("invalid did: %w", err))
+		return
+	}
+
+	// admins may only rebase repos on their own host
+	actor, err := s.db.GetActorByDID(ctx, in.Did)
+	if errors.Is(err, db.ErrNotFound) || (err == nil && actor.PdsHost != host.hostname) {
+		s.notFound(w, fmt.Errorf("repo not found"))
+		return
+	}
+	if err != nil {
+		s.internalErr(w, fmt.Errorf("failed to get actor: %w", err))
+		return
+	}
+
+	res, err := s.db.RebaseRepo(ctx, in.Did)
+	if err != nil {
+		s.internalErr(w, fmt.Errorf("failed to rebase repo: %w", err))
+		return
+	}
+
+	s.audit(ctx, host, "net.atlaspds.admin.rebaseRepo", in.Did, nil, map[string]string{"cid": res.CommitCID.String(), "rev": res.Rev})
+	s.log.Info("rebased repo", "did", in.Did, "cid", res.CommitCID.String(), "rev", res.Rev,
+		"blocks_reindexed", res.BlocksReindexed, "blocks_deleted", res.Blocks.BlocksDeleted)
+
+	s.jsonOK(w, &rebaseRepoOutput{
+		Cid:             res.CommitCID.String(),
+		Rev:             res.Rev,
+		BlocksReindexed: res.BlocksReindexed,
+		BlocksDeleted:   res.Blocks.BlocksDeleted,
+	})
+}
@@ -0,0 +1,392 @@
+package pds
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/jcalabro/atlas/internal/pds/metrics"
+)
+
+const (
+	// relayCrawlInterval is how often every host is re-announced to its relays
+	relayCrawlInterval = time.Hour
+
+	// relayHealthInterval is how often relay connection state is re-evaluated
+	relayHealthInterval = time.Minute
+
+	// relayCrawlMinInterval debounces crawl requests triggered by account creation
+	relayCrawlMinInterval = time.Minute
+
+	// relayCrawlMaxAttempts is the number of times a single requestCrawl is attempted
+	relayCrawlMaxAttempts = 5
+)
+
+// relayKey identifies a relay configured for a particular PDS host
+type relayKey struct {
+	pdsHost string
+	relay   string
+}
+
+// relayStatus tracks what we know about a single configured relay
+type relayStatus struct {
+	// hostname and addrs are used to attribute firehose subscribers to this relay
+	hostname string
+	addrs    map[string]struct{}
+
+	alertAfter    time.Duration
+	connections   int
+	lastConnected time.Time
+	lastCrawl     time.Time
+	crawling      bool
+	flagged       bool
+}
+
+// relayCrawler announces our hosts to relays via com.atproto.sync.requestCrawl and tracks whether
+// those relays are actually subscribed to our firehose
+type relayCrawler struct {
+	log     *slog.Logger
+	client  *http.Client
+	hosts   func() []*loadedHostConfig
+	resolve func(ctx context.Context, host string) ([]string, error)
+	started time.Time
+
+	retryBase time.Duration
+	requests  chan string
+
+	mu     sync.Mutex
+	status map[relayKey]*relayStatus
+}
+
+func newRelayCrawler(log *slog.Logger, hosts func() []*loadedHostConfig) *relayCrawler {
+	return &relayCrawler{
+		log:       log.With("component", "relay-crawler"),
+		client:    &http.Client{Timeout: 15 * time.Second},
+		hosts:     hosts,
+		resolve:   net.DefaultResolver.LookupHost,
+		started:   time.Now(),
+		retryBase: 2 * time.Second,
+		requests:  make(chan string, 64),
+		status:    make(map[relayKey]*relayStatus),
+	}
+}
+
+// Run requests a crawl from every configured relay on startup and then periodically, services
+// crawl requests triggered by account creation, and evaluates relay connection health.
+// Returns when ctx is cancelled.
+func (c *relayCrawler) Run(ctx context.Context) {
+	if c == nil {
+		return
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	c.refresh(ctx)
+	c.crawlAll(ctx, &wg)
+
+	crawlTicker := time.NewTicker(relayCrawlInterval)
+	defer crawlTicker.Stop()
+	healthTicker := time.NewTicker(relayHealthInterval)
+	defer healthTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-crawlTicker.C:
+			c.crawlAll(ctx, &wg)
+		case <-healthTicker.C:
+			c.refresh(ctx)
+			c.checkHealth(time.Now())
+		case hostname := <-c.requests:
+			for _, host := range c.hosts() {
+				if host.hostname == hostname {
+					c.crawlHost(ctx, &wg, host, false)
+				}
+			}
+		}
+	}
+}
+
+// RequestCrawl asks the crawler to (re)announce the given host to its relays, for instance after
+// a new account is created. It never blocks; requests are debounced per relay.
+func (c *relayCrawler) RequestCrawl(hostname string) {
+	if c == nil {
+		return
+	}
+
+	select {
+	case c.requests <- hostname:
+	default:
+		c.log.Warn("dropping relay crawl request, queue is full", "pds_host", hostname)
+	}
+}
+
+func (c *relayCrawler) crawlAll(ctx context.Context, wg *sync.WaitGroup) {
+	for _, host := range c.hosts() {
+		c.crawlHost(ctx, wg, host, true)
+	}
+}
+
+// crawlHost starts a requestCrawl for each of the host's relays that isn't already in progress.
+// Unless force is set, relays that were successfully crawled recently are skipped.
+func (c *relayCrawler) crawlHost(ctx context.Context, wg *sync.WaitGroup, host *loadedHostConfig, force bool) {
+	for _, relay := range host.relays {
+		st := c.statusFor(relayKey{pdsHost: host.hostname, relay: relay}, host)
+
+		c.mu.Lock()
+		skip := st.crawling || (!force && time.Since(st.lastCrawl) < relayCrawlMinInterval)
+		if !skip {
+			st.crawling = true
+		}
+		c.mu.Unlock()
+		if skip {
+			continue
+		}
+
+		wg.Go(func() {
+			err := c.requestCrawlWithRetry(ctx, relay, host.hostname)
+
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			st.crawling = false
+			if err == nil {
+				st.lastCrawl = time.Now()
+			}
+		})
+	}
+}
+
+// requestCrawlWithRetry calls requestCrawl with exponential backoff until it succeeds, attempts
+// are exhausted, or ctx is cancelled
+func (c *relayCrawler) requestCrawlWithRetry(ctx context.Context, relay, hostname string) error {
+	delay := c.retryBase
+
+	var err error
+	for attempt := 1; attempt <= relayCrawlMaxAttempts; attempt++ {
+		err = c.requestCrawl(ctx, relay, hostname)
+		if err == nil {
+			metrics.RelayCrawlRequests.WithLabelValues(hostname, relay, "success").Inc()
+			c.log.Info("requested crawl from relay", "relay", relay, "pds_host", hostname)
+			return nil
+		}
+
+		metrics.RelayCrawlRequests.WithLabelValues(hostname, relay, "error").Inc()
+		c.log.Warn("failed to request crawl from relay", "relay", relay, "pds_host", hostname, "attempt", attempt, "err", err)
+
+		if attempt == relayCrawlMaxAttempts {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+
+	return fmt.Errorf("giving up on requestCrawl to %s after %d attempts: %w", relay, relayCrawlMaxAttempts, err)
+}
+
+// requestCrawl makes a single com.atproto.sync.requestCrawl call to the relay
+func (c *relayCrawler) requestCrawl(ctx context.Context, relay, hostname string) error {
+	body, err := json.Marshal(&atproto.SyncRequestCrawl_Input{Hostname: hostname})
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	u := strings.TrimSuffix(relay, "/") + "/xrpc/com.atproto.sync.requestCrawl"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("relay returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	return nil
+}
+
+// statusFor returns the tracked status for a relay, creating it if this is the first time we've
+// seen it
+func (c *relayCrawler) statusFor(key relayKey, host *loadedHostConfig) *relayStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	st, ok := c.status[key]
+	if !ok {
+		var hostname string
+		if u, err := url.Parse(key.relay); err == nil {
+			hostname = strings.ToLower(u.Hostname())
+		}
+
+		st = &relayStatus{hostname: hostname, addrs: make(map[string]struct{})}
+		if net.ParseIP(hostname) != nil {
+			st.addrs[hostname] = struct{}{}
+		}
+		c.status[key] = st
+	}
+	st.alertAfter = host.relayAlertAfter
+
+	return st
+}
+
+// refresh syncs the tracked relays with the current config (which may have been reloaded) and
+// re-resolves each relay's addresses
+func (c *relayCrawler) refresh(ctx context.Context) {
+	configured := make(map[relayKey]struct{})
+	for _, host := range c.hosts() {
+		for _, relay := range host.relays {
+			key := relayKey{pdsHost: host.hostname, relay: relay}
+			configured[key] = struct{}{}
+
+			st := c.statusFor(key, host)
+			if net.ParseIP(st.hostname) != nil || st.hostname == "" {
+				continue
+			}
+
+			addrs, err := c.resolve(ctx, st.hostname)
+			if err != nil {
+				c.log.Warn("failed to resolve relay", "relay", relay, "err", err)
+				continue
+			}
+
+			c.mu.Lock()
+			st.addrs = make(map[string]struct{}, len(addrs))
+			for _, addr := range addrs {
+				st.addrs[addr] = struct{}{}
+			}
+			c.mu.Unlock()
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.status {
+		if _, ok := configured[key]; !ok {
+			delete(c.status, key)
+			metrics.RelayConnections.DeleteLabelValues(key.pdsHost, key.relay)
+			metrics.RelayDisconnected.DeleteLabelValues(key.pdsHost, key.relay)
+		}
+	}
+}
+
+// checkHealth flags relays that have gone longer than their alert window without a firehose
+// subscription
+func (c *relayCrawler) checkHealth(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, st := range c.status {
+		lastSeen := st.lastConnected
+		if lastSeen.IsZero() {
+			lastSeen = c.started
+		}
+		disconnected := st.connections == 0 && now.Sub(lastSeen) > st.alertAfter
+
+		switch {
+		case disconnected && !st.flagged:
+			c.log.Warn("relay is not subscribed to the firehose", "relay", key.relay, "pds_host", key.pdsHost,
+				"last_connected", st.lastConnected, "alert_after", st.alertAfter)
+		case !disconnected && st.flagged:
+			c.log.Info("relay is subscribed to the firehose again", "relay", key.relay, "pds_host", key.pdsHost)
+		}
+		st.flagged = disconnected
+
+		val := 0.0
+		if disconnected {
+			val = 1
+		}
+		metrics.RelayDisconnected.WithLabelValues(key.pdsHost, key.relay).Set(val)
+	}
+}
+
+// subscriberConnected attributes a new firehose subscriber to any configured relays it appears to
+// come from, either by remote address or user agent. The returned func must be called when the
+// subscriber disconnects.
+func (c *relayCrawler) subscriberConnected(pdsHost string, r *http.Request) func() {
+	if c == nil {
+		return func() {}
+	}
+
+	ips := requestIPs(r)
+	ua := strings.ToLower(r.UserAgent())
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var matched []relayKey
+	for key, st := range c.status {
+		if pdsHost != "" && key.pdsHost != pdsHost {
+			continue
+		}
+		if !st.matches(ips, ua) {
+			continue
+		}
+
+		st.connections++
+		st.lastConnected = time.Now()
+		metrics.RelayConnections.WithLabelValues(key.pdsHost, key.relay).Set(float64(st.connections))
+		matched = append(matched, key)
+	}
+
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		for _, key := range matched {
+			st, ok := c.status[key]
+			if !ok {
+				continue
+			}
+			st.connections--
+			st.lastConnected = time.Now()
+			metrics.RelayConnections.WithLabelValues(key.pdsHost, key.relay).Set(float64(st.connections))
+		}
+	}
+}
+
+func (st *relayStatus) matches(ips []string, ua string) bool {
+	for _, ip := range ips {
+		if _, ok := st.addrs[ip]; ok {
+			return true
+		}
+	}
+	return st.hostname != "" && ua != "" && strings.Contains(ua, st.hostname)
+}
+
+// requestIPs returns the direct peer address of the request along with any addresses from
+// X-Forwarded-For, since we're commonly deployed behind a load balancer
+func requestIPs(r *http.Request) []string {
+	var ips []string
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ips = append(ips, host)
+	}
+	for entry := range strings.SplitSeq(r.Header.Get("X-Forwarded-For"), ",") {
+		if ip := strings.TrimSpace(entry); ip != "" {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
@@ -0,0 +1,202 @@
+package pds
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/stretchr/testify/require"
+)
+
+func testRelayCrawler(hosts ...*loadedHostConfig) *relayCrawler {
+	c := newRelayCrawler(slog.Default(), func() []*loadedHostConfig { return hosts })
+	c.retryBase = time.Millisecond
+	c.resolve = func(ctx context.Context, host string) ([]string, error) {
+		return []string{"10.0.0.1"}, nil
+	}
+	return c
+}
+
+func TestRelayRequestCrawl(t *testing.T) {
+	t.Parallel()
+
+	t.Run("sends hostname to relay", func(t *testing.T) {
+		t.Parallel()
+
+		var got atomic.Value
+		relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, http.MethodPost, r.Method)
+			require.Equal(t, "/xrpc/com.atproto.sync.requestCrawl", r.URL.Path)
+
+			var in atproto.SyncRequestCrawl_Input
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&in))
+			got.Store(in.Hostname)
+		}))
+		t.Cleanup(relay.Close)
+
+		c := testRelayCrawler()
+		require.NoError(t, c.requestCrawlWithRetry(t.Context(), relay.URL+"/", testPDSHost))
+		require.Equal(t, testPDSHost, got.Load())
+	})
+
+	t.Run("retries until success", func(t *testing.T) {
+		t.Parallel()
+
+		var calls atomic.Int32
+		relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if calls.Add(1) < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}))
+		t.Cleanup(relay.Close)
+
+		c := testRelayCrawler()
+		require.NoError(t, c.requestCrawlWithRetry(t.Context(), relay.URL, testPDSHost))
+		require.Equal(t, int32(3), calls.Load())
+	})
+
+	t.Run("gives up after max attempts", func(t *testing.T) {
+		t.Parallel()
+
+		var calls atomic.Int32
+		relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			w.WriteHeader(http.StatusBadRequest)
+		}))
+		t.Cleanup(relay.Close)
+
+		c := testRelayCrawler()
+		err := c.requestCrawlWithRetry(t.Context(), relay.URL, testPDSHost)
+		require.ErrorContains(t, err, "status 400")
+		require.Equal(t, int32(relayCrawlMaxAttempts), calls.Load())
+	})
+
+	t.Run("crawl host debounces", func(t *testing.T) {
+		t.Parallel()
+
+		var calls atomic.Int32
+		relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+		}))
+		t.Cleanup(relay.Close)
+
+		host := &loadedHostConfig{hostname: testPDSHost, relays: []string{relay.URL}, relayAlertAfter: time.Minute}
+		c := testRelayCrawler(host)
+
+		var wg sync.WaitGroup
+		c.crawlHost(t.Context(), &wg, host, false)
+		wg.Wait()
+		require.Equal(t, int32(1), calls.Load())
+
+		// recently crawled, so this is skipped unless forced
+		c.crawlHost(t.Context(), &wg, host, false)
+		wg.Wait()
+		require.Equal(t, int32(1), calls.Load())
+
+		c.crawlHost(t.Context(), &wg, host, true)
+		wg.Wait()
+		require.Equal(t, int32(2), calls.Load())
+	})
+}
+
+func TestRelayConnectionTracking(t *testing.T) {
+	t.Parallel()
+
+	host := &loadedHostConfig{
+		hostname:        testPDSHost,
+		relays:          []string{"https://relay.example.com", "https://other.example.com"},
+		relayAlertAfter: time.Minute,
+	}
+
+	t.Run("attributes subscribers by address and flags idle relays", func(t *testing.T) {
+		t.Parallel()
+
+		c := testRelayCrawler(host)
+		c.resolve = func(ctx context.Context, h string) ([]string, error) {
+			if h == "relay.example.com" {
+				return []string{"10.0.0.1"}, nil
+			}
+			return []string{"10.0.0.2"}, nil
+		}
+		c.refresh(t.Context())
+
+		r := httptest.NewRequest(http.MethodGet, "/xrpc/com.atproto.sync.subscribeRepos", nil)
+		r.RemoteAddr = "10.0.0.1:5555"
+		done := c.subscriberConnected(testPDSHost, r)
+
+		relayKey1 := relayKey{pdsHost: testPDSHost, relay: "https://relay.example.com"}
+		relayKey2 := relayKey{pdsHost: testPDSHost, relay: "https://other.example.com"}
+		require.Equal(t, 1, c.status[relayKey1].connections)
+		require.Equal(t, 0, c.status[relayKey2].connections)
+
+		// well past the alert window, only the relay without a subscription is flagged
+		c.checkHealth(time.Now().Add(time.Hour))
+		require.False(t, c.status[relayKey1].flagged)
+		require.True(t, c.status[relayKey2].flagged)
+
+		done()
+		require.Equal(t, 0, c.status[relayKey1].connections)
+
+		// recently disconnected relays stay healthy until the window elapses
+		c.checkHealth(time.Now())
+		require.False(t, c.status[relayKey1].flagged)
+		c.checkHealth(time.Now().Add(2 * time.Minute))
+		require.True(t, c.status[relayKey1].flagged)
+	})
+
+	t.Run("attributes subscribers by user agent and forwarded address", func(t *testing.T) {
+		t.Parallel()
+
+		c := testRelayCrawler(host)
+		c.resolve = func(ctx context.Context, h string) ([]string, error) {
+			if h == "other.example.com" {
+				return []string{"10.0.0.9"}, nil
+			}
+			return nil, nil
+		}
+		c.refresh(t.Context())
+
+		r := httptest.NewRequest(http.MethodGet, "/xrpc/com.atproto.sync.subscribeRepos", nil)
+		r.RemoteAddr = "192.168.1.1:5555"
+		r.Header.Set("User-Agent", "relay-client (+https://relay.example.com)")
+		r.Header.Set("X-Forwarded-For", "10.0.0.9")
+		done := c.subscriberConnected(testPDSHost, r)
+		defer done()
+
+		require.Equal(t, 1, c.status[relayKey{pdsHost: testPDSHost, relay: "https://relay.example.com"}].connections)
+		require.Equal(t, 1, c.status[relayKey{pdsHost: testPDSHost, relay: "https://other.example.com"}].connections)
+	})
+
+	t.Run("unmatched subscribers and other hosts are ignored", func(t *testing.T) {
+		t.Parallel()
+
+		c := testRelayCrawler(host)
+		c.refresh(t.Context())
+
+		r := httptest.NewRequest(http.MethodGet, "/xrpc/com.atproto.sync.subscribeRepos", nil)
+		r.RemoteAddr = "10.0.0.1:5555"
+		done := c.subscriberConnected("some-other-host.example.com", r)
+		defer done()
+
+		for _, st := range c.status {
+			require.Equal(t, 0, st.connections)
+		}
+	})
+
+	t.Run("nil crawler is a no-op", func(t *testing.T) {
+		t.Parallel()
+
+		var c *relayCrawler
+		c.RequestCrawl(testPDSHost)
+		c.subscriberConnected(testPDSHost, httptest.NewRequest(http.MethodGet, "/", nil))()
+		c.Run(t.Context())
+	})
+}
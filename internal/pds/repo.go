@@ -33,9 +33,12 @@ func (s *server) handleDescribeServer(w http.ResponseWriter, r *http.Request) {
 		return &str
 	}
 
-	// @NOTE (jrc): we haven't implemented invite codes or phone # verification yet
+	phoneVerificationRequired := host.phoneVerificationRequired()
+
 	s.jsonOK(w, &atproto.ServerDescribeServer_Output{
-		AvailableUserDomains: host.userDomains,
+		AvailableUserDomains:      host.userDomains,
+		InviteCodeRequired:        &host.inviteCodeRequired,
+		PhoneVerificationRequired: &phoneVerificationRequired,
 		Contact: &atproto.ServerDescribeServer_Contact{
 			Email: nullStr(host.contactEmail),
 		},
@@ -97,6 +100,16 @@ func (s *server) handleGetRecord(w http.ResponseWriter, r *http.Request) {
 		did = ident.DID.String()
 	}
 
+	takenDown, err := s.db.IsTakenDown(ctx, &db.Subject{Did: did, Collection: collection, Rkey: rkey})
+	if errors.Is(err, db.ErrNotFound) || takenDown {
+		s.notFound(w, fmt.Errorf("record not found"))
+		return
+	}
+	if err != nil {
+		s.internalErr(w, fmt.Errorf("failed to get takedown status: %w", err))
+		return
+	}
+
 	uri := at.FormatURI(did, collection, rkey)
 
 	record, err := s.db.GetRecord(ctx, uri)
@@ -171,14 +184,18 @@ func (s *server) handleListRepos(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	repos := make([]*atproto.SyncListRepos_Repo, len(actors))
-	for ndx, actor := range actors {
-		repos[ndx] = &atproto.SyncListRepos_Repo{
+	repos := make([]*atproto.SyncListRepos_Repo, 0, len(actors))
+	for _, actor := range actors {
+		if actor.Takedown != nil {
+			continue
+		}
+
+		repos = append(repos, &atproto.SyncListRepos_Repo{
 			Active: util.Ptr(actor.Active),
 			Did:    actor.Did,
 			Head:   actor.Head,
 			Rev:    actor.Rev,
-		}
+		})
 	}
 
 	s.jsonOK(w, atproto.SyncListRepos_Output{
@@ -237,6 +254,11 @@ func (s *server) handleCreateRecord(w http.ResponseWriter, r *http.Request) {
 	// past validation - start recording metrics
 	metricCollection = in.Collection
 
+	if !s.checkWritePoints(w, r, createWritePoints) {
+		metricStatus = "rate_limited"
+		return
+	}
+
 	// parse or generate rkey
 	var rkey string
 	if in.Rkey != nil && *in.Rkey != "" {
@@ -304,6 +326,10 @@ func (s *server) handleCreateRecord(w http.ResponseWriter, r *http.Request) {
 			s.conflict(w, fmt.Errorf("repo was modified concurrently, please retry"))
 			return
 		}
+		if errors.Is(err, db.ErrRepoTakendown) {
+			s.accountTakedown(w)
+			return
+		}
 		s.internalErr(w, fmt.Errorf("failed to create record: %w", err))
 		return
 	}
@@ -379,6 +405,11 @@ func (s *server) handleDeleteRecord(w http.ResponseWriter, r *http.Request) {
 	// past validation - start recording metrics
 	metricCollection = in.Collection
 
+	if !s.checkWritePoints(w, r, deleteWritePoints) {
+		metricStatus = "rate_limited"
+		return
+	}
+
 	uri := at.FormatURI(actor.Did, in.Collection, in.Rkey)
 
 	// check if record exists
@@ -417,6 +448,10 @@ func (s *server) handleDeleteRecord(w http.ResponseWriter, r *http.Request) {
 			s.conflict(w, fmt.Errorf("repo was modified concurrently, please retry"))
 			return
 		}
+		if errors.Is(err, db.ErrRepoTakendown) {
+			s.accountTakedown(w)
+			return
+		}
 		s.internalErr(w, fmt.Errorf("failed to delete record: %w", err))
 		return
 	}
@@ -499,6 +534,11 @@ func (s *server) handlePutRecord(w http.ResponseWriter, r *http.Request) {
 	// past validation - start recording metrics
 	metricCollection = in.Collection
 
+	if !s.checkWritePoints(w, r, updateWritePoints) {
+		metricStatus = "rate_limited"
+		return
+	}
+
 	// validate swapRecord CID if provided
 	if in.SwapRecord != nil {
 		if _, err := syntax.ParseCID(*in.SwapRecord); err != nil {
@@ -544,6 +584,10 @@ func (s *server) handlePutRecord(w http.ResponseWriter, r *http.Request) {
 			s.conflict(w, fmt.Errorf("repo was modified concurrently, please retry"))
 			return
 		}
+		if errors.Is(err, db.ErrRepoTakendown) {
+			s.accountTakedown(w)
+			return
+		}
 		s.internalErr(w, fmt.Errorf("failed to put record: %w", err))
 		return
 	}
@@ -610,6 +654,10 @@ func (s *server) handleApplyWrites(w http.ResponseWriter, r *http.Request) {
 		s.badRequest(w, fmt.Errorf("writes is required"))
 		return
 	}
+	if len(in.Writes) > db.MaxCommitOps {
+		s.badRequest(w, fmt.Errorf("too many writes (max %d)", db.MaxCommitOps))
+		return
+	}
 
 	// past basic validation - start recording metrics
 	recordMetric = true
@@ -695,6 +743,15 @@ func (s *server) handleApplyWrites(w http.ResponseWriter, r *http.Request) {
 		ops = append(ops, op)
 	}
 
+	var points int64
+	for _, op := range ops {
+		points += writePoints(op.Action)
+	}
+	if !s.checkWritePoints(w, r, points) {
+		metricStatus = "rate_limited"
+		return
+	}
+
 	// check if any creates would conflict with existing records
 	for i, op := range ops {
 		if op.Action == "create" {
@@ -720,6 +777,14 @@ func (s *server) handleApplyWrites(w http.ResponseWriter, r *http.Request) {
 			s.conflict(w, fmt.Errorf("repo was modified concurrently, please retry"))
 			return
 		}
+		if errors.Is(err, db.ErrRepoTakendown) {
+			s.accountTakedown(w)
+			return
+		}
+		if errors.Is(err, db.ErrTooManyOps) {
+			s.badRequest(w, err)
+			return
+		}
 		s.internalErr(w, fmt.Errorf("failed to apply writes: %w", err))
 		return
 	}
@@ -808,8 +873,8 @@ func (s *server) handleListRecords(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// verify repo exists
-	_, err = s.db.GetActorByDID(ctx, did)
-	if errors.Is(err, db.ErrNotFound) {
+	actor, err := s.db.GetActorByDID(ctx, did)
+	if errors.Is(err, db.ErrNotFound) || (err == nil && actor.Takedown != nil) {
 		s.notFound(w, fmt.Errorf("repo not found"))
 		return
 	}
@@ -887,6 +952,17 @@ func (s *server) handleDescribeRepo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// repos that aren't hosted here have no takedown state, and are described as before
+	takenDown, err := s.db.IsTakenDown(ctx, &db.Subject{Did: ident.DID.String()})
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		s.internalErr(w, fmt.Errorf("failed to get takedown status: %w", err))
+		return
+	}
+	if takenDown {
+		s.notFound(w, fmt.Errorf("repo not found"))
+		return
+	}
+
 	// check if handle resolves correctly
 	// if the handle is "handle.invalid", it means bi-directional verification failed
 	handleIsCorrect := ident.Handle != syntax.HandleInvalid
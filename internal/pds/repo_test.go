@@ -60,16 +60,15 @@ func TestHandleListRepos(t *testing.T) {
 	prefix := "did:plc:zzzzztestrepos"
 	for i := 1; i <= 5; i++ {
 		actor := &types.Actor{
-			Did:           fmt.Sprintf("%s%03d", prefix, i),
-			Email:         fmt.Sprintf("testrepos%d@example.com", i),
-			Handle:        fmt.Sprintf("testrepos%d.dev.atlaspds.net", i),
-			PdsHost:       testPDSHost,
-			CreatedAt:     timestamppb.New(time.Now()),
-			PasswordHash:  fmt.Appendf(nil, "hash%d", i),
-			SigningKey:    fmt.Appendf(nil, "key%d", i),
-			RotationKeys:  [][]byte{fmt.Appendf(nil, "rotation%d", i)},
-			RefreshTokens: []*types.RefreshToken{},
-			Active:        true,
+			Did:          fmt.Sprintf("%s%03d", prefix, i),
+			Email:        fmt.Sprintf("testrepos%d@example.com", i),
+			Handle:       fmt.Sprintf("testrepos%d.dev.atlaspds.net", i),
+			PdsHost:      testPDSHost,
+			CreatedAt:    timestamppb.New(time.Now()),
+			PasswordHash: fmt.Appendf(nil, "hash%d", i),
+			SigningKey:   fmt.Appendf(nil, "key%d", i),
+			RotationKeys: [][]byte{fmt.Appendf(nil, "rotation%d", i)},
+			Active:       true,
 		}
 		err := srv.db.SaveActor(ctx, actor)
 		require.NoError(t, err)
@@ -1989,6 +1988,37 @@ func TestHandleApplyWrites(t *testing.T) {
 		require.Equal(t, http.StatusBadRequest, w.Code)
 	})
 
+	t.Run("error - too many writes", func(t *testing.T) {
+		t.Parallel()
+
+		actor, session := setupTestActor(t, srv, "did:plc:applywrites11", "applywrites11@example.com", "applywrites11.dev.atlaspds.dev")
+
+		writes := make([]map[string]any, db.MaxCommitOps+1)
+		for i := range writes {
+			writes[i] = map[string]any{
+				"$type":      "com.atproto.repo.applyWrites#delete",
+				"collection": "app.bsky.feed.post",
+				"rkey":       fmt.Sprintf("rkey%d", i),
+			}
+		}
+
+		input := map[string]any{
+			"repo":   actor.Did,
+			"writes": writes,
+		}
+
+		body, err := json.Marshal(input)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/xrpc/com.atproto.repo.applyWrites", bytes.NewReader(body))
+		req = addAuthContext(t, ctx, srv, req, actor, session.AccessToken)
+		srv.handleApplyWrites(w, req)
+
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		require.Contains(t, w.Body.String(), "too many writes")
+	})
+
 	t.Run("error - invalid write type", func(t *testing.T) {
 		t.Parallel()
 
@@ -0,0 +1,408 @@
+package pds
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	indigoutil "github.com/bluesky-social/indigo/util"
+	"github.com/jcalabro/atlas/internal/at"
+	"github.com/jcalabro/atlas/internal/pds/db"
+	"github.com/jcalabro/atlas/internal/types"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// maxReportReasonLength is the longest report reason, in bytes, that the lexicon allows
+	maxReportReasonLength = 20000
+
+	// maxListReports bounds the page size of listReports
+	maxListReports = 100
+)
+
+// ModerationConfig configures what happens to the moderation reports made by a host's accounts.
+// Reports are proxied to the appview like any other request if neither option is set.
+type ModerationConfig struct {
+	// ServiceDID is the DID of an Ozone-compatible moderation service that reports are forwarded to
+	ServiceDID string `toml:"service_did"`
+
+	// ServiceURL is the base URL of the moderation service. It's resolved from the atproto_labeler
+	// service of ServiceDID's DID document if empty.
+	ServiceURL string `toml:"service_url"`
+
+	// StoreReports keeps a copy of every report so the host's admins can review them
+	StoreReports bool `toml:"store_reports"`
+}
+
+// moderation is the loaded moderation config of a host
+type moderation struct {
+	serviceDID   string
+	serviceURL   string
+	storeReports bool
+	client       *http.Client
+}
+
+// loadModeration validates the moderation config, returning nil if reports aren't handled locally
+func loadModeration(cfg *ModerationConfig) (*moderation, error) {
+	switch {
+	case cfg.ServiceURL != "" && cfg.ServiceDID == "":
+		return nil, fmt.Errorf("service_url requires service_did")
+	case cfg.ServiceDID == "" && !cfg.StoreReports:
+		return nil, nil
+	}
+
+	if cfg.ServiceDID != "" {
+		if _, err := syntax.ParseDID(cfg.ServiceDID); err != nil {
+			return nil, fmt.Errorf("invalid service_did: %w", err)
+		}
+	}
+
+	if cfg.ServiceURL != "" {
+		u, err := url.Parse(cfg.ServiceURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid service_url %q: must be an absolute http(s) url", cfg.ServiceURL)
+		}
+	}
+
+	return &moderation{
+		serviceDID:   cfg.ServiceDID,
+		serviceURL:   strings.TrimSuffix(cfg.ServiceURL, "/"),
+		storeReports: cfg.StoreReports,
+		client:       &http.Client{Timeout: 15 * time.Second},
+	}, nil
+}
+
+// handleCreateReport files a report from the caller, forwarding it to the host's moderation
+// service and/or storing it for the host's admins
+func (s *server) handleCreateReport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	span := spanFromContext(ctx)
+	defer span.End()
+
+	host := hostFromContext(ctx)
+	if host.moderation == nil {
+		s.handleProxy(w, r)
+		return
+	}
+
+	actor := actorFromContext(ctx)
+	if actor == nil {
+		s.internalErr(w, fmt.Errorf("actor not found in context"))
+		return
+	}
+
+	var in atproto.ModerationCreateReport_Input
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		s.badRequest(w, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+
+	switch {
+	case in.ReasonType == nil || *in.ReasonType == "":
+		s.badRequest(w, fmt.Errorf("reasonType is required"))
+		return
+	case in.Reason != nil && len(*in.Reason) > maxReportReasonLength:
+		s.badRequest(w, fmt.Errorf("reason must be at most %d bytes", maxReportReasonLength))
+		return
+	case in.Subject == nil:
+		s.badRequest(w, fmt.Errorf("subject is required"))
+		return
+	}
+
+	report := &types.Report{
+		PdsHost:    host.hostname,
+		ReportedBy: actor.Did,
+		ReasonType: *in.ReasonType,
+		CreatedAt:  timestamppb.Now(),
+	}
+	if in.Reason != nil {
+		report.Reason = *in.Reason
+	}
+
+	switch {
+	case in.Subject.AdminDefs_RepoRef != nil:
+		report.SubjectDid = in.Subject.AdminDefs_RepoRef.Did
+	case in.Subject.RepoStrongRef != nil:
+		aturi, err := at.ParseURI(in.Subject.RepoStrongRef.Uri)
+		if err != nil {
+			s.badRequest(w, fmt.Errorf("invalid subject uri: %w", err))
+			return
+		}
+		if _, err := syntax.ParseCID(in.Subject.RepoStrongRef.Cid); err != nil {
+			s.badRequest(w, fmt.Errorf("invalid subject cid: %w", err))
+			return
+		}
+
+		report.SubjectDid = aturi.Repo
+		report.SubjectUri = aturi.String()
+		report.SubjectCid = in.Subject.RepoStrongRef.Cid
+	default:
+		s.badRequest(w, fmt.Errorf("unsupported subject type"))
+		return
+	}
+
+	if _, err := syntax.ParseDID(report.SubjectDid); err != nil {
+		s.badRequest(w, fmt.Errorf("invalid subject did: %w", err))
+		return
+	}
+
+	span.SetAttributes(
+		attribute.String("reason_type", report.ReasonType),
+		attribute.String("subject_did", report.SubjectDid),
+		attribute.String("subject_uri", report.SubjectUri),
+	)
+
+	var out *atproto.ModerationCreateReport_Output
+	if host.moderation.serviceDID != "" {
+		forwarded, err := s.forwardReport(ctx, host.moderation, actor, &in)
+		switch {
+		case err == nil:
+			out = forwarded
+			report.ForwardedId = forwarded.Id
+		case host.moderation.storeReports:
+			// the stored copy means the report isn't lost
+			s.log.Error("failed to forward report to moderation service", "err", err, "did", actor.Did)
+		default:
+			s.xrpcErr(w, http.StatusBadGateway, "UpstreamFailure", fmt.Errorf("failed to forward report: %w", err))
+			return
+		}
+	}
+
+	if host.moderation.storeReports {
+		if err := s.db.CreateReport(ctx, report); err != nil {
+			s.internalErr(w, fmt.Errorf("failed to store report: %w", err))
+			return
+		}
+
+		if out == nil {
+			out = &atproto.ModerationCreateReport_Output{
+				Id:         report.Id,
+				CreatedAt:  report.CreatedAt.AsTime().Format(indigoutil.ISO8601),
+				Reason:     in.Reason,
+				ReasonType: in.ReasonType,
+				ReportedBy: actor.Did,
+				Subject: &atproto.ModerationCreateReport_Output_Subject{
+					AdminDefs_RepoRef: in.Subject.AdminDefs_RepoRef,
+					RepoStrongRef:     in.Subject.RepoStrongRef,
+				},
+			}
+		}
+	}
+
+	s.log.Info("account made a report", "did", actor.Did, "id", report.Id, "forwarded_id", report.ForwardedId)
+
+	s.jsonOK(w, out)
+}
+
+// forwardReport files the report with the moderation service on behalf of the actor
+func (s *server) forwardReport(
+	ctx context.Context,
+	mod *moderation,
+	actor *types.Actor,
+	in *atproto.ModerationCreateReport_Input,
+) (*atproto.ModerationCreateReport_Output, error) {
+	const lxm = "com.atproto.moderation.createReport"
+
+	endpoint := mod.serviceURL
+	if endpoint == "" {
+		ident, err := s.directory.LookupDID(ctx, syntax.DID(mod.serviceDID))
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve moderation service: %w", err)
+		}
+
+		endpoint = strings.TrimSuffix(ident.GetServiceEndpoint("atproto_labeler"), "/")
+		if endpoint == "" {
+			return nil, fmt.Errorf("moderation service %q has no atproto_labeler endpoint", mod.serviceDID)
+		}
+	}
+
+	token, err := s.createServiceAuthToken(ctx, actor, mod.serviceDID, lxm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create service auth token: %w", err)
+	}
+
+	body, err := json.Marshal(in)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal report: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+"/xrpc/"+lxm, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := mod.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close() // nolint:errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("moderation service returned status %d: %s", resp.StatusCode, msg)
+	}
+
+	var out atproto.ModerationCreateReport_Output
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return &out, nil
+}
+
+type reportView struct {
+	ID             int64  `json:"id"`
+	ReportedBy     string `json:"reportedBy"`
+	ReasonType     string `json:"reasonType"`
+	Reason         string `json:"reason,omitempty"`
+	SubjectDid     string `json:"subjectDid"`
+	SubjectURI     string `json:"subjectUri,omitempty"`
+	SubjectCID     string `json:"subjectCid,omitempty"`
+	CreatedAt      string `json:"createdAt"`
+	ForwardedID    int64  `json:"forwardedId,omitempty"`
+	ResolvedAt     string `json:"resolvedAt,omitempty"`
+	ResolvedBy     string `json:"resolvedBy,omitempty"`
+	ResolutionNote string `json:"resolutionNote,omitempty"`
+}
+
+func newReportView(report *types.Report) *reportView {
+	view := &reportView{
+		ID:             report.Id,
+		ReportedBy:     report.ReportedBy,
+		ReasonType:     report.ReasonType,
+		Reason:         report.Reason,
+		SubjectDid:     report.SubjectDid,
+		SubjectURI:     report.SubjectUri,
+		SubjectCID:     report.SubjectCid,
+		CreatedAt:      report.CreatedAt.AsTime().Format(indigoutil.ISO8601),
+		ForwardedID:    report.ForwardedId,
+		ResolvedBy:     report.ResolvedBy,
+		ResolutionNote: report.ResolutionNote,
+	}
+	if report.ResolvedAt != nil {
+		view.ResolvedAt = report.ResolvedAt.AsTime().Format(indigoutil.ISO8601)
+	}
+
+	return view
+}
+
+type listReportsOutput struct {
+	Cursor  *string       `json:"cursor,omitempty"`
+	Reports []*reportView `json:"reports"`
+}
+
+// handleListReports lists the reports stored for the host, oldest first. Only unresolved reports
+// are listed if open=true.
+func (s *server) handleListReports(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	span := spanFromContext(ctx)
+	defer span.End()
+
+	host := hostFromContext(ctx)
+
+	var cursor int64
+	if c := r.URL.Query().Get("cursor"); c != "" {
+		var err error
+		cursor, err = strconv.ParseInt(c, 10, 64)
+		if err != nil || cursor < 0 {
+			s.badRequest(w, fmt.Errorf("invalid cursor"))
+			return
+		}
+	}
+
+	limit, err := parseIntParam(r, "limit", 50)
+	if err != nil || limit < 1 {
+		s.badRequest(w, fmt.Errorf("invalid limit"))
+		return
+	}
+	limit = min(limit, maxListReports)
+
+	openOnly := r.URL.Query().Get("open") == "true"
+	span.SetAttributes(attribute.Bool("open", openOnly))
+
+	reports, next, err := s.db.ListReports(ctx, host.hostname, openOnly, cursor, int(limit))
+	if err != nil {
+		s.internalErr(w, fmt.Errorf("failed to list reports: %w", err))
+		return
+	}
+
+	out := &listReportsOutput{Reports: make([]*reportView, 0, len(reports))}
+	for _, report := range reports {
+		out.Reports = append(out.Reports, newReportView(report))
+	}
+	if next > 0 {
+		out.Cursor = nextCursorOrNil(strconv.FormatInt(next, 10))
+	}
+
+	s.jsonOK(w, out)
+}
+
+type resolveReportInput struct {
+	ID   int64  `json:"id"`
+	Note string `json:"note,omitempty"`
+}
+
+// handleResolveReport marks one of the host's stored reports as resolved
+func (s *server) handleResolveReport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	span := spanFromContext(ctx)
+	defer span.End()
+
+	host := hostFromContext(ctx)
+
+	var in resolveReportInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		s.badRequest(w, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	if in.ID <= 0 {
+		s.badRequest(w, fmt.Errorf("id is required"))
+		return
+	}
+
+	span.SetAttributes(attribute.Int64("id", in.ID))
+
+	resolvedBy := adminActor(ctx)
+	before, err := s.db.GetReport(ctx, host.hostname, in.ID)
+	if errors.Is(err, db.ErrNotFound) {
+		s.notFound(w, fmt.Errorf("report not found"))
+		return
+	}
+	if err != nil {
+		s.internalErr(w, fmt.Errorf("failed to get report: %w", err))
+		return
+	}
+
+	report, err := s.db.ResolveReport(ctx, host.hostname, in.ID, resolvedBy, in.Note)
+	if errors.Is(err, db.ErrNotFound) {
+		s.notFound(w, fmt.Errorf("report not found"))
+		return
+	}
+	if err != nil {
+		s.internalErr(w, fmt.Errorf("failed to resolve report: %w", err))
+		return
+	}
+
+	// reports are audited under what was reported, since that's what a resolution acts on
+	subject := report.SubjectDid
+	if report.SubjectUri != "" {
+		subject = report.SubjectUri
+	}
+	s.audit(ctx, host, "net.atlaspds.admin.resolveReport", subject, newReportView(before), newReportView(report))
+	s.log.Info("admin resolved report", "id", report.Id, "resolved_by", resolvedBy)
+
+	s.jsonOK(w, newReportView(report))
+}
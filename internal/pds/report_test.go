@@ -0,0 +1,260 @@
+package pds
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/jcalabro/atlas/internal/at"
+	"github.com/jcalabro/atlas/internal/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadModeration(t *testing.T) {
+	t.Parallel()
+
+	mod, err := loadModeration(&ModerationConfig{})
+	require.NoError(t, err)
+	require.Nil(t, mod)
+
+	mod, err = loadModeration(&ModerationConfig{StoreReports: true})
+	require.NoError(t, err)
+	require.True(t, mod.storeReports)
+	require.Empty(t, mod.serviceDID)
+
+	mod, err = loadModeration(&ModerationConfig{ServiceDID: "did:plc:ozone", ServiceURL: "https://mod.example.com/"})
+	require.NoError(t, err)
+	require.Equal(t, "did:plc:ozone", mod.serviceDID)
+	require.Equal(t, "https://mod.example.com", mod.serviceURL)
+	require.False(t, mod.storeReports)
+
+	_, err = loadModeration(&ModerationConfig{ServiceDID: "not-a-did"})
+	require.Error(t, err)
+
+	_, err = loadModeration(&ModerationConfig{ServiceURL: "https://mod.example.com"})
+	require.Error(t, err)
+
+	_, err = loadModeration(&ModerationConfig{ServiceDID: "did:plc:ozone", ServiceURL: "mod.example.com"})
+	require.Error(t, err)
+}
+
+func TestCreateReport(t *testing.T) {
+	t.Parallel()
+
+	// a fake Ozone that accepts reports that carry a service auth token
+	var forwarded []*atproto.ModerationCreateReport_Input
+	ozone := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/xrpc/com.atproto.moderation.createReport" || !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var in atproto.ModerationCreateReport_Input
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		forwarded = append(forwarded, &in)
+
+		_ = json.NewEncoder(w).Encode(&atproto.ModerationCreateReport_Output{
+			Id:         int64(1000 + len(forwarded)),
+			ReasonType: in.ReasonType,
+			Subject:    &atproto.ModerationCreateReport_Output_Subject{AdminDefs_RepoRef: in.Subject.AdminDefs_RepoRef},
+		})
+	}))
+	t.Cleanup(ozone.Close)
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(down.Close)
+
+	report := func(t *testing.T, srv *server, in any) *httptest.ResponseRecorder {
+		t.Helper()
+
+		actor, session := setupTestActor(t, srv, "did:plc:reporter"+strings.ToLower(util.RandString(8)), "reporter@example.com", "reporter.dev.atlaspds.dev")
+
+		body, err := json.Marshal(in)
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodPost, "/xrpc/com.atproto.moderation.createReport", bytes.NewReader(body))
+		req = addAuthContext(t, t.Context(), srv, req, actor, session.AccessToken)
+		w := httptest.NewRecorder()
+		srv.handleCreateReport(w, req)
+		return w
+	}
+
+	spam := "com.atproto.moderation.defs#reasonSpam"
+	accountReport := &atproto.ModerationCreateReport_Input{
+		ReasonType: &spam,
+		Reason:     util.Ptr("selling followers"),
+		Subject:    &atproto.ModerationCreateReport_Input_Subject{AdminDefs_RepoRef: &atproto.AdminDefs_RepoRef{Did: "did:plc:spammer"}},
+	}
+
+	t.Run("forwards to the moderation service", func(t *testing.T) {
+		srv := testServer(t)
+		srv.hosts[testPDSHost].moderation = &moderation{serviceDID: "did:plc:ozone", serviceURL: ozone.URL, client: ozone.Client()}
+
+		w := report(t, srv, accountReport)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var out atproto.ModerationCreateReport_Output
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &out))
+		require.Greater(t, out.Id, int64(1000))
+		require.Equal(t, "did:plc:spammer", forwarded[len(forwarded)-1].Subject.AdminDefs_RepoRef.Did)
+
+		// without a stored copy, failures are reported to the caller
+		srv.hosts[testPDSHost].moderation = &moderation{serviceDID: "did:plc:ozone", serviceURL: down.URL, client: down.Client()}
+		w = report(t, srv, accountReport)
+		require.Equal(t, http.StatusBadGateway, w.Code)
+	})
+
+	t.Run("stores reports, even if they can't be forwarded", func(t *testing.T) {
+		srv := testServer(t)
+		host := "reports-" + strings.ToLower(util.RandString(8)) + ".dev.atlaspds.dev"
+		srv.hosts[testPDSHost].hostname = host
+		srv.hosts[testPDSHost].moderation = &moderation{serviceDID: "did:plc:ozone", serviceURL: down.URL, client: down.Client(), storeReports: true}
+
+		w := report(t, srv, accountReport)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var out atproto.ModerationCreateReport_Output
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &out))
+		require.Equal(t, int64(1), out.Id)
+		require.Equal(t, spam, *out.ReasonType)
+
+		recordReport := &atproto.ModerationCreateReport_Input{
+			ReasonType: &spam,
+			Subject: &atproto.ModerationCreateReport_Input_Subject{RepoStrongRef: &atproto.RepoStrongRef{
+				Uri: at.FormatURI("did:plc:spammer", "app.bsky.feed.post", "3jui7kd2xs22b"),
+				Cid: "bafyreie5737gdxlw5i64vzichcalba3z2v5n6icifvx5xytvske7mr3hpm",
+			}},
+		}
+		srv.hosts[testPDSHost].moderation = &moderation{storeReports: true}
+		w = report(t, srv, recordReport)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		reports, next, err := srv.db.ListReports(t.Context(), host, true, 0, 10)
+		require.NoError(t, err)
+		require.Zero(t, next)
+		require.Len(t, reports, 2)
+		require.Equal(t, "did:plc:spammer", reports[0].SubjectDid)
+		require.Equal(t, "selling followers", reports[0].Reason)
+		require.Equal(t, recordReport.Subject.RepoStrongRef.Uri, reports[1].SubjectUri)
+	})
+
+	t.Run("rejects invalid reports", func(t *testing.T) {
+		t.Parallel()
+
+		srv := testServer(t)
+		srv.hosts[testPDSHost].moderation = &moderation{storeReports: true}
+
+		w := report(t, srv, &atproto.ModerationCreateReport_Input{Subject: accountReport.Subject})
+		require.Equal(t, http.StatusBadRequest, w.Code)
+
+		w = report(t, srv, &atproto.ModerationCreateReport_Input{ReasonType: &spam})
+		require.Equal(t, http.StatusBadRequest, w.Code)
+
+		w = report(t, srv, &atproto.ModerationCreateReport_Input{
+			ReasonType: &spam,
+			Subject:    &atproto.ModerationCreateReport_Input_Subject{AdminDefs_RepoRef: &atproto.AdminDefs_RepoRef{Did: "not-a-did"}},
+		})
+		require.Equal(t, http.StatusBadRequest, w.Code)
+
+		w = report(t, srv, &atproto.ModerationCreateReport_Input{
+			ReasonType: &spam,
+			Reason:     util.Ptr(strings.Repeat("a", maxReportReasonLength+1)),
+			Subject:    accountReport.Subject,
+		})
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestListAndResolveReports(t *testing.T) {
+	t.Parallel()
+
+	srv := testServer(t)
+	host := "resolve-" + strings.ToLower(util.RandString(8)) + ".dev.atlaspds.dev"
+	srv.hosts[testPDSHost].hostname = host
+	srv.hosts[testPDSHost].moderation = &moderation{storeReports: true}
+
+	actor, session := setupTestActor(t, srv, "did:plc:resolvereporter", "resolvereporter@example.com", "resolvereporter.dev.atlaspds.dev")
+
+	spam := "com.atproto.moderation.defs#reasonSpam"
+	for range 3 {
+		body, err := json.Marshal(&atproto.ModerationCreateReport_Input{
+			ReasonType: &spam,
+			Subject:    &atproto.ModerationCreateReport_Input_Subject{AdminDefs_RepoRef: &atproto.AdminDefs_RepoRef{Did: "did:plc:spammer"}},
+		})
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+		req = addAuthContext(t, t.Context(), srv, req, actor, session.AccessToken)
+		w := httptest.NewRecorder()
+		srv.handleCreateReport(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+
+	list := func(t *testing.T, query string) *listReportsOutput {
+		t.Helper()
+
+		req := addTestHostContext(srv, httptest.NewRequest(http.MethodGet, "/?"+query, nil))
+		w := httptest.NewRecorder()
+		srv.handleListReports(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var out listReportsOutput
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &out))
+		return &out
+	}
+
+	page := list(t, "limit=2")
+	require.Len(t, page.Reports, 2)
+	require.Equal(t, int64(1), page.Reports[0].ID)
+	require.NotNil(t, page.Cursor)
+
+	page = list(t, "limit=2&cursor="+*page.Cursor)
+	require.Len(t, page.Reports, 1)
+	require.Equal(t, int64(3), page.Reports[0].ID)
+	require.Nil(t, page.Cursor)
+
+	resolve := func(t *testing.T, in *resolveReportInput) *httptest.ResponseRecorder {
+		t.Helper()
+
+		body, err := json.Marshal(in)
+		require.NoError(t, err)
+
+		req := addTestHostContext(srv, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+		w := httptest.NewRecorder()
+		srv.handleResolveReport(w, req)
+		return w
+	}
+
+	w := resolve(t, &resolveReportInput{ID: 2, Note: "suspended the account"})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var resolved reportView
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resolved))
+	require.Equal(t, "admin", resolved.ResolvedBy)
+	require.Equal(t, "suspended the account", resolved.ResolutionNote)
+	require.NotEmpty(t, resolved.ResolvedAt)
+
+	page = list(t, "open=true")
+	require.Len(t, page.Reports, 2)
+	require.Equal(t, int64(1), page.Reports[0].ID)
+	require.Equal(t, int64(3), page.Reports[1].ID)
+
+	require.Len(t, list(t, "").Reports, 3)
+
+	require.Equal(t, http.StatusNotFound, resolve(t, &resolveReportInput{ID: 100}).Code)
+	require.Equal(t, http.StatusBadRequest, resolve(t, &resolveReportInput{}).Code)
+
+	req := addTestHostContext(srv, httptest.NewRequest(http.MethodGet, "/?cursor=abc", nil))
+	w = httptest.NewRecorder()
+	srv.handleListReports(w, req)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,136 @@
+package pds
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+
+	"github.com/jcalabro/atlas/internal/envelope"
+	"github.com/jcalabro/atlas/internal/pds/db"
+	"github.com/jcalabro/atlas/internal/types"
+	"go.opentelemetry.io/otel"
+)
+
+// RewrapKeysArgs configures a run of the actor key re-wrapper
+type RewrapKeysArgs struct {
+	// ConfigFile is the PDS config, which provides each host's current and previous KEKs
+	ConfigFile string
+
+	// Hosts are the PDS hostnames whose actors' keys should be re-wrapped. Every configured host
+	// is re-wrapped if empty.
+	Hosts []string
+
+	FDB db.Config
+}
+
+type rewrapReport struct {
+	Host      string `json:"host"`
+	KeyID     string `json:"kekId"`
+	Checked   int    `json:"checked"`
+	Rewrapped int    `json:"rewrapped"`
+}
+
+// RewrapKeys re-wraps the private keys of every actor on the requested hosts with each host's
+// current key-encryption key, and encrypts any keys that are still stored in plaintext. It's safe
+// to run against a live database, and writes a JSON line to out for each host.
+//
+// To rotate a KEK, configure the new key as the host's kek_file with the old one in
+// previous_kek_files, deploy it, then run RewrapKeys. The old key may be removed once it completes.
+func RewrapKeys(ctx context.Context, out io.Writer, args *RewrapKeysArgs) error {
+	log := slog.Default().With(slog.String("service", "atlas.rewrap"))
+
+	cfg, err := LoadConfig(args.ConfigFile)
+	if err != nil {
+		return err
+	}
+
+	hosts := args.Hosts
+	if len(hosts) == 0 {
+		for hostname := range cfg.Hosts {
+			hosts = append(hosts, hostname)
+		}
+		slices.Sort(hosts)
+	}
+
+	for _, hostname := range hosts {
+		host, ok := cfg.Hosts[hostname]
+		if !ok {
+			return fmt.Errorf("host %q is not configured", hostname)
+		}
+		if host.keyring == nil {
+			return fmt.Errorf("host %q has no key-encryption key configured", hostname)
+		}
+	}
+
+	database, err := db.New(otel.Tracer("atlas.rewrap"), args.FDB)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(out)
+	for _, hostname := range hosts {
+		keyring := cfg.Hosts[hostname].keyring
+
+		report, err := rewrapHost(ctx, database, hostname, keyring)
+		if err != nil {
+			return fmt.Errorf("failed to rewrap keys for host %s: %w", hostname, err)
+		}
+
+		log.Info("rewrapped host keys", "host", hostname, "kek_id", report.KeyID,
+			"checked", report.Checked, "rewrapped", report.Rewrapped)
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func rewrapHost(ctx context.Context, database *db.DB, host string, keyring *envelope.Keyring) (*rewrapReport, error) {
+	report := &rewrapReport{
+		Host:  host,
+		KeyID: keyring.KeyID(),
+	}
+
+	var cursor string
+	for {
+		actors, next, err := database.ListActors(ctx, host, cursor, fsckPageSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list actors: %w", err)
+		}
+
+		for _, actor := range actors {
+			changed, err := database.RewrapKeys(ctx, actor.Did, keyringWrapper(keyring))
+			if errors.Is(err, db.ErrNotFound) {
+				continue // deleted since it was listed
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to rewrap keys for %s: %w", actor.Did, err)
+			}
+
+			report.Checked++
+			if changed {
+				report.Rewrapped++
+			}
+		}
+
+		if next == "" {
+			return report, nil
+		}
+		cursor = next
+	}
+}
+
+// keyringWrapper re-wraps encrypted keys with the keyring's current KEK, and seals plaintext keys
+func keyringWrapper(keyring *envelope.Keyring) db.KeyWrapper {
+	return func(ctx context.Context, wrapped *types.WrappedKey, plain []byte) (*types.WrappedKey, error) {
+		if wrapped != nil {
+			return keyring.Rewrap(ctx, wrapped)
+		}
+		return keyring.Seal(ctx, plain)
+	}
+}
@@ -5,10 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"math"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -18,6 +20,7 @@ import (
 	"github.com/bluesky-social/indigo/atproto/identity"
 	"github.com/jcalabro/atlas/internal/metrics"
 	"github.com/jcalabro/atlas/internal/pds/db"
+	pdsmetrics "github.com/jcalabro/atlas/internal/pds/metrics"
 	"github.com/jcalabro/atlas/internal/plc"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/trace"
@@ -39,6 +42,15 @@ type Args struct {
 	ConfigFile          string
 	FallbackAppviewURLs []string
 
+	// BlockRetention is how long unreachable repo blocks are kept before they're garbage collected
+	BlockRetention time.Duration
+
+	// SigningKeyGrace is how long a repo's previous signing key is kept after a key rotation
+	SigningKeyGrace time.Duration
+
+	// AuditLogFile is a JSONL file that audit events are appended to, in addition to FDB
+	AuditLogFile string
+
 	FDB db.Config
 }
 
@@ -48,9 +60,16 @@ type server struct {
 	log    *slog.Logger
 	tracer trace.Tracer
 
-	hostsMu    sync.RWMutex
-	hosts      map[string]*loadedHostConfig
-	configFile string
+	// hosts is what's served: the registered hosts, overridden by the hosts in the config file
+	hostsMu         sync.RWMutex
+	hosts           map[string]*loadedHostConfig
+	staticHosts     map[string]*loadedHostConfig
+	registeredHosts map[string]*loadedHostConfig
+	configFile      string
+	configDigest    string
+
+	// hostRegistry is nil unless the host registry is enabled
+	hostRegistry *hostRegistry
 
 	db        *db.DB
 	blobstore *blobstore
@@ -59,6 +78,19 @@ type server struct {
 	plc          plc.PLC
 	appviewProxy *appviewProxy
 	firehose     *firehose
+	relays       *relayCrawler
+	labelSync    *labelSync
+
+	// auditFile is nil unless audit events are also written to a file
+	auditFile *auditFile
+
+	// certs is nil unless the server terminates TLS itself
+	certs *certManager
+
+	// proxies are the peers whose X-Forwarded-For headers are honored
+	proxies *trustedProxies
+
+	signingKeyGrace time.Duration
 }
 
 func (s *server) shutdown(cancel context.CancelFunc) {
@@ -71,15 +103,22 @@ func (s *server) shutdown(cancel context.CancelFunc) {
 func (s *server) reloadConfig() {
 	s.log.Info("reloading configuration", "file", s.configFile)
 
+	pdsmetrics.ConfigLastReloadTimestamp.SetToCurrentTime()
+
+	// the running config is kept if the new one doesn't pass the same validation as at startup
 	cfg, err := LoadConfig(s.configFile)
 	if err != nil {
+		pdsmetrics.ConfigLastReloadSuccessful.Set(0)
 		s.log.Error("failed to reload config", "err", err)
 		return
 	}
+	pdsmetrics.ConfigLastReloadSuccessful.Set(1)
+
+	digest := configDigest(s.configFile)
 
-	s.hostsMu.Lock()
-	s.hosts = cfg.Hosts
-	s.hostsMu.Unlock()
+	before, beforeDigest := s.setStaticHosts(cfg.Hosts, digest)
+
+	s.auditConfigReload(context.Background(), before, cfg.Hosts, beforeDigest, digest)
 
 	s.log.Info("configuration reloaded successfully", "num_hosts", len(cfg.Hosts))
 }
@@ -90,6 +129,48 @@ func (s *server) getHost(hostname string) *loadedHostConfig {
 	return s.hosts[hostname]
 }
 
+// routeHost finds the host that serves a request hostname. A hostname that isn't a host is matched
+// against the hosts' user domains, preferring the longest match, and userDomain is set if so.
+func (s *server) routeHost(reqHost string) (host *loadedHostConfig, userDomain bool) {
+	s.hostsMu.RLock()
+	defer s.hostsMu.RUnlock()
+
+	if host := s.hosts[reqHost]; host != nil {
+		return host, false
+	}
+
+	var longest string
+	for _, candidate := range s.hosts {
+		for _, domain := range candidate.userDomains {
+			domain = strings.ToLower(domain)
+			if !strings.HasSuffix(reqHost, domain) || len(domain) < len(longest) {
+				continue
+			}
+
+			// the same domain can only be claimed twice while configs disagree, so break ties
+			// deterministically rather than by map order
+			if host != nil && len(domain) == len(longest) && candidate.hostname > host.hostname {
+				continue
+			}
+
+			host, longest = candidate, domain
+		}
+	}
+
+	return host, host != nil
+}
+
+func (s *server) allHosts() []*loadedHostConfig {
+	s.hostsMu.RLock()
+	defer s.hostsMu.RUnlock()
+
+	hosts := make([]*loadedHostConfig, 0, len(s.hosts))
+	for _, host := range s.hosts {
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
 func Run(ctx context.Context, args *Args) error {
 	log := slog.Default().With(slog.String("service", serviceName))
 
@@ -106,6 +187,8 @@ func Run(ctx context.Context, args *Args) error {
 		return fmt.Errorf("failed to load config: %w", err)
 	}
 	log.Info("loaded host configurations", "hosts", len(cfg.Hosts))
+	pdsmetrics.ConfigLastReloadTimestamp.SetToCurrentTime()
+	pdsmetrics.ConfigLastReloadSuccessful.Set(1)
 
 	plcClient, err := plc.NewClient(&plc.ClientArgs{
 		Tracer: tracer,
@@ -138,8 +221,12 @@ func Run(ctx context.Context, args *Args) error {
 		log:    log,
 		tracer: tracer,
 
-		hosts:      cfg.Hosts,
-		configFile: args.ConfigFile,
+		hosts:        cfg.Hosts,
+		staticHosts:  cfg.Hosts,
+		configFile:   args.ConfigFile,
+		configDigest: configDigest(args.ConfigFile),
+		hostRegistry: cfg.HostRegistry,
+		proxies:      cfg.TrustedProxies,
 
 		db:        db,
 		blobstore: bs,
@@ -150,8 +237,54 @@ func Run(ctx context.Context, args *Args) error {
 		plc:          plcClient,
 		appviewProxy: appviewProxy,
 		firehose:     newFirehose(log, db),
+
+		signingKeyGrace: args.SigningKeyGrace,
+	}
+	if s.signingKeyGrace <= 0 {
+		s.signingKeyGrace = defaultSigningKeyGrace
+	}
+	db.SetKeyOpener(s)
+	if args.AuditLogFile != "" {
+		s.auditFile, err = openAuditFile(args.AuditLogFile)
+		if err != nil {
+			return err
+		}
+		defer s.auditFile.Close() //nolint:errcheck
+		log.Info("writing audit events to file", "file", args.AuditLogFile)
+	}
+	for _, host := range cfg.Hosts {
+		if host.keyring == nil {
+			log.Warn("private keys are stored unencrypted since no key-encryption key is configured", "host", host.hostname)
+		}
+	}
+
+	if s.hostRegistry != nil {
+		registered, err := s.loadRegisteredHosts(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to load registered hosts: %w", err)
+		}
+		s.setRegisteredHosts(registered)
+		log.Info("loaded registered hosts", "num_hosts", len(registered))
+	}
+
+	if cfg.TLS != nil {
+		s.certs = s.newCertManager(cfg.TLS)
+		if cfg.TLS.keyring == nil {
+			log.Warn("tls private keys are stored unencrypted since no key-encryption key is configured")
+		}
+		if cfg.TLS.acme == nil {
+			for _, host := range s.allHosts() {
+				if host.certificate == nil {
+					log.Warn("host has no certificate and acme is disabled, so tls handshakes will fail", "host", host.hostname)
+				}
+			}
+		}
 	}
 
+	s.relays = newRelayCrawler(log, s.allHosts)
+	s.firehose.relays = s.relays
+	s.labelSync = newLabelSync(log, db, s.directory, s.allHosts)
+
 	cancelOnce := &sync.Once{}
 	ctx, cancelFn := context.WithCancel(ctx)
 	cancel := func() {
@@ -198,6 +331,45 @@ func Run(ctx context.Context, args *Args) error {
 		return nil
 	})
 
+	errs.Go(func() error {
+		s.relays.Run(ctx)
+		return nil
+	})
+
+	errs.Go(func() error {
+		s.labelSync.Run(ctx)
+		return nil
+	})
+
+	errs.Go(func() error {
+		newBlockSweeper(log, db, args.BlockRetention).Run(ctx)
+		return nil
+	})
+
+	if s.hostRegistry != nil {
+		errs.Go(func() error {
+			s.watchHostRegistry(ctx)
+			return nil
+		})
+	}
+
+	if s.certs != nil {
+		errs.Go(func() error {
+			s.certs.Run(ctx)
+			return nil
+		})
+	}
+
+	errs.Go(func() error {
+		s.sweepSessions(ctx)
+		return nil
+	})
+
+	errs.Go(func() error {
+		s.sweepRateLimits(ctx)
+		return nil
+	})
+
 	errs.Go(func() error {
 		if err := s.serve(ctx, cancel, args); err != nil {
 			return fmt.Errorf("failed to run connect rpc server: %w", err)
@@ -222,23 +394,62 @@ func (s *server) serve(ctx context.Context, cancel context.CancelFunc, args *Arg
 		ReadTimeout:  args.ReadTimeout,
 	}
 
+	servers := []*http.Server{srv}
+	errs, ctx := errgroup.WithContext(ctx)
+
+	if s.certs != nil {
+		srv.TLSConfig = s.certs.tlsConfig()
+
+		if addr := s.certs.cfg.httpAddr; addr != "" {
+			httpSrv := &http.Server{
+				Handler:      s.certs.httpHandler(),
+				Addr:         addr,
+				ErrorLog:     srv.ErrorLog,
+				WriteTimeout: args.WriteTimeout,
+				ReadTimeout:  args.ReadTimeout,
+			}
+			servers = append(servers, httpSrv)
+
+			errs.Go(func() error {
+				s.log.Info("http redirect server listening", "addr", addr)
+				if err := httpSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					return fmt.Errorf("listen: %w", err)
+				}
+				return nil
+			})
+		}
+	}
+
 	go func() {
 		<-ctx.Done()
 
 		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer shutdownCancel()
 
-		srv.SetKeepAlivesEnabled(false)
-		if err := srv.Shutdown(shutdownCtx); err != nil {
-			s.log.Error("server shutdown error", "err", err)
+		for _, srv := range servers {
+			srv.SetKeepAlivesEnabled(false)
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				s.log.Error("server shutdown error", "err", err)
+			}
 		}
 	}()
 
-	s.log.Info("server listening", "addr", args.Addr)
-	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		return fmt.Errorf("listen: %w", err)
-	}
-	return nil
+	errs.Go(func() error {
+		var err error
+		if srv.TLSConfig != nil {
+			s.log.Info("server listening with tls", "addr", args.Addr)
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			s.log.Info("server listening", "addr", args.Addr)
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			return fmt.Errorf("listen: %w", err)
+		}
+		return nil
+	})
+
+	return errs.Wait()
 }
 
 func (s *server) plaintextOK(w http.ResponseWriter, msg string, args ...any) {
@@ -285,17 +496,17 @@ func (s *server) conflict(w http.ResponseWriter, err error) {
 	s.err(w, http.StatusConflict, err)
 }
 
+// tooManyRequests writes a 429, telling the client to retry once the rate limit window resets
+func (s *server) tooManyRequests(w http.ResponseWriter, retryAfter time.Duration, err error) {
+	w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(max(retryAfter, 0).Seconds())), 10))
+	s.err(w, http.StatusTooManyRequests, err)
+}
+
 func (s *server) internalErr(w http.ResponseWriter, err error) {
 	s.err(w, http.StatusInternalServerError, err)
 }
 
 func (s *server) err(w http.ResponseWriter, code int, err error) {
-	// XRPC error format
-	type response struct {
-		Error   string `json:"error"`
-		Message string `json:"message"`
-	}
-
 	// map HTTP status codes to XRPC error names
 	var errName string
 	switch code {
@@ -309,12 +520,25 @@ func (s *server) err(w http.ResponseWriter, code int, err error) {
 		errName = "NotFound"
 	case http.StatusConflict:
 		errName = "Conflict"
+	case http.StatusTooManyRequests:
+		errName = "RateLimitExceeded"
 	default:
 		errName = "InternalServerError"
 	}
 
+	s.xrpcErr(w, code, errName, err)
+}
+
+// xrpcErr writes an error with a specific XRPC error name, for errors that lexicons define
+func (s *server) xrpcErr(w http.ResponseWriter, code int, name string, err error) {
+	// XRPC error format
+	type response struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+
 	s.jsonWithCode(w, code, &response{
-		Error:   errName,
+		Error:   name,
 		Message: err.Error(),
 	})
 }
@@ -365,12 +589,12 @@ func (s *server) router() *http.ServeMux {
 
 	mux.HandleFunc("GET /xrpc/com.atproto.repo.describeRepo", s.handleDescribeRepo)
 	mux.HandleFunc("GET /xrpc/com.atproto.repo.getRecord", s.handleGetRecord)
-	mux.HandleFunc("GET /xrpc/com.atproto.repo.listRecords", s.handleListRecords)
+	mux.HandleFunc("GET /xrpc/com.atproto.repo.listRecords", s.rateLimitMiddleware("com.atproto.repo.listRecords", s.handleListRecords))
 	mux.HandleFunc("POST /xrpc/com.atproto.repo.createRecord", s.authMiddleware(s.handleCreateRecord))
 	mux.HandleFunc("POST /xrpc/com.atproto.repo.putRecord", s.authMiddleware(s.handlePutRecord))
 	mux.HandleFunc("POST /xrpc/com.atproto.repo.deleteRecord", s.authMiddleware(s.handleDeleteRecord))
-	mux.HandleFunc("POST /xrpc/com.atproto.repo.applyWrites", s.authMiddleware(s.handleApplyWrites))
-	mux.HandleFunc("POST /xrpc/com.atproto.repo.uploadBlob", s.authMiddleware(s.handleUploadBlob))
+	mux.HandleFunc("POST /xrpc/com.atproto.repo.applyWrites", s.authMiddleware(s.rateLimitMiddleware("com.atproto.repo.applyWrites", s.handleApplyWrites)))
+	mux.HandleFunc("POST /xrpc/com.atproto.repo.uploadBlob", s.authMiddleware(s.rateLimitMiddleware("com.atproto.repo.uploadBlob", s.handleUploadBlob)))
 
 	mux.HandleFunc("GET /xrpc/com.atproto.server.describeServer", s.handleDescribeServer)
 	mux.HandleFunc("POST /xrpc/com.atproto.server.createAccount", s.handleCreateAccount)
@@ -378,6 +602,12 @@ func (s *server) router() *http.ServeMux {
 	mux.HandleFunc("GET /xrpc/com.atproto.server.getSession", s.authMiddleware(s.handleGetSession))
 	mux.HandleFunc("POST /xrpc/com.atproto.server.refreshSession", s.authMiddleware(s.handleRefreshSession))
 	mux.HandleFunc("POST /xrpc/com.atproto.server.deleteSession", s.authMiddleware(s.handleDeleteSession))
+	mux.HandleFunc("POST /xrpc/com.atproto.temp.requestPhoneVerification", s.rateLimitMiddleware("com.atproto.temp.requestPhoneVerification", s.handleRequestPhoneVerification))
+	mux.HandleFunc("GET /xrpc/com.atproto.server.getAccountInviteCodes", s.authMiddleware(s.handleGetAccountInviteCodes))
+	mux.HandleFunc("POST /xrpc/com.atproto.server.createInviteCode", s.adminMiddleware(s.handleCreateInviteCode))
+	mux.HandleFunc("POST /xrpc/com.atproto.server.createInviteCodes", s.adminMiddleware(s.handleCreateInviteCodes))
+	mux.HandleFunc("GET /xrpc/net.atlaspds.server.listSessions", s.authMiddleware(s.handleListSessions))
+	mux.HandleFunc("POST /xrpc/net.atlaspds.server.revokeSession", s.authMiddleware(s.handleRevokeSession))
 
 	mux.HandleFunc("GET /xrpc/com.atproto.sync.listRepos", s.handleListRepos)
 	mux.HandleFunc("GET /xrpc/com.atproto.sync.listBlobs", s.handleListBlobs)
@@ -386,8 +616,9 @@ func (s *server) router() *http.ServeMux {
 	mux.HandleFunc("GET /xrpc/com.atproto.sync.getRecord", s.handleSyncGetRecord)
 	mux.HandleFunc("GET /xrpc/com.atproto.sync.getLatestCommit", s.handleGetLatestCommit)
 	mux.HandleFunc("GET /xrpc/com.atproto.sync.getRepoStatus", s.handleGetRepoStatus)
-	mux.HandleFunc("GET /xrpc/com.atproto.sync.getRepo", s.handleGetRepo)
+	mux.HandleFunc("GET /xrpc/com.atproto.sync.getRepo", s.rateLimitMiddleware("com.atproto.sync.getRepo", s.handleGetRepo))
 	mux.HandleFunc("GET /xrpc/com.atproto.sync.subscribeRepos", s.handleSubscribeRepos)
+	mux.HandleFunc("GET /subscribe", s.handleJetstreamSubscribe)
 
 	mux.HandleFunc("GET /xrpc/app.bsky.feed.getFeed", s.handleGetFeed)
 
@@ -395,13 +626,46 @@ func (s *server) router() *http.ServeMux {
 	mux.HandleFunc("POST /xrpc/app.bsky.actor.putPreferences", s.authMiddleware(s.handlePutPreferences))
 
 	mux.HandleFunc("GET /xrpc/com.atproto.label.queryLabels", s.handleQueryLabels)
+	mux.HandleFunc("GET /xrpc/com.atproto.label.subscribeLabels", s.handleSubscribeLabels)
+
+	mux.HandleFunc("POST /xrpc/com.atproto.moderation.createReport", s.authMiddleware(s.rateLimitMiddleware("com.atproto.moderation.createReport", s.handleCreateReport)))
+
+	//
+	// Admin routes
+	//
+
+	mux.HandleFunc("GET /xrpc/com.atproto.admin.getAccountInfo", s.adminMiddleware(s.handleGetAccountInfo))
+	mux.HandleFunc("GET /xrpc/com.atproto.admin.getAccountInfos", s.adminMiddleware(s.handleGetAccountInfos))
+	mux.HandleFunc("GET /xrpc/com.atproto.admin.searchAccounts", s.adminMiddleware(s.handleSearchAccounts))
+	mux.HandleFunc("POST /xrpc/com.atproto.admin.updateAccountEmail", s.adminMiddleware(s.handleUpdateAccountEmail))
+	mux.HandleFunc("POST /xrpc/com.atproto.admin.updateAccountHandle", s.adminMiddleware(s.handleUpdateAccountHandle))
+	mux.HandleFunc("POST /xrpc/com.atproto.admin.updateAccountPassword", s.adminMiddleware(s.handleUpdateAccountPassword))
+	mux.HandleFunc("POST /xrpc/com.atproto.admin.deleteAccount", s.adminMiddleware(s.handleDeleteAccount))
+	mux.HandleFunc("POST /xrpc/com.atproto.admin.disableAccountInvites", s.adminMiddleware(s.handleDisableAccountInvites))
+	mux.HandleFunc("POST /xrpc/com.atproto.admin.sendEmail", s.adminMiddleware(s.handleSendEmail))
+	mux.HandleFunc("GET /xrpc/com.atproto.admin.getSubjectStatus", s.adminMiddleware(s.handleGetSubjectStatus))
+	mux.HandleFunc("POST /xrpc/com.atproto.admin.updateSubjectStatus", s.adminMiddleware(s.handleUpdateSubjectStatus))
+	mux.HandleFunc("POST /xrpc/net.atlaspds.admin.fsck", s.adminMiddleware(s.handleFsck))
+	mux.HandleFunc("POST /xrpc/net.atlaspds.admin.rebaseRepo", s.adminMiddleware(s.handleRebaseRepo))
+	mux.HandleFunc("POST /xrpc/net.atlaspds.admin.repairRepoBlocks", s.adminMiddleware(s.handleRepairRepoBlocks))
+	mux.HandleFunc("POST /xrpc/net.atlaspds.admin.rotateSigningKey", s.adminMiddleware(s.handleRotateSigningKey))
+	mux.HandleFunc("POST /xrpc/net.atlaspds.admin.unlockAccount", s.adminMiddleware(s.handleUnlockAccount))
+	mux.HandleFunc("GET /xrpc/net.atlaspds.admin.listReports", s.adminMiddleware(s.handleListReports))
+	mux.HandleFunc("POST /xrpc/net.atlaspds.admin.resolveReport", s.adminMiddleware(s.handleResolveReport))
+	mux.HandleFunc("POST /xrpc/net.atlaspds.admin.emitLabel", s.adminMiddleware(s.handleEmitLabel))
+	mux.HandleFunc("GET /xrpc/net.atlaspds.admin.listAuditEvents", s.adminMiddleware(s.handleListAuditEvents))
+	mux.HandleFunc("POST /xrpc/net.atlaspds.admin.createHost", s.hostRegistryAdminMiddleware(s.handleCreateHost))
+	mux.HandleFunc("POST /xrpc/net.atlaspds.admin.updateHost", s.hostRegistryAdminMiddleware(s.handleUpdateHost))
+	mux.HandleFunc("POST /xrpc/net.atlaspds.admin.disableHost", s.hostRegistryAdminMiddleware(s.handleDisableHost))
+	mux.HandleFunc("POST /xrpc/net.atlaspds.admin.enableHost", s.hostRegistryAdminMiddleware(s.handleEnableHost))
+	mux.HandleFunc("GET /xrpc/net.atlaspds.admin.listHosts", s.hostRegistryAdminMiddleware(s.handleListHosts))
 
 	//
 	// Proxy catch-all for unhandled XRPC requests
 	//
 
-	mux.HandleFunc("GET /xrpc/", s.handleProxy)
-	mux.HandleFunc("POST /xrpc/", s.handleProxy)
+	mux.HandleFunc("GET /xrpc/", s.rateLimitMiddleware("proxy", s.handleProxy))
+	mux.HandleFunc("POST /xrpc/", s.rateLimitMiddleware("proxy", s.handleProxy))
 
 	return mux
 }
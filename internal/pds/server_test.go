@@ -66,8 +66,13 @@ func testServer(t *testing.T) *server {
 
 		db: testDB,
 
+		// tests stand in for the load balancer by setting X-Forwarded-For
+		proxies: &trustedProxies{all: true},
+
 		directory: &dir,
 		plc:       &plc.MockClient{},
+
+		signingKeyGrace: defaultSigningKeyGrace,
 	}
 }
 
@@ -85,16 +90,15 @@ func setupTestActor(t *testing.T, srv *server, did, email, handle string) (*type
 	require.NoError(t, err)
 
 	actor := &types.Actor{
-		Did:           did,
-		Email:         email,
-		Handle:        handle,
-		PdsHost:       testPDSHost,
-		CreatedAt:     timestamppb.Now(),
-		PasswordHash:  pwHash,
-		SigningKey:    signingKey.Bytes(),
-		RotationKeys:  [][]byte{signingKey.Bytes()},
-		RefreshTokens: []*types.RefreshToken{},
-		Active:        true,
+		Did:          did,
+		Email:        email,
+		Handle:       handle,
+		PdsHost:      testPDSHost,
+		CreatedAt:    timestamppb.Now(),
+		PasswordHash: pwHash,
+		SigningKey:   signingKey.Bytes(),
+		RotationKeys: [][]byte{signingKey.Bytes()},
+		Active:       true,
 	}
 
 	// initialize the repo for this actor
@@ -1,23 +1,23 @@
 package pds
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"strings"
 	"time"
 
-	"github.com/bluesky-social/indigo/atproto/atcrypto"
 	"github.com/google/uuid"
 	"github.com/jcalabro/atlas/internal/types"
 )
 
 // createServiceAuthToken creates a service auth JWT for proxying requests.
 // The token is signed with the actor's K256 signing key using ES256K.
-func createServiceAuthToken(actor *types.Actor, aud, lxm string) (string, error) {
-	privkey, err := atcrypto.ParsePrivateBytesK256(actor.SigningKey)
+func (s *server) createServiceAuthToken(ctx context.Context, actor *types.Actor, aud, lxm string) (string, error) {
+	privkey, err := s.db.SigningKey(ctx, actor)
 	if err != nil {
-		return "", fmt.Errorf("failed to parse signing key: %w", err)
+		return "", err
 	}
 
 	header := map[string]string{
@@ -23,6 +23,9 @@ import (
 const (
 	accessTokenTTL  = 3 * time.Hour
 	refreshTokenTTL = 7 * 24 * time.Hour
+
+	// sessionSweepInterval is how often expired refresh tokens are deleted
+	sessionSweepInterval = 10 * time.Minute
 )
 
 type Session struct {
@@ -86,6 +89,17 @@ func (s *server) handleCreateSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// attempts are counted against the account rather than the name it was given by, so switching
+	// between its handle, email and did doesn't get a fresh budget
+	account := identifier
+	if actor != nil {
+		account = actor.Did
+	}
+	if !s.checkRateLimits(w, r, s.loginRateLimits(host, r, account)...) {
+		metricStatus = "rate_limited"
+		return
+	}
+
 	if actor == nil || errors.Is(err, db.ErrNotFound) {
 		s.unauthorized(w, fmt.Errorf("invalid account identifier or password"))
 		return
@@ -97,12 +111,53 @@ func (s *server) handleCreateSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var lockout db.LoginLockoutPolicy
+	if host.rateLimits != nil {
+		lockout = host.rateLimits.lockout
+	}
+
+	if lockout.MaxFailures > 0 {
+		lockedUntil, err := s.db.GetLoginLockout(ctx, actor.Did)
+		if err != nil {
+			metricStatus = "error"
+			s.internalErr(w, fmt.Errorf("failed to get login lockout: %w", err))
+			return
+		}
+		if !lockedUntil.IsZero() {
+			metricStatus = "locked"
+			s.tooManyRequests(w, time.Until(lockedUntil), fmt.Errorf("account is temporarily locked due to too many failed logins"))
+			return
+		}
+	}
+
 	if err := bcrypt.CompareHashAndPassword(actor.PasswordHash, []byte(in.Password)); err != nil {
+		if lockout.MaxFailures > 0 {
+			lockedUntil, err := s.db.RecordLoginFailure(ctx, actor.Did, lockout)
+			if err != nil {
+				s.log.Error("failed to record login failure", "did", actor.Did, "err", err)
+			} else if !lockedUntil.IsZero() {
+				s.log.Warn("locked account after too many failed logins", "did", actor.Did, "until", lockedUntil)
+			}
+		}
+
 		s.badRequest(w, fmt.Errorf("invalid identifier or password"))
 		return
 	}
 
-	session, err := s.createSession(r.Context(), actor)
+	if lockout.MaxFailures > 0 {
+		if err := s.db.ClearLoginFailures(ctx, actor.Did); err != nil {
+			s.log.Error("failed to clear login failures", "did", actor.Did, "err", err)
+		}
+	}
+
+	// only reveal that the account is taken down to someone who knows its password
+	if actor.Takedown != nil {
+		metricStatus = "takendown"
+		s.accountTakedown(w)
+		return
+	}
+
+	session, err := s.createSession(context.WithValue(ctx, userAgentContextKey{}, r.UserAgent()), actor)
 	if err != nil {
 		metricStatus = "error"
 		s.log.Error("failed to create session", "did", actor.Did, "err", err)
@@ -137,9 +192,53 @@ func (s *server) createSession(ctx context.Context, actor *types.Actor) (*Sessio
 	ctx, span := s.tracer.Start(ctx, "createSession")
 	defer span.End()
 
+	session, stored, err := s.issueTokens(ctx, actor, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.db.CreateSession(ctx, stored); err != nil {
+		return nil, fmt.Errorf("failed to save refresh token: %w", err)
+	}
+
+	return session, nil
+}
+
+// rotateSession exchanges the given refresh token for a new token pair in the same family
+func (s *server) rotateSession(ctx context.Context, actor *types.Actor, refreshToken string) (*Session, error) {
+	ctx, span := s.tracer.Start(ctx, "rotateSession")
+	defer span.End()
+
+	claims, err := s.verifyRefreshToken(ctx, refreshToken)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := s.db.GetSession(ctx, actor.Did, claims.JTI)
+	if err != nil {
+		return nil, err
+	}
+
+	session, next, err := s.issueTokens(ctx, actor, current.Family)
+	if err != nil {
+		return nil, err
+	}
+	next.FamilyCreatedAt = current.FamilyCreatedAt
+	next.UserAgent = current.UserAgent
+
+	if err := s.db.RotateSession(ctx, actor.Did, claims.JTI, db.HashRefreshToken(refreshToken), next); err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// issueTokens signs a new access and refresh token pair that share a jti, and returns the refresh
+// session to store for them. A new family is started if family is empty.
+func (s *server) issueTokens(ctx context.Context, actor *types.Actor, family string) (*Session, *types.RefreshSession, error) {
 	host := hostFromContext(ctx)
 	if host == nil {
-		return nil, fmt.Errorf("host config not found in context")
+		return nil, nil, fmt.Errorf("host config not found in context")
 	}
 
 	now := time.Now()
@@ -168,29 +267,34 @@ func (s *server) createSession(ctx context.Context, actor *types.Actor) (*Sessio
 	accessToken := jwt.NewWithClaims(jwt.SigningMethodES256, accessClaims)
 	accessString, err := accessToken.SignedString(host.signingKey)
 	if err != nil {
-		return nil, fmt.Errorf("failed to sign access token: %w", err)
+		return nil, nil, fmt.Errorf("failed to sign access token: %w", err)
 	}
 
 	refreshToken := jwt.NewWithClaims(jwt.SigningMethodES256, refreshClaims)
 	refreshString, err := refreshToken.SignedString(host.signingKey)
 	if err != nil {
-		return nil, fmt.Errorf("failed to sign refresh token: %w", err)
+		return nil, nil, fmt.Errorf("failed to sign refresh token: %w", err)
 	}
 
-	actor.RefreshTokens = append(actor.RefreshTokens, &types.RefreshToken{
-		Token:     refreshString,
-		CreatedAt: timestamppb.New(now),
-		ExpiresAt: timestamppb.New(refexp),
-	})
+	if family == "" {
+		family = jti
+	}
 
-	if err := s.db.SaveActor(ctx, actor); err != nil {
-		return nil, fmt.Errorf("failed to save actor with refresh token: %w", err)
+	stored := &types.RefreshSession{
+		Did:             actor.Did,
+		Jti:             jti,
+		Family:          family,
+		TokenHash:       db.HashRefreshToken(refreshString),
+		CreatedAt:       timestamppb.New(now),
+		ExpiresAt:       timestamppb.New(refexp),
+		FamilyCreatedAt: timestamppb.New(now),
+		UserAgent:       userAgentFromContext(ctx),
 	}
 
 	return &Session{
 		AccessToken:  accessString,
 		RefreshToken: refreshString,
-	}, nil
+	}, stored, nil
 }
 
 type VerifiedClaims struct {
@@ -313,18 +417,22 @@ func (s *server) handleRefreshSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// remove the old refresh token from the actor's list
-	newRefreshTokens := make([]*types.RefreshToken, 0, len(actor.RefreshTokens))
-	for _, rt := range actor.RefreshTokens {
-		if rt.Token != refreshToken {
-			newRefreshTokens = append(newRefreshTokens, rt)
-		}
-	}
-	actor.RefreshTokens = newRefreshTokens
-
-	// create a new session
-	session, err := s.createSession(r.Context(), actor)
-	if err != nil {
+	session, err := s.rotateSession(r.Context(), actor, refreshToken)
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		metricStatus = "failure"
+		s.unauthorized(w, fmt.Errorf("refresh token not found"))
+		return
+	case errors.Is(err, db.ErrSessionExpired):
+		metricStatus = "failure"
+		s.unauthorized(w, fmt.Errorf("refresh token expired"))
+		return
+	case errors.Is(err, db.ErrRefreshTokenReused):
+		metricStatus = "failure"
+		s.log.Warn("refresh token reuse detected, revoked session", "did", actor.Did)
+		s.unauthorized(w, fmt.Errorf("refresh token has already been used"))
+		return
+	case err != nil:
 		s.log.Error("failed to create new session for refresh", "did", actor.Did, "error", err)
 		s.internalErr(w, fmt.Errorf("failed to create session"))
 		return
@@ -373,25 +481,140 @@ func (s *server) handleDeleteSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// remove the refresh token that matches this JTI
-	newRefreshTokens := make([]*types.RefreshToken, 0, len(actor.RefreshTokens))
-	for _, rt := range actor.RefreshTokens {
-		rtClaims, err := s.verifyRefreshToken(ctx, rt.Token)
-		if err != nil {
-			continue // skip invalid tokens
-		}
-
-		if rtClaims.JTI != claims.JTI {
-			// keep tokens that don't match the JTI
-			newRefreshTokens = append(newRefreshTokens, rt)
-		}
+	// revoke every refresh token descended from the same login
+	session, err := s.db.GetSession(ctx, actor.Did, claims.JTI)
+	if errors.Is(err, db.ErrNotFound) {
+		return // already revoked
+	}
+	if err != nil {
+		s.log.Error("failed to get session", "did", actor.Did, "error", err)
+		s.internalErr(w, fmt.Errorf("failed to delete session"))
+		return
 	}
-	actor.RefreshTokens = newRefreshTokens
 
-	// save the updated actor
-	if err := s.db.SaveActor(ctx, actor); err != nil {
-		s.log.Error("failed to save actor after deleting session", "did", actor.Did, "error", err)
+	if err := s.db.RevokeSession(ctx, actor.Did, session.Family); err != nil && !errors.Is(err, db.ErrNotFound) {
+		s.log.Error("failed to revoke session", "did", actor.Did, "error", err)
 		s.internalErr(w, fmt.Errorf("failed to delete session"))
 		return
 	}
 }
+
+type sessionView struct {
+	ID          string `json:"id"`
+	CreatedAt   string `json:"createdAt"`
+	RefreshedAt string `json:"refreshedAt"`
+	ExpiresAt   string `json:"expiresAt"`
+	UserAgent   string `json:"userAgent,omitempty"`
+	Current     bool   `json:"current"`
+}
+
+type listSessionsOutput struct {
+	Sessions []*sessionView `json:"sessions"`
+}
+
+// handleListSessions lists the caller's active logins. Each is identified by its token family,
+// which stays the same as the session's refresh token is rotated.
+func (s *server) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	actor := actorFromContext(ctx)
+	if actor == nil {
+		s.internalErr(w, fmt.Errorf("actor not found in context"))
+		return
+	}
+
+	claims, err := s.verifyAccessToken(ctx, tokenFromContext(ctx))
+	if err != nil {
+		s.internalErr(w, fmt.Errorf("failed to verify token: %w", err))
+		return
+	}
+
+	var currentFamily string
+	current, err := s.db.GetSession(ctx, actor.Did, claims.JTI)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		s.internalErr(w, fmt.Errorf("failed to get current session: %w", err))
+		return
+	}
+	if current != nil {
+		currentFamily = current.Family
+	}
+
+	sessions, err := s.db.ListSessions(ctx, actor.Did)
+	if err != nil {
+		s.internalErr(w, fmt.Errorf("failed to list sessions: %w", err))
+		return
+	}
+
+	out := &listSessionsOutput{Sessions: make([]*sessionView, 0, len(sessions))}
+	for _, session := range sessions {
+		out.Sessions = append(out.Sessions, &sessionView{
+			ID:          session.Family,
+			CreatedAt:   session.FamilyCreatedAt.AsTime().Format(time.RFC3339),
+			RefreshedAt: session.CreatedAt.AsTime().Format(time.RFC3339),
+			ExpiresAt:   session.ExpiresAt.AsTime().Format(time.RFC3339),
+			UserAgent:   session.UserAgent,
+			Current:     session.Family == currentFamily,
+		})
+	}
+
+	s.jsonOK(w, out)
+}
+
+type revokeSessionInput struct {
+	ID string `json:"id"`
+}
+
+// handleRevokeSession logs out one of the caller's sessions, as listed by handleListSessions
+func (s *server) handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	actor := actorFromContext(ctx)
+	if actor == nil {
+		s.internalErr(w, fmt.Errorf("actor not found in context"))
+		return
+	}
+
+	var in revokeSessionInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		s.badRequest(w, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	if in.ID == "" {
+		s.badRequest(w, fmt.Errorf("id is required"))
+		return
+	}
+
+	err := s.db.RevokeSession(ctx, actor.Did, in.ID)
+	if errors.Is(err, db.ErrNotFound) {
+		s.notFound(w, fmt.Errorf("session not found"))
+		return
+	}
+	if err != nil {
+		s.internalErr(w, fmt.Errorf("failed to revoke session: %w", err))
+		return
+	}
+}
+
+// sweepSessions periodically deletes expired refresh tokens until ctx is cancelled
+func (s *server) sweepSessions(ctx context.Context) {
+	ticker := time.NewTicker(sessionSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			deleted, err := s.db.SweepSessions(ctx, time.Now())
+			if err != nil {
+				if ctx.Err() == nil {
+					s.log.Error("failed to sweep expired sessions", "err", err)
+				}
+				continue
+			}
+			if deleted > 0 {
+				s.log.Info("swept expired sessions", "deleted", deleted)
+			}
+		}
+	}
+}
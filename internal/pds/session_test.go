@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/jcalabro/atlas/internal/pds/db"
 	"github.com/jcalabro/atlas/internal/types"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/crypto/bcrypt"
@@ -35,16 +36,15 @@ func TestCreateSession(t *testing.T) {
 
 	t.Run("creates valid access and refresh tokens", func(t *testing.T) {
 		actor := &types.Actor{
-			Did:           "did:plc:testuser123",
-			Email:         "test@example.com",
-			Handle:        "test.dev.atlaspds.net",
-			PdsHost:       testPDSHost,
-			CreatedAt:     timestamppb.Now(),
-			Active:        true,
-			PasswordHash:  []byte("password_hash"),
-			SigningKey:    []byte("signing_key"),
-			RotationKeys:  [][]byte{[]byte("rotation_key")},
-			RefreshTokens: []*types.RefreshToken{},
+			Did:          "did:plc:testuser123",
+			Email:        "test@example.com",
+			Handle:       "test.dev.atlaspds.net",
+			PdsHost:      testPDSHost,
+			CreatedAt:    timestamppb.Now(),
+			Active:       true,
+			PasswordHash: []byte("password_hash"),
+			SigningKey:   []byte("signing_key"),
+			RotationKeys: [][]byte{[]byte("rotation_key")},
 		}
 
 		err := srv.db.SaveActor(ctx, actor)
@@ -86,18 +86,17 @@ func TestCreateSession(t *testing.T) {
 		require.Equal(t, accessClaims["jti"], refreshClaims["jti"])
 	})
 
-	t.Run("saves refresh token to actor", func(t *testing.T) {
+	t.Run("saves hashed refresh token", func(t *testing.T) {
 		actor := &types.Actor{
-			Did:           "did:plc:testuser456",
-			Email:         "testsaverefresh@example.com",
-			Handle:        "testsaverefresh.dev.atlaspds.net",
-			PdsHost:       testPDSHost,
-			CreatedAt:     timestamppb.Now(),
-			Active:        true,
-			PasswordHash:  []byte("password_hash"),
-			SigningKey:    []byte("signing_key"),
-			RotationKeys:  [][]byte{[]byte("rotation_key")},
-			RefreshTokens: []*types.RefreshToken{},
+			Did:          "did:plc:testuser456",
+			Email:        "testsaverefresh@example.com",
+			Handle:       "testsaverefresh.dev.atlaspds.net",
+			PdsHost:      testPDSHost,
+			CreatedAt:    timestamppb.Now(),
+			Active:       true,
+			PasswordHash: []byte("password_hash"),
+			SigningKey:   []byte("signing_key"),
+			RotationKeys: [][]byte{[]byte("rotation_key")},
 		}
 
 		err := srv.db.SaveActor(ctx, actor)
@@ -106,32 +105,30 @@ func TestCreateSession(t *testing.T) {
 		session, err := srv.createSession(hostCtx, actor)
 		require.NoError(t, err)
 
-		retrievedActor, err := srv.db.GetActorByEmail(ctx, testPDSHost, actor.Email)
-		require.NoError(t, err)
-		require.NotNil(t, retrievedActor)
-
-		require.Len(t, retrievedActor.RefreshTokens, 1)
-		require.Equal(t, session.RefreshToken, retrievedActor.RefreshTokens[0].Token)
-		require.NotNil(t, retrievedActor.RefreshTokens[0].CreatedAt)
-		require.NotNil(t, retrievedActor.RefreshTokens[0].ExpiresAt)
+		stored := storedSession(t, srv, hostCtx, session.RefreshToken)
+		require.Equal(t, actor.Did, stored.Did)
+		require.Equal(t, db.HashRefreshToken(session.RefreshToken), stored.TokenHash)
+		require.NotContains(t, string(stored.TokenHash), session.RefreshToken)
+		require.Equal(t, stored.Jti, stored.Family)
+		require.Empty(t, stored.RotatedTo)
+		require.NotNil(t, stored.CreatedAt)
 
-		expiresAt := retrievedActor.RefreshTokens[0].ExpiresAt.AsTime()
+		expiresAt := stored.ExpiresAt.AsTime()
 		expectedExpiry := time.Now().Add(refreshTokenTTL)
 		require.WithinDuration(t, expectedExpiry, expiresAt, 5*time.Second)
 	})
 
 	t.Run("supports multiple refresh tokens per actor", func(t *testing.T) {
 		actor := &types.Actor{
-			Did:           "did:plc:testuser789",
-			Email:         "testmultirefresh@example.com",
-			Handle:        "testmultirefresh.dev.atlaspds.net",
-			PdsHost:       testPDSHost,
-			CreatedAt:     timestamppb.Now(),
-			Active:        true,
-			PasswordHash:  []byte("password_hash"),
-			SigningKey:    []byte("signing_key"),
-			RotationKeys:  [][]byte{[]byte("rotation_key")},
-			RefreshTokens: []*types.RefreshToken{},
+			Did:          "did:plc:testuser789",
+			Email:        "testmultirefresh@example.com",
+			Handle:       "testmultirefresh.dev.atlaspds.net",
+			PdsHost:      testPDSHost,
+			CreatedAt:    timestamppb.Now(),
+			Active:       true,
+			PasswordHash: []byte("password_hash"),
+			SigningKey:   []byte("signing_key"),
+			RotationKeys: [][]byte{[]byte("rotation_key")},
 		}
 
 		err := srv.db.SaveActor(ctx, actor)
@@ -140,35 +137,31 @@ func TestCreateSession(t *testing.T) {
 		session1, err := srv.createSession(hostCtx, actor)
 		require.NoError(t, err)
 
-		retrievedActor, err := srv.db.GetActorByEmail(ctx, testPDSHost, actor.Email)
-		require.NoError(t, err)
-		require.Len(t, retrievedActor.RefreshTokens, 1)
-
-		session2, err := srv.createSession(hostCtx, retrievedActor)
+		session2, err := srv.createSession(hostCtx, actor)
 		require.NoError(t, err)
 
-		retrievedActor, err = srv.db.GetActorByEmail(ctx, testPDSHost, actor.Email)
+		sessions, err := srv.db.ListSessions(ctx, actor.Did)
 		require.NoError(t, err)
-		require.Len(t, retrievedActor.RefreshTokens, 2)
+		require.Len(t, sessions, 2)
 
-		require.Equal(t, session1.RefreshToken, retrievedActor.RefreshTokens[0].Token)
-		require.Equal(t, session2.RefreshToken, retrievedActor.RefreshTokens[1].Token)
+		stored1 := storedSession(t, srv, hostCtx, session1.RefreshToken)
+		stored2 := storedSession(t, srv, hostCtx, session2.RefreshToken)
+		require.NotEqual(t, stored1.Family, stored2.Family)
 		require.NotEqual(t, session1.RefreshToken, session2.RefreshToken)
 		require.NotEqual(t, session1.AccessToken, session2.AccessToken)
 	})
 
 	t.Run("access token expires in 3 hours", func(t *testing.T) {
 		actor := &types.Actor{
-			Did:           "did:plc:testuser101112",
-			Email:         "test4@example.com",
-			Handle:        "test4.dev.atlaspds.net",
-			PdsHost:       testPDSHost,
-			CreatedAt:     timestamppb.Now(),
-			Active:        true,
-			PasswordHash:  []byte("password_hash"),
-			SigningKey:    []byte("signing_key"),
-			RotationKeys:  [][]byte{[]byte("rotation_key")},
-			RefreshTokens: []*types.RefreshToken{},
+			Did:          "did:plc:testuser101112",
+			Email:        "test4@example.com",
+			Handle:       "test4.dev.atlaspds.net",
+			PdsHost:      testPDSHost,
+			CreatedAt:    timestamppb.Now(),
+			Active:       true,
+			PasswordHash: []byte("password_hash"),
+			SigningKey:   []byte("signing_key"),
+			RotationKeys: [][]byte{[]byte("rotation_key")},
 		}
 
 		err := srv.db.SaveActor(ctx, actor)
@@ -195,16 +188,15 @@ func TestCreateSession(t *testing.T) {
 
 	t.Run("refresh token expires in 7 days", func(t *testing.T) {
 		actor := &types.Actor{
-			Did:           "did:plc:testuser131415",
-			Email:         "test5@example.com",
-			Handle:        "test5.dev.atlaspds.net",
-			PdsHost:       testPDSHost,
-			CreatedAt:     timestamppb.Now(),
-			Active:        true,
-			PasswordHash:  []byte("password_hash"),
-			SigningKey:    []byte("signing_key"),
-			RotationKeys:  [][]byte{[]byte("rotation_key")},
-			RefreshTokens: []*types.RefreshToken{},
+			Did:          "did:plc:testuser131415",
+			Email:        "test5@example.com",
+			Handle:       "test5.dev.atlaspds.net",
+			PdsHost:      testPDSHost,
+			CreatedAt:    timestamppb.Now(),
+			Active:       true,
+			PasswordHash: []byte("password_hash"),
+			SigningKey:   []byte("signing_key"),
+			RotationKeys: [][]byte{[]byte("rotation_key")},
 		}
 
 		err := srv.db.SaveActor(ctx, actor)
@@ -248,16 +240,15 @@ func TestVerifyAccessToken(t *testing.T) {
 		t.Parallel()
 
 		actor := &types.Actor{
-			Did:           "did:plc:testuser123",
-			Email:         "test@example.com",
-			Handle:        "test.dev.atlaspds.net",
-			PdsHost:       testPDSHost,
-			CreatedAt:     timestamppb.Now(),
-			Active:        true,
-			PasswordHash:  []byte("password_hash"),
-			SigningKey:    []byte("signing_key"),
-			RotationKeys:  [][]byte{[]byte("rotation_key")},
-			RefreshTokens: []*types.RefreshToken{},
+			Did:          "did:plc:testuser123",
+			Email:        "test@example.com",
+			Handle:       "test.dev.atlaspds.net",
+			PdsHost:      testPDSHost,
+			CreatedAt:    timestamppb.Now(),
+			Active:       true,
+			PasswordHash: []byte("password_hash"),
+			SigningKey:   []byte("signing_key"),
+			RotationKeys: [][]byte{[]byte("rotation_key")},
 		}
 
 		err := srv.db.SaveActor(ctx, actor)
@@ -279,16 +270,15 @@ func TestVerifyAccessToken(t *testing.T) {
 		t.Parallel()
 
 		actor := &types.Actor{
-			Did:           "did:plc:testuser456rejectrefresh",
-			Email:         "testrejectrefresh@example.com",
-			Handle:        "testrejectrefresh.dev.atlaspds.net",
-			PdsHost:       testPDSHost,
-			CreatedAt:     timestamppb.Now(),
-			Active:        true,
-			PasswordHash:  []byte("password_hash"),
-			SigningKey:    []byte("signing_key"),
-			RotationKeys:  [][]byte{[]byte("rotation_key")},
-			RefreshTokens: []*types.RefreshToken{},
+			Did:          "did:plc:testuser456rejectrefresh",
+			Email:        "testrejectrefresh@example.com",
+			Handle:       "testrejectrefresh.dev.atlaspds.net",
+			PdsHost:      testPDSHost,
+			CreatedAt:    timestamppb.Now(),
+			Active:       true,
+			PasswordHash: []byte("password_hash"),
+			SigningKey:   []byte("signing_key"),
+			RotationKeys: [][]byte{[]byte("rotation_key")},
 		}
 
 		err := srv.db.SaveActor(ctx, actor)
@@ -423,16 +413,15 @@ func TestVerifyRefreshToken(t *testing.T) {
 		t.Parallel()
 
 		actor := &types.Actor{
-			Did:           "did:plc:testuser123",
-			Email:         "test@example.com",
-			Handle:        "test.dev.atlaspds.net",
-			PdsHost:       testPDSHost,
-			CreatedAt:     timestamppb.Now(),
-			Active:        true,
-			PasswordHash:  []byte("password_hash"),
-			SigningKey:    []byte("signing_key"),
-			RotationKeys:  [][]byte{[]byte("rotation_key")},
-			RefreshTokens: []*types.RefreshToken{},
+			Did:          "did:plc:testuser123",
+			Email:        "test@example.com",
+			Handle:       "test.dev.atlaspds.net",
+			PdsHost:      testPDSHost,
+			CreatedAt:    timestamppb.Now(),
+			Active:       true,
+			PasswordHash: []byte("password_hash"),
+			SigningKey:   []byte("signing_key"),
+			RotationKeys: [][]byte{[]byte("rotation_key")},
 		}
 
 		err := srv.db.SaveActor(ctx, actor)
@@ -454,16 +443,15 @@ func TestVerifyRefreshToken(t *testing.T) {
 		t.Parallel()
 
 		actor := &types.Actor{
-			Did:           "did:plc:testuser456rejectaccess",
-			Email:         "testrejectaccess@example.com",
-			Handle:        "testrejectaccess.dev.atlaspds.net",
-			PdsHost:       testPDSHost,
-			CreatedAt:     timestamppb.Now(),
-			Active:        true,
-			PasswordHash:  []byte("password_hash"),
-			SigningKey:    []byte("signing_key"),
-			RotationKeys:  [][]byte{[]byte("rotation_key")},
-			RefreshTokens: []*types.RefreshToken{},
+			Did:          "did:plc:testuser456rejectaccess",
+			Email:        "testrejectaccess@example.com",
+			Handle:       "testrejectaccess.dev.atlaspds.net",
+			PdsHost:      testPDSHost,
+			CreatedAt:    timestamppb.Now(),
+			Active:       true,
+			PasswordHash: []byte("password_hash"),
+			SigningKey:   []byte("signing_key"),
+			RotationKeys: [][]byte{[]byte("rotation_key")},
 		}
 
 		err := srv.db.SaveActor(ctx, actor)
@@ -505,16 +493,15 @@ func TestVerifyRefreshToken(t *testing.T) {
 		t.Parallel()
 
 		actor := &types.Actor{
-			Did:           "did:plc:testuser101112",
-			Email:         "testjti@example.com",
-			Handle:        "testjti.dev.atlaspds.net",
-			PdsHost:       testPDSHost,
-			CreatedAt:     timestamppb.Now(),
-			Active:        true,
-			PasswordHash:  []byte("password_hash"),
-			SigningKey:    []byte("signing_key"),
-			RotationKeys:  [][]byte{[]byte("rotation_key")},
-			RefreshTokens: []*types.RefreshToken{},
+			Did:          "did:plc:testuser101112",
+			Email:        "testjti@example.com",
+			Handle:       "testjti.dev.atlaspds.net",
+			PdsHost:      testPDSHost,
+			CreatedAt:    timestamppb.Now(),
+			Active:       true,
+			PasswordHash: []byte("password_hash"),
+			SigningKey:   []byte("signing_key"),
+			RotationKeys: [][]byte{[]byte("rotation_key")},
 		}
 
 		err := srv.db.SaveActor(ctx, actor)
@@ -560,7 +547,6 @@ func TestHandleCreateSession(t *testing.T) {
 			Active:         true,
 			SigningKey:     []byte("signing_key"),
 			RotationKeys:   [][]byte{[]byte("rotation_key")},
-			RefreshTokens:  []*types.RefreshToken{{Token: "initial_token"}},
 		}
 
 		err = srv.db.SaveActor(ctx, actor)
@@ -725,7 +711,6 @@ func TestHandleCreateSession(t *testing.T) {
 			Active:         false, // inactive account
 			SigningKey:     []byte("signing_key"),
 			RotationKeys:   [][]byte{[]byte("rotation_key")},
-			RefreshTokens:  []*types.RefreshToken{{Token: "initial_token"}},
 		}
 
 		err = srv.db.SaveActor(ctx, actor)
@@ -779,7 +764,6 @@ func TestHandleGetSession(t *testing.T) {
 			Active:         true,
 			SigningKey:     []byte("signing_key"),
 			RotationKeys:   [][]byte{[]byte("rotation_key")},
-			RefreshTokens:  []*types.RefreshToken{},
 		}
 
 		err = srv.db.SaveActor(ctx, actor)
@@ -840,7 +824,6 @@ func TestHandleGetSession(t *testing.T) {
 			Active:         false,
 			SigningKey:     []byte("signing_key"),
 			RotationKeys:   [][]byte{[]byte("rotation_key")},
-			RefreshTokens:  []*types.RefreshToken{},
 		}
 
 		err = srv.db.SaveActor(ctx, actor)
@@ -940,7 +923,6 @@ func TestHandleRefreshSession(t *testing.T) {
 			Active:         true,
 			SigningKey:     []byte("signing_key"),
 			RotationKeys:   [][]byte{[]byte("rotation_key")},
-			RefreshTokens:  []*types.RefreshToken{},
 		}
 
 		err = srv.db.SaveActor(ctx, actor)
@@ -987,12 +969,56 @@ func TestHandleRefreshSession(t *testing.T) {
 		require.NotEqual(t, session.AccessToken, resp["accessJwt"])
 		require.NotEqual(t, session.RefreshToken, resp["refreshJwt"])
 
-		// verify old refresh token was removed
-		updatedActor, err := srv.db.GetActorByDID(ctx, actor.Did)
+		// the new token continues the same session
+		refreshJwt, ok := resp["refreshJwt"].(string)
+		require.True(t, ok)
+		before := storedSession(t, srv, hostCtx, session.RefreshToken)
+		after := storedSession(t, srv, hostCtx, refreshJwt)
+		require.Equal(t, before.Family, after.Family)
+		require.Equal(t, after.Jti, before.RotatedTo)
+
+		sessions, err := srv.db.ListSessions(ctx, actor.Did)
+		require.NoError(t, err)
+		require.Len(t, sessions, 1)
+		require.Equal(t, after.Jti, sessions[0].Jti)
+	})
+
+	t.Run("reusing a rotated refresh token revokes the session", func(t *testing.T) {
+		t.Parallel()
+
+		actor, session := setupTestActor("did:plc:refresh4", "refresh4@example.com", "refresh4.dev.atlaspds.net")
+		other, err := srv.createSession(hostCtx, actor)
 		require.NoError(t, err)
-		for _, rt := range updatedActor.RefreshTokens {
-			require.NotEqual(t, session.RefreshToken, rt.Token)
+
+		refresh := func(token string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/xrpc/com.atproto.server.refreshSession", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			srv.router().ServeHTTP(w, addHostContext(req))
+			return w
 		}
+
+		w := refresh(session.RefreshToken)
+		require.Equal(t, http.StatusOK, w.Code)
+		var resp map[string]any
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		rotated, ok := resp["refreshJwt"].(string)
+		require.True(t, ok)
+
+		// replaying the original token is rejected and revokes the token it was rotated into
+		w = refresh(session.RefreshToken)
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		require.Contains(t, resp["message"], "already been used")
+
+		w = refresh(rotated)
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+
+		// other logins are unaffected
+		sessions, err := srv.db.ListSessions(ctx, actor.Did)
+		require.NoError(t, err)
+		require.Len(t, sessions, 1)
+		require.Equal(t, storedSession(t, srv, hostCtx, other.RefreshToken).Family, sessions[0].Family)
 	})
 
 	t.Run("rejects access token for refreshSession", func(t *testing.T) {
@@ -1084,7 +1110,6 @@ func TestHandleDeleteSession(t *testing.T) {
 			Active:         true,
 			SigningKey:     []byte("signing_key"),
 			RotationKeys:   [][]byte{[]byte("rotation_key")},
-			RefreshTokens:  []*types.RefreshToken{},
 		}
 
 		err = srv.db.SaveActor(ctx, actor)
@@ -1107,10 +1132,10 @@ func TestHandleDeleteSession(t *testing.T) {
 
 		actor, session := setupTestActor("did:plc:delete1", "delete1@example.com", "delete1.dev.atlaspds.net")
 
-		// verify refresh token exists before deletion
-		beforeActor, err := srv.db.GetActorByDID(ctx, actor.Did)
+		// verify the session exists before deletion
+		before, err := srv.db.ListSessions(ctx, actor.Did)
 		require.NoError(t, err)
-		require.Len(t, beforeActor.RefreshTokens, 1)
+		require.Len(t, before, 1)
 
 		w := httptest.NewRecorder()
 		router := srv.router()
@@ -1122,10 +1147,17 @@ func TestHandleDeleteSession(t *testing.T) {
 
 		require.Equal(t, http.StatusOK, w.Code)
 
-		// verify refresh token was removed
-		afterActor, err := srv.db.GetActorByDID(ctx, actor.Did)
+		// verify the session was removed
+		after, err := srv.db.ListSessions(ctx, actor.Did)
 		require.NoError(t, err)
-		require.Len(t, afterActor.RefreshTokens, 0)
+		require.Empty(t, after)
+
+		// and its access token no longer works
+		w = httptest.NewRecorder()
+		req = httptest.NewRequest(http.MethodGet, "/xrpc/com.atproto.server.getSession", nil)
+		req.Header.Set("Authorization", "Bearer "+session.AccessToken)
+		router.ServeHTTP(w, addHostContext(req))
+		require.Equal(t, http.StatusUnauthorized, w.Code)
 	})
 
 	t.Run("preserves other sessions when deleting one", func(t *testing.T) {
@@ -1134,15 +1166,13 @@ func TestHandleDeleteSession(t *testing.T) {
 		actor, session1 := setupTestActor("did:plc:delete2", "delete2@example.com", "delete2.dev.atlaspds.net")
 
 		// create a second session
-		updatedActor, err := srv.db.GetActorByDID(ctx, actor.Did)
-		require.NoError(t, err)
-		session2, err := srv.createSession(hostCtx, updatedActor)
+		session2, err := srv.createSession(hostCtx, actor)
 		require.NoError(t, err)
 
-		// verify two refresh tokens exist
-		beforeActor, err := srv.db.GetActorByDID(ctx, actor.Did)
+		// verify two sessions exist
+		before, err := srv.db.ListSessions(ctx, actor.Did)
 		require.NoError(t, err)
-		require.Len(t, beforeActor.RefreshTokens, 2)
+		require.Len(t, before, 2)
 
 		w := httptest.NewRecorder()
 		router := srv.router()
@@ -1154,11 +1184,11 @@ func TestHandleDeleteSession(t *testing.T) {
 
 		require.Equal(t, http.StatusOK, w.Code)
 
-		// verify only the first session's refresh token was removed
-		afterActor, err := srv.db.GetActorByDID(ctx, actor.Did)
+		// verify only the first session was removed
+		after, err := srv.db.ListSessions(ctx, actor.Did)
 		require.NoError(t, err)
-		require.Len(t, afterActor.RefreshTokens, 1)
-		require.Equal(t, session2.RefreshToken, afterActor.RefreshTokens[0].Token)
+		require.Len(t, after, 1)
+		require.Equal(t, db.HashRefreshToken(session2.RefreshToken), after[0].TokenHash)
 	})
 
 	t.Run("rejects request without authorization header", func(t *testing.T) {
@@ -1234,7 +1264,6 @@ func TestAuthMiddleware(t *testing.T) {
 			Active:         true,
 			SigningKey:     []byte("signing_key"),
 			RotationKeys:   [][]byte{[]byte("rotation_key")},
-			RefreshTokens:  []*types.RefreshToken{},
 		}
 
 		err = srv.db.SaveActor(ctx, actor)
@@ -1512,14 +1541,13 @@ func TestAuthMiddleware(t *testing.T) {
 		require.Contains(t, resp["message"], "actor not found")
 	})
 
-	t.Run("rejects refresh token not in actor's token list", func(t *testing.T) {
+	t.Run("rejects revoked refresh token", func(t *testing.T) {
 		t.Parallel()
 
 		actor, session := setupTestActor("did:plc:authmw8", "authmw8@example.com", "authmw8.dev.atlaspds.net")
 
-		// remove the refresh token from the actor's list
-		actor.RefreshTokens = []*types.RefreshToken{}
-		err := srv.db.SaveActor(ctx, actor)
+		stored := storedSession(t, srv, hostCtx, session.RefreshToken)
+		err := srv.db.RevokeSession(ctx, actor.Did, stored.Family)
 		require.NoError(t, err)
 
 		w := httptest.NewRecorder()
@@ -1572,18 +1600,21 @@ func TestAuthMiddleware(t *testing.T) {
 			Active:         true,
 			SigningKey:     []byte("signing_key"),
 			RotationKeys:   [][]byte{[]byte("rotation_key")},
-			RefreshTokens: []*types.RefreshToken{
-				{
-					Token:     refreshString,
-					CreatedAt: timestamppb.New(now),
-					ExpiresAt: timestamppb.New(expiredTime), // expired in database
-				},
-			},
 		}
 
 		err = srv.db.SaveActor(ctx, actor)
 		require.NoError(t, err)
 
+		err = srv.db.CreateSession(ctx, &types.RefreshSession{
+			Did:       actor.Did,
+			Jti:       "test-jti-db-expired",
+			Family:    "test-jti-db-expired",
+			TokenHash: db.HashRefreshToken(refreshString),
+			CreatedAt: timestamppb.New(now),
+			ExpiresAt: timestamppb.New(expiredTime), // expired in database
+		})
+		require.NoError(t, err)
+
 		w := httptest.NewRecorder()
 		router := srv.router()
 
@@ -1629,3 +1660,81 @@ func TestAuthMiddleware(t *testing.T) {
 		require.Equal(t, session.AccessToken, capturedToken)
 	})
 }
+
+func TestHandleListAndRevokeSessions(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	srv := testServer(t)
+	hostCtx := context.WithValue(ctx, hostContextKey{}, srv.hosts[testPDSHost])
+
+	actor := &types.Actor{
+		Did:          "did:plc:listsessions1",
+		Email:        "listsessions1@example.com",
+		Handle:       "listsessions1.dev.atlaspds.net",
+		PdsHost:      testPDSHost,
+		CreatedAt:    timestamppb.Now(),
+		Active:       true,
+		PasswordHash: []byte("password_hash"),
+		SigningKey:   []byte("signing_key"),
+		RotationKeys: [][]byte{[]byte("rotation_key")},
+	}
+	require.NoError(t, srv.db.SaveActor(ctx, actor))
+
+	uaCtx := context.WithValue(hostCtx, userAgentContextKey{}, "test-client/1.0")
+	current, err := srv.createSession(uaCtx, actor)
+	require.NoError(t, err)
+	other, err := srv.createSession(hostCtx, actor)
+	require.NoError(t, err)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+current.AccessToken)
+		srv.router().ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), hostContextKey{}, srv.hosts[testPDSHost])))
+		return w
+	}
+
+	w := do(http.MethodGet, "/xrpc/net.atlaspds.server.listSessions", "")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var out listSessionsOutput
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&out))
+	require.Len(t, out.Sessions, 2)
+
+	otherFamily := storedSession(t, srv, hostCtx, other.RefreshToken).Family
+	for _, session := range out.Sessions {
+		if session.Current {
+			require.Equal(t, "test-client/1.0", session.UserAgent)
+		} else {
+			require.Equal(t, otherFamily, session.ID)
+		}
+	}
+
+	w = do(http.MethodPost, "/xrpc/net.atlaspds.server.revokeSession", `{"id":"`+otherFamily+`"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = do(http.MethodPost, "/xrpc/net.atlaspds.server.revokeSession", `{"id":"`+otherFamily+`"}`)
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	w = do(http.MethodPost, "/xrpc/net.atlaspds.server.revokeSession", `{}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	sessions, err := srv.db.ListSessions(ctx, actor.Did)
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	require.Equal(t, db.HashRefreshToken(current.RefreshToken), sessions[0].TokenHash)
+}
+
+// storedSession returns the refresh session saved for the given refresh token
+func storedSession(t *testing.T, srv *server, hostCtx context.Context, refreshToken string) *types.RefreshSession {
+	t.Helper()
+
+	claims, err := srv.verifyRefreshToken(hostCtx, refreshToken)
+	require.NoError(t, err)
+
+	session, err := srv.db.GetSession(hostCtx, claims.DID, claims.JTI)
+	require.NoError(t, err)
+
+	return session
+}
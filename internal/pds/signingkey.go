@@ -0,0 +1,164 @@
+package pds
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/jcalabro/atlas/internal/pds/db"
+	"github.com/jcalabro/atlas/internal/plc"
+	"github.com/jcalabro/atlas/internal/types"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// defaultSigningKeyGrace is how long a repo's previous signing key is kept after a rotation
+const defaultSigningKeyGrace = 7 * 24 * time.Hour
+
+type signingKeyRotation struct {
+	SigningKey string
+	CommitCID  string
+	Rev        string
+}
+
+// rotateSigningKey replaces the actor's repo signing key with a freshly generated one. The new key
+// is published to the actor's DID document with a PLC operation signed by the actor's rotation key,
+// then the current head is re-signed with it. An interrupted rotation resumes with the same key.
+func (s *server) rotateSigningKey(ctx context.Context, actor *types.Actor) (*signingKeyRotation, error) {
+	host := s.getHost(actor.PdsHost)
+	if host == nil {
+		return nil, fmt.Errorf("host %q is not configured", actor.PdsHost)
+	}
+
+	rotationKey, err := s.db.RotationKey(ctx, actor)
+	if err != nil {
+		return nil, err
+	}
+
+	generated, err := atcrypto.GeneratePrivateKeyK256()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create signing key: %w", err)
+	}
+
+	wrapped, plain, err := sealKey(ctx, host, generated.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to seal signing key: %w", err)
+	}
+
+	actor, err = s.db.PrepareSigningKeyRotation(ctx, actor.Did, wrapped, plain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare signing key rotation: %w", err)
+	}
+
+	signingKey, err := s.db.PendingSigningKey(ctx, actor)
+	if err != nil {
+		return nil, err
+	}
+	pubkey, err := signingKey.PublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pending signing public key: %w", err)
+	}
+
+	last, err := s.plc.GetLastOperation(ctx, actor.Did)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get last plc operation: %w", err)
+	}
+
+	// a resumed rotation may have already published the new key
+	if last.VerificationMethods["atproto"] != pubkey.DIDKey() {
+		op, err := plc.SigningKeyUpdate(last, signingKey, rotationKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create plc operation: %w", err)
+		}
+		if err := s.plc.SendOperation(ctx, actor.Did, op); err != nil {
+			return nil, fmt.Errorf("failed to submit plc operation: %w", err)
+		}
+	}
+
+	if err := s.directory.Purge(ctx, syntax.DID(actor.Did).AtIdentifier()); err != nil {
+		s.log.Warn("failed to purge identity from cache", "err", err, "did", actor.Did)
+	}
+
+	identityEvent := &types.RepoEvent{
+		PdsHost:   actor.PdsHost,
+		Repo:      actor.Did,
+		Handle:    actor.Handle,
+		Time:      timestamppb.Now(),
+		EventType: types.EventType_EVENT_TYPE_IDENTITY,
+	}
+	if err := s.db.WriteIdentityEvent(ctx, identityEvent); err != nil {
+		return nil, fmt.Errorf("failed to write identity event: %w", err)
+	}
+
+	res, err := s.db.RotateSigningKey(ctx, actor.Did, s.signingKeyGrace)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rotate signing key: %w", err)
+	}
+
+	return &signingKeyRotation{
+		SigningKey: pubkey.DIDKey(),
+		CommitCID:  res.CommitCID.String(),
+		Rev:        res.Rev,
+	}, nil
+}
+
+type rotateSigningKeyInput struct {
+	Did string `json:"did"`
+}
+
+type rotateSigningKeyOutput struct {
+	Did        string `json:"did"`
+	SigningKey string `json:"signingKey"`
+	Cid        string `json:"cid"`
+	Rev        string `json:"rev"`
+}
+
+func (s *server) handleRotateSigningKey(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	span := spanFromContext(ctx)
+	defer span.End()
+
+	host := hostFromContext(ctx)
+
+	var in rotateSigningKeyInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		s.badRequest(w, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+
+	if _, err := syntax.ParseDID(in.Did); err != nil {
+		s.badRequest(w, fmt.Errorf("invalid did: %w", err))
+		return
+	}
+
+	// admins may only rotate keys for repos on their own host
+	actor, err := s.db.GetActorByDID(ctx, in.Did)
+	if errors.Is(err, db.ErrNotFound) || (err == nil && actor.PdsHost != host.hostname) {
+		s.notFound(w, fmt.Errorf("repo not found"))
+		return
+	}
+	if err != nil {
+		s.internalErr(w, fmt.Errorf("failed to get actor: %w", err))
+		return
+	}
+
+	res, err := s.rotateSigningKey(ctx, actor)
+	if err != nil {
+		s.internalErr(w, err)
+		return
+	}
+
+	s.audit(ctx, host, "net.atlaspds.admin.rotateSigningKey", in.Did, nil, map[string]string{"signingKey": res.SigningKey})
+	s.log.Info("rotated signing key", "did", in.Did, "signing_key", res.SigningKey, "cid", res.CommitCID)
+
+	s.jsonOK(w, &rotateSigningKeyOutput{
+		Did:        in.Did,
+		SigningKey: res.SigningKey,
+		Cid:        res.CommitCID,
+		Rev:        res.Rev,
+	})
+}
@@ -0,0 +1,120 @@
+package pds
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleRotateSigningKey(t *testing.T) {
+	t.Parallel()
+	srv := testServer(t)
+
+	rotate := func(t *testing.T, in *rotateSigningKeyInput) (*httptest.ResponseRecorder, *rotateSigningKeyOutput) {
+		t.Helper()
+
+		body, err := json.Marshal(in)
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodPost, "/xrpc/net.atlaspds.admin.rotateSigningKey", bytes.NewReader(body))
+		req = req.WithContext(context.WithValue(req.Context(), hostContextKey{}, srv.hosts[testPDSHost]))
+
+		w := httptest.NewRecorder()
+		srv.handleRotateSigningKey(w, req)
+
+		var out rotateSigningKeyOutput
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &out))
+		}
+		return w, &out
+	}
+
+	t.Run("publishes the new key and re-signs the repo", func(t *testing.T) {
+		t.Parallel()
+		ctx := t.Context()
+
+		actor, _ := setupTestActor(t, srv, "did:plc:rotatehandler1", "rotatehandler1@example.com", "rotatehandler1.dev.atlaspds.dev")
+
+		// publish a genesis operation controlled by the actor's rotation key
+		signingKey, err := atcrypto.ParsePrivateBytesK256(actor.SigningKey)
+		require.NoError(t, err)
+		rotationKey, err := atcrypto.ParsePrivateBytesK256(actor.RotationKeys[0])
+		require.NoError(t, err)
+		_, genesis, err := srv.plc.CreateDID(ctx, signingKey, rotationKey, "", actor.Handle, testPDSHost)
+		require.NoError(t, err)
+		require.NoError(t, srv.plc.SendOperation(ctx, actor.Did, genesis))
+		genesisCID, err := genesis.CID()
+		require.NoError(t, err)
+
+		cursor, err := srv.db.GetLatestSeq(ctx)
+		require.NoError(t, err)
+
+		w, out := rotate(t, &rotateSigningKeyInput{Did: actor.Did})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		// the did document was updated
+		op, err := srv.plc.GetLastOperation(ctx, actor.Did)
+		require.NoError(t, err)
+		require.Equal(t, out.SigningKey, op.VerificationMethods["atproto"])
+		require.Equal(t, genesisCID.String(), *op.Prev)
+
+		// the repo was re-signed with the new key
+		updated, err := srv.db.GetActorByDID(ctx, actor.Did)
+		require.NoError(t, err)
+		require.Equal(t, out.Cid, updated.Head)
+		require.NotEqual(t, actor.SigningKey, updated.SigningKey)
+		require.Len(t, updated.RetiredSigningKeys, 1)
+
+		newKey, err := atcrypto.ParsePrivateBytesK256(updated.SigningKey)
+		require.NoError(t, err)
+		pub, err := newKey.PublicKey()
+		require.NoError(t, err)
+		require.Equal(t, out.SigningKey, pub.DIDKey())
+
+		// identity and sync events were emitted in order
+		events, _, err := srv.db.GetEventsSince(ctx, cursor, 100)
+		require.NoError(t, err)
+
+		var kinds []string
+		for _, event := range events {
+			if event.Repo == actor.Did {
+				kinds = append(kinds, event.EventType.String())
+			}
+		}
+		require.Equal(t, []string{"EVENT_TYPE_IDENTITY", "EVENT_TYPE_SYNC"}, kinds)
+	})
+
+	t.Run("error - no plc history", func(t *testing.T) {
+		t.Parallel()
+
+		actor, _ := setupTestActor(t, srv, "did:plc:rotatehandler2", "rotatehandler2@example.com", "rotatehandler2.dev.atlaspds.dev")
+
+		w, _ := rotate(t, &rotateSigningKeyInput{Did: actor.Did})
+		require.Equal(t, http.StatusInternalServerError, w.Code)
+
+		// the signing key is unchanged
+		unchanged, err := srv.db.GetActorByDID(t.Context(), actor.Did)
+		require.NoError(t, err)
+		require.Equal(t, actor.SigningKey, unchanged.SigningKey)
+	})
+
+	t.Run("error - invalid did", func(t *testing.T) {
+		t.Parallel()
+
+		w, _ := rotate(t, &rotateSigningKeyInput{Did: "not-a-did"})
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("error - repo not found", func(t *testing.T) {
+		t.Parallel()
+
+		w, _ := rotate(t, &rotateSigningKeyInput{Did: "did:plc:rotatehandlernotfound"})
+		require.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
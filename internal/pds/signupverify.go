@@ -0,0 +1,157 @@
+package pds
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/jcalabro/atlas/internal/verify"
+)
+
+// SignupVerification configures the captcha or phone verification that signups must pass
+type SignupVerification struct {
+	// Provider is one of "hcaptcha", "turnstile", "twilio", "fake" or "fake_phone". Signups aren't
+	// verified if it's empty.
+	Provider string `toml:"provider"`
+
+	// SecretEnv names the environment variable holding the captcha secret key or Twilio auth token
+	SecretEnv string `toml:"secret_env"`
+
+	// Endpoint overrides the provider's API URL
+	Endpoint string `toml:"endpoint"`
+
+	// AccountSID and ServiceSID identify the Twilio account and Verify service
+	AccountSID string `toml:"account_sid"`
+	ServiceSID string `toml:"service_sid"`
+
+	// FakeCode is the code accepted by the fake providers
+	FakeCode string `toml:"fake_code"`
+}
+
+// e164 matches phone numbers in E.164 format, such as "+15555550123"
+var e164 = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+// loadSignupVerifier creates the configured verifier, or returns nil if verification is disabled
+func loadSignupVerifier(cfg *SignupVerification) (verify.Verifier, error) {
+	secret := func() (string, error) {
+		if cfg.SecretEnv == "" {
+			return "", fmt.Errorf("secret_env is required for provider %q", cfg.Provider)
+		}
+		val, ok := os.LookupEnv(cfg.SecretEnv)
+		if !ok || val == "" {
+			return "", fmt.Errorf("environment variable %q is not set", cfg.SecretEnv)
+		}
+		return val, nil
+	}
+
+	switch cfg.Provider {
+	case "":
+		return nil, nil
+	case "hcaptcha", "turnstile":
+		endpoint := cfg.Endpoint
+		if endpoint == "" {
+			endpoint = verify.HCaptchaEndpoint
+			if cfg.Provider == "turnstile" {
+				endpoint = verify.TurnstileEndpoint
+			}
+		}
+
+		key, err := secret()
+		if err != nil {
+			return nil, err
+		}
+		return verify.NewCaptcha(endpoint, key)
+	case "twilio":
+		token, err := secret()
+		if err != nil {
+			return nil, err
+		}
+		return verify.NewTwilio(&verify.TwilioArgs{
+			Endpoint:   cfg.Endpoint,
+			AccountSID: cfg.AccountSID,
+			AuthToken:  token,
+			ServiceSID: cfg.ServiceSID,
+		})
+	case "fake", "fake_phone":
+		if cfg.FakeCode == "" {
+			return nil, fmt.Errorf("fake_code is required for provider %q", cfg.Provider)
+		}
+		if cfg.Provider == "fake_phone" {
+			return verify.NewFakePhone(cfg.FakeCode), nil
+		}
+		return &verify.Fake{Code: cfg.FakeCode}, nil
+	default:
+		return nil, fmt.Errorf("unknown provider %q", cfg.Provider)
+	}
+}
+
+// phoneVerificationRequired returns true if signups on the host must verify a phone number
+func (h *loadedHostConfig) phoneVerificationRequired() bool {
+	_, ok := h.signupVerifier.(verify.PhoneVerifier)
+	return ok
+}
+
+// verifySignup checks the captcha token or phone verification code supplied with a signup, if the
+// host requires one. Returns the HTTP status code to respond with on error.
+func (s *server) verifySignup(r *http.Request, host *loadedHostConfig, in *atproto.ServerCreateAccount_Input) (int, error) {
+	if host.signupVerifier == nil {
+		return http.StatusOK, nil
+	}
+
+	sub := &verify.Submission{RemoteIP: s.clientIP(r)}
+	if in.VerificationCode != nil {
+		sub.Code = *in.VerificationCode
+	}
+	if in.VerificationPhone != nil {
+		sub.Phone = *in.VerificationPhone
+	}
+
+	err := host.signupVerifier.Verify(r.Context(), sub)
+	switch {
+	case errors.Is(err, verify.ErrVerificationFailed):
+		return http.StatusBadRequest, err
+	case err != nil:
+		return http.StatusInternalServerError, fmt.Errorf("failed to verify signup: %w", err)
+	}
+
+	return http.StatusOK, nil
+}
+
+// handleRequestPhoneVerification sends a signup verification code to the given phone number
+func (s *server) handleRequestPhoneVerification(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	span := spanFromContext(ctx)
+	defer span.End()
+
+	host := hostFromContext(ctx)
+	phone, ok := host.signupVerifier.(verify.PhoneVerifier)
+	if !ok {
+		s.badRequest(w, fmt.Errorf("phone verification is not enabled on this host"))
+		return
+	}
+
+	var in atproto.TempRequestPhoneVerification_Input
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		s.badRequest(w, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+
+	if !e164.MatchString(in.PhoneNumber) {
+		s.badRequest(w, fmt.Errorf("phone number must be in E.164 format"))
+		return
+	}
+
+	err := phone.SendCode(ctx, in.PhoneNumber)
+	if errors.Is(err, verify.ErrVerificationFailed) {
+		s.badRequest(w, err)
+		return
+	}
+	if err != nil {
+		s.internalErr(w, fmt.Errorf("failed to send verification code: %w", err))
+		return
+	}
+}
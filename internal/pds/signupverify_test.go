@@ -0,0 +1,124 @@
+package pds
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/jcalabro/atlas/internal/verify"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadSignupVerifier(t *testing.T) {
+	t.Parallel()
+
+	verifier, err := loadSignupVerifier(&SignupVerification{})
+	require.NoError(t, err)
+	require.Nil(t, verifier)
+
+	verifier, err = loadSignupVerifier(&SignupVerification{Provider: "fake_phone", FakeCode: "123456"})
+	require.NoError(t, err)
+	require.IsType(t, &verify.FakePhone{}, verifier)
+
+	_, err = loadSignupVerifier(&SignupVerification{Provider: "fake"})
+	require.ErrorContains(t, err, "fake_code")
+
+	_, err = loadSignupVerifier(&SignupVerification{Provider: "hcaptcha"})
+	require.ErrorContains(t, err, "secret_env")
+
+	_, err = loadSignupVerifier(&SignupVerification{Provider: "turnstile", SecretEnv: "ATLAS_TEST_UNSET_CAPTCHA_SECRET"})
+	require.ErrorContains(t, err, "not set")
+
+	_, err = loadSignupVerifier(&SignupVerification{Provider: "carrier-pigeon"})
+	require.ErrorContains(t, err, "unknown provider")
+}
+
+func TestSignupVerification(t *testing.T) {
+	t.Parallel()
+
+	srv := testServer(t)
+	phone := verify.NewFakePhone("123456")
+	srv.hosts[testPDSHost].signupVerifier = phone
+
+	withHost := func(req *http.Request) *http.Request {
+		return req.WithContext(context.WithValue(req.Context(), hostContextKey{}, srv.hosts[testPDSHost]))
+	}
+
+	requestCode := func(number string) *httptest.ResponseRecorder {
+		body, err := json.Marshal(&atproto.TempRequestPhoneVerification_Input{PhoneNumber: number})
+		require.NoError(t, err)
+
+		req := withHost(httptest.NewRequest(http.MethodPost, "/xrpc/com.atproto.temp.requestPhoneVerification", bytes.NewReader(body)))
+		w := httptest.NewRecorder()
+		srv.handleRequestPhoneVerification(w, req)
+		return w
+	}
+
+	signup := func(number, code string) *createAccountResponse {
+		password := "secure-password-123"
+		return createAccount(t, srv, &atproto.ServerCreateAccount_Input{
+			Email:             uniqueEmail(),
+			Handle:            uniqueHandle(),
+			Password:          &password,
+			VerificationPhone: &number,
+			VerificationCode:  &code,
+		})
+	}
+
+	t.Run("rejects invalid phone numbers", func(t *testing.T) {
+		t.Parallel()
+
+		w := requestCode("555-0123")
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		require.Contains(t, w.Body.String(), "E.164")
+	})
+
+	t.Run("requires a sent code", func(t *testing.T) {
+		t.Parallel()
+
+		resp := signup("+15555550100", "123456")
+		require.Equal(t, http.StatusBadRequest, resp.Code)
+
+		w := requestCode("+15555550101")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.True(t, phone.Sent("+15555550101"))
+
+		resp = signup("+15555550101", "000000")
+		require.Equal(t, http.StatusBadRequest, resp.Code)
+		require.Contains(t, resp.Body.Body.String(), "invalid verification code")
+
+		resp = signup("+15555550101", "123456")
+		require.Equal(t, http.StatusOK, resp.Code, resp.Body.Body.String())
+	})
+
+	t.Run("describeServer advertises phone verification", func(t *testing.T) {
+		t.Parallel()
+
+		w := httptest.NewRecorder()
+		srv.handleDescribeServer(w, withHost(httptest.NewRequest(http.MethodGet, "/xrpc/com.atproto.server.describeServer", nil)))
+
+		var out atproto.ServerDescribeServer_Output
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &out))
+		require.NotNil(t, out.PhoneVerificationRequired)
+		require.True(t, *out.PhoneVerificationRequired)
+	})
+
+	t.Run("phone verification must be enabled", func(t *testing.T) {
+		t.Parallel()
+
+		other := testServer(t)
+		other.hosts[testPDSHost].signupVerifier = &verify.Fake{Code: "captcha"}
+		require.False(t, other.hosts[testPDSHost].phoneVerificationRequired())
+
+		body := bytes.NewReader([]byte(`{"phoneNumber":"+15555550102"}`))
+		req := httptest.NewRequest(http.MethodPost, "/xrpc/com.atproto.temp.requestPhoneVerification", body)
+		req = req.WithContext(context.WithValue(req.Context(), hostContextKey{}, other.hosts[testPDSHost]))
+		w := httptest.NewRecorder()
+		other.handleRequestPhoneVerification(w, req)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
@@ -1,9 +1,11 @@
 package pds
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 
 	"github.com/bluesky-social/indigo/api/atproto"
@@ -14,6 +16,7 @@ import (
 	"github.com/ipld/go-car"
 	carutil "github.com/ipld/go-car/util"
 	"github.com/jcalabro/atlas/internal/pds/db"
+	"github.com/jcalabro/atlas/internal/util"
 )
 
 func (s *server) handleGetBlocks(w http.ResponseWriter, r *http.Request) {
@@ -50,6 +53,10 @@ func (s *server) handleGetBlocks(w http.ResponseWriter, r *http.Request) {
 		s.internalErr(w, fmt.Errorf("failed to get actor: %w", err))
 		return
 	}
+	if actor.Takedown != nil {
+		s.repoTakendown(w)
+		return
+	}
 
 	// parse the requested CIDs
 	cids := make([]cid.Cid, 0, len(cidParams))
@@ -69,41 +76,14 @@ func (s *server) handleGetBlocks(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// build the CAR response
-	buf := new(bytes.Buffer)
-
-	// write CAR header
-	hb, err := cbor.DumpObject(&car.CarHeader{
-		Roots:   []cid.Cid{rootCID},
-		Version: 1,
-	})
-	if err != nil {
-		s.internalErr(w, fmt.Errorf("failed to encode car header: %w", err))
-		return
-	}
-
-	if err := carutil.LdWrite(buf, hb); err != nil {
-		s.internalErr(w, fmt.Errorf("failed to write car header: %w", err))
+	// stream blocks to the client as they're read
+	cs := newCarStream(w, rootCID)
+	if err := s.db.StreamBlocks(ctx, actor.Did, cids, cs.writeBlock); err != nil {
+		s.carStreamErr(w, cs, fmt.Errorf("failed to get blocks: %w", err))
 		return
 	}
 
-	// get blocks from the blockstore and write them to the CAR
-	blks, err := s.db.GetBlocks(ctx, actor.Did, cids)
-	if err != nil {
-		s.internalErr(w, fmt.Errorf("failed to get blocks: %w", err))
-		return
-	}
-
-	for _, blk := range blks {
-		if err := carutil.LdWrite(buf, blk.Cid().Bytes(), blk.RawData()); err != nil {
-			s.internalErr(w, fmt.Errorf("failed to write block to car: %w", err))
-			return
-		}
-	}
-
-	w.Header().Set("Content-Type", "application/vnd.ipld.car")
-	w.WriteHeader(http.StatusOK)
-	if _, err := buf.WriteTo(w); err != nil {
+	if err := cs.finish(); err != nil {
 		s.log.Error("failed to write car response", "err", err)
 	}
 }
@@ -134,6 +114,10 @@ func (s *server) handleGetLatestCommit(w http.ResponseWriter, r *http.Request) {
 		s.internalErr(w, fmt.Errorf("failed to get actor: %w", err))
 		return
 	}
+	if actor.Takedown != nil {
+		s.repoTakendown(w)
+		return
+	}
 
 	s.jsonOK(w, &atproto.SyncGetLatestCommit_Output{
 		Cid: actor.Head,
@@ -169,11 +153,16 @@ func (s *server) handleGetRepoStatus(w http.ResponseWriter, r *http.Request) {
 
 	out := &atproto.SyncGetRepoStatus_Output{
 		Did:    actor.Did,
-		Active: actor.Active,
+		Active: actor.Active && actor.Takedown == nil,
 	}
 
-	// only include rev if active
-	if actor.Active {
+	switch {
+	case actor.Takedown != nil:
+		out.Status = util.Ptr("takendown")
+	case !actor.Active:
+		out.Status = util.Ptr("deactivated")
+	default:
+		// only include rev if active
 		out.Rev = &actor.Rev
 	}
 
@@ -216,6 +205,16 @@ func (s *server) handleSyncGetRecord(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	takenDown, err := s.db.IsTakenDown(ctx, &db.Subject{Did: did, Collection: collection, Rkey: rkey})
+	if errors.Is(err, db.ErrNotFound) || takenDown {
+		s.notFound(w, fmt.Errorf("record not found"))
+		return
+	}
+	if err != nil {
+		s.internalErr(w, fmt.Errorf("failed to get takedown status: %w", err))
+		return
+	}
+
 	proof, err := s.db.GetRecordProof(ctx, did, collection, rkey)
 	if errors.Is(err, db.ErrNotFound) {
 		s.notFound(w, fmt.Errorf("record not found"))
@@ -285,6 +284,10 @@ func (s *server) handleGetRepo(w http.ResponseWriter, r *http.Request) {
 		s.internalErr(w, fmt.Errorf("failed to get actor: %w", err))
 		return
 	}
+	if actor.Takedown != nil {
+		s.repoTakendown(w)
+		return
+	}
 
 	rootCID, err := cid.Decode(actor.Head)
 	if err != nil {
@@ -292,43 +295,107 @@ func (s *server) handleGetRepo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	buf := new(bytes.Buffer)
+	cs := newCarStream(w, rootCID)
+
+	if since != "" {
+		// stream only the blocks that changed between the commit at `since` and the head
+		err := s.db.StreamRepoDiff(ctx, actor.Did, rootCID, since, cs.writeBlock)
+		if errors.Is(err, db.ErrUnknownRev) && !cs.started {
+			s.badRequest(w, fmt.Errorf("unknown since revision %q", since))
+			return
+		}
+		if err != nil {
+			s.carStreamErr(w, cs, fmt.Errorf("failed to diff repo: %w", err))
+			return
+		}
+	} else {
+		// stream the full repo to the client as the MST is walked
+		if err := s.db.StreamRepo(ctx, actor.Did, rootCID, cs.writeBlock); err != nil {
+			s.carStreamErr(w, cs, fmt.Errorf("failed to export repo: %w", err))
+			return
+		}
+	}
+
+	if err := cs.finish(); err != nil {
+		s.log.Error("failed to write car response", "err", err)
+	}
+}
+
+// carStream writes a CAR file block by block. The response status and CAR header are written
+// lazily along with the first block, so errors that occur before any data has been sent can still
+// be reported as a normal XRPC error.
+type carStream struct {
+	w       io.Writer
+	bw      *bufio.Writer
+	root    cid.Cid
+	started bool
+
+	// onStart is called before the CAR header is written, if set
+	onStart func()
+}
+
+// newCarStream returns a carStream that writes to an http response
+func newCarStream(w http.ResponseWriter, root cid.Cid) *carStream {
+	return &carStream{
+		w:    w,
+		root: root,
+		onStart: func() {
+			w.Header().Set("Content-Type", "application/vnd.ipld.car")
+			w.WriteHeader(http.StatusOK)
+		},
+	}
+}
+
+// start writes the response headers and CAR header if they haven't been written yet
+func (c *carStream) start() error {
+	if c.started {
+		return nil
+	}
+	c.started = true
 
 	hb, err := cbor.DumpObject(&car.CarHeader{
-		Roots:   []cid.Cid{rootCID},
+		Roots:   []cid.Cid{c.root},
 		Version: 1,
 	})
 	if err != nil {
-		s.internalErr(w, fmt.Errorf("failed to encode car header: %w", err))
-		return
+		return fmt.Errorf("failed to encode car header: %w", err)
 	}
 
-	if err := carutil.LdWrite(buf, hb); err != nil {
-		s.internalErr(w, fmt.Errorf("failed to write car header: %w", err))
-		return
+	if c.onStart != nil {
+		c.onStart()
 	}
 
-	var blks []blocks.Block
-	if since != "" {
-		blks, err = s.db.GetBlocksSince(ctx, actor.Did, since)
-	} else {
-		blks, err = s.db.GetAllBlocks(ctx, actor.Did)
+	c.bw = bufio.NewWriterSize(c.w, 64*1024)
+	if err := carutil.LdWrite(c.bw, hb); err != nil {
+		return fmt.Errorf("failed to write car header: %w", err)
 	}
-	if err != nil {
-		s.internalErr(w, fmt.Errorf("failed to get blocks: %w", err))
-		return
+	return nil
+}
+
+func (c *carStream) writeBlock(blk blocks.Block) error {
+	if err := c.start(); err != nil {
+		return err
 	}
+	if err := carutil.LdWrite(c.bw, blk.Cid().Bytes(), blk.RawData()); err != nil {
+		return fmt.Errorf("failed to write block to car: %w", err)
+	}
+	return nil
+}
 
-	for _, blk := range blks {
-		if err := carutil.LdWrite(buf, blk.Cid().Bytes(), blk.RawData()); err != nil {
-			s.internalErr(w, fmt.Errorf("failed to write block to car: %w", err))
-			return
-		}
+// finish writes the header if no blocks were written and flushes any buffered data
+func (c *carStream) finish() error {
+	if err := c.start(); err != nil {
+		return err
 	}
+	return c.bw.Flush()
+}
 
-	w.Header().Set("Content-Type", "application/vnd.ipld.car")
-	w.WriteHeader(http.StatusOK)
-	if _, err := buf.WriteTo(w); err != nil {
-		s.log.Error("failed to write car response", "err", err)
+// carStreamErr reports an error that occurred while streaming a CAR. If nothing has been sent yet
+// it's returned to the client as usual, otherwise all we can do is log and cut the response short.
+func (s *server) carStreamErr(w http.ResponseWriter, cs *carStream, err error) {
+	if !cs.started {
+		s.internalErr(w, err)
+		return
 	}
+	s.log.Error("car stream failed after response started", "err", err)
 }
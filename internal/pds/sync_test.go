@@ -7,10 +7,14 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"slices"
 	"testing"
 	"time"
 
 	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/repo"
+	"github.com/bluesky-social/indigo/atproto/repo/mst"
+	"github.com/ipfs/go-cid"
 	"github.com/ipld/go-car"
 	carutil "github.com/ipld/go-car/util"
 	"github.com/stretchr/testify/require"
@@ -360,6 +364,56 @@ func TestHandleGetRepo(t *testing.T) {
 		require.Greater(t, len(carCIDs), len(recordCIDs), "should have more blocks than just records")
 	})
 
+	t.Run("success - export is a complete repo in preorder", func(t *testing.T) {
+		t.Parallel()
+
+		actor, _ := setupTestActor(t, srv, "did:plc:getrepo3", "getrepo3@example.com", "getrepo3.dev.atlaspds.dev")
+
+		paths := make(map[string]bool)
+		for i := range 25 {
+			collection := "app.bsky.feed.post"
+			if i%2 == 0 {
+				collection = "app.bsky.feed.like"
+			}
+			rkey := createTestRecordDirect(t, srv, actor, collection, map[string]any{
+				"$type":     collection,
+				"text":      fmt.Sprintf("export post %d", i),
+				"createdAt": time.Now().Format(time.RFC3339),
+			})
+			paths[collection+"/"+rkey] = true
+		}
+
+		actor, err := srv.db.GetActorByDID(ctx, actor.Did)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		url := fmt.Sprintf("/xrpc/com.atproto.sync.getRepo?did=%s", actor.Did)
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req = addTestHostContext(srv, req)
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		// the commit block must come first, immediately followed by the MST root
+		carReader, err := car.NewCarReader(bytes.NewReader(w.Body.Bytes()))
+		require.NoError(t, err)
+		first, err := carReader.Next()
+		require.NoError(t, err)
+		require.Equal(t, actor.Head, first.Cid().String())
+
+		// the CAR must contain every block needed to load the repo
+		commit, r, err := repo.LoadRepoFromCAR(ctx, bytes.NewReader(w.Body.Bytes()))
+		require.NoError(t, err)
+		require.Equal(t, actor.Rev, commit.Rev)
+
+		found := make(map[string]bool)
+		err = r.MST.Walk(func(key []byte, val cid.Cid) error {
+			found[string(key)] = true
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, paths, found)
+	})
+
 	t.Run("error - missing did parameter", func(t *testing.T) {
 		t.Parallel()
 
@@ -528,6 +582,126 @@ func TestHandleGetRepo(t *testing.T) {
 		}
 		require.Equal(t, 0, blockCount, "should have no blocks when since equals current rev")
 	})
+
+	t.Run("success - since diff applied to the old repo yields the new repo", func(t *testing.T) {
+		t.Parallel()
+
+		actor, _ := setupTestActor(t, srv, "did:plc:getreposince3", "getreposince3@example.com", "getreposince3.dev.atlaspds.dev")
+
+		getCAR := func(since string) *bytes.Reader {
+			url := fmt.Sprintf("/xrpc/com.atproto.sync.getRepo?did=%s", actor.Did)
+			if since != "" {
+				url += "&since=" + since
+			}
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, url, nil)
+			req = addTestHostContext(srv, req)
+			router.ServeHTTP(w, req)
+			require.Equal(t, http.StatusOK, w.Code)
+			return bytes.NewReader(w.Body.Bytes())
+		}
+
+		const collection = "app.bsky.feed.post"
+		record := func(i int) map[string]any {
+			return map[string]any{
+				"$type":     collection,
+				"text":      fmt.Sprintf("diff post %d", i),
+				"createdAt": time.Now().Format(time.RFC3339),
+			}
+		}
+
+		var rkeys []string
+		for i := range 30 {
+			rkeys = append(rkeys, createTestRecordDirect(t, srv, actor, collection, record(i)))
+		}
+
+		actor, err := srv.db.GetActorByDID(ctx, actor.Did)
+		require.NoError(t, err)
+		sinceRev := actor.Rev
+
+		// the consumer's copy of the repo as of sinceRev
+		store := repo.NewTinyBlockstore()
+		carReader, err := car.NewCarReader(getCAR(""))
+		require.NoError(t, err)
+		for {
+			blk, err := carReader.Next()
+			if err != nil {
+				break
+			}
+			require.NoError(t, store.Put(ctx, blk))
+		}
+
+		// add, update, and delete records
+		for i := range 5 {
+			rkeys = append(rkeys, createTestRecordDirect(t, srv, actor, collection, record(100+i)))
+		}
+		putTestRecordDirect(t, srv, actor, collection, rkeys[3], record(200))
+		deleteTestRecordDirect(t, srv, actor, collection, rkeys[7])
+		rkeys = slices.Delete(rkeys, 7, 8)
+
+		actor, err = srv.db.GetActorByDID(ctx, actor.Did)
+		require.NoError(t, err)
+
+		// apply the diff and load the new head from the combined blocks
+		carReader, err = car.NewCarReader(getCAR(sinceRev))
+		require.NoError(t, err)
+		require.Equal(t, actor.Head, carReader.Header.Roots[0].String())
+
+		var numDiffBlocks int
+		for {
+			blk, err := carReader.Next()
+			if err != nil {
+				break
+			}
+			require.NoError(t, store.Put(ctx, blk))
+			numDiffBlocks++
+		}
+
+		allBlocks, err := srv.db.GetAllBlocks(ctx, actor.Did)
+		require.NoError(t, err)
+		require.Less(t, numDiffBlocks, len(allBlocks)/2, "diff should be much smaller than the repo")
+
+		headCID, err := cid.Decode(actor.Head)
+		require.NoError(t, err)
+		headBlk, err := store.Get(ctx, headCID)
+		require.NoError(t, err)
+
+		var commit repo.Commit
+		require.NoError(t, commit.UnmarshalCBOR(bytes.NewReader(headBlk.RawData())))
+
+		tree, err := mst.LoadTreeFromStore(ctx, store, commit.Data)
+		require.NoError(t, err)
+
+		var got []string
+		require.NoError(t, tree.Walk(func(key []byte, val cid.Cid) error {
+			// every record in the new tree must be available to the consumer
+			_, err := store.Get(ctx, val)
+			require.NoError(t, err, "missing record %s", key)
+			got = append(got, string(key))
+			return nil
+		}))
+
+		var want []string
+		for _, rkey := range rkeys {
+			want = append(want, collection+"/"+rkey)
+		}
+		require.ElementsMatch(t, want, got)
+	})
+
+	t.Run("error - unknown since revision", func(t *testing.T) {
+		t.Parallel()
+
+		actor, _ := setupTestActor(t, srv, "did:plc:getreposince4", "getreposince4@example.com", "getreposince4.dev.atlaspds.dev")
+
+		w := httptest.NewRecorder()
+		url := fmt.Sprintf("/xrpc/com.atproto.sync.getRepo?did=%s&since=%s", actor.Did, "2222222222222")
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req = addTestHostContext(srv, req)
+		router.ServeHTTP(w, req)
+
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		require.Contains(t, w.Body.String(), "unknown since revision")
+	})
 }
 
 func TestHandleGetBlocks(t *testing.T) {
@@ -0,0 +1,360 @@
+package pds
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/ipfs/go-cid"
+	"github.com/jcalabro/atlas/internal/at"
+	"github.com/jcalabro/atlas/internal/pds/db"
+	"github.com/jcalabro/atlas/internal/types"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// repoTakendown responds to sync requests for a repo that an admin has taken down
+func (s *server) repoTakendown(w http.ResponseWriter) {
+	s.xrpcErr(w, http.StatusBadRequest, "RepoTakendown", fmt.Errorf("repo has been taken down"))
+}
+
+// accountTakedown responds to requests authenticated as an account that an admin has taken down
+func (s *server) accountTakedown(w http.ResponseWriter) {
+	s.xrpcErr(w, http.StatusUnauthorized, "AccountTakedown", fmt.Errorf("account has been taken down"))
+}
+
+// quarantineKey returns the S3 object key that a taken down blob's contents are moved to
+func quarantineKey(did string, c cid.Cid) string {
+	return "quarantine/" + blobKey(did, c)
+}
+
+// moveBlob moves an object within the blobstore. Objects that were already moved are skipped so
+// that failed takedowns and reversals can be retried.
+func (s *server) moveBlob(ctx context.Context, from, to string) error {
+	if s.blobstore == nil {
+		return nil
+	}
+
+	_, err := s.blobstore.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.blobstore.bucket),
+		Key:    aws.String(from),
+	})
+	var notFound *s3types.NotFound
+	if errors.As(err, &notFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get blob object: %w", err)
+	}
+
+	source := &url.URL{Path: s.blobstore.bucket + "/" + from}
+	_, err = s.blobstore.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(s.blobstore.bucket),
+		CopySource: aws.String(source.EscapedPath()),
+		Key:        aws.String(to),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to copy blob object: %w", err)
+	}
+
+	_, err = s.blobstore.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.blobstore.bucket),
+		Key:    aws.String(from),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete blob object: %w", err)
+	}
+
+	return nil
+}
+
+// takedownSubject resolves the subject of a takedown to the account that owns it, which must
+// belong to the host. A uri identifies a record, a blob cid plus did identifies a blob, and a did
+// alone identifies an account. Returns the HTTP status code to respond with on error.
+func (s *server) takedownSubject(
+	ctx context.Context,
+	host *loadedHostConfig,
+	did, uri, blob string,
+) (*db.Subject, *types.Actor, int, error) {
+	subject := &db.Subject{Did: did}
+
+	switch {
+	case uri != "":
+		aturi, err := at.ParseURI(uri)
+		if err != nil {
+			return nil, nil, http.StatusBadRequest, fmt.Errorf("invalid uri: %w", err)
+		}
+		if _, err := syntax.ParseNSID(aturi.Collection); err != nil {
+			return nil, nil, http.StatusBadRequest, fmt.Errorf("invalid uri collection: %w", err)
+		}
+		if _, err := syntax.ParseRecordKey(aturi.Rkey); err != nil {
+			return nil, nil, http.StatusBadRequest, fmt.Errorf("invalid uri rkey: %w", err)
+		}
+
+		subject = &db.Subject{Did: aturi.Repo, Collection: aturi.Collection, Rkey: aturi.Rkey}
+	case blob != "":
+		c, err := cid.Decode(blob)
+		if err != nil {
+			return nil, nil, http.StatusBadRequest, fmt.Errorf("invalid blob cid: %w", err)
+		}
+
+		subject.Cid = c.Bytes()
+	}
+
+	// subjects must name the repo by DID, since handles can change out from under a takedown
+	if _, err := syntax.ParseDID(subject.Did); err != nil {
+		return nil, nil, http.StatusBadRequest, fmt.Errorf("invalid did: %w", err)
+	}
+
+	actor, code, err := s.adminAccount(ctx, host, subject.Did)
+	if err != nil {
+		return nil, nil, code, err
+	}
+
+	return subject, actor, http.StatusOK, nil
+}
+
+// handleUpdateSubjectStatus takes down or restores an account, record, or blob
+func (s *server) handleUpdateSubjectStatus(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	span := spanFromContext(ctx)
+	defer span.End()
+
+	host := hostFromContext(ctx)
+
+	var in atproto.AdminUpdateSubjectStatus_Input
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		s.badRequest(w, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+
+	switch {
+	case in.Subject == nil:
+		s.badRequest(w, fmt.Errorf("subject is required"))
+		return
+	case in.Deactivated != nil:
+		s.badRequest(w, fmt.Errorf("deactivating subjects is not supported"))
+		return
+	case in.Takedown == nil:
+		s.badRequest(w, fmt.Errorf("takedown is required"))
+		return
+	}
+
+	var did, uri, blob string
+	switch {
+	case in.Subject.AdminDefs_RepoRef != nil:
+		did = in.Subject.AdminDefs_RepoRef.Did
+	case in.Subject.RepoStrongRef != nil:
+		uri = in.Subject.RepoStrongRef.Uri
+	case in.Subject.AdminDefs_RepoBlobRef != nil:
+		did = in.Subject.AdminDefs_RepoBlobRef.Did
+		blob = in.Subject.AdminDefs_RepoBlobRef.Cid
+		if blob == "" {
+			s.badRequest(w, fmt.Errorf("blob cid is required"))
+			return
+		}
+	default:
+		s.badRequest(w, fmt.Errorf("unsupported subject type"))
+		return
+	}
+
+	subject, actor, code, err := s.takedownSubject(ctx, host, did, uri, blob)
+	if err != nil {
+		s.err(w, code, err)
+		return
+	}
+
+	span.SetAttributes(
+		attribute.String("did", subject.Did),
+		attribute.String("uri", uri),
+		attribute.String("blob", blob),
+		attribute.Bool("applied", in.Takedown.Applied),
+	)
+
+	var takedown *types.Takedown
+	if in.Takedown.Applied {
+		takedown = &types.Takedown{CreatedAt: timestamppb.Now()}
+		if in.Takedown.Ref != nil {
+			takedown.Ref = *in.Takedown.Ref
+		}
+	}
+
+	// blobs stop being served as soon as the takedown is stored, and are only served again once
+	// their contents are back in place
+	var blobCID cid.Cid
+	if len(subject.Cid) > 0 {
+		blobCID, err = cid.Cast(subject.Cid)
+		if err != nil {
+			s.internalErr(w, fmt.Errorf("invalid blob cid: %w", err))
+			return
+		}
+
+		if takedown == nil {
+			if err := s.moveBlob(ctx, quarantineKey(subject.Did, blobCID), blobKey(subject.Did, blobCID)); err != nil {
+				s.internalErr(w, fmt.Errorf("failed to restore blob: %w", err))
+				return
+			}
+		}
+	}
+
+	previous, err := s.db.GetTakedown(ctx, subject)
+	if err != nil {
+		s.internalErr(w, fmt.Errorf("failed to get takedown: %w", err))
+		return
+	}
+
+	err = s.db.SetTakedown(ctx, subject, takedown)
+	if errors.Is(err, db.ErrNotFound) {
+		s.notFound(w, fmt.Errorf("subject not found"))
+		return
+	}
+	if err != nil {
+		s.internalErr(w, fmt.Errorf("failed to update takedown: %w", err))
+		return
+	}
+
+	if len(subject.Cid) > 0 && takedown != nil {
+		if err := s.moveBlob(ctx, blobKey(subject.Did, blobCID), quarantineKey(subject.Did, blobCID)); err != nil {
+			s.internalErr(w, fmt.Errorf("failed to quarantine blob: %w", err))
+			return
+		}
+	}
+
+	if uri == "" && blob == "" && (actor.Takedown != nil) != (takedown != nil) {
+		s.writeTakedownEvent(ctx, host, actor, takedown != nil)
+	}
+
+	// records are identified by their uri and blobs by their cid, which are both globally unique
+	auditSubject := subject.Did
+	switch {
+	case uri != "":
+		auditSubject = at.FormatURI(subject.Did, subject.Collection, subject.Rkey)
+	case blob != "":
+		auditSubject = blob
+	}
+	s.audit(ctx, host, "com.atproto.admin.updateSubjectStatus", auditSubject, takedownStatus(previous), takedownStatus(takedown))
+
+	s.log.Info("admin updated subject status", "did", subject.Did, "uri", uri, "blob", blob, "takedown", in.Takedown.Applied)
+
+	s.jsonOK(w, &atproto.AdminUpdateSubjectStatus_Output{
+		Subject: &atproto.AdminUpdateSubjectStatus_Output_Subject{
+			AdminDefs_RepoRef:     in.Subject.AdminDefs_RepoRef,
+			RepoStrongRef:         in.Subject.RepoStrongRef,
+			AdminDefs_RepoBlobRef: in.Subject.AdminDefs_RepoBlobRef,
+		},
+		Takedown: in.Takedown,
+	})
+}
+
+// writeTakedownEvent tells the firehose that an account was taken down or restored
+func (s *server) writeTakedownEvent(ctx context.Context, host *loadedHostConfig, actor *types.Actor, takenDown bool) {
+	accountEvent := &types.RepoEvent{
+		PdsHost:   host.hostname,
+		Repo:      actor.Did,
+		Time:      timestamppb.Now(),
+		EventType: types.EventType_EVENT_TYPE_ACCOUNT,
+		Active:    actor.Active && !takenDown,
+		Status:    "active",
+	}
+
+	switch {
+	case takenDown:
+		accountEvent.Status = "takendown"
+	case !actor.Active:
+		accountEvent.Status = "deactivated"
+	}
+
+	if err := s.db.WriteIdentityEvent(ctx, accountEvent); err != nil {
+		s.log.Error("failed to write account event", "err", err, "did", actor.Did)
+	}
+}
+
+// handleGetSubjectStatus reports whether an account, record, or blob is taken down
+func (s *server) handleGetSubjectStatus(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	span := spanFromContext(ctx)
+	defer span.End()
+
+	host := hostFromContext(ctx)
+
+	did := r.URL.Query().Get("did")
+	uri := r.URL.Query().Get("uri")
+	blob := r.URL.Query().Get("blob")
+	span.SetAttributes(
+		attribute.String("did", did),
+		attribute.String("uri", uri),
+		attribute.String("blob", blob),
+	)
+
+	if uri != "" && (did != "" || blob != "") {
+		s.badRequest(w, fmt.Errorf("uri can't be combined with did or blob"))
+		return
+	}
+
+	subject, actor, code, err := s.takedownSubject(ctx, host, did, uri, blob)
+	if err != nil {
+		s.err(w, code, err)
+		return
+	}
+
+	out := &atproto.AdminGetSubjectStatus_Output{
+		Subject: &atproto.AdminGetSubjectStatus_Output_Subject{},
+	}
+
+	switch {
+	case uri != "":
+		record, err := s.db.GetRecord(ctx, at.FormatURI(subject.Did, subject.Collection, subject.Rkey))
+		if errors.Is(err, db.ErrNotFound) {
+			s.notFound(w, fmt.Errorf("record not found"))
+			return
+		}
+		if err != nil {
+			s.internalErr(w, fmt.Errorf("failed to get record: %w", err))
+			return
+		}
+
+		out.Subject.RepoStrongRef = &atproto.RepoStrongRef{Uri: record.URI().String(), Cid: record.Cid}
+	case blob != "":
+		_, err := s.db.GetBlob(ctx, subject.Did, subject.Cid)
+		if errors.Is(err, db.ErrNotFound) {
+			s.notFound(w, fmt.Errorf("blob not found"))
+			return
+		}
+		if err != nil {
+			s.internalErr(w, fmt.Errorf("failed to get blob: %w", err))
+			return
+		}
+
+		out.Subject.AdminDefs_RepoBlobRef = &atproto.AdminDefs_RepoBlobRef{Did: actor.Did, Cid: blob}
+	default:
+		out.Subject.AdminDefs_RepoRef = &atproto.AdminDefs_RepoRef{Did: actor.Did}
+	}
+
+	takedown, err := s.db.GetTakedown(ctx, subject)
+	if err != nil {
+		s.internalErr(w, fmt.Errorf("failed to get takedown: %w", err))
+		return
+	}
+
+	out.Takedown = takedownStatus(takedown)
+
+	s.jsonOK(w, out)
+}
+
+// takedownStatus converts a stored takedown, which is nil if the subject isn't taken down, to its
+// lexicon representation
+func takedownStatus(takedown *types.Takedown) *atproto.AdminDefs_StatusAttr {
+	status := &atproto.AdminDefs_StatusAttr{Applied: takedown != nil}
+	if takedown != nil && takedown.Ref != "" {
+		status.Ref = &takedown.Ref
+	}
+	return status
+}
@@ -0,0 +1,312 @@
+package pds
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/jcalabro/atlas/internal/at"
+	"github.com/jcalabro/atlas/internal/types"
+	"github.com/jcalabro/atlas/internal/util"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestSubjectStatus(t *testing.T) {
+	t.Parallel()
+
+	srv := testServer(t)
+	router := srv.router()
+
+	updateStatus := func(t *testing.T, subject *atproto.AdminUpdateSubjectStatus_Input_Subject, applied bool) *httptest.ResponseRecorder {
+		t.Helper()
+
+		in := &atproto.AdminUpdateSubjectStatus_Input{
+			Subject:  subject,
+			Takedown: &atproto.AdminDefs_StatusAttr{Applied: applied, Ref: util.Ptr("ticket-123")},
+		}
+		body, err := json.Marshal(in)
+		require.NoError(t, err)
+
+		req := addTestHostContext(srv, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+		w := httptest.NewRecorder()
+		srv.handleUpdateSubjectStatus(w, req)
+		return w
+	}
+
+	getStatus := func(t *testing.T, query url.Values) (*httptest.ResponseRecorder, *atproto.AdminGetSubjectStatus_Output) {
+		t.Helper()
+
+		req := addTestHostContext(srv, httptest.NewRequest(http.MethodGet, "/?"+query.Encode(), nil))
+		w := httptest.NewRecorder()
+		srv.handleGetSubjectStatus(w, req)
+
+		var out atproto.AdminGetSubjectStatus_Output
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &out))
+		}
+		return w, &out
+	}
+
+	get := func(t *testing.T, path string) *httptest.ResponseRecorder {
+		t.Helper()
+
+		req := addTestHostContext(srv, httptest.NewRequest(http.MethodGet, path, nil))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	xrpcError := func(t *testing.T, w *httptest.ResponseRecorder) string {
+		t.Helper()
+
+		var out struct {
+			Error string `json:"error"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &out))
+		return out.Error
+	}
+
+	t.Run("takes down and restores an account", func(t *testing.T) {
+		t.Parallel()
+
+		password := "secure-password-123"
+		handle := uniqueHandle()
+		resp := createAccount(t, srv, &atproto.ServerCreateAccount_Input{
+			Email:    uniqueEmail(),
+			Handle:   handle,
+			Password: &password,
+		})
+		require.Equal(t, http.StatusOK, resp.Code, resp.Body.Body.String())
+		did := resp.Out.Did
+
+		subject := &atproto.AdminUpdateSubjectStatus_Input_Subject{AdminDefs_RepoRef: &atproto.AdminDefs_RepoRef{Did: did}}
+		w := updateStatus(t, subject, true)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		w, status := getStatus(t, url.Values{"did": {did}})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.Equal(t, did, status.Subject.AdminDefs_RepoRef.Did)
+		require.True(t, status.Takedown.Applied)
+		require.Equal(t, "ticket-123", *status.Takedown.Ref)
+
+		w = get(t, "/xrpc/com.atproto.sync.getRepo?did="+did)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		require.Equal(t, "RepoTakendown", xrpcError(t, w))
+
+		w = get(t, "/xrpc/com.atproto.sync.getLatestCommit?did="+did)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+
+		w = get(t, "/xrpc/com.atproto.sync.getRepoStatus?did="+did)
+		require.Equal(t, http.StatusOK, w.Code)
+		var repoStatus atproto.SyncGetRepoStatus_Output
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &repoStatus))
+		require.False(t, repoStatus.Active)
+		require.Equal(t, "takendown", *repoStatus.Status)
+
+		w = get(t, "/xrpc/com.atproto.repo.listRecords?collection=app.bsky.feed.post&repo="+did)
+		require.Equal(t, http.StatusNotFound, w.Code)
+
+		// taken down accounts can't log in, even with the right password
+		body, err := json.Marshal(&atproto.ServerCreateSession_Input{Identifier: handle, Password: password})
+		require.NoError(t, err)
+		req := addTestHostContext(srv, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+		w = httptest.NewRecorder()
+		srv.handleCreateSession(w, req)
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+		require.Equal(t, "AccountTakedown", xrpcError(t, w))
+
+		// nor use the sessions they already had
+		req = addTestHostContext(srv, httptest.NewRequest(http.MethodGet, "/xrpc/com.atproto.server.getSession", nil))
+		req.Header.Set("Authorization", "Bearer "+resp.Out.AccessJwt)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+		require.Equal(t, "AccountTakedown", xrpcError(t, w))
+
+		w = updateStatus(t, subject, false)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		w, status = getStatus(t, url.Values{"did": {did}})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.False(t, status.Takedown.Applied)
+
+		w = get(t, "/xrpc/com.atproto.sync.getLatestCommit?did="+did)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		req = addTestHostContext(srv, httptest.NewRequest(http.MethodGet, "/xrpc/com.atproto.server.getSession", nil))
+		req.Header.Set("Authorization", "Bearer "+resp.Out.AccessJwt)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	})
+
+	t.Run("takes down and restores a record", func(t *testing.T) {
+		t.Parallel()
+
+		actor, _ := setupTestActor(t, srv, "did:plc:takedownrecord", "takedownrecord@example.com", "takedownrecord.dev.atlaspds.dev")
+
+		var uris []string
+		for ndx := range 3 {
+			record := &types.Record{
+				Did:        actor.Did,
+				Collection: "app.bsky.feed.post",
+				Rkey:       fmt.Sprintf("3jui7kd2xs2%db", ndx),
+				Cid:        fmt.Sprintf("cid%d", ndx),
+				Value:      []byte{0xa0}, // empty cbor map
+				CreatedAt:  timestamppb.New(time.Now()),
+			}
+			require.NoError(t, srv.db.SaveRecord(t.Context(), record))
+			uris = append(uris, record.URI().String())
+		}
+
+		subject := &atproto.AdminUpdateSubjectStatus_Input_Subject{RepoStrongRef: &atproto.RepoStrongRef{Uri: uris[1], Cid: "cid1"}}
+		w := updateStatus(t, subject, true)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		w, status := getStatus(t, url.Values{"uri": {uris[1]}})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.Equal(t, "cid1", status.Subject.RepoStrongRef.Cid)
+		require.True(t, status.Takedown.Applied)
+
+		aturi, err := at.ParseURI(uris[1])
+		require.NoError(t, err)
+		w = get(t, fmt.Sprintf("/xrpc/com.atproto.repo.getRecord?repo=%s&collection=%s&rkey=%s", aturi.Repo, aturi.Collection, aturi.Rkey))
+		require.Equal(t, http.StatusNotFound, w.Code)
+
+		w = get(t, fmt.Sprintf("/xrpc/com.atproto.sync.getRecord?did=%s&collection=%s&rkey=%s", aturi.Repo, aturi.Collection, aturi.Rkey))
+		require.Equal(t, http.StatusNotFound, w.Code)
+
+		w = get(t, "/xrpc/com.atproto.repo.listRecords?collection=app.bsky.feed.post&repo="+actor.Did)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var list struct {
+			Records []struct {
+				Uri string `json:"uri"`
+			} `json:"records"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+		require.Len(t, list.Records, 2)
+		for _, rec := range list.Records {
+			require.NotEqual(t, uris[1], rec.Uri)
+		}
+
+		// the rest of the account is unaffected
+		w = get(t, "/xrpc/com.atproto.sync.getLatestCommit?did="+actor.Did)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		w = updateStatus(t, subject, false)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		w = get(t, fmt.Sprintf("/xrpc/com.atproto.repo.getRecord?repo=%s&collection=%s&rkey=%s", aturi.Repo, aturi.Collection, aturi.Rkey))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	})
+
+	t.Run("rejects invalid subjects", func(t *testing.T) {
+		t.Parallel()
+
+		w := updateStatus(t, &atproto.AdminUpdateSubjectStatus_Input_Subject{}, true)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+
+		w = updateStatus(t, &atproto.AdminUpdateSubjectStatus_Input_Subject{
+			AdminDefs_RepoRef: &atproto.AdminDefs_RepoRef{Did: "did:plc:nonexistenttakedown"},
+		}, true)
+		require.Equal(t, http.StatusNotFound, w.Code)
+
+		w = updateStatus(t, &atproto.AdminUpdateSubjectStatus_Input_Subject{
+			RepoStrongRef: &atproto.RepoStrongRef{Uri: "at://not-a-did/app.bsky.feed.post/abc"},
+		}, true)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+
+		actor, _ := setupTestActor(t, srv, "did:plc:takedownmissing", "takedownmissing@example.com", "takedownmissing.dev.atlaspds.dev")
+		w = updateStatus(t, &atproto.AdminUpdateSubjectStatus_Input_Subject{
+			RepoStrongRef: &atproto.RepoStrongRef{Uri: at.FormatURI(actor.Did, "app.bsky.feed.post", "missing")},
+		}, true)
+		require.Equal(t, http.StatusNotFound, w.Code)
+
+		w, _ = getStatus(t, url.Values{"uri": {at.FormatURI(actor.Did, "app.bsky.feed.post", "missing")}, "did": {actor.Did}})
+		require.Equal(t, http.StatusBadRequest, w.Code)
+
+		w, _ = getStatus(t, url.Values{"blob": {"bafkreibme22gw2h7y2h7tg2fhqotaqjucnbc24deqo72b6mkl2egezxhvy"}})
+		require.Equal(t, http.StatusBadRequest, w.Code)
+
+		body, err := json.Marshal(&atproto.AdminUpdateSubjectStatus_Input{
+			Subject:     &atproto.AdminUpdateSubjectStatus_Input_Subject{AdminDefs_RepoRef: &atproto.AdminDefs_RepoRef{Did: actor.Did}},
+			Deactivated: &atproto.AdminDefs_StatusAttr{Applied: true},
+			Takedown:    &atproto.AdminDefs_StatusAttr{Applied: true},
+		})
+		require.NoError(t, err)
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+		req = req.WithContext(context.WithValue(req.Context(), hostContextKey{}, srv.hosts[testPDSHost]))
+		w = httptest.NewRecorder()
+		srv.handleUpdateSubjectStatus(w, req)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestBlobTakedown(t *testing.T) {
+	t.Parallel()
+
+	srv := testServerWithBlobstore(t)
+	router := srv.router()
+	ctx := t.Context()
+
+	actor, session := setupTestActor(t, srv, "did:plc:takedownblob", "takedownblob@example.com", "takedownblob.dev.atlaspds.dev")
+
+	blobContent := []byte("blob that will be taken down")
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/xrpc/com.atproto.repo.uploadBlob", bytes.NewReader(blobContent))
+	req.Header.Set("Content-Type", "text/plain")
+	req = addAuthContext(t, ctx, srv, req, actor, session.AccessToken)
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var uploaded atproto.RepoUploadBlob_Output
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &uploaded))
+	blobCID := uploaded.Blob.Ref.String()
+
+	getBlob := func(t *testing.T) *httptest.ResponseRecorder {
+		t.Helper()
+
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/xrpc/com.atproto.sync.getBlob?did=%s&cid=%s", actor.Did, blobCID), nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, addTestHostContext(srv, req))
+		return w
+	}
+
+	updateStatus := func(t *testing.T, applied bool) {
+		t.Helper()
+
+		body, err := json.Marshal(&atproto.AdminUpdateSubjectStatus_Input{
+			Subject: &atproto.AdminUpdateSubjectStatus_Input_Subject{
+				AdminDefs_RepoBlobRef: &atproto.AdminDefs_RepoBlobRef{Did: actor.Did, Cid: blobCID},
+			},
+			Takedown: &atproto.AdminDefs_StatusAttr{Applied: applied},
+		})
+		require.NoError(t, err)
+
+		req := addTestHostContext(srv, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+		w := httptest.NewRecorder()
+		srv.handleUpdateSubjectStatus(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+
+	require.Equal(t, http.StatusOK, getBlob(t).Code)
+
+	updateStatus(t, true)
+	require.Equal(t, http.StatusNotFound, getBlob(t).Code)
+
+	// applying the takedown again is harmless
+	updateStatus(t, true)
+
+	updateStatus(t, false)
+	w = getBlob(t)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Equal(t, blobContent, w.Body.Bytes())
+}
@@ -0,0 +1,701 @@
+package pds
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jcalabro/atlas/internal/envelope"
+	"github.com/jcalabro/atlas/internal/pds/db"
+	"github.com/jcalabro/atlas/internal/types"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// certRenewBefore is how long before expiry certificates are renewed
+	certRenewBefore = 30 * 24 * time.Hour
+
+	// wildcardCheckInterval is how often wildcard certificates are checked for renewal, and how
+	// often other replicas pick up the renewed certificates
+	wildcardCheckInterval = time.Hour
+
+	// certLockTTL bounds how long a replica can hold a certificate's issuance lock
+	certLockTTL = 10 * time.Minute
+
+	// wildcardAccountKeyName is the TLS cache entry of the ACME account key used for DNS-01 orders
+	wildcardAccountKeyName = "acme_dns01_account+key"
+
+	defaultDNSPropagationSeconds = 60
+)
+
+// TLSConfig makes the PDS serve HTTPS on its listen address, rather than relying on a proxy to
+// terminate TLS. Certificates come from each host's cert files, or from ACME. Changes to this
+// section take effect on restart rather than on reload.
+type TLSConfig struct {
+	// HTTPAddr serves ACME HTTP-01 challenges and redirects everything else to HTTPS. No plain
+	// HTTP listener is started if empty.
+	HTTPAddr string `toml:"http_addr"`
+
+	// KEKFile is the path to a base64-encoded 32 byte key-encryption key that encrypts the
+	// certificate private keys stored in FDB. KEKEnv names an environment variable holding the key
+	// instead. Keys are stored unencrypted if neither is set.
+	KEKFile string `toml:"kek_file"`
+	KEKEnv  string `toml:"kek_env"`
+
+	// ACME gets certificates for hosts without cert files. Hosts without cert files can't be
+	// served if this is unset.
+	ACME *ACMEConfig `toml:"acme"`
+}
+
+// ACMEConfig configures the ACME certificate authority. Hostnames are validated with the
+// TLS-ALPN-01 or HTTP-01 challenges, and user domains get wildcard certificates through DNS-01.
+type ACMEConfig struct {
+	// Email is given to the certificate authority for expiry notices, and may be empty
+	Email string `toml:"email"`
+
+	// DirectoryURL is the certificate authority's directory. Defaults to Let's Encrypt.
+	DirectoryURL string `toml:"directory_url"`
+
+	// DNS01 enables wildcard certificates for user domains. Handle subdomains can't be served
+	// over HTTPS if this is unset.
+	DNS01 *DNS01Config `toml:"dns01"`
+}
+
+// DNS01Config configures the DNS provider that publishes DNS-01 challenge records
+type DNS01Config struct {
+	// Provider is the name of a registered DNS provider, such as "exec"
+	Provider string `toml:"provider"`
+
+	// Command is the program and leading arguments run by the exec provider
+	Command []string `toml:"command"`
+
+	// PropagationSeconds is how long to wait for challenge records to be visible to the
+	// certificate authority. Defaults to 60.
+	PropagationSeconds int `toml:"propagation_seconds"`
+}
+
+// HostTLSConfig sets a host's certificate. The certificate must also cover the host's user domains,
+// such as with a wildcard, since it's served for handle subdomains too.
+type HostTLSConfig struct {
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+}
+
+// tlsConfig is the loaded TLS config
+type tlsConfig struct {
+	httpAddr string
+
+	// keyring encrypts stored certificate keys, or is nil if they're stored unencrypted
+	keyring *envelope.Keyring
+
+	// acme is nil unless certificates are issued with ACME
+	acme *acmeConfig
+}
+
+type acmeConfig struct {
+	email        string
+	directoryURL string
+
+	// dns is nil unless wildcard certificates are issued for user domains
+	dns            DNSProvider
+	dnsPropagation time.Duration
+}
+
+func loadTLSConfig(cfg *TLSConfig) (*tlsConfig, error) {
+	loaded := &tlsConfig{httpAddr: cfg.HTTPAddr}
+
+	if cfg.KEKFile != "" && cfg.KEKEnv != "" {
+		return nil, fmt.Errorf("only one of kek_file and kek_env may be set")
+	}
+	if cfg.KEKFile != "" || cfg.KEKEnv != "" {
+		kms, err := envelope.LoadLocalKMS(cfg.KEKFile, cfg.KEKEnv)
+		if err != nil {
+			return nil, err
+		}
+		loaded.keyring = envelope.NewKeyring(kms)
+	}
+
+	if cfg.ACME == nil {
+		return loaded, nil
+	}
+
+	loaded.acme = &acmeConfig{
+		email:        cfg.ACME.Email,
+		directoryURL: cfg.ACME.DirectoryURL,
+	}
+	if loaded.acme.directoryURL == "" {
+		loaded.acme.directoryURL = acme.LetsEncryptURL
+	}
+
+	if dns := cfg.ACME.DNS01; dns != nil {
+		var err error
+		loaded.acme.dns, err = loadDNSProvider(dns)
+		if err != nil {
+			return nil, fmt.Errorf("invalid acme.dns01 config: %w", err)
+		}
+
+		seconds := dns.PropagationSeconds
+		if seconds < 0 {
+			return nil, fmt.Errorf("acme.dns01.propagation_seconds must not be negative")
+		}
+		if seconds == 0 {
+			seconds = defaultDNSPropagationSeconds
+		}
+		loaded.acme.dnsPropagation = time.Duration(seconds) * time.Second
+	}
+
+	return loaded, nil
+}
+
+func loadHostCertificate(cfg *HostTLSConfig) (*tls.Certificate, error) {
+	if cfg.CertFile == "" && cfg.KeyFile == "" {
+		return nil, nil
+	}
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, fmt.Errorf("cert_file and key_file must be set together")
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+
+	return &cert, nil
+}
+
+// certCache stores certificates and ACME state in FDB so that every replica shares them. It's
+// used both as autocert's cache and for wildcard certificates.
+type certCache struct {
+	db *db.DB
+
+	// keyring seals entries, or is nil if they're stored unencrypted
+	keyring *envelope.Keyring
+}
+
+var _ autocert.Cache = (*certCache)(nil)
+
+func (c *certCache) Get(ctx context.Context, name string) ([]byte, error) {
+	entry, err := c.db.GetTLSCacheEntry(ctx, name)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, autocert.ErrCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return c.open(ctx, name, entry)
+}
+
+func (c *certCache) Put(ctx context.Context, name string, data []byte) error {
+	entry, err := c.seal(ctx, data)
+	if err != nil {
+		return err
+	}
+
+	return c.db.PutTLSCacheEntry(ctx, name, entry)
+}
+
+// PutIfAbsent stores data unless the entry already exists, and returns whichever data is stored
+func (c *certCache) PutIfAbsent(ctx context.Context, name string, data []byte) ([]byte, error) {
+	entry, err := c.seal(ctx, data)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := c.db.CreateTLSCacheEntry(ctx, name, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.open(ctx, name, stored)
+}
+
+func (c *certCache) seal(ctx context.Context, data []byte) (*types.TLSCacheEntry, error) {
+	entry := &types.TLSCacheEntry{UpdatedAt: timestamppb.Now()}
+	if c.keyring == nil {
+		entry.Data = data
+		return entry, nil
+	}
+
+	sealed, err := c.keyring.Seal(ctx, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to seal tls cache entry: %w", err)
+	}
+	entry.Sealed = sealed
+	return entry, nil
+}
+
+func (c *certCache) open(ctx context.Context, name string, entry *types.TLSCacheEntry) ([]byte, error) {
+	if entry.Sealed == nil {
+		return entry.Data, nil
+	}
+	if c.keyring == nil {
+		return nil, fmt.Errorf("tls cache entry %q is encrypted, but no key-encryption key is configured", name)
+	}
+
+	return c.keyring.Open(ctx, entry.Sealed)
+}
+
+func (c *certCache) Delete(ctx context.Context, name string) error {
+	return c.db.DeleteTLSCacheEntry(ctx, name)
+}
+
+// encodeCertificate encodes a private key and certificate chain as PEM, in the same format as
+// autocert's cache entries
+func encodeCertificate(key *ecdsa.PrivateKey, chain [][]byte) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal certificate key: %w", err)
+	}
+
+	buf := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	for _, cert := range chain {
+		buf = append(buf, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})...)
+	}
+
+	return buf, nil
+}
+
+// parseCertificate decodes a certificate encoded by encodeCertificate
+func parseCertificate(data []byte) (*tls.Certificate, error) {
+	keyBlock, rest := pem.Decode(data)
+	if keyBlock == nil || !strings.Contains(keyBlock.Type, "PRIVATE") {
+		return nil, fmt.Errorf("certificate key is not PEM encoded")
+	}
+
+	cert, err := tls.X509KeyPair(rest, pem.EncodeToMemory(keyBlock))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+
+	return &cert, nil
+}
+
+// wildcardName returns the wildcard certificate name that covers a handle subdomain, if it's
+// directly under one of the host's user domains. Deeper subdomains aren't covered by wildcards.
+func wildcardName(host *loadedHostConfig, serverName string) (string, bool) {
+	_, parent, ok := strings.Cut(serverName, ".")
+	if !ok {
+		return "", false
+	}
+
+	for _, domain := range host.userDomains {
+		if strings.EqualFold(domain, "."+parent) {
+			return "*." + parent, true
+		}
+	}
+
+	return "", false
+}
+
+type cachedCert struct {
+	cert     *tls.Certificate
+	loadedAt time.Time
+}
+
+// certManager selects certificates by SNI and issues them with ACME
+type certManager struct {
+	log *slog.Logger
+
+	cfg   *tlsConfig
+	db    *db.DB
+	cache *certCache
+
+	routeHost func(string) (*loadedHostConfig, bool)
+	allHosts  func() []*loadedHostConfig
+
+	// autocert issues certificates for hostnames, or is nil if ACME is disabled
+	autocert *autocert.Manager
+
+	// holder identifies this replica in issuance locks
+	holder string
+
+	wildcardsMu sync.Mutex
+	wildcards   map[string]*cachedCert
+}
+
+func (s *server) newCertManager(cfg *tlsConfig) *certManager {
+	m := &certManager{
+		log:       s.log.With("component", "tls"),
+		cfg:       cfg,
+		db:        s.db,
+		cache:     &certCache{db: s.db, keyring: cfg.keyring},
+		routeHost: s.routeHost,
+		allHosts:  s.allHosts,
+		holder:    uuid.NewString(),
+		wildcards: make(map[string]*cachedCert),
+	}
+
+	if cfg.acme != nil {
+		m.autocert = &autocert.Manager{
+			Prompt:      autocert.AcceptTOS,
+			Cache:       m.cache,
+			HostPolicy:  m.hostPolicy,
+			RenewBefore: certRenewBefore,
+			Email:       cfg.acme.email,
+			Client:      &acme.Client{DirectoryURL: cfg.acme.directoryURL},
+		}
+	}
+
+	return m
+}
+
+// hostPolicy allows ACME certificates for hostnames that don't have cert files. Handle subdomains
+// are covered by wildcard certificates instead.
+func (m *certManager) hostPolicy(_ context.Context, name string) error {
+	host, userDomain := m.routeHost(name)
+	switch {
+	case host == nil:
+		return fmt.Errorf("host %q not found", name)
+	case userDomain:
+		return fmt.Errorf("%q is a handle subdomain, which is covered by a wildcard certificate", name)
+	case host.certificate != nil:
+		return fmt.Errorf("host %q has a certificate file", name)
+	}
+	return nil
+}
+
+func (m *certManager) tlsConfig() *tls.Config {
+	cfg := &tls.Config{
+		GetCertificate: m.getCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+		MinVersion:     tls.VersionTLS12,
+	}
+	if m.autocert != nil {
+		cfg.NextProtos = append(cfg.NextProtos, acme.ALPNProto)
+	}
+	return cfg
+}
+
+// getCertificate selects the certificate of the host that serves the SNI server name
+func (m *certManager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name == "" {
+		return nil, fmt.Errorf("missing server name")
+	}
+
+	host, userDomain := m.routeHost(name)
+	if host == nil {
+		return nil, fmt.Errorf("host %q not found", name)
+	}
+	if host.certificate != nil {
+		return host.certificate, nil
+	}
+	if m.autocert == nil {
+		return nil, fmt.Errorf("host %q has no certificate and acme is disabled", name)
+	}
+
+	if !userDomain {
+		return m.autocert.GetCertificate(hello)
+	}
+
+	wildcard, ok := wildcardName(host, name)
+	if !ok {
+		return nil, fmt.Errorf("no certificate covers %q", name)
+	}
+
+	return m.wildcard(hello.Context(), wildcard)
+}
+
+// wildcard returns a wildcard certificate that was issued by any replica. Certificates are issued
+// in the background since DNS propagation is too slow to do it during a handshake.
+func (m *certManager) wildcard(ctx context.Context, name string) (*tls.Certificate, error) {
+	m.wildcardsMu.Lock()
+	cached := m.wildcards[name]
+	m.wildcardsMu.Unlock()
+
+	if cached != nil && time.Since(cached.loadedAt) < wildcardCheckInterval {
+		return cached.cert, nil
+	}
+
+	data, err := m.cache.Get(ctx, name)
+	if errors.Is(err, autocert.ErrCacheMiss) {
+		return nil, fmt.Errorf("wildcard certificate %q hasn't been issued yet", name)
+	}
+	if err != nil {
+		if cached != nil {
+			// keep serving the previous certificate through FDB outages
+			m.log.Warn("failed to reload wildcard certificate", "err", err, "name", name)
+			return cached.cert, nil
+		}
+		return nil, fmt.Errorf("failed to load wildcard certificate: %w", err)
+	}
+
+	cert, err := parseCertificate(data)
+	if err != nil {
+		return nil, err
+	}
+
+	m.wildcardsMu.Lock()
+	m.wildcards[name] = &cachedCert{cert: cert, loadedAt: time.Now()}
+	m.wildcardsMu.Unlock()
+
+	return cert, nil
+}
+
+// Run keeps the wildcard certificates of every host's user domains issued and renewed
+func (m *certManager) Run(ctx context.Context) {
+	if m.cfg.acme == nil || m.cfg.acme.dns == nil {
+		return
+	}
+
+	ticker := time.NewTicker(wildcardCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, host := range m.allHosts() {
+			if host.certificate != nil {
+				continue
+			}
+
+			for _, domain := range host.userDomains {
+				name := "*" + strings.ToLower(domain)
+				if err := m.ensureWildcard(ctx, name); err != nil {
+					m.log.Error("failed to issue wildcard certificate", "err", err, "name", name, "host", host.hostname)
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ensureWildcard orders a wildcard certificate if it's missing or due for renewal, unless another
+// replica is already ordering it
+func (m *certManager) ensureWildcard(ctx context.Context, name string) error {
+	data, err := m.cache.Get(ctx, name)
+	switch {
+	case errors.Is(err, autocert.ErrCacheMiss):
+	case err != nil:
+		return err
+	default:
+		cert, err := parseCertificate(data)
+		if err == nil && time.Until(cert.Leaf.NotAfter) > certRenewBefore {
+			return nil
+		}
+	}
+
+	acquired, err := m.db.AcquireTLSLock(ctx, name, m.holder, certLockTTL)
+	if err != nil {
+		return err
+	}
+	if !acquired {
+		return nil
+	}
+	defer func() {
+		if err := m.db.ReleaseTLSLock(context.WithoutCancel(ctx), name, m.holder); err != nil {
+			m.log.Warn("failed to release certificate lock", "err", err, "name", name)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, certLockTTL)
+	defer cancel()
+
+	m.log.Info("ordering wildcard certificate", "name", name)
+	if err := m.orderWildcard(ctx, name); err != nil {
+		return err
+	}
+	m.log.Info("issued wildcard certificate", "name", name)
+
+	m.wildcardsMu.Lock()
+	delete(m.wildcards, name)
+	m.wildcardsMu.Unlock()
+
+	return nil
+}
+
+// orderWildcard issues a certificate for name with DNS-01 challenges and stores it in the cache
+func (m *certManager) orderWildcard(ctx context.Context, name string) error {
+	client, err := m.acmeClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(name))
+	if err != nil {
+		return fmt.Errorf("failed to create order: %w", err)
+	}
+
+	for _, url := range order.AuthzURLs {
+		if err := m.authorizeDNS01(ctx, client, url); err != nil {
+			return err
+		}
+	}
+
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return fmt.Errorf("failed to wait for order: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate certificate key: %w", err)
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{name}}, key)
+	if err != nil {
+		return fmt.Errorf("failed to create certificate request: %w", err)
+	}
+
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("failed to finalize order: %w", err)
+	}
+
+	data, err := encodeCertificate(key, chain)
+	if err != nil {
+		return err
+	}
+
+	return m.cache.Put(ctx, name, data)
+}
+
+func (m *certManager) authorizeDNS01(ctx context.Context, client *acme.Client, url string) error {
+	authz, err := client.GetAuthorization(ctx, url)
+	if err != nil {
+		return fmt.Errorf("failed to get authorization: %w", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "dns-01" {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("certificate authority didn't offer a dns-01 challenge for %q", authz.Identifier.Value)
+	}
+
+	value, err := client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return fmt.Errorf("failed to compute dns-01 record: %w", err)
+	}
+
+	// wildcard identifiers are given without the "*." prefix
+	fqdn := "_acme-challenge." + authz.Identifier.Value + "."
+
+	dns := m.cfg.acme.dns
+	if err := dns.Present(ctx, fqdn, value); err != nil {
+		return err
+	}
+	defer func() {
+		if err := dns.CleanUp(context.WithoutCancel(ctx), fqdn, value); err != nil {
+			m.log.Warn("failed to clean up dns-01 record", "err", err, "fqdn", fqdn)
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(m.cfg.acme.dnsPropagation):
+	}
+
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("failed to accept dns-01 challenge: %w", err)
+	}
+	if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("dns-01 challenge for %q failed: %w", authz.Identifier.Value, err)
+	}
+
+	return nil
+}
+
+// acmeClient returns a client for DNS-01 orders whose account key is shared by every replica
+func (m *certManager) acmeClient(ctx context.Context) (*acme.Client, error) {
+	key, err := m.accountKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &acme.Client{Key: key, DirectoryURL: m.cfg.acme.directoryURL}
+
+	account := &acme.Account{}
+	if m.cfg.acme.email != "" {
+		account.Contact = []string{"mailto:" + m.cfg.acme.email}
+	}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, fmt.Errorf("failed to register acme account: %w", err)
+	}
+
+	return client, nil
+}
+
+// accountKey loads the shared ACME account key, creating it on first use. Replicas racing to create
+// it all use whichever key was stored first, so they share a single account.
+func (m *certManager) accountKey(ctx context.Context) (crypto.Signer, error) {
+	data, err := m.cache.Get(ctx, wildcardAccountKeyName)
+	if errors.Is(err, autocert.ErrCacheMiss) {
+		data, err = m.createAccountKey(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("acme account key is not PEM encoded")
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+func (m *certManager) createAccountKey(ctx context.Context) ([]byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate acme account key: %w", err)
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal acme account key: %w", err)
+	}
+
+	return m.cache.PutIfAbsent(ctx, wildcardAccountKeyName, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+}
+
+// httpHandler serves the plain HTTP listener, which answers HTTP-01 challenges and redirects
+// everything else to HTTPS
+func (m *certManager) httpHandler() http.Handler {
+	redirect := http.HandlerFunc(redirectHTTPS)
+	if m.autocert == nil {
+		return redirect
+	}
+	return m.autocert.HTTPHandler(redirect)
+}
+
+func redirectHTTPS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "use https", http.StatusBadRequest)
+		return
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
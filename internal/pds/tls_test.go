@@ -0,0 +1,235 @@
+package pds
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme"
+)
+
+// testCertificate creates a self-signed certificate for the given names
+func testCertificate(t *testing.T, names ...string) (*ecdsa.PrivateKey, []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	return key, der
+}
+
+// writeTestCertificate writes a self-signed certificate and its key to dir
+func writeTestCertificate(t *testing.T, dir string, names ...string) *HostTLSConfig {
+	t.Helper()
+
+	key, der := testCertificate(t, names...)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	cfg := &HostTLSConfig{
+		CertFile: filepath.Join(dir, names[0]+".crt"),
+		KeyFile:  filepath.Join(dir, names[0]+".key"),
+	}
+	require.NoError(t, os.WriteFile(cfg.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(cfg.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return cfg
+}
+
+func TestLoadTLSConfig(t *testing.T) {
+	t.Parallel()
+
+	cfg, err := loadTLSConfig(&TLSConfig{HTTPAddr: ":80"})
+	require.NoError(t, err)
+	require.Equal(t, ":80", cfg.httpAddr)
+	require.Nil(t, cfg.keyring)
+	require.Nil(t, cfg.acme)
+
+	cfg, err = loadTLSConfig(&TLSConfig{ACME: &ACMEConfig{Email: "ops@example.com"}})
+	require.NoError(t, err)
+	require.Equal(t, acme.LetsEncryptURL, cfg.acme.directoryURL)
+	require.Nil(t, cfg.acme.dns)
+
+	cfg, err = loadTLSConfig(&TLSConfig{ACME: &ACMEConfig{
+		DNS01: &DNS01Config{Provider: "exec", Command: []string{"/bin/true"}},
+	}})
+	require.NoError(t, err)
+	require.NotNil(t, cfg.acme.dns)
+	require.Equal(t, defaultDNSPropagationSeconds*time.Second, cfg.acme.dnsPropagation)
+
+	_, err = loadTLSConfig(&TLSConfig{ACME: &ACMEConfig{DNS01: &DNS01Config{Provider: "nope"}}})
+	require.ErrorContains(t, err, "unknown dns provider")
+
+	_, err = loadTLSConfig(&TLSConfig{ACME: &ACMEConfig{DNS01: &DNS01Config{Provider: "exec"}}})
+	require.ErrorContains(t, err, "command is required")
+
+	_, err = loadTLSConfig(&TLSConfig{KEKFile: "kek", KEKEnv: "ATLAS_KEK"})
+	require.ErrorContains(t, err, "only one of")
+}
+
+func TestLoadHostCertificate(t *testing.T) {
+	t.Parallel()
+
+	cert, err := loadHostCertificate(&HostTLSConfig{})
+	require.NoError(t, err)
+	require.Nil(t, cert)
+
+	cfg := writeTestCertificate(t, t.TempDir(), "pds.example.com", "*.pds.example.com")
+	cert, err = loadHostCertificate(cfg)
+	require.NoError(t, err)
+	require.Equal(t, []string{"pds.example.com", "*.pds.example.com"}, cert.Leaf.DNSNames)
+
+	_, err = loadHostCertificate(&HostTLSConfig{CertFile: cfg.CertFile})
+	require.ErrorContains(t, err, "set together")
+
+	// the key doesn't match the certificate
+	other := writeTestCertificate(t, t.TempDir(), "other.example.com")
+	_, err = loadHostCertificate(&HostTLSConfig{CertFile: cfg.CertFile, KeyFile: other.KeyFile})
+	require.Error(t, err)
+}
+
+func TestEncodeCertificate(t *testing.T) {
+	t.Parallel()
+
+	key, der := testCertificate(t, "*.pds.example.com")
+	data, err := encodeCertificate(key, [][]byte{der})
+	require.NoError(t, err)
+
+	cert, err := parseCertificate(data)
+	require.NoError(t, err)
+	require.Equal(t, []string{"*.pds.example.com"}, cert.Leaf.DNSNames)
+
+	_, err = parseCertificate([]byte("not a certificate"))
+	require.Error(t, err)
+}
+
+func TestWildcardName(t *testing.T) {
+	t.Parallel()
+
+	host := &loadedHostConfig{userDomains: []string{".pds.example.com"}}
+
+	name, ok := wildcardName(host, "alice.pds.example.com")
+	require.True(t, ok)
+	require.Equal(t, "*.pds.example.com", name)
+
+	// wildcards only cover one label
+	_, ok = wildcardName(host, "a.b.pds.example.com")
+	require.False(t, ok)
+
+	_, ok = wildcardName(host, "pds")
+	require.False(t, ok)
+}
+
+func TestCertManagerGetCertificate(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	certA, err := loadHostCertificate(writeTestCertificate(t, dir, "a.example.com", "*.a.example.com"))
+	require.NoError(t, err)
+	certB, err := loadHostCertificate(writeTestCertificate(t, dir, "b.example.com", "*.b.example.com"))
+	require.NoError(t, err)
+
+	s := testMultiHostServer()
+	s.hosts = map[string]*loadedHostConfig{
+		"a.example.com": {hostname: "a.example.com", userDomains: []string{".a.example.com"}, certificate: certA},
+		"b.example.com": {hostname: "b.example.com", userDomains: []string{".b.example.com"}, certificate: certB},
+		"c.example.com": {hostname: "c.example.com", userDomains: []string{".c.example.com"}},
+	}
+	m := s.newCertManager(&tlsConfig{})
+
+	get := func(serverName string) (*tls.Certificate, error) {
+		return m.getCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	}
+
+	// SNI selects the host's certificate, including for its handle subdomains
+	for serverName, expected := range map[string]*tls.Certificate{
+		"a.example.com":       certA,
+		"A.EXAMPLE.COM.":      certA,
+		"alice.a.example.com": certA,
+		"b.example.com":       certB,
+		"bob.b.example.com":   certB,
+	} {
+		cert, err := get(serverName)
+		require.NoError(t, err, serverName)
+		require.Same(t, expected, cert, serverName)
+	}
+
+	_, err = get("")
+	require.ErrorContains(t, err, "missing server name")
+
+	_, err = get("unknown.example.org")
+	require.ErrorContains(t, err, "not found")
+
+	// hosts without cert files need acme
+	_, err = get("c.example.com")
+	require.ErrorContains(t, err, "acme is disabled")
+
+	m = s.newCertManager(&tlsConfig{acme: &acmeConfig{directoryURL: acme.LetsEncryptURL}})
+	require.NoError(t, m.hostPolicy(t.Context(), "c.example.com"))
+	require.Error(t, m.hostPolicy(t.Context(), "a.example.com"))
+	require.Error(t, m.hostPolicy(t.Context(), "carol.c.example.com"))
+	require.Error(t, m.hostPolicy(t.Context(), "unknown.example.org"))
+
+	_, err = get("a.b.c.example.com")
+	require.ErrorContains(t, err, "no certificate covers")
+}
+
+func TestExecDNSProvider(t *testing.T) {
+	t.Parallel()
+
+	out := filepath.Join(t.TempDir(), "records")
+	provider, err := loadDNSProvider(&DNS01Config{
+		Provider: "exec",
+		Command:  []string{"sh", "-c", `echo "$@" >> "$0"`, out},
+	})
+	require.NoError(t, err)
+
+	ctx := t.Context()
+	require.NoError(t, provider.Present(ctx, "_acme-challenge.pds.example.com.", "token"))
+	require.NoError(t, provider.CleanUp(ctx, "_acme-challenge.pds.example.com.", "token"))
+
+	buf, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "present _acme-challenge.pds.example.com. token\ncleanup _acme-challenge.pds.example.com. token\n", string(buf))
+
+	failing, err := loadDNSProvider(&DNS01Config{Provider: "exec", Command: []string{"sh", "-c", "echo denied; exit 1"}})
+	require.NoError(t, err)
+	require.ErrorContains(t, failing.Present(ctx, "_acme-challenge.pds.example.com.", "token"), "denied")
+}
+
+func TestRedirectHTTPS(t *testing.T) {
+	t.Parallel()
+
+	req := httptest.NewRequest(http.MethodGet, "/xrpc/com.atproto.server.describeServer?x=1", nil)
+	req.Host = "pds.example.com:80"
+	w := httptest.NewRecorder()
+	redirectHTTPS(w, req)
+	require.Equal(t, http.StatusMovedPermanently, w.Code)
+	require.Equal(t, "https://pds.example.com/xrpc/com.atproto.server.describeServer?x=1", w.Header().Get("Location"))
+
+	req = httptest.NewRequest(http.MethodPost, "/xrpc/com.atproto.server.createSession", nil)
+	w = httptest.NewRecorder()
+	redirectHTTPS(w, req)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
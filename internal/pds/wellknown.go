@@ -4,15 +4,22 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"strings"
 
 	"github.com/jcalabro/atlas/internal/pds/db"
 )
 
 type didDocument struct {
-	Context []string     `json:"@context"`
-	ID      string       `json:"id"`
-	Service []didService `json:"service"`
+	Context            []string                `json:"@context"`
+	ID                 string                  `json:"id"`
+	VerificationMethod []didVerificationMethod `json:"verificationMethod,omitempty"`
+	Service            []didService            `json:"service"`
+}
+
+type didVerificationMethod struct {
+	ID                 string `json:"id"`
+	Type               string `json:"type"`
+	Controller         string `json:"controller"`
+	PublicKeyMultibase string `json:"publicKeyMultibase"`
 }
 
 type didService struct {
@@ -40,6 +47,28 @@ func (s *server) handleWellKnown(w http.ResponseWriter, r *http.Request) {
 		},
 	}
 
+	// hosts that are labelers advertise their label signing key and stream
+	if host.labelSigner != nil {
+		pub, err := host.labelSigner.PublicKey()
+		if err != nil {
+			s.internalErr(w, fmt.Errorf("failed to get label signing public key: %w", err))
+			return
+		}
+
+		doc.Context = append(doc.Context, "https://w3id.org/security/multikey/v1")
+		doc.VerificationMethod = append(doc.VerificationMethod, didVerificationMethod{
+			ID:                 host.serviceDID + "#atproto_label",
+			Type:               "Multikey",
+			Controller:         host.serviceDID,
+			PublicKeyMultibase: pub.Multibase(),
+		})
+		doc.Service = append(doc.Service, didService{
+			ID:              "#atproto_labeler",
+			Type:            "AtprotoLabeler",
+			ServiceEndpoint: fmt.Sprintf("https://%s", host.hostname),
+		})
+	}
+
 	s.jsonOK(w, doc)
 }
 
@@ -51,11 +80,7 @@ func (s *server) handleAtprotoDid(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// strip port from host header if present
-	reqHost := r.Host
-	if idx := strings.LastIndex(reqHost, ":"); idx != -1 {
-		reqHost = reqHost[:idx]
-	}
+	reqHost := requestHost(r)
 
 	// if the host matches our configured hostname, return the server's DID
 	if reqHost == host.hostname {
@@ -65,8 +90,7 @@ func (s *server) handleAtprotoDid(w http.ResponseWriter, r *http.Request) {
 
 	// check if this is a user handle subdomain
 	// user handles are like: user.pds1.dev.atlaspds.net
-	// the host middleware already validated the base host, so if we got here
-	// with a different reqHost, it might be a handle lookup
+	// the host middleware routed the handle to the host that owns its user domain
 	actor, err := s.db.GetActorByHandle(ctx, reqHost)
 	if err != nil && !errors.Is(err, db.ErrNotFound) {
 		s.internalErr(w, fmt.Errorf("failed to look up handle: %w", err))
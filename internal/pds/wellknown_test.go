@@ -5,8 +5,10 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/jcalabro/atlas/internal/util"
 	"github.com/stretchr/testify/require"
 )
 
@@ -76,6 +78,60 @@ func TestHandleAtprotoDid_InvalidSubdomain(t *testing.T) {
 	require.Equal(t, http.StatusNoContent, w.Code)
 }
 
+func TestHandleAtprotoDid_HandleSubdomain(t *testing.T) {
+	t.Parallel()
+
+	srv := testServer(t)
+	srv.hosts["other.example.com"] = &loadedHostConfig{
+		hostname:    "other.example.com",
+		serviceDID:  "did:web:other.example.com",
+		userDomains: []string{".other.example.com"},
+	}
+	handler := srv.hostMiddleware(srv.router())
+
+	suffix := strings.ToLower(util.RandString(8))
+	actor, _ := setupTestActor(t, srv, "did:plc:wkhandle"+suffix, "wkhandle"+suffix+"@example.com",
+		"wkhandle"+suffix+".dev.atlaspds.dev")
+
+	// a handle registered on a different host than the one owning its domain
+	other, _ := setupTestActor(t, srv, "did:plc:wkother"+suffix, "wkother"+suffix+"@example.com",
+		"wkother"+suffix+".other.example.com")
+
+	resolve := func(reqHost string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/.well-known/atproto-did", nil)
+		req.Host = reqHost
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := resolve(actor.Handle)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Equal(t, actor.Did, w.Body.String())
+
+	w = resolve(strings.ToUpper(actor.Handle))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Equal(t, actor.Did, w.Body.String())
+
+	w = resolve("other.example.com")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Equal(t, "did:web:other.example.com", w.Body.String())
+
+	// hosts only resolve their own accounts' handles
+	w = resolve(other.Handle)
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+
+	w = resolve("nobody" + suffix + ".dev.atlaspds.dev")
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+
+	// handle subdomains don't serve the rest of the PDS
+	req := httptest.NewRequest(http.MethodGet, "/xrpc/com.atproto.server.describeServer", nil)
+	req.Host = actor.Handle
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+}
+
 func TestHandleOauthProtectedResource(t *testing.T) {
 	t.Parallel()
 
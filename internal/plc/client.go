@@ -9,8 +9,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"maps"
 	"net/http"
 	"net/url"
+	"slices"
 	"strings"
 
 	"github.com/bluesky-social/indigo/atproto/atcrypto"
@@ -22,6 +24,7 @@ import (
 type PLC interface {
 	CreateDID(ctx context.Context, sigkey *atcrypto.PrivateKeyK256, rotationKey atcrypto.PrivateKey, recovery, handle, pdsHostname string) (string, *Operation, error)
 	SendOperation(ctx context.Context, did string, op *Operation) error
+	GetLastOperation(ctx context.Context, did string) (*Operation, error)
 }
 
 type Client struct {
@@ -115,6 +118,77 @@ func CreateDIDCredentials(sigkey *atcrypto.PrivateKeyK256, rotationKey atcrypto.
 	return &creds, nil
 }
 
+// nextOperation returns an unsigned copy of last that follows it in the DID's operation log
+func nextOperation(last *Operation) (*Operation, error) {
+	if last.Type != "plc_operation" {
+		return nil, fmt.Errorf("unsupported previous operation type %q", last.Type)
+	}
+
+	prev, err := last.CID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute previous operation cid: %w", err)
+	}
+	prevStr := prev.String()
+
+	op := Operation{
+		Type:                "plc_operation",
+		VerificationMethods: maps.Clone(last.VerificationMethods),
+		RotationKeys:        slices.Clone(last.RotationKeys),
+		AlsoKnownAs:         slices.Clone(last.AlsoKnownAs),
+		Services:            maps.Clone(last.Services),
+		Prev:                &prevStr,
+	}
+	if op.VerificationMethods == nil {
+		op.VerificationMethods = make(map[string]string)
+	}
+
+	return &op, nil
+}
+
+// SigningKeyUpdate builds an operation that follows last and replaces the atproto signing key
+// with sigkey, signed by rotationKey. rotationKey must be one of the DID's current rotation keys.
+func SigningKeyUpdate(last *Operation, sigkey *atcrypto.PrivateKeyK256, rotationKey atcrypto.PrivateKey) (*Operation, error) {
+	op, err := nextOperation(last)
+	if err != nil {
+		return nil, err
+	}
+
+	pubsigkey, err := sigkey.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	op.VerificationMethods["atproto"] = pubsigkey.DIDKey()
+
+	if err := signOp(rotationKey, op); err != nil {
+		return nil, err
+	}
+
+	return op, nil
+}
+
+// HandleUpdate builds an operation that follows last and replaces the DID's handle, signed by
+// rotationKey. Other alsoKnownAs entries that aren't at:// URIs are kept as they are.
+func HandleUpdate(last *Operation, handle string, rotationKey atcrypto.PrivateKey) (*Operation, error) {
+	op, err := nextOperation(last)
+	if err != nil {
+		return nil, err
+	}
+
+	aka := []string{fmt.Sprintf("at://%s", handle)}
+	for _, uri := range op.AlsoKnownAs {
+		if !strings.HasPrefix(uri, "at://") {
+			aka = append(aka, uri)
+		}
+	}
+	op.AlsoKnownAs = aka
+
+	if err := signOp(rotationKey, op); err != nil {
+		return nil, err
+	}
+
+	return op, nil
+}
+
 func (c *Client) SignOp(rotationKey atcrypto.PrivateKey, op *Operation) error {
 	return signOp(rotationKey, op)
 }
@@ -174,6 +248,44 @@ func (c *Client) SendOperation(ctx context.Context, did string, op *Operation) e
 	return nil
 }
 
+// GetLastOperation fetches the most recent operation in the DID's PLC log
+func (c *Client) GetLastOperation(ctx context.Context, did string) (*Operation, error) {
+	ctx, span := c.tracer.Start(ctx, "plc/GetLastOperation")
+	defer span.End()
+
+	u := fmt.Sprintf("%s/%s/log/last", c.plcURL, url.QueryEscape(did))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // nolint:errcheck
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read plc log response body: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf(
+			"failed to get last plc operation, status %d, response %q",
+			resp.StatusCode,
+			body,
+		)
+	}
+
+	var op Operation
+	if err := json.Unmarshal(body, &op); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal plc operation: %w", err)
+	}
+
+	return &op, nil
+}
+
 func DIDFromOp(op *Operation) (string, error) {
 	b, err := op.MarshalCBOR()
 	if err != nil {
@@ -0,0 +1,101 @@
+package plc
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSigningKeyUpdate(t *testing.T) {
+	t.Parallel()
+
+	sigkey, err := atcrypto.GeneratePrivateKeyK256()
+	require.NoError(t, err)
+	rotationKey, err := atcrypto.GeneratePrivateKeyK256()
+	require.NoError(t, err)
+
+	mock := &MockClient{}
+	did, genesis, err := mock.CreateDID(t.Context(), sigkey, rotationKey, "", "alice.example.com", "example.com")
+	require.NoError(t, err)
+
+	newkey, err := atcrypto.GeneratePrivateKeyK256()
+	require.NoError(t, err)
+	newpub, err := newkey.PublicKey()
+	require.NoError(t, err)
+
+	op, err := SigningKeyUpdate(genesis, newkey, rotationKey)
+	require.NoError(t, err)
+
+	genesisCID, err := genesis.CID()
+	require.NoError(t, err)
+	require.NotNil(t, op.Prev)
+	require.Equal(t, genesisCID.String(), *op.Prev)
+
+	// only the signing key changes
+	require.Equal(t, newpub.DIDKey(), op.VerificationMethods["atproto"])
+	require.Equal(t, genesis.RotationKeys, op.RotationKeys)
+	require.Equal(t, genesis.AlsoKnownAs, op.AlsoKnownAs)
+	require.Equal(t, genesis.Services, op.Services)
+	require.NotEqual(t, genesis.VerificationMethods["atproto"], op.VerificationMethods["atproto"])
+
+	// the update is signed by the rotation key
+	unsigned := *op
+	unsigned.Sig = ""
+	b, err := unsigned.MarshalCBOR()
+	require.NoError(t, err)
+	sig, err := base64.RawURLEncoding.DecodeString(op.Sig)
+	require.NoError(t, err)
+	rotationPub, err := rotationKey.PublicKey()
+	require.NoError(t, err)
+	require.NoError(t, rotationPub.HashAndVerify(b, sig))
+
+	// the mock records sent operations
+	require.NoError(t, mock.SendOperation(t.Context(), did, op))
+	last, err := mock.GetLastOperation(t.Context(), did)
+	require.NoError(t, err)
+	require.Equal(t, op, last)
+
+	_, err = mock.GetLastOperation(t.Context(), "did:plc:unknown")
+	require.ErrorIs(t, err, ErrMockOperationNotFound)
+
+	t.Run("rejects tombstones", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := SigningKeyUpdate(&Operation{Type: "plc_tombstone"}, newkey, rotationKey)
+		require.Error(t, err)
+	})
+}
+
+func TestHandleUpdate(t *testing.T) {
+	t.Parallel()
+
+	sigkey, err := atcrypto.GeneratePrivateKeyK256()
+	require.NoError(t, err)
+	rotationKey, err := atcrypto.GeneratePrivateKeyK256()
+	require.NoError(t, err)
+
+	mock := &MockClient{}
+	_, genesis, err := mock.CreateDID(t.Context(), sigkey, rotationKey, "", "alice.example.com", "example.com")
+	require.NoError(t, err)
+	genesis.AlsoKnownAs = append(genesis.AlsoKnownAs, "https://alice.example.com")
+
+	op, err := HandleUpdate(genesis, "bob.example.com", rotationKey)
+	require.NoError(t, err)
+
+	genesisCID, err := genesis.CID()
+	require.NoError(t, err)
+	require.NotNil(t, op.Prev)
+	require.Equal(t, genesisCID.String(), *op.Prev)
+
+	// the at:// uri is replaced and everything else is kept
+	require.Equal(t, []string{"at://bob.example.com", "https://alice.example.com"}, op.AlsoKnownAs)
+	require.Equal(t, genesis.VerificationMethods, op.VerificationMethods)
+	require.Equal(t, genesis.RotationKeys, op.RotationKeys)
+	require.Equal(t, genesis.Services, op.Services)
+	require.NotEmpty(t, op.Sig)
+
+	_, err = HandleUpdate(&Operation{Type: "plc_tombstone"}, "bob.example.com", rotationKey)
+	require.Error(t, err)
+}
@@ -2,14 +2,24 @@ package plc
 
 import (
 	"context"
+	"errors"
+	"sync"
 
 	"github.com/bluesky-social/indigo/atproto/atcrypto"
 )
 
+// ErrMockOperationNotFound is returned by MockClient when no operation has been sent for a DID
+var ErrMockOperationNotFound = errors.New("no plc operations for did")
+
 // MockClient is a mock PLC client for testing
 type MockClient struct {
-	CreateDIDFunc     func(ctx context.Context, sigkey *atcrypto.PrivateKeyK256, rotationKey atcrypto.PrivateKey, recovery, handle, pdsHostname string) (string, *Operation, error)
-	SendOperationFunc func(ctx context.Context, did string, op *Operation) error
+	CreateDIDFunc        func(ctx context.Context, sigkey *atcrypto.PrivateKeyK256, rotationKey atcrypto.PrivateKey, recovery, handle, pdsHostname string) (string, *Operation, error)
+	SendOperationFunc    func(ctx context.Context, did string, op *Operation) error
+	GetLastOperationFunc func(ctx context.Context, did string) (*Operation, error)
+
+	// ops holds the last operation sent for each DID by the default SendOperation
+	mu  sync.Mutex
+	ops map[string]*Operation
 }
 
 func (m *MockClient) SetCreateDIDFunc(fn func(ctx context.Context, sigkey *atcrypto.PrivateKeyK256, rotationKey atcrypto.PrivateKey, recovery, handle, pdsHostname string) (string, *Operation, error)) {
@@ -57,6 +67,26 @@ func (m *MockClient) SendOperation(ctx context.Context, did string, op *Operatio
 	if m.SendOperationFunc != nil {
 		return m.SendOperationFunc(ctx, did, op)
 	}
-	// Default no-op implementation (don't actually send to PLC)
+	// Default implementation records the operation rather than sending it to PLC
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ops == nil {
+		m.ops = make(map[string]*Operation)
+	}
+	m.ops[did] = op
 	return nil
 }
+
+func (m *MockClient) GetLastOperation(ctx context.Context, did string) (*Operation, error) {
+	if m.GetLastOperationFunc != nil {
+		return m.GetLastOperationFunc(ctx, did)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	op, ok := m.ops[did]
+	if !ok {
+		return nil, ErrMockOperationNotFound
+	}
+	return op, nil
+}
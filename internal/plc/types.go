@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 
 	"github.com/bluesky-social/indigo/atproto/atdata"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
 	typegen "github.com/whyrusleeping/cbor-gen"
 )
 
@@ -51,3 +53,14 @@ func (po *Operation) MarshalCBOR() ([]byte, error) {
 
 	return b, nil
 }
+
+// CID returns the content identifier of the signed operation, which is referenced by the prev
+// field of the operation that follows it
+func (po *Operation) CID() (cid.Cid, error) {
+	b, err := po.MarshalCBOR()
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	return cid.NewPrefixV1(cid.DagCBOR, multihash.SHA2_256).Sum(b)
+}
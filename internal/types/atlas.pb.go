@@ -29,6 +29,7 @@ const (
 	EventType_EVENT_TYPE_COMMIT      EventType = 1
 	EventType_EVENT_TYPE_IDENTITY    EventType = 2
 	EventType_EVENT_TYPE_ACCOUNT     EventType = 3
+	EventType_EVENT_TYPE_SYNC        EventType = 4
 )
 
 // Enum value maps for EventType.
@@ -38,12 +39,14 @@ var (
 		1: "EVENT_TYPE_COMMIT",
 		2: "EVENT_TYPE_IDENTITY",
 		3: "EVENT_TYPE_ACCOUNT",
+		4: "EVENT_TYPE_SYNC",
 	}
 	EventType_value = map[string]int32{
 		"EVENT_TYPE_UNSPECIFIED": 0,
 		"EVENT_TYPE_COMMIT":      1,
 		"EVENT_TYPE_IDENTITY":    2,
 		"EVENT_TYPE_ACCOUNT":     3,
+		"EVENT_TYPE_SYNC":        4,
 	}
 )
 
@@ -86,13 +89,25 @@ type Actor struct {
 	Handle                string                 `protobuf:"bytes,8,opt,name=handle,proto3" json:"handle,omitempty"`
 	Active                bool                   `protobuf:"varint,9,opt,name=active,proto3" json:"active,omitempty"`
 	RotationKeys          [][]byte               `protobuf:"bytes,10,rep,name=rotation_keys,json=rotationKeys,proto3" json:"rotation_keys,omitempty"`
-	RefreshTokens         []*RefreshToken        `protobuf:"bytes,11,rep,name=refresh_tokens,json=refreshTokens,proto3" json:"refresh_tokens,omitempty"`
-	Head                  string                 `protobuf:"bytes,12,opt,name=head,proto3" json:"head,omitempty"`
-	Rev                   string                 `protobuf:"bytes,13,opt,name=rev,proto3" json:"rev,omitempty"`
-	PdsHost               string                 `protobuf:"bytes,14,opt,name=pds_host,json=pdsHost,proto3" json:"pds_host,omitempty"` // hostname of the PDS this actor belongs to
-	Preferences           []byte                 `protobuf:"bytes,15,opt,name=preferences,proto3" json:"preferences,omitempty"`        // JSON-encoded user preferences
-	unknownFields         protoimpl.UnknownFields
-	sizeCache             protoimpl.SizeCache
+	// Deprecated: Marked as deprecated in atlas.proto.
+	RefreshTokens      []*RefreshToken      `protobuf:"bytes,11,rep,name=refresh_tokens,json=refreshTokens,proto3" json:"refresh_tokens,omitempty"` // legacy plaintext tokens, moved to RefreshSession when the actor is next saved or authenticates
+	Head               string               `protobuf:"bytes,12,opt,name=head,proto3" json:"head,omitempty"`
+	Rev                string               `protobuf:"bytes,13,opt,name=rev,proto3" json:"rev,omitempty"`
+	PdsHost            string               `protobuf:"bytes,14,opt,name=pds_host,json=pdsHost,proto3" json:"pds_host,omitempty"`                                    // hostname of the PDS this actor belongs to
+	Preferences        []byte               `protobuf:"bytes,15,opt,name=preferences,proto3" json:"preferences,omitempty"`                                           // JSON-encoded user preferences
+	PendingSigningKey  []byte               `protobuf:"bytes,16,opt,name=pending_signing_key,json=pendingSigningKey,proto3" json:"pending_signing_key,omitempty"`    // replacement signing key while a key rotation is in progress
+	RetiredSigningKeys []*RetiredSigningKey `protobuf:"bytes,17,rep,name=retired_signing_keys,json=retiredSigningKeys,proto3" json:"retired_signing_keys,omitempty"` // previous signing keys kept for a grace window
+	// Envelope encrypted private keys. When set, they replace the corresponding plaintext fields
+	// above, which are only populated for keys stored before encryption was enabled for the host.
+	WrappedSigningKey        *WrappedKey   `protobuf:"bytes,18,opt,name=wrapped_signing_key,json=wrappedSigningKey,proto3" json:"wrapped_signing_key,omitempty"`
+	WrappedRotationKeys      []*WrappedKey `protobuf:"bytes,19,rep,name=wrapped_rotation_keys,json=wrappedRotationKeys,proto3" json:"wrapped_rotation_keys,omitempty"`
+	WrappedPendingSigningKey *WrappedKey   `protobuf:"bytes,20,opt,name=wrapped_pending_signing_key,json=wrappedPendingSigningKey,proto3" json:"wrapped_pending_signing_key,omitempty"`
+	InviteCode               string        `protobuf:"bytes,21,opt,name=invite_code,json=inviteCode,proto3" json:"invite_code,omitempty"`                 // invite code the account signed up with, if any
+	InvitesDisabled          bool          `protobuf:"varint,22,opt,name=invites_disabled,json=invitesDisabled,proto3" json:"invites_disabled,omitempty"` // set by an admin to stop the account from creating invite codes
+	InviteNote               string        `protobuf:"bytes,23,opt,name=invite_note,json=inviteNote,proto3" json:"invite_note,omitempty"`                 // admin note explaining why invites were disabled
+	Takedown                 *Takedown     `protobuf:"bytes,24,opt,name=takedown,proto3" json:"takedown,omitempty"`                                       // set while the account is taken down by an admin
+	unknownFields            protoimpl.UnknownFields
+	sizeCache                protoimpl.SizeCache
 }
 
 func (x *Actor) Reset() {
@@ -195,6 +210,7 @@ func (x *Actor) GetRotationKeys() [][]byte {
 	return nil
 }
 
+// Deprecated: Marked as deprecated in atlas.proto.
 func (x *Actor) GetRefreshTokens() []*RefreshToken {
 	if x != nil {
 		return x.RefreshTokens
@@ -230,33 +246,1060 @@ func (x *Actor) GetPreferences() []byte {
 	return nil
 }
 
+func (x *Actor) GetPendingSigningKey() []byte {
+	if x != nil {
+		return x.PendingSigningKey
+	}
+	return nil
+}
+
+func (x *Actor) GetRetiredSigningKeys() []*RetiredSigningKey {
+	if x != nil {
+		return x.RetiredSigningKeys
+	}
+	return nil
+}
+
+func (x *Actor) GetWrappedSigningKey() *WrappedKey {
+	if x != nil {
+		return x.WrappedSigningKey
+	}
+	return nil
+}
+
+func (x *Actor) GetWrappedRotationKeys() []*WrappedKey {
+	if x != nil {
+		return x.WrappedRotationKeys
+	}
+	return nil
+}
+
+func (x *Actor) GetWrappedPendingSigningKey() *WrappedKey {
+	if x != nil {
+		return x.WrappedPendingSigningKey
+	}
+	return nil
+}
+
+func (x *Actor) GetInviteCode() string {
+	if x != nil {
+		return x.InviteCode
+	}
+	return ""
+}
+
+func (x *Actor) GetInvitesDisabled() bool {
+	if x != nil {
+		return x.InvitesDisabled
+	}
+	return false
+}
+
+func (x *Actor) GetInviteNote() string {
+	if x != nil {
+		return x.InviteNote
+	}
+	return ""
+}
+
+func (x *Actor) GetTakedown() *Takedown {
+	if x != nil {
+		return x.Takedown
+	}
+	return nil
+}
+
+// WrappedKey is a private key encrypted with a data-encryption key, which is itself encrypted
+// with a host's key-encryption key
+type WrappedKey struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	KekId         string                 `protobuf:"bytes,1,opt,name=kek_id,json=kekId,proto3" json:"kek_id,omitempty"`                // identifies the key-encryption key that wrapped the DEK
+	WrappedDek    []byte                 `protobuf:"bytes,2,opt,name=wrapped_dek,json=wrappedDek,proto3" json:"wrapped_dek,omitempty"` // data-encryption key encrypted with the KEK
+	Ciphertext    []byte                 `protobuf:"bytes,3,opt,name=ciphertext,proto3" json:"ciphertext,omitempty"`                   // private key encrypted with the DEK
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *WrappedKey) Reset() {
+	*x = WrappedKey{}
+	mi := &file_atlas_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WrappedKey) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WrappedKey) ProtoMessage() {}
+
+func (x *WrappedKey) ProtoReflect() protoreflect.Message {
+	mi := &file_atlas_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WrappedKey.ProtoReflect.Descriptor instead.
+func (*WrappedKey) Descriptor() ([]byte, []int) {
+	return file_atlas_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *WrappedKey) GetKekId() string {
+	if x != nil {
+		return x.KekId
+	}
+	return ""
+}
+
+func (x *WrappedKey) GetWrappedDek() []byte {
+	if x != nil {
+		return x.WrappedDek
+	}
+	return nil
+}
+
+func (x *WrappedKey) GetCiphertext() []byte {
+	if x != nil {
+		return x.Ciphertext
+	}
+	return nil
+}
+
+// RetiredSigningKey is a signing key that was replaced by a key rotation
+type RetiredSigningKey struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Key           []byte                 `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	RetiredAt     *timestamppb.Timestamp `protobuf:"bytes,2,opt,name=retired_at,json=retiredAt,proto3" json:"retired_at,omitempty"`
+	ExpiresAt     *timestamppb.Timestamp `protobuf:"bytes,3,opt,name=expires_at,json=expiresAt,proto3" json:"expires_at,omitempty"`
+	WrappedKey    *WrappedKey            `protobuf:"bytes,4,opt,name=wrapped_key,json=wrappedKey,proto3" json:"wrapped_key,omitempty"` // set instead of key when the key is envelope encrypted
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RetiredSigningKey) Reset() {
+	*x = RetiredSigningKey{}
+	mi := &file_atlas_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RetiredSigningKey) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RetiredSigningKey) ProtoMessage() {}
+
+func (x *RetiredSigningKey) ProtoReflect() protoreflect.Message {
+	mi := &file_atlas_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RetiredSigningKey.ProtoReflect.Descriptor instead.
+func (*RetiredSigningKey) Descriptor() ([]byte, []int) {
+	return file_atlas_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *RetiredSigningKey) GetKey() []byte {
+	if x != nil {
+		return x.Key
+	}
+	return nil
+}
+
+func (x *RetiredSigningKey) GetRetiredAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.RetiredAt
+	}
+	return nil
+}
+
+func (x *RetiredSigningKey) GetExpiresAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.ExpiresAt
+	}
+	return nil
+}
+
+func (x *RetiredSigningKey) GetWrappedKey() *WrappedKey {
+	if x != nil {
+		return x.WrappedKey
+	}
+	return nil
+}
+
 // Blob stores metadata about an uploaded blob
 type Blob struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
-	Did           string                 `protobuf:"bytes,1,opt,name=did,proto3" json:"did,omitempty"`                           // DID of the owner
-	Cid           []byte                 `protobuf:"bytes,2,opt,name=cid,proto3" json:"cid,omitempty"`                           // CID of the blob content
-	MimeType      string                 `protobuf:"bytes,3,opt,name=mime_type,json=mimeType,proto3" json:"mime_type,omitempty"` // MIME type of the blob
-	Size          int64                  `protobuf:"varint,4,opt,name=size,proto3" json:"size,omitempty"`                        // size in bytes
-	CreatedAt     *timestamppb.Timestamp `protobuf:"bytes,5,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
+	Did           string                 `protobuf:"bytes,1,opt,name=did,proto3" json:"did,omitempty"`                           // DID of the owner
+	Cid           []byte                 `protobuf:"bytes,2,opt,name=cid,proto3" json:"cid,omitempty"`                           // CID of the blob content
+	MimeType      string                 `protobuf:"bytes,3,opt,name=mime_type,json=mimeType,proto3" json:"mime_type,omitempty"` // MIME type of the blob
+	Size          int64                  `protobuf:"varint,4,opt,name=size,proto3" json:"size,omitempty"`                        // size in bytes
+	CreatedAt     *timestamppb.Timestamp `protobuf:"bytes,5,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Blob) Reset() {
+	*x = Blob{}
+	mi := &file_atlas_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Blob) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Blob) ProtoMessage() {}
+
+func (x *Blob) ProtoReflect() protoreflect.Message {
+	mi := &file_atlas_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Blob.ProtoReflect.Descriptor instead.
+func (*Blob) Descriptor() ([]byte, []int) {
+	return file_atlas_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *Blob) GetDid() string {
+	if x != nil {
+		return x.Did
+	}
+	return ""
+}
+
+func (x *Blob) GetCid() []byte {
+	if x != nil {
+		return x.Cid
+	}
+	return nil
+}
+
+func (x *Blob) GetMimeType() string {
+	if x != nil {
+		return x.MimeType
+	}
+	return ""
+}
+
+func (x *Blob) GetSize() int64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *Blob) GetCreatedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.CreatedAt
+	}
+	return nil
+}
+
+type RefreshToken struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Token         string                 `protobuf:"bytes,1,opt,name=token,proto3" json:"token,omitempty"`
+	CreatedAt     *timestamppb.Timestamp `protobuf:"bytes,2,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
+	ExpiresAt     *timestamppb.Timestamp `protobuf:"bytes,3,opt,name=expires_at,json=expiresAt,proto3" json:"expires_at,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RefreshToken) Reset() {
+	*x = RefreshToken{}
+	mi := &file_atlas_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RefreshToken) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RefreshToken) ProtoMessage() {}
+
+func (x *RefreshToken) ProtoReflect() protoreflect.Message {
+	mi := &file_atlas_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RefreshToken.ProtoReflect.Descriptor instead.
+func (*RefreshToken) Descriptor() ([]byte, []int) {
+	return file_atlas_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *RefreshToken) GetToken() string {
+	if x != nil {
+		return x.Token
+	}
+	return ""
+}
+
+func (x *RefreshToken) GetCreatedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.CreatedAt
+	}
+	return nil
+}
+
+func (x *RefreshToken) GetExpiresAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.ExpiresAt
+	}
+	return nil
+}
+
+// RefreshSession is a refresh token issued to an actor, keyed by (did, jti). Only a hash of the
+// token is stored. Each refresh replaces the token with a new one in the same family, and the old
+// token is kept until it expires so that reuse can be detected.
+type RefreshSession struct {
+	state           protoimpl.MessageState `protogen:"open.v1"`
+	Did             string                 `protobuf:"bytes,1,opt,name=did,proto3" json:"did,omitempty"`
+	Jti             string                 `protobuf:"bytes,2,opt,name=jti,proto3" json:"jti,omitempty"`
+	Family          string                 `protobuf:"bytes,3,opt,name=family,proto3" json:"family,omitempty"`                        // jti of the token issued at login, shared by every token rotated from it
+	TokenHash       []byte                 `protobuf:"bytes,4,opt,name=token_hash,json=tokenHash,proto3" json:"token_hash,omitempty"` // SHA-256 of the refresh token
+	CreatedAt       *timestamppb.Timestamp `protobuf:"bytes,5,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
+	ExpiresAt       *timestamppb.Timestamp `protobuf:"bytes,6,opt,name=expires_at,json=expiresAt,proto3" json:"expires_at,omitempty"`
+	FamilyCreatedAt *timestamppb.Timestamp `protobuf:"bytes,7,opt,name=family_created_at,json=familyCreatedAt,proto3" json:"family_created_at,omitempty"` // when the family's login happened
+	RotatedTo       string                 `protobuf:"bytes,8,opt,name=rotated_to,json=rotatedTo,proto3" json:"rotated_to,omitempty"`                     // jti of the replacement token, set once this token has been used
+	UserAgent       string                 `protobuf:"bytes,9,opt,name=user_agent,json=userAgent,proto3" json:"user_agent,omitempty"`                     // user agent of the client at login
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *RefreshSession) Reset() {
+	*x = RefreshSession{}
+	mi := &file_atlas_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RefreshSession) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RefreshSession) ProtoMessage() {}
+
+func (x *RefreshSession) ProtoReflect() protoreflect.Message {
+	mi := &file_atlas_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RefreshSession.ProtoReflect.Descriptor instead.
+func (*RefreshSession) Descriptor() ([]byte, []int) {
+	return file_atlas_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *RefreshSession) GetDid() string {
+	if x != nil {
+		return x.Did
+	}
+	return ""
+}
+
+func (x *RefreshSession) GetJti() string {
+	if x != nil {
+		return x.Jti
+	}
+	return ""
+}
+
+func (x *RefreshSession) GetFamily() string {
+	if x != nil {
+		return x.Family
+	}
+	return ""
+}
+
+func (x *RefreshSession) GetTokenHash() []byte {
+	if x != nil {
+		return x.TokenHash
+	}
+	return nil
+}
+
+func (x *RefreshSession) GetCreatedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.CreatedAt
+	}
+	return nil
+}
+
+func (x *RefreshSession) GetExpiresAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.ExpiresAt
+	}
+	return nil
+}
+
+func (x *RefreshSession) GetFamilyCreatedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.FamilyCreatedAt
+	}
+	return nil
+}
+
+func (x *RefreshSession) GetRotatedTo() string {
+	if x != nil {
+		return x.RotatedTo
+	}
+	return ""
+}
+
+func (x *RefreshSession) GetUserAgent() string {
+	if x != nil {
+		return x.UserAgent
+	}
+	return ""
+}
+
+// LoginLockout tracks an actor's consecutive failed logins
+type LoginLockout struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Failures      int64                  `protobuf:"varint,1,opt,name=failures,proto3" json:"failures,omitempty"`
+	LastFailure   *timestamppb.Timestamp `protobuf:"bytes,2,opt,name=last_failure,json=lastFailure,proto3" json:"last_failure,omitempty"`
+	LockedUntil   *timestamppb.Timestamp `protobuf:"bytes,3,opt,name=locked_until,json=lockedUntil,proto3" json:"locked_until,omitempty"` // set once too many logins have failed in a row
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LoginLockout) Reset() {
+	*x = LoginLockout{}
+	mi := &file_atlas_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LoginLockout) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LoginLockout) ProtoMessage() {}
+
+func (x *LoginLockout) ProtoReflect() protoreflect.Message {
+	mi := &file_atlas_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LoginLockout.ProtoReflect.Descriptor instead.
+func (*LoginLockout) Descriptor() ([]byte, []int) {
+	return file_atlas_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *LoginLockout) GetFailures() int64 {
+	if x != nil {
+		return x.Failures
+	}
+	return 0
+}
+
+func (x *LoginLockout) GetLastFailure() *timestamppb.Timestamp {
+	if x != nil {
+		return x.LastFailure
+	}
+	return nil
+}
+
+func (x *LoginLockout) GetLockedUntil() *timestamppb.Timestamp {
+	if x != nil {
+		return x.LockedUntil
+	}
+	return nil
+}
+
+// Takedown records an admin's moderation action against an account, record, or blob
+type Takedown struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Ref           string                 `protobuf:"bytes,1,opt,name=ref,proto3" json:"ref,omitempty"` // opaque reference supplied by the admin, e.g. a moderation ticket id
+	CreatedAt     *timestamppb.Timestamp `protobuf:"bytes,2,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Takedown) Reset() {
+	*x = Takedown{}
+	mi := &file_atlas_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Takedown) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Takedown) ProtoMessage() {}
+
+func (x *Takedown) ProtoReflect() protoreflect.Message {
+	mi := &file_atlas_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Takedown.ProtoReflect.Descriptor instead.
+func (*Takedown) Descriptor() ([]byte, []int) {
+	return file_atlas_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *Takedown) GetRef() string {
+	if x != nil {
+		return x.Ref
+	}
+	return ""
+}
+
+func (x *Takedown) GetCreatedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.CreatedAt
+	}
+	return nil
+}
+
+// Report is a moderation report made by one of a host's accounts
+type Report struct {
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	Id             int64                  `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"` // sequential per host
+	PdsHost        string                 `protobuf:"bytes,2,opt,name=pds_host,json=pdsHost,proto3" json:"pds_host,omitempty"`
+	ReportedBy     string                 `protobuf:"bytes,3,opt,name=reported_by,json=reportedBy,proto3" json:"reported_by,omitempty"` // DID of the reporting account
+	ReasonType     string                 `protobuf:"bytes,4,opt,name=reason_type,json=reasonType,proto3" json:"reason_type,omitempty"` // e.g. "com.atproto.moderation.defs#reasonSpam"
+	Reason         string                 `protobuf:"bytes,5,opt,name=reason,proto3" json:"reason,omitempty"`
+	SubjectDid     string                 `protobuf:"bytes,6,opt,name=subject_did,json=subjectDid,proto3" json:"subject_did,omitempty"` // DID of the reported account, or of the record's repo
+	SubjectUri     string                 `protobuf:"bytes,7,opt,name=subject_uri,json=subjectUri,proto3" json:"subject_uri,omitempty"` // AT URI of the reported record, if any
+	SubjectCid     string                 `protobuf:"bytes,8,opt,name=subject_cid,json=subjectCid,proto3" json:"subject_cid,omitempty"`
+	CreatedAt      *timestamppb.Timestamp `protobuf:"bytes,9,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
+	ForwardedId    int64                  `protobuf:"varint,10,opt,name=forwarded_id,json=forwardedId,proto3" json:"forwarded_id,omitempty"` // id assigned by the moderation service, if forwarded
+	ResolvedAt     *timestamppb.Timestamp `protobuf:"bytes,11,opt,name=resolved_at,json=resolvedAt,proto3" json:"resolved_at,omitempty"`
+	ResolvedBy     string                 `protobuf:"bytes,12,opt,name=resolved_by,json=resolvedBy,proto3" json:"resolved_by,omitempty"` // DID of the resolving admin, or "admin"
+	ResolutionNote string                 `protobuf:"bytes,13,opt,name=resolution_note,json=resolutionNote,proto3" json:"resolution_note,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *Report) Reset() {
+	*x = Report{}
+	mi := &file_atlas_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Report) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Report) ProtoMessage() {}
+
+func (x *Report) ProtoReflect() protoreflect.Message {
+	mi := &file_atlas_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Report.ProtoReflect.Descriptor instead.
+func (*Report) Descriptor() ([]byte, []int) {
+	return file_atlas_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *Report) GetId() int64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *Report) GetPdsHost() string {
+	if x != nil {
+		return x.PdsHost
+	}
+	return ""
+}
+
+func (x *Report) GetReportedBy() string {
+	if x != nil {
+		return x.ReportedBy
+	}
+	return ""
+}
+
+func (x *Report) GetReasonType() string {
+	if x != nil {
+		return x.ReasonType
+	}
+	return ""
+}
+
+func (x *Report) GetReason() string {
+	if x != nil {
+		return x.Reason
+	}
+	return ""
+}
+
+func (x *Report) GetSubjectDid() string {
+	if x != nil {
+		return x.SubjectDid
+	}
+	return ""
+}
+
+func (x *Report) GetSubjectUri() string {
+	if x != nil {
+		return x.SubjectUri
+	}
+	return ""
+}
+
+func (x *Report) GetSubjectCid() string {
+	if x != nil {
+		return x.SubjectCid
+	}
+	return ""
+}
+
+func (x *Report) GetCreatedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.CreatedAt
+	}
+	return nil
+}
+
+func (x *Report) GetForwardedId() int64 {
+	if x != nil {
+		return x.ForwardedId
+	}
+	return 0
+}
+
+func (x *Report) GetResolvedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.ResolvedAt
+	}
+	return nil
+}
+
+func (x *Report) GetResolvedBy() string {
+	if x != nil {
+		return x.ResolvedBy
+	}
+	return ""
+}
+
+func (x *Report) GetResolutionNote() string {
+	if x != nil {
+		return x.ResolutionNote
+	}
+	return ""
+}
+
+// Label is a com.atproto.label.defs#label. Timestamps are kept as the strings that were signed so
+// that signatures remain verifiable.
+type Label struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Src           string                 `protobuf:"bytes,1,opt,name=src,proto3" json:"src,omitempty"` // DID of the labeler, or of the repo for self-labels
+	Uri           string                 `protobuf:"bytes,2,opt,name=uri,proto3" json:"uri,omitempty"` // AT URI or DID of the subject
+	Cid           string                 `protobuf:"bytes,3,opt,name=cid,proto3" json:"cid,omitempty"` // optional CID of the subject record
+	Val           string                 `protobuf:"bytes,4,opt,name=val,proto3" json:"val,omitempty"`
+	Neg           bool                   `protobuf:"varint,5,opt,name=neg,proto3" json:"neg,omitempty"` // negates an earlier label with the same src, uri, and val
+	Cts           string                 `protobuf:"bytes,6,opt,name=cts,proto3" json:"cts,omitempty"`
+	Exp           string                 `protobuf:"bytes,7,opt,name=exp,proto3" json:"exp,omitempty"`
+	Sig           []byte                 `protobuf:"bytes,8,opt,name=sig,proto3" json:"sig,omitempty"` // empty for self-labels
+	Ver           int64                  `protobuf:"varint,9,opt,name=ver,proto3" json:"ver,omitempty"`
+	Seq           int64                  `protobuf:"varint,10,opt,name=seq,proto3" json:"seq,omitempty"` // position in the labeler's stream, for labels this PDS issues
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Label) Reset() {
+	*x = Label{}
+	mi := &file_atlas_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Label) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Label) ProtoMessage() {}
+
+func (x *Label) ProtoReflect() protoreflect.Message {
+	mi := &file_atlas_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Label.ProtoReflect.Descriptor instead.
+func (*Label) Descriptor() ([]byte, []int) {
+	return file_atlas_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *Label) GetSrc() string {
+	if x != nil {
+		return x.Src
+	}
+	return ""
+}
+
+func (x *Label) GetUri() string {
+	if x != nil {
+		return x.Uri
+	}
+	return ""
+}
+
+func (x *Label) GetCid() string {
+	if x != nil {
+		return x.Cid
+	}
+	return ""
+}
+
+func (x *Label) GetVal() string {
+	if x != nil {
+		return x.Val
+	}
+	return ""
+}
+
+func (x *Label) GetNeg() bool {
+	if x != nil {
+		return x.Neg
+	}
+	return false
+}
+
+func (x *Label) GetCts() string {
+	if x != nil {
+		return x.Cts
+	}
+	return ""
+}
+
+func (x *Label) GetExp() string {
+	if x != nil {
+		return x.Exp
+	}
+	return ""
+}
+
+func (x *Label) GetSig() []byte {
+	if x != nil {
+		return x.Sig
+	}
+	return nil
+}
+
+func (x *Label) GetVer() int64 {
+	if x != nil {
+		return x.Ver
+	}
+	return 0
+}
+
+func (x *Label) GetSeq() int64 {
+	if x != nil {
+		return x.Seq
+	}
+	return 0
+}
+
+// AuditEvent records an admin or moderation mutation. The event's id is the versionstamp it was
+// stored under.
+type AuditEvent struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"` // hex versionstamp, filled in when read
+	PdsHost       string                 `protobuf:"bytes,2,opt,name=pds_host,json=pdsHost,proto3" json:"pds_host,omitempty"`
+	Actor         string                 `protobuf:"bytes,3,opt,name=actor,proto3" json:"actor,omitempty"`     // DID of the admin, "admin" for the shared password, or "system"
+	Action        string                 `protobuf:"bytes,4,opt,name=action,proto3" json:"action,omitempty"`   // e.g. "com.atproto.admin.updateSubjectStatus"
+	Subject       string                 `protobuf:"bytes,5,opt,name=subject,proto3" json:"subject,omitempty"` // DID, AT URI, or other identifier the action applied to
+	Before        string                 `protobuf:"bytes,6,opt,name=before,proto3" json:"before,omitempty"`   // JSON encoded state before the mutation, if any
+	After         string                 `protobuf:"bytes,7,opt,name=after,proto3" json:"after,omitempty"`     // JSON encoded state after the mutation, if any
+	RequestId     string                 `protobuf:"bytes,8,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"`
+	CreatedAt     *timestamppb.Timestamp `protobuf:"bytes,9,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AuditEvent) Reset() {
+	*x = AuditEvent{}
+	mi := &file_atlas_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AuditEvent) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AuditEvent) ProtoMessage() {}
+
+func (x *AuditEvent) ProtoReflect() protoreflect.Message {
+	mi := &file_atlas_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AuditEvent.ProtoReflect.Descriptor instead.
+func (*AuditEvent) Descriptor() ([]byte, []int) {
+	return file_atlas_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *AuditEvent) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *AuditEvent) GetPdsHost() string {
+	if x != nil {
+		return x.PdsHost
+	}
+	return ""
+}
+
+func (x *AuditEvent) GetActor() string {
+	if x != nil {
+		return x.Actor
+	}
+	return ""
+}
+
+func (x *AuditEvent) GetAction() string {
+	if x != nil {
+		return x.Action
+	}
+	return ""
+}
+
+func (x *AuditEvent) GetSubject() string {
+	if x != nil {
+		return x.Subject
+	}
+	return ""
+}
+
+func (x *AuditEvent) GetBefore() string {
+	if x != nil {
+		return x.Before
+	}
+	return ""
+}
+
+func (x *AuditEvent) GetAfter() string {
+	if x != nil {
+		return x.After
+	}
+	return ""
+}
+
+func (x *AuditEvent) GetRequestId() string {
+	if x != nil {
+		return x.RequestId
+	}
+	return ""
+}
+
+func (x *AuditEvent) GetCreatedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.CreatedAt
+	}
+	return nil
+}
+
+// RegisteredHost is a PDS host stored in the host registry rather than the config file. Its key
+// material is encrypted with the registry's key-encryption key.
+type RegisteredHost struct {
+	state           protoimpl.MessageState `protogen:"open.v1"`
+	Hostname        string                 `protobuf:"bytes,1,opt,name=hostname,proto3" json:"hostname,omitempty"`
+	Config          string                 `protobuf:"bytes,2,opt,name=config,proto3" json:"config,omitempty"`                                            // TOML encoded host config, without key material or secrets
+	JwtSigningKey   *WrappedKey            `protobuf:"bytes,3,opt,name=jwt_signing_key,json=jwtSigningKey,proto3" json:"jwt_signing_key,omitempty"`       // PEM encoded
+	LabelSigningKey *WrappedKey            `protobuf:"bytes,4,opt,name=label_signing_key,json=labelSigningKey,proto3" json:"label_signing_key,omitempty"` // PEM encoded, unset if the host isn't a labeler
+	AdminPassword   *WrappedKey            `protobuf:"bytes,5,opt,name=admin_password,json=adminPassword,proto3" json:"admin_password,omitempty"`         // unset if the admin password is disabled
+	Disabled        bool                   `protobuf:"varint,6,opt,name=disabled,proto3" json:"disabled,omitempty"`
+	CreatedAt       *timestamppb.Timestamp `protobuf:"bytes,7,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
+	UpdatedAt       *timestamppb.Timestamp `protobuf:"bytes,8,opt,name=updated_at,json=updatedAt,proto3" json:"updated_at,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *RegisteredHost) Reset() {
+	*x = RegisteredHost{}
+	mi := &file_atlas_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RegisteredHost) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RegisteredHost) ProtoMessage() {}
+
+func (x *RegisteredHost) ProtoReflect() protoreflect.Message {
+	mi := &file_atlas_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RegisteredHost.ProtoReflect.Descriptor instead.
+func (*RegisteredHost) Descriptor() ([]byte, []int) {
+	return file_atlas_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *RegisteredHost) GetHostname() string {
+	if x != nil {
+		return x.Hostname
+	}
+	return ""
+}
+
+func (x *RegisteredHost) GetConfig() string {
+	if x != nil {
+		return x.Config
+	}
+	return ""
+}
+
+func (x *RegisteredHost) GetJwtSigningKey() *WrappedKey {
+	if x != nil {
+		return x.JwtSigningKey
+	}
+	return nil
+}
+
+func (x *RegisteredHost) GetLabelSigningKey() *WrappedKey {
+	if x != nil {
+		return x.LabelSigningKey
+	}
+	return nil
+}
+
+func (x *RegisteredHost) GetAdminPassword() *WrappedKey {
+	if x != nil {
+		return x.AdminPassword
+	}
+	return nil
+}
+
+func (x *RegisteredHost) GetDisabled() bool {
+	if x != nil {
+		return x.Disabled
+	}
+	return false
+}
+
+func (x *RegisteredHost) GetCreatedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.CreatedAt
+	}
+	return nil
+}
+
+func (x *RegisteredHost) GetUpdatedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.UpdatedAt
+	}
+	return nil
+}
+
+// TLSCacheEntry is an entry of the TLS certificate cache that's shared by every replica, such as an
+// ACME account key or a certificate with its private key. Entries are sealed with the TLS
+// key-encryption key if one is configured.
+type TLSCacheEntry struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Data          []byte                 `protobuf:"bytes,1,opt,name=data,proto3" json:"data,omitempty"`     // set if the entry isn't sealed
+	Sealed        *WrappedKey            `protobuf:"bytes,2,opt,name=sealed,proto3" json:"sealed,omitempty"` // set if the entry is sealed
+	UpdatedAt     *timestamppb.Timestamp `protobuf:"bytes,3,opt,name=updated_at,json=updatedAt,proto3" json:"updated_at,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
-func (x *Blob) Reset() {
-	*x = Blob{}
-	mi := &file_atlas_proto_msgTypes[1]
+func (x *TLSCacheEntry) Reset() {
+	*x = TLSCacheEntry{}
+	mi := &file_atlas_proto_msgTypes[12]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
 
-func (x *Blob) String() string {
+func (x *TLSCacheEntry) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*Blob) ProtoMessage() {}
+func (*TLSCacheEntry) ProtoMessage() {}
 
-func (x *Blob) ProtoReflect() protoreflect.Message {
-	mi := &file_atlas_proto_msgTypes[1]
+func (x *TLSCacheEntry) ProtoReflect() protoreflect.Message {
+	mi := &file_atlas_proto_msgTypes[12]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -267,70 +1310,115 @@ func (x *Blob) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use Blob.ProtoReflect.Descriptor instead.
-func (*Blob) Descriptor() ([]byte, []int) {
-	return file_atlas_proto_rawDescGZIP(), []int{1}
+// Deprecated: Use TLSCacheEntry.ProtoReflect.Descriptor instead.
+func (*TLSCacheEntry) Descriptor() ([]byte, []int) {
+	return file_atlas_proto_rawDescGZIP(), []int{12}
 }
 
-func (x *Blob) GetDid() string {
+func (x *TLSCacheEntry) GetData() []byte {
 	if x != nil {
-		return x.Did
+		return x.Data
 	}
-	return ""
+	return nil
 }
 
-func (x *Blob) GetCid() []byte {
+func (x *TLSCacheEntry) GetSealed() *WrappedKey {
 	if x != nil {
-		return x.Cid
+		return x.Sealed
 	}
 	return nil
 }
 
-func (x *Blob) GetMimeType() string {
+func (x *TLSCacheEntry) GetUpdatedAt() *timestamppb.Timestamp {
 	if x != nil {
-		return x.MimeType
+		return x.UpdatedAt
 	}
-	return ""
+	return nil
 }
 
-func (x *Blob) GetSize() int64 {
+// TLSLock is held by the replica that's ordering a certificate
+type TLSLock struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Holder        string                 `protobuf:"bytes,1,opt,name=holder,proto3" json:"holder,omitempty"`
+	ExpiresAt     *timestamppb.Timestamp `protobuf:"bytes,2,opt,name=expires_at,json=expiresAt,proto3" json:"expires_at,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TLSLock) Reset() {
+	*x = TLSLock{}
+	mi := &file_atlas_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TLSLock) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TLSLock) ProtoMessage() {}
+
+func (x *TLSLock) ProtoReflect() protoreflect.Message {
+	mi := &file_atlas_proto_msgTypes[13]
 	if x != nil {
-		return x.Size
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
 	}
-	return 0
+	return mi.MessageOf(x)
 }
 
-func (x *Blob) GetCreatedAt() *timestamppb.Timestamp {
+// Deprecated: Use TLSLock.ProtoReflect.Descriptor instead.
+func (*TLSLock) Descriptor() ([]byte, []int) {
+	return file_atlas_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *TLSLock) GetHolder() string {
 	if x != nil {
-		return x.CreatedAt
+		return x.Holder
+	}
+	return ""
+}
+
+func (x *TLSLock) GetExpiresAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.ExpiresAt
 	}
 	return nil
 }
 
-type RefreshToken struct {
+// InviteCode gates account creation on hosts that require invites
+type InviteCode struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
-	Token         string                 `protobuf:"bytes,1,opt,name=token,proto3" json:"token,omitempty"`
-	CreatedAt     *timestamppb.Timestamp `protobuf:"bytes,2,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
-	ExpiresAt     *timestamppb.Timestamp `protobuf:"bytes,3,opt,name=expires_at,json=expiresAt,proto3" json:"expires_at,omitempty"`
+	Code          string                 `protobuf:"bytes,1,opt,name=code,proto3" json:"code,omitempty"`
+	PdsHost       string                 `protobuf:"bytes,2,opt,name=pds_host,json=pdsHost,proto3" json:"pds_host,omitempty"` // invite codes may only be used on the host that issued them
+	Available     int64                  `protobuf:"varint,3,opt,name=available,proto3" json:"available,omitempty"`           // total number of times the code may be used
+	Disabled      bool                   `protobuf:"varint,4,opt,name=disabled,proto3" json:"disabled,omitempty"`
+	ForAccount    string                 `protobuf:"bytes,5,opt,name=for_account,json=forAccount,proto3" json:"for_account,omitempty"` // DID of the account the code was issued to, or "admin"
+	CreatedBy     string                 `protobuf:"bytes,6,opt,name=created_by,json=createdBy,proto3" json:"created_by,omitempty"`    // DID of the account that created the code, or "admin"
+	CreatedAt     *timestamppb.Timestamp `protobuf:"bytes,7,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
+	Uses          []*InviteCodeUse       `protobuf:"bytes,8,rep,name=uses,proto3" json:"uses,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
-func (x *RefreshToken) Reset() {
-	*x = RefreshToken{}
-	mi := &file_atlas_proto_msgTypes[2]
+func (x *InviteCode) Reset() {
+	*x = InviteCode{}
+	mi := &file_atlas_proto_msgTypes[14]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
 
-func (x *RefreshToken) String() string {
+func (x *InviteCode) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*RefreshToken) ProtoMessage() {}
+func (*InviteCode) ProtoMessage() {}
 
-func (x *RefreshToken) ProtoReflect() protoreflect.Message {
-	mi := &file_atlas_proto_msgTypes[2]
+func (x *InviteCode) ProtoReflect() protoreflect.Message {
+	mi := &file_atlas_proto_msgTypes[14]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -341,28 +1429,115 @@ func (x *RefreshToken) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use RefreshToken.ProtoReflect.Descriptor instead.
-func (*RefreshToken) Descriptor() ([]byte, []int) {
-	return file_atlas_proto_rawDescGZIP(), []int{2}
+// Deprecated: Use InviteCode.ProtoReflect.Descriptor instead.
+func (*InviteCode) Descriptor() ([]byte, []int) {
+	return file_atlas_proto_rawDescGZIP(), []int{14}
 }
 
-func (x *RefreshToken) GetToken() string {
+func (x *InviteCode) GetCode() string {
 	if x != nil {
-		return x.Token
+		return x.Code
 	}
 	return ""
 }
 
-func (x *RefreshToken) GetCreatedAt() *timestamppb.Timestamp {
+func (x *InviteCode) GetPdsHost() string {
+	if x != nil {
+		return x.PdsHost
+	}
+	return ""
+}
+
+func (x *InviteCode) GetAvailable() int64 {
+	if x != nil {
+		return x.Available
+	}
+	return 0
+}
+
+func (x *InviteCode) GetDisabled() bool {
+	if x != nil {
+		return x.Disabled
+	}
+	return false
+}
+
+func (x *InviteCode) GetForAccount() string {
+	if x != nil {
+		return x.ForAccount
+	}
+	return ""
+}
+
+func (x *InviteCode) GetCreatedBy() string {
+	if x != nil {
+		return x.CreatedBy
+	}
+	return ""
+}
+
+func (x *InviteCode) GetCreatedAt() *timestamppb.Timestamp {
 	if x != nil {
 		return x.CreatedAt
 	}
 	return nil
 }
 
-func (x *RefreshToken) GetExpiresAt() *timestamppb.Timestamp {
+func (x *InviteCode) GetUses() []*InviteCodeUse {
 	if x != nil {
-		return x.ExpiresAt
+		return x.Uses
+	}
+	return nil
+}
+
+type InviteCodeUse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	UsedBy        string                 `protobuf:"bytes,1,opt,name=used_by,json=usedBy,proto3" json:"used_by,omitempty"` // DID of the account that signed up with the code
+	UsedAt        *timestamppb.Timestamp `protobuf:"bytes,2,opt,name=used_at,json=usedAt,proto3" json:"used_at,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *InviteCodeUse) Reset() {
+	*x = InviteCodeUse{}
+	mi := &file_atlas_proto_msgTypes[15]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *InviteCodeUse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*InviteCodeUse) ProtoMessage() {}
+
+func (x *InviteCodeUse) ProtoReflect() protoreflect.Message {
+	mi := &file_atlas_proto_msgTypes[15]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use InviteCodeUse.ProtoReflect.Descriptor instead.
+func (*InviteCodeUse) Descriptor() ([]byte, []int) {
+	return file_atlas_proto_rawDescGZIP(), []int{15}
+}
+
+func (x *InviteCodeUse) GetUsedBy() string {
+	if x != nil {
+		return x.UsedBy
+	}
+	return ""
+}
+
+func (x *InviteCodeUse) GetUsedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.UsedAt
 	}
 	return nil
 }
@@ -382,7 +1557,7 @@ type Record struct {
 
 func (x *Record) Reset() {
 	*x = Record{}
-	mi := &file_atlas_proto_msgTypes[3]
+	mi := &file_atlas_proto_msgTypes[16]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -394,7 +1569,7 @@ func (x *Record) String() string {
 func (*Record) ProtoMessage() {}
 
 func (x *Record) ProtoReflect() protoreflect.Message {
-	mi := &file_atlas_proto_msgTypes[3]
+	mi := &file_atlas_proto_msgTypes[16]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -407,7 +1582,7 @@ func (x *Record) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Record.ProtoReflect.Descriptor instead.
 func (*Record) Descriptor() ([]byte, []int) {
-	return file_atlas_proto_rawDescGZIP(), []int{3}
+	return file_atlas_proto_rawDescGZIP(), []int{16}
 }
 
 func (x *Record) GetDid() string {
@@ -454,7 +1629,7 @@ func (x *Record) GetCreatedAt() *timestamppb.Timestamp {
 
 // RepoEvent represents an event to be streamed via the firehose.
 // Stored in FDB with a versionstamp key for global ordering.
-// Can be a commit, identity, or account event based on event_type.
+// Can be a commit, identity, account, or sync event based on event_type.
 type RepoEvent struct {
 	state protoimpl.MessageState `protogen:"open.v1"`
 	// Sequence number assigned by FDB versionstamp (set after commit)
@@ -463,13 +1638,13 @@ type RepoEvent struct {
 	PdsHost string `protobuf:"bytes,2,opt,name=pds_host,json=pdsHost,proto3" json:"pds_host,omitempty"`
 	// The repo (DID) that was modified (for commits) or the DID (for identity/account)
 	Repo string `protobuf:"bytes,3,opt,name=repo,proto3" json:"repo,omitempty"`
-	// The new revision after this commit (commits only)
+	// The new revision after this commit (commits and syncs only)
 	Rev string `protobuf:"bytes,4,opt,name=rev,proto3" json:"rev,omitempty"`
 	// The previous revision (nil for first commit) (commits only)
 	Since string `protobuf:"bytes,5,opt,name=since,proto3" json:"since,omitempty"`
-	// CID of the commit object (commits only)
+	// CID of the commit object (commits and syncs only)
 	Commit []byte `protobuf:"bytes,6,opt,name=commit,proto3" json:"commit,omitempty"`
-	// CAR file containing the blocks for this commit (commits only)
+	// CAR file containing the blocks for this commit (commits and syncs only)
 	Blocks []byte `protobuf:"bytes,7,opt,name=blocks,proto3" json:"blocks,omitempty"`
 	// Operations performed in this commit (commits only)
 	Ops []*RepoOp `protobuf:"bytes,8,rep,name=ops,proto3" json:"ops,omitempty"`
@@ -477,7 +1652,7 @@ type RepoEvent struct {
 	Time *timestamppb.Timestamp `protobuf:"bytes,9,opt,name=time,proto3" json:"time,omitempty"`
 	// Whether this commit is too big to include blocks inline (commits only)
 	TooBig bool `protobuf:"varint,10,opt,name=too_big,json=tooBig,proto3" json:"too_big,omitempty"`
-	// Type of event (commit, identity, account)
+	// Type of event (commit, identity, account, sync)
 	EventType EventType `protobuf:"varint,11,opt,name=event_type,json=eventType,proto3,enum=types.EventType" json:"event_type,omitempty"`
 	// Handle for identity events
 	Handle string `protobuf:"bytes,12,opt,name=handle,proto3" json:"handle,omitempty"`
@@ -491,7 +1666,7 @@ type RepoEvent struct {
 
 func (x *RepoEvent) Reset() {
 	*x = RepoEvent{}
-	mi := &file_atlas_proto_msgTypes[4]
+	mi := &file_atlas_proto_msgTypes[17]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -503,7 +1678,7 @@ func (x *RepoEvent) String() string {
 func (*RepoEvent) ProtoMessage() {}
 
 func (x *RepoEvent) ProtoReflect() protoreflect.Message {
-	mi := &file_atlas_proto_msgTypes[4]
+	mi := &file_atlas_proto_msgTypes[17]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -516,7 +1691,7 @@ func (x *RepoEvent) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use RepoEvent.ProtoReflect.Descriptor instead.
 func (*RepoEvent) Descriptor() ([]byte, []int) {
-	return file_atlas_proto_rawDescGZIP(), []int{4}
+	return file_atlas_proto_rawDescGZIP(), []int{17}
 }
 
 func (x *RepoEvent) GetSeq() int64 {
@@ -632,7 +1807,7 @@ type RepoOp struct {
 
 func (x *RepoOp) Reset() {
 	*x = RepoOp{}
-	mi := &file_atlas_proto_msgTypes[5]
+	mi := &file_atlas_proto_msgTypes[18]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -644,7 +1819,7 @@ func (x *RepoOp) String() string {
 func (*RepoOp) ProtoMessage() {}
 
 func (x *RepoOp) ProtoReflect() protoreflect.Message {
-	mi := &file_atlas_proto_msgTypes[5]
+	mi := &file_atlas_proto_msgTypes[18]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -657,7 +1832,7 @@ func (x *RepoOp) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use RepoOp.ProtoReflect.Descriptor instead.
 func (*RepoOp) Descriptor() ([]byte, []int) {
-	return file_atlas_proto_rawDescGZIP(), []int{5}
+	return file_atlas_proto_rawDescGZIP(), []int{18}
 }
 
 func (x *RepoOp) GetAction() string {
@@ -685,7 +1860,7 @@ var File_atlas_proto protoreflect.FileDescriptor
 
 const file_atlas_proto_rawDesc = "" +
 	"\n" +
-	"\vatlas.proto\x12\x05types\x1a\x1fgoogle/protobuf/timestamp.proto\"\x85\x04\n" +
+	"\vatlas.proto\x12\x05types\x1a\x1fgoogle/protobuf/timestamp.proto\"\xfb\a\n" +
 	"\x05Actor\x12\x10\n" +
 	"\x03did\x18\x01 \x01(\tR\x03did\x129\n" +
 	"\n" +
@@ -699,12 +1874,39 @@ const file_atlas_proto_rawDesc = "" +
 	"\x06handle\x18\b \x01(\tR\x06handle\x12\x16\n" +
 	"\x06active\x18\t \x01(\bR\x06active\x12#\n" +
 	"\rrotation_keys\x18\n" +
-	" \x03(\fR\frotationKeys\x12:\n" +
-	"\x0erefresh_tokens\x18\v \x03(\v2\x13.types.RefreshTokenR\rrefreshTokens\x12\x12\n" +
+	" \x03(\fR\frotationKeys\x12>\n" +
+	"\x0erefresh_tokens\x18\v \x03(\v2\x13.types.RefreshTokenB\x02\x18\x01R\rrefreshTokens\x12\x12\n" +
 	"\x04head\x18\f \x01(\tR\x04head\x12\x10\n" +
 	"\x03rev\x18\r \x01(\tR\x03rev\x12\x19\n" +
 	"\bpds_host\x18\x0e \x01(\tR\apdsHost\x12 \n" +
-	"\vpreferences\x18\x0f \x01(\fR\vpreferences\"\x96\x01\n" +
+	"\vpreferences\x18\x0f \x01(\fR\vpreferences\x12.\n" +
+	"\x13pending_signing_key\x18\x10 \x01(\fR\x11pendingSigningKey\x12J\n" +
+	"\x14retired_signing_keys\x18\x11 \x03(\v2\x18.types.RetiredSigningKeyR\x12retiredSigningKeys\x12A\n" +
+	"\x13wrapped_signing_key\x18\x12 \x01(\v2\x11.types.WrappedKeyR\x11wrappedSigningKey\x12E\n" +
+	"\x15wrapped_rotation_keys\x18\x13 \x03(\v2\x11.types.WrappedKeyR\x13wrappedRotationKeys\x12P\n" +
+	"\x1bwrapped_pending_signing_key\x18\x14 \x01(\v2\x11.types.WrappedKeyR\x18wrappedPendingSigningKey\x12\x1f\n" +
+	"\vinvite_code\x18\x15 \x01(\tR\n" +
+	"inviteCode\x12)\n" +
+	"\x10invites_disabled\x18\x16 \x01(\bR\x0finvitesDisabled\x12\x1f\n" +
+	"\vinvite_note\x18\x17 \x01(\tR\n" +
+	"inviteNote\x12+\n" +
+	"\btakedown\x18\x18 \x01(\v2\x0f.types.TakedownR\btakedown\"d\n" +
+	"\n" +
+	"WrappedKey\x12\x15\n" +
+	"\x06kek_id\x18\x01 \x01(\tR\x05kekId\x12\x1f\n" +
+	"\vwrapped_dek\x18\x02 \x01(\fR\n" +
+	"wrappedDek\x12\x1e\n" +
+	"\n" +
+	"ciphertext\x18\x03 \x01(\fR\n" +
+	"ciphertext\"\xcf\x01\n" +
+	"\x11RetiredSigningKey\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\fR\x03key\x129\n" +
+	"\n" +
+	"retired_at\x18\x02 \x01(\v2\x1a.google.protobuf.TimestampR\tretiredAt\x129\n" +
+	"\n" +
+	"expires_at\x18\x03 \x01(\v2\x1a.google.protobuf.TimestampR\texpiresAt\x122\n" +
+	"\vwrapped_key\x18\x04 \x01(\v2\x11.types.WrappedKeyR\n" +
+	"wrappedKey\"\x96\x01\n" +
 	"\x04Blob\x12\x10\n" +
 	"\x03did\x18\x01 \x01(\tR\x03did\x12\x10\n" +
 	"\x03cid\x18\x02 \x01(\fR\x03cid\x12\x1b\n" +
@@ -717,7 +1919,114 @@ const file_atlas_proto_rawDesc = "" +
 	"\n" +
 	"created_at\x18\x02 \x01(\v2\x1a.google.protobuf.TimestampR\tcreatedAt\x129\n" +
 	"\n" +
-	"expires_at\x18\x03 \x01(\v2\x1a.google.protobuf.TimestampR\texpiresAt\"\xb1\x01\n" +
+	"expires_at\x18\x03 \x01(\v2\x1a.google.protobuf.TimestampR\texpiresAt\"\xe7\x02\n" +
+	"\x0eRefreshSession\x12\x10\n" +
+	"\x03did\x18\x01 \x01(\tR\x03did\x12\x10\n" +
+	"\x03jti\x18\x02 \x01(\tR\x03jti\x12\x16\n" +
+	"\x06family\x18\x03 \x01(\tR\x06family\x12\x1d\n" +
+	"\n" +
+	"token_hash\x18\x04 \x01(\fR\ttokenHash\x129\n" +
+	"\n" +
+	"created_at\x18\x05 \x01(\v2\x1a.google.protobuf.TimestampR\tcreatedAt\x129\n" +
+	"\n" +
+	"expires_at\x18\x06 \x01(\v2\x1a.google.protobuf.TimestampR\texpiresAt\x12F\n" +
+	"\x11family_created_at\x18\a \x01(\v2\x1a.google.protobuf.TimestampR\x0ffamilyCreatedAt\x12\x1d\n" +
+	"\n" +
+	"rotated_to\x18\b \x01(\tR\trotatedTo\x12\x1d\n" +
+	"\n" +
+	"user_agent\x18\t \x01(\tR\tuserAgent\"\xa8\x01\n" +
+	"\fLoginLockout\x12\x1a\n" +
+	"\bfailures\x18\x01 \x01(\x03R\bfailures\x12=\n" +
+	"\flast_failure\x18\x02 \x01(\v2\x1a.google.protobuf.TimestampR\vlastFailure\x12=\n" +
+	"\flocked_until\x18\x03 \x01(\v2\x1a.google.protobuf.TimestampR\vlockedUntil\"W\n" +
+	"\bTakedown\x12\x10\n" +
+	"\x03ref\x18\x01 \x01(\tR\x03ref\x129\n" +
+	"\n" +
+	"created_at\x18\x02 \x01(\v2\x1a.google.protobuf.TimestampR\tcreatedAt\"\xd5\x03\n" +
+	"\x06Report\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\x03R\x02id\x12\x19\n" +
+	"\bpds_host\x18\x02 \x01(\tR\apdsHost\x12\x1f\n" +
+	"\vreported_by\x18\x03 \x01(\tR\n" +
+	"reportedBy\x12\x1f\n" +
+	"\vreason_type\x18\x04 \x01(\tR\n" +
+	"reasonType\x12\x16\n" +
+	"\x06reason\x18\x05 \x01(\tR\x06reason\x12\x1f\n" +
+	"\vsubject_did\x18\x06 \x01(\tR\n" +
+	"subjectDid\x12\x1f\n" +
+	"\vsubject_uri\x18\a \x01(\tR\n" +
+	"subjectUri\x12\x1f\n" +
+	"\vsubject_cid\x18\b \x01(\tR\n" +
+	"subjectCid\x129\n" +
+	"\n" +
+	"created_at\x18\t \x01(\v2\x1a.google.protobuf.TimestampR\tcreatedAt\x12!\n" +
+	"\fforwarded_id\x18\n" +
+	" \x01(\x03R\vforwardedId\x12;\n" +
+	"\vresolved_at\x18\v \x01(\v2\x1a.google.protobuf.TimestampR\n" +
+	"resolvedAt\x12\x1f\n" +
+	"\vresolved_by\x18\f \x01(\tR\n" +
+	"resolvedBy\x12'\n" +
+	"\x0fresolution_note\x18\r \x01(\tR\x0eresolutionNote\"\xbb\x01\n" +
+	"\x05Label\x12\x10\n" +
+	"\x03src\x18\x01 \x01(\tR\x03src\x12\x10\n" +
+	"\x03uri\x18\x02 \x01(\tR\x03uri\x12\x10\n" +
+	"\x03cid\x18\x03 \x01(\tR\x03cid\x12\x10\n" +
+	"\x03val\x18\x04 \x01(\tR\x03val\x12\x10\n" +
+	"\x03neg\x18\x05 \x01(\bR\x03neg\x12\x10\n" +
+	"\x03cts\x18\x06 \x01(\tR\x03cts\x12\x10\n" +
+	"\x03exp\x18\a \x01(\tR\x03exp\x12\x10\n" +
+	"\x03sig\x18\b \x01(\fR\x03sig\x12\x10\n" +
+	"\x03ver\x18\t \x01(\x03R\x03ver\x12\x10\n" +
+	"\x03seq\x18\n" +
+	" \x01(\x03R\x03seq\"\x87\x02\n" +
+	"\n" +
+	"AuditEvent\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x19\n" +
+	"\bpds_host\x18\x02 \x01(\tR\apdsHost\x12\x14\n" +
+	"\x05actor\x18\x03 \x01(\tR\x05actor\x12\x16\n" +
+	"\x06action\x18\x04 \x01(\tR\x06action\x12\x18\n" +
+	"\asubject\x18\x05 \x01(\tR\asubject\x12\x16\n" +
+	"\x06before\x18\x06 \x01(\tR\x06before\x12\x14\n" +
+	"\x05after\x18\a \x01(\tR\x05after\x12\x1d\n" +
+	"\n" +
+	"request_id\x18\b \x01(\tR\trequestId\x129\n" +
+	"\n" +
+	"created_at\x18\t \x01(\v2\x1a.google.protobuf.TimestampR\tcreatedAt\"\x8a\x03\n" +
+	"\x0eRegisteredHost\x12\x1a\n" +
+	"\bhostname\x18\x01 \x01(\tR\bhostname\x12\x16\n" +
+	"\x06config\x18\x02 \x01(\tR\x06config\x129\n" +
+	"\x0fjwt_signing_key\x18\x03 \x01(\v2\x11.types.WrappedKeyR\rjwtSigningKey\x12=\n" +
+	"\x11label_signing_key\x18\x04 \x01(\v2\x11.types.WrappedKeyR\x0flabelSigningKey\x128\n" +
+	"\x0eadmin_password\x18\x05 \x01(\v2\x11.types.WrappedKeyR\radminPassword\x12\x1a\n" +
+	"\bdisabled\x18\x06 \x01(\bR\bdisabled\x129\n" +
+	"\n" +
+	"created_at\x18\a \x01(\v2\x1a.google.protobuf.TimestampR\tcreatedAt\x129\n" +
+	"\n" +
+	"updated_at\x18\b \x01(\v2\x1a.google.protobuf.TimestampR\tupdatedAt\"\x89\x01\n" +
+	"\rTLSCacheEntry\x12\x12\n" +
+	"\x04data\x18\x01 \x01(\fR\x04data\x12)\n" +
+	"\x06sealed\x18\x02 \x01(\v2\x11.types.WrappedKeyR\x06sealed\x129\n" +
+	"\n" +
+	"updated_at\x18\x03 \x01(\v2\x1a.google.protobuf.TimestampR\tupdatedAt\"\\\n" +
+	"\aTLSLock\x12\x16\n" +
+	"\x06holder\x18\x01 \x01(\tR\x06holder\x129\n" +
+	"\n" +
+	"expires_at\x18\x02 \x01(\v2\x1a.google.protobuf.TimestampR\texpiresAt\"\x9a\x02\n" +
+	"\n" +
+	"InviteCode\x12\x12\n" +
+	"\x04code\x18\x01 \x01(\tR\x04code\x12\x19\n" +
+	"\bpds_host\x18\x02 \x01(\tR\apdsHost\x12\x1c\n" +
+	"\tavailable\x18\x03 \x01(\x03R\tavailable\x12\x1a\n" +
+	"\bdisabled\x18\x04 \x01(\bR\bdisabled\x12\x1f\n" +
+	"\vfor_account\x18\x05 \x01(\tR\n" +
+	"forAccount\x12\x1d\n" +
+	"\n" +
+	"created_by\x18\x06 \x01(\tR\tcreatedBy\x129\n" +
+	"\n" +
+	"created_at\x18\a \x01(\v2\x1a.google.protobuf.TimestampR\tcreatedAt\x12(\n" +
+	"\x04uses\x18\b \x03(\v2\x14.types.InviteCodeUseR\x04uses\"]\n" +
+	"\rInviteCodeUse\x12\x17\n" +
+	"\aused_by\x18\x01 \x01(\tR\x06usedBy\x123\n" +
+	"\aused_at\x18\x02 \x01(\v2\x1a.google.protobuf.TimestampR\x06usedAt\"\xb1\x01\n" +
 	"\x06Record\x12\x10\n" +
 	"\x03did\x18\x01 \x01(\tR\x03did\x12\x1e\n" +
 	"\n" +
@@ -748,12 +2057,13 @@ const file_atlas_proto_rawDesc = "" +
 	"\x06RepoOp\x12\x16\n" +
 	"\x06action\x18\x01 \x01(\tR\x06action\x12\x12\n" +
 	"\x04path\x18\x02 \x01(\tR\x04path\x12\x10\n" +
-	"\x03cid\x18\x03 \x01(\fR\x03cid*o\n" +
+	"\x03cid\x18\x03 \x01(\fR\x03cid*\x84\x01\n" +
 	"\tEventType\x12\x1a\n" +
 	"\x16EVENT_TYPE_UNSPECIFIED\x10\x00\x12\x15\n" +
 	"\x11EVENT_TYPE_COMMIT\x10\x01\x12\x17\n" +
 	"\x13EVENT_TYPE_IDENTITY\x10\x02\x12\x16\n" +
-	"\x12EVENT_TYPE_ACCOUNT\x10\x03B*Z(github.com/jcalabro/atlas/internal/typesb\x06proto3"
+	"\x12EVENT_TYPE_ACCOUNT\x10\x03\x12\x13\n" +
+	"\x0fEVENT_TYPE_SYNC\x10\x04B*Z(github.com/jcalabro/atlas/internal/typesb\x06proto3"
 
 var (
 	file_atlas_proto_rawDescOnce sync.Once
@@ -768,32 +2078,73 @@ func file_atlas_proto_rawDescGZIP() []byte {
 }
 
 var file_atlas_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
-var file_atlas_proto_msgTypes = make([]protoimpl.MessageInfo, 6)
+var file_atlas_proto_msgTypes = make([]protoimpl.MessageInfo, 19)
 var file_atlas_proto_goTypes = []any{
 	(EventType)(0),                // 0: types.EventType
 	(*Actor)(nil),                 // 1: types.Actor
-	(*Blob)(nil),                  // 2: types.Blob
-	(*RefreshToken)(nil),          // 3: types.RefreshToken
-	(*Record)(nil),                // 4: types.Record
-	(*RepoEvent)(nil),             // 5: types.RepoEvent
-	(*RepoOp)(nil),                // 6: types.RepoOp
-	(*timestamppb.Timestamp)(nil), // 7: google.protobuf.Timestamp
+	(*WrappedKey)(nil),            // 2: types.WrappedKey
+	(*RetiredSigningKey)(nil),     // 3: types.RetiredSigningKey
+	(*Blob)(nil),                  // 4: types.Blob
+	(*RefreshToken)(nil),          // 5: types.RefreshToken
+	(*RefreshSession)(nil),        // 6: types.RefreshSession
+	(*LoginLockout)(nil),          // 7: types.LoginLockout
+	(*Takedown)(nil),              // 8: types.Takedown
+	(*Report)(nil),                // 9: types.Report
+	(*Label)(nil),                 // 10: types.Label
+	(*AuditEvent)(nil),            // 11: types.AuditEvent
+	(*RegisteredHost)(nil),        // 12: types.RegisteredHost
+	(*TLSCacheEntry)(nil),         // 13: types.TLSCacheEntry
+	(*TLSLock)(nil),               // 14: types.TLSLock
+	(*InviteCode)(nil),            // 15: types.InviteCode
+	(*InviteCodeUse)(nil),         // 16: types.InviteCodeUse
+	(*Record)(nil),                // 17: types.Record
+	(*RepoEvent)(nil),             // 18: types.RepoEvent
+	(*RepoOp)(nil),                // 19: types.RepoOp
+	(*timestamppb.Timestamp)(nil), // 20: google.protobuf.Timestamp
 }
 var file_atlas_proto_depIdxs = []int32{
-	7, // 0: types.Actor.created_at:type_name -> google.protobuf.Timestamp
-	3, // 1: types.Actor.refresh_tokens:type_name -> types.RefreshToken
-	7, // 2: types.Blob.created_at:type_name -> google.protobuf.Timestamp
-	7, // 3: types.RefreshToken.created_at:type_name -> google.protobuf.Timestamp
-	7, // 4: types.RefreshToken.expires_at:type_name -> google.protobuf.Timestamp
-	7, // 5: types.Record.created_at:type_name -> google.protobuf.Timestamp
-	6, // 6: types.RepoEvent.ops:type_name -> types.RepoOp
-	7, // 7: types.RepoEvent.time:type_name -> google.protobuf.Timestamp
-	0, // 8: types.RepoEvent.event_type:type_name -> types.EventType
-	9, // [9:9] is the sub-list for method output_type
-	9, // [9:9] is the sub-list for method input_type
-	9, // [9:9] is the sub-list for extension type_name
-	9, // [9:9] is the sub-list for extension extendee
-	0, // [0:9] is the sub-list for field type_name
+	20, // 0: types.Actor.created_at:type_name -> google.protobuf.Timestamp
+	5,  // 1: types.Actor.refresh_tokens:type_name -> types.RefreshToken
+	3,  // 2: types.Actor.retired_signing_keys:type_name -> types.RetiredSigningKey
+	2,  // 3: types.Actor.wrapped_signing_key:type_name -> types.WrappedKey
+	2,  // 4: types.Actor.wrapped_rotation_keys:type_name -> types.WrappedKey
+	2,  // 5: types.Actor.wrapped_pending_signing_key:type_name -> types.WrappedKey
+	8,  // 6: types.Actor.takedown:type_name -> types.Takedown
+	20, // 7: types.RetiredSigningKey.retired_at:type_name -> google.protobuf.Timestamp
+	20, // 8: types.RetiredSigningKey.expires_at:type_name -> google.protobuf.Timestamp
+	2,  // 9: types.RetiredSigningKey.wrapped_key:type_name -> types.WrappedKey
+	20, // 10: types.Blob.created_at:type_name -> google.protobuf.Timestamp
+	20, // 11: types.RefreshToken.created_at:type_name -> google.protobuf.Timestamp
+	20, // 12: types.RefreshToken.expires_at:type_name -> google.protobuf.Timestamp
+	20, // 13: types.RefreshSession.created_at:type_name -> google.protobuf.Timestamp
+	20, // 14: types.RefreshSession.expires_at:type_name -> google.protobuf.Timestamp
+	20, // 15: types.RefreshSession.family_created_at:type_name -> google.protobuf.Timestamp
+	20, // 16: types.LoginLockout.last_failure:type_name -> google.protobuf.Timestamp
+	20, // 17: types.LoginLockout.locked_until:type_name -> google.protobuf.Timestamp
+	20, // 18: types.Takedown.created_at:type_name -> google.protobuf.Timestamp
+	20, // 19: types.Report.created_at:type_name -> google.protobuf.Timestamp
+	20, // 20: types.Report.resolved_at:type_name -> google.protobuf.Timestamp
+	20, // 21: types.AuditEvent.created_at:type_name -> google.protobuf.Timestamp
+	2,  // 22: types.RegisteredHost.jwt_signing_key:type_name -> types.WrappedKey
+	2,  // 23: types.RegisteredHost.label_signing_key:type_name -> types.WrappedKey
+	2,  // 24: types.RegisteredHost.admin_password:type_name -> types.WrappedKey
+	20, // 25: types.RegisteredHost.created_at:type_name -> google.protobuf.Timestamp
+	20, // 26: types.RegisteredHost.updated_at:type_name -> google.protobuf.Timestamp
+	2,  // 27: types.TLSCacheEntry.sealed:type_name -> types.WrappedKey
+	20, // 28: types.TLSCacheEntry.updated_at:type_name -> google.protobuf.Timestamp
+	20, // 29: types.TLSLock.expires_at:type_name -> google.protobuf.Timestamp
+	20, // 30: types.InviteCode.created_at:type_name -> google.protobuf.Timestamp
+	16, // 31: types.InviteCode.uses:type_name -> types.InviteCodeUse
+	20, // 32: types.InviteCodeUse.used_at:type_name -> google.protobuf.Timestamp
+	20, // 33: types.Record.created_at:type_name -> google.protobuf.Timestamp
+	19, // 34: types.RepoEvent.ops:type_name -> types.RepoOp
+	20, // 35: types.RepoEvent.time:type_name -> google.protobuf.Timestamp
+	0,  // 36: types.RepoEvent.event_type:type_name -> types.EventType
+	37, // [37:37] is the sub-list for method output_type
+	37, // [37:37] is the sub-list for method input_type
+	37, // [37:37] is the sub-list for extension type_name
+	37, // [37:37] is the sub-list for extension extendee
+	0,  // [0:37] is the sub-list for field type_name
 }
 
 func init() { file_atlas_proto_init() }
@@ -807,7 +2158,7 @@ func file_atlas_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_atlas_proto_rawDesc), len(file_atlas_proto_rawDesc)),
 			NumEnums:      1,
-			NumMessages:   6,
+			NumMessages:   19,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
@@ -0,0 +1,87 @@
+package verify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// HCaptchaEndpoint is hCaptcha's token verification endpoint
+	HCaptchaEndpoint = "https://api.hcaptcha.com/siteverify"
+
+	// TurnstileEndpoint is Cloudflare Turnstile's token verification endpoint
+	TurnstileEndpoint = "https://challenges.cloudflare.com/turnstile/v0/siteverify"
+)
+
+// Captcha verifies captcha response tokens with a siteverify endpoint, such as hCaptcha's or
+// Cloudflare Turnstile's, which share the same API
+type Captcha struct {
+	client   *http.Client
+	endpoint string
+	secret   string
+}
+
+// NewCaptcha creates a verifier that checks tokens with the given siteverify endpoint
+func NewCaptcha(endpoint, secret string) (*Captcha, error) {
+	if endpoint == "" {
+		return nil, fmt.Errorf("captcha endpoint is required")
+	}
+	if secret == "" {
+		return nil, fmt.Errorf("captcha secret is required")
+	}
+
+	return &Captcha{
+		client:   newHTTPClient(),
+		endpoint: endpoint,
+		secret:   secret,
+	}, nil
+}
+
+type siteverifyResponse struct {
+	Success    bool     `json:"success"`
+	ErrorCodes []string `json:"error-codes"`
+}
+
+func (c *Captcha) Verify(ctx context.Context, sub *Submission) error {
+	if sub.Code == "" {
+		return fmt.Errorf("%w: captcha token is required", ErrVerificationFailed)
+	}
+
+	form := url.Values{
+		"secret":   {c.secret},
+		"response": {sub.Code},
+	}
+	if sub.RemoteIP != "" {
+		form.Set("remoteip", sub.RemoteIP)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to create captcha request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to verify captcha: %w", err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("captcha verification returned status %d", resp.StatusCode)
+	}
+
+	var out siteverifyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return fmt.Errorf("failed to decode captcha response: %w", err)
+	}
+	if !out.Success {
+		return fmt.Errorf("%w: captcha rejected (%s)", ErrVerificationFailed, strings.Join(out.ErrorCodes, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package verify
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Fake is a Verifier that accepts a fixed code, for tests and local development
+type Fake struct {
+	// Code is the only code that's accepted
+	Code string
+}
+
+func (f *Fake) Verify(_ context.Context, sub *Submission) error {
+	if sub.Code == "" || sub.Code != f.Code {
+		return fmt.Errorf("%w: invalid verification code", ErrVerificationFailed)
+	}
+	return nil
+}
+
+// FakePhone is a PhoneVerifier that accepts a fixed code, as long as it was "sent" to the
+// submitted phone number first. It's meant for tests and local development.
+type FakePhone struct {
+	Fake
+
+	mu   sync.Mutex
+	sent map[string]bool
+}
+
+// NewFakePhone creates a fake phone verifier that accepts the given code
+func NewFakePhone(code string) *FakePhone {
+	return &FakePhone{Fake: Fake{Code: code}}
+}
+
+func (f *FakePhone) SendCode(_ context.Context, phone string) error {
+	if phone == "" {
+		return fmt.Errorf("%w: phone number is required", ErrVerificationFailed)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.sent == nil {
+		f.sent = make(map[string]bool)
+	}
+	f.sent[phone] = true
+
+	return nil
+}
+
+// Sent returns true if a code was sent to the given phone number
+func (f *FakePhone) Sent(phone string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.sent[phone]
+}
+
+func (f *FakePhone) Verify(ctx context.Context, sub *Submission) error {
+	if !f.Sent(sub.Phone) {
+		return fmt.Errorf("%w: no code was sent to this phone number", ErrVerificationFailed)
+	}
+	return f.Fake.Verify(ctx, sub)
+}
@@ -0,0 +1,134 @@
+package verify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// TwilioEndpoint is the base URL of the Twilio Verify API
+const TwilioEndpoint = "https://verify.twilio.com"
+
+// Twilio sends and checks SMS codes with a Twilio Verify service, which keeps track of the codes
+// it has sent so that we don't have to
+type Twilio struct {
+	client     *http.Client
+	endpoint   string
+	accountSID string
+	authToken  string
+	serviceSID string
+}
+
+// TwilioArgs configures a Twilio Verify client
+type TwilioArgs struct {
+	// Endpoint defaults to TwilioEndpoint
+	Endpoint string
+
+	AccountSID string
+	AuthToken  string
+	ServiceSID string
+}
+
+// NewTwilio creates a phone verifier backed by the given Twilio Verify service
+func NewTwilio(args *TwilioArgs) (*Twilio, error) {
+	switch {
+	case args.AccountSID == "":
+		return nil, fmt.Errorf("twilio account sid is required")
+	case args.AuthToken == "":
+		return nil, fmt.Errorf("twilio auth token is required")
+	case args.ServiceSID == "":
+		return nil, fmt.Errorf("twilio verify service sid is required")
+	}
+
+	endpoint := args.Endpoint
+	if endpoint == "" {
+		endpoint = TwilioEndpoint
+	}
+
+	return &Twilio{
+		client:     newHTTPClient(),
+		endpoint:   strings.TrimSuffix(endpoint, "/"),
+		accountSID: args.AccountSID,
+		authToken:  args.AuthToken,
+		serviceSID: args.ServiceSID,
+	}, nil
+}
+
+type twilioVerification struct {
+	Status string `json:"status"`
+}
+
+// post calls a Twilio Verify service endpoint. Returns a nil verification if Twilio responded with
+// a 404, which it does for codes that were never sent or have expired.
+func (t *Twilio) post(ctx context.Context, path string, form url.Values) (*twilioVerification, error) {
+	u := fmt.Sprintf("%s/v2/Services/%s/%s", t.endpoint, url.PathEscape(t.serviceSID), path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create twilio request: %w", err)
+	}
+	req.SetBasicAuth(t.accountSID, t.authToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call twilio: %w", err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, nil
+	case resp.StatusCode == http.StatusBadRequest:
+		return nil, fmt.Errorf("%w: twilio rejected the request", ErrVerificationFailed)
+	case resp.StatusCode >= 300:
+		return nil, fmt.Errorf("twilio returned status %d", resp.StatusCode)
+	}
+
+	var out twilioVerification
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("failed to decode twilio response: %w", err)
+	}
+
+	return &out, nil
+}
+
+func (t *Twilio) SendCode(ctx context.Context, phone string) error {
+	if phone == "" {
+		return fmt.Errorf("%w: phone number is required", ErrVerificationFailed)
+	}
+
+	out, err := t.post(ctx, "Verifications", url.Values{
+		"To":      {phone},
+		"Channel": {"sms"},
+	})
+	if err != nil {
+		return err
+	}
+	if out == nil {
+		return fmt.Errorf("twilio verify service %q not found", t.serviceSID)
+	}
+
+	return nil
+}
+
+func (t *Twilio) Verify(ctx context.Context, sub *Submission) error {
+	if sub.Phone == "" || sub.Code == "" {
+		return fmt.Errorf("%w: phone number and verification code are required", ErrVerificationFailed)
+	}
+
+	out, err := t.post(ctx, "VerificationCheck", url.Values{
+		"To":   {sub.Phone},
+		"Code": {sub.Code},
+	})
+	if err != nil {
+		return err
+	}
+	if out == nil || out.Status != "approved" {
+		return fmt.Errorf("%w: invalid or expired verification code", ErrVerificationFailed)
+	}
+
+	return nil
+}
@@ -0,0 +1,46 @@
+// Package verify checks that account signups were made by a human before they're accepted, with
+// a captcha token or a code sent to the user's phone by SMS.
+package verify
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// requestTimeout bounds each call to a verification provider
+const requestTimeout = 10 * time.Second
+
+// ErrVerificationFailed is returned when a signup's proof is missing, invalid, or expired
+var ErrVerificationFailed = errors.New("signup verification failed")
+
+// Submission is the proof that's supplied with a signup
+type Submission struct {
+	// Code is the captcha response token, or the code that was sent to Phone
+	Code string
+
+	// Phone is the phone number that Code was sent to, if phone verification is used
+	Phone string
+
+	// RemoteIP is the address of the client that's signing up
+	RemoteIP string
+}
+
+// Verifier checks a signup's proof. Verify returns an error wrapping ErrVerificationFailed if
+// the proof is rejected, or another error if the provider couldn't be reached.
+type Verifier interface {
+	Verify(ctx context.Context, sub *Submission) error
+}
+
+// PhoneVerifier is a Verifier that checks codes sent to the user's phone. SendCode must be called
+// before the signup to send a code to the given phone number.
+type PhoneVerifier interface {
+	Verifier
+
+	SendCode(ctx context.Context, phone string) error
+}
+
+func newHTTPClient() *http.Client {
+	return &http.Client{Timeout: requestTimeout}
+}
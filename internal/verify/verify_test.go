@@ -0,0 +1,130 @@
+package verify
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCaptcha(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		resp := siteverifyResponse{Success: r.PostForm.Get("secret") == "secret" && r.PostForm.Get("response") == "good"}
+		if !resp.Success {
+			resp.ErrorCodes = []string{"invalid-input-response"}
+		}
+		if r.PostForm.Get("remoteip") != "192.0.2.1" {
+			resp = siteverifyResponse{ErrorCodes: []string{"missing-remoteip"}}
+		}
+
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(srv.Close)
+
+	captcha, err := NewCaptcha(srv.URL, "secret")
+	require.NoError(t, err)
+
+	require.NoError(t, captcha.Verify(t.Context(), &Submission{Code: "good", RemoteIP: "192.0.2.1"}))
+
+	err = captcha.Verify(t.Context(), &Submission{Code: "bad", RemoteIP: "192.0.2.1"})
+	require.ErrorIs(t, err, ErrVerificationFailed)
+	require.ErrorContains(t, err, "invalid-input-response")
+
+	err = captcha.Verify(t.Context(), &Submission{RemoteIP: "192.0.2.1"})
+	require.ErrorIs(t, err, ErrVerificationFailed)
+
+	// provider outages aren't verification failures
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(down.Close)
+
+	broken, err := NewCaptcha(down.URL, "secret")
+	require.NoError(t, err)
+	err = broken.Verify(t.Context(), &Submission{Code: "good", RemoteIP: "192.0.2.1"})
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ErrVerificationFailed)
+
+	_, err = NewCaptcha(srv.URL, "")
+	require.Error(t, err)
+}
+
+func TestTwilio(t *testing.T) {
+	t.Parallel()
+
+	sent := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "AC123" || pass != "token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/v2/Services/VA123/Verifications":
+			sent <- r.PostForm.Get("To")
+			_ = json.NewEncoder(w).Encode(twilioVerification{Status: "pending"})
+		case "/v2/Services/VA123/VerificationCheck":
+			status := "pending"
+			if r.PostForm.Get("Code") == "123456" {
+				status = "approved"
+			}
+			_ = json.NewEncoder(w).Encode(twilioVerification{Status: status})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	twilio, err := NewTwilio(&TwilioArgs{
+		Endpoint:   srv.URL,
+		AccountSID: "AC123",
+		AuthToken:  "token",
+		ServiceSID: "VA123",
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, twilio.SendCode(t.Context(), "+15555550123"))
+	require.Equal(t, "+15555550123", <-sent)
+
+	require.NoError(t, twilio.Verify(t.Context(), &Submission{Phone: "+15555550123", Code: "123456"}))
+	require.ErrorIs(t, twilio.Verify(t.Context(), &Submission{Phone: "+15555550123", Code: "000000"}), ErrVerificationFailed)
+	require.ErrorIs(t, twilio.Verify(t.Context(), &Submission{Code: "123456"}), ErrVerificationFailed)
+
+	wrongService, err := NewTwilio(&TwilioArgs{Endpoint: srv.URL, AccountSID: "AC123", AuthToken: "token", ServiceSID: "VA999"})
+	require.NoError(t, err)
+	require.Error(t, wrongService.SendCode(t.Context(), "+15555550123"))
+
+	_, err = NewTwilio(&TwilioArgs{AccountSID: "AC123"})
+	require.Error(t, err)
+}
+
+func TestFake(t *testing.T) {
+	t.Parallel()
+
+	fake := &Fake{Code: "code"}
+	require.NoError(t, fake.Verify(t.Context(), &Submission{Code: "code"}))
+	require.ErrorIs(t, fake.Verify(t.Context(), &Submission{Code: "nope"}), ErrVerificationFailed)
+
+	phone := NewFakePhone("code")
+	require.ErrorIs(t, phone.Verify(t.Context(), &Submission{Phone: "+15555550123", Code: "code"}), ErrVerificationFailed)
+	require.NoError(t, phone.SendCode(t.Context(), "+15555550123"))
+	require.True(t, phone.Sent("+15555550123"))
+	require.NoError(t, phone.Verify(t.Context(), &Submission{Phone: "+15555550123", Code: "code"}))
+	require.ErrorIs(t, phone.Verify(t.Context(), &Submission{Phone: "+15555550123", Code: "nope"}), ErrVerificationFailed)
+
+	var _ PhoneVerifier = phone
+}